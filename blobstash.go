@@ -4,7 +4,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/server"
@@ -21,6 +26,11 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
 	flag.BoolVar(&check, "check", false, "Check the blobstore consistency.")
 	flag.BoolVar(&scan, "scan", false, "Trigger a BlobStore rescan.")
 	flag.BoolVar(&s3scan, "s3-scan", false, "Trigger a BlobStore rescan of the S3 backend.")
@@ -59,3 +69,60 @@ func main() {
 		log.Fatalf("failed: %v", err)
 	}
 }
+
+// parseTime parses either a RFC 3339 date or a Unix timestamp (in seconds)
+func parseTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// restore rebuilds the state of the instance at a given time (from the S3 replication) into a fresh data directory
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	until := fs.String("until", "", "Point in time to restore (RFC 3339 date or Unix timestamp).")
+	dataDir := fs.String("data-dir", "", "Empty directory where the instance will be restored.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore -until=<timestamp> -data-dir=<dir> CONFIG_FILE_PATH\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *until == "" || *dataDir == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	t, err := parseTime(*until)
+	if err != nil {
+		log.Fatalf("invalid until time %q: %v", *until, err)
+	}
+	conf, err := config.New(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to load config at \"%v\": %v", fs.Arg(0), err)
+	}
+	if conf.S3Repl == nil {
+		log.Fatalf("the S3 replication must be configured to restore an instance")
+	}
+	if files, err := ioutil.ReadDir(*dataDir); err == nil && len(files) > 0 {
+		log.Fatalf("the data dir %q must be empty", *dataDir)
+	}
+
+	conf.DataDir = *dataDir
+	conf.RestoreUntil = t.UnixNano()
+	// Don't ship the restored blobs to the WAL, and don't notify the webhooks
+	conf.S3Repl.WALShipping = false
+	conf.Webhooks = nil
+
+	s, err := server.New(conf)
+	if err != nil {
+		log.Fatalf("failed to initialize server: %v", err)
+	}
+	if err := s.Bootstrap(); err != nil {
+		log.Fatalf("restore failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		log.Fatalf("failed to close the server: %v", err)
+	}
+	fmt.Printf("Instance restored as of %s in %s.\n", t.UTC().Format(time.RFC3339), *dataDir)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/client/filetree"
+	"a4.io/blobstash/pkg/client/kvstore"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/hashutil"
+	synctable "a4.io/blobstash/pkg/sync"
+)
+
+const ua = "blobstash-cli v1"
+
+const usageText = `Usage: %s [OPTIONS] COMMAND [ARGS]
+
+Commands:
+  blob put FILE|-              Upload a blob, and output its hash
+  blob get HASH                Output the content of a blob
+  kv set KEY VALUE             Set a key (-ref HASH to attach a blob, -version to set an explicit version)
+  kv get KEY                   Output the latest (or the given -version) value of a key
+  kv history KEY               List the versions of a key (-limit N)
+  kv move FROM TO              Move the keys (with their history) from a prefix to another (-dry-run)
+  filetree upload FSNAME DIR   Upload a directory as a snapshot of the given FS (-message MSG, -encrypt, -workers N,
+                               -progress)
+  filetree get REF [FILE]      Download a file (decrypted if needed) to FILE or to stdout
+  e2e init                     Create the keyring holding the client-side encryption key
+  e2e export-recovery          Output the recovery code of the encryption key
+  e2e import-recovery CODE     Re-create the keyring from a recovery code
+  sync REMOTE                  Sync the server with the remote instance (-api-key KEY, -one-way)
+
+The servers are configured as profiles in %s, the BLOBSTASH_API_{HOST|KEY} environment variables
+take precedence over the selected profile.
+
+The client-side encryption key is stored in %s protected by a passphrase (read from the
+BLOBSTASH_PASSPHRASE environment variable, or prompted), the server only sees the encrypted content of the files
+uploaded with -encrypt (but not their names). Keep the recovery code safe, the data cannot be decrypted without it.
+
+Options:
+`
+
+var (
+	profileName string
+	jsonOutput  bool
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, usageText, os.Args[0], profilesPath(), keyringPath())
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.StringVar(&profileName, "profile", "", "Profile to use (defaults to the profile set as default)")
+	flag.BoolVar(&jsonOutput, "json", false, "Output JSON (for scripting)")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	profile, err := loadProfile(profileName)
+	if err != nil {
+		fail(err)
+	}
+
+	options := []func(*http.Request) error{
+		clientutil.WithAPIKey(profile.APIKey),
+		clientutil.WithUserAgent(ua),
+	}
+	if profile.Namespace != "" {
+		options = append(options, clientutil.WithNamespace(profile.Namespace))
+	}
+	c := clientutil.NewClientUtil(profile.Host, options...)
+
+	args := flag.Args()
+	switch {
+	case len(args) >= 2 && args[0] == "blob" && args[1] == "put":
+		err = blobPut(c, args[2:])
+	case len(args) >= 2 && args[0] == "blob" && args[1] == "get":
+		err = blobGet(c, args[2:])
+	case len(args) >= 2 && args[0] == "kv" && args[1] == "set":
+		err = kvSet(c, args[2:])
+	case len(args) >= 2 && args[0] == "kv" && args[1] == "get":
+		err = kvGet(c, args[2:])
+	case len(args) >= 2 && args[0] == "kv" && args[1] == "history":
+		err = kvHistory(c, args[2:])
+	case len(args) >= 2 && args[0] == "kv" && args[1] == "move":
+		err = kvMove(c, args[2:])
+	case len(args) >= 2 && args[0] == "filetree" && args[1] == "upload":
+		err = filetreeUpload(profile, args[2:])
+	case len(args) >= 2 && args[0] == "filetree" && args[1] == "get":
+		err = filetreeGet(c, args[2:])
+	case len(args) >= 2 && args[0] == "e2e" && args[1] == "init":
+		err = e2eInit(args[2:])
+	case len(args) >= 2 && args[0] == "e2e" && args[1] == "export-recovery":
+		err = e2eExportRecovery(args[2:])
+	case len(args) >= 2 && args[0] == "e2e" && args[1] == "import-recovery":
+		err = e2eImportRecovery(args[2:])
+	case args[0] == "sync":
+		err = sync(c, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"error": err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+// output outputs either the JSON encoded data or the text output
+func output(data interface{}, text string) error {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	}
+	_, err := fmt.Fprint(os.Stdout, text)
+	return err
+}
+
+// parseArgs parses the subcommand flags, and checks the number of positional args
+func parseArgs(fs *flag.FlagSet, args []string, nargs int, usage string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func blobPut(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("blob put", flag.ExitOnError)
+	if err := parseArgs(fs, args, 1, "blob put FILE|-"); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	hash := hashutil.Compute(data)
+	if err := blobstore.New(c).Put(context.Background(), hash, data); err != nil {
+		return err
+	}
+	return output(map[string]interface{}{"hash": hash, "size": len(data)}, hash+"\n")
+}
+
+func blobGet(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("blob get", flag.ExitOnError)
+	if err := parseArgs(fs, args, 1, "blob get HASH"); err != nil {
+		return err
+	}
+
+	data, err := blobstore.New(c).Get(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return output(map[string]interface{}{"hash": fs.Arg(0), "size": len(data), "data": data}, "")
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func kvSet(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("kv set", flag.ExitOnError)
+	ref := fs.String("ref", "", "Hash of the blob attached to the version")
+	version := fs.Int("version", -1, "Explicit version (defaults to the current time)")
+	if err := parseArgs(fs, args, 2, "kv set [-ref HASH] [-version VERSION] KEY VALUE"); err != nil {
+		return err
+	}
+
+	kv, err := kvstore.New(c).Put(context.Background(), fs.Arg(0), *ref, []byte(fs.Arg(1)), *version)
+	if err != nil {
+		return err
+	}
+	return output(kv, fmt.Sprintf("%s@%d\n", kv.Key, kv.Version))
+}
+
+func kvGet(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("kv get", flag.ExitOnError)
+	version := fs.Int("version", -1, "Version to fetch (defaults to the latest)")
+	if err := parseArgs(fs, args, 1, "kv get [-version VERSION] KEY"); err != nil {
+		return err
+	}
+
+	kv, err := kvstore.New(c).Get(context.Background(), fs.Arg(0), *version)
+	if err != nil {
+		return err
+	}
+	text := string(kv.Data)
+	if kv.Hash != "" {
+		text = fmt.Sprintf("%s (ref=%s)", text, kv.Hash)
+	}
+	return output(kv, text+"\n")
+}
+
+func kvHistory(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("kv history", flag.ExitOnError)
+	limit := fs.Int("limit", 50, "Maximum number of versions")
+	if err := parseArgs(fs, args, 1, "kv history [-limit N] KEY"); err != nil {
+		return err
+	}
+
+	kvv, err := kvstore.New(c).Versions(context.Background(), fs.Arg(0), 0, 0, *limit)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return output(kvv, "")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tREF\tDATA")
+	for _, kv := range kvv.Versions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", kv.Version, kv.Hash, kv.Data)
+	}
+	return tw.Flush()
+}
+
+func kvMove(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("kv move", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only list the keys that would be moved")
+	if err := parseArgs(fs, args, 2, "kv move [-dry-run] FROM TO"); err != nil {
+		return err
+	}
+
+	resp, err := c.Post("/api/kvstore/_move", nil, clientutil.WithQueryArgs(map[string]string{
+		"from":    fs.Arg(0),
+		"to":      fs.Arg(1),
+		"dry_run": strconv.FormatBool(*dryRun),
+	}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	res := &struct {
+		DryRun bool `json:"dry_run"`
+		Data   []struct {
+			From     string `json:"from"`
+			To       string `json:"to"`
+			Versions int    `json:"versions"`
+		} `json:"data"`
+	}{}
+	if err := clientutil.Unmarshal(resp, res); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return output(res, "")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FROM\tTO\tVERSIONS")
+	for _, move := range res.Data {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", move.From, move.To, move.Versions)
+	}
+	return tw.Flush()
+}
+
+func filetreeUpload(profile *Profile, args []string) error {
+	fs := flag.NewFlagSet("filetree upload", flag.ExitOnError)
+	message := fs.String("message", "", "Optional snapshot message")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the files content with the keyring key")
+	workers := fs.Int("workers", 5, "Number of files uploaded concurrently")
+	progress := fs.Bool("progress", false, "Report the upload progress on stderr")
+	if err := parseArgs(fs, args, 2, "filetree upload [-message MSG] [-encrypt] [-workers N] [-progress] FSNAME DIR"); err != nil {
+		return err
+	}
+	fsName := fs.Arg(0)
+	dirPath := fs.Arg(1)
+
+	finfo, err := os.Stat(dirPath)
+	if err != nil {
+		return err
+	}
+	if !finfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	// Like the uploader, work within a namespace dedicated to the upload
+	c := clientutil.NewClientUtil(profile.Host,
+		clientutil.WithAPIKey(profile.APIKey),
+		clientutil.WithUserAgent(ua),
+		clientutil.WithNamespace(fsName))
+	ft := filetree.New(c)
+
+	up := writer.NewUploader(blobstore.New(c))
+	if *encrypt {
+		key, err := unlockKeyring()
+		if err != nil {
+			return err
+		}
+		up.SetEncryptionKey(key)
+	}
+	up.SetWorkers(*workers)
+	if *progress {
+		up.SetProgress(func(p *writer.Progress) {
+			fmt.Fprintf(os.Stderr, "%d/%d files, %d/%d bytes (%d bytes uploaded)\n", p.FilesDone, p.FilesTotal, p.BytesDone, p.BytesTotal, p.BytesUploaded)
+		})
+	}
+
+	m, err := up.PutDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to upload: %v", err)
+	}
+
+	rev, err := ft.MakeSnapshot(m.Hash, fsName, *message, ua)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+
+	// The GC step will actually save the tree in the root namespace
+	if err := ft.GC(fsName, fsName, rev); err != nil {
+		return fmt.Errorf("failed to perform GC: %v", err)
+	}
+
+	return output(map[string]interface{}{
+		"fs":       fsName,
+		"ref":      m.Hash,
+		"revision": rev,
+	}, fmt.Sprintf("root=%s\nrev=%d\n", m.Hash, rev))
+}
+
+func filetreeGet(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("filetree get", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 && fs.NArg() != 2 {
+		return fmt.Errorf("usage: filetree get REF [FILE]")
+	}
+	ctx := context.Background()
+	bs := blobstore.New(c)
+
+	data, err := bs.Get(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	meta, err := rnode.NewNodeFromBlob(fs.Arg(0), data)
+	if err != nil {
+		return err
+	}
+	if !meta.IsFile() {
+		return fmt.Errorf("%s is not a file", fs.Arg(0))
+	}
+
+	var key *[32]byte
+	if len(meta.EncryptedKey) > 0 {
+		key, err = unlockKeyring()
+		if err != nil {
+			return err
+		}
+	}
+	f, err := filereader.NewDecryptedFile(ctx, bs, meta, key, nil)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out := os.Stdout
+	if fs.NArg() == 2 {
+		out, err = os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return err
+	}
+	if fs.NArg() == 2 {
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return output(map[string]interface{}{"ref": meta.Hash, "name": meta.Name, "size": meta.Size}, "")
+	}
+	return nil
+}
+
+func sync(c *clientutil.ClientUtil, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	apiKey := fs.String("api-key", "", "API key of the remote instance")
+	oneWay := fs.Bool("one-way", false, "Only download the blobs from the remote")
+	if err := parseArgs(fs, args, 1, "sync [-api-key KEY] [-one-way] REMOTE"); err != nil {
+		return err
+	}
+
+	// The server performs the sync
+	resp, err := c.PostJSON("/api/sync/_trigger", map[string]interface{}{
+		"url":     fs.Arg(0),
+		"api_key": *apiKey,
+		"one_way": *oneWay,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	stats := &synctable.SyncStats{}
+	if err := clientutil.Unmarshal(resp, stats); err != nil {
+		return err
+	}
+
+	text := fmt.Sprintf("downloaded %d blobs (%d bytes), uploaded %d blobs (%d bytes) in %s\n",
+		stats.Downloaded, stats.DownloadedSize, stats.Uploaded, stats.UploadedSize, stats.Duration)
+	if stats.AlreadySynced {
+		text = "already in sync\n"
+	}
+	return output(stats, text)
+}
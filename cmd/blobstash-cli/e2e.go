@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"a4.io/blobstash/pkg/crypto"
+)
+
+func keyringPath() string {
+	if p := os.Getenv("BLOBSTASH_KEYRING"); p != "" {
+		return p
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "blobstash", "keyring.json")
+}
+
+// readPassphrase returns the passphrase from the `BLOBSTASH_PASSPHRASE` environment variable, or prompts for it
+func readPassphrase(prompt string) ([]byte, error) {
+	if p := os.Getenv("BLOBSTASH_PASSPHRASE"); p != "" {
+		return []byte(p), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return []byte(line), nil
+}
+
+// unlockKeyring returns the master key of the client-side encryption
+func unlockKeyring() (*[32]byte, error) {
+	kr, err := crypto.LoadKeyring(keyringPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no keyring, run `e2e init` first")
+		}
+		return nil, err
+	}
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	key, err := kr.Unlock(passphrase)
+	if err == crypto.ErrDecryption {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	return key, err
+}
+
+// saveKeyring protects the master key with a passphrase and saves it
+func saveKeyring(key *[32]byte) error {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	kr, err := crypto.NewKeyring(key, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := kr.Save(keyringPath()); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists", keyringPath())
+		}
+		return err
+	}
+	return output(map[string]interface{}{"keyring": keyringPath()}, fmt.Sprintf("keyring saved to %s\n", keyringPath()))
+}
+
+func e2eInit(args []string) error {
+	fs := flag.NewFlagSet("e2e init", flag.ExitOnError)
+	if err := parseArgs(fs, args, 0, "e2e init"); err != nil {
+		return err
+	}
+	key, err := crypto.NewKey()
+	if err != nil {
+		return err
+	}
+	return saveKeyring(key)
+}
+
+func e2eExportRecovery(args []string) error {
+	fs := flag.NewFlagSet("e2e export-recovery", flag.ExitOnError)
+	if err := parseArgs(fs, args, 0, "e2e export-recovery"); err != nil {
+		return err
+	}
+	key, err := unlockKeyring()
+	if err != nil {
+		return err
+	}
+	code := crypto.RecoveryCode(key)
+	return output(map[string]interface{}{"recovery_code": code}, code+"\n")
+}
+
+func e2eImportRecovery(args []string) error {
+	fs := flag.NewFlagSet("e2e import-recovery", flag.ExitOnError)
+	if err := parseArgs(fs, args, 1, "e2e import-recovery CODE"); err != nil {
+		return err
+	}
+	key, err := crypto.ParseRecoveryCode(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return saveKeyring(key)
+}
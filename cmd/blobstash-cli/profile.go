@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Profile holds the configuration for a BlobStash server
+type Profile struct {
+	Host      string `yaml:"host"`
+	APIKey    string `yaml:"api_key"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Profiles holds the content of the profiles file, e.g.:
+//
+//	default: home
+//	profiles:
+//	  home:
+//	    host: https://blobstash.home.lan
+//	    api_key: secret
+//	  local:
+//	    host: http://localhost:8051
+type Profiles struct {
+	Default  string              `yaml:"default"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+func profilesPath() string {
+	if p := os.Getenv("BLOBSTASH_PROFILES"); p != "" {
+		return p
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "blobstash", "profiles.yaml")
+}
+
+// loadProfile returns the profile with the given name (or the default one), the `BLOBSTASH_API_{HOST|KEY}`
+// environment variables take precedence over the profiles file.
+func loadProfile(name string) (*Profile, error) {
+	profile := &Profile{}
+
+	data, err := ioutil.ReadFile(profilesPath())
+	switch {
+	case err == nil:
+		profiles := &Profiles{}
+		if err := yaml.Unmarshal(data, profiles); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", profilesPath(), err)
+		}
+		if name == "" {
+			name = profiles.Default
+		}
+		if name != "" {
+			p, ok := profiles.Profiles[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown profile %q", name)
+			}
+			profile = p
+		}
+	case os.IsNotExist(err):
+		if name != "" {
+			return nil, fmt.Errorf("unknown profile %q, %s does not exist", name, profilesPath())
+		}
+	default:
+		return nil, err
+	}
+
+	if host := os.Getenv("BLOBSTASH_API_HOST"); host != "" {
+		profile.Host = host
+	}
+	if apiKey := os.Getenv("BLOBSTASH_API_KEY"); apiKey != "" {
+		profile.APIKey = apiKey
+	}
+	if profile.Host == "" {
+		return nil, fmt.Errorf("no server configured, please set BLOBSTASH_API_{HOST|KEY} or create %s", profilesPath())
+	}
+	return profile, nil
+}
@@ -27,6 +27,9 @@ function premark_filetree_node (ref)
   else
     if cnode.r then
       for _, contentRef in ipairs(cnode.r) do
+        if contentRef[3] then
+          premark(contentRef[3])
+        end
         premark(contentRef[2])
       end
     end
@@ -61,6 +64,9 @@ function mark_filetree_node (ref)
   else
     if cnode.r then
       for _, contentRef in ipairs(cnode.r) do
+        if contentRef[3] then
+          mark(contentRef[3])
+        end
         mark(contentRef[2])
       end
     end
@@ -0,0 +1,374 @@
+/*
+
+Package admin implements the admin dashboard, a single HTML page built on top of the existing APIs (status, blobstore
+stats, audit log, stash, sync, GC and scrub jobs).
+
+The page is only served to admin API keys, and the actions it triggers (GC, scrub and sync) are gated by the admin
+permissions of the underlying APIs.
+
+*/
+package admin // import "a4.io/blobstash/pkg/admin"
+
+import (
+	"net/http"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/perms"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+)
+
+// dashboardPage is the dashboard, the browser authenticates via basic auth and the credentials are re-used by the API
+// calls
+const dashboardPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>BlobStash Admin</title>
+<style>
+body { font-family: sans-serif; max-width: 1100px; margin: 0 auto; padding: 1em; color: #222; }
+header { display: flex; align-items: center; justify-content: space-between; }
+section { border: 1px solid #eee; border-radius: 4px; padding: .5em 1em; margin-top: 1em; }
+h2 { font-size: 1.1em; }
+table { width: 100%; border-collapse: collapse; }
+td, th { padding: .3em; border-bottom: 1px solid #eee; text-align: left; font-size: .9em; }
+dl { display: grid; grid-template-columns: max-content auto; gap: .2em 1em; }
+dt { color: #555; }
+dd { margin: 0; }
+form { display: flex; flex-wrap: wrap; gap: .5em; align-items: center; }
+#status { min-height: 1.5em; color: #555; }
+#status.error { color: #b00; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<header>
+<h1>BlobStash Admin</h1>
+<button id="refresh">Refresh</button>
+</header>
+<p id="status"></p>
+
+<section>
+<h2>Storage</h2>
+<dl id="storage"></dl>
+</section>
+
+<section>
+<h2>Namespaces</h2>
+<table>
+<thead><tr><th>Name</th><th></th></tr></thead>
+<tbody id="namespaces"></tbody>
+</table>
+</section>
+
+<section>
+<h2>Background jobs</h2>
+<form id="scrub-form"><button type="submit">Start a scrub</button></form>
+<table>
+<thead><tr><th>ID</th><th>Status</th><th>Progress</th><th>Started</th><th>Finished</th></tr></thead>
+<tbody id="jobs"></tbody>
+</table>
+</section>
+
+<section>
+<h2>Last GC</h2>
+<dl id="gc"></dl>
+</section>
+
+<section>
+<h2>Sync</h2>
+<dl id="sync"></dl>
+<form id="sync-form">
+<input name="url" placeholder="Remote URL" required>
+<input name="api_key" type="password" placeholder="Remote API key">
+<label><input name="one_way" type="checkbox"> One way</label>
+<button type="submit">Sync now</button>
+</form>
+</section>
+
+<section>
+<h2>Recent activity</h2>
+<table>
+<thead><tr><th>Time</th><th>Method</th><th>Path</th><th>Status</th><th>Auth</th></tr></thead>
+<tbody id="activity"></tbody>
+</table>
+</section>
+
+<script>
+(function() {
+  "use strict";
+  var $ = function(id) { return document.getElementById(id); };
+
+  function status(msg, isError) {
+    $("status").textContent = msg || "";
+    $("status").className = isError ? "error" : "";
+  }
+
+  function request(method, url, body) {
+    var opts = {method: method, credentials: "same-origin", headers: {"Accept": "application/json", "BlobStash-CSRF": "1"}};
+    if (body !== undefined) {
+      opts.headers["Content-Type"] = "application/json";
+      opts.body = JSON.stringify(body);
+    }
+    return fetch(url, opts).then(function(resp) {
+      if (!resp.ok) {
+        return resp.text().then(function(body) {
+          var msg = resp.status + " " + resp.statusText;
+          try { msg = JSON.parse(body).error || msg; } catch (e) {}
+          var err = new Error(url + ": " + msg);
+          err.status = resp.status;
+          throw err;
+        });
+      }
+      if (resp.status === 204) {
+        return null;
+      }
+      return resp.json();
+    });
+  }
+
+  function date(ts) {
+    if (!ts) {
+      return "";
+    }
+    if (typeof ts === "number") {
+      ts = ts * 1000;
+    }
+    return new Date(ts).toLocaleString();
+  }
+
+  function row(tbody, values) {
+    var tr = document.createElement("tr");
+    values.forEach(function(value) {
+      var td = document.createElement("td");
+      if (value instanceof Node) {
+        td.appendChild(value);
+      } else {
+        td.textContent = value === undefined || value === null ? "" : String(value);
+      }
+      tr.appendChild(td);
+    });
+    tbody.appendChild(tr);
+  }
+
+  function fill(dl, pairs) {
+    dl.textContent = "";
+    pairs.forEach(function(pair) {
+      var dt = document.createElement("dt");
+      dt.textContent = pair[0];
+      var dd = document.createElement("dd");
+      dd.textContent = pair[1] === undefined || pair[1] === null ? "" : String(pair[1]);
+      dl.appendChild(dt);
+      dl.appendChild(dd);
+    });
+  }
+
+  // Each panel is loaded independently, so a missing permission (or a disabled app) only breaks its own panel
+  function panel(id, promise) {
+    return promise.catch(function(err) {
+      var el = $(id);
+      el.textContent = "";
+      var p = document.createElement(el.tagName === "TBODY" ? "tr" : "div");
+      p.className = "error";
+      p.textContent = err.message;
+      el.appendChild(p);
+    });
+  }
+
+  function loadStorage() {
+    return panel("storage", Promise.all([
+      request("GET", "/api/status"),
+      request("GET", "/api/blobstore/stats").catch(function() { return null; })
+    ]).then(function(res) {
+      var st = res[0], stats = res[1];
+      var pairs = [
+        ["Started at", date(st.started_at)],
+        ["Blobs", st.blobstore.blobs_count],
+        ["Size", st.blobstore.blobs_size_human],
+        ["BlobsFile volumes", st.blobstore.blobs_blobsfile_volumes],
+        ["Pending writes", st.blobstore.pending_writes]
+      ];
+      if (stats && stats.dedup) {
+        pairs.push(["Deduplication ratio", stats.dedup.ratio.toFixed(2)]);
+        pairs.push(["Deduplicated writes", stats.dedup.deduplicated + " / " + stats.dedup.puts]);
+      }
+      (st.backends || []).forEach(function(b) {
+        pairs.push(["Backend " + (b.name || ""), b.healthy === false ? "unhealthy" : "healthy"]);
+      });
+      if (st.s3) {
+        pairs.push(["S3 replication", JSON.stringify(st.s3)]);
+      }
+      if (st.load_shedding) {
+        pairs.push(["Load shedding", JSON.stringify(st.load_shedding)]);
+      }
+      fill($("storage"), pairs);
+    }));
+  }
+
+  function loadNamespaces() {
+    return panel("namespaces", request("GET", "/api/stash/").then(function(resp) {
+      var tbody = $("namespaces");
+      tbody.textContent = "";
+      (resp.data || []).forEach(function(name) {
+        var btn = document.createElement("button");
+        btn.textContent = "GC";
+        btn.onclick = function() { gc(name); };
+        row(tbody, [name, btn]);
+      });
+    }));
+  }
+
+  function loadJobs() {
+    return panel("jobs", request("GET", "/api/blobstore/verify").then(function(resp) {
+      var tbody = $("jobs");
+      tbody.textContent = "";
+      (resp.data || []).forEach(function(job) {
+        var progress = job.checked + " / " + job.total + " blobs";
+        if ((job.corrupted || []).length) {
+          progress += ", " + job.corrupted.length + " corrupted";
+        }
+        if ((job.missing || []).length) {
+          progress += ", " + job.missing.length + " missing";
+        }
+        row(tbody, [job.id, job.error ? job.state + ": " + job.error : job.state, progress, date(job.started_at), date(job.finished_at)]);
+      });
+    }));
+  }
+
+  function loadGC() {
+    return panel("gc", request("GET", "/api/stash/_gc/last").catch(function(err) {
+      // 404 until the first GC
+      if (err.status === 404) {
+        return null;
+      }
+      throw err;
+    }).then(function(report) {
+      if (!report || !report.namespace) {
+        return fill($("gc"), [["", "No GC has been performed yet."]]);
+      }
+      fill($("gc"), [
+        ["Namespace", report.namespace],
+        ["Status", report.status],
+        ["Marked at", date(report.marked_at)],
+        ["Swept at", date(report.swept_at)],
+        ["Marked blobs", report.marked],
+        ["Saved blobs", report.saved],
+        ["Swept blobs", (report.sweep || []).length]
+      ]);
+    }));
+  }
+
+  function loadSync() {
+    return panel("sync", request("GET", "/api/sync/_status").then(function(resp) {
+      var last = resp.data;
+      if (!last) {
+        return fill($("sync"), [["", "No sync since the start."]]);
+      }
+      fill($("sync"), [
+        ["Remote", last.url],
+        ["Started at", date(last.started_at)],
+        ["Finished at", date(last.finished_at)],
+        ["Result", last.error ? "failed: " + last.error : "ok"],
+        ["Stats", last.stats ? JSON.stringify(last.stats) : ""]
+      ]);
+    }));
+  }
+
+  function loadActivity() {
+    return panel("activity", request("GET", "/api/audit?limit=20").then(function(resp) {
+      var tbody = $("activity");
+      tbody.textContent = "";
+      (resp.data || []).forEach(function(e) {
+        row(tbody, [date(e.time), e.method, e.path, e.status, e.auth_id]);
+      });
+    }));
+  }
+
+  function refresh() {
+    status("Loading...");
+    Promise.all([loadStorage(), loadNamespaces(), loadJobs(), loadGC(), loadSync(), loadActivity()]).then(function() {
+      status("Updated at " + new Date().toLocaleTimeString() + ".");
+    });
+  }
+
+  function gc(name) {
+    var script = prompt("GC script for " + name + " (the blobs marked by the script are kept)", "");
+    if (script === null) {
+      return;
+    }
+    var dryRun = confirm("Perform a dry run first? (Cancel to run the GC)");
+    status("Running the GC of " + name + "...");
+    request("POST", "/api/stash/" + encodeURIComponent(name) + "/_gc", {script: script, dry_run: dryRun}).then(function() {
+      status("GC of " + name + " done.");
+      refresh();
+    }).catch(function(err) { status(err.message, true); });
+  }
+
+  $("scrub-form").onsubmit = function(e) {
+    e.preventDefault();
+    request("POST", "/api/blobstore/verify").then(function() {
+      status("Scrub started.");
+      loadJobs();
+    }).catch(function(err) { status(err.message, true); });
+  };
+
+  $("sync-form").onsubmit = function(e) {
+    e.preventDefault();
+    var form = e.target;
+    var params = {url: form.url.value, api_key: form.api_key.value, one_way: form.one_way.checked};
+    status("Syncing with " + form.url.value + "...");
+    request("POST", "/api/sync/_trigger", params).then(function() {
+      status("Sync done.");
+      loadSync();
+    }).catch(function(err) { status(err.message, true); loadSync(); });
+  };
+
+  $("refresh").onclick = refresh;
+  refresh();
+})();
+</script>
+</body>
+</html>
+`
+
+// Admin serves the admin dashboard
+type Admin struct {
+	log log.Logger
+}
+
+// New initializes the admin dashboard
+func New(logger log.Logger) *Admin {
+	return &Admin{log: logger}
+}
+
+func (a *Admin) dashboardHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Dashboard),
+			perms.Resource(perms.Server, perms.Dashboard),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Frame-Options", "DENY")
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write([]byte(dashboardPage))
+	}
+}
+
+// Register registers the dashboard at the given path
+func (a *Admin) Register(r *mux.Router, path string, basicAuth func(http.Handler) http.Handler) {
+	r.Handle(path, basicAuth(http.HandlerFunc(a.dashboardHandler())))
+}
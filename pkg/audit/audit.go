@@ -0,0 +1,243 @@
+/*
+
+Package audit implements a structured audit log of all the mutating API calls.
+
+Each entry is stored as a version of the `_audit:log` key (the version being the entry timestamp), so the entries are
+persisted as msgpack-encoded meta blobs like any other kvstore entry, and are restored by a rescan.
+
+*/
+package audit // import "a4.io/blobstash/pkg/audit"
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// LogKey is the kvstore key holding the audit entries
+const LogKey = "_audit:log"
+
+type key int
+
+const entryKey key = 0
+
+// Entry holds a single mutating API call
+type Entry struct {
+	Time     int64    `json:"time" msgpack:"t"`
+	Method   string   `json:"method" msgpack:"m"`
+	Path     string   `json:"path" msgpack:"p"`
+	Status   int      `json:"status" msgpack:"s"`
+	AuthID   string   `json:"auth_id,omitempty" msgpack:"a,omitempty"`
+	RemoteIP string   `json:"remote_ip" msgpack:"ip"`
+	Refs     []string `json:"refs,omitempty" msgpack:"r,omitempty"`
+
+	mu sync.Mutex
+}
+
+// AddRefs attaches the affected refs (blob hashes, keys...) to the audit entry of the current request
+func AddRefs(ctx context.Context, refs ...string) {
+	e, ok := ctx.Value(entryKey).(*Entry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Refs = append(e.Refs, refs...)
+}
+
+// Audit records and serves the audit log
+type Audit struct {
+	kvStore store.KvStore
+
+	mu   sync.Mutex
+	last int64
+
+	log log.Logger
+}
+
+// New initializes the audit log
+func New(logger log.Logger, kvStore store.KvStore) *Audit {
+	logger.Debug("init")
+	return &Audit{
+		kvStore: kvStore,
+		log:     logger,
+	}
+}
+
+// Record persists the entry
+func (a *Audit) Record(e *Entry) error {
+	// Entries are versions of the same key, ensure they cannot collide
+	a.mu.Lock()
+	if e.Time <= a.last {
+		e.Time = a.last + 1
+	}
+	a.last = e.Time
+	a.mu.Unlock()
+
+	encoded, err := msgpack.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.kvStore.Put(context.Background(), LogKey, "", encoded, e.Time)
+	return err
+}
+
+// Entries returns the entries more recent than `since`, starting from the most recent one (or from `cursor`).
+func (a *Audit) Entries(since int64, cursor string, limit int) ([]*Entry, string, error) {
+	entries := []*Entry{}
+	if cursor == "" {
+		cursor = "0"
+	}
+	kvv, nextCursor, err := a.kvStore.Versions(context.Background(), LogKey, cursor, limit)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return entries, "", nil
+	default:
+		return nil, "", err
+	}
+
+	for _, kv := range kvv.Versions {
+		if kv.Version < since {
+			return entries, "", nil
+		}
+		e := &Entry{}
+		if err := msgpack.Unmarshal(kv.Data, e); err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nextCursor, nil
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements `http.Flusher` (for the streamed responses)
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements `http.Hijacker`
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Middleware records all the mutating requests
+func (a *Audit) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST", "PUT", "PATCH", "DELETE":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := &Entry{
+			Time:     time.Now().UTC().UnixNano(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			RemoteIP: httputil.GetIpAddress(r),
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		// Deferred so the requests that panic are recorded too
+		defer func() {
+			rec := recover()
+			e.Status = sw.status
+			if rec != nil {
+				e.Status = http.StatusInternalServerError
+			}
+			// Set by `auth.Can` (the API key ID, never the secret)
+			e.AuthID = w.Header().Get("BlobStash-Auth-ID")
+			if err := a.Record(e); err != nil {
+				a.log.Error("failed to record audit entry", "err", err)
+			}
+			if rec != nil {
+				panic(rec)
+			}
+		}()
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), entryKey, e)))
+	})
+}
+
+func (a *Audit) auditHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.AuditEntry),
+			perms.Resource(perms.Audit, perms.AuditEntry),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		since, err := q.GetInt64Default("since", 0)
+		if err != nil {
+			panic(err)
+		}
+		limit, err := q.GetIntDefault("limit", 50)
+		if err != nil {
+			panic(err)
+		}
+
+		entries, cursor, err := a.Entries(since, q.Get("cursor"), limit)
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": entries,
+			"pagination": map[string]interface{}{
+				"cursor":   cursor,
+				"has_more": cursor != "" && len(entries) == limit,
+				"count":    len(entries),
+				"per_page": limit,
+			},
+		})
+	}
+}
+
+// Register registers the HTTP handlers
+func (a *Audit) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("", basicAuth(http.HandlerFunc(a.auditHandler())))
+}
+
+// FormatRef formats a versioned key as an audit ref
+func FormatRef(key string, version int64) string {
+	return key + "@" + strconv.FormatInt(version, 10)
+}
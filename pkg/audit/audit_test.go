@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	env := testutil.New(t, "audit_test")
+	defer env.Close()
+	logger, kvs := env.Log, env.KvStore
+
+	a := New(logger, kvs)
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The streamed responses must still be flushable
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("the response writer should implement http.Flusher")
+		}
+		AddRefs(r.Context(), "ref1", "ref2")
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	for _, method := range []string{"GET", "POST", "HEAD", "DELETE"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/api/test", nil))
+	}
+
+	entries, _, err := a.Entries(0, "", 50)
+	check(err)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries (the mutating requests only), got %d", len(entries))
+	}
+	// Entries are returned from the most recent one
+	if entries[0].Method != "DELETE" || entries[1].Method != "POST" {
+		t.Errorf("unexpected entries order: %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Status != http.StatusCreated || len(e.Refs) != 2 || e.Path != "/api/test" {
+			t.Errorf("bad entry %+v", e)
+		}
+	}
+
+	entries, _, err = a.Entries(entries[0].Time, "", 50)
+	check(err)
+	if len(entries) != 1 || entries[0].Method != "DELETE" {
+		t.Errorf("since should filter out older entries, got %+v", entries)
+	}
+
+	// The requests that panic are recorded too
+	panicking := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("the panic should be propagated")
+			}
+		}()
+		panicking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/api/panic", nil))
+	}()
+	entries, _, err = a.Entries(0, "", 1)
+	check(err)
+	if len(entries) != 1 || entries[0].Path != "/api/panic" || entries[0].Status != http.StatusInternalServerError {
+		t.Errorf("the panicking request should be recorded, got %+v", entries)
+	}
+}
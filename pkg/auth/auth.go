@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
@@ -22,6 +23,12 @@ const authKey key = 0
 var auths = []*Auth{}
 var logger log.Logger
 
+// mu protects `auths` (replaced when the config is reloaded)
+var mu sync.RWMutex
+
+// checkers are the additional auth methods (like the OIDC sessions), tried when the basic auth fails
+var checkers = []func(*http.Request) *Auth{}
+
 type Auth struct {
 	ID       string
 	roles    rbac.Roles
@@ -36,13 +43,40 @@ func Setup(conf *config.Config, l log.Logger) error {
 		return err
 	}
 	logger = l
+	newAuths, err := authsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	auths = newAuths
+	return nil
+}
+
+// Reload replaces the roles and the API keys with the ones from the new config
+func Reload(conf *config.Config) error {
+	if err := perms.Reload(conf); err != nil {
+		return err
+	}
+	newAuths, err := authsFromConfig(conf)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	auths = newAuths
+	return nil
+}
+
+func authsFromConfig(conf *config.Config) ([]*Auth, error) {
+	out := []*Auth{}
 	for _, c := range conf.Auth {
 		roles, err := perms.GetRoles(c.Roles)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		encoded := "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
-		auths = append(auths, &Auth{
+		out = append(out, &Auth{
 			ID:       c.ID,
 			roles:    roles,
 			sroles:   c.Roles,
@@ -51,18 +85,46 @@ func Setup(conf *config.Config, l log.Logger) error {
 			encoded:  []byte(encoded),
 		})
 	}
-	return nil
+	return out, nil
+}
+
+// NewAuth returns an auth for the given roles (for the auth methods other than the basic auth)
+func NewAuth(id string, roles []string) (*Auth, error) {
+	rroles, err := perms.GetRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{
+		ID:     id,
+		roles:  rroles,
+		sroles: roles,
+	}, nil
+}
+
+// RegisterChecker registers an additional auth method
+func RegisterChecker(checker func(*http.Request) *Auth) {
+	checkers = append(checkers, checker)
 }
 
 func Check(req *http.Request) bool {
 	h := req.Header.Get("Authorization")
-	for _, auth := range auths {
+	mu.RLock()
+	current := auths
+	mu.RUnlock()
+	for _, auth := range current {
 		if subtle.ConstantTimeCompare([]byte(h), auth.encoded) == 1 {
 			logger.Debug("successful auth", "auth", auth.ID, "roles", auth.sroles)
 			gcontext.Set(req, authKey, auth)
 			return true
 		}
 	}
+	for _, checker := range checkers {
+		if auth := checker(req); auth != nil {
+			logger.Debug("successful auth", "auth", auth.ID, "roles", auth.sroles)
+			gcontext.Set(req, authKey, auth)
+			return true
+		}
+	}
 	return false
 }
 
@@ -73,10 +135,7 @@ func Can(w http.ResponseWriter, r *http.Request, action, resource string) bool {
 		return true
 	}
 	a := auth.(*Auth)
-	can, err := a.roles.Can(action, resource)
-	if err != nil {
-		panic(err)
-	}
+	can := a.Can(action, resource)
 	w.Header().Set("BlobStash-Auth-ID", a.ID)
 	w.Header().Add("BlobStash-RBAC-Action", action)
 	w.Header().Add("BlobStash-RBAC-Resource", resource)
@@ -85,6 +144,31 @@ func Can(w http.ResponseWriter, r *http.Request, action, resource string) bool {
 	return can
 }
 
+// Can returns true if the roles of the auth allow the action on the resource
+func (a *Auth) Can(action, resource string) bool {
+	can, err := a.roles.Can(action, resource)
+	if err != nil {
+		panic(err)
+	}
+	return can
+}
+
+// FromRequest returns the auth set by a successful Check on the request
+func FromRequest(r *http.Request) (*Auth, bool) {
+	if auth, ok := gcontext.GetOk(r, authKey); ok {
+		return auth.(*Auth), true
+	}
+	return nil, false
+}
+
+// ID returns the ID of the auth used by the request (an empty string if the request is not authenticated)
+func ID(r *http.Request) string {
+	if auth, ok := gcontext.GetOk(r, authKey); ok {
+		return auth.(*Auth).ID
+	}
+	return ""
+}
+
 func Forbidden(w http.ResponseWriter) {
 	httputil.WriteJSONError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
 }
@@ -0,0 +1,128 @@
+/*
+
+Package mtls implements the TLS client certificate auth.
+
+The client certificates are verified against the configured CA during the TLS handshake, then the subject of the
+certificate is mapped to roles (see the `client_certs` config item), so the certificate is accepted by every endpoint
+protected by the basic auth.
+
+*/
+package mtls // import "a4.io/blobstash/pkg/auth/mtls"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/acme"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+)
+
+// MTLS holds the client certificates config
+type MTLS struct {
+	conf *config.ClientCerts
+	pool *x509.CertPool
+	log  log.Logger
+}
+
+// New loads the CA, and registers the client certificates as an auth method
+func New(logger log.Logger, conf *config.Config) (*MTLS, error) {
+	logger.Debug("init")
+	if !conf.TLSEnabled() {
+		return nil, fmt.Errorf("the client certificates auth requires TLS")
+	}
+	pem, err := ioutil.ReadFile(conf.ClientCerts.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", conf.ClientCerts.CA)
+	}
+	// Check the roles early
+	for subject, roles := range conf.ClientCerts.Subjects {
+		if _, err := auth.NewAuth("", roles); err != nil {
+			return nil, fmt.Errorf("invalid roles for subject %q: %v", subject, err)
+		}
+	}
+	m := &MTLS{
+		conf: conf.ClientCerts,
+		pool: pool,
+		log:  logger,
+	}
+	auth.RegisterChecker(m.check)
+	return m, nil
+}
+
+// TLSConfig configures the client certificates verification of the HTTPS listener
+func (m *MTLS) TLSConfig(c *tls.Config) *tls.Config {
+	c.ClientCAs = m.pool
+	if !m.conf.Required {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		return c
+	}
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// The ACME TLS-ALPN challenge (`tls_auto`) is validated by the CA without a client certificate
+	acmeConfig := c.Clone()
+	acmeConfig.ClientAuth = tls.NoClientCert
+	acmeConfig.NextProtos = []string{acme.ALPNProto}
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isACMEChallenge(hello.SupportedProtos) {
+			return acmeConfig, nil
+		}
+		return nil, nil
+	}
+	return c
+}
+
+// isACMEChallenge returns true for the ACME TLS-ALPN challenge handshakes (see `autocert.Manager.GetCertificate`)
+func isACMEChallenge(protos []string) bool {
+	return len(protos) == 1 && protos[0] == acme.ALPNProto
+}
+
+// Middleware rejects the HTTP requests sent over the ACME challenge connections (they skip the client certificates
+// verification, and are only meant for the TLS handshake)
+func (m *MTLS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.TLS.NegotiatedProtocol == acme.ALPNProto {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Roles returns the roles mapped to the certificate subject, either the full subject (e.g. "CN=backup,O=Example") or
+// just its common name
+func (m *MTLS) Roles(cert *x509.Certificate) ([]string, bool) {
+	if roles, ok := m.conf.Subjects[cert.Subject.String()]; ok {
+		return roles, true
+	}
+	roles, ok := m.conf.Subjects[cert.Subject.CommonName]
+	return roles, ok
+}
+
+// check authenticates the requests with a verified client certificate
+func (m *MTLS) check(r *http.Request) *auth.Auth {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	roles, ok := m.Roles(cert)
+	if !ok {
+		m.log.Debug("unknown certificate subject", "subject", cert.Subject.String())
+		return nil
+	}
+	a, err := auth.NewAuth("cert:"+cert.Subject.CommonName, roles)
+	if err != nil {
+		m.log.Error("failed to load the certificate roles", "subject", cert.Subject.String(), "err", err)
+		return nil
+	}
+	return a
+}
@@ -0,0 +1,140 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/acme"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func newCert(subject pkix.Name, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	check(err)
+	cert, err := x509.ParseCertificate(der)
+	check(err)
+	return cert, key
+}
+
+func TestClientCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(pkix.Name{CommonName: "Test CA"}, nil, nil)
+	caPath := filepath.Join(dir, "ca.pem")
+	check(ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{
+		TLSCert: "cert.pem",
+		TLSKey:  "key.pem",
+		ClientCerts: &config.ClientCerts{
+			CA:       caPath,
+			Required: true,
+			Subjects: map[string][]string{
+				"backup":                []string{"admin"},
+				"CN=ops,O=Example Corp": []string{"admin"},
+			},
+		},
+	}
+	check(auth.Setup(conf, logger))
+	m, err := New(logger, conf)
+	check(err)
+
+	tlsConfig := m.TLSConfig(&tls.Config{})
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Errorf("unexpected TLS config %+v", tlsConfig)
+	}
+
+	// The ACME TLS-ALPN challenge handshakes don't require a client certificate
+	for _, tc := range []struct {
+		protos []string
+		acme   bool
+	}{
+		{[]string{acme.ALPNProto}, true},
+		{[]string{"h2", acme.ALPNProto}, false},
+		{[]string{"h2", "http/1.1"}, false},
+	} {
+		c, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: tc.protos})
+		check(err)
+		if tc.acme != (c != nil && c.ClientAuth == tls.NoClientCert) {
+			t.Errorf("%v: unexpected config %+v", tc.protos, c)
+		}
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("the challenge config must not change the listener config")
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/ping", nil)
+	req.TLS = &tls.ConnectionState{NegotiatedProtocol: acme.ALPNProto}
+	m.Middleware(http.NotFoundHandler()).ServeHTTP(w, req)
+	if w.Code != http.StatusMisdirectedRequest {
+		t.Errorf("the requests over the challenge connections should be rejected, got %d", w.Code)
+	}
+
+	for _, tc := range []struct {
+		subject pkix.Name
+		ok      bool
+	}{
+		{pkix.Name{CommonName: "backup"}, true},
+		{pkix.Name{CommonName: "ops", Organization: []string{"Example Corp"}}, true},
+		{pkix.Name{CommonName: "ops"}, false},
+		{pkix.Name{CommonName: "unknown"}, false},
+	} {
+		cert, _ := newCert(tc.subject, ca, caKey)
+		_, err := cert.Verify(x509.VerifyOptions{Roots: tlsConfig.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		check(err)
+		req := httptest.NewRequest("GET", "/api/ping", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca}}}
+		if ok := auth.Check(req); ok != tc.ok {
+			t.Errorf("%s: expected %v, got %v", tc.subject, tc.ok, ok)
+		}
+		if tc.ok && auth.ID(req) != "cert:"+tc.subject.CommonName {
+			t.Errorf("unexpected auth ID %q", auth.ID(req))
+		}
+	}
+
+	// No client certificate
+	if auth.Check(httptest.NewRequest("GET", "/api/ping", nil)) {
+		t.Errorf("a request without certificate should not be authenticated")
+	}
+}
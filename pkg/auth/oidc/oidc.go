@@ -0,0 +1,429 @@
+/*
+
+Package oidc implements the OpenID Connect login (authorization code flow) for the web UIs.
+
+Once logged in, the user gets a session cookie accepted by every endpoint protected by the basic auth, with the roles
+mapped from the groups claim of the ID token (see the `oidc` config item).
+
+The cookie is only enough for the safe methods (GET/HEAD/OPTIONS), the other requests must also set the
+`BlobStash-CSRF` header (which cannot be set by a cross-site form, and needs a CORS preflight from another origin).
+
+The ID token is received directly from the token endpoint (over TLS), so its signature is not checked (as allowed by
+the OpenID Connect Core spec, section 3.1.3.7), only its claims are.
+
+*/
+package oidc // import "a4.io/blobstash/pkg/auth/oidc"
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/session"
+)
+
+const sessionName = "oidc"
+
+const defaultSessionTTL = 12 * time.Hour
+
+// CSRFHeader must be set on the unsafe requests authenticated by the session cookie
+const CSRFHeader = "BlobStash-CSRF"
+
+// ErrInvalidToken is returned when the ID token claims are not valid
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// provider holds the endpoints from the discovery document
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// loginState is stored in the session during the redirect to the provider
+type loginState struct {
+	State string `json:"state"`
+	Nonce string `json:"nonce"`
+	Next  string `json:"next"`
+}
+
+// User is a logged in user
+type User struct {
+	ID        string   `json:"id"`
+	Email     string   `json:"email,omitempty"`
+	Groups    []string `json:"groups"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"expires_at"`
+}
+
+// OIDC handles the login flow and the sessions
+type OIDC struct {
+	conf   *config.OIDC
+	sess   *session.Session
+	client *http.Client
+	log    log.Logger
+
+	provider *provider
+	mu       sync.Mutex
+}
+
+// New initializes the OIDC login, and registers the session cookie as an auth method
+func New(logger log.Logger, conf *config.Config, sess *session.Session) (*OIDC, error) {
+	logger.Debug("init")
+	o := &OIDC{
+		conf:   conf.OIDC,
+		sess:   sess,
+		client: &http.Client{Timeout: 10 * time.Second},
+		log:    logger,
+	}
+	// Check the roles of the group mapping early
+	for _, roles := range append([][]string{o.conf.DefaultRoles}, groupRoles(o.conf.Groups)...) {
+		if _, err := auth.NewAuth("", roles); err != nil {
+			return nil, fmt.Errorf("invalid oidc groups config: %v", err)
+		}
+	}
+	auth.RegisterChecker(o.check)
+	return o, nil
+}
+
+func groupRoles(groups map[string][]string) [][]string {
+	out := [][]string{}
+	for _, roles := range groups {
+		out = append(out, roles)
+	}
+	return out
+}
+
+// discover fetches (and caches) the provider discovery document
+func (o *OIDC) discover() (*provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	resp, err := o.client.Get(strings.TrimSuffix(o.conf.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the discovery document: %s", resp.Status)
+	}
+	p := &provider{}
+	if err := json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, err
+	}
+	o.provider = p
+	return p, nil
+}
+
+// Roles returns the roles granted for the given groups
+func (o *OIDC) Roles(groups []string) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	add := func(rs []string) {
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				roles = append(roles, r)
+			}
+		}
+	}
+	add(o.conf.DefaultRoles)
+	for _, g := range groups {
+		add(o.conf.Groups[g])
+	}
+	return roles
+}
+
+// check returns the auth of the logged in user (nil if there's no valid session)
+func (o *OIDC) check(r *http.Request) *auth.Auth {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if r.Header.Get(CSRFHeader) == "" {
+			return nil
+		}
+	}
+	user, err := o.user(r)
+	if err != nil || user == nil {
+		return nil
+	}
+	a, err := auth.NewAuth("oidc:"+user.ID, user.Roles)
+	if err != nil {
+		o.log.Error("failed to load the session roles", "user", user.ID, "err", err)
+		return nil
+	}
+	return a
+}
+
+// user returns the logged in user from the session cookie
+func (o *OIDC) user(r *http.Request) (*User, error) {
+	store, err := o.sess.Session().Get(r, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	js, ok := store.Values["user"].([]byte)
+	if !ok {
+		return nil, nil
+	}
+	user := &User{}
+	if err := json.Unmarshal(js, user); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > user.ExpiresAt {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// safeNext returns the redirection target after the login, only local paths are allowed
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func (o *OIDC) loginHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := o.discover()
+		if err != nil {
+			panic(fmt.Errorf("failed to discover the OIDC provider: %v", err))
+		}
+		state := &loginState{
+			State: randomString(),
+			Nonce: randomString(),
+			Next:  safeNext(r.URL.Query().Get("next")),
+		}
+		store, err := o.sess.Session().Get(r, sessionName)
+		if err != nil {
+			// Invalid cookie (e.g. the secret key changed), start from a fresh session
+			store.Values = map[interface{}]interface{}{}
+		}
+		js, err := json.Marshal(state)
+		if err != nil {
+			panic(err)
+		}
+		store.Values["login"] = js
+		if err := store.Save(r, w); err != nil {
+			panic(err)
+		}
+
+		scopes := o.conf.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "profile", "email"}
+		}
+		q := url.Values{}
+		q.Set("response_type", "code")
+		q.Set("client_id", o.conf.ClientID)
+		q.Set("redirect_uri", o.conf.RedirectURL)
+		q.Set("scope", strings.Join(scopes, " "))
+		q.Set("state", state.State)
+		q.Set("nonce", state.Nonce)
+		sep := "?"
+		if strings.Contains(p.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	}
+}
+
+// exchange exchanges the authorization code for the ID token claims
+func (o *OIDC) exchange(code string) (map[string]interface{}, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.PostForm(p.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.conf.RedirectURL},
+		"client_id":     {o.conf.ClientID},
+		"client_secret": {o.conf.ClientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if !stringOrListContains(claims["aud"], o.conf.ClientID) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) < time.Now().Unix() {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+func stringOrListContains(v interface{}, s string) bool {
+	switch vv := v.(type) {
+	case string:
+		return vv == s
+	case []interface{}:
+		for _, item := range vv {
+			if item == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *OIDC) callbackHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			httputil.WriteJSONError(w, http.StatusUnauthorized, fmt.Sprintf("login failed: %s", e))
+			return
+		}
+		store, err := o.sess.Session().Get(r, sessionName)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "invalid session")
+			return
+		}
+		js, ok := store.Values["login"].([]byte)
+		if !ok {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "no login in progress")
+			return
+		}
+		delete(store.Values, "login")
+		state := &loginState{}
+		if err := json.Unmarshal(js, state); err != nil {
+			panic(err)
+		}
+		if q.Get("state") == "" || q.Get("state") != state.State {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "invalid state")
+			return
+		}
+
+		claims, err := o.exchange(q.Get("code"))
+		if err != nil {
+			o.log.Error("failed to exchange the code", "err", err)
+			httputil.WriteJSONError(w, http.StatusUnauthorized, "login failed")
+			return
+		}
+		if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+			httputil.WriteJSONError(w, http.StatusUnauthorized, "invalid nonce")
+			return
+		}
+
+		groupsClaim := o.conf.GroupsClaim
+		if groupsClaim == "" {
+			groupsClaim = "groups"
+		}
+		user := &User{Groups: []string{}}
+		user.ID, _ = claims["sub"].(string)
+		user.Email, _ = claims["email"].(string)
+		if groups, ok := claims[groupsClaim].([]interface{}); ok {
+			for _, g := range groups {
+				if sg, ok := g.(string); ok {
+					user.Groups = append(user.Groups, sg)
+				}
+			}
+		}
+		user.Roles = o.Roles(user.Groups)
+		if user.ID == "" || len(user.Roles) == 0 {
+			o.log.Info("login rejected", "user", user.ID, "groups", user.Groups)
+			auth.Forbidden(w)
+			return
+		}
+		ttl := defaultSessionTTL
+		if o.conf.SessionTTL > 0 {
+			ttl = time.Duration(o.conf.SessionTTL) * time.Second
+		}
+		user.ExpiresAt = time.Now().Add(ttl).Unix()
+
+		ujs, err := json.Marshal(user)
+		if err != nil {
+			panic(err)
+		}
+		store.Values["user"] = ujs
+		store.Options.HttpOnly = true
+		store.Options.MaxAge = int(ttl.Seconds())
+		if err := store.Save(r, w); err != nil {
+			panic(err)
+		}
+		o.log.Info("logged in", "user", user.ID, "roles", user.Roles)
+		http.Redirect(w, r, state.Next, http.StatusFound)
+	}
+}
+
+func (o *OIDC) logoutHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		store, _ := o.sess.Session().Get(r, sessionName)
+		store.Values = map[interface{}]interface{}{}
+		store.Options.MaxAge = -1
+		if err := store.Save(r, w); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (o *OIDC) meHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := o.user(r)
+		if user == nil {
+			httputil.WriteJSONError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		httputil.MarshalAndWrite(r, w, user)
+	}
+}
+
+// Register registers the login endpoints (not protected by the auth)
+func (o *OIDC) Register(r *mux.Router) {
+	r.Handle("/login", http.HandlerFunc(o.loginHandler()))
+	r.Handle("/callback", http.HandlerFunc(o.callbackHandler()))
+	r.Handle("/logout", http.HandlerFunc(o.logoutHandler()))
+	r.Handle("/me", http.HandlerFunc(o.meHandler()))
+}
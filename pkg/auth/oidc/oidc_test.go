@@ -0,0 +1,152 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/session"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	var nonce string
+	var issuer string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+			})
+		case "/token":
+			check(r.ParseForm())
+			if r.Form.Get("code") != "c0de" || r.Form.Get("client_secret") != "s3cr3t" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			claims, err := json.Marshal(map[string]interface{}{
+				"iss":    issuer,
+				"aud":    "blobstash",
+				"sub":    "thomas",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+				"nonce":  nonce,
+				"groups": []string{"staff", "admins"},
+			})
+			check(err)
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig",
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{
+		SecretKey: "secret",
+		OIDC: &config.OIDC{
+			Issuer:       issuer,
+			ClientID:     "blobstash",
+			ClientSecret: "s3cr3t",
+			RedirectURL:  "http://localhost/api/oidc/callback",
+			Groups:       map[string][]string{"admins": []string{"admin"}},
+		},
+	}
+	check(auth.Setup(conf, logger))
+	o, err := New(logger, conf, session.New(conf))
+	check(err)
+	r := mux.NewRouter()
+	o.Register(r.PathPrefix("/api/oidc").Subrouter())
+
+	// Start the login
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/api/oidc/login?next=/api/filetree/fs/root/", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", rec.Code)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	check(err)
+	if loc.Path != "/authorize" || loc.Query().Get("client_id") != "blobstash" {
+		t.Errorf("unexpected authorization URL %s", loc)
+	}
+	nonce = loc.Query().Get("nonce")
+	cookies := rec.Result().Cookies()
+
+	// A wrong state is rejected
+	req := httptest.NewRequest("GET", "/api/oidc/callback?code=c0de&state=nope", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a wrong state, got %d", rec.Code)
+	}
+
+	// Complete the login
+	req = httptest.NewRequest("GET", "/api/oidc/callback?code=c0de&state="+loc.Query().Get("state"), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/api/filetree/fs/root/" {
+		t.Fatalf("unexpected callback response %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The session cookie is now accepted as an auth method
+	req = httptest.NewRequest("GET", "/api/ping", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if !auth.Check(req) {
+		t.Errorf("session not accepted")
+	}
+	if auth.Check(httptest.NewRequest("GET", "/api/ping", nil)) {
+		t.Errorf("request without session accepted")
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.SameSite != http.SameSiteLaxMode || !c.HttpOnly {
+			t.Errorf("unexpected session cookie attributes %+v", c)
+		}
+	}
+
+	// The writes also need the CSRF header
+	req = httptest.NewRequest("POST", "/api/kvstore/key/a", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if auth.Check(req) {
+		t.Errorf("write without the CSRF header accepted")
+	}
+	req.Header.Set(CSRFHeader, "1")
+	if !auth.Check(req) {
+		t.Errorf("write with the CSRF header not accepted")
+	}
+
+	if roles := o.Roles([]string{"staff"}); len(roles) != 0 {
+		t.Errorf("unexpected roles %v", roles)
+	}
+	if safeNext("//evil.com") != "/" || safeNext("https://evil.com") != "/" {
+		t.Errorf("open redirect")
+	}
+}
@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"sync"
+	"time"
+)
+
+// Delays between the retries of the failed uploads (doubled after each consecutive failure)
+var (
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// backoff tracks the consecutive upload failures, the uploads are paused until the next retry (or until the bucket is
+// reachable again)
+type backoff struct {
+	attempts    int
+	lastError   string
+	lastFailure time.Time
+	nextRetry   time.Time
+
+	// Wakes up the workers waiting for the next retry
+	wake chan struct{}
+
+	mu sync.Mutex
+}
+
+func newBackoff() *backoff {
+	return &backoff{wake: make(chan struct{}, 1)}
+}
+
+// fail records a failure and returns the delay before the next retry
+func (b *backoff) fail(err error) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delay := minRetryDelay << uint(b.attempts)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	b.attempts++
+	b.lastError = err.Error()
+	b.lastFailure = time.Now()
+	b.nextRetry = b.lastFailure.Add(delay)
+	return delay
+}
+
+// success resets the backoff
+func (b *backoff) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = 0
+	b.nextRetry = time.Time{}
+}
+
+// ready returns true if the uploads are not paused
+func (b *backoff) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextRetry.IsZero() || !time.Now().Before(b.nextRetry)
+}
+
+// retryNow cancels the current delay (if any)
+func (b *backoff) retryNow() {
+	b.mu.Lock()
+	paused := !b.nextRetry.IsZero()
+	b.nextRetry = time.Time{}
+	b.mu.Unlock()
+	if paused {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait blocks until the delay is over, the backoff is reset, or stop is closed (and returns false in this case)
+func (b *backoff) wait(delay time.Duration, stop chan struct{}) bool {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+	case <-b.wake:
+	}
+	return true
+}
+
+// QueuedBlob is a blob waiting to be uploaded
+type QueuedBlob struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// QueueStatus holds the state of the upload queue
+type QueueStatus struct {
+	Blobs int   `json:"blobs"`
+	Size  int64 `json:"size"`
+
+	// Consecutive failures (0 if the last upload succeeded)
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+
+	WALEntries int `json:"wal_entries"`
+
+	// The oldest queued blobs
+	Items []*QueuedBlob `json:"items"`
+}
+
+// QueueStatus returns the state of the upload queue, with the `limit` oldest blobs
+func (b *S3Backend) QueueStatus(limit int) (*QueueStatus, error) {
+	// Snapshot the queue and the retry state first, the sizes are then read without holding any lock (the upload
+	// worker holds the queue lock while uploading)
+	b.uploadQueue.Lock()
+	blbs, err := b.uploadQueue.Blobs()
+	b.uploadQueue.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	status := b.retries.status()
+
+	for _, blb := range blbs {
+		size, err := b.backend.Size(blb.Hash)
+		if err != nil {
+			return nil, err
+		}
+		status.Blobs++
+		status.Size += int64(size)
+		if len(status.Items) < limit {
+			status.Items = append(status.Items, &QueuedBlob{Hash: blb.Hash, Size: size})
+		}
+	}
+
+	if b.walQueue != nil {
+		if status.WALEntries, err = b.walQueue.Size(); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// status returns a copy of the retry state
+func (b *backoff) status() *QueueStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := &QueueStatus{Items: []*QueuedBlob{}, Attempts: b.attempts}
+	if status.Attempts > 0 {
+		status.LastError = b.lastError
+		lastFailure := b.lastFailure
+		status.LastFailure = &lastFailure
+		if !b.nextRetry.IsZero() {
+			nextRetry := b.nextRetry
+			status.NextRetry = &nextRetry
+		}
+	}
+	return status
+}
+
+// RetryNow resumes the uploads right away
+func (b *S3Backend) RetryNow() {
+	b.retries.retryNow()
+}
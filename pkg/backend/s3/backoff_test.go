@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff()
+	if !b.ready() {
+		t.Errorf("backoff should be ready before any failure")
+	}
+
+	var prev time.Duration
+	for i := 0; i < 20; i++ {
+		delay := b.fail(fmt.Errorf("unreachable"))
+		if delay < prev || delay > maxRetryDelay {
+			t.Errorf("unexpected delay %v after %v", delay, prev)
+		}
+		prev = delay
+	}
+	if prev != maxRetryDelay {
+		t.Errorf("delay should be capped to %v, got %v", maxRetryDelay, prev)
+	}
+	if b.ready() {
+		t.Errorf("backoff should not be ready after a failure")
+	}
+
+	b.retryNow()
+	if !b.ready() {
+		t.Errorf("backoff should be ready after retryNow")
+	}
+	if !b.wait(time.Hour, make(chan struct{})) {
+		t.Errorf("wait should be interrupted by retryNow")
+	}
+
+	b.success()
+	if b.attempts != 0 {
+		t.Errorf("attempts should be reset, got %d", b.attempts)
+	}
+	if delay := b.fail(fmt.Errorf("unreachable")); delay != minRetryDelay {
+		t.Errorf("expected %v, got %v", minRetryDelay, delay)
+	}
+}
@@ -2,6 +2,7 @@ package index // import "a4.io/blobstash/pkg/backend/s3/index"
 
 import (
 	"encoding/hex"
+	"io"
 	"sync"
 
 	"a4.io/blobstash/pkg/rangedb"
@@ -97,3 +98,31 @@ func (i *Index) Get(hash string) (string, error) {
 	}
 	return "", nil
 }
+
+// List returns the plain hashes indexed after the given one (sorted), at most `limit`
+func (i *Index) List(after string, limit int) ([]string, error) {
+	i.Lock()
+	defer i.Unlock()
+	var start []byte
+	if after != "" {
+		bafter, err := hex.DecodeString(after)
+		if err != nil {
+			return nil, err
+		}
+		start = rangedb.NextKey(bafter)
+	}
+	r := i.db.Range(start, []byte{0xff}, false)
+	defer r.Close()
+	out := []string{}
+	for len(out) < limit {
+		k, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hex.EncodeToString(k))
+	}
+	return out, nil
+}
@@ -38,3 +38,31 @@ func TestIndex(t *testing.T) {
 		t.Errorf("h \"%s\" should not exists", h2)
 	}
 }
+
+func TestIndexList(t *testing.T) {
+	i, err := New("index_list_test")
+	defer func() {
+		i.Remove()
+	}()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	hashes := []string{
+		"00f1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f12998800",
+		"c0f1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f12998800",
+		"fff1480a26c2fd4deb8e738a52b7530ed111b9bcd17bbb09259ce03f12998800",
+	}
+	for _, h := range hashes {
+		check(i.Index(h, h))
+	}
+	page, err := i.List("", 2)
+	check(err)
+	if len(page) != 2 || page[0] != hashes[0] || page[1] != hashes[1] {
+		t.Errorf("unexpected first page %q", page)
+	}
+	page, err = i.List(page[1], 2)
+	check(err)
+	if len(page) != 1 || page[0] != hashes[2] {
+		t.Errorf("unexpected last page %q", page)
+	}
+}
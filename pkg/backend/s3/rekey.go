@@ -0,0 +1,519 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+// RekeyJob is the kind of the re-keying job
+const RekeyJob = "s3.rekey"
+
+// ErrNoRekey is returned when no re-keying is configured
+var ErrNoRekey = errors.New("no re-keying configured")
+
+// Number of blobs processed per page by the re-keying job
+var rekeyPageSize = 100
+
+// Delay before resuming a failed re-keying job (doubled after each failed attempt)
+var rekeyRetryDelay = 30 * time.Second
+
+// Max number of attempts of the re-keying job, a new job is started on the next start if all of them failed
+const rekeyMaxAttempts = 10
+
+// RekeyStatus holds the progress of the re-keying job
+type RekeyStatus struct {
+	Running bool `json:"running"`
+	Done    bool `json:"done"`
+
+	// Blobs still encrypted with the old key
+	Blobs     int `json:"blobs"`
+	Remaining int `json:"remaining"`
+
+	LastError string `json:"last_error,omitempty"`
+}
+
+// rekeyer holds the state of the re-keying job, the re-keyed blobs are tracked in a dedicated index (plain hash ->
+// encrypted hash with the new key), so the job can resume after a failure or a restart
+type rekeyer struct {
+	key   *[32]byte
+	index *index.Index
+
+	// Written once the job is done, the old key can only be removed after that
+	donePath string
+
+	mu      sync.Mutex
+	running bool
+	done    bool
+	lastErr error
+}
+
+func keyFingerprint(key *[32]byte) string {
+	return hashutil.Compute(key[:])
+}
+
+// setupRekey loads the state of the re-keying job (the fingerprint of the new key is saved along the index, to
+// detect the end of the job once the new key replaced the old one, and a marker is written once all the objects are
+// re-keyed)
+func (b *S3Backend) setupRekey(varDir string, newKey *[32]byte) error {
+	indexPath := filepath.Join(varDir, "s3-rekey.index")
+	fingerprintPath := filepath.Join(varDir, "s3-rekey.key")
+	donePath := filepath.Join(varDir, "s3-rekey.done")
+	done, err := fileExists(donePath)
+	if err != nil {
+		return err
+	}
+
+	var fingerprint string
+	data, err := ioutil.ReadFile(fingerprintPath)
+	switch {
+	case err == nil:
+		fingerprint = string(data)
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+
+	if newKey == nil {
+		if fingerprint == "" {
+			return nil
+		}
+		if b.key == nil || fingerprint != keyFingerprint(b.key) {
+			return fmt.Errorf("a re-keying is in progress, new_key_file must be set")
+		}
+		// The new key replaced the old one, the old objects would not be readable anymore if the job is not over
+		if !done {
+			return fmt.Errorf("the re-keying is not finished, set back key_file to the old key and new_key_file to the new one")
+		}
+		i, err := index.New(indexPath)
+		if err != nil {
+			return err
+		}
+		_, remaining, err := b.rekeyCounts(i)
+		i.Close()
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return fmt.Errorf("%d blobs are still encrypted with the old key, set back key_file to the old key and new_key_file to the new one", remaining)
+		}
+		b.log.Info("re-keying completed, removing its state")
+		if err := os.RemoveAll(indexPath); err != nil {
+			return err
+		}
+		if err := os.Remove(donePath); err != nil {
+			return err
+		}
+		return os.Remove(fingerprintPath)
+	}
+
+	if b.key == nil {
+		return fmt.Errorf("new_key_file requires key_file")
+	}
+	newFingerprint := keyFingerprint(newKey)
+	if newFingerprint == keyFingerprint(b.key) {
+		return fmt.Errorf("new_key_file must differ from key_file (remove it once the re-keying is done)")
+	}
+	if fingerprint != "" && fingerprint != newFingerprint {
+		return fmt.Errorf("a re-keying to another key is in progress")
+	}
+	if fingerprint == "" {
+		// A new job (a marker may be left by a job whose new key was discarded)
+		if err := os.RemoveAll(donePath); err != nil {
+			return err
+		}
+		done = false
+		if err := ioutil.WriteFile(fingerprintPath, []byte(newFingerprint), 0600); err != nil {
+			return err
+		}
+	}
+
+	i, err := index.New(indexPath)
+	if err != nil {
+		return err
+	}
+	b.rekey = &rekeyer{key: newKey, index: i, donePath: donePath, done: done}
+	return nil
+}
+
+// RegisterJobs registers the re-keying job on the jobs manager, and starts it if the re-keying is not done yet (unless
+// an interrupted job is resumed)
+func (b *S3Backend) RegisterJobs(m *jobs.Manager) error {
+	if b.rekey == nil {
+		return nil
+	}
+	if err := m.RegisterKind(&jobs.Kind{
+		Name:      RekeyJob,
+		Run:       b.runRekey,
+		Retry:     jobs.RetryPolicy{MaxAttempts: rekeyMaxAttempts, Backoff: rekeyRetryDelay},
+		Exclusive: true,
+	}); err != nil {
+		return err
+	}
+	b.rekey.mu.Lock()
+	done := b.rekey.done
+	b.rekey.mu.Unlock()
+	if done {
+		return nil
+	}
+	if _, err := m.Start(RekeyJob, nil); err != nil && err != jobs.ErrAlreadyRunning {
+		return err
+	}
+	return nil
+}
+
+func fileExists(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// rekeyCounts returns the number of blobs, and the number of blobs not re-keyed yet
+func (b *S3Backend) rekeyCounts(rekeyIndex *index.Index) (int, int, error) {
+	var blobs, remaining int
+	var after string
+	for {
+		hashes, err := b.index.List(after, rekeyPageSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, h := range hashes {
+			blobs++
+			done, err := rekeyIndex.Exists(h)
+			if err != nil {
+				return 0, 0, err
+			}
+			if !done {
+				remaining++
+			}
+		}
+		if len(hashes) < rekeyPageSize {
+			break
+		}
+		after = hashes[len(hashes)-1]
+	}
+	return blobs, remaining, nil
+}
+
+// sealKey returns the key used to encrypt the new objects
+func (b *S3Backend) sealKey() *[32]byte {
+	if b.rekey != nil {
+		return b.rekey.key
+	}
+	return b.key
+}
+
+// lookup returns the encrypted hash of the blob, and the key it is encrypted with
+func (b *S3Backend) lookup(hash string) (string, *[32]byte, error) {
+	if b.rekey != nil {
+		ehash, err := b.rekey.index.Get(hash)
+		if err != nil {
+			return "", nil, err
+		}
+		if ehash != "" {
+			return ehash, b.rekey.key, nil
+		}
+	}
+	ehash, err := b.index.Get(hash)
+	return ehash, b.key, err
+}
+
+// encryptedBlob returns the object as an encrypted blob, readable with both keys while a re-keying is in progress
+func (b *S3Backend) encryptedBlob(o *s3util.Object) *s3util.EncryptedBlob {
+	eblob := s3util.NewEncryptedBlob(o, b.key)
+	if b.rekey != nil {
+		eblob.WithFallbackKey(b.rekey.key)
+	}
+	return eblob
+}
+
+// open decrypts data sealed with s3util.Seal (WAL segments), trying the new key first
+func (b *S3Backend) open(data []byte) ([]byte, error) {
+	if b.rekey != nil {
+		if plain, err := s3util.Open(b.rekey.key, data); err == nil {
+			return plain, nil
+		}
+	}
+	return s3util.Open(b.key, data)
+}
+
+// openPack decrypts a BlobsFile pack, trying the new key first
+func (b *S3Backend) openPack(path string) (string, error) {
+	if b.rekey != nil {
+		if decrypted, err := crypto.Open(b.rekey.key, path); err == nil {
+			return decrypted, nil
+		}
+	}
+	return crypto.Open(b.key, path)
+}
+
+// RekeyStatus returns the progress of the re-keying job
+func (b *S3Backend) RekeyStatus() (*RekeyStatus, error) {
+	if b.rekey == nil {
+		return nil, ErrNoRekey
+	}
+	blobs, remaining, err := b.rekeyCounts(b.rekey.index)
+	if err != nil {
+		return nil, err
+	}
+	status := &RekeyStatus{Blobs: blobs, Remaining: remaining}
+
+	b.rekey.mu.Lock()
+	defer b.rekey.mu.Unlock()
+	status.Running = b.rekey.running
+	status.Done = b.rekey.done
+	if b.rekey.lastErr != nil {
+		status.LastError = b.rekey.lastErr.Error()
+	}
+	return status, nil
+}
+
+func (r *rekeyer) setState(running, done bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = running
+	r.done = done
+	r.lastErr = err
+}
+
+func (b *S3Backend) runRekey(ctx context.Context, h *jobs.Handle) error {
+	log := b.log.New("job", h.ID())
+	log.Info("starting re-keying", "attempt", h.Attempt())
+	b.rekey.setState(true, false, nil)
+	t := time.Now()
+	if err := b.rekeyAll(ctx, log, h); err != nil {
+		b.rekey.setState(false, false, err)
+		return err
+	}
+	if err := ioutil.WriteFile(b.rekey.donePath, []byte(time.Now().UTC().Format(time.RFC3339)), 0600); err != nil {
+		b.rekey.setState(false, false, err)
+		return err
+	}
+	b.rekey.setState(false, true, nil)
+	log.Info("re-keying done, new_key_file can now replace key_file", "duration", time.Since(t))
+	return nil
+}
+
+// rekeyStopped returns the error to return if the job must stop (canceled or shutting down)
+func (b *S3Backend) rekeyStopped(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.stop:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// rekeyAll re-encrypts the blobs (skipping the ones already re-keyed), then the WAL segments and the packs (the
+// ones already encrypted with the new key are detected by decrypting them)
+func (b *S3Backend) rekeyAll(ctx context.Context, log log.Logger, h *jobs.Handle) error {
+	blobs, remaining, err := b.rekeyCounts(b.rekey.index)
+	if err != nil {
+		return err
+	}
+	processed := int64(blobs - remaining)
+	h.SetProgress(processed, int64(blobs))
+
+	var after string
+	var cnt int
+	for {
+		hashes, err := b.index.List(after, rekeyPageSize)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := b.rekeyStopped(ctx); err != nil {
+				return err
+			}
+			rekeyed, err := b.rekeyBlob(hash)
+			if err != nil {
+				return fmt.Errorf("failed to re-key blob %s: %v", hash, err)
+			}
+			if rekeyed {
+				cnt++
+				processed++
+				h.SetProgress(processed, int64(blobs))
+			}
+		}
+		if len(hashes) < rekeyPageSize {
+			break
+		}
+		after = hashes[len(hashes)-1]
+	}
+	log.Info("blobs re-keyed", "count", cnt)
+
+	bucket := s3util.NewBucket(b.s3, b.bucket)
+	for _, prefix := range []string{WALPrefix, "packs/"} {
+		var marker string
+		for {
+			objs, err := bucket.ListPrefix(prefix, marker, rekeyPageSize)
+			if err != nil {
+				return err
+			}
+			if len(objs) == 0 {
+				break
+			}
+			for _, obj := range objs {
+				if err := b.rekeyStopped(ctx); err != nil {
+					return err
+				}
+				marker = obj.Key
+				if strings.HasPrefix(obj.Key, WALPrefix) {
+					err = b.rekeyWALSegment(obj)
+				} else {
+					err = b.rekeyPack(obj)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to re-key %s: %v", obj.Key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rekeyBlob re-encrypts the blob with the new key, the old object is removed once the blob is tracked as re-keyed
+// (the upload queue is locked so the blob is not uploaded/deleted concurrently)
+func (b *S3Backend) rekeyBlob(hash string) (bool, error) {
+	b.uploadQueue.Lock()
+	defer b.uploadQueue.Unlock()
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	done, err := b.rekey.index.Exists(hash)
+	if err != nil || done {
+		return false, err
+	}
+	ehash, err := b.index.Get(hash)
+	if err != nil || ehash == "" {
+		return false, err
+	}
+
+	obj := s3util.NewBucket(b.s3, b.bucket).GetObject(ehash)
+	fhash, data, err := s3util.NewEncryptedBlob(obj, b.key).HashAndPlainText()
+	if err != nil {
+		return false, err
+	}
+	if fhash != hash {
+		return false, fmt.Errorf("hash does not match")
+	}
+	sealed, err := s3util.Seal(b.rekey.key, &blob.Blob{Hash: hash, Data: data})
+	if err != nil {
+		return false, err
+	}
+	nehash := hashutil.Compute(sealed)
+	if _, err := b.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(nehash),
+		Body:   bytes.NewReader(sealed),
+	}); err != nil {
+		return false, err
+	}
+
+	// The lookups rely on the re-keying index, so it must be updated first
+	if err := b.rekey.index.Index(hash, nehash); err != nil {
+		return false, err
+	}
+	if err := b.index.Index(hash, nehash); err != nil {
+		return false, err
+	}
+	if err := obj.Delete(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rekeyWALSegment re-encrypts the WAL segment in place (unless it is already encrypted with the new key)
+func (b *S3Backend) rekeyWALSegment(obj *s3util.Object) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s3util.Open(b.rekey.key, data); err == nil {
+		return nil
+	}
+	plain, err := s3util.Open(b.key, data)
+	if err != nil {
+		return err
+	}
+	sealed, err := s3util.Seal(b.rekey.key, &blob.Blob{Hash: hashutil.Compute(plain), Data: plain})
+	if err != nil {
+		return err
+	}
+	_, err = b.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(obj.Key),
+		Body:   bytes.NewReader(sealed),
+	})
+	return err
+}
+
+// rekeyPack re-encrypts the BlobsFile pack in place (unless it is already encrypted with the new key)
+func (b *S3Backend) rekeyPack(obj *s3util.Object) error {
+	dir, err := ioutil.TempDir("", "blobstash_rekey_pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := os.Create(filepath.Join(dir, "download"))
+	if err != nil {
+		return err
+	}
+	if err := b.DownloadFile(obj.Key, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if decrypted, err := crypto.Open(b.rekey.key, tmp.Name()); err == nil {
+		return os.Remove(decrypted)
+	}
+	decrypted, err := crypto.Open(b.key, tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(decrypted)
+	sealed, err := crypto.Seal(b.rekey.key, decrypted)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sealed)
+
+	f, err := os.Open(sealed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.UploadFile(f, obj.Key)
+}
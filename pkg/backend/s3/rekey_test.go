@@ -0,0 +1,58 @@
+package s3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend/s3/index"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestRekeySwitch(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "blobstash_s3_rekey")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	newKey := &[32]byte{1}
+	i, err := index.New(filepath.Join(dir, "s3.index"))
+	check(err)
+	defer i.Close()
+	plain := hashutil.Compute([]byte("plain"))
+	check(i.Index(plain, hashutil.Compute([]byte("encrypted"))))
+	// new_key_file replaced key_file
+	b := &S3Backend{log: logger, key: newKey, index: i}
+	check(ioutil.WriteFile(filepath.Join(dir, "s3-rekey.key"), []byte(keyFingerprint(newKey)), 0600))
+
+	// The job never completed
+	if err := b.setupRekey(dir, nil); err == nil {
+		t.Fatalf("the switch should be refused before the re-keying is done")
+	}
+
+	// The marker is there, but a blob is still encrypted with the old key
+	check(ioutil.WriteFile(filepath.Join(dir, "s3-rekey.done"), []byte("done"), 0600))
+	if err := b.setupRekey(dir, nil); err == nil {
+		t.Fatalf("the switch should be refused while blobs are not re-keyed")
+	}
+
+	ri, err := index.New(filepath.Join(dir, "s3-rekey.index"))
+	check(err)
+	check(ri.Index(plain, hashutil.Compute([]byte("reencrypted"))))
+	check(ri.Close())
+	check(b.setupRekey(dir, nil))
+	for _, name := range []string{"s3-rekey.key", "s3-rekey.done", "s3-rekey.index"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed once the re-keying is over", name)
+		}
+	}
+}
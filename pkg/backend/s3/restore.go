@@ -0,0 +1,192 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// RestoreUntil rebuilds the local state as it was at the given time (Unix nano timestamp), it expects to run against
+// an empty data directory.
+//
+// The blobs are restored from the packs, the standalone blob objects, and then from the WAL (for the blobs not
+// replicated yet). The kv versions created after `until` are skipped, the other blobs are all restored as they are
+// content-addressed (and only reachable from the kv entries).
+func (b *S3Backend) RestoreUntil(until int64) error {
+	b.wg.Add(1)
+	defer b.wg.Done()
+	b.log.Info("starting point-in-time restore", "until", time.Unix(0, until).UTC())
+	start := time.Now()
+
+	var cnt, skipped int
+	restore := func(hash string, data []byte) error {
+		skip, err := createdAfter(data, until)
+		if err != nil {
+			return err
+		}
+		if skip {
+			skipped++
+			return nil
+		}
+		exists, err := b.backend.Exists(hash)
+		if err != nil || exists {
+			return err
+		}
+		if err := b.backend.Put(hash, data); err != nil {
+			return err
+		}
+		cnt++
+		// Let the subscribers (meta, indexes...) process the blob as if it was a new one
+		return b.hub.NewBlobEvent(context.TODO(), &blob.Blob{Hash: hash, Data: data}, nil)
+	}
+
+	bucket := s3util.NewBucket(b.s3, b.bucket)
+
+	// First, the packs
+	var marker string
+	for {
+		packs, err := bucket.ListPrefix("packs/", marker, 100)
+		if err != nil {
+			return err
+		}
+		if len(packs) == 0 {
+			break
+		}
+		for _, pack := range packs {
+			marker = pack.Key
+			b.log.Info("restoring pack", "pack", pack.Key)
+			if err := b.restorePack(pack.Key, restore); err != nil {
+				return fmt.Errorf("failed to restore pack %s: %v", pack.Key, err)
+			}
+		}
+	}
+
+	// Then the blobs not packed yet
+	if err := bucket.Iter(100, func(object *s3util.Object) error {
+		if strings.Contains(object.Key, "/") {
+			// Skip the packs and the WAL segments
+			return nil
+		}
+		hash, data, err := b.encryptedBlob(object).HashAndPlainText()
+		if err != nil {
+			return err
+		}
+		if err := b.index.Index(hash, object.Key); err != nil {
+			return err
+		}
+		return restore(hash, data)
+	}); err != nil {
+		return err
+	}
+
+	// And finally the WAL, for the most recent meta blobs
+	var missing int
+	if err := b.IterWAL(until, func(e *WALEntry) error {
+		if e.Data == nil {
+			exists, err := b.backend.Exists(e.Hash)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				// The data blob was not replicated before the failure, the content is lost
+				b.log.Warn("missing data blob", "hash", e.Hash)
+				missing++
+			}
+			return nil
+		}
+		return restore(e.Hash, e.Data)
+	}); err != nil {
+		return err
+	}
+
+	b.log.Info("point-in-time restore done", "blobs_restored", cnt, "kv_versions_skipped", skipped, "missing_blobs", missing, "duration", time.Since(start))
+	return nil
+}
+
+// restorePack downloads a BlobsFile pack and calls `f` for each of its blobs
+func (b *S3Backend) restorePack(key string, f func(string, []byte) error) error {
+	dir, err := ioutil.TempDir("", "blobstash_restore_pack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := os.Create(filepath.Join(dir, "download"))
+	if err != nil {
+		return err
+	}
+	if err := b.DownloadFile(key, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	decrypted, err := b.openPack(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	// Open the pack as a standalone BlobsFile (it will be re-indexed)
+	packDir := filepath.Join(dir, "pack")
+	if err := os.MkdirAll(packDir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(decrypted, filepath.Join(packDir, "blobs-00000")); err != nil {
+		return err
+	}
+	pack, err := blobsfile.New(&blobsfile.Opts{Directory: packDir})
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pack.Enumerate(out, "", "\xff", 0)
+	}()
+	for blb := range out {
+		data, err := pack.Get(blb.Hash)
+		if err != nil {
+			return err
+		}
+		if err := f(blb.Hash, data); err != nil {
+			return err
+		}
+	}
+	return <-errc
+}
+
+// createdAfter returns true if the blob is a kv version (or a batch of versions) created after the given time
+func createdAfter(data []byte, until int64) (bool, error) {
+	metaType, metaData, isMeta := meta.IsMetaBlob(data)
+	if !isMeta {
+		return false, nil
+	}
+	kvs, err := vkv.UnserializeMetaBlob(metaType, metaData)
+	if err != nil {
+		return false, err
+	}
+	if len(kvs) == 0 {
+		return false, nil
+	}
+	// A batch is restored as a whole, as long as one of its versions was created before `until`
+	for _, kv := range kvs {
+		if kv.Version <= until {
+			return false, nil
+		}
+	}
+	return true, nil
+}
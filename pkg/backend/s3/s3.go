@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -60,11 +61,15 @@ type S3Backend struct {
 	log log.Logger
 
 	uploadQueue *queue.Queue
+	walQueue    *queue.Queue
 	index       *index.Index
 
 	encrypted bool
 	key       *[32]byte
 
+	// Set while the objects are re-encrypted with a new key
+	rekey *rekeyer
+
 	backend *blobsfile.BlobsFiles
 	hub     *hub.Hub
 
@@ -78,6 +83,9 @@ type S3Backend struct {
 
 	stop chan struct{}
 
+	// Paces the retries of the failed uploads (shared by the blobs and the WAL segments uploads)
+	retries *backoff
+
 	bucket string
 
 	uploadedSinceStartup      uint64
@@ -95,6 +103,10 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 	if err != nil {
 		return nil, err
 	}
+	newKey, err := conf.S3Repl.NewKey()
+	if err != nil {
+		return nil, err
+	}
 
 	var s3svc *s3.S3
 	if conf.S3Repl.Endpoint != "" {
@@ -134,6 +146,7 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 		hub:         h,
 		s3:          s3svc,
 		stop:        make(chan struct{}),
+		retries:     newBackoff(),
 		bucket:      bucket,
 		key:         key,
 		uploadQueue: uq,
@@ -164,9 +177,23 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 		}
 	}
 
+	if err := s3backend.setupRekey(conf.VarDir(), newKey); err != nil {
+		return nil, err
+	}
+
 	// Initialize the worker (queue consumer)
 	go s3backend.uploadWorker()
 
+	if conf.S3Repl.WALShipping {
+		interval := 5 * time.Second
+		if conf.S3Repl.WALFlushInterval > 0 {
+			interval = time.Duration(conf.S3Repl.WALFlushInterval) * time.Second
+		}
+		if err := s3backend.setupWAL(conf.VarDir(), interval); err != nil {
+			return nil, err
+		}
+	}
+
 	return s3backend, nil
 }
 
@@ -182,7 +209,7 @@ func (b *S3Backend) BlobsFilesDownloadPack(key string) error {
 	if err := f.Close(); err != nil {
 		return err
 	}
-	decrypted, err := crypto.Open(b.key, f.Name())
+	decrypted, err := b.openPack(f.Name())
 	if err != nil {
 		return err
 	}
@@ -208,7 +235,7 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 		return nil
 	}
 
-	encrypted, err := crypto.Seal(b.key, pack)
+	encrypted, err := crypto.Seal(b.sealKey(), pack)
 	if err != nil {
 		return err
 	}
@@ -257,7 +284,7 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 		}
 		b.log.Debug("deleting blob", "hash", h, "exists", exists)
 		if exists {
-			ehash, err := b.index.Get(h)
+			ehash, _, err := b.lookup(h)
 			if err == nil && ehash != "" {
 				if err := bucket.GetObject(ehash).Delete(); err != nil {
 					return fmt.Errorf("failed to remove blob:%s/%s: %v", h, ehash, err)
@@ -265,6 +292,11 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 				if err := b.index.Delete(h); err != nil {
 					return err
 				}
+				if b.rekey != nil {
+					if err := b.rekey.index.Delete(h); err != nil {
+						return err
+					}
+				}
 				b.log.Debug("blob deleted", "hash", h)
 			}
 		}
@@ -357,8 +389,12 @@ func (b *S3Backend) Reindex(restore bool) error {
 
 	if err := bucket.Iter(max, func(object *s3util.Object) error {
 		b.log.Debug("fetching an objects batch from S3")
+		if strings.Contains(object.Key, "/") {
+			// Skip the packs and the WAL segments
+			return nil
+		}
 		ehash := object.Key
-		eblob := s3util.NewEncryptedBlob(object, b.key)
+		eblob := b.encryptedBlob(object)
 		hash, err := eblob.PlainTextHash()
 		if err != nil {
 			return err
@@ -465,7 +501,7 @@ L:
 				b.uploadQueue.Unlock()
 			}
 			if ok {
-				if err := func(blob *blob.Blob) error {
+				err := func(blob *blob.Blob) error {
 					t := time.Now()
 					defer b.uploadQueue.Unlock()
 					b.wg.Add(1)
@@ -500,10 +536,17 @@ L:
 					log.Info("blob uploaded to s3", "hash", blob.Hash, "size", humanize.Bytes(blobSize), "duration", time.Since(t), "uploaded_since_startup", humanize.Bytes(b.uploadedSinceStartup))
 
 					return nil
-				}(blb); err != nil {
-					log.Error("failed to upload blob", "hash", blb.Hash, "err", err)
-					time.Sleep(1 * time.Second)
+				}(blb)
+				if err != nil {
+					// The blob stays in the queue, wait before retrying
+					delay := b.retries.fail(err)
+					log.Error("failed to upload blob", "hash", blb.Hash, "err", err, "retry_in", delay)
+					if !b.retries.wait(delay, b.stop) {
+						break L
+					}
+					continue L
 				}
+				b.retries.success()
 				continue L
 			}
 			time.Sleep(1 * time.Second)
@@ -519,7 +562,7 @@ func (b *S3Backend) put(hash string, data []byte) error {
 	// Encrypt if requested
 	if b.encrypted {
 		var err error
-		data, err = s3util.Seal(b.key, &blob.Blob{Hash: hash, Data: data})
+		data, err = s3util.Seal(b.sealKey(), &blob.Blob{Hash: hash, Data: data})
 		if err != nil {
 			return err
 		}
@@ -540,6 +583,13 @@ func (b *S3Backend) put(hash string, data []byte) error {
 		return err
 	}
 
+	// Sealed with the new key, track it as re-keyed first (see rekeyBlob)
+	if b.rekey != nil {
+		if err := b.rekey.index.Index(hash, ehash); err != nil {
+			return err
+		}
+	}
+
 	// Save the hash in the local index
 	if err := b.index.Index(hash, ehash); err != nil {
 		return nil
@@ -557,13 +607,13 @@ func (b *S3Backend) Exists(hash string) (bool, error) {
 }
 
 func (b *S3Backend) Get(hash string) ([]byte, error) {
-	ehash, err := b.index.Get(hash)
+	ehash, key, err := b.lookup(hash)
 	if err != nil {
 		return nil, err
 	}
 
 	obj := s3util.NewBucket(b.s3, b.bucket).GetObject(ehash)
-	eblob := s3util.NewEncryptedBlob(obj, b.key)
+	eblob := s3util.NewEncryptedBlob(obj, key)
 	fhash, data, err := eblob.HashAndPlainText()
 	if fhash != hash {
 		return nil, fmt.Errorf("hash does not match")
@@ -572,14 +622,32 @@ func (b *S3Backend) Get(hash string) ([]byte, error) {
 	return data, err
 }
 
+// Ping checks the bucket is reachable (the paused uploads are left to the backoff, so a flapping bucket is not hammered)
+func (b *S3Backend) Ping() error {
+	ok, err := s3util.NewBucket(b.s3, b.bucket).Exists()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %q not found", b.bucket)
+	}
+	return nil
+}
+
 func (b *S3Backend) Close() {
 	b.log.Debug("stopping workers")
-	b.stop <- struct{}{}
+	close(b.stop)
 	b.log.Debug("waiting for waitgroup")
 	b.wg.Wait()
 	b.log.Debug("done")
 	b.uploadQueue.Close()
+	if b.walQueue != nil {
+		b.walQueue.Close()
+	}
 	b.log.Debug("queues closed")
 	b.index.Close()
+	if b.rekey != nil {
+		b.rekey.index.Close()
+	}
 	b.log.Debug("s3 backend closed")
 }
@@ -284,14 +284,29 @@ func (o *Object) reader(size int64) (io.ReadCloser, error) {
 }
 
 type EncryptedBlob struct {
-	o   *Object
-	key *[32]byte
+	o        *Object
+	key      *[32]byte
+	fallback *[32]byte
 }
 
 func NewEncryptedBlob(o *Object, key *[32]byte) *EncryptedBlob {
 	return &EncryptedBlob{o: o, key: key}
 }
 
+// WithFallbackKey sets a second key, tried if the blob cannot be decrypted with the first one
+func (b *EncryptedBlob) WithFallbackKey(key *[32]byte) *EncryptedBlob {
+	b.fallback = key
+	return b
+}
+
+func (b *EncryptedBlob) open(data []byte) ([]byte, error) {
+	decoded, err := Open(b.key, data)
+	if err != nil && b.fallback != nil {
+		return Open(b.fallback, data)
+	}
+	return decoded, err
+}
+
 func (b *EncryptedBlob) PlainText() ([]byte, error) {
 	r, err := b.o.Reader()
 	if err != nil {
@@ -307,7 +322,7 @@ func (b *EncryptedBlob) PlainText() ([]byte, error) {
 		return nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
 	}
 
-	decoded, err := Open(b.key, data)
+	decoded, err := b.open(data)
 	if err != nil {
 		return nil, err
 	}
@@ -330,7 +345,7 @@ func (b *EncryptedBlob) HashAndPlainText() (string, []byte, error) {
 		return "", nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
 	}
 
-	decoded, err := Open(b.key, data)
+	decoded, err := b.open(data)
 	if err != nil {
 		return "", nil, err
 	}
@@ -0,0 +1,208 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/queue"
+)
+
+// WAL shipping: every new blob is appended to a disk-backed queue, which is flushed to the bucket as segments (under
+// the `wal/` prefix) every few seconds.
+//
+// Each segment is an object holding one JSON entry per line, named after the time of its first and last entries
+// (zero-padded so the keys are sorted chronologically), allowing to replay the log up to any point in time without
+// waiting for the blobs/packs replication.
+
+// WALPrefix is the prefix of the WAL segments keys
+const WALPrefix = "wal/"
+
+const walMaxSegmentEntries = 1000
+
+// WALEntry holds a single new blob
+type WALEntry struct {
+	Time int64  `json:"t"`
+	Hash string `json:"h"`
+	Size int    `json:"s"`
+	Data []byte `json:"d,omitempty"` // Only set for meta blobs/filetree nodes, data blobs are only referenced
+}
+
+func (b *S3Backend) setupWAL(dir string, interval time.Duration) error {
+	wq, err := queue.New(filepath.Join(dir, "s3-wal.queue"))
+	if err != nil {
+		return err
+	}
+	b.walQueue = wq
+	// Added before starting the worker so a concurrent Close waits for it
+	b.wg.Add(1)
+	go b.walWorker(interval)
+	return nil
+}
+
+// AppendWAL adds the blob to the WAL (a no-op if the WAL shipping is disabled)
+func (b *S3Backend) AppendWAL(blb *blob.Blob) error {
+	if b.walQueue == nil {
+		return nil
+	}
+	e := &WALEntry{
+		Time: time.Now().UTC().UnixNano(),
+		Hash: blb.Hash,
+		Size: len(blb.Data),
+	}
+	if blb.IsMeta() || blb.IsFiletreeNode() {
+		e.Data = blb.Data
+	}
+	_, err := b.walQueue.Enqueue(e)
+	return err
+}
+
+func (b *S3Backend) walWorker(interval time.Duration) {
+	defer b.wg.Done()
+	log := b.log.New("worker", "wal_worker")
+	log.Debug("starting worker")
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			log.Debug("worker stopped")
+			return
+		case <-t.C:
+			// Wait for the bucket to be reachable again
+			if !b.retries.ready() {
+				continue
+			}
+			for {
+				cnt, err := b.shipWALSegment()
+				if err != nil {
+					delay := b.retries.fail(err)
+					log.Error("failed to ship WAL segment", "err", err, "retry_in", delay)
+					break
+				}
+				b.retries.success()
+				if cnt < walMaxSegmentEntries {
+					break
+				}
+			}
+		}
+	}
+}
+
+// shipWALSegment uploads the oldest queued entries as a new segment
+func (b *S3Backend) shipWALSegment() (int, error) {
+	var buf bytes.Buffer
+	var first, last int64
+	cnt, deqFunc, err := b.walQueue.DequeueBatch(walMaxSegmentEntries, func(js []byte) error {
+		e := &WALEntry{}
+		if err := json.Unmarshal(js, e); err != nil {
+			return err
+		}
+		if first == 0 {
+			first = e.Time
+		}
+		last = e.Time
+		buf.Write(js)
+		buf.WriteByte('\n')
+		return nil
+	})
+	if err != nil || cnt == 0 {
+		return 0, err
+	}
+
+	data := buf.Bytes()
+	if b.encrypted {
+		data, err = s3util.Seal(b.sealKey(), &blob.Blob{Hash: hashutil.Compute(data), Data: data})
+		if err != nil {
+			return 0, err
+		}
+	}
+	key := fmt.Sprintf("%s%019d-%019d.jsonl", WALPrefix, first, last)
+	if _, err := b.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		deqFunc(false)
+		return 0, err
+	}
+	deqFunc(true)
+	b.log.Debug("WAL segment shipped", "key", key, "entries", cnt)
+	return cnt, nil
+}
+
+// IterWAL replays the shipped WAL entries, from the oldest one, until the given time (0 means no limit)
+func (b *S3Backend) IterWAL(until int64, f func(*WALEntry) error) error {
+	bucket := s3util.NewBucket(b.s3, b.bucket)
+	var marker string
+	for {
+		objs, err := bucket.ListPrefix(WALPrefix, marker, 100)
+		if err != nil {
+			return err
+		}
+		if len(objs) == 0 {
+			return nil
+		}
+		for _, obj := range objs {
+			marker = obj.Key
+			// The key contains the time of the first entry of the segment
+			start, err := strconv.ParseInt(strings.Split(strings.TrimPrefix(obj.Key, WALPrefix), "-")[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid WAL segment key %q: %v", obj.Key, err)
+			}
+			if until > 0 && start > until {
+				return nil
+			}
+			if err := b.replayWALSegment(obj, until, f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *S3Backend) replayWALSegment(obj *s3util.Object, until int64, f func(*WALEntry) error) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if b.encrypted {
+		data, err = b.open(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// Lines can hold meta blobs
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		e := &WALEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return err
+		}
+		if until > 0 && e.Time > until {
+			return nil
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
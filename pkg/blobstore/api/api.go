@@ -2,14 +2,20 @@ package api // import "a4.io/blobstash/pkg/blobstore/api"
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/gorilla/mux"
 
 	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/audit"
 	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/backend/s3"
 	mblob "a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
@@ -17,18 +23,271 @@ import (
 	"a4.io/blobstash/pkg/stash/store"
 )
 
+// NDJSONMimeType is the content type of the streamed enumerate results (one JSON object per line)
+const NDJSONMimeType = "application/x-ndjson"
+
+// Number of blobs enumerated at once when streaming
+var streamPageSize = 1000
+
+// MaxStatBatchSize is the max number of hashes checked in a single stat batch request
+const MaxStatBatchSize = 10000
+
 type BlobStoreAPI struct {
 	bs store.BlobStore
+
+	// Root blobstore, verified by the verification jobs (the endpoints are disabled if nil)
+	root *blobstore.BlobStore
 }
 
 func New(bs store.BlobStore) *BlobStoreAPI {
-	return &BlobStoreAPI{bs}
+	return &BlobStoreAPI{bs: bs}
+}
+
+// WithRoot enables the verification endpoints on the given root blobstore
+func (bs *BlobStoreAPI) WithRoot(root *blobstore.BlobStore) *BlobStoreAPI {
+	bs.root = root
+	return bs
 }
 
 func (bs *BlobStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/blobs", basicAuth(http.HandlerFunc(bs.enumerateHandler())))
 	r.Handle("/upload", basicAuth(http.HandlerFunc(bs.uploadHandler())))
+	r.Handle("/stat", basicAuth(http.HandlerFunc(bs.statHandler())))
 	r.Handle("/blob/{hash}", basicAuth(http.HandlerFunc(bs.blobHandler())))
+	if bs.root != nil {
+		r.Handle("/verify", basicAuth(http.HandlerFunc(bs.verifyHandler())))
+		r.Handle("/verify/{job}", basicAuth(http.HandlerFunc(bs.verifyJobHandler())))
+		r.Handle("/warm_cache", basicAuth(http.HandlerFunc(bs.warmCacheHandler())))
+		r.Handle("/stats", basicAuth(http.HandlerFunc(bs.statsHandler())))
+		r.Handle("/s3/queue", basicAuth(http.HandlerFunc(bs.s3QueueHandler())))
+		r.Handle("/s3/rekey", basicAuth(http.HandlerFunc(bs.s3RekeyHandler())))
+	}
+}
+
+// statsHandler reports the blobstore stats, including the deduplication ratio (logical vs physical bytes)
+func (bs *BlobStoreAPI) statsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Stat, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		stats, err := bs.root.Stats()
+		if err != nil {
+			panic(err)
+		}
+		dedup, err := bs.root.DedupStats()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"blobs_count":      stats.BlobsCount,
+			"blobs_size":       stats.BlobsSize,
+			"blobsfiles_count": stats.BlobsFilesCount,
+			"blobsfiles_size":  stats.BlobsFilesSize,
+			"dedup":            dedup,
+		})
+	}
+}
+
+// s3RekeyHandler reports the progress of the S3 re-keying job (how many blobs are still encrypted with the old key)
+func (bs *BlobStoreAPI) s3RekeyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Stat, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		status, err := bs.root.S3Rekey()
+		if err != nil {
+			if err == blobstore.ErrRemoteNotAvailable || err == s3.ErrNoRekey {
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, status)
+	}
+}
+
+// s3QueueHandler reports the state of the S3 upload queue (GET), or resumes the uploads paused after a failure (POST)
+func (bs *BlobStoreAPI) s3QueueHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Stat, perms.Blob),
+				perms.Resource(perms.BlobStore, perms.Blob),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			limit, err := httputil.NewQuery(r.URL.Query()).GetIntDefault("limit", 50)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			status, err := bs.root.S3Queue(limit)
+			if err != nil {
+				if err == blobstore.ErrRemoteNotAvailable {
+					httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, status)
+		case "POST":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Blob),
+				perms.Resource(perms.BlobStore, perms.Blob),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if err := bs.root.RetryS3Uploads(); err != nil {
+				if err == blobstore.ErrRemoteNotAvailable {
+					httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// warmCacheHandler exports the hashes of the recently read blobs (GET), or pre-warms the local store with the export
+// of another instance (POST)
+func (bs *BlobStoreAPI) warmCacheHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"hashes": bs.root.ExportWarmCache(),
+			})
+		case "POST":
+			req := &struct {
+				Hashes []string `json:"hashes"`
+			}{}
+			if err := httputil.Unmarshal(r, req); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if len(req.Hashes) > MaxStatBatchSize {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("too many hashes (max %d)", MaxStatBatchSize))
+				return
+			}
+			for _, hash := range req.Hashes {
+				if len(hash) != 64 {
+					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid hash %q", hash))
+					return
+				}
+			}
+			res, err := bs.root.ImportWarmCache(r.Context(), req.Hashes)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, res)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// verifyHandler launches a background verification of all the blobs (POST), or lists the verification jobs (GET)
+func (bs *BlobStoreAPI) verifyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if r.Method == "GET" {
+			// List the jobs
+			reports, err := bs.root.VerifyReports()
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": reports,
+			})
+			return
+		}
+		report, err := bs.root.StartVerify()
+		if err != nil {
+			if err == blobstore.ErrVerifyRunning {
+				httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+				return
+			}
+			panic(err)
+		}
+		w.Header().Set("Location", r.URL.Path+"/"+report.ID)
+		httputil.MarshalAndWrite(r, w, report, httputil.WithStatusCode(http.StatusAccepted))
+	}
+}
+
+// verifyJobHandler returns the progress/report of a verification job
+func (bs *BlobStoreAPI) verifyJobHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		report, ok := bs.root.VerifyReport(mux.Vars(r)["job"])
+		if !ok {
+			httputil.WriteJSONError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		httputil.MarshalAndWrite(r, w, report)
+	}
 }
 
 func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request) {
@@ -58,7 +317,7 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 			//parse the multipart form in the request
 			mr, err := r.MultipartReader()
@@ -88,8 +347,10 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 				}
 				b := &mblob.Blob{Hash: hash, Data: blob}
 				if _, err := bs.bs.Put(ctx, b); err != nil {
-					httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+					httputil.Error(w, err)
+					return
 				}
+				audit.AddRefs(ctx, hash)
 			}
 			// XXX(tsileo): returns a `http.StatusNoContent` here?
 		default:
@@ -98,9 +359,60 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 	}
 }
 
+// statHandler checks the existence of a batch of blobs at once, and returns the missing ones (in the request order)
+func (bs *BlobStoreAPI) statHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Stat, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		req := &struct {
+			Hashes []string `json:"hashes"`
+		}{}
+		if err := httputil.Unmarshal(r, req); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(req.Hashes) > MaxStatBatchSize {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("too many hashes (max %d)", MaxStatBatchSize))
+			return
+		}
+
+		missing := []string{}
+		for _, hash := range req.Hashes {
+			if len(hash) != 64 {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid hash %q", hash))
+				return
+			}
+			exists, err := bs.bs.Stat(ctx, hash)
+			if err != nil {
+				panic(err)
+			}
+			if !exists {
+				missing = append(missing, hash)
+			}
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"missing": missing,
+		})
+	}
+}
+
 func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 		vars := mux.Vars(r)
 		switch r.Method {
 		case "GET":
@@ -113,6 +425,8 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 				auth.Forbidden(w)
 				return
 			}
+			// Requests from the peers are only served from the local blobs
+			ctx = ctxutil.WithPeerFetch(ctx, r.Header.Get(ctxutil.PeerFetchHeader) != "")
 			// FIXME(tsileo): clean this case, skip a decoding/encoding round and return the bytes as is from the
 			// backend storage
 			blob, err := bs.bs.Get(ctx, vars["hash"])
@@ -174,8 +488,10 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 
 			b := &mblob.Blob{Hash: vars["hash"], Data: blob}
 			if _, err := bs.bs.Put(ctx, b); err != nil {
-				httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
+				httputil.Error(w, err)
+				return
 			}
+			audit.AddRefs(ctx, vars["hash"])
 
 			w.WriteHeader(http.StatusCreated)
 		default:
@@ -197,8 +513,12 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 				auth.Forbidden(w)
 				return
 			}
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 			q := httputil.NewQuery(r.URL.Query())
+			if _, ok := r.URL.Query()["start"]; ok || r.Header.Get("Accept") == NDJSONMimeType {
+				bs.streamBlobs(ctx, w, q)
+				return
+			}
 			limit, err := q.GetInt("limit", 50, 1000)
 			if err != nil {
 				httputil.Error(w, err)
@@ -229,3 +549,54 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 		}
 	}
 }
+
+// streamBlobs streams the hash/size pairs (starting from the `start` hash, inclusive) as newline-delimited JSON, the
+// blobs are enumerated page by page so the full blob set is never loaded in memory.
+//
+// An error occurring after the first page is sent is reported as a last `{"error": "..."}` line.
+func (bs *BlobStoreAPI) streamBlobs(ctx context.Context, w http.ResponseWriter, q *httputil.Query) {
+	// 0 means no limit
+	limit, err := q.GetIntDefault("limit", 0)
+	if err != nil {
+		httputil.Error(w, err)
+		return
+	}
+	cursor := q.Get("start")
+	if cursor == "" {
+		cursor = q.Get("cursor")
+	}
+
+	w.Header().Set("Content-Type", NDJSONMimeType)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var sent int
+	for {
+		pageSize := streamPageSize
+		if limit > 0 && limit-sent < pageSize {
+			pageSize = limit - sent
+		}
+		refs, nextCursor, err := bs.bs.Enumerate(ctx, cursor, "\xff", pageSize)
+		if err != nil {
+			if sent == 0 {
+				httputil.Error(w, err)
+				return
+			}
+			enc.Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		for _, ref := range refs {
+			if err := enc.Encode(ref); err != nil {
+				// The client is gone
+				return
+			}
+		}
+		sent += len(refs)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(refs) < pageSize || (limit > 0 && sent >= limit) {
+			return
+		}
+		cursor = nextCursor
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	bsClient "a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestStreamBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_api_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := blobstore.New(logger, true, dir, nil, hub.New(logger, true))
+	check(err)
+	defer bs.Close()
+
+	hashes := []string{}
+	for i := 0; i < 10; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob%d", i)))
+		_, err := bs.Put(context.Background(), b)
+		check(err)
+		hashes = append(hashes, b.Hash)
+	}
+	sort.Strings(hashes)
+
+	// Force several pages
+	streamPageSize = 3
+
+	r := mux.NewRouter()
+	New(bs).Register(r.PathPrefix("/api/blobstore").Subrouter(), func(h http.Handler) http.Handler { return h })
+	server := httptest.NewServer(r)
+	defer server.Close()
+	client := bsClient.New(clientutil.NewClientUtil(server.URL))
+
+	for _, tdata := range []struct {
+		start    string
+		limit    int
+		expected []string
+	}{
+		{"", 0, hashes},
+		{"", 4, hashes[:4]},
+		{hashes[5], 0, hashes[5:]},
+		{hashes[5], 3, hashes[5:8]},
+	} {
+		out := []string{}
+		check(client.Enumerate(context.Background(), tdata.start, tdata.limit, func(ref *bsClient.SizedBlobRef) error {
+			if ref.Size != 5 {
+				t.Errorf("bad size for %s: %d", ref.Hash, ref.Size)
+			}
+			out = append(out, ref.Hash)
+			return nil
+		}))
+		if fmt.Sprintf("%v", out) != fmt.Sprintf("%v", tdata.expected) {
+			t.Errorf("start=%q limit=%d: expected %v, got %v", tdata.start, tdata.limit, tdata.expected, out)
+		}
+	}
+}
+
+func TestStatBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_api_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := blobstore.New(logger, true, dir, nil, hub.New(logger, true))
+	check(err)
+	defer bs.Close()
+
+	hashes := []string{}
+	for i := 0; i < 6; i++ {
+		b := blob.New([]byte(fmt.Sprintf("blob%d", i)))
+		// Only store half of the blobs
+		if i%2 == 0 {
+			_, err := bs.Put(context.Background(), b)
+			check(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+
+	r := mux.NewRouter()
+	New(bs).Register(r.PathPrefix("/api/blobstore").Subrouter(), func(h http.Handler) http.Handler { return h })
+	server := httptest.NewServer(r)
+	defer server.Close()
+	client := bsClient.New(clientutil.NewClientUtil(server.URL))
+
+	missing, err := client.StatBatch(context.Background(), hashes)
+	check(err)
+	expected := []string{hashes[1], hashes[3], hashes[5]}
+	if fmt.Sprintf("%v", missing) != fmt.Sprintf("%v", expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+
+	if _, err := client.StatBatch(context.Background(), []string{"nope"}); err == nil {
+		t.Errorf("invalid hash should fail")
+	}
+}
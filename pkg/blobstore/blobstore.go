@@ -6,6 +6,7 @@ import (
 	"expvar"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
@@ -15,7 +16,10 @@ import (
 	"a4.io/blobstash/pkg/backend/s3"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
+	"a4.io/blobstash/pkg/rangedb"
 )
 
 var (
@@ -51,6 +55,34 @@ type BlobStore struct {
 	back   *blobsfile.BlobsFiles
 	s3back *s3.S3Backend
 
+	// Secondary fast hashes (only recorded for blobs bigger than fastMinSize)
+	fastHashes  *rangedb.RangeDB
+	fastMinSize int
+
+	// Remote instances the missing blobs are fetched from
+	peers []*peer
+
+	// Caching proxy mode (nil if disabled)
+	upstream *upstream
+
+	// Backends health checks (nil if disabled)
+	health *health
+
+	// Called with the latency and the outcome of each backend operation (see the `loadshed` package)
+	observer func(time.Duration, error)
+
+	// Bad blobs served from the replicas (see the verification jobs)
+	verifier *verifier
+
+	// Background jobs (nil until `RegisterJobs` is called)
+	jobs *jobs.Manager
+
+	// Recently read blobs (see the warm cache export)
+	hot *hotBlobs
+
+	// Deduplication counters
+	dedup *dedupCounters
+
 	hub  *hub.Hub
 	root bool
 	stop chan struct{}
@@ -81,13 +113,49 @@ func New(logger log.Logger, root bool, dir string, conf2 *config.Config, hub *hu
 			}
 		}
 	}
+	dedup, err := loadDedupCounters(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the dedup stats: %v", err)
+	}
+	verifier, err := loadVerifier(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the repaired blobs: %v", err)
+	}
 	bs := &BlobStore{
-		back:   back,
-		root:   root,
-		s3back: s3back,
-		hub:    hub,
-		log:    logger,
-		stop:   make(chan struct{}),
+		back:     back,
+		root:     root,
+		s3back:   s3back,
+		hub:      hub,
+		log:      logger,
+		stop:     make(chan struct{}),
+		verifier: verifier,
+		hot:      newHotBlobs(maxHotBlobs),
+		dedup:    dedup,
+	}
+	go bs.flushDedupCounters()
+
+	if root && conf2 != nil {
+		bs.peers = newPeers(conf2.Peers)
+		if conf2.Upstream != nil {
+			if err := bs.setupUpstream(conf2.Upstream, "", filepath.Join(dir, "upstream.queue")); err != nil {
+				return nil, fmt.Errorf("failed to init the upstream push queue: %v", err)
+			}
+		}
+	}
+
+	if root && conf2 != nil && conf2.HealthCheckInterval > 0 {
+		interval := time.Duration(conf2.HealthCheckInterval) * time.Second
+		if err := bs.setupHealthChecks(filepath.Join(dir, "blobs"), filepath.Join(dir, "pending-writes.queue"), interval); err != nil {
+			return nil, fmt.Errorf("failed to init the pending writes queue: %v", err)
+		}
+	}
+
+	if conf2 != nil && conf2.FastVerifyMinSize > 0 {
+		bs.fastMinSize = conf2.FastVerifyMinSize
+		bs.fastHashes, err = rangedb.New(filepath.Join(dir, "fasthashes"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to init the fast hashes index: %v", err)
+		}
 	}
 
 	if bs.root && bs.s3back != nil {
@@ -125,11 +193,30 @@ func (bs *BlobStore) ReplicationEnabled() bool {
 }
 
 func (bs *BlobStore) Close() error {
+	close(bs.stop)
+	if bs.upstream != nil {
+		if err := bs.upstream.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bs.dedup.flush(); err != nil {
+		return err
+	}
 	// TODO(tsileo): improve this
 	if bs.s3back != nil {
 		bs.s3back.Close()
 	}
 
+	if err := bs.closeHealth(); err != nil {
+		return err
+	}
+
+	if bs.fastHashes != nil {
+		if err := bs.fastHashes.Close(); err != nil {
+			return err
+		}
+	}
+
 	if err := bs.back.Close(); err != nil {
 		return err
 	}
@@ -144,6 +231,31 @@ func (bs *BlobStore) S3Stats() (map[string]interface{}, error) {
 	return bs.s3back.Stats()
 }
 
+// S3Queue returns the state of the S3 upload queue, with the `limit` oldest blobs waiting to be uploaded
+func (bs *BlobStore) S3Queue(limit int) (*s3.QueueStatus, error) {
+	if !bs.root || bs.s3back == nil {
+		return nil, ErrRemoteNotAvailable
+	}
+	return bs.s3back.QueueStatus(limit)
+}
+
+// S3Rekey returns the progress of the S3 re-keying job
+func (bs *BlobStore) S3Rekey() (*s3.RekeyStatus, error) {
+	if !bs.root || bs.s3back == nil {
+		return nil, ErrRemoteNotAvailable
+	}
+	return bs.s3back.RekeyStatus()
+}
+
+// RetryS3Uploads resumes the S3 uploads paused after a failure
+func (bs *BlobStore) RetryS3Uploads() error {
+	if !bs.root || bs.s3back == nil {
+		return ErrRemoteNotAvailable
+	}
+	bs.s3back.RetryNow()
+	return nil
+}
+
 func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 	bs.log.Info("OP Put", "hash", blob.Hash, "len", len(blob.Data))
 	var saved bool
@@ -155,43 +267,102 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 
 	exists, err := bs.back.Exists(blob.Hash)
 	if err != nil {
-		return saved, err
+		if bs.primaryHealthy() {
+			return saved, err
+		}
+		exists = false
 	}
 
 	if exists {
 		bs.log.Debug("blob already saved", "hash", blob.Hash)
+		bs.dedup.put(len(blob.Data), true)
 		return saved, nil
 	}
 
-	saved = true
+	// Let the subscribers (e.g. the quotas) reject the blob before it's saved
+	if err := bs.hub.PutBlobEvent(ctx, blob, nil); err != nil {
+		return saved, err
+	}
 
+	// The blob will be saved once the primary backend is back up
+	if !bs.primaryHealthy() {
+		if _, pending := bs.pendingBlob(blob.Hash); pending {
+			bs.dedup.put(len(blob.Data), true)
+			return saved, nil
+		}
+		bs.log.Info("primary backend down, queueing write", "hash", blob.Hash)
+		if err := bs.queueWrite(blob); err != nil {
+			return saved, err
+		}
+		bs.dedup.put(len(blob.Data), false)
+		return true, nil
+	}
+
+	if err := bs.save(ctx, blob); err != nil {
+		return saved, err
+	}
+	bs.dedup.put(len(blob.Data), false)
+	return true, nil
+}
+
+// save writes the blob to the backends, and notifies the hub subscribers
+func (bs *BlobStore) save(ctx context.Context, blob *blob.Blob) error {
 	var specialBlob bool
 	if blob.IsMeta() || blob.IsFiletreeNode() {
 		specialBlob = true
 	}
 
 	// Save the blob
-	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
-		return saved, err
+	start := time.Now()
+	err := bs.back.Put(blob.Hash, blob.Data)
+	bs.observe(start, err)
+	if err != nil {
+		return err
+	}
+
+	if bs.fastHashes != nil && len(blob.Data) >= bs.fastMinSize {
+		if err := bs.fastHashes.Set([]byte(blob.Hash), []byte(hashutil.ComputeFast(blob.Data))); err != nil {
+			return err
+		}
 	}
 
 	// Wait for adding the blob to the S3 replication queue if enabled
 	if bs.root && bs.s3back != nil {
 		if err := bs.s3back.Put(blob.Hash); err != nil {
-			return saved, err
+			return err
 		}
+		if err := bs.s3back.AppendWAL(blob); err != nil {
+			return err
+		}
+	}
+
+	// Push the blob to the upstream in the background (caching proxy mode), the blob is already saved so the error
+	// is only logged
+	if err := bs.queuePush(ctx, blob.Hash); err != nil {
+		bs.log.Error("failed to queue the upstream push", "hash", blob.Hash, "err", err)
 	}
 
 	// Wait for subscribed event completion
 	if err := bs.hub.NewBlobEvent(ctx, blob, nil); err != nil {
-		return saved, err
+		return err
 	}
 
 	writeCountVar.Add(1)
 	writeVar.Add(int64(len(blob.Data)))
 
 	bs.log.Debug("blob saved", "hash", blob.Hash, "special_blob", specialBlob)
-	return saved, nil
+	return nil
+}
+
+// SetLatencyObserver registers a func called with the latency and the outcome of each backend read/write
+func (bs *BlobStore) SetLatencyObserver(f func(time.Duration, error)) {
+	bs.observer = f
+}
+
+func (bs *BlobStore) observe(start time.Time, err error) {
+	if bs.observer != nil {
+		bs.observer(time.Since(start), err)
+	}
 }
 
 func (bs *BlobStore) Stats() (*blobsfile.Stats, error) {
@@ -200,19 +371,86 @@ func (bs *BlobStore) Stats() (*blobsfile.Stats, error) {
 
 func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
 	bs.log.Info("OP Get", "hash", hash)
-	blob, err := bs.back.Get(hash)
+	if data, ok := bs.pendingBlob(hash); ok {
+		return data, nil
+	}
+	var blob []byte
+	var err error
+	if bs.primaryHealthy() && !bs.verifier.servedFromReplicas(hash) {
+		start := time.Now()
+		blob, err = bs.back.Get(hash)
+		if err == blobsfile.ErrBlobNotFound {
+			bs.observe(start, nil)
+		} else {
+			bs.observe(start, err)
+		}
+		if err == blobsfile.ErrBlobNotFound && len(bs.peers) > 0 {
+			blob, err = bs.getFromPeers(ctx, hash)
+		}
+	} else {
+		blob, err = bs.getFromReplicas(ctx, hash)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	readCountVar.Add(1)
 	readVar.Add(int64(len(blob)))
+	bs.hot.touch(hash)
 
 	return blob, err
 }
 
+// FastHash returns the secondary fast hash of the blob, or an empty string if none is recorded
+func (bs *BlobStore) FastHash(ctx context.Context, hash string) (string, error) {
+	if bs.fastHashes == nil {
+		return "", nil
+	}
+	fh, err := bs.fastHashes.Get([]byte(hash))
+	if err != nil {
+		return "", err
+	}
+	return string(fh), nil
+}
+
+// Verify ensures the data match the blob hash, using the fast hash if one is recorded (the blob must already be
+// stored)
+func (bs *BlobStore) Verify(ctx context.Context, hash string, data []byte) error {
+	fh, err := bs.FastHash(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if fh != "" {
+		return hashutil.CheckFast(data, fh)
+	}
+	return (&blob.Blob{Hash: hash, Data: data}).Check()
+}
+
+// Scrub reads back all the blobs and verify their content, returns the number of corrupted blobs
+func (bs *BlobStore) Scrub(ctx context.Context) (int, error) {
+	refs, _, err := bs.Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return 0, err
+	}
+	var corrupted int
+	for _, ref := range refs {
+		data, err := bs.back.Get(ref.Hash)
+		if err != nil {
+			return corrupted, err
+		}
+		if err := bs.Verify(ctx, ref.Hash, data); err != nil {
+			bs.log.Error("corrupted blob", "hash", ref.Hash, "err", err)
+			corrupted++
+		}
+	}
+	return corrupted, nil
+}
+
 func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 	bs.log.Info("OP Stat", "hash", hash)
+	if _, ok := bs.pendingBlob(hash); ok {
+		return true, nil
+	}
 	return bs.back.Exists(hash)
 }
 
@@ -0,0 +1,83 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hub"
+)
+
+const (
+	benchBlobsCount = 256
+	benchBlobSize   = 512 << 10
+)
+
+func setupBench(b *testing.B) (*BlobStore, []string, func()) {
+	dir, err := ioutil.TempDir("", "blobstore_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := New(logger, true, dir, nil, hub.New(logger, true))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	hashes := []string{}
+	for i := 0; i < benchBlobsCount; i++ {
+		data := make([]byte, benchBlobSize)
+		if _, err := rand.Read(data); err != nil {
+			b.Fatal(err)
+		}
+		blob := blob.New(data)
+		if _, err := bs.Put(context.Background(), blob); err != nil {
+			b.Fatal(err)
+		}
+		hashes = append(hashes, blob.Hash)
+	}
+
+	return bs, hashes, func() {
+		bs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// BenchmarkGet reads the blobs sequentially from a single goroutine
+func BenchmarkGet(b *testing.B) {
+	bs, hashes, teardown := setupBench(b)
+	defer teardown()
+
+	b.SetBytes(benchBlobSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bs.Get(context.Background(), hashes[i%len(hashes)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetParallel reads the blobs concurrently (like filetree streaming does), BlobsFile reads use positional
+// reads (`ReadAt`) without holding the backend lock, so the throughput should scale with GOMAXPROCS.
+func BenchmarkGetParallel(b *testing.B) {
+	bs, hashes, teardown := setupBench(b)
+	defer teardown()
+
+	b.SetBytes(benchBlobSize)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, err := bs.Get(context.Background(), hashes[i%len(hashes)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name of the file persisting the deduplication counters (in the blobstore directory)
+const dedupStatsFilename = "dedup_stats.json"
+
+// Interval between the flushes of the deduplication counters
+var dedupFlushInterval = time.Minute
+
+// DedupStats reports the space saved by skipping the writes of the blobs already stored
+type DedupStats struct {
+	Puts         int64 `json:"puts"`          // Blobs written by the clients
+	Deduplicated int64 `json:"deduplicated"`  // Writes skipped as the blob was already stored
+	LogicalSize  int64 `json:"logical_size"`  // Bytes written by the clients (physical + deduplicated)
+	PhysicalSize int64 `json:"physical_size"` // Bytes of the blobs actually stored
+	SavedSize    int64 `json:"saved_size"`
+
+	// Logical size / physical size (1 means no deduplication)
+	Ratio float64 `json:"ratio"`
+}
+
+// dedupCounters holds the persisted counters (the physical size is computed from the BlobsFile stats)
+type dedupCounters struct {
+	Puts         int64 `json:"puts"`
+	Deduplicated int64 `json:"deduplicated"`
+	SavedSize    int64 `json:"saved_size"`
+
+	path  string
+	dirty bool
+	mu    sync.Mutex
+}
+
+func loadDedupCounters(dir string) (*dedupCounters, error) {
+	c := &dedupCounters{path: filepath.Join(dir, dedupStatsFilename)}
+	data, err := ioutil.ReadFile(c.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *dedupCounters) put(size int, deduplicated bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Puts++
+	if deduplicated {
+		c.Deduplicated++
+		c.SavedSize += int64(size)
+	}
+	c.dirty = true
+}
+
+// flush persists the counters if they changed since the last flush
+func (c *dedupCounters) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// flushDedupCounters periodically persists the deduplication counters
+func (bs *BlobStore) flushDedupCounters() {
+	t := time.NewTicker(dedupFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-bs.stop:
+			return
+		case <-t.C:
+			if err := bs.dedup.flush(); err != nil {
+				bs.log.Error("failed to save the dedup stats", "err", err)
+			}
+		}
+	}
+}
+
+// DedupStats returns the deduplication stats (the counters are kept since the first start of this version)
+func (bs *BlobStore) DedupStats() (*DedupStats, error) {
+	stats, err := bs.back.Stats()
+	if err != nil {
+		return nil, err
+	}
+	bs.dedup.mu.Lock()
+	defer bs.dedup.mu.Unlock()
+	out := &DedupStats{
+		Puts:         bs.dedup.Puts,
+		Deduplicated: bs.dedup.Deduplicated,
+		PhysicalSize: stats.BlobsSize,
+		LogicalSize:  stats.BlobsSize + bs.dedup.SavedSize,
+		SavedSize:    bs.dedup.SavedSize,
+		Ratio:        1,
+	}
+	if out.PhysicalSize > 0 {
+		out.Ratio = float64(out.LogicalSize) / float64(out.PhysicalSize)
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestDedupStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_dedup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := New(logger, true, dir, nil, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	b := blob.New([]byte("deduplicated blob"))
+	for i := 0; i < 3; i++ {
+		saved, err := bs.Put(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved != (i == 0) {
+			t.Errorf("only the first write should be saved")
+		}
+	}
+	stats, err := bs.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(b.Data))
+	if stats.Puts != 3 || stats.Deduplicated != 2 || stats.SavedSize != 2*size || stats.LogicalSize != stats.PhysicalSize+2*size || stats.Ratio <= 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// The counters are persisted
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = New(logger, true, dir, nil, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	stats2, err := bs.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats2 != *stats {
+		t.Errorf("the stats should be reloaded, got %+v, expected %+v", stats2, stats)
+	}
+}
+
+func TestDedupStatsRejectedPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_dedup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	errRejected := errors.New("rejected")
+	h.Subscribe(hub.PutBlob, "reject", func(_ context.Context, _ *blob.Blob, _ interface{}) error {
+		return errRejected
+	})
+	bs, err := New(logger, true, dir, nil, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// A rejected write is not counted
+	if _, err := bs.Put(context.Background(), blob.New([]byte("rejected blob"))); err != errRejected {
+		t.Fatalf("expected the blob to be rejected, got %v", err)
+	}
+	stats, err := bs.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Puts != 0 || stats.LogicalSize != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,105 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"strconv"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+// FastHashBackfillJob is the kind of the job recording the fast hashes of the blobs stored before they were enabled
+// (or before the min size was lowered)
+const FastHashBackfillJob = "blobstore.fasthash_backfill"
+
+// Key of the fast hashes index holding the min size of the last complete backfill (the other keys are blob hashes)
+var fastHashBackfillKey = []byte("_backfill")
+
+// fastHashBackfillNeeded returns true if some blobs may miss their fast hash
+func (bs *BlobStore) fastHashBackfillNeeded() (bool, error) {
+	if bs.fastHashes == nil {
+		return false, nil
+	}
+	v, err := bs.fastHashes.Get(fastHashBackfillKey)
+	if err != nil {
+		return false, err
+	}
+	if v == nil {
+		return true, nil
+	}
+	minSize, err := strconv.Atoi(string(v))
+	if err != nil {
+		return false, err
+	}
+	return minSize > bs.fastMinSize, nil
+}
+
+// startFastHashBackfill starts the backfill job if needed (unless an interrupted job is resumed)
+func (bs *BlobStore) startFastHashBackfill() error {
+	needed, err := bs.fastHashBackfillNeeded()
+	if err != nil || !needed {
+		return err
+	}
+	if _, err := bs.jobs.Start(FastHashBackfillJob, nil); err != nil && err != jobs.ErrAlreadyRunning {
+		return err
+	}
+	return nil
+}
+
+// runFastHashBackfill records the missing fast hashes, the blobs are checked against their canonical hash first (the
+// corrupted ones are skipped, the verification job reports them)
+func (bs *BlobStore) runFastHashBackfill(ctx context.Context, h *jobs.Handle) error {
+	var total, done int64
+	if stats, err := bs.back.Stats(); err == nil {
+		total = int64(stats.BlobsCount)
+	}
+	h.SetProgress(0, total)
+
+	var recorded int
+	var cursor string
+	for {
+		refs, next, err := bs.Enumerate(ctx, cursor, "\xff", verifyPageSize)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			done++
+			h.SetProgress(done, total)
+			if ref.Size < bs.fastMinSize {
+				continue
+			}
+			fh, err := bs.FastHash(ctx, ref.Hash)
+			if err != nil {
+				return err
+			}
+			if fh != "" {
+				continue
+			}
+			data, err := bs.back.Get(ref.Hash)
+			if err != nil {
+				return err
+			}
+			if err := (&blob.Blob{Hash: ref.Hash, Data: data}).Check(); err != nil {
+				bs.log.Error("corrupted blob, no fast hash recorded", "hash", ref.Hash, "err", err)
+				continue
+			}
+			if err := bs.fastHashes.Set([]byte(ref.Hash), []byte(hashutil.ComputeFast(data))); err != nil {
+				return err
+			}
+			recorded++
+		}
+		if len(refs) < verifyPageSize {
+			break
+		}
+		cursor = next
+	}
+	bs.log.Info("fast hashes backfilled", "job", h.ID(), "recorded", recorded)
+	if err := h.SetResult(map[string]int{"recorded": recorded}); err != nil {
+		return err
+	}
+	return bs.fastHashes.Set(fastHashBackfillKey, []byte(strconv.Itoa(bs.fastMinSize)))
+}
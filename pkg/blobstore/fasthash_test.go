@@ -0,0 +1,77 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+func TestFastHashBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_fasthash_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	ctx := context.Background()
+
+	// The blobs are stored before the fast hashes are enabled
+	bs, err := New(logger, true, dir, &config.Config{}, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := blob.New([]byte("ab"))
+	big := blob.New([]byte("a bigger blob"))
+	for _, b := range []*blob.Blob{small, big} {
+		if _, err := bs.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err = New(logger, true, dir, &config.Config{FastVerifyMinSize: 3}, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	jm, err := jobs.New(logger, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jm.Close()
+	if err := bs.RegisterJobs(jm); err != nil {
+		t.Fatal(err)
+	}
+	js, err := jm.List(FastHashBackfillJob, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(js) != 1 {
+		t.Fatalf("expected a backfill job, got %+v", js)
+	}
+	if _, err := jm.Wait(ctx, js[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if fh, err := bs.FastHash(ctx, big.Hash); err != nil || fh == "" {
+		t.Errorf("expected a fast hash for the big blob, got %q (err=%v)", fh, err)
+	}
+	if fh, err := bs.FastHash(ctx, small.Hash); err != nil || fh != "" {
+		t.Errorf("expected no fast hash for the small blob, got %q (err=%v)", fh, err)
+	}
+	if needed, err := bs.fastHashBackfillNeeded(); err != nil || needed {
+		t.Errorf("the backfill should be complete (err=%v)", err)
+	}
+}
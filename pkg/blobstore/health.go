@@ -0,0 +1,317 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/queue"
+)
+
+// ErrPendingWritesFull is returned when the primary backend is down and the pending writes queue is full
+var ErrPendingWritesFull = fmt.Errorf("primary backend unavailable and pending writes queue full")
+
+// Max size of the writes queued while the primary backend is down
+var maxPendingSize = 256 << 20
+
+const primaryBackend = "blobsfile"
+
+// Pinger is implemented by the backends supporting health checks
+type Pinger interface {
+	Ping() error
+}
+
+// BackendHealth holds the result of the last health check of a backend
+type BackendHealth struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Since     time.Time `json:"since"` // last status change
+}
+
+// localPinger checks the BlobsFile backend can still write to its directory
+type localPinger struct {
+	dir  string
+	back *blobsfile.BlobsFiles
+}
+
+func (l *localPinger) Ping() error {
+	probe := filepath.Join(l.dir, ".health")
+	if err := ioutil.WriteFile(probe, []byte(time.Now().String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Remove(probe); err != nil {
+		return err
+	}
+	_, err := l.back.Stats()
+	return err
+}
+
+// pendingWrite is a write queued while the primary backend is down
+type pendingWrite struct {
+	Hash string `json:"hash"`
+	Data []byte `json:"data"`
+}
+
+// health runs the periodic health checks, and holds the writes queued while the primary backend is down
+type health struct {
+	backends map[string]Pinger
+	names    []string
+	status   map[string]*BackendHealth
+
+	// The pending writes are persisted in the queue before being acknowledged (and kept in memory so they can be
+	// served until they're flushed)
+	queue        *queue.Queue
+	pending      map[string]*blob.Blob
+	pendingOrder []string
+	pendingSize  int
+
+	// Serializes the flushes (the worker and `Close`)
+	flushMu sync.Mutex
+	closed  bool
+
+	mu sync.Mutex
+}
+
+// newHealth opens the pending writes queue, the writes left by a previous run are reloaded
+func newHealth(queuePath string) (*health, error) {
+	q, err := queue.New(queuePath)
+	if err != nil {
+		return nil, err
+	}
+	h := &health{
+		backends: map[string]Pinger{},
+		status:   map[string]*BackendHealth{},
+		queue:    q,
+		pending:  map[string]*blob.Blob{},
+	}
+	// Load the writes left by a previous run (they stay in the queue until flushed)
+	if _, _, err := q.DequeueBatch(math.MaxInt32, func(js []byte) error {
+		pw := &pendingWrite{}
+		if err := json.Unmarshal(js, pw); err != nil {
+			return err
+		}
+		h.pending[pw.Hash] = &blob.Blob{Hash: pw.Hash, Data: pw.Data}
+		h.pendingOrder = append(h.pendingOrder, pw.Hash)
+		h.pendingSize += len(pw.Data)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *health) add(name string, p Pinger) {
+	h.backends[name] = p
+	h.names = append(h.names, name)
+	// Assume the backends are healthy until the first check
+	h.status[name] = &BackendHealth{Name: name, Healthy: true, Since: time.Now()}
+}
+
+// check pings all the backends and returns true if the primary backend is back up
+func (h *health) check() bool {
+	var recovered bool
+	for _, name := range h.names {
+		err := h.backends[name].Ping()
+		now := time.Now()
+
+		h.mu.Lock()
+		st := h.status[name]
+		healthy := err == nil
+		if healthy != st.Healthy {
+			st.Since = now
+			if name == primaryBackend && healthy {
+				recovered = true
+			}
+		}
+		st.Healthy = healthy
+		st.CheckedAt = now
+		st.LastError = ""
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		h.mu.Unlock()
+	}
+	return recovered
+}
+
+func (h *health) healthy(name string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.status[name]
+	return !ok || st.Healthy
+}
+
+// Health returns the status of the backends (nil if the health checks are disabled)
+func (bs *BlobStore) Health() []*BackendHealth {
+	if bs.health == nil {
+		return nil
+	}
+	bs.health.mu.Lock()
+	defer bs.health.mu.Unlock()
+	out := []*BackendHealth{}
+	for _, name := range bs.health.names {
+		st := *bs.health.status[name]
+		out = append(out, &st)
+	}
+	return out
+}
+
+// PendingWrites returns the number of blobs queued while the primary backend is down
+func (bs *BlobStore) PendingWrites() int {
+	if bs.health == nil {
+		return 0
+	}
+	bs.health.mu.Lock()
+	defer bs.health.mu.Unlock()
+	return len(bs.health.pendingOrder)
+}
+
+// setupHealthChecks registers the backends and starts the health worker
+func (bs *BlobStore) setupHealthChecks(dir, queuePath string, interval time.Duration) error {
+	var err error
+	bs.health, err = newHealth(queuePath)
+	if err != nil {
+		return err
+	}
+	bs.health.add(primaryBackend, &localPinger{dir: dir, back: bs.back})
+	if bs.s3back != nil {
+		bs.health.add("s3", bs.s3back)
+	}
+	for _, p := range bs.peers {
+		bs.health.add("peer:"+p.url, p)
+	}
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-bs.stop:
+				return
+			case <-t.C:
+				recovered := bs.health.check()
+				if !bs.primaryHealthy() {
+					bs.log.Error("primary backend unhealthy, failing over", "pending_writes", bs.PendingWrites())
+					continue
+				}
+				if recovered || bs.PendingWrites() > 0 {
+					bs.flushPendingWrites()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// closeHealth flushes the pending writes if the primary backend is up, the remaining ones are kept in the queue
+// until the next start
+func (bs *BlobStore) closeHealth() error {
+	if bs.health == nil {
+		return nil
+	}
+	if bs.primaryHealthy() && bs.PendingWrites() > 0 {
+		bs.flushPendingWrites()
+	}
+	bs.health.flushMu.Lock()
+	defer bs.health.flushMu.Unlock()
+	bs.health.closed = true
+	return bs.health.queue.Close()
+}
+
+func (bs *BlobStore) primaryHealthy() bool {
+	return bs.health.healthy(primaryBackend)
+}
+
+// queueWrite persists the blob in the pending writes queue until the primary backend is back up
+func (bs *BlobStore) queueWrite(blb *blob.Blob) error {
+	bs.health.mu.Lock()
+	defer bs.health.mu.Unlock()
+	if _, ok := bs.health.pending[blb.Hash]; ok {
+		return nil
+	}
+	if bs.health.pendingSize+len(blb.Data) > maxPendingSize {
+		return ErrPendingWritesFull
+	}
+	if _, err := bs.health.queue.Enqueue(&pendingWrite{Hash: blb.Hash, Data: blb.Data}); err != nil {
+		return fmt.Errorf("failed to queue the write: %w", err)
+	}
+	bs.health.pending[blb.Hash] = blb
+	bs.health.pendingOrder = append(bs.health.pendingOrder, blb.Hash)
+	bs.health.pendingSize += len(blb.Data)
+	return nil
+}
+
+// pendingBlob returns the blob if it's waiting to be written
+func (bs *BlobStore) pendingBlob(hash string) ([]byte, bool) {
+	if bs.health == nil {
+		return nil, false
+	}
+	bs.health.mu.Lock()
+	defer bs.health.mu.Unlock()
+	if blb, ok := bs.health.pending[hash]; ok {
+		return blb.Data, true
+	}
+	return nil, false
+}
+
+// flushPendingWrites saves the queued blobs (in order), it stops at the first error
+func (bs *BlobStore) flushPendingWrites() {
+	bs.health.flushMu.Lock()
+	defer bs.health.flushMu.Unlock()
+	for !bs.health.closed {
+		pw := &pendingWrite{}
+		ok, deqFunc, err := bs.health.queue.Dequeue(pw)
+		if err != nil {
+			bs.log.Error("failed to dequeue pending write", "err", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		blb := &blob.Blob{Hash: pw.Hash, Data: pw.Data}
+
+		if err := bs.save(context.Background(), blb); err != nil {
+			bs.log.Error("failed to flush pending write", "hash", blb.Hash, "err", err)
+			return
+		}
+		deqFunc(true)
+
+		bs.health.mu.Lock()
+		delete(bs.health.pending, blb.Hash)
+		bs.health.pendingOrder = bs.health.pendingOrder[1:]
+		bs.health.pendingSize -= len(blb.Data)
+		bs.health.mu.Unlock()
+		bs.log.Info("pending write flushed", "hash", blb.Hash)
+	}
+}
+
+// getFromReplicas fetches the blob from the S3 replica or the peers while the primary backend is down
+func (bs *BlobStore) getFromReplicas(ctx context.Context, hash string) ([]byte, error) {
+	if bs.s3back != nil && bs.health.healthy("s3") {
+		if exists, err := bs.s3back.Exists(hash); err == nil && exists {
+			data, err := bs.s3back.Get(hash)
+			if err == nil {
+				return data, nil
+			}
+			bs.log.Error("failed to fetch blob from the S3 replica", "hash", hash, "err", err)
+		}
+	}
+	if len(bs.peers) > 0 {
+		return bs.getFromPeers(ctx, hash)
+	}
+	return nil, blobsfile.ErrBlobNotFound
+}
@@ -0,0 +1,105 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hub"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (p *fakePinger) Ping() error {
+	return p.err
+}
+
+func TestFailover(t *testing.T) {
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "blobstore_health_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := New(logger, true, dir, nil, hub.New(logger, true))
+	check(err)
+	defer bs.Close()
+
+	primary := &fakePinger{err: errors.New("disk failure")}
+	queuePath := filepath.Join(dir, "pending-writes.queue")
+	bs.health, err = newHealth(queuePath)
+	check(err)
+	bs.health.add(primaryBackend, primary)
+	if recovered := bs.health.check(); recovered {
+		t.Errorf("primary should not be recovered")
+	}
+	if st := bs.Health(); len(st) != 1 || st[0].Healthy || st[0].LastError != "disk failure" {
+		t.Errorf("unexpected health %+v", st[0])
+	}
+
+	ctx := context.Background()
+	b := blob.New([]byte("hello"))
+	saved, err := bs.Put(ctx, b)
+	check(err)
+	if !saved || bs.PendingWrites() != 1 {
+		t.Errorf("write should be queued")
+	}
+	if exists, _ := bs.back.Exists(b.Hash); exists {
+		t.Errorf("blob should not be written yet")
+	}
+	// The queued blob is readable
+	data, err := bs.Get(ctx, b.Hash)
+	check(err)
+	if string(data) != "hello" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if exists, err := bs.Stat(ctx, b.Hash); err != nil || !exists {
+		t.Errorf("queued blob should exist")
+	}
+
+	// The queue is bounded
+	maxPendingSize = 10
+	defer func() { maxPendingSize = 256 << 20 }()
+	if _, err := bs.Put(ctx, blob.New([]byte("too large for the queue"))); err != ErrPendingWritesFull {
+		t.Errorf("expected ErrPendingWritesFull, got %v", err)
+	}
+
+	// The queued writes survive a restart
+	check(bs.health.queue.Close())
+	bs.health, err = newHealth(queuePath)
+	check(err)
+	bs.health.add(primaryBackend, primary)
+	bs.health.check()
+	if bs.PendingWrites() != 1 {
+		t.Errorf("the queued write should be reloaded")
+	}
+
+	// Recover and flush the queue
+	primary.err = nil
+	if recovered := bs.health.check(); !recovered {
+		t.Errorf("primary should be recovered")
+	}
+	bs.flushPendingWrites()
+	if bs.PendingWrites() != 0 {
+		t.Errorf("queue should be empty")
+	}
+	if exists, _ := bs.back.Exists(b.Hash); !exists {
+		t.Errorf("blob should be written")
+	}
+	if size, err := bs.health.queue.Size(); err != nil || size != 0 {
+		t.Errorf("the persisted queue should be empty, got %d (%v)", size, err)
+	}
+}
@@ -0,0 +1,95 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"net/http"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/blob"
+	bsClient "a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+)
+
+// peer is a remote instance the missing blobs are fetched from
+type peer struct {
+	url    string
+	client *clientutil.ClientUtil
+	bs     *bsClient.BlobStore
+	cache  bool
+
+	// The upstream of the caching proxy mode (the cached blobs are not pushed back to it)
+	upstream bool
+}
+
+func newPeers(conf []*config.Peer) []*peer {
+	peers := []*peer{}
+	for _, p := range conf {
+		client := clientutil.NewClientUtil(
+			p.URL,
+			clientutil.WithAPIKey(p.APIKey),
+			clientutil.WithHeader(ctxutil.PeerFetchHeader, "1"),
+		)
+		peers = append(peers, &peer{
+			url:    p.URL,
+			client: client,
+			bs:     bsClient.New(client),
+			cache:  p.Cache,
+		})
+	}
+	return peers
+}
+
+// Ping checks the peer is up
+func (p *peer) Ping() error {
+	resp, err := p.client.Get("/api/ping")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getFromPeers fetches a blob missing locally from the peers, the first peer returning the blob wins.
+//
+// The peers are not trusted: the blob is checked against its hash, and if the blob is cached, it goes through the
+// regular `Put` (quotas, hub subscribers...).
+func (bs *BlobStore) getFromPeers(ctx context.Context, hash string) ([]byte, error) {
+	if ctxutil.PeerFetch(ctx) {
+		return nil, blobsfile.ErrBlobNotFound
+	}
+	for _, p := range bs.peers {
+		data, err := p.bs.Get(ctx, hash)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound:
+			continue
+		default:
+			bs.log.Error("failed to fetch blob from peer", "peer", p.url, "hash", hash, "err", err)
+			continue
+		}
+
+		b := &blob.Blob{Hash: hash, Data: data}
+		if err := b.Check(); err != nil {
+			bs.log.Error("peer returned an invalid blob", "peer", p.url, "hash", hash, "err", err)
+			continue
+		}
+		bs.log.Info("blob fetched from peer", "peer", p.url, "hash", hash)
+		if p.cache {
+			putCtx := ctx
+			if p.upstream {
+				putCtx = context.WithValue(ctx, upstreamFetchKey, true)
+			}
+			if _, err := bs.Put(putCtx, b); err != nil {
+				bs.log.Error("failed to cache blob fetched from peer", "peer", p.url, "hash", hash, "err", err)
+			}
+		}
+		return data, nil
+	}
+	return nil, blobsfile.ErrBlobNotFound
+}
@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestGetFromPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_peers_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := blob.New([]byte("remote blob"))
+	corrupted := blob.New([]byte("corrupted blob"))
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get(ctxutil.PeerFetchHeader) == "" {
+			t.Errorf("missing peer fetch header")
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/") {
+		case remote.Hash:
+			w.Write(remote.Data)
+		case corrupted.Hash:
+			w.Write([]byte("not the blob"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{Peers: []*config.Peer{{URL: server.URL, Cache: true}}}
+	bs, err := New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx := context.Background()
+	data, err := bs.Get(ctx, remote.Hash)
+	if err != nil || string(data) != string(remote.Data) {
+		t.Fatalf("failed to fetch blob from peer: %v", err)
+	}
+	if exists, _ := bs.back.Exists(remote.Hash); !exists {
+		t.Errorf("the blob should be cached locally")
+	}
+
+	if _, err := bs.Get(ctx, corrupted.Hash); err != blobsfile.ErrBlobNotFound {
+		t.Errorf("invalid blobs from peers must be rejected, got %v", err)
+	}
+	if _, err := bs.Get(ctx, blob.New([]byte("missing")).Hash); err != blobsfile.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	// Peers must only be served the local blobs
+	before := hits
+	if _, err := bs.Get(ctxutil.WithPeerFetch(ctx, true), corrupted.Hash); err != blobsfile.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+	if hits != before {
+		t.Errorf("a peer fetch should not query the peers")
+	}
+}
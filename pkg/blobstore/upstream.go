@@ -0,0 +1,226 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	bsClient "a4.io/blobstash/pkg/client/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/queue"
+)
+
+// Delay before checking the push queue again once it's empty
+var upstreamQueueWait = 1 * time.Second
+
+// Maximum delay between two push attempts while the upstream is unreachable
+var upstreamMaxBackoff = 1 * time.Minute
+
+type upstreamFetchKeyType struct{}
+
+var upstreamFetchKey = upstreamFetchKeyType{}
+
+// fromUpstream returns true if the blob being saved was fetched from the upstream (it must not be pushed back)
+func fromUpstream(ctx context.Context) bool {
+	v, _ := ctx.Value(upstreamFetchKey).(bool)
+	return v
+}
+
+// upstream pushes the blobs saved locally to the proxied instance, the hashes are queued on disk so the pending pushes
+// survive a restart
+type upstream struct {
+	conf  *config.Upstream
+	peer  *peer
+	queue *queue.Queue
+
+	stop chan struct{}
+	done chan struct{}
+	log  log.Logger
+}
+
+// pushItem is a queued push (the blob is read back from the local backend when pushed)
+type pushItem struct {
+	Hash string `json:"hash"`
+
+	// Failed pushes are retried with a backoff, the item is enqueued again at its retry date (Unix nano timestamp)
+	Attempts int   `json:"attempts,omitempty"`
+	RetryAt  int64 `json:"retry_at,omitempty"`
+}
+
+// errUnreadableBlob is returned when the blob to push cannot be read back from the local backend
+var errUnreadableBlob = errors.New("failed to read the local blob")
+
+// UpstreamStatus reports the state of the caching proxy mode
+type UpstreamStatus struct {
+	URL     string `json:"url"`
+	Pending int    `json:"pending_pushes"`
+}
+
+// setupUpstream enables the caching proxy mode, the blobs are fetched from/pushed to the given namespace of the
+// upstream (the root namespace if empty)
+func (bs *BlobStore) setupUpstream(conf *config.Upstream, namespace, path string) error {
+	q, err := queue.New(path)
+	if err != nil {
+		return err
+	}
+	opts := []func(*http.Request) error{
+		clientutil.WithAPIKey(conf.APIKey),
+		clientutil.WithHeader(ctxutil.PeerFetchHeader, "1"),
+	}
+	if namespace != "" {
+		opts = append(opts, clientutil.WithNamespace(namespace))
+	}
+	client := clientutil.NewClientUtil(conf.URL, opts...)
+	p := &peer{
+		url:      conf.URL,
+		client:   client,
+		bs:       bsClient.New(client),
+		cache:    true,
+		upstream: true,
+	}
+	bs.upstream = &upstream{
+		conf:  conf,
+		peer:  p,
+		queue: q,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		log:   bs.log.New("submodule", "upstream", "upstream", conf.URL, "namespace", namespace),
+	}
+	// The upstream is queried before the peers
+	bs.peers = append([]*peer{p}, bs.peers...)
+	go bs.pushWorker()
+	return nil
+}
+
+// ProxyUpstream enables the caching proxy mode of the root BlobStore (if enabled) on a namespace BlobStore, its blobs
+// are fetched from/pushed to the same namespace on the upstream
+func (bs *BlobStore) ProxyUpstream(root *BlobStore, namespace, path string) error {
+	if root == nil || root.upstream == nil {
+		return nil
+	}
+	return bs.setupUpstream(root.upstream.conf, namespace, path)
+}
+
+// UpstreamStatus returns the state of the caching proxy mode (nil if disabled)
+func (bs *BlobStore) UpstreamStatus() (*UpstreamStatus, error) {
+	if bs.upstream == nil {
+		return nil, nil
+	}
+	pending, err := bs.upstream.queue.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamStatus{URL: bs.upstream.peer.url, Pending: pending}, nil
+}
+
+// queuePush schedules the push of the blob to the upstream
+func (bs *BlobStore) queuePush(ctx context.Context, hash string) error {
+	if bs.upstream == nil || fromUpstream(ctx) {
+		return nil
+	}
+	_, err := bs.upstream.queue.Enqueue(&pushItem{Hash: hash})
+	return err
+}
+
+// pushBackoff returns the delay before the next attempt of a push that failed `attempts` times
+func pushBackoff(attempts int) time.Duration {
+	backoff := upstreamQueueWait
+	for i := 1; i < attempts && backoff < upstreamMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > upstreamMaxBackoff {
+		backoff = upstreamMaxBackoff
+	}
+	return backoff
+}
+
+func (bs *BlobStore) pushWorker() {
+	up := bs.upstream
+	defer close(up.done)
+	for {
+		select {
+		case <-up.stop:
+			return
+		default:
+		}
+
+		item := &pushItem{}
+		ok, deqFunc, err := up.queue.Dequeue(item)
+		if err != nil {
+			up.log.Error("failed to dequeue", "err", err)
+		}
+		wait := upstreamQueueWait
+		if ok && err == nil && item.RetryAt > 0 {
+			// The items are ordered by retry date, none of them is due yet
+			if delay := time.Until(time.Unix(0, item.RetryAt)); delay > 0 {
+				ok = false
+				if delay < wait {
+					wait = delay
+				}
+			}
+		}
+		if !ok || err != nil {
+			select {
+			case <-up.stop:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		err = bs.push(item.Hash)
+		switch {
+		case err == nil:
+			deqFunc(true)
+		case errors.Is(err, errUnreadableBlob):
+			// Retrying would block the queue forever
+			up.log.Error("dropping the push of an unreadable blob", "hash", item.Hash, "err", err)
+			deqFunc(true)
+		default:
+			// Move the blob behind the other pushes, and retry it later
+			item.Attempts++
+			retryAt := time.Now().Add(pushBackoff(item.Attempts))
+			item.RetryAt = retryAt.UnixNano()
+			up.log.Error("failed to push blob", "hash", item.Hash, "err", err, "attempts", item.Attempts, "retry_at", retryAt)
+			if _, err := up.queue.EnqueueAt(item, retryAt); err != nil {
+				up.log.Error("failed to requeue the push", "hash", item.Hash, "err", err)
+				deqFunc(false)
+				continue
+			}
+			deqFunc(true)
+		}
+	}
+}
+
+func (bs *BlobStore) push(hash string) error {
+	up := bs.upstream
+	ctx := context.Background()
+	exists, err := up.peer.bs.Stat(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	data, err := bs.back.Get(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnreadableBlob, err)
+	}
+	if err := up.peer.bs.Put(ctx, hash, data); err != nil {
+		return err
+	}
+	up.log.Debug("blob pushed", "hash", hash)
+	return nil
+}
+
+func (up *upstream) Close() error {
+	close(up.stop)
+	<-up.done
+	return up.queue.Close()
+}
@@ -0,0 +1,181 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_upstream_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstreamQueueWait = 10 * time.Millisecond
+
+	remote := blob.New([]byte("remote blob"))
+	var mu sync.Mutex
+	blobs := map[string][]byte{remote.Hash: remote.Data}
+	namespaces := map[string]string{}
+	var down bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		hash := strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/")
+		if r.Method == "POST" {
+			namespaces[hash] = r.Header.Get("BlobStash-Namespace")
+		}
+		data, ok := blobs[hash]
+		switch r.Method {
+		case "POST":
+			encoded, _ := ioutil.ReadAll(r.Body)
+			data, err := snappy.Decode(nil, encoded)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			blobs[hash] = data
+			w.WriteHeader(http.StatusCreated)
+		case "HEAD":
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{Upstream: &config.Upstream{URL: server.URL}}
+	bs, err := New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ctx := context.Background()
+
+	// Gets are served from the upstream and cached, without being pushed back
+	data, err := bs.Get(ctx, remote.Hash)
+	if err != nil || string(data) != string(remote.Data) {
+		t.Fatalf("failed to fetch blob from upstream: %v", err)
+	}
+	if exists, _ := bs.back.Exists(remote.Hash); !exists {
+		t.Errorf("the blob should be cached locally")
+	}
+	status, err := bs.UpstreamStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Pending != 0 {
+		t.Errorf("the cached blobs must not be pushed, got %d pending", status.Pending)
+	}
+
+	// Puts are saved locally and pushed in the background, even while the upstream is down
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	// A blob missing locally must not block the next pushes
+	if err := bs.queuePush(ctx, blob.New([]byte("missing blob")).Hash); err != nil {
+		t.Fatal(err)
+	}
+	local := blob.New([]byte("local blob"))
+	if _, err := bs.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := bs.Get(ctx, local.Hash); err != nil || string(data) != string(local.Data) {
+		t.Fatalf("failed to get the local blob: %v", err)
+	}
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		pushed := string(blobs[local.Hash]) == string(local.Data)
+		mu.Unlock()
+		if pushed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the blob was not pushed upstream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The namespaces are pushed to the same namespace upstream
+	nsDir, err := ioutil.TempDir("", "blobstore_upstream_ns_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(nsDir)
+	nsbs, err := New(logger, false, nsDir, nil, hub.New(logger, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nsbs.Close()
+	if err := nsbs.ProxyUpstream(bs, "myns", nsDir+"/upstream.queue"); err != nil {
+		t.Fatal(err)
+	}
+	nsBlob := blob.New([]byte("namespace blob"))
+	if _, err := nsbs.Put(ctx, nsBlob); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		mu.Lock()
+		ns, pushed := namespaces[nsBlob.Hash]
+		mu.Unlock()
+		if pushed {
+			if ns != "myns" {
+				t.Errorf("expected the blob to be pushed to the namespace, got %q", ns)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the namespace blob was not pushed upstream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The unreadable blob was dropped
+	for {
+		status, err := bs.UpstreamStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the unreadable blob is still queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,306 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+// ErrVerifyRunning is returned when a verification job is already running
+var ErrVerifyRunning = errors.New("a verification job is already running")
+
+// ErrNoJobs is returned when starting a job before the jobs are registered
+var ErrNoJobs = errors.New("jobs not registered")
+
+// Number of blobs enumerated at once by the verification jobs
+var verifyPageSize = 1000
+
+// VerifyJob is the kind of the verification jobs
+const VerifyJob = "blobstore.verify"
+
+// Verification job states
+const (
+	VerifyRunning  = jobs.Running
+	VerifyDone     = jobs.Done
+	VerifyFailed   = jobs.Failed
+	VerifyCanceled = jobs.Canceled
+)
+
+// VerifyReport holds the progress and the result of a verification job
+type VerifyReport struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	Total   int `json:"total"`
+	Checked int `json:"checked"`
+
+	verifyResult
+}
+
+// verifyResult holds the bad blobs found by a verification job (the job result)
+type verifyResult struct {
+	// Blobs whose content does not match their hash
+	Corrupted []string `json:"corrupted"`
+	// Indexed blobs that cannot be read back
+	Missing []string `json:"missing"`
+
+	// Bad blobs for which a valid copy was fetched from the replicas
+	Repaired []string `json:"repaired"`
+}
+
+func newVerifyReport(j *jobs.Job) *VerifyReport {
+	r := &VerifyReport{
+		ID:         j.ID,
+		State:      j.State,
+		Error:      j.Error,
+		StartedAt:  j.CreatedAt,
+		FinishedAt: j.FinishedAt,
+		Total:      int(j.Progress.Total),
+		Checked:    int(j.Progress.Done),
+		verifyResult: verifyResult{
+			Corrupted: []string{},
+			Missing:   []string{},
+			Repaired:  []string{},
+		},
+	}
+	if len(j.Result) > 0 {
+		if err := json.Unmarshal(j.Result, &r.verifyResult); err != nil {
+			r.Error = err.Error()
+		}
+	}
+	return r
+}
+
+// Name of the file persisting the blobs served from the replicas (in the blobstore directory)
+const fromReplicasFilename = "from_replicas.json"
+
+// verifier holds the blobs now served from the replicas, the set is persisted as the bad local blobs stay bad after
+// a restart
+type verifier struct {
+	// Bad local blobs that have a valid copy in the replicas
+	fromReplicas map[string]bool
+
+	path string
+	mu   sync.Mutex
+}
+
+func loadVerifier(dir string) (*verifier, error) {
+	v := &verifier{
+		fromReplicas: map[string]bool{},
+		path:         filepath.Join(dir, fromReplicasFilename),
+	}
+	data, err := ioutil.ReadFile(v.path)
+	switch {
+	case err == nil:
+		hashes := []string{}
+		if err := json.Unmarshal(data, &hashes); err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			v.fromReplicas[hash] = true
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return v, nil
+}
+
+// add marks the blob as served from the replicas, and persists the set
+func (v *verifier) add(hash string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.fromReplicas[hash] {
+		return nil
+	}
+	v.fromReplicas[hash] = true
+	hashes := make([]string, 0, len(v.fromReplicas))
+	for h := range v.fromReplicas {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+func (v *verifier) servedFromReplicas(hash string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fromReplicas[hash]
+}
+
+// RegisterJobs registers the BlobStore jobs (the verification, the fast hashes backfill, and the S3 re-keying) on the
+// jobs manager
+func (bs *BlobStore) RegisterJobs(m *jobs.Manager) error {
+	bs.jobs = m
+	if err := m.RegisterKind(&jobs.Kind{
+		Name:      VerifyJob,
+		Run:       bs.runVerify,
+		Exclusive: true,
+	}); err != nil {
+		return err
+	}
+	if bs.fastHashes != nil {
+		if err := m.RegisterKind(&jobs.Kind{
+			Name:      FastHashBackfillJob,
+			Run:       bs.runFastHashBackfill,
+			Retry:     jobs.RetryPolicy{MaxAttempts: 3, Backoff: time.Minute},
+			Exclusive: true,
+		}); err != nil {
+			return err
+		}
+		if err := bs.startFastHashBackfill(); err != nil {
+			return err
+		}
+	}
+	if bs.s3back != nil {
+		return bs.s3back.RegisterJobs(m)
+	}
+	return nil
+}
+
+// StartVerify launches a background job that reads back every stored blob and checks it against its hash.
+//
+// A valid copy of the missing/corrupted blobs is looked up in the replicas (S3 replica or peers), as BlobsFile cannot
+// overwrite an indexed blob, the repaired blobs are served from the replicas from then on.
+func (bs *BlobStore) StartVerify() (*VerifyReport, error) {
+	if bs.jobs == nil {
+		return nil, ErrNoJobs
+	}
+	job, err := bs.jobs.Start(VerifyJob, nil)
+	if err != nil {
+		if err == jobs.ErrAlreadyRunning {
+			return nil, ErrVerifyRunning
+		}
+		return nil, err
+	}
+	return newVerifyReport(job), nil
+}
+
+// VerifyReport returns the report of the given verification job
+func (bs *BlobStore) VerifyReport(id string) (*VerifyReport, bool) {
+	if bs.jobs == nil {
+		return nil, false
+	}
+	job, err := bs.jobs.Get(id)
+	if err != nil || job.Kind != VerifyJob {
+		return nil, false
+	}
+	return newVerifyReport(job), true
+}
+
+// VerifyReports returns the reports of all the verification jobs, the most recent first
+func (bs *BlobStore) VerifyReports() ([]*VerifyReport, error) {
+	out := []*VerifyReport{}
+	if bs.jobs == nil {
+		return out, nil
+	}
+	js, err := bs.jobs.List(VerifyJob, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range js {
+		out = append(out, newVerifyReport(j))
+	}
+	return out, nil
+}
+
+func (bs *BlobStore) runVerify(ctx context.Context, h *jobs.Handle) error {
+	var total, checked int64
+	if stats, err := bs.back.Stats(); err == nil {
+		total = int64(stats.BlobsCount)
+	}
+	h.SetProgress(0, total)
+	res := &verifyResult{
+		Corrupted: []string{},
+		Missing:   []string{},
+		Repaired:  []string{},
+	}
+
+	var cursor string
+	for {
+		refs, next, err := bs.Enumerate(ctx, cursor, "\xff", verifyPageSize)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if bs.verifyBlob(ctx, res, ref.Hash) {
+				if err := h.SetResult(res); err != nil {
+					return err
+				}
+			}
+			checked++
+			h.SetProgress(checked, total)
+		}
+		if len(refs) < verifyPageSize {
+			break
+		}
+		cursor = next
+	}
+	bs.log.Info("verification done", "job", h.ID(), "checked", checked, "bad", len(res.Corrupted)+len(res.Missing))
+	return h.SetResult(res)
+}
+
+// verifyBlob checks a single blob, and tries to repair it from the replicas (returns true if the blob is bad)
+func (bs *BlobStore) verifyBlob(ctx context.Context, res *verifyResult, hash string) bool {
+	var missing bool
+	data, err := bs.back.Get(hash)
+	if err != nil {
+		missing = true
+	} else {
+		err = bs.Verify(ctx, hash, data)
+	}
+	if err == nil {
+		return false
+	}
+
+	bs.log.Error("bad blob", "hash", hash, "missing", missing, "err", err)
+	if missing {
+		res.Missing = append(res.Missing, hash)
+	} else {
+		res.Corrupted = append(res.Corrupted, hash)
+	}
+	if bs.repairBlob(ctx, hash) {
+		res.Repaired = append(res.Repaired, hash)
+	}
+	return true
+}
+
+// repairBlob looks up a valid copy of the blob in the replicas
+func (bs *BlobStore) repairBlob(ctx context.Context, hash string) bool {
+	data, err := bs.getFromReplicas(ctx, hash)
+	if err != nil {
+		return false
+	}
+	b := &blob.Blob{Hash: hash, Data: data}
+	if err := b.Check(); err != nil {
+		bs.log.Error("replica returned an invalid blob", "hash", hash, "err", err)
+		return false
+	}
+	if err := bs.verifier.add(hash); err != nil {
+		bs.log.Error("failed to save the repaired blob", "hash", hash, "err", err)
+		return false
+	}
+	return true
+}
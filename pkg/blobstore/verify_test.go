@@ -0,0 +1,107 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_verify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bad := blob.New([]byte("a blob that will be corrupted"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/") == bad.Hash {
+			w.Write(bad.Data)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{
+		Peers:             []*config.Peer{{URL: server.URL}},
+		FastVerifyMinSize: 1,
+	}
+	bs, err := New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	jm, err := jobs.New(logger, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jm.Close()
+	if err := bs.RegisterJobs(jm); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	verifyPageSize = 2
+	defer func() { verifyPageSize = 1000 }()
+	for _, data := range []string{"blob1", "blob2", "blob3", "blob4"} {
+		if _, err := bs.Put(ctx, blob.New([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bs.Put(ctx, bad); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the recorded fast hash so the verification fails
+	if err := bs.fastHashes.Set([]byte(bad.Hash), []byte("nope")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := bs.StartVerify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for report.State == VerifyRunning {
+		time.Sleep(10 * time.Millisecond)
+		report, _ = bs.VerifyReport(report.ID)
+	}
+	if report.State != VerifyDone || report.Total != 5 || report.Checked != 5 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != bad.Hash || len(report.Missing) != 0 {
+		t.Errorf("unexpected bad blobs %+v", report)
+	}
+	if len(report.Repaired) != 1 || report.Repaired[0] != bad.Hash {
+		t.Errorf("the corrupted blob should be repaired from the peer %+v", report)
+	}
+	if !bs.verifier.servedFromReplicas(bad.Hash) {
+		t.Errorf("the corrupted blob should be served from the replicas")
+	}
+
+	if _, ok := bs.VerifyReport("unknown"); ok {
+		t.Errorf("unknown job should not be found")
+	}
+
+	// The repaired blobs are still served from the replicas after a restart
+	v, err := loadVerifier(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.servedFromReplicas(bad.Hash) {
+		t.Errorf("the repaired blob should be persisted")
+	}
+}
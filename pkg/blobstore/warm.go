@@ -0,0 +1,104 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+// Max number of recently read blobs tracked for the warm cache export
+var maxHotBlobs = 10000
+
+// WarmResult holds the result of a warm cache import
+type WarmResult struct {
+	Present int      `json:"present"`
+	Fetched int      `json:"fetched"`
+	Failed  []string `json:"failed"`
+}
+
+// hotBlobs tracks the hashes of the most recently read blobs (LRU)
+type hotBlobs struct {
+	order *list.List
+	items map[string]*list.Element
+	max   int
+
+	mu sync.Mutex
+}
+
+func newHotBlobs(max int) *hotBlobs {
+	return &hotBlobs{
+		order: list.New(),
+		items: map[string]*list.Element{},
+		max:   max,
+	}
+}
+
+func (h *hotBlobs) touch(hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elm, ok := h.items[hash]; ok {
+		h.order.MoveToFront(elm)
+		return
+	}
+	h.items[hash] = h.order.PushFront(hash)
+	if h.order.Len() > h.max {
+		last := h.order.Back()
+		h.order.Remove(last)
+		delete(h.items, last.Value.(string))
+	}
+}
+
+// hashes returns the tracked hashes, the most recently read first
+func (h *hotBlobs) hashes() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]string, 0, h.order.Len())
+	for elm := h.order.Front(); elm != nil; elm = elm.Next() {
+		out = append(out, elm.Value.(string))
+	}
+	return out
+}
+
+// ExportWarmCache returns the hashes of the most recently read blobs, the most recent first
+func (bs *BlobStore) ExportWarmCache() []string {
+	return bs.hot.hashes()
+}
+
+// ImportWarmCache pre-warms the local store with the given blobs (e.g. the export of another instance), the missing
+// blobs are fetched from the replicas (S3 replica or peers)
+func (bs *BlobStore) ImportWarmCache(ctx context.Context, hashes []string) (*WarmResult, error) {
+	res := &WarmResult{Failed: []string{}}
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		exists, err := bs.back.Exists(hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			res.Present++
+			continue
+		}
+		data, err := bs.getFromReplicas(ctx, hash)
+		if err != nil {
+			res.Failed = append(res.Failed, hash)
+			continue
+		}
+		b := &blob.Blob{Hash: hash, Data: data}
+		if err := b.Check(); err != nil {
+			bs.log.Error("replica returned an invalid blob", "hash", hash, "err", err)
+			res.Failed = append(res.Failed, hash)
+			continue
+		}
+		// The peers may have already cached it
+		if _, err := bs.Put(ctx, b); err != nil {
+			return nil, err
+		}
+		bs.hot.touch(hash)
+		res.Fetched++
+	}
+	return res, nil
+}
@@ -0,0 +1,79 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestWarmCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore_warm_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := blob.New([]byte("hot remote blob"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/") == remote.Hash {
+			w.Write(remote.Data)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{Peers: []*config.Peer{{URL: server.URL}}}
+	bs, err := New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	ctx := context.Background()
+	local := blob.New([]byte("hot local blob"))
+	if _, err := bs.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := blob.New([]byte("missing everywhere")).Hash
+	res, err := bs.ImportWarmCache(ctx, []string{local.Hash, remote.Hash, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Present != 1 || res.Fetched != 1 || !reflect.DeepEqual(res.Failed, []string{missing}) {
+		t.Errorf("unexpected import result %+v", res)
+	}
+	if exists, _ := bs.back.Exists(remote.Hash); !exists {
+		t.Errorf("the imported blob should be stored locally")
+	}
+
+	if _, err := bs.Get(ctx, local.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if hashes := bs.ExportWarmCache(); !reflect.DeepEqual(hashes, []string{local.Hash, remote.Hash}) {
+		t.Errorf("unexpected export %+v", hashes)
+	}
+
+	// Only the most recently read blobs are kept
+	h := newHotBlobs(2)
+	for _, hash := range []string{"a", "b", "a", "c"} {
+		h.touch(hash)
+	}
+	if hashes := h.hashes(); !reflect.DeepEqual(hashes, []string{"c", "a"}) {
+		t.Errorf("unexpected hot blobs %+v", hashes)
+	}
+}
@@ -118,6 +118,9 @@ func (c *Cache) Add(key string, value []byte) error {
 		c.currentSize += size - elm.Value.(*element).size
 		elm.Value.(*element).size = size
 		elm.Value.(*element).lastAccess = lastAccess
+		if err := ioutil.WriteFile(filepath.Join(c.path, key), value, 0600); err != nil {
+			return err
+		}
 		return c.doEviction()
 	}
 
@@ -1,10 +1,15 @@
 package capabilities // import "a4.io/blobstash/pkg/capabilities"
 
 import (
+	"fmt"
 	"net/http"
+	"runtime"
 
 	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
 
@@ -12,6 +17,9 @@ import (
 	log "github.com/inconshreveable/log15"
 )
 
+// Version is the server version, set at build time (`-ldflags "-X a4.io/blobstash/pkg/capabilities.Version=x.y.z"`)
+var Version = "dev"
+
 type Capabilities struct {
 	bs   *blobstore.BlobStore
 	hub  *hub.Hub
@@ -30,9 +38,74 @@ func New(logger log.Logger, conf *config.Config, bs *blobstore.BlobStore, h *hub
 	return capa, nil
 }
 
-func (c *Capabilities) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+func (c *Capabilities) Register(r *mux.Router, root *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	// Register the SSE HTTP endpoint
 	r.Handle("/", basicAuth(http.HandlerFunc(c.indexHandler)))
+	root.Handle("/api/version", basicAuth(http.HandlerFunc(c.versionHandler)))
+}
+
+// apps returns the enabled apps
+func (c *Capabilities) apps() []string {
+	apps := []string{"blobstore", "kvstore", "filetree", "docstore", "sync", "apps", "audit", "stats"}
+	if c.bs.ReplicationEnabled() {
+		apps = append(apps, "s3_replication")
+	}
+	if c.conf.ReplicateFrom != nil {
+		apps = append(apps, "replication")
+	}
+	if c.conf.Replication != nil && c.conf.Replication.EnableOplog {
+		apps = append(apps, "oplog")
+	}
+	if c.conf.Filetree != nil && c.conf.Filetree.SFTP != nil {
+		apps = append(apps, "sftp")
+	}
+	return apps
+}
+
+// features returns the supported protocol features, so clients can negotiate them instead of relying on error
+// messages
+func (c *Capabilities) features() map[string]interface{} {
+	features := map[string]interface{}{
+		"vkv_tombstones":  true,
+		"filetree_shares": true,
+	}
+	var chunkerConf *config.ChunkerConfig
+	if c.conf.Filetree != nil {
+		chunkerConf = c.conf.Filetree.Chunker
+	}
+	// The config is validated when the filetree app is initialized
+	if opts, err := filetree.ChunkerOptionsFromConfig(chunkerConf); err == nil {
+		chunker := map[string]interface{}{
+			"algorithm":    opts.Algorithm,
+			"min_size":     opts.MinSize,
+			"average_size": opts.AvgSize,
+			"max_size":     opts.MaxSize,
+		}
+		if opts.Algorithm == writer.Rabin {
+			chunker["polynomial"] = fmt.Sprintf("%x", uint64(opts.Pol))
+		}
+		features["chunker"] = chunker
+	}
+	if c.conf.FastVerifyMinSize > 0 {
+		features["fast_hash"] = map[string]interface{}{
+			"algorithm": hashutil.FastHashAlgo,
+			"min_size":  c.conf.FastVerifyMinSize,
+		}
+	}
+	return features
+}
+
+func (c *Capabilities) versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	httputil.MarshalAndWrite(r, w, map[string]interface{}{
+		"version":    Version,
+		"go_version": runtime.Version(),
+		"apps":       c.apps(),
+		"features":   c.features(),
+	})
 }
 
 func (c *Capabilities) indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -2,12 +2,21 @@ package blobstore // import "a4.io/blobstash/pkg/client/blobstore"
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
 	"a4.io/blobstash/pkg/client/clientutil"
 )
 
+// SizedBlobRef holds a blob hash along with its size
+type SizedBlobRef struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
 type BlobStore struct {
 	client *clientutil.ClientUtil
 }
@@ -55,6 +64,41 @@ func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 	return true, nil
 }
 
+// statBatchSize is the max number of hashes sent in a single stat request
+const statBatchSize = 10000
+
+// StatBatch returns the hashes of the blobs missing on the remote BlobStash instance (in one request for every 10k
+// hashes)
+func (bs *BlobStore) StatBatch(ctx context.Context, hashes []string) ([]string, error) {
+	missing := []string{}
+	for start := 0; start < len(hashes); start += statBatchSize {
+		end := start + statBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		resp, err := bs.client.PostJSON("/api/blobstore/stat", map[string]interface{}{
+			"hashes": hashes[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		out := &struct {
+			Missing []string `json:"missing"`
+		}{}
+		if serr := clientutil.ExpectStatusCode(resp, http.StatusOK); serr != nil {
+			resp.Body.Close()
+			return nil, serr
+		}
+		err = clientutil.Unmarshal(resp, out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, out.Missing...)
+	}
+	return missing, nil
+}
+
 func (bs *BlobStore) Put(ctx context.Context, hash string, blob []byte) error {
 	resp, err := bs.client.Post(fmt.Sprintf("/api/blobstore/blob/%s", hash), blob)
 	if err != nil {
@@ -69,4 +113,41 @@ func (bs *BlobStore) Put(ctx context.Context, hash string, blob []byte) error {
 	return nil
 }
 
-// TODO(tsileo): add Enumerate and all other methods from the other client
+// Enumerate streams the hash/size pairs of the blobs, starting from the `start` hash (inclusive), `fn` is called for
+// each blob (a 0 `limit` means all the blobs).
+func (bs *BlobStore) Enumerate(ctx context.Context, start string, limit int, fn func(*SizedBlobRef) error) error {
+	resp, err := bs.client.Get("/api/blobstore/blobs", clientutil.WithQueryArgs(map[string]string{
+		"start": start,
+		"limit": strconv.Itoa(limit),
+	}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		ref := &struct {
+			*SizedBlobRef
+			Error string `json:"error"`
+		}{SizedBlobRef: &SizedBlobRef{}}
+		if err := dec.Decode(ref); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ref.Error != "" {
+			return fmt.Errorf("enumerate failed: %s", ref.Error)
+		}
+		if err := fn(ref.SizedBlobRef); err != nil {
+			return err
+		}
+	}
+}
+
+// TODO(tsileo): add all other methods from the other client
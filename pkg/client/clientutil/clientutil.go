@@ -226,10 +226,21 @@ type BadStatusCodeError struct {
 	RequestMethod      string
 	RequestURL         string
 
+	// Typed error decoded from the response (see `NewAPIError`)
+	APIErr error
+
 	// In case it failed before getting the response
 	Err error
 }
 
+// Unwrap returns the typed error, so `errors.As` and the `Is*` helpers can be used
+func (e *BadStatusCodeError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return e.APIErr
+}
+
 func (e *BadStatusCodeError) IsNotFound() (res bool) {
 	if e.ResponseStatusCode == http.StatusNotFound {
 		res = true
@@ -270,6 +281,7 @@ func ExpectStatusCode(resp *http.Response, status int) *BadStatusCodeError {
 		ResponseBody:       body,
 		RequestURL:         resp.Request.URL.String(),
 		RequestMethod:      resp.Request.Method,
+		APIErr:             NewAPIError(resp, body),
 	}
 }
 
@@ -507,7 +519,7 @@ func (client *Client) GetJSON(ctx context.Context, path string, headers map[stri
 		if resp.StatusCode == 404 {
 			return ErrNotFound
 		}
-		return fmt.Errorf("API call failed with status %d: %s", resp.StatusCode, body)
+		return NewAPIError(resp, body)
 	}
 	if err := json.Unmarshal(body, out); err != nil {
 		return fmt.Errorf("failed to unmarshal: %v", err)
@@ -0,0 +1,115 @@
+package clientutil // import "a4.io/blobstash/pkg/client/clientutil"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ReqIDHeader is the header set by the server to identify the request in its logs
+const ReqIDHeader = "Blobstash-Req-ID"
+
+// APIError holds the details of a failed API call, the error message is decoded from the server structured error
+// response (`{"error": "<msg>"}`) if possible.
+type APIError struct {
+	StatusCode    int
+	Message       string
+	RequestID     string
+	RequestMethod string
+	RequestURL    string
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s failed with status %d", e.RequestMethod, e.RequestURL, e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request ID %s)", e.RequestID)
+	}
+	return msg
+}
+
+// NotFoundError is returned for 404 responses
+type NotFoundError struct{ *APIError }
+
+// UnauthorizedError is returned for 401/403 responses
+type UnauthorizedError struct{ *APIError }
+
+// QuotaExceededError is returned for 413/429/507 responses
+type QuotaExceededError struct{ *APIError }
+
+// ConflictError is returned for 409/412 responses
+type ConflictError struct{ *APIError }
+
+// ServerError is returned for 5xx responses, the request ID can be used to find the failure in the server logs
+type ServerError struct{ *APIError }
+
+// NewAPIError returns a typed error for the given response, `body` is the already decoded response body.
+func NewAPIError(resp *http.Response, body []byte) error {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(ReqIDHeader),
+	}
+	if resp.Request != nil {
+		apiErr.RequestMethod = resp.Request.Method
+		apiErr.RequestURL = resp.Request.URL.String()
+	}
+
+	jsonErr := &struct {
+		Error string `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, jsonErr); err == nil && jsonErr.Error != "" {
+		apiErr.Message = jsonErr.Error
+	} else {
+		apiErr.Message = string(body)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return &NotFoundError{apiErr}
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return &UnauthorizedError{apiErr}
+	case resp.StatusCode == http.StatusRequestEntityTooLarge, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusInsufficientStorage:
+		return &QuotaExceededError{apiErr}
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusPreconditionFailed:
+		return &ConflictError{apiErr}
+	case resp.StatusCode >= 500:
+		return &ServerError{apiErr}
+	default:
+		return apiErr
+	}
+}
+
+// IsNotFound returns true if the error (or the error it wraps) is a `NotFoundError`
+func IsNotFound(err error) bool {
+	var e *NotFoundError
+	return errors.As(err, &e)
+}
+
+// IsUnauthorized returns true if the error (or the error it wraps) is an `UnauthorizedError`
+func IsUnauthorized(err error) bool {
+	var e *UnauthorizedError
+	return errors.As(err, &e)
+}
+
+// IsQuotaExceeded returns true if the error (or the error it wraps) is a `QuotaExceededError`
+func IsQuotaExceeded(err error) bool {
+	var e *QuotaExceededError
+	return errors.As(err, &e)
+}
+
+// IsConflict returns true if the error (or the error it wraps) is a `ConflictError`
+func IsConflict(err error) bool {
+	var e *ConflictError
+	return errors.As(err, &e)
+}
+
+// IsServerError returns true if the error (or the error it wraps) is a `ServerError`
+func IsServerError(err error) bool {
+	var e *ServerError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,56 @@
+package clientutil
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	for _, tdata := range []struct {
+		status int
+		body   string
+		check  func(error) bool
+		msg    string
+	}{
+		{404, `{"error": "Not Found"}`, IsNotFound, "Not Found"},
+		{401, `Unauthorized`, IsUnauthorized, "Unauthorized"},
+		{429, ``, IsQuotaExceeded, ""},
+		{412, `{"error": "etag mismatch"}`, IsConflict, "etag mismatch"},
+		{500, `{"error": "boom"}`, IsServerError, "boom"},
+	} {
+		resp := &http.Response{
+			StatusCode: tdata.status,
+			Header:     http.Header{},
+			Request:    &http.Request{Method: "GET", URL: &url.URL{Path: "/api/test"}},
+		}
+		resp.Header.Set(ReqIDHeader, "reqid")
+		err := NewAPIError(resp, []byte(tdata.body))
+		if !tdata.check(err) {
+			t.Errorf("unexpected error type %T for status %d", err, tdata.status)
+		}
+
+		// Ensure the typed error is reachable from a `BadStatusCodeError`
+		wrapped := &BadStatusCodeError{ResponseStatusCode: tdata.status, APIErr: err}
+		if !tdata.check(wrapped) {
+			t.Errorf("typed error not reachable from BadStatusCodeError for status %d", tdata.status)
+		}
+
+		var apiErr *APIError
+		switch e := err.(type) {
+		case *NotFoundError:
+			apiErr = e.APIError
+		case *UnauthorizedError:
+			apiErr = e.APIError
+		case *QuotaExceededError:
+			apiErr = e.APIError
+		case *ConflictError:
+			apiErr = e.APIError
+		case *ServerError:
+			apiErr = e.APIError
+		}
+		if apiErr.Message != tdata.msg || apiErr.RequestID != "reqid" {
+			t.Errorf("bad error details, got %+v", apiErr)
+		}
+	}
+}
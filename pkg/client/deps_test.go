@@ -0,0 +1,51 @@
+package client
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Third-party packages the client is allowed to import, everything else must come from the stdlib or from the client
+// itself, so the client can be carved into its own module without dragging the server dependencies (leveldb, cgo...).
+var allowedDeps = map[string]bool{
+	"github.com/golang/snappy":       true,
+	"github.com/vmihailenco/msgpack": true,
+}
+
+func TestClientDeps(t *testing.T) {
+	fset := token.NewFileSet()
+	if err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
+		if err != nil {
+			return err
+		}
+		for _, imp := range f.Imports {
+			ipath, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				return err
+			}
+			// Stdlib packages have no dot in their first path element
+			if !strings.Contains(strings.Split(ipath, "/")[0], ".") {
+				continue
+			}
+			if strings.HasPrefix(ipath, "a4.io/blobstash/pkg/client") || allowedDeps[ipath] {
+				continue
+			}
+			t.Errorf("%s imports %q, the client must not depend on the server packages", path, ipath)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
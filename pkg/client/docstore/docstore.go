@@ -140,9 +140,11 @@ func (col *Collection) Insert(ctx context.Context, idoc interface{}, opts *Inser
 		_id.hash = resp.Header.Get("BlobStash-DocStore-Doc-Hash")
 		return _id, nil
 	default:
-		var body bytes.Buffer
-		body.ReadFrom(resp.Body)
-		return nil, fmt.Errorf("failed to insert doc (%d): %v", resp.StatusCode, body.String())
+		body, err := clientutil.Decode(resp)
+		if err != nil {
+			return nil, err
+		}
+		return nil, clientutil.NewAPIError(resp, body)
 	}
 }
 
@@ -161,9 +163,11 @@ func (col *Collection) UpdateID(ctx context.Context, id string, doc interface{})
 	case 200:
 		return nil
 	default:
-		var body bytes.Buffer
-		body.ReadFrom(resp.Body)
-		return fmt.Errorf("failed to insert doc: %v", body.String())
+		body, err := clientutil.Decode(resp)
+		if err != nil {
+			return err
+		}
+		return clientutil.NewAPIError(resp, body)
 	}
 }
 
@@ -32,7 +32,7 @@ type snapResp struct {
 	Ref     string `json:"ref"`
 }
 
-// MakeSnaphot create a FS snapshot from a tree reference
+// MakeSnaphot create a FS snapshot from a tree reference (the author is the API key ID)
 func (f *Filetree) MakeSnapshot(ref, fs, message, userAgent string) (int64, error) {
 	h, err := os.Hostname()
 	if err != nil {
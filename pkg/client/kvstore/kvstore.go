@@ -2,8 +2,10 @@ package kvstore // import "a4.io/blobstash/pkg/client/kvstore"
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -100,11 +102,14 @@ func (kvs *KvStore) Versions(ctx context.Context, key string, start, end, limit
 		return nil, err
 	}
 
-	kvversions := &response.KeyValueVersions{}
-	if err := clientutil.Unmarshal(resp, kvversions); err != nil {
+	// The versions are returned paginated
+	page := &struct {
+		Data []*response.KeyValue `json:"data"`
+	}{}
+	if err := clientutil.Unmarshal(resp, page); err != nil {
 		return nil, err
 	}
-	return kvversions, nil
+	return &response.KeyValueVersions{Key: key, Versions: page.Data}, nil
 }
 
 func (kvs *KvStore) Keys(ctx context.Context, prefix, start, end string, limit int) ([]*response.KeyValue, error) {
@@ -125,3 +130,58 @@ func (kvs *KvStore) Keys(ctx context.Context, prefix, start, end string, limit i
 
 	return keys.Keys, nil
 }
+
+// Query is a declarative query executed server-side (see `POST /api/kvstore/query`)
+type Query struct {
+	Prefix      string `json:"prefix,omitempty"`
+	KeyRegex    string `json:"key_regex,omitempty"`
+	MinVersion  int64  `json:"min_version,omitempty"`
+	MaxVersion  int64  `json:"max_version,omitempty"`
+	AllVersions bool   `json:"all_versions,omitempty"`
+	Decode      string `json:"decode,omitempty"` // raw, string, json or msgpack
+	Limit       int    `json:"limit,omitempty"`
+	Order       string `json:"order,omitempty"` // asc or desc
+}
+
+// QueryResult is a single version matched by a query
+type QueryResult struct {
+	Key         string      `json:"key"`
+	Version     int64       `json:"version"`
+	Hash        string      `json:"hash,omitempty"`
+	Data        []byte      `json:"data,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+	DecodeError string      `json:"decode_error,omitempty"`
+}
+
+// Query streams the results of the query, `fn` is called for each result
+func (kvs *KvStore) Query(ctx context.Context, q *Query, fn func(*QueryResult) error) error {
+	resp, err := kvs.client.PostJSON("/api/kvstore/query", q)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		res := &struct {
+			*QueryResult
+			Error string `json:"error"`
+		}{QueryResult: &QueryResult{}}
+		if err := dec.Decode(res); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if res.Error != "" {
+			return fmt.Errorf("query failed: %s", res.Error)
+		}
+		if err := fn(res.QueryResult); err != nil {
+			return err
+		}
+	}
+}
@@ -47,7 +47,7 @@ func (o *Oplog) GetBlob(ctx context.Context, hash string) ([]byte, error) {
 	return clientutil.Decode(resp)
 }
 
-// FIXME(tsileo): use a ctx and support cancelation
+// Notify streams the remote oplog into `ops` until the connection fails or the context is canceled
 func (o *Oplog) Notify(ctx context.Context, ops chan<- *Op, connCallback func()) error {
 	resp, err := o.client.Get("/_oplog/")
 	if err != nil {
@@ -65,12 +65,26 @@ func (o *Oplog) Notify(ctx context.Context, ops chan<- *Op, connCallback func())
 	reader := bufio.NewReader(resp.Body)
 
 	defer resp.Body.Close()
-	// TODO(tsileo): a select with ctx cancel?
+
+	// Unblock the reader when the context is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
 	var op *Op
 	for {
 		// Read each new line and process the type of event
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 		switch {
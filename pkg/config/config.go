@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"gopkg.in/yaml.v2"
@@ -40,6 +41,26 @@ type S3Repl struct {
 	Endpoint  string `yaml:"endpoint"`
 	AccessKey string `yaml:"access_key_id"`
 	SecretKey string `yaml:"secret_access_key"`
+
+	// Stream every new blob (the content of meta blobs, the reference of data blobs) to the bucket as an append-only
+	// log, flushed every `wal_flush_interval` seconds (default to 5), for point-in-time recovery
+	WALShipping      bool `yaml:"wal_shipping"`
+	WALFlushInterval int  `yaml:"wal_flush_interval"`
+
+	// Re-encrypt the replicated objects with this key in the background, once done (see `/api/blobstore/s3/rekey`),
+	// it must replace `key_file` (and the option removed)
+	NewKeyFile string `yaml:"new_key_file"`
+}
+
+// Webhook defines an endpoint where the hub events are POSTed
+type Webhook struct {
+	URL string `yaml:"url"`
+
+	// Used to sign the payloads (HMAC-SHA256), the signature is sent in the `BlobStash-Webhook-Signature` header
+	Secret string `yaml:"secret"`
+
+	// Events to deliver (`blob.new`, `kv.version`, `filetree.update`), all of them if empty
+	Events []string `yaml:"events"`
 }
 
 type Replication struct {
@@ -51,12 +72,35 @@ type ReplicateFrom struct {
 	APIKey string `yaml:"api_key"`
 }
 
+// Peer is a remote BlobStash instance the blobs missing locally are fetched from
+type Peer struct {
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+	Cache  bool   `yaml:"cache"` // save the fetched blobs locally
+}
+
+// Upstream is the remote BlobStash instance proxied by this one: the blobs missing locally are fetched from it (and
+// cached), and the blobs saved locally are pushed to it in the background
+type Upstream struct {
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+}
+
 func (s3 *S3Repl) Key() (*[32]byte, error) {
-	if s3.KeyFile == "" {
+	return readKey(s3.KeyFile)
+}
+
+// NewKey returns the key the objects are being re-encrypted with (nil if no re-keying is configured)
+func (s3 *S3Repl) NewKey() (*[32]byte, error) {
+	return readKey(s3.NewKeyFile)
+}
+
+func readKey(path string) (*[32]byte, error) {
+	if path == "" {
 		return nil, nil
 	}
 	var out [32]byte
-	data, err := ioutil.ReadFile(s3.KeyFile)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +115,69 @@ type BasicAuth struct {
 	Password string   `yaml:"password"`
 }
 
+// OIDC configures the OpenID Connect login (authorization code flow), used as an alternative to the basic auth
+// for the web UIs
+type OIDC struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"` // must point to `/api/oidc/callback`
+	Scopes       []string `yaml:"scopes"`       // default to openid, profile, email
+	GroupsClaim  string   `yaml:"groups_claim"` // default to "groups"
+
+	// Roles granted to the members of each group (the users without any role are rejected)
+	Groups       map[string][]string `yaml:"groups"`
+	DefaultRoles []string            `yaml:"default_roles"`
+
+	// Session duration in seconds (default to 12 hours)
+	SessionTTL int `yaml:"session_ttl"`
+}
+
+// ClientCerts configures the TLS client certificates auth (mTLS)
+type ClientCerts struct {
+	CA string `yaml:"ca"` // PEM file of the CA the client certificates must be signed by
+
+	// Reject the TLS handshakes without a valid client certificate (the other auth methods are still accepted
+	// otherwise)
+	Required bool `yaml:"required"`
+
+	// Roles granted to each certificate subject, either the full subject (e.g. "CN=backup,O=Example") or just its
+	// common name (the certificates with an unknown subject are rejected)
+	Subjects map[string][]string `yaml:"subjects"`
+}
+
+// Public defines the resources readable without auth (everything else stays protected)
+type Public struct {
+	FiletreeRoots       []string `yaml:"filetree_roots"`
+	DocstoreCollections []string `yaml:"docstore_collections"`
+}
+
+// IsPublicRoot returns true if the filetree FS is publicly readable
+func (p *Public) IsPublicRoot(name string) bool {
+	if p == nil {
+		return false
+	}
+	for _, root := range p.FiletreeRoots {
+		if root == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPublicCollection returns true if the docstore collection is publicly readable
+func (p *Public) IsPublicCollection(name string) bool {
+	if p == nil {
+		return false
+	}
+	for _, col := range p.DocstoreCollections {
+		if col == name {
+			return true
+		}
+	}
+	return false
+}
+
 type Role struct {
 	Name     string                 `yaml:"name"`
 	Template string                 `yaml:"template"`
@@ -90,14 +197,26 @@ type Perm struct {
 // Config holds the configuration items
 type Config struct {
 	init     bool
+	path     string
 	Listen   string `yaml:"listen"`
 	LogLevel string `yaml:"log_level"`
 	// TLS     bool     `yaml:"tls"`
 	AutoTLS bool     `yaml:"tls_auto"`
 	Domains []string `yaml:"tls_domains"`
 
+	// Static certificate (PEM files) for the HTTPS listener (as an alternative to `tls_auto`)
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// Auth via TLS client certificates (requires TLS)
+	ClientCerts *ClientCerts `yaml:"client_certs"`
+
 	Roles []*Role `yaml:"roles"`
 	Auth  []*BasicAuth
+	OIDC  *OIDC `yaml:"oidc"`
+
+	// Read-only endpoints exposed without auth
+	Public *Public `yaml:"public"`
 
 	ExpvarListen string `yaml:"expvar_server_listen"`
 
@@ -107,19 +226,80 @@ type Config struct {
 	DataDir    string  `yaml:"data_dir"`
 	S3Repl     *S3Repl `yaml:"s3_replication"`
 
+	// Blobs bigger than FastVerifyMinSize get a secondary fast hash (Blake3) recorded, and are verified with it during
+	// the local scrub/verification (0 disables it), the fast hashes of the blobs already stored are recorded by a
+	// background job (the blobs received from a remote are always checked against their canonical hash)
+	FastVerifyMinSize int `yaml:"fast_verify_min_size"`
+
 	Apps          []*AppConfig    `yaml:"apps"`
 	Docstore      *DocstoreConfig `yaml:"docstore"`
+	Filetree      *FiletreeConfig `yaml:"filetree"`
 	Replication   *Replication    `yaml:"replication"`
 	ReplicateFrom *ReplicateFrom  `yaml:"replicate_from"`
 
+	// Peers are queried (in order) when a blob is missing locally
+	Peers []*Peer `yaml:"peers"`
+
+	// Run as a caching proxy of the upstream instance (queried before the peers)
+	Upstream *Upstream `yaml:"upstream"`
+
+	// Interval (in seconds) of the backends health checks (0 disables them), while the local backend is unhealthy,
+	// the reads fail over to the S3 replica/the peers and the writes are queued in memory
+	HealthCheckInterval int `yaml:"health_check_interval"`
+
 	SecretKey string `yaml:"secret_key"`
 
+	MaxBodySize *MaxBodySize `yaml:"max_body_size"`
+
+	Webhooks []*Webhook `yaml:"webhooks"`
+
+	// Sign the meta blobs and the filetree nodes with an Ed25519 key, so a mirror can prove the data originated from
+	// this instance (nil disables it)
+	Provenance *ProvenanceConfig `yaml:"provenance"`
+
+	// Persist the hub events (in a local index) so the durable subscribers (e.g. the webhooks) can replay the events
+	// missed after a crash
+	HubEventLog bool `yaml:"hub_event_log"`
+
+	// Minimum delay (in seconds) between the mark and the sweep of a namespace GC, the blobs uploaded in the meantime
+	// are kept (0 performs both at once)
+	StashGCGracePeriod int `yaml:"stash_gc_grace_period"`
+
+	// Delay (in seconds) after the expiration of a namespace before its data is destroyed (0 keeps the data until
+	// the namespace is deleted), the expired namespaces are never accessible
+	ExpiredNamespacesRetention int `yaml:"expired_namespaces_retention"`
+
+	// Delay (in seconds) before the export archives of the deleted namespaces are removed (0 keeps them)
+	StashExportsRetention int `yaml:"stash_exports_retention"`
+
+	// Token bucket rate limits, per auth ID ("*" for the API keys without their own limits) and per route class
+	// ("blob_writes", "kv_writes" or "reads")
+	RateLimits map[string]map[string]*RateLimit `yaml:"rate_limits"`
+
+	// Shed the low-priority traffic (thumbnails, anonymous reads and background jobs) while the backend is degraded
+	LoadShedding *LoadShedding `yaml:"load_shedding"`
+
+	// Pre-load the blobs index and the latest filetree roots in the background after startup
+	WarmUp bool `yaml:"warm_up"`
+
+	// Serve the OCI distribution API (a container registry) under `/v2/`
+	Registry bool `yaml:"registry"`
+
+	// Quotas holds the max size (in bytes) for each namespace (see the `usage` package for the namespace names)
+	Quotas map[string]int64 `yaml:"quotas"`
+
+	// Write-once retention locks, the recent versions (and the blobs they reference) cannot be deleted or GCed
+	RetentionLocks *RetentionLocks `yaml:"retention_locks"`
+
 	// Items defined with the CLI flags
 	CheckMode                  bool `yaml:"-"`
 	ScanMode                   bool `yaml:"-"`
 	S3ScanMode                 bool `yaml:"-"`
 	S3RestoreMode              bool `yaml:"-"`
 	DocstoreIndexesReindexMode bool `yaml:"-"`
+
+	// Point-in-time restore target (Unix nano timestamp), see `blobstash restore`
+	RestoreUntil int64 `yaml:"-"`
 }
 
 func (c *Config) LogLvl() log15.Lvl {
@@ -133,12 +313,168 @@ func (c *Config) LogLvl() log15.Lvl {
 	return lvl
 }
 
+// MaxBodySize holds the maximum request body sizes in bytes (a negative value disables the limit)
+type MaxBodySize struct {
+	Upload int64 `yaml:"upload"` // blob/file upload endpoints and apps (default to no limit)
+	JSON   int64 `yaml:"json"`   // every other endpoint (default to 16MB)
+}
+
+// RateLimit holds the rate (in requests per second) and the burst size (default to the rate) of a token bucket
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// LoadShedding holds the backend health thresholds (over the last 30 seconds) that trigger the load shedding
+type LoadShedding struct {
+	MaxLatency   int     `yaml:"max_latency"`    // average latency of the blobstore operations (in milliseconds)
+	MaxErrorRate float64 `yaml:"max_error_rate"` // ratio of failed blobstore operations (between 0 and 1)
+	Cooldown     int     `yaml:"cooldown"`       // delay (in seconds) the backend must stay healthy before stopping (default to 30)
+}
+
+// DefaultMaxJSONBodySize is the default max request body size for the JSON endpoints
+const DefaultMaxJSONBodySize = 16 << 20
+
 type DocstoreSortIndex struct {
 	Field string `yaml:"field"`
 }
 
+// DocstoreView defines a map/reduce view, maintained as the documents change (the Lua code must return a function
+// like for the `_map_reduce` endpoint)
+type DocstoreView struct {
+	Map    string `yaml:"map"`
+	Reduce string `yaml:"reduce"`
+}
+
 type DocstoreConfig struct {
 	SortIndexes map[string]map[string]*DocstoreSortIndex `yaml:"sort_indexes"`
+	Views       map[string]map[string]*DocstoreView      `yaml:"views"` // collection => name => view
+}
+
+// RetentionPolicy defines which versions of a filetree FS are kept, every version that is not selected by one of the
+// rules is pruned (a negative value means "forever", 0 disables the rule).
+//
+// The latest version is always kept.
+type RetentionPolicy struct {
+	KeepLast    int `yaml:"keep_last" json:"keep_last"`
+	KeepHourly  int `yaml:"keep_hourly" json:"keep_hourly"`   // Keep the latest version of each hour for the last N hours
+	KeepDaily   int `yaml:"keep_daily" json:"keep_daily"`     // Keep the latest version of each day for the last N days
+	KeepMonthly int `yaml:"keep_monthly" json:"keep_monthly"` // Keep the latest version of each month for the last N months
+}
+
+// RetentionLocks holds the retention locks (in days) by filetree FS name and by namespace name: the versions younger
+// than the lock cannot be pruned, and a namespace holding such versions cannot be deleted or garbage collected.
+//
+// The locks cannot be hot-reloaded (a restart is required to lift one).
+type RetentionLocks struct {
+	FS         map[string]int `yaml:"fs"`
+	Namespaces map[string]int `yaml:"namespaces"`
+}
+
+// HLSConfig holds the HLS transcoding settings
+type HLSConfig struct {
+	// Heights of the renditions (the ones taller than the video are skipped), defaults to 360 and 720
+	Renditions []int `yaml:"renditions"`
+
+	// Target duration (in seconds) of the segments, defaults to 6
+	SegmentDuration int `yaml:"segment_duration"`
+}
+
+type FiletreeConfig struct {
+	// Retention policies by FS name
+	Retention map[string]*RetentionPolicy `yaml:"retention"`
+
+	// Optional SFTP server exposing the FSes
+	SFTP *SFTPConfig `yaml:"sftp"`
+
+	// Content-defined chunking parameters for the uploaded files, optionally overridden by namespace (e.g. larger
+	// chunks for a namespace holding large media files)
+	Chunker           *ChunkerConfig            `yaml:"chunker"`
+	NamespaceChunkers map[string]*ChunkerConfig `yaml:"namespace_chunkers"`
+
+	// Store the modified chunks of the text files as deltas against the previous version of the file (trading CPU
+	// for space on frequently edited large files)
+	DeltaCompression bool `yaml:"delta_compression"`
+
+	// Number of chunks fetched concurrently ahead of the current one when serving files (speeds up the streaming of
+	// large files, e.g. videos, from a remote backend), 0 disables the read-ahead
+	ReadAhead int `yaml:"read_ahead"`
+
+	// Number of dir children fetched concurrently when listing a dir, the first children of the listed sub dirs are
+	// also pre-warmed in the background (speeds up browsing deep trees from a remote backend), 0 disables it
+	PrefetchDirs int `yaml:"prefetch_dirs"`
+
+	// Transcode the uploaded videos into HLS renditions (ffmpeg required), nil disables it
+	HLS *HLSConfig `yaml:"hls"`
+
+	// Delay (in seconds) the nodes deleted from a FS are kept in its trash (and can be restored), the blobs of the
+	// trashed nodes are not eligible for GC until they expire (0 disables the trash)
+	TrashRetention int `yaml:"trash_retention"`
+
+	// Signed cookies accepted by the file handlers, so the web apps can embed private files (e.g. in <img> tags)
+	// without signing every URL
+	EmbedCookie *EmbedCookieConfig `yaml:"embed_cookie"`
+
+	// Content-Security-Policy header set when serving HTML files (e.g. "sandbox" to prevent the uploaded pages from
+	// running scripts with the origin of the instance)
+	HTMLContentSecurityPolicy string `yaml:"html_content_security_policy"`
+
+	// FSes served as static sites at `/site/{name}/` (by FS name)
+	Sites map[string]*SiteConfig `yaml:"sites"`
+
+	// Cloud folders (Dropbox/Google Drive) mirrored into FSes on a schedule (by FS name)
+	CloudImports map[string]*CloudImportConfig `yaml:"cloud_imports"`
+}
+
+// CloudImportConfig holds the settings of a cloud folder mirrored into a FS
+type CloudImportConfig struct {
+	Provider string `yaml:"provider"` // "dropbox" or "gdrive"
+
+	// OAuth app credentials and the refresh token obtained when authorizing the app (offline access)
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+
+	// Folder path for Dropbox (defaults to the whole Dropbox), folder ID for Google Drive (defaults to "root")
+	Folder string `yaml:"folder"`
+
+	Interval int `yaml:"interval"` // in seconds (default to 1 hour)
+}
+
+// SiteConfig holds the settings of a FS served as a static site (the Markdown files are rendered with the
+// `_layout.html` template of the FS root if any, and support a YAML front matter)
+type SiteConfig struct {
+	Render bool `yaml:"render"`
+}
+
+// EmbedCookieConfig holds the settings of the embed cookies
+type EmbedCookieConfig struct {
+	TTL      int    `yaml:"ttl"`       // in seconds (default to 1 hour)
+	Domain   string `yaml:"domain"`    // optional, e.g. to share the cookie with the subdomains
+	SameSite string `yaml:"same_site"` // "lax" (default), "strict" or "none" (for apps on another site, requires TLS)
+}
+
+// ChunkerConfig holds the content-defined chunking parameters, unset values use the defaults
+type ChunkerConfig struct {
+	Algorithm  string `yaml:"algorithm"` // "rabin" (default) or "fastcdc"
+	MinSize    int    `yaml:"min_size"`
+	AvgSize    int    `yaml:"avg_size"` // must be a power of 2
+	MaxSize    int    `yaml:"max_size"`
+	Polynomial string `yaml:"polynomial"` // hex encoded irreducible polynomial (rabin only)
+}
+
+// ProvenanceConfig holds the signing key config
+type ProvenanceConfig struct {
+	Key string `yaml:"key"` // PEM encoded Ed25519 private key path, generated in the config dir if not set
+}
+
+// SFTPConfig holds the embedded SFTP server config (the clients authenticate with the `auth` credentials)
+type SFTPConfig struct {
+	Listen  string `yaml:"listen"`   // e.g. ":2022"
+	HostKey string `yaml:"host_key"` // PEM encoded private key path, generated in the config dir if not set
+
+	// Namespace exposed over SFTP (the root namespace if not set)
+	Namespace string `yaml:"namespace"`
 }
 
 // New initialize a config object by loading the YAML path at the given path
@@ -151,10 +487,28 @@ func New(path string) (*Config, error) {
 	if err := yaml.Unmarshal([]byte(data), &conf); err != nil {
 		return nil, err
 	}
+	conf.path = path
 	return conf, nil
 }
 
-// VarDir returns the directory where the index will be stored
+// Path returns the path of the YAML file the config was loaded from (empty if the config was not loaded from a file)
+func (c *Config) Path() string {
+	return c.path
+}
+
+// FSRetentionLock returns the retention lock of the given filetree FS (0 if not locked)
+func (c *Config) FSRetentionLock(name string) time.Duration {
+	if c.RetentionLocks == nil {
+		return 0
+	}
+	return time.Duration(c.RetentionLocks.FS[name]) * 24 * time.Hour
+}
+
+// TLSEnabled returns true if the server listens over HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.AutoTLS || c.TLSCert != ""
+}
+
 func (c *Config) ConfigDir() string {
 	// TODO(tsileo): allow override?
 	return pathutil.ConfigDir()
@@ -213,6 +567,27 @@ func (c *Config) Init() error {
 	if c.SharingKey == "" {
 		return fmt.Errorf("missing `sharing_key` config item")
 	}
+	if c.OIDC != nil && (c.OIDC.Issuer == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "") {
+		return fmt.Errorf("the `oidc` config requires `issuer`, `client_id` and `redirect_url`")
+	}
+	if c.OIDC != nil && c.SecretKey == "" {
+		return fmt.Errorf("the `oidc` config requires the `secret_key` config item (for the session cookies)")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("the `tls_cert` and `tls_key` config items must be set together")
+	}
+	if c.ClientCerts != nil && (c.ClientCerts.CA == "" || !c.TLSEnabled()) {
+		return fmt.Errorf("the `client_certs` config requires `ca`, and TLS to be enabled")
+	}
+	for id, limits := range c.RateLimits {
+		for class := range limits {
+			switch class {
+			case "blob_writes", "kv_writes", "reads":
+			default:
+				return fmt.Errorf("invalid rate limit class %q for %q", class, id)
+			}
+		}
+	}
 	if c.S3Repl != nil {
 		// Set default region
 		if c.S3Repl.Region == "" {
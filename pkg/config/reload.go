@@ -0,0 +1,76 @@
+package config // import "a4.io/blobstash/pkg/config"
+
+import (
+	"reflect"
+	"strings"
+)
+
+// HotReloadable lists the config items (by YAML name) that can be applied without restarting the server
+var HotReloadable = map[string]bool{
+	"auth":           true,
+	"roles":          true,
+	"webhooks":       true,
+	"rate_limits":    true,
+	"quotas":         true,
+	"replicate_from": true,
+	"log_level":      true,
+
+	"expired_namespaces_retention": true,
+	"stash_exports_retention":      true,
+}
+
+// yamlName returns the YAML name of the field ("" if the field is not loaded from the YAML file)
+func yamlName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := f.Tag.Get("yaml")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+// Diff returns the (YAML names of the) items that changed in the new config, split between the ones that can be
+// hot-reloaded and the ones that require a restart
+func (c *Config) Diff(newConf *Config) ([]string, []string) {
+	reloadable := []string{}
+	restart := []string{}
+	cv := reflect.ValueOf(c).Elem()
+	nv := reflect.ValueOf(newConf).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		name := yamlName(cv.Type().Field(i))
+		if name == "" || reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if HotReloadable[name] {
+			reloadable = append(reloadable, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	// Enabling/disabling the auth or the replication is not supported at runtime, only updating them
+	if (len(c.Auth) == 0) != (len(newConf.Auth) == 0) && c.OIDC == nil && c.ClientCerts == nil {
+		reloadable, restart = moveItem(reloadable, restart, "auth")
+	}
+	if (c.ReplicateFrom == nil) != (newConf.ReplicateFrom == nil) {
+		reloadable, restart = moveItem(reloadable, restart, "replicate_from")
+	}
+	return reloadable, restart
+}
+
+func moveItem(src, dst []string, item string) ([]string, []string) {
+	out := []string{}
+	for _, it := range src {
+		if it == item {
+			dst = append(dst, it)
+			continue
+		}
+		out = append(out, it)
+	}
+	return out, dst
+}
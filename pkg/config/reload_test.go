@@ -0,0 +1,35 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	conf := &Config{
+		Listen:     ":8051",
+		SharingKey: "key",
+		Auth:       []*BasicAuth{{ID: "a", Password: "p1"}},
+	}
+	newConf := &Config{
+		Listen:     ":8052",
+		SharingKey: "key",
+		Auth:       []*BasicAuth{{ID: "a", Password: "p2"}},
+		RateLimits: map[string]map[string]*RateLimit{"*": {"reads": {Rate: 10}}},
+		CheckMode:  true,
+	}
+	reloadable, restart := conf.Diff(newConf)
+	if !reflect.DeepEqual(reloadable, []string{"auth", "rate_limits"}) {
+		t.Errorf("unexpected reloadable items %q", reloadable)
+	}
+	if !reflect.DeepEqual(restart, []string{"listen"}) {
+		t.Errorf("unexpected restart items %q", restart)
+	}
+
+	// Enabling the replication requires a restart
+	newConf = &Config{Listen: ":8051", SharingKey: "key", Auth: conf.Auth, ReplicateFrom: &ReplicateFrom{URL: "http://remote"}}
+	reloadable, restart = conf.Diff(newConf)
+	if len(reloadable) != 0 || !reflect.DeepEqual(restart, []string{"replicate_from"}) {
+		t.Errorf("unexpected diff %q %q", reloadable, restart)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+
+Package conntrack keeps track of the HTTP connections (age, last activity and in-flight request), and allows an
+admin to kill one (e.g. a stuck client holding an upload forever).
+
+*/
+package conntrack // import "a4.io/blobstash/pkg/conntrack"
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+type connIDKey struct{}
+
+// Conn holds the state of a connection
+type Conn struct {
+	ID           uint64    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	State        string    `json:"state"`
+	StartedAt    time.Time `json:"started_at"`
+	Age          float64   `json:"age"` // seconds
+	LastActivity time.Time `json:"last_activity"`
+	Idle         float64   `json:"idle"` // seconds since the last activity
+	Requests     int       `json:"requests"`
+
+	// In-flight request (e.g. "POST /api/blobstore/upload")
+	Op string `json:"op,omitempty"`
+
+	conn net.Conn
+}
+
+// Tracker holds the open connections
+type Tracker struct {
+	conns  map[uint64]*Conn
+	byConn map[net.Conn]*Conn
+	nextID uint64
+
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// New initializes a connection tracker
+func New() *Tracker {
+	return &Tracker{
+		conns:  map[uint64]*Conn{},
+		byConn: map[net.Conn]*Conn{},
+		now:    time.Now,
+	}
+}
+
+// Setup hooks the tracker into the HTTP server
+func (t *Tracker) Setup(srv *http.Server) {
+	srv.ConnState = t.connState
+	srv.ConnContext = t.connContext
+}
+
+// connContext registers the connection, and attaches its ID to the requests context
+func (t *Tracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.nextID++
+	conn := &Conn{
+		ID:           t.nextID,
+		RemoteAddr:   c.RemoteAddr().String(),
+		State:        http.StateNew.String(),
+		StartedAt:    now,
+		LastActivity: now,
+		conn:         c,
+	}
+	t.conns[conn.ID] = conn
+	t.byConn[c] = conn
+	return context.WithValue(ctx, connIDKey{}, conn.ID)
+}
+
+func (t *Tracker) connState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.byConn[c]
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, conn.ID)
+		delete(t.byConn, c)
+	default:
+		conn.State = state.String()
+		conn.LastActivity = t.now()
+	}
+}
+
+// Middleware records the in-flight request of the connections
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := r.Context().Value(connIDKey{}).(uint64)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t.setOp(id, r.Method+" "+r.URL.Path)
+		defer t.setOp(id, "")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *Tracker) setOp(id uint64, op string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if conn, ok := t.conns[id]; ok {
+		if op != "" {
+			conn.Requests++
+		}
+		conn.Op = op
+		conn.LastActivity = t.now()
+	}
+}
+
+// Conns returns the open connections, the oldest first
+func (t *Tracker) Conns() []*Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	out := []*Conn{}
+	for _, conn := range t.conns {
+		c := *conn
+		c.Age = now.Sub(c.StartedAt).Seconds()
+		c.Idle = now.Sub(c.LastActivity).Seconds()
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Kill closes the given connection, returns false if the connection does not exist
+func (t *Tracker) Kill(id uint64) (bool, error) {
+	t.mu.Lock()
+	conn, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, conn.conn.Close()
+}
+
+func (t *Tracker) connsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Conn),
+			perms.Resource(perms.Debug, perms.Conn),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		conns := t.Conns()
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data":  conns,
+			"count": len(conns),
+		})
+	}
+}
+
+func (t *Tracker) connHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rawID := mux.Vars(r)["id"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Conn),
+			perms.ResourceWithID(perms.Debug, perms.Conn, rawID),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		id, err := strconv.ParseUint(rawID, 10, 64)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusNotFound, "connection not found")
+			return
+		}
+		ok, err := t.Kill(id)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			httputil.WriteJSONError(w, http.StatusNotFound, "connection not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Register registers the HTTP endpoints
+func (t *Tracker) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/conns", basicAuth(http.HandlerFunc(t.connsHandler())))
+	r.Handle("/conns/{id}", basicAuth(http.HandlerFunc(t.connHandler())))
+}
@@ -0,0 +1,63 @@
+package conntrack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := New()
+	started := make(chan struct{})
+	server := httptest.NewUnstartedServer(tracker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Stuck until the connection is killed
+		<-r.Context().Done()
+	})))
+	tracker.Setup(server.Config)
+	server.Start()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(server.URL+"/api/blobstore/upload", "text/plain", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+
+	conns := tracker.Conns()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %+v", conns)
+	}
+	c := conns[0]
+	if c.Op != "POST /api/blobstore/upload" || c.State != "active" || c.Requests != 1 {
+		t.Errorf("unexpected connection %+v", c)
+	}
+
+	if ok, _ := tracker.Kill(c.ID + 1); ok {
+		t.Errorf("unknown connection should not be killed")
+	}
+	if ok, err := tracker.Kill(c.ID); !ok || err != nil {
+		t.Fatalf("failed to kill the connection: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("the request should have failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection was not killed")
+	}
+
+	// The connection is removed once closed
+	for i := 0; i < 100 && len(tracker.Conns()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns := tracker.Conns(); len(conns) != 0 {
+		t.Errorf("expected no connections, got %+v", conns)
+	}
+}
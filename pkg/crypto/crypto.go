@@ -112,7 +112,9 @@ L:
 		copy(nonce[:], chunk[:24])
 		decrypted, ok := secretbox.Open(nil, chunk[24:], &nonce, nkey)
 		if !ok {
-			panic("decryption error")
+			tmpfile.Close()
+			os.Remove(tmpfile.Name())
+			return "", fmt.Errorf("failed to decrypt file (bad key?)")
 		}
 
 		if _, err = tmpfile.Write(decrypted); err != nil {
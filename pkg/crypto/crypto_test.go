@@ -53,4 +53,11 @@ func TestCrypto(t *testing.T) {
 	if !bytes.Equal(dat, dat2) {
 		t.Errorf("failed to decrypt input")
 	}
+
+	var otherKey [32]byte
+	copy(otherKey[:], secretKeyBytes)
+	otherKey[0]++
+	if _, err := Open(&otherKey, sealed); err == nil {
+		t.Errorf("decrypting with another key should fail")
+	}
 }
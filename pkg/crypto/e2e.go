@@ -0,0 +1,215 @@
+package crypto // import "a4.io/blobstash/pkg/crypto"
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrDecryption is returned when a chunk/key cannot be decrypted (wrong key or corrupted data)
+var ErrDecryption = errors.New("decryption failed")
+
+// Key derivation parameters
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Prefix of the recovery codes
+const recoveryPrefix = "BSK1-"
+
+// NewKey returns a random key
+func NewKey() (*[keyLength]byte, error) {
+	key := new([keyLength]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeriveKey derives a key from the passphrase
+func DeriveKey(passphrase, salt []byte) (*[keyLength]byte, error) {
+	dk, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	key := new([keyLength]byte)
+	copy(key[:], dk)
+	return key, nil
+}
+
+// seal encrypts the data with the given nonce, the nonce is prepended to the output
+func seal(key *[keyLength]byte, nonce *[nonceLength]byte, data []byte) []byte {
+	return secretbox.Seal(nonce[:], data, nonce, key)
+}
+
+// open decrypts the data encrypted with `seal`
+func open(key *[keyLength]byte, data []byte) ([]byte, error) {
+	if len(data) < nonceLength+secretbox.Overhead {
+		return nil, ErrDecryption
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], data[:nonceLength])
+	out, ok := secretbox.Open(nil, data[nonceLength:], &nonce, key)
+	if !ok {
+		return nil, ErrDecryption
+	}
+	return out, nil
+}
+
+// SealChunk encrypts a file chunk, the nonce is derived from the content so the identical chunks of a file are
+// deduplicated
+func SealChunk(key *[keyLength]byte, chunk []byte) []byte {
+	mac, err := blake2b.New256(key[:])
+	if err != nil {
+		panic(err)
+	}
+	mac.Write(chunk)
+	var nonce [nonceLength]byte
+	copy(nonce[:], mac.Sum(nil))
+	return seal(key, &nonce, chunk)
+}
+
+// OpenChunk decrypts a chunk encrypted with `SealChunk`
+func OpenChunk(key *[keyLength]byte, data []byte) ([]byte, error) {
+	return open(key, data)
+}
+
+// WrapKey encrypts the key with the master key
+func WrapKey(master, key *[keyLength]byte) ([]byte, error) {
+	var nonce [nonceLength]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return seal(master, &nonce, key[:]), nil
+}
+
+// UnwrapKey decrypts a key encrypted with `WrapKey`
+func UnwrapKey(master *[keyLength]byte, wrapped []byte) (*[keyLength]byte, error) {
+	data, err := open(master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != keyLength {
+		return nil, ErrDecryption
+	}
+	key := new([keyLength]byte)
+	copy(key[:], data)
+	return key, nil
+}
+
+// Keyring holds the master key encrypted with a key derived from the passphrase
+type Keyring struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// NewKeyring protects the master key with the passphrase
+func NewKeyring(master *[keyLength]byte, passphrase []byte) (*Keyring, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	pkey, err := DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := WrapKey(pkey, master)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{Version: 1, Salt: salt, WrappedKey: wrapped}, nil
+}
+
+// Unlock returns the master key, `ErrDecryption` is returned if the passphrase is wrong
+func (kr *Keyring) Unlock(passphrase []byte) (*[keyLength]byte, error) {
+	pkey, err := DeriveKey(passphrase, kr.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKey(pkey, kr.WrappedKey)
+}
+
+// LoadKeyring loads the keyring stored at path
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := &Keyring{}
+	if err := json.Unmarshal(data, kr); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %v", path, err)
+	}
+	if kr.Version != 1 {
+		return nil, fmt.Errorf("unsupported keyring version %d", kr.Version)
+	}
+	return kr, nil
+}
+
+// Save stores the keyring at path (it fails if the file already exists)
+func (kr *Keyring) Save(path string) error {
+	js, err := json.Marshal(kr)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(js); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode encodes the master key (with a checksum) as a printable code, it gives access to all the encrypted data
+func RecoveryCode(master *[keyLength]byte) string {
+	sum := blake2b.Sum256(master[:])
+	code := recoveryEncoding.EncodeToString(append(master[:], sum[:4]...))
+	// Split the code in groups of 4 chars for readability
+	var parts []string
+	for len(code) > 4 {
+		parts = append(parts, code[:4])
+		code = code[4:]
+	}
+	parts = append(parts, code)
+	return recoveryPrefix + strings.Join(parts, "-")
+}
+
+// ParseRecoveryCode returns the master key encoded in the recovery code
+func ParseRecoveryCode(code string) (*[keyLength]byte, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !strings.HasPrefix(code, recoveryPrefix) {
+		return nil, fmt.Errorf("invalid recovery code")
+	}
+	data, err := recoveryEncoding.DecodeString(strings.Replace(code[len(recoveryPrefix):], "-", "", -1))
+	if err != nil || len(data) != keyLength+4 {
+		return nil, fmt.Errorf("invalid recovery code")
+	}
+	sum := blake2b.Sum256(data[:keyLength])
+	if !bytes.Equal(sum[:4], data[keyLength:]) {
+		return nil, fmt.Errorf("invalid recovery code checksum")
+	}
+	key := new([keyLength]byte)
+	copy(key[:], data[:keyLength])
+	return key, nil
+}
@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunks(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		panic(err)
+	}
+	chunk := []byte("hello world")
+	sealed := SealChunk(key, chunk)
+	if bytes.Contains(sealed, chunk) {
+		t.Errorf("chunk not encrypted")
+	}
+	// The identical chunks must be deduplicated
+	if !bytes.Equal(sealed, SealChunk(key, chunk)) {
+		t.Errorf("sealing is not deterministic")
+	}
+	out, err := OpenChunk(key, sealed)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(out, chunk) {
+		t.Errorf("got %q, expected %q", out, chunk)
+	}
+	other, err := NewKey()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := OpenChunk(other, sealed); err != ErrDecryption {
+		t.Errorf("expected ErrDecryption, got %v", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_keyring")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	master, err := NewKey()
+	if err != nil {
+		panic(err)
+	}
+	kr, err := NewKeyring(master, []byte("passphrase"))
+	if err != nil {
+		panic(err)
+	}
+	if err := kr.Save(path); err != nil {
+		panic(err)
+	}
+	if err := kr.Save(path); !os.IsExist(err) {
+		t.Errorf("expected the keyring to not be overwritten, got %v", err)
+	}
+	kr, err = LoadKeyring(path)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := kr.Unlock([]byte("wrong")); err != ErrDecryption {
+		t.Errorf("expected ErrDecryption, got %v", err)
+	}
+	key, err := kr.Unlock([]byte("passphrase"))
+	if err != nil {
+		panic(err)
+	}
+	if *key != *master {
+		t.Errorf("unlocked key mismatch")
+	}
+
+	code := RecoveryCode(master)
+	key, err = ParseRecoveryCode(code)
+	if err != nil {
+		panic(err)
+	}
+	if *key != *master {
+		t.Errorf("recovered key mismatch")
+	}
+	if _, err := ParseRecoveryCode(code[:len(code)-1] + "A"); err == nil && code[len(code)-1] != 'A' {
+		t.Errorf("expected an invalid checksum error")
+	}
+}
@@ -2,6 +2,9 @@ package ctxutil // import "a4.io/blobstash/pkg/ctxutil"
 
 import (
 	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
 
 	"a4.io/blobstash/pkg/auth"
 )
@@ -9,7 +12,15 @@ import (
 const (
 	StashNameHeader        = "BlobStash-Stash-Name"
 	FileTreeHostnameHeader = "BlobStash-FileTree-Hostname"
+	FileTreeMessageHeader  = "BlobStash-FileTree-Message"
 	NamespaceHeader        = "BlobStash-Namespace"
+
+	// Query parameter that can be used instead of the namespace header (e.g. `?db=<namespace>`)
+	NamespaceParam = "db"
+
+	// Set on the requests sent to the peers, so a missing blob is never fetched from a peer of a peer (preventing
+	// loops between instances peering with each other)
+	PeerFetchHeader = "BlobStash-Peer-Fetch"
 )
 
 type key int
@@ -19,6 +30,11 @@ const (
 	filetreeHostnameKey
 	namespaceKey
 	authKey
+	usageNamespaceKey
+	peerFetchKey
+	filetreeAuthorKey
+	filetreeMessageKey
+	localWriteKey
 )
 
 func WithStashName(ctx context.Context, name string) context.Context {
@@ -39,6 +55,26 @@ func FileTreeHostname(ctx context.Context) (string, bool) {
 	return h, ok
 }
 
+// WithFileTreeAuthor sets the author of the FS versions created within the context
+func WithFileTreeAuthor(ctx context.Context, author string) context.Context {
+	return context.WithValue(ctx, filetreeAuthorKey, author)
+}
+
+func FileTreeAuthor(ctx context.Context) (string, bool) {
+	a, ok := ctx.Value(filetreeAuthorKey).(string)
+	return a, ok
+}
+
+// WithFileTreeMessage sets the message of the FS versions created within the context
+func WithFileTreeMessage(ctx context.Context, message string) context.Context {
+	return context.WithValue(ctx, filetreeMessageKey, message)
+}
+
+func FileTreeMessage(ctx context.Context) (string, bool) {
+	m, ok := ctx.Value(filetreeMessageKey).(string)
+	return m, ok
+}
+
 func WithNamespace(ctx context.Context, namespace string) context.Context {
 	return context.WithValue(ctx, namespaceKey, namespace)
 }
@@ -48,6 +84,60 @@ func Namespace(ctx context.Context) (string, bool) {
 	return namespace, ok
 }
 
+// RequestNamespace returns the namespace targeted by the request, selected via the `BlobStash-Namespace` header or
+// the `db` query parameter (the header takes precedence), the root namespace is ""
+func RequestNamespace(r *http.Request) string {
+	if ns := r.Header.Get(NamespaceHeader); ns != "" {
+		return ns
+	}
+	return r.URL.Query().Get(NamespaceParam)
+}
+
+// ValidNamespace returns false if the namespace name cannot be used as a directory name within the stash dir (it
+// must not contain any path separator or "..", the root namespace "" is valid)
+func ValidNamespace(name string) bool {
+	if name == "" {
+		return true
+	}
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return false
+	}
+	clean := filepath.Clean(name)
+	return clean != "." && clean == name
+}
+
+// WithUsageNamespace sets the namespace the blobs written within the context are accounted to
+func WithUsageNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, usageNamespaceKey, namespace)
+}
+
+func UsageNamespace(ctx context.Context) (string, bool) {
+	namespace, ok := ctx.Value(usageNamespaceKey).(string)
+	return namespace, ok
+}
+
+// WithPeerFetch marks the context as being a fetch from a peer instance (the missing blobs are not fetched from the
+// peers)
+func WithPeerFetch(ctx context.Context, peerFetch bool) context.Context {
+	return context.WithValue(ctx, peerFetchKey, peerFetch)
+}
+
+func PeerFetch(ctx context.Context) bool {
+	peerFetch, _ := ctx.Value(peerFetchKey).(bool)
+	return peerFetch
+}
+
+// WithLocalWrite marks the blobs written within the context as created by this instance (as opposed to the blobs
+// received via the sync, the replication or from the peers)
+func WithLocalWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localWriteKey, true)
+}
+
+func LocalWrite(ctx context.Context) bool {
+	local, _ := ctx.Value(localWriteKey).(bool)
+	return local
+}
+
 type actionResource struct {
 	action, resource string
 }
@@ -34,7 +34,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/evanphx/json-patch"
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
 	logext "github.com/inconshreveable/log15/ext"
@@ -48,6 +47,7 @@ import (
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/httputil/bewit"
+	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/stash/store"
@@ -138,11 +138,13 @@ type DocStore struct {
 
 	indexes map[string]map[string]Indexer
 
+	views map[string]map[string]*view
+
 	logger log.Logger
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree) (*DocStore, error) {
+func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree, h *hub.Hub) (*DocStore, error) {
 	logger.Debug("init")
 
 	sortIndexes := map[string]map[string]Indexer{}
@@ -176,6 +178,7 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		locker:     newLocker(),
 		logger:     logger,
 		indexes:    sortIndexes,
+		views:      map[string]map[string]*view{},
 	}
 
 	// Finish the indexes setup
@@ -197,6 +200,10 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		}
 	}
 
+	if err := dc.setupViews(h); err != nil {
+		return nil, err
+	}
+
 	return dc, nil
 }
 
@@ -212,6 +219,13 @@ func (docstore *DocStore) Close() error {
 			}
 		}
 	}
+	for _, views := range docstore.views {
+		for _, v := range views {
+			if err := v.Close(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -268,6 +282,7 @@ func (docstore *DocStore) Register(r *mux.Router, basicAuth func(http.Handler) h
 	r.Handle("/{collection}/_rebuild_indexes", basicAuth(http.HandlerFunc(docstore.reindexDocsHandler()))) // FIXME Move this to _indexes with a DELETE ?
 	r.Handle("/{collection}/_map_reduce", basicAuth(http.HandlerFunc(docstore.mapReduceHandler())))
 	r.Handle("/{collection}/_indexes", basicAuth(http.HandlerFunc(docstore.indexesHandler())))
+	r.Handle("/{collection}/_view/{name}", basicAuth(http.HandlerFunc(docstore.viewHandler())))
 	r.Handle("/{collection}/{_id}", basicAuth(http.HandlerFunc(docstore.docHandler())))
 	r.Handle("/{collection}/{_id}/_versions", basicAuth(http.HandlerFunc(docstore.docVersionsHandler())))
 }
@@ -424,7 +439,7 @@ func (docstore *DocStore) indexesHandler() func(http.ResponseWriter, *http.Reque
 		switch r.Method {
 		case "GET":
 			// GET request, just list all the indexes
-			srw := httputil.NewSnappyResponseWriter(w, r)
+			srw := httputil.NewCompressResponseWriter(w, r)
 			indexes, err := docstore.GetSortIndexes(collection)
 			if err != nil {
 				panic(err)
@@ -532,6 +547,9 @@ type query struct {
 	script     string
 	lfunc      *lua.LFunction
 	sortIndex  string
+
+	// Native matcher (e.g. the SQL queries), takes precedence over the Lua queries
+	matcher QueryMatcher
 }
 
 func queryToScript(q *query) string {
@@ -545,7 +563,7 @@ end
 }
 
 func (q *query) isMatchAll() bool {
-	if q.lfunc == nil && q.script == "" && q.basicQuery == "" {
+	if q.matcher == nil && q.lfunc == nil && q.script == "" && q.basicQuery == "" {
 		return true
 	}
 	return false
@@ -660,6 +678,24 @@ func (docstore *DocStore) Query(collection string, query *query, cursor string,
 	return docs, pointers, stats, nil
 }
 
+// Select returns the documents matching the given native matcher, sorted using the given sort index (e.g. "-_id")
+func (docstore *DocStore) Select(collection string, matcher QueryMatcher, sortIndex string, limit int) ([]map[string]interface{}, error) {
+	docs, _, _, err := docstore.query(nil, collection, &query{
+		matcher:   matcher,
+		sortIndex: sortIndex,
+	}, "", limit, false, 0)
+	return docs, err
+}
+
+// IsIndexed returns true if the documents of the collection can be sorted by the given field
+func (docstore *DocStore) IsIndexed(collection, field string) bool {
+	if field == "_id" {
+		return true
+	}
+	_, err := docstore.GetSortIndex(collection, field)
+	return err == nil
+}
+
 // query returns a JSON list as []byte for the given query
 // docs are unmarhsalled to JSON only when needed.
 func (docstore *DocStore) query(L *lua.LState, collection string, query *query, cursor string, limit int, fetchPointers bool, asOf int64) ([]map[string]interface{}, map[string]interface{}, *executionStats, error) {
@@ -702,6 +738,9 @@ func (docstore *DocStore) query(L *lua.LState, collection string, query *query,
 	case query.isMatchAll():
 		stats.Engine = "match_all"
 		qmatcher = &MatchAllEngine{}
+	case query.matcher != nil:
+		stats.Engine = "native"
+		qmatcher = query.matcher
 	default:
 		qmatcher, err = docstore.newLuaQueryEngine(L, query)
 		if err != nil {
@@ -1428,73 +1467,26 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 				auth.Forbidden(w)
 				return
 			}
-			// Patch the document (JSON-Patch/RFC6902)
-
-			// Lock the document before making any change to it, this way the PATCH operation is *truly* atomic/safe
-			docstore.locker.Lock(sid)
-			defer docstore.locker.Unlock(sid)
-
-			ctx := context.Background()
-
-			// Fetch the current doc
-			doc := map[string]interface{}{}
-			if _id, _, err = docstore.Fetch(collection, sid, &doc, false, false, -1); err != nil {
-				if err == vkv.ErrNotFound {
-					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				panic(err)
-			}
-
-			js, err := json.Marshal(doc)
-			if err != nil {
-				panic(err)
-			}
-
-			// FIXME(tsileo): make it required?
-			if etag := r.Header.Get("If-Match"); etag != "" {
-				if etag != _id.VersionString() {
-					w.WriteHeader(http.StatusPreconditionFailed)
-					return
-				}
-			}
-
+			// Patch the document (JSON-Patch/RFC6902, or JSON Merge Patch/RFC7386 depending on the content type)
 			buf, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				panic(err)
 			}
+			merge := strings.HasPrefix(r.Header.Get("Content-Type"), MergePatchContentType)
 
-			patch, err := jsonpatch.DecodePatch(buf)
-			if err != nil {
-				panic(err)
-			}
-			docstore.logger.Debug("patch decoded", "patch", patch)
-
-			pdata, err := patch.Apply(js)
-			if err != nil {
-				panic(err)
-			}
-
-			// Back to msgpack
-			ndoc := map[string]interface{}{}
-			if err := json.Unmarshal(pdata, &ndoc); err != nil {
-				panic(err)
-			}
-			data, err := msgpack.Marshal(ndoc)
-			if err != nil {
-				panic(err)
-			}
-
-			// TODO(tsileo): also check for reserved keys here
-
-			nkv, err := docstore.kvStore.Put(ctx, fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), -1)
-			if err != nil {
-				panic(err)
-			}
-			_id.SetVersion(nkv.Version)
-
-			if err := docstore.IndexDoc(collection, _id, ndoc); err != nil {
+			_id, err := docstore.Patch(collection, sid, buf, merge, r.Header.Get("If-Match"))
+			switch {
+			case err == nil:
+			case err == ErrDocNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case err == ErrPreconditionFailed:
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			case errors.Is(err, ErrInvalidPatch):
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			default:
 				panic(err)
 			}
 
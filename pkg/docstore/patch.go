@@ -0,0 +1,101 @@
+package docstore // import "a4.io/blobstash/pkg/docstore"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Content types of the PATCH payloads
+const (
+	JSONPatchContentType  = "application/json-patch+json"
+	MergePatchContentType = "application/merge-patch+json"
+)
+
+// ErrInvalidPatch is returned when the patch cannot be decoded or applied (including a failed JSON Patch "test" op)
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// Patch applies a JSON Patch (RFC 6902), or a JSON Merge Patch (RFC 7386) if `merge` is set, to the latest version of
+// the document, and saves (and indexes) the patched document as a new version
+func (docstore *DocStore) Patch(collection, sid string, patch []byte, merge bool, ifMatch string) (*id.ID, error) {
+	// Lock the document so the patch is applied atomically
+	docstore.locker.Lock(sid)
+	defer docstore.locker.Unlock(sid)
+
+	ctx := context.Background()
+	doc := map[string]interface{}{}
+	_id, _, err := docstore.Fetch(collection, sid, &doc, false, false, -1)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, ErrDocNotFound
+		}
+		return nil, err
+	}
+	// The deleted documents are fetched as tombstones
+	if _id.Flag() == flagDeleted {
+		return nil, ErrDocNotFound
+	}
+
+	// Optimistic concurrency (done via If-Match header/status precondition failed)
+	if ifMatch != "" && ifMatch != _id.VersionString() {
+		return nil, ErrPreconditionFailed
+	}
+
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var pdata []byte
+	if merge {
+		if pdata, err = jsonpatch.MergePatch(js, patch); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	} else {
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if pdata, err = p.Apply(js); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	}
+
+	newDoc := map[string]interface{}{}
+	if err := json.Unmarshal(pdata, &newDoc); err != nil {
+		return nil, fmt.Errorf("%w: the patched document must be an object", ErrInvalidPatch)
+	}
+
+	// Field/key starting with `_` are forbidden, remove them
+	for k := range newDoc {
+		if _, ok := reservedKeys[k]; ok {
+			delete(newDoc, k)
+		}
+	}
+
+	data, err := msgpack.Marshal(newDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	docstore.logger.Debug("Patch", "_id", sid, "new_doc", newDoc)
+
+	kv, err := docstore.kvStore.Put(ctx, fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), -1)
+	if err != nil {
+		return nil, err
+	}
+	_id.SetVersion(kv.Version)
+
+	if err := docstore.IndexDoc(collection, _id, newDoc); err != nil {
+		return nil, err
+	}
+
+	return _id, nil
+}
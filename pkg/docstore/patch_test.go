@@ -0,0 +1,69 @@
+package docstore
+
+import (
+	"errors"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestPatch(t *testing.T) {
+	env := testutil.New(t, "docstore_patch_test")
+	defer env.Close()
+
+	docstore, err := New(env.Log, &config.Config{DataDir: env.Dir}, env.KvStore, env.BlobStore, nil, env.Hub)
+	check(err)
+	defer docstore.Close()
+
+	_id, err := docstore.Insert("posts", map[string]interface{}{"title": "hello", "tags": []interface{}{"a"}})
+	check(err)
+	sid := _id.String()
+
+	fetch := func() (string, map[string]interface{}) {
+		doc := map[string]interface{}{}
+		_id, _, err := docstore.Fetch("posts", sid, &doc, false, false, -1)
+		check(err)
+		return _id.VersionString(), doc
+	}
+	version, _ := fetch()
+
+	// JSON Patch
+	_id, err = docstore.Patch("posts", sid, []byte(`[{"op": "replace", "path": "/title", "value": "world"}, {"op": "add", "path": "/tags/-", "value": "b"}]`), false, version)
+	check(err)
+	newVersion, doc := fetch()
+	if newVersion != _id.VersionString() || newVersion == version {
+		t.Errorf("a new version should have been saved")
+	}
+	if doc["title"] != "world" || len(doc["tags"].([]interface{})) != 2 {
+		t.Errorf("patch not applied, got %+v", doc)
+	}
+
+	// The previous version is stale
+	if _, err := docstore.Patch("posts", sid, []byte(`{"title": "stale"}`), true, version); err != ErrPreconditionFailed {
+		t.Errorf("expected ErrPreconditionFailed, got %v", err)
+	}
+
+	// Merge patch
+	_, err = docstore.Patch("posts", sid, []byte(`{"title": null, "draft": true}`), true, newVersion)
+	check(err)
+	_, doc = fetch()
+	if _, ok := doc["title"]; ok || doc["draft"] != true {
+		t.Errorf("merge patch not applied, got %+v", doc)
+	}
+
+	// A failed "test" op rejects the whole patch
+	if _, err := docstore.Patch("posts", sid, []byte(`[{"op": "test", "path": "/draft", "value": false}]`), false, ""); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("expected ErrInvalidPatch, got %v", err)
+	}
+	if _, err := docstore.Patch("posts", "nope", []byte(`{}`), true, ""); err == nil {
+		t.Errorf("patching a missing doc should fail")
+	}
+
+	// A deleted doc cannot be patched
+	_, err = docstore.Remove("posts", sid)
+	check(err)
+	if _, err := docstore.Patch("posts", sid, []byte(`{"title": "back"}`), true, ""); err != ErrDocNotFound {
+		t.Errorf("expected ErrDocNotFound for a deleted doc, got %v", err)
+	}
+}
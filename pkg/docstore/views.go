@@ -0,0 +1,451 @@
+package docstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Views are map/reduce queries (using the same Lua hooks as the `_map_reduce` endpoint) that are incrementally
+// maintained as the documents of the collection change (via the hub events).
+//
+// The emitted values of each document are kept in a local index, so when a document changes, only the keys it
+// emitted (before and after the change) are reduced again. The reduced values are materialized in the kvstore:
+//
+//	docstore-view:<collection>:<view>:<key> => <JSON reduced value>
+var (
+	viewPrefixKeyFmt = "docstore-view:%s:%s:"
+	viewKeyFmt       = viewPrefixKeyFmt + "%s"
+)
+
+// Keys of the local index
+const (
+	viewCodeKey     = "code"
+	viewDocPrefix   = "d:" // d:<doc id> => emits of the latest version of the doc
+	viewEmitsPrefix = "k:" // k:<key>\x00<doc id> => values emitted for the key by the doc
+)
+
+type viewDoc struct {
+	Version int64                               `json:"v"`
+	Emits   map[string][]map[string]interface{} `json:"e,omitempty"`
+}
+
+type view struct {
+	collection, name string
+	code             string
+
+	db  *rangedb.RangeDB
+	mre *MapReduceEngine // The Lua state is not thread-safe, calls are guarded by `mu`
+
+	kvStore store.KvStore
+	path    string
+	log     log.Logger
+	mu      sync.Mutex
+}
+
+func (docstore *DocStore) newView(collection, name string, conf *config.DocstoreView) (*view, error) {
+	mre := NewMapReduceEngine()
+	if err := mre.SetupMap(conf.Map); err != nil {
+		mre.Close()
+		return nil, fmt.Errorf("invalid map: %w", err)
+	}
+	if err := mre.SetupReduce(conf.Reduce); err != nil {
+		mre.Close()
+		return nil, fmt.Errorf("invalid reduce: %w", err)
+	}
+	path := filepath.Join(docstore.conf.VarDir(), fmt.Sprintf("docstore_%s_view_%s.index", collection, name))
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &view{
+		collection: collection,
+		name:       name,
+		code:       fmt.Sprintf("%x", blake2b.Sum256([]byte(conf.Map+"\x00"+conf.Reduce))),
+		db:         db,
+		mre:        mre,
+		kvStore:    docstore.kvStore,
+		path:       path,
+		log:        docstore.logger.New("view", fmt.Sprintf("%s:%s", collection, name)),
+	}, nil
+}
+
+func (v *view) Close() error {
+	v.mre.Close()
+	return v.db.Close()
+}
+
+// emits runs the map hook against the doc
+func (v *view) emits(sid string, doc map[string]interface{}) (map[string][]map[string]interface{}, error) {
+	v.mre.emitted = map[string][]map[string]interface{}{}
+	mdoc := map[string]interface{}{}
+	for k, val := range doc {
+		mdoc[k] = val
+	}
+	mdoc["_id"] = sid
+	if err := v.mre.M.ExecuteNoResult(mdoc); err != nil {
+		return nil, err
+	}
+	return v.mre.emitted, nil
+}
+
+// apply updates the local index with the new version of a doc (`doc` is nil if it has been deleted), and returns the
+// keys that need to be reduced again
+func (v *view) apply(sid string, version int64, doc map[string]interface{}) (map[string]struct{}, error) {
+	affected := map[string]struct{}{}
+
+	old := &viewDoc{}
+	data, err := v.db.Get([]byte(viewDocPrefix + sid))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, old); err != nil {
+			return nil, err
+		}
+		// Versions may be replayed out of order (e.g. sync/scan)
+		if old.Version >= version {
+			return affected, nil
+		}
+	}
+
+	newDoc := &viewDoc{Version: version}
+	if doc != nil {
+		newDoc.Emits, err = v.emits(sid, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range old.Emits {
+		if err := v.db.Delete([]byte(viewEmitsPrefix + key + "\x00" + sid)); err != nil {
+			return nil, err
+		}
+		affected[key] = struct{}{}
+	}
+	for key, values := range newDoc.Emits {
+		js, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.db.Set([]byte(viewEmitsPrefix+key+"\x00"+sid), js); err != nil {
+			return nil, err
+		}
+		affected[key] = struct{}{}
+	}
+
+	// Keep the version of deleted docs too, to discard older versions
+	js, err := json.Marshal(newDoc)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.db.Set([]byte(viewDocPrefix+sid), js); err != nil {
+		return nil, err
+	}
+	return affected, nil
+}
+
+// refresh reduces the values emitted for the key and materializes the result in the kvstore
+func (v *view) refresh(ctx context.Context, key string) error {
+	values := []map[string]interface{}{}
+	c := v.db.PrefixRange([]byte(viewEmitsPrefix+key+"\x00"), false)
+	defer c.Close()
+	_, data, err := c.Next()
+	for ; err == nil; _, data, err = c.Next() {
+		var docValues []map[string]interface{}
+		if err := json.Unmarshal(data, &docValues); err != nil {
+			return err
+		}
+		values = append(values, docValues...)
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	kvKey := fmt.Sprintf(viewKeyFmt, v.collection, v.name, key)
+	current, err := v.kvStore.Get(ctx, kvKey, -1)
+	if err != nil && err != vkv.ErrNotFound {
+		return err
+	}
+	if err == vkv.ErrNotFound || current.Tombstone {
+		current = nil
+	}
+
+	if len(values) == 0 {
+		if current != nil {
+			if _, err := v.kvStore.Delete(ctx, kvKey, -1); err != nil && err != vkv.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reduced, err := v.mre.R.ExecuteReduce(key, values)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(reduced)
+	if err != nil {
+		return err
+	}
+	if current != nil && bytes.Equal(current.Data, js) {
+		return nil
+	}
+	_, err = v.kvStore.Put(ctx, kvKey, "", js, -1)
+	return err
+}
+
+// update processes a new doc version
+func (v *view) update(ctx context.Context, sid string, version int64, doc map[string]interface{}) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	affected, err := v.apply(sid, version, doc)
+	if err != nil {
+		return err
+	}
+	for key := range affected {
+		if err := v.refresh(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuild re-creates the view from scratch (needed when it's created or when its code changes)
+func (v *view) rebuild(docstore *DocStore) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	code, err := v.db.Get([]byte(viewCodeKey))
+	if err != nil {
+		return err
+	}
+	if string(code) == v.code {
+		return nil
+	}
+	v.log.Info("building view")
+
+	if err := v.db.Destroy(); err != nil {
+		return err
+	}
+	if v.db, err = rangedb.New(v.path); err != nil {
+		return err
+	}
+
+	affected := map[string]struct{}{}
+	if err := docstore.IterCollection(v.collection, func(_id *id.ID, doc map[string]interface{}) error {
+		keys, err := v.apply(_id.String(), _id.Version(), doc)
+		if err != nil {
+			return err
+		}
+		for key := range keys {
+			affected[key] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for key := range affected {
+		if err := v.refresh(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// Remove the keys from the previous definition that are not emitted anymore
+	prefix := fmt.Sprintf(viewPrefixKeyFmt, v.collection, v.name)
+	kvs, _, err := docstore.kvStore.Keys(ctx, prefix, prefix+"\xff", -1)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if _, ok := affected[strings.TrimPrefix(kv.Key, prefix)]; ok || kv.Tombstone {
+			continue
+		}
+		if _, err := docstore.kvStore.Delete(ctx, kv.Key, -1); err != nil && err != vkv.ErrNotFound {
+			return err
+		}
+	}
+
+	return v.db.Set([]byte(viewCodeKey), []byte(v.code))
+}
+
+// setupViews loads the views defined in the config, and subscribes to the new blob event to maintain them
+func (docstore *DocStore) setupViews(h *hub.Hub) error {
+	if docstore.conf.Docstore == nil || len(docstore.conf.Docstore.Views) == 0 {
+		return nil
+	}
+	for collection, views := range docstore.conf.Docstore.Views {
+		docstore.views[collection] = map[string]*view{}
+		for name, viewConf := range views {
+			v, err := docstore.newView(collection, name, viewConf)
+			if err != nil {
+				return fmt.Errorf("failed to init view %s/%s: %w", collection, name, err)
+			}
+			docstore.views[collection][name] = v
+			if err := v.rebuild(docstore); err != nil {
+				return fmt.Errorf("failed to build view %s/%s: %w", collection, name, err)
+			}
+		}
+	}
+	h.Subscribe(hub.NewBlob, "docstore_views", docstore.viewsNewBlobCallback)
+	return nil
+}
+
+func (docstore *DocStore) viewsNewBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	metaType, data, isMeta := meta.IsMetaBlob(blb.Data)
+	if !isMeta {
+		return nil
+	}
+	kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := docstore.updateViews(ctx, kv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (docstore *DocStore) updateViews(ctx context.Context, kv *vkv.KeyValue) error {
+	if !strings.HasPrefix(kv.Key, prefixKey) || len(kv.Data) == 0 {
+		return nil
+	}
+	parts := strings.Split(kv.Key[len(prefixKey):], ":")
+	if len(parts) != 2 {
+		return nil
+	}
+	views, ok := docstore.views[parts[0]]
+	if !ok {
+		return nil
+	}
+
+	var doc map[string]interface{}
+	if kv.Data[0] != flagDeleted {
+		doc = map[string]interface{}{}
+		if err := msgpack.Unmarshal(kv.Data[1:], &doc); err != nil {
+			return err
+		}
+	}
+	for _, v := range views {
+		if err := v.update(ctx, parts[1], kv.Version, doc); err != nil {
+			return fmt.Errorf("failed to update view %s/%s: %w", v.collection, v.name, err)
+		}
+	}
+	return nil
+}
+
+func viewValue(kv *vkv.KeyValue) (map[string]interface{}, error) {
+	value := map[string]interface{}{}
+	if err := json.Unmarshal(kv.Data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (docstore *DocStore) viewHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		name := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.JSONCollection),
+			perms.ResourceWithID(perms.DocStore, perms.JSONCollection, collection),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if _, ok := docstore.views[collection][name]; !ok {
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("view %q not found", name))
+			return
+		}
+
+		ctx := context.Background()
+		q := httputil.NewQuery(r.URL.Query())
+		prefix := fmt.Sprintf(viewPrefixKeyFmt, collection, name)
+
+		// Fetch a single key
+		if key := q.Get("key"); key != "" {
+			kv, err := docstore.kvStore.Get(ctx, prefix+key, -1)
+			if err == vkv.ErrNotFound || (err == nil && kv.Tombstone) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
+			value, err := viewValue(kv)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"key":   key,
+				"value": value,
+			})
+			return
+		}
+
+		limit, err := q.GetInt("limit", 50, 1000)
+		if err != nil {
+			panic(err)
+		}
+		kvs, cursor, err := docstore.kvStore.Keys(ctx, prefix+q.Get("cursor"), prefix+"\xff", limit)
+		if err != nil {
+			panic(err)
+		}
+		out := []map[string]interface{}{}
+		for _, kv := range kvs {
+			if kv.Tombstone {
+				continue
+			}
+			value, err := viewValue(kv)
+			if err != nil {
+				panic(err)
+			}
+			out = append(out, map[string]interface{}{
+				"key":   strings.TrimPrefix(kv.Key, prefix),
+				"value": value,
+			})
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": out,
+			"pagination": map[string]interface{}{
+				"cursor":   strings.TrimPrefix(cursor, prefix),
+				"has_more": len(kvs) == limit,
+				"count":    len(out),
+				"per_page": limit,
+			},
+		})
+	}
+}
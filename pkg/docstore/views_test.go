@@ -0,0 +1,89 @@
+package docstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestViews(t *testing.T) {
+	env := testutil.New(t, "docstore_views_test")
+	defer env.Close()
+	kvs := env.KvStore
+
+	conf := &config.Config{
+		DataDir: env.Dir,
+		Docstore: &config.DocstoreConfig{
+			Views: map[string]map[string]*config.DocstoreView{
+				"posts": map[string]*config.DocstoreView{
+					"by_tag": &config.DocstoreView{
+						Map: `return function(doc)
+  emit(doc.tag, { count = 1 })
+end`,
+						Reduce: `return function(key, values)
+  local out = { count = 0 }
+  for _, v in ipairs(values) do
+    out.count = out.count + v.count
+  end
+  return out
+end`,
+					},
+				},
+			},
+		},
+	}
+	docstore, err := New(env.Log, conf, env.KvStore, env.BlobStore, nil, env.Hub)
+	check(err)
+	defer docstore.Close()
+
+	count := func(tag string) int {
+		kv, err := kvs.Get(context.Background(), fmt.Sprintf(viewKeyFmt, "posts", "by_tag", tag), -1)
+		if err == vkv.ErrNotFound {
+			return 0
+		}
+		check(err)
+		value := map[string]interface{}{}
+		check(json.Unmarshal(kv.Data, &value))
+		return int(value["count"].(float64))
+	}
+
+	_, err = docstore.Insert("posts", map[string]interface{}{"tag": "go"})
+	check(err)
+	_id, err := docstore.Insert("posts", map[string]interface{}{"tag": "go"})
+	check(err)
+	_, err = docstore.Insert("posts", map[string]interface{}{"tag": "lua"})
+	check(err)
+	if c := count("go"); c != 2 {
+		t.Errorf("expected 2 go posts, got %d", c)
+	}
+	if c := count("lua"); c != 1 {
+		t.Errorf("expected 1 lua post, got %d", c)
+	}
+
+	// Moving a doc to another key updates both keys
+	_, err = docstore.Update("posts", _id.String(), map[string]interface{}{"tag": "lua"}, "")
+	check(err)
+	if c := count("go"); c != 1 {
+		t.Errorf("expected 1 go post, got %d", c)
+	}
+	if c := count("lua"); c != 2 {
+		t.Errorf("expected 2 lua posts, got %d", c)
+	}
+
+	_, err = docstore.Remove("posts", _id.String())
+	check(err)
+	if c := count("lua"); c != 1 {
+		t.Errorf("expected 1 lua post, got %d", c)
+	}
+}
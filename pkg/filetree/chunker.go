@@ -0,0 +1,99 @@
+package filetree
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/restic/chunker"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/filetree/writer"
+)
+
+// ChunkerOptionsFromConfig converts the chunker config, the unset values use the defaults
+func ChunkerOptionsFromConfig(conf *config.ChunkerConfig) (*writer.ChunkerOptions, error) {
+	opts := writer.DefaultChunkerOptions()
+	if conf == nil {
+		return opts, nil
+	}
+	if conf.Algorithm != "" {
+		opts.Algorithm = conf.Algorithm
+	}
+	if conf.MinSize > 0 {
+		opts.MinSize = conf.MinSize
+	}
+	if conf.AvgSize > 0 {
+		opts.AvgSize = conf.AvgSize
+	}
+	if conf.MaxSize > 0 {
+		opts.MaxSize = conf.MaxSize
+	}
+	if conf.Polynomial != "" {
+		pol, err := strconv.ParseUint(conf.Polynomial, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		opts.Pol = chunker.Pol(pol)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func (ft *FileTree) setupChunkers() error {
+	var err error
+	ft.chunker, err = ChunkerOptionsFromConfig(nil)
+	if err != nil {
+		return err
+	}
+	ft.nsChunkers = map[string]*writer.ChunkerOptions{}
+	if ft.conf.Filetree == nil {
+		return nil
+	}
+	if ft.chunker, err = ChunkerOptionsFromConfig(ft.conf.Filetree.Chunker); err != nil {
+		return err
+	}
+	for ns, conf := range ft.conf.Filetree.NamespaceChunkers {
+		if ft.nsChunkers[ns], err = ChunkerOptionsFromConfig(conf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChunkerOptions returns the chunking parameters for the namespace of the given context
+func (ft *FileTree) ChunkerOptions(ctx context.Context) *writer.ChunkerOptions {
+	if ns, ok := ctxutil.Namespace(ctx); ok {
+		if opts, ok := ft.nsChunkers[ns]; ok {
+			return opts
+		}
+	}
+	return ft.chunker
+}
+
+// NewUploader returns a file uploader for the namespace of the given context
+func (ft *FileTree) NewUploader(ctx context.Context) *writer.Uploader {
+	uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+	// The options are validated at startup
+	if err := uploader.SetChunker(ft.ChunkerOptions(ctx)); err != nil {
+		panic(err)
+	}
+	return uploader
+}
+
+// NewDeltaUploader returns a file uploader that stores the modified chunks as deltas against the previous version of
+// the file, if the delta compression is enabled
+func (ft *FileTree) NewDeltaUploader(ctx context.Context, prev *Node) *writer.Uploader {
+	uploader := ft.NewUploader(ctx)
+	if ft.conf.Filetree == nil || !ft.conf.Filetree.DeltaCompression {
+		return uploader
+	}
+	if prev != nil && prev.Meta != nil && prev.Meta.IsFile() && prev.Meta.Size > 0 {
+		if err := uploader.SetDeltaBase(prev.Meta); err != nil {
+			panic(err)
+		}
+	}
+	return uploader
+}
@@ -0,0 +1,342 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/cloudimport"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/jobs"
+)
+
+// CloudImportJob is the kind of the cloud folder import jobs (the params hold the FS `name`)
+const CloudImportJob = "filetree.cloudimport"
+
+// Node metadata holding the provider content hash of the imported files
+const cloudHashKey = "cloud_content_hash"
+
+// CloudImportResult holds the result of a cloud folder import
+type CloudImportResult struct {
+	Ref        string `json:"ref"`
+	Files      int    `json:"files"`
+	Downloaded int    `json:"downloaded"`
+	Size       int64  `json:"size"` // Downloaded bytes
+
+	// Set if the import created a new FS version
+	Version int64 `json:"version,omitempty"`
+}
+
+type cloudImportParams struct {
+	Name string `json:"name"`
+}
+
+// RegisterJobs registers the FileTree jobs (the cloud imports and the HLS transcoding) on the jobs manager, and
+// schedules the configured cloud imports
+func (ft *FileTree) RegisterJobs(m *jobs.Manager) error {
+	if err := m.RegisterKind(&jobs.Kind{
+		Name:  CloudImportJob,
+		Run:   ft.runCloudImport,
+		Retry: jobs.RetryPolicy{MaxAttempts: 3, Backoff: time.Minute},
+	}); err != nil {
+		return err
+	}
+	if ft.hlsEnabled() {
+		if err := ft.registerHLSJob(m); err != nil {
+			return err
+		}
+	}
+	if ft.conf.Filetree == nil {
+		return nil
+	}
+	for name, conf := range ft.conf.Filetree.CloudImports {
+		if _, err := cloudimport.New(conf); err != nil {
+			return fmt.Errorf("invalid cloud import %q: %v", name, err)
+		}
+		go ft.cloudImportWorker(m, name, conf)
+	}
+	return nil
+}
+
+// cloudImportWorker periodically starts the import of the cloud folder
+func (ft *FileTree) cloudImportWorker(m *jobs.Manager, name string, conf *config.CloudImportConfig) {
+	log := ft.log.New("worker", "cloud_import_worker", "fs", name)
+	log.Debug("starting worker")
+	interval := time.Hour
+	if conf.Interval > 0 {
+		interval = time.Duration(conf.Interval) * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if ft.shedder.Shedding() {
+			log.Info("backend degraded, skipping the cloud import")
+		} else if err := ft.startCloudImport(m, name); err != nil {
+			log.Error("failed to start the cloud import", "err", err)
+		}
+		select {
+		case <-ft.stop:
+			log.Debug("worker stopped")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// startCloudImport starts an import job, unless the previous one is not finished yet
+func (ft *FileTree) startCloudImport(m *jobs.Manager, name string) error {
+	for _, state := range []string{jobs.Running, jobs.Pending} {
+		active, err := m.List(CloudImportJob, state, 0)
+		if err != nil {
+			return err
+		}
+		for _, j := range active {
+			params := &cloudImportParams{}
+			if err := json.Unmarshal(j.Params, params); err == nil && params.Name == name {
+				return nil
+			}
+		}
+	}
+	_, err := m.Start(CloudImportJob, &cloudImportParams{Name: name})
+	return err
+}
+
+func (ft *FileTree) runCloudImport(ctx context.Context, h *jobs.Handle) error {
+	params := &cloudImportParams{}
+	if err := h.Params(params); err != nil {
+		return err
+	}
+	var conf *config.CloudImportConfig
+	if ft.conf.Filetree != nil {
+		conf = ft.conf.Filetree.CloudImports[params.Name]
+	}
+	if conf == nil {
+		return fmt.Errorf("unknown cloud import %q", params.Name)
+	}
+	p, err := cloudimport.New(conf)
+	if err != nil {
+		return err
+	}
+	res, err := ft.CloudImport(ctx, params.Name, p, func(done, total int) {
+		h.SetProgress(int64(done), int64(total))
+	})
+	if err != nil {
+		return err
+	}
+	return h.SetResult(res)
+}
+
+// CloudImport mirrors the cloud folder into the FS, the files of the previous imports are replaced by the folder
+// content while the other files of the FS are kept (a cloud file conflicting with one of them is skipped). The
+// modification times are preserved and only the new/modified files are downloaded (the others are matched via the
+// provider content hash recorded in the node metadata).
+//
+// A new FS version is only created if the folder has changed since the last import.
+func (ft *FileTree) CloudImport(ctx context.Context, name string, p cloudimport.Provider, progress func(done, total int)) (*CloudImportResult, error) {
+	files, err := p.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the %s folder: %v", p.Name(), err)
+	}
+
+	fs, err := ft.FS(ctx, name, FSKeyFmt, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	root := newImportDir("_root")
+	previous := map[string]*rnode.RawNode{}
+	importedDirs := map[*importDir]bool{}
+	if fs.Ref != "" {
+		rootMeta, err := ft.rawNode(ctx, fs.Ref)
+		if err != nil {
+			return nil, err
+		}
+		root.mode = rootMeta.Mode
+		root.modTime = rootMeta.ModTime
+		if _, err := ft.loadImportDir(ctx, rootMeta, "", root, previous, importedDirs); err != nil {
+			return nil, err
+		}
+	}
+
+	up := ft.NewUploader(ctx)
+	res := &CloudImportResult{}
+	seen := map[string]struct{}{}
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(i, len(files))
+		fpath := path.Clean("/" + f.Path)[1:]
+		if fpath == "" {
+			continue
+		}
+		parent, err := root.dir(path.Dir("/" + fpath))
+		if err != nil {
+			ft.log.Error("skipping cloud file", "fs", name, "path", f.Path, "err", err)
+			continue
+		}
+		base := path.Base(fpath)
+		if _, ok := parent.dirs[base]; ok {
+			ft.log.Error("skipping cloud file, a dir has the same name", "fs", name, "path", f.Path)
+			continue
+		}
+		if _, ok := seen[fpath]; ok {
+			ft.log.Error("skipping duplicate cloud file", "fs", name, "path", f.Path)
+			continue
+		}
+		if _, ok := parent.files[base]; ok {
+			ft.log.Error("skipping cloud file, a local file has the same name", "fs", name, "path", f.Path)
+			continue
+		}
+		seen[fpath] = struct{}{}
+		res.Files++
+
+		if prev, ok := previous[fpath]; ok && f.Hash != "" && prev.Metadata[cloudHashKey] == f.Hash && prev.ModTime == f.ModTime.Unix() {
+			parent.files[base] = prev
+			continue
+		}
+
+		meta, err := ft.downloadCloudFile(ctx, up, p, f, base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %q: %v", f.Path, err)
+		}
+		parent.files[base] = meta
+		res.Downloaded++
+		res.Size += int64(meta.Size)
+	}
+	progress(len(files), len(files))
+	root.pruneDirs(importedDirs)
+	root.setModTimes()
+
+	meta, err := ft.putImportDir(up, root, &ImportResult{})
+	if err != nil {
+		return nil, err
+	}
+	res.Ref = meta.Hash
+	if meta.Hash == fs.Ref {
+		return res, nil
+	}
+
+	snapEncoded, err := msgpack.Marshal(&Snapshot{
+		Hostname: "cloudimport",
+		Message:  fmt.Sprintf("%s import", p.Name()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	newRev, err := ft.kvStore.Put(ctx, fmt.Sprintf(FSKeyFmt, name), meta.Hash, snapEncoded, -1)
+	if err != nil {
+		return nil, err
+	}
+	res.Version = newRev.Version
+
+	updateEvent := &FSUpdateEvent{
+		Name: name,
+		Type: "cloud-import",
+		Ref:  meta.Hash,
+		Time: time.Now().UTC().Unix(),
+	}
+	if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+		return nil, err
+	}
+	ft.log.Info("cloud folder imported", "fs", name, "files", res.Files, "downloaded", res.Downloaded, "version", res.Version)
+	return res, nil
+}
+
+// downloadCloudFile uploads the content of the cloud file, along with its content hash
+func (ft *FileTree) downloadCloudFile(ctx context.Context, up *writer.Uploader, p cloudimport.Provider, f *cloudimport.File, name string) (*rnode.RawNode, error) {
+	rc, err := p.Open(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	meta := &rnode.RawNode{
+		Name:    name,
+		Type:    rnode.File,
+		Mode:    0644,
+		ModTime: f.ModTime.Unix(),
+	}
+	if f.Hash != "" {
+		meta.Metadata = map[string]interface{}{cloudHashKey: f.Hash}
+	}
+	return up.PutReaderMeta(rc, meta)
+}
+
+func (ft *FileTree) rawNode(ctx context.Context, ref string) (*rnode.RawNode, error) {
+	data, err := ft.blobStore.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return rnode.NewNodeFromBlob(ref, data)
+}
+
+// loadImportDir loads the existing FS dir into `d`, the files of a previous import (the ones with a provider content
+// hash) are collected by path in `previous` instead, and the dirs holding some of them are marked in `importedDirs`
+func (ft *FileTree) loadImportDir(ctx context.Context, m *rnode.RawNode, p string, d *importDir, previous map[string]*rnode.RawNode, importedDirs map[*importDir]bool) (bool, error) {
+	var imported bool
+	for _, cref := range m.Refs {
+		child, err := ft.rawNode(ctx, cref.(string))
+		if err != nil {
+			return false, err
+		}
+		childPath := path.Join(p, child.Name)
+		if child.Type == rnode.File {
+			if _, ok := child.Metadata[cloudHashKey]; ok {
+				previous[childPath] = child
+				imported = true
+				continue
+			}
+			d.files[child.Name] = child
+			continue
+		}
+		sub := newImportDir(child.Name)
+		sub.mode = child.Mode
+		sub.modTime = child.ModTime
+		d.dirs[child.Name] = sub
+		subImported, err := ft.loadImportDir(ctx, child, childPath, sub, previous, importedDirs)
+		if err != nil {
+			return false, err
+		}
+		imported = imported || subImported
+	}
+	if imported {
+		importedDirs[d] = true
+	}
+	return imported, nil
+}
+
+// pruneDirs removes the dirs left empty by the removal of the imported files (the empty dirs created locally are kept)
+func (d *importDir) pruneDirs(importedDirs map[*importDir]bool) {
+	for name, child := range d.dirs {
+		child.pruneDirs(importedDirs)
+		if len(child.dirs) == 0 && len(child.files) == 0 && importedDirs[child] {
+			delete(d.dirs, name)
+		}
+	}
+}
+
+// setModTimes sets the modification time of the dirs to the most recent one of their children, so an unchanged
+// folder is imported as the same tree
+func (d *importDir) setModTimes() int64 {
+	var latest int64
+	for _, child := range d.dirs {
+		if mt := child.setModTimes(); mt > latest {
+			latest = mt
+		}
+	}
+	for _, meta := range d.files {
+		if meta.ModTime > latest {
+			latest = meta.ModTime
+		}
+	}
+	// Keep the modification time of the empty dirs (so the tree stays the same across imports)
+	if latest > 0 {
+		d.modTime = latest
+	}
+	return d.modTime
+}
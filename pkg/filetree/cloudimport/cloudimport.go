@@ -0,0 +1,152 @@
+// Package cloudimport implements the Dropbox and Google Drive clients used to mirror cloud folders into FSes.
+//
+// The clients only need read access, they authenticate with the refresh token obtained when the OAuth app was
+// authorized (offline access), the access tokens are refreshed as they expire.
+package cloudimport // import "a4.io/blobstash/pkg/filetree/cloudimport"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// Providers
+const (
+	Dropbox     = "dropbox"
+	GoogleDrive = "gdrive"
+)
+
+// Timeout of the API calls (the downloads are not bounded)
+var apiTimeout = 30 * time.Second
+
+// File is a file of the mirrored folder
+type File struct {
+	ID      string
+	Path    string // Relative to the mirrored folder (slash-separated, no leading slash)
+	Size    int64
+	ModTime time.Time
+
+	// Provider content hash (prefixed by its type), used to skip the unchanged files (the files without hash are
+	// always downloaded)
+	Hash string
+}
+
+// Provider lists and downloads the files of a cloud folder
+type Provider interface {
+	Name() string
+
+	// List returns all the files of the folder (recursively)
+	List(context.Context) ([]*File, error)
+
+	// Open downloads the file
+	Open(context.Context, *File) (io.ReadCloser, error)
+}
+
+// New returns the provider client for the given config
+func New(conf *config.CloudImportConfig) (Provider, error) {
+	if conf.ClientID == "" || conf.RefreshToken == "" {
+		return nil, fmt.Errorf("missing client_id/refresh_token")
+	}
+	switch conf.Provider {
+	case Dropbox:
+		return newDropbox(conf), nil
+	case GoogleDrive:
+		return newGoogleDrive(conf), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", conf.Provider)
+	}
+}
+
+// tokenSource returns an access token, refreshed using the refresh token
+type tokenSource struct {
+	endpoint string
+	conf     *config.CloudImportConfig
+	client   *http.Client
+
+	token  string
+	expiry time.Time
+	mu     sync.Mutex
+}
+
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	// Refreshed a bit early so the token does not expire in flight
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {ts.conf.RefreshToken},
+		"client_id":     {ts.conf.ClientID},
+		"client_secret": {ts.conf.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ts.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", apiError("token endpoint", resp)
+	}
+	tokens := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	ts.token = tokens.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// do performs an authenticated request, any non-2xx response is returned as an error
+func do(ctx context.Context, client *http.Client, ts *tokenSource, req *http.Request) (*http.Response, error) {
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the access token: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, apiError(req.URL.Path, resp)
+	}
+	return resp, nil
+}
+
+// doJSON performs an authenticated API call, and decodes the JSON response
+func doJSON(ctx context.Context, client *http.Client, ts *tokenSource, req *http.Request, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	resp, err := do(ctx, client, ts, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func apiError(call string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s returned %s: %s", call, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,150 @@
+package cloudimport
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// tokenHandler checks the refresh token, and the access token of the API calls
+func tokenHandler(api http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			check(r.ParseForm())
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token": "access", "expires_in": 3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		api(w, r)
+	}
+}
+
+func TestDropbox(t *testing.T) {
+	server := httptest.NewServer(tokenHandler(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/list_folder":
+			args := map[string]interface{}{}
+			check(json.NewDecoder(r.Body).Decode(&args))
+			if args["path"] != "/photos" || args["recursive"] != true {
+				t.Errorf("unexpected args %+v", args)
+			}
+			w.Write([]byte(`{"entries": [
+				{".tag": "folder", "id": "id:1", "path_display": "/Photos/2020"},
+				{".tag": "file", "id": "id:2", "path_display": "/Photos/2020/a.jpg", "size": 5, "client_modified": "2020-01-02T03:04:05Z", "content_hash": "h2"}
+			], "cursor": "c1", "has_more": true}`))
+		case "/files/list_folder/continue":
+			w.Write([]byte(`{"entries": [
+				{".tag": "file", "id": "id:3", "path_display": "/Photos/b.jpg", "size": 3, "client_modified": "2020-01-02T03:04:05Z", "content_hash": "h3"}
+			], "cursor": "c2", "has_more": false}`))
+		case "/files/download":
+			if r.Header.Get("Dropbox-API-Arg") != `{"path":"id:2"}` {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("hello"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	dropboxTokenURL = server.URL + "/token"
+	dropboxAPIURL = server.URL
+	dropboxContentURL = server.URL
+
+	p, err := New(&config.CloudImportConfig{Provider: Dropbox, ClientID: "id", RefreshToken: "refresh", Folder: "photos/"})
+	check(err)
+	ctx := context.Background()
+	files, err := p.List(ctx)
+	check(err)
+	if len(files) != 2 || files[0].Path != "2020/a.jpg" || files[0].Hash != "dropbox:h2" || files[0].ModTime.Unix() != 1577934245 || files[1].Path != "b.jpg" {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	rc, err := p.Open(ctx, files[0])
+	check(err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	check(err)
+	if string(data) != "hello" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if _, err := p.Open(ctx, files[1]); err == nil {
+		t.Errorf("the API errors should be returned")
+	}
+}
+
+func TestGoogleDrive(t *testing.T) {
+	server := httptest.NewServer(tokenHandler(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files":
+			switch r.URL.Query().Get("q") {
+			case "'root' in parents and trashed = false":
+				if r.URL.Query().Get("pageToken") == "" {
+					w.Write([]byte(`{"files": [
+						{"id": "f1", "name": "docs", "mimeType": "application/vnd.google-apps.folder"},
+						{"id": "g1", "name": "notes", "mimeType": "application/vnd.google-apps.document"}
+					], "nextPageToken": "p2"}`))
+					return
+				}
+				w.Write([]byte(`{"files": [
+					{"id": "b1", "name": "a/b.txt", "mimeType": "text/plain", "size": "5", "modifiedTime": "2020-01-02T03:04:05.000Z", "md5Checksum": "m1"}
+				]}`))
+			case "'f1' in parents and trashed = false":
+				w.Write([]byte(`{"files": [
+					{"id": "b2", "name": "c.pdf", "mimeType": "application/pdf", "size": "3", "modifiedTime": "2020-01-02T03:04:05.000Z", "md5Checksum": "m2"}
+				]}`))
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		case "/files/b1":
+			if r.URL.Query().Get("alt") != "media" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("hello"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	gdriveTokenURL = server.URL + "/token"
+	gdriveAPIURL = server.URL
+
+	p, err := New(&config.CloudImportConfig{Provider: GoogleDrive, ClientID: "id", RefreshToken: "refresh"})
+	check(err)
+	ctx := context.Background()
+	files, err := p.List(ctx)
+	check(err)
+	if len(files) != 2 || files[0].Path != "docs/c.pdf" || files[0].Hash != "md5:m2" || files[1].Path != "a_b.txt" || files[1].Size != 5 {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	rc, err := p.Open(ctx, files[1])
+	check(err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	check(err)
+	if string(data) != "hello" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if _, err := New(&config.CloudImportConfig{Provider: "box", ClientID: "id", RefreshToken: "refresh"}); err == nil {
+		t.Errorf("unknown providers should be rejected")
+	}
+}
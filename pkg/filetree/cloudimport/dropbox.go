@@ -0,0 +1,135 @@
+package cloudimport // import "a4.io/blobstash/pkg/filetree/cloudimport"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+var (
+	dropboxTokenURL   = "https://api.dropboxapi.com/oauth2/token"
+	dropboxAPIURL     = "https://api.dropboxapi.com/2"
+	dropboxContentURL = "https://content.dropboxapi.com/2"
+)
+
+type dropbox struct {
+	folder string
+	client *http.Client
+	ts     *tokenSource
+}
+
+func newDropbox(conf *config.CloudImportConfig) *dropbox {
+	// The Dropbox root is "", the other folders start with a slash
+	folder := strings.TrimRight(conf.Folder, "/")
+	if folder != "" && !strings.HasPrefix(folder, "/") {
+		folder = "/" + folder
+	}
+	client := &http.Client{}
+	return &dropbox{
+		folder: folder,
+		client: client,
+		ts: &tokenSource{
+			endpoint: dropboxTokenURL,
+			conf:     conf,
+			client:   client,
+		},
+	}
+}
+
+func (d *dropbox) Name() string {
+	return Dropbox
+}
+
+type dropboxEntry struct {
+	Tag            string `json:".tag"`
+	ID             string `json:"id"`
+	PathDisplay    string `json:"path_display"`
+	Size           int64  `json:"size"`
+	ClientModified string `json:"client_modified"`
+	ContentHash    string `json:"content_hash"`
+}
+
+type dropboxListResult struct {
+	Entries []*dropboxEntry `json:"entries"`
+	Cursor  string          `json:"cursor"`
+	HasMore bool            `json:"has_more"`
+}
+
+func (d *dropbox) call(ctx context.Context, endpoint string, args interface{}, out interface{}) error {
+	js, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", dropboxAPIURL+endpoint, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(ctx, d.client, d.ts, req, out)
+}
+
+// List implements the Provider interface
+func (d *dropbox) List(ctx context.Context) ([]*File, error) {
+	files := []*File{}
+	res := &dropboxListResult{}
+	if err := d.call(ctx, "/files/list_folder", map[string]interface{}{
+		"path":      d.folder,
+		"recursive": true,
+	}, res); err != nil {
+		return nil, err
+	}
+	for {
+		for _, e := range res.Entries {
+			if e.Tag != "file" {
+				continue
+			}
+			// The client modification time is the one set by the uploader (i.e. the original mtime)
+			mtime, err := time.Parse(time.RFC3339, e.ClientModified)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, &File{
+				ID:      e.ID,
+				Path:    strings.TrimPrefix(e.PathDisplay[len(d.folder):], "/"),
+				Size:    e.Size,
+				ModTime: mtime,
+				Hash:    "dropbox:" + e.ContentHash,
+			})
+		}
+		if !res.HasMore {
+			return files, nil
+		}
+		cursor := res.Cursor
+		res = &dropboxListResult{}
+		if err := d.call(ctx, "/files/list_folder/continue", map[string]interface{}{
+			"cursor": cursor,
+		}, res); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Open implements the Provider interface
+func (d *dropbox) Open(ctx context.Context, f *File) (io.ReadCloser, error) {
+	req, err := http.NewRequest("POST", dropboxContentURL+"/files/download", nil)
+	if err != nil {
+		return nil, err
+	}
+	// The IDs are ASCII, unlike the paths (the header must be)
+	arg, err := json.Marshal(map[string]string{"path": f.ID})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	resp, err := do(ctx, d.client, d.ts, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,144 @@
+package cloudimport // import "a4.io/blobstash/pkg/filetree/cloudimport"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+var (
+	gdriveTokenURL = "https://oauth2.googleapis.com/token"
+	gdriveAPIURL   = "https://www.googleapis.com/drive/v3"
+)
+
+const gdriveFolderType = "application/vnd.google-apps.folder"
+
+type googleDrive struct {
+	folder string
+	client *http.Client
+	ts     *tokenSource
+}
+
+func newGoogleDrive(conf *config.CloudImportConfig) *googleDrive {
+	folder := conf.Folder
+	if folder == "" {
+		folder = "root"
+	}
+	client := &http.Client{}
+	return &googleDrive{
+		folder: folder,
+		client: client,
+		ts: &tokenSource{
+			endpoint: gdriveTokenURL,
+			conf:     conf,
+			client:   client,
+		},
+	}
+}
+
+func (g *googleDrive) Name() string {
+	return GoogleDrive
+}
+
+type gdriveFile struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	Size         string `json:"size"`
+	ModifiedTime string `json:"modifiedTime"`
+	MD5Checksum  string `json:"md5Checksum"`
+}
+
+// List implements the Provider interface
+func (g *googleDrive) List(ctx context.Context) ([]*File, error) {
+	files := []*File{}
+	if err := g.list(ctx, g.folder, "", &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// list walks the folder (Drive has no recursive listing)
+func (g *googleDrive) list(ctx context.Context, id, prefix string, files *[]*File) error {
+	var pageToken string
+	for {
+		q := url.Values{
+			"q":        {fmt.Sprintf("'%s' in parents and trashed = false", id)},
+			"fields":   {"nextPageToken,files(id,name,mimeType,size,modifiedTime,md5Checksum)"},
+			"pageSize": {"1000"},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest("GET", gdriveAPIURL+"/files?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		res := struct {
+			Files         []*gdriveFile `json:"files"`
+			NextPageToken string        `json:"nextPageToken"`
+		}{}
+		if err := doJSON(ctx, g.client, g.ts, req, &res); err != nil {
+			return err
+		}
+		for _, f := range res.Files {
+			// The names may contain slashes
+			p := path.Join(prefix, strings.Replace(f.Name, "/", "_", -1))
+			if f.MimeType == gdriveFolderType {
+				if err := g.list(ctx, f.ID, p, files); err != nil {
+					return err
+				}
+				continue
+			}
+			// The Google Docs have no binary content (they would need to be exported)
+			if strings.HasPrefix(f.MimeType, "application/vnd.google-apps.") {
+				continue
+			}
+			mtime, err := time.Parse(time.RFC3339, f.ModifiedTime)
+			if err != nil {
+				return err
+			}
+			var size int64
+			if f.Size != "" {
+				if size, err = strconv.ParseInt(f.Size, 10, 64); err != nil {
+					return err
+				}
+			}
+			file := &File{
+				ID:      f.ID,
+				Path:    p,
+				Size:    size,
+				ModTime: mtime,
+			}
+			if f.MD5Checksum != "" {
+				file.Hash = "md5:" + f.MD5Checksum
+			}
+			*files = append(*files, file)
+		}
+		if res.NextPageToken == "" {
+			return nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// Open implements the Provider interface
+func (g *googleDrive) Open(ctx context.Context, f *File) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", gdriveAPIURL+"/files/"+url.PathEscape(f.ID)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(ctx, g.client, g.ts, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,145 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/filetree/cloudimport"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+// fakeProvider serves in-memory files, and records the downloads
+type fakeProvider struct {
+	files      []*cloudimport.File
+	contents   map[string]string
+	downloaded []string
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) List(ctx context.Context) ([]*cloudimport.File, error) {
+	return p.files, nil
+}
+
+func (p *fakeProvider) Open(ctx context.Context, f *cloudimport.File) (io.ReadCloser, error) {
+	p.downloaded = append(p.downloaded, f.Path)
+	return ioutil.NopCloser(bytes.NewReader([]byte(p.contents[f.ID]))), nil
+}
+
+func TestCloudImport(t *testing.T) {
+	env := testutil.New(t, "filetree_cloudimport_test")
+	defer env.Close()
+	dir, kvs := env.Dir, env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p := &fakeProvider{
+		files: []*cloudimport.File{
+			{ID: "1", Path: "a.txt", ModTime: mtime, Hash: "h1"},
+			{ID: "2", Path: "sub/b.txt", ModTime: mtime, Hash: "h2"},
+		},
+		contents: map[string]string{"1": "hello", "2": "world"},
+	}
+	ctx := context.Background()
+	noProgress := func(int, int) {}
+
+	res, err := ft.CloudImport(ctx, "cloud", p, noProgress)
+	check(err)
+	if res.Files != 2 || res.Downloaded != 2 || res.Size != 10 || res.Version == 0 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// Nothing changed
+	res2, err := ft.CloudImport(ctx, "cloud", p, noProgress)
+	check(err)
+	if res2.Downloaded != 0 || res2.Version != 0 || res2.Ref != res.Ref {
+		t.Errorf("unexpected result %+v", res2)
+	}
+
+	// Only the modified file is downloaded
+	p.files[1] = &cloudimport.File{ID: "3", Path: "sub/b.txt", ModTime: mtime.Add(time.Hour), Hash: "h3"}
+	p.contents["3"] = "world!"
+	p.downloaded = nil
+	res3, err := ft.CloudImport(ctx, "cloud", p, noProgress)
+	check(err)
+	if res3.Downloaded != 1 || len(p.downloaded) != 1 || p.downloaded[0] != "sub/b.txt" || res3.Version == 0 {
+		t.Errorf("unexpected result %+v (%v)", res3, p.downloaded)
+	}
+
+	fs, err := ft.FS(ctx, "cloud", FSKeyFmt, false, 0)
+	check(err)
+	if fs.Ref != res3.Ref {
+		t.Errorf("the FS should point to the last import")
+	}
+	for path, expected := range map[string]string{"a.txt": "hello", "sub/b.txt": "world!"} {
+		node, _, _, err := fs.Path(ctx, "/"+path, 1, false, 0)
+		check(err)
+		f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+		out, err := ioutil.ReadAll(f)
+		check(err)
+		f.Close()
+		if string(out) != expected {
+			t.Errorf("%s: unexpected content %q", path, out)
+		}
+		for _, f := range p.files {
+			if f.Path == path && node.Meta.ModTime != f.ModTime.Unix() {
+				t.Errorf("%s: the modification time should be preserved %+v", path, node.Meta)
+			}
+		}
+	}
+
+	// The local files of the target FS are kept across the imports
+	src := filepath.Join(dir, "src")
+	check(os.MkdirAll(filepath.Join(src, "local"), 0700))
+	check(ioutil.WriteFile(filepath.Join(src, "local.txt"), []byte("local"), 0600))
+	check(ioutil.WriteFile(filepath.Join(src, "local", "c.txt"), []byte("local c"), 0600))
+	localRoot, err := ft.NewUploader(ctx).PutDir(src)
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "mixed"), localRoot.Hash, nil, -1)
+	check(err)
+	p2 := &fakeProvider{
+		files: []*cloudimport.File{
+			{ID: "1", Path: "a.txt", ModTime: mtime, Hash: "h1"},
+			{ID: "2", Path: "sub/b.txt", ModTime: mtime, Hash: "h2"},
+			{ID: "4", Path: "local.txt", ModTime: mtime, Hash: "h4"},
+		},
+		contents: map[string]string{"1": "hello", "2": "world", "4": "conflict"},
+	}
+	res4, err := ft.CloudImport(ctx, "mixed", p2, noProgress)
+	check(err)
+	if res4.Files != 2 {
+		t.Errorf("the conflicting file should be skipped %+v", res4)
+	}
+	// The removed cloud files are removed from the FS (along with their dir)
+	p2.files = p2.files[:1]
+	_, err = ft.CloudImport(ctx, "mixed", p2, noProgress)
+	check(err)
+	fs, err = ft.FS(ctx, "mixed", FSKeyFmt, false, 0)
+	check(err)
+	for path, expected := range map[string]string{"a.txt": "hello", "local.txt": "local", "local/c.txt": "local c"} {
+		node, _, _, err := fs.Path(ctx, "/"+path, 1, false, 0)
+		check(err)
+		f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+		out, err := ioutil.ReadAll(f)
+		check(err)
+		f.Close()
+		if string(out) != expected {
+			t.Errorf("%s: unexpected content %q", path, out)
+		}
+	}
+	if _, _, _, err := fs.Path(ctx, "/sub", 1, false, 0); err != clientutil.ErrBlobNotFound {
+		t.Errorf("the sub dir should be removed, got %v", err)
+	}
+}
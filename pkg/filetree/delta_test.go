@@ -0,0 +1,56 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestDeltaUploader(t *testing.T) {
+	env := testutil.New(t, "filetree_delta_test")
+	defer env.Close()
+	conf := &config.Config{
+		Filetree: &config.FiletreeConfig{DeltaCompression: true},
+	}
+	ft := newTestFileTree(t, env, conf)
+	defer ft.Close()
+
+	var buf bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buf, "line %d\n", i)
+	}
+	v1 := buf.Bytes()
+	v2 := bytes.Replace(v1, []byte("line 50000\n"), []byte("edited line\n"), 1)
+
+	ctx := context.Background()
+	n1, err := ft.NewDeltaUploader(ctx, nil).PutReader("data.txt", bytes.NewReader(v1), nil)
+	check(err)
+	prev, err := ft.nodeByRef(ctx, n1.Hash)
+	check(err)
+	n2, err := ft.NewDeltaUploader(ctx, prev).PutReader("data.txt", bytes.NewReader(v2), nil)
+	check(err)
+
+	deltas := 0
+	for _, iv := range n2.FileRefs() {
+		if iv.Base != "" {
+			deltas++
+		}
+	}
+	if deltas != 1 {
+		t.Errorf("expected 1 delta chunk, got %d", deltas)
+	}
+
+	f := filereader.NewFile(ctx, ft.blobStore, n2, nil)
+	defer f.Close()
+	out, err := ioutil.ReadAll(f)
+	check(err)
+	if !bytes.Equal(out, v2) {
+		t.Errorf("failed to read the delta encoded file")
+	}
+}
@@ -0,0 +1,91 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestFetchDirPage(t *testing.T) {
+	env := testutil.New(t, "filetree_dirpage_test")
+	defer env.Close()
+	dir := env.Dir
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	src := filepath.Join(dir, "src")
+	check(os.MkdirAll(filepath.Join(src, "sub"), 0700))
+	check(ioutil.WriteFile(filepath.Join(src, "sub", "nested.txt"), []byte("nested"), 0600))
+	for i := 0; i < 4; i++ {
+		check(ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("file %d", i)), 0600))
+	}
+
+	ctx := context.Background()
+	root, err := ft.NewUploader(ctx).PutDir(src)
+	check(err)
+
+	seen := map[string]bool{}
+	var cursor string
+	pages := 0
+	for {
+		n, err := ft.nodeByRef(ctx, root.Hash)
+		check(err)
+		check(ft.fetchDirPage(ctx, n, cursor, 2, 2))
+		pages++
+		for _, c := range n.Children {
+			seen[c.Name] = true
+			if c.Name == "sub" && len(c.Children) != 1 {
+				t.Errorf("the sub dir children should be fetched (depth=2), got %+v", c.Children)
+			}
+		}
+		if n.ChildrenCount != 5 {
+			t.Errorf("unexpected children count %d", n.ChildrenCount)
+		}
+		cursor = n.ChildrenCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if pages != 3 || len(seen) != 5 {
+		t.Errorf("unexpected pagination: %d pages, children=%v", pages, seen)
+	}
+
+	// The cursor is bound to the dir version
+	n, err := ft.nodeByRef(ctx, root.Hash)
+	check(err)
+	if err := ft.fetchDirPage(ctx, n, encodeDirCursor("other", 2), 2, 1); err != errInvalidCursor {
+		t.Errorf("expected errInvalidCursor, got %v", err)
+	}
+	if err := ft.fetchDirPage(ctx, n, "garbage!", 2, 1); err != errInvalidCursor {
+		t.Errorf("expected errInvalidCursor, got %v", err)
+	}
+
+	for _, tdata := range []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"depth=2&limit=5000", true},
+		{"depth=0", false},
+		{"depth=x", false},
+		{"limit=-1", false},
+		{"limit=x", false},
+	} {
+		values, err := url.ParseQuery(tdata.query)
+		check(err)
+		_, limit, err := dirQuery(httputil.NewQuery(values))
+		if (err == nil) != tdata.ok {
+			t.Errorf("%q: unexpected error %v", tdata.query, err)
+		}
+		if limit > maxDirPageSize {
+			t.Errorf("%q: the limit should be capped, got %d", tdata.query, limit)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// DuplicateGroup holds files sharing the same content
+type DuplicateGroup struct {
+	ContentHash string   `json:"content_hash"`
+	Size        int64    `json:"size"` // Size of a single copy
+	Paths       []string `json:"paths"`
+
+	// Logical size of the extra copies (stored only once thanks to the content addressing)
+	DuplicatedSize int64 `json:"duplicated_size"`
+}
+
+// DuplicatesReport lists the files sharing identical content within a tree
+type DuplicatesReport struct {
+	Ref   string `json:"ref"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"` // Logical size of the tree
+
+	DuplicatedFiles int               `json:"duplicated_files"` // Number of extra copies
+	DuplicatedSize  int64             `json:"duplicated_size"`
+	Groups          []*DuplicateGroup `json:"groups"` // Sorted by duplicated size
+}
+
+// contentKey returns the key used to group identical files, nodes uploaded without a content hash are grouped by
+// their chunks
+func contentKey(n *rnode.RawNode) string {
+	if n.ContentHash != "" {
+		return n.ContentHash
+	}
+	refs := []string{}
+	for _, iv := range n.FileRefs() {
+		refs = append(refs, fmt.Sprintf("%d:%s", iv.Index, iv.Value))
+	}
+	return hashutil.Compute([]byte(strings.Join(refs, ",")))
+}
+
+// Duplicates walks the tree at `ref` and groups the files (at least `minSize` bytes long) having the same content.
+func (ft *FileTree) Duplicates(ctx context.Context, ref string, minSize int64) (*DuplicatesReport, error) {
+	report := &DuplicatesReport{Ref: ref, Groups: []*DuplicateGroup{}}
+	groups := map[string]*DuplicateGroup{}
+
+	// `dir` is the path of the parent dir (the node only knows its own name)
+	var walk func(string, string, bool) error
+	walk = func(ref, dir string, root bool) error {
+		data, err := ft.blobStore.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		n, err := rnode.NewNodeFromBlob(ref, data)
+		if err != nil {
+			return err
+		}
+
+		if !n.IsFile() {
+			// The name of the root dir is the FS name, it's not part of the paths
+			path := dir
+			if !root {
+				path = filepath.Join(dir, n.Name)
+			}
+			for _, cref := range n.Refs {
+				if err := walk(cref.(string), path, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		report.Files++
+		report.Size += int64(n.Size)
+		if n.Size == 0 || int64(n.Size) < minSize {
+			return nil
+		}
+		key := contentKey(n)
+		g, ok := groups[key]
+		if !ok {
+			g = &DuplicateGroup{ContentHash: key, Size: int64(n.Size)}
+			groups[key] = g
+		}
+		g.Paths = append(g.Paths, filepath.Join(dir, n.Name))
+		return nil
+	}
+
+	if err := walk(ref, "/", true); err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		if len(g.Paths) < 2 {
+			continue
+		}
+		sort.Strings(g.Paths)
+		g.DuplicatedSize = g.Size * int64(len(g.Paths)-1)
+		report.DuplicatedFiles += len(g.Paths) - 1
+		report.DuplicatedSize += g.DuplicatedSize
+		report.Groups = append(report.Groups, g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].DuplicatedSize == report.Groups[j].DuplicatedSize {
+			return report.Groups[i].ContentHash < report.Groups[j].ContentHash
+		}
+		return report.Groups[i].DuplicatedSize > report.Groups[j].DuplicatedSize
+	})
+
+	return report, nil
+}
+
+func (ft *FileTree) duplicatesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		refType := vars["type"]
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		asOf, err := q.GetInt64Default("as_of", 0)
+		if err != nil {
+			panic(err)
+		}
+		minSize, err := q.GetInt64Default("min_size", 1)
+		if err != nil {
+			panic(err)
+		}
+		limit, err := q.GetInt("limit", 100, 1000)
+		if err != nil {
+			panic(err)
+		}
+
+		var ref string
+		switch refType {
+		case "ref":
+			ref = fsName
+		case "fs":
+			fs, err := ft.FS(ctx, fsName, prefixFmt, false, asOf)
+			if err != nil {
+				panic(err)
+			}
+			ref = fs.Ref
+		default:
+			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+		}
+
+		if ref == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		report, err := ft.Duplicates(ctx, ref, minSize)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			panic(err)
+		}
+
+		// Only the biggest groups are returned, the totals cover all of them
+		if len(report.Groups) > limit {
+			report.Groups = report.Groups[:limit]
+		}
+
+		httputil.MarshalAndWrite(r, w, report)
+	}
+}
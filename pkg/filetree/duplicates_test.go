@@ -0,0 +1,62 @@
+package filetree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestDuplicates(t *testing.T) {
+	env := testutil.New(t, "filetree_duplicates_test")
+	defer env.Close()
+	dir := env.Dir
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	src := filepath.Join(dir, "src")
+	for path, content := range map[string]string{
+		"a.txt":        "hello",
+		"b.txt":        "hello",
+		"sub/c.txt":    "hello",
+		"sub/d.txt":    "unique",
+		"sub/big1.bin": "0123456789",
+		"big2.bin":     "0123456789",
+		"empty1":       "",
+		"empty2":       "",
+	} {
+		check(os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0700))
+		check(ioutil.WriteFile(filepath.Join(src, path), []byte(content), 0600))
+	}
+
+	ctx := context.Background()
+	root, err := ft.NewUploader(ctx).PutDir(src)
+	check(err)
+
+	report, err := ft.Duplicates(ctx, root.Hash, 1)
+	check(err)
+	if report.Files != 8 || report.DuplicatedFiles != 3 || report.DuplicatedSize != 20 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.Groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(report.Groups))
+	}
+	// Same duplicated size, sorted by content hash
+	if !reflect.DeepEqual(report.Groups[0].Paths, []string{"/a.txt", "/b.txt", "/sub/c.txt"}) || report.Groups[0].DuplicatedSize != 10 {
+		t.Errorf("unexpected group %+v", report.Groups[0])
+	}
+	if !reflect.DeepEqual(report.Groups[1].Paths, []string{"/big2.bin", "/sub/big1.bin"}) || report.Groups[1].DuplicatedSize != 10 {
+		t.Errorf("unexpected group %+v", report.Groups[1])
+	}
+
+	// Smaller files can be ignored
+	report, err = ft.Duplicates(ctx, root.Hash, 6)
+	check(err)
+	if len(report.Groups) != 1 || report.DuplicatedSize != 10 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,223 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// EmbedCookieName is the prefix of the name of the signed cookies accepted by the file handlers
+const EmbedCookieName = "blobstash_embed"
+
+const defaultEmbedTTL = 1 * time.Hour
+
+// embedCookieSettings returns the TTL, the SameSite mode and the domain of the embed cookies
+func (ft *FileTree) embedCookieSettings() (time.Duration, http.SameSite, string, error) {
+	if ft.conf.Filetree == nil || ft.conf.Filetree.EmbedCookie == nil {
+		return defaultEmbedTTL, http.SameSiteLaxMode, "", nil
+	}
+	conf := ft.conf.Filetree.EmbedCookie
+	ttl := defaultEmbedTTL
+	if conf.TTL > 0 {
+		ttl = time.Duration(conf.TTL) * time.Second
+	}
+	switch strings.ToLower(conf.SameSite) {
+	case "", "lax":
+		return ttl, http.SameSiteLaxMode, conf.Domain, nil
+	case "strict":
+		return ttl, http.SameSiteStrictMode, conf.Domain, nil
+	case "none":
+		return ttl, http.SameSiteNoneMode, conf.Domain, nil
+	default:
+		return 0, 0, "", fmt.Errorf("invalid embed cookie same_site value %q", conf.SameSite)
+	}
+}
+
+// EmbedRevokedKeyFmt is the key marking an embed cookie ID as revoked (always stored in the root namespace, the value
+// is the expiration of the cookie)
+var EmbedRevokedKeyFmt = "_filetree:embed_revoked:%s"
+
+// embedCookieName returns the name of the embed cookie for the given node (each cookie grants access to a single node,
+// so several nodes can be embedded at once)
+func embedCookieName(ref string) string {
+	return EmbedCookieName + "_" + ref
+}
+
+// signEmbedCookie returns the value of an embed cookie for the node `ref` valid until `expires`, `id` identifies the
+// cookie for revoking it
+func (ft *FileTree) signEmbedCookie(id, ref string, expires int64) string {
+	payload := fmt.Sprintf("%s.%d.%s", id, expires, ref)
+	mac := hmac.New(sha256.New, ft.sharingCred.Key)
+	mac.Write([]byte("embed:" + payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseEmbedCookie checks the signature of the cookie value, and returns the cookie ID, the node ref and the expiration
+func (ft *FileTree) parseEmbedCookie(value string) (string, string, int64, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return "", "", 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", "", 0, false
+	}
+	if !hmac.Equal([]byte(value), []byte(ft.signEmbedCookie(parts[0], parts[2], expires))) {
+		return "", "", 0, false
+	}
+	return parts[0], parts[2], expires, true
+}
+
+// embedRevoked returns true if the embed cookie ID has been revoked
+func (ft *FileTree) embedRevoked(id string) (bool, error) {
+	_, err := ft.kvStore.Get(context.Background(), fmt.Sprintf(EmbedRevokedKeyFmt, id), -1)
+	switch err {
+	case nil:
+		return true, nil
+	case vkv.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// revokeEmbedCookie prevents the embed cookie ID from being used again
+func (ft *FileTree) revokeEmbedCookie(id string, expires int64) error {
+	_, err := ft.kvStore.Put(context.Background(), fmt.Sprintf(EmbedRevokedKeyFmt, id), "", []byte(strconv.FormatInt(expires, 10)), -1)
+	return err
+}
+
+// purgeEmbedRevocations removes the revocations of the expired embed cookies (they are rejected anyway), and returns
+// the number of purged revocations
+func (ft *FileTree) purgeEmbedRevocations(ctx context.Context) (int, error) {
+	prefix := fmt.Sprintf(EmbedRevokedKeyFmt, "")
+	keys, _, err := ft.kvStore.Keys(ctx, prefix, prefix+"\xff", 0)
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	now := time.Now().Unix()
+	for _, key := range keys {
+		kvv, _, err := ft.kvStore.Versions(ctx, key.Key, "0", -1)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			continue
+		default:
+			return purged, err
+		}
+		for _, kv := range kvv.Versions {
+			expires, err := strconv.ParseInt(string(kv.Data), 10, 64)
+			if err == nil && expires > now {
+				continue
+			}
+			if err := ft.kvStore.DeleteVersion(ctx, key.Key, kv.Version); err != nil && err != vkv.ErrNotFound {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// checkEmbedCookie returns true if the request holds a valid (not expired, nor revoked) embed cookie for the node
+func (ft *FileTree) checkEmbedCookie(r *http.Request, ref string) bool {
+	c, err := r.Cookie(embedCookieName(ref))
+	if err != nil {
+		return false
+	}
+	id, cref, expires, ok := ft.parseEmbedCookie(c.Value)
+	if !ok || cref != ref || time.Now().Unix() > expires {
+		return false
+	}
+	revoked, err := ft.embedRevoked(id)
+	if err != nil {
+		ft.log.Error("failed to check the embed cookie", "id", id, "err", err)
+		return false
+	}
+	return !revoked
+}
+
+// embedHandler exchanges the credentials for a short-lived embed cookie for the node `ref` (POST), or revokes and
+// clears it (DELETE)
+func (ft *FileTree) embedHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "missing ref")
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Node),
+			perms.ResourceWithID(perms.Filetree, perms.Node, ref),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		ttl, sameSite, domain, err := ft.embedCookieSettings()
+		if err != nil {
+			panic(err)
+		}
+		cookie := &http.Cookie{
+			Name:     embedCookieName(ref),
+			Path:     "/",
+			Domain:   domain,
+			HttpOnly: true,
+			SameSite: sameSite,
+			// Browsers reject the `SameSite=None` cookies that are not secure
+			Secure: r.TLS != nil || sameSite == http.SameSiteNoneMode,
+		}
+
+		switch r.Method {
+		case "POST":
+			rid := make([]byte, 8)
+			if _, err := rand.Read(rid); err != nil {
+				panic(err)
+			}
+			id := hex.EncodeToString(rid)
+			expires := time.Now().Add(ttl)
+			cookie.Value = ft.signEmbedCookie(id, ref, expires.Unix())
+			cookie.Expires = expires
+			http.SetCookie(w, cookie)
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"id":         id,
+				"ref":        ref,
+				"expires_at": expires.Unix(),
+			})
+		case "DELETE":
+			// Revoke the given cookie ID, or the one sent with the request
+			id := r.URL.Query().Get("id")
+			expires := time.Now().Add(ttl).Unix()
+			if c, err := r.Cookie(cookie.Name); id == "" && err == nil {
+				if cid, cref, cexpires, ok := ft.parseEmbedCookie(c.Value); ok && cref == ref {
+					id, expires = cid, cexpires
+				}
+			}
+			if id != "" {
+				if err := ft.revokeEmbedCookie(id, expires); err != nil {
+					panic(err)
+				}
+			}
+			cookie.MaxAge = -1
+			http.SetCookie(w, cookie)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
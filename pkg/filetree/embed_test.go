@@ -0,0 +1,89 @@
+package filetree
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestEmbedCookie(t *testing.T) {
+	env := testutil.New(t, "filetree_embed_test")
+	defer env.Close()
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	w := httptest.NewRecorder()
+	ft.embedHandler()(w, httptest.NewRequest("POST", "/api/filetree/embed", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("a ref is required, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ft.embedHandler()(w, httptest.NewRequest("POST", "/api/filetree/embed?ref=ref1", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != embedCookieName("ref1") || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookies %+v", cookies)
+	}
+
+	for _, tdata := range []struct {
+		ref      string
+		name     string
+		value    string
+		expected bool
+	}{
+		{"ref1", cookies[0].Name, cookies[0].Value, true},
+		{"ref1", cookies[0].Name, cookies[0].Value + "0", false},
+		{"ref1", cookies[0].Name, ft.signEmbedCookie("id", "ref1", time.Now().Add(-1*time.Minute).Unix()), false},
+		{"ref1", cookies[0].Name, "invalid", false},
+		// The cookie is only valid for its node
+		{"ref2", embedCookieName("ref2"), cookies[0].Value, false},
+	} {
+		r := httptest.NewRequest("GET", "/f/"+tdata.ref, nil)
+		r.AddCookie(&http.Cookie{Name: tdata.name, Value: tdata.value})
+		if ft.checkEmbedCookie(r, tdata.ref) != tdata.expected {
+			t.Errorf("checkEmbedCookie(%q) should be %v", tdata.value, tdata.expected)
+		}
+	}
+
+	// A revoked cookie cannot be used anymore
+	r := httptest.NewRequest("DELETE", "/api/filetree/embed?ref=ref1", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	ft.embedHandler()(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/f/ref1", nil)
+	r.AddCookie(cookies[0])
+	if ft.checkEmbedCookie(r, "ref1") {
+		t.Errorf("the revoked cookie should be rejected")
+	}
+
+	// The revocations are purged once the cookies are expired
+	check(ft.revokeEmbedCookie("expired", time.Now().Add(-1*time.Minute).Unix()))
+	purged, err := ft.purgeEmbedRevocations(context.Background())
+	check(err)
+	if purged != 1 {
+		t.Errorf("expected 1 purged revocation, got %d", purged)
+	}
+	if revoked, err := ft.embedRevoked("expired"); err != nil || revoked {
+		t.Errorf("the expired revocation should be purged")
+	}
+	r = httptest.NewRequest("GET", "/f/ref1", nil)
+	r.AddCookie(cookies[0])
+	if ft.checkEmbedCookie(r, "ref1") {
+		t.Errorf("the revoked cookie should still be rejected")
+	}
+
+	ft.conf.Filetree = &config.FiletreeConfig{EmbedCookie: &config.EmbedCookieConfig{SameSite: "none"}}
+	w = httptest.NewRecorder()
+	ft.embedHandler()(w, httptest.NewRequest("POST", "/api/filetree/embed?ref=ref1", nil))
+	if c := w.Result().Cookies()[0]; c.SameSite != http.SameSiteNoneMode || !c.Secure {
+		t.Errorf("SameSite=None cookies must be secure: %+v", c)
+	}
+}
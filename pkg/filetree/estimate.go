@@ -0,0 +1,168 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// RestoreEstimate holds the amount of data a restore/download of a tree would transfer
+type RestoreEstimate struct {
+	Ref     string `json:"ref"`
+	BaseRef string `json:"base_ref,omitempty"`
+
+	Files int   `json:"files"`
+	Dirs  int   `json:"dirs"`
+	Size  int64 `json:"size"` // Total size of the files
+
+	Blobs        int   `json:"blobs"`         // Unique data blobs to fetch
+	TransferSize int64 `json:"transfer_size"` // Total size of the unique data blobs to fetch
+}
+
+// EstimateRestore computes the number of files/bytes needed to restore the tree at `ref`, if `baseRef` is set, only
+// the files that are not already in the `baseRef` tree are accounted for (like an incremental restore would do).
+func (ft *FileTree) EstimateRestore(ctx context.Context, ref, baseRef string) (*RestoreEstimate, error) {
+	est := &RestoreEstimate{Ref: ref, BaseRef: baseRef}
+
+	// Mark all the blobs of the base tree (it's assumed to be already restored)
+	base := map[string]int64{}
+	if baseRef != "" {
+		if err := ft.markTree(ctx, baseRef, base, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	fetched := map[string]struct{}{}
+	var estimate func(string) error
+	estimate = func(ref string) error {
+		// Nodes are content-addressed, a node in the base tree means the whole subtree is already there
+		if _, ok := base[ref]; ok {
+			return nil
+		}
+		data, err := ft.blobStore.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		n, err := rnode.NewNodeFromBlob(ref, data)
+		if err != nil {
+			return err
+		}
+
+		if !n.IsFile() {
+			est.Dirs++
+			for _, cref := range n.Refs {
+				if err := estimate(cref.(string)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		est.Files++
+		est.Size += int64(n.Size)
+
+		// The index is the end offset of the chunk
+		var prev int64
+		for _, iv := range n.FileRefs() {
+			size := iv.Index - prev
+			prev = iv.Index
+			if _, ok := base[iv.Value]; ok {
+				continue
+			}
+			if _, ok := fetched[iv.Value]; ok {
+				continue
+			}
+			fetched[iv.Value] = struct{}{}
+			est.Blobs++
+			est.TransferSize += size
+		}
+		return nil
+	}
+
+	if err := estimate(ref); err != nil {
+		return nil, err
+	}
+
+	return est, nil
+}
+
+func (ft *FileTree) estimateHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		refType := vars["type"]
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		asOf, err := q.GetInt64Default("as_of", 0)
+		if err != nil {
+			panic(err)
+		}
+		baseAsOf, err := q.GetInt64Default("base_as_of", 0)
+		if err != nil {
+			panic(err)
+		}
+		baseRef := q.Get("base_ref")
+
+		var ref string
+		switch refType {
+		case "ref":
+			ref = fsName
+		case "fs":
+			fs, err := ft.FS(ctx, fsName, prefixFmt, false, asOf)
+			if err != nil {
+				panic(err)
+			}
+			ref = fs.Ref
+
+			// Estimate the diff between two versions of the FS
+			if baseAsOf > 0 {
+				baseFS, err := ft.FS(ctx, fsName, prefixFmt, false, baseAsOf)
+				if err != nil {
+					panic(err)
+				}
+				if baseFS.Ref == "" {
+					httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("no version as of %d", baseAsOf))
+					return
+				}
+				baseRef = baseFS.Ref
+			}
+		default:
+			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+		}
+
+		if ref == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		est, err := ft.EstimateRestore(ctx, ref, baseRef)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, est)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"compress/gzip"
 	"container/list"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +19,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -26,6 +29,7 @@ import (
 	"gopkg.in/src-d/go-git.v4/utils/binary"
 
 	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/audit"
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/cache"
@@ -41,8 +45,10 @@ import (
 	"a4.io/blobstash/pkg/httputil/bewit"
 	"a4.io/blobstash/pkg/httputil/resize"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/loadshed"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
 )
@@ -96,13 +102,34 @@ type FileTree struct {
 
 	thumbCache    *cache.Cache
 	metadataCache *cache.Cache
-	// TODO(tsileo): use the node cache
+	// Prefetched node blobs (see prefetchNodes)
 	nodeCache *lru.Cache
+	// Listings currently pre-warming their sub dirs
+	prewarming chan struct{}
+
 	webmQueue *queue.Queue
 
 	fileTypeCache *lru.Cache
 
-	log log.Logger
+	sftp *sftpServer
+
+	// Photos indexed by taken time, the FS (namespace, name) pending indexing are processed by `photosWorker`
+	photos        *rangedb.RangeDB
+	photosMu      sync.Mutex
+	photosPending map[[2]string]struct{}
+	photosWake    chan struct{}
+
+	// Downloads counters of the sharing links
+	shares *rangedb.RangeDB
+
+	chunker    *writer.ChunkerOptions
+	nsChunkers map[string]*writer.ChunkerOptions
+
+	// The background jobs are paused while the backend is degraded
+	shedder *loadshed.Shedder
+
+	stop chan struct{}
+	log  log.Logger
 }
 
 func (ft *FileTree) SharingCred() *bewit.Cred {
@@ -123,6 +150,15 @@ type BlobStore struct {
 	ctx       context.Context
 }
 
+// localBlobStore marks the blobs written by the filetree (the nodes, and the uploaded files) as created locally
+type localBlobStore struct {
+	store.BlobStore
+}
+
+func (bs *localBlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
+	return bs.BlobStore.Put(ctxutil.WithLocalWrite(ctx), blob)
+}
+
 func (bs *BlobStore) Get(hash string) ([]byte, error) {
 	return bs.blobStore.Get(bs.ctx, hash)
 }
@@ -142,10 +178,19 @@ type Snapshot struct {
 	CreatedAt int64  `msgpack:"-" json:"created_at"`
 
 	Hostname  string `msgpack:"h" json:"hostname,omitempty"`
+	Author    string `msgpack:"a,omitempty" json:"author,omitempty"`
 	Message   string `msgpack:"m,omitempty" json:"message,omitempty"`
 	UserAgent string `msgpack:"ua,omitempty" json:"user_agent,omitempty"`
 }
 
+// commitContext returns the request context holding the hostname, the author and the message of the FS versions
+// created by the request (the author is the authenticated identity, it's never taken from the client)
+func commitContext(r *http.Request) context.Context {
+	ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
+	ctx = ctxutil.WithFileTreeAuthor(ctx, auth.ID(r))
+	return ctxutil.WithFileTreeMessage(ctx, r.Header.Get(ctxutil.FileTreeMessageHeader))
+}
+
 type FS struct {
 	Name     string `json:"-"`
 	Ref      string `json:"ref"`
@@ -160,8 +205,11 @@ func NewFS(ref string, ft *FileTree) *FS {
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub) (*FileTree, error) {
+func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub, shedder *loadshed.Shedder) (*FileTree, error) {
 	logger.Debug("init")
+	if conf.SharingKey == "" {
+		return nil, fmt.Errorf("missing sharing_key")
+	}
 	// FIXME(tsileo): make the number of thumbnails to keep in memory a config item
 	thumbscache, err := cache.New(conf.VarDir(), "filetree_thumbs.cache", 512<<20)
 	if err != nil {
@@ -171,7 +219,7 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 	if err != nil {
 		return nil, err
 	}
-	nodeCache, err := lru.New(512)
+	nodeCache, err := lru.New(nodeCacheSize)
 	if err != nil {
 		return nil, err
 	}
@@ -184,36 +232,79 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 	if err != nil {
 		return nil, err
 	}
+	photos, err := rangedb.New(filepath.Join(conf.VarDir(), "filetree-photos.index"))
+	if err != nil {
+		return nil, err
+	}
+	shares, err := rangedb.New(filepath.Join(conf.VarDir(), "filetree-shares.index"))
+	if err != nil {
+		return nil, err
+	}
 
 	ft := &FileTree{
 		conf:      conf,
 		kvStore:   kvStore,
-		blobStore: blobStore,
+		blobStore: &localBlobStore{blobStore},
 		sharingCred: &bewit.Cred{
 			Key: []byte(conf.SharingKey),
 			ID:  "filetree",
 		},
 		webmQueue:     webmQueue,
+		photos:        photos,
+		photosPending: map[[2]string]struct{}{},
+		photosWake:    make(chan struct{}, 1),
+		shares:        shares,
 		thumbCache:    thumbscache,
 		metadataCache: metacache,
 		nodeCache:     nodeCache,
+		prewarming:    make(chan struct{}, maxPrewarming),
 		fileTypeCache: fileTypeCache,
 		authFunc:      authFunc,
 		shareTTL:      1 * time.Hour,
 		hub:           chub,
+		shedder:       shedder,
+		stop:          make(chan struct{}),
 		log:           logger,
 	}
 
+	if err := ft.setupChunkers(); err != nil {
+		return nil, fmt.Errorf("invalid chunker config: %v", err)
+	}
+	if _, _, _, err := ft.embedCookieSettings(); err != nil {
+		return nil, err
+	}
+
 	chub.Subscribe(hub.NewFiletreeNode, "webm", ft.webmHubCallback)
+	chub.Subscribe(hub.FiletreeFSUpdate, "photos", ft.photosHubCallback)
 	go ft.webmWorker()
+	go ft.photosWorker()
+
+	// Always started, the embed cookie revocations must be purged even without any retention policy
+	var retention map[string]*config.RetentionPolicy
+	if conf.Filetree != nil {
+		retention = conf.Filetree.Retention
+	}
+	go ft.retentionWorker(retention)
+
+	if conf.Filetree != nil && conf.Filetree.SFTP != nil {
+		if ft.sftp, err = ft.startSFTP(conf.Filetree.SFTP); err != nil {
+			return nil, fmt.Errorf("failed to start the SFTP server: %v", err)
+		}
+	}
 
 	return ft, nil
 }
 
 // Close closes all the open DB files.
 func (ft *FileTree) Close() error {
+	close(ft.stop)
+	if ft.sftp != nil {
+		ft.sftp.Close()
+	}
 	ft.thumbCache.Close()
 	ft.metadataCache.Close()
+	ft.photos.Close()
+	ft.shares.Close()
 	return nil
 }
 
@@ -228,6 +319,10 @@ L:
 		//	log.Debug("worker stopped")
 		//	break L
 		default:
+			if ft.shedder.Shedding() {
+				time.Sleep(1 * time.Second)
+				continue
+			}
 			ok, deqFunc, err := ft.webmQueue.Dequeue(n)
 			if err != nil {
 				panic(err)
@@ -310,6 +405,8 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	r.Handle("/node/{ref}", basicAuth(http.HandlerFunc(ft.nodeHandler())))
 	r.Handle("/node/{ref}/_snapshot", basicAuth(http.HandlerFunc(ft.nodeSnapshotHandler())))
 	r.Handle("/node/{ref}/_search", basicAuth(http.HandlerFunc(ft.nodeSearchHandler())))
+	r.Handle("/node/{ref}/_probe", basicAuth(http.HandlerFunc(ft.probeHandler())))
+	r.Handle("/node/{ref}/metadata", basicAuth(http.HandlerFunc(ft.nodeMetadataHandler())))
 
 	// TODO(ts): deprecate this endpoint and use commit /_snapshot?
 	r.Handle("/commit/{type}/{name}", basicAuth(http.HandlerFunc(ft.commitHandler())))
@@ -320,20 +417,49 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	r.Handle("/fs/{type}/{name}/_tree_blobs", basicAuth(http.HandlerFunc(ft.treeBlobsHandler())))
 	r.Handle("/fs/{type}/{name}/_tgz", basicAuth(http.HandlerFunc(ft.tgzHandler())))
 	r.Handle("/fs/{type}/{name}/_create", basicAuth(http.HandlerFunc(ft.fsCreateHandler())))
+	r.Handle("/fs/{type}/{name}/_prune", basicAuth(http.HandlerFunc(ft.pruneHandler())))
+	r.Handle("/fs/{type}/{name}/_estimate", basicAuth(http.HandlerFunc(ft.estimateHandler())))
+	r.Handle("/fs/{type}/{name}/_versions", basicAuth(http.HandlerFunc(ft.pathVersionsHandler())))
+	r.Handle("/fs/{type}/{name}/_duplicates", basicAuth(http.HandlerFunc(ft.duplicatesHandler())))
+	r.Handle("/fs/{type}/{name}/_mv", basicAuth(http.HandlerFunc(ft.moveHandler(false))))
+	r.Handle("/fs/{type}/{name}/_cp", basicAuth(http.HandlerFunc(ft.moveHandler(true))))
+	r.Handle("/fs/{type}/{name}/_trash", basicAuth(http.HandlerFunc(ft.trashHandler())))
+	r.Handle("/fs/{type}/{name}/_trash/{id}/_restore", basicAuth(http.HandlerFunc(ft.trashRestoreHandler())))
+	r.Handle("/photos", basicAuth(http.HandlerFunc(ft.photosHandler())))
+	r.Handle("/union/", basicAuth(http.HandlerFunc(ft.unionHandler())))
+	r.Handle("/union/{path:.+}", basicAuth(http.HandlerFunc(ft.unionHandler())))
 	r.Handle("/fs/{type}/{name}/", basicAuth(http.HandlerFunc(ft.fsHandler())))
 	r.Handle("/fs/{type}/{name}/{path:.+}", basicAuth(http.HandlerFunc(ft.fsHandler())))
 	// r.Handle("/fs", http.HandlerFunc(ft.fsHandler()))
 	// r.Handle("/fs/{name}", http.HandlerFunc(ft.fsByNameHandler()))
 
+	root.Handle("/site/{name}/", http.HandlerFunc(ft.siteHandler()))
+	root.Handle("/site/{name}/{path:.+}", http.HandlerFunc(ft.siteHandler()))
 	root.Handle("/public/{type}/{name}/", http.HandlerFunc(ft.publicHandler()))
 	root.Handle("/public/{type}/{name}/{path:.+}", http.HandlerFunc(ft.publicHandler()))
 
 	r.Handle("/upload", basicAuth(http.HandlerFunc(ft.uploadHandler())))
+	r.Handle("/import", basicAuth(http.HandlerFunc(ft.importHandler())))
+	r.Handle("/embed", basicAuth(http.HandlerFunc(ft.embedHandler())))
+
+	// Web file manager
+	r.Handle("/ui", basicAuth(http.HandlerFunc(ft.uiHandler())))
+
+	// Sharing links
+	r.Handle("/shares", basicAuth(http.HandlerFunc(ft.sharesHandler())))
+	r.Handle("/shares/{id}", basicAuth(http.HandlerFunc(ft.shareHandler())))
+	root.Handle("/share/{token}", http.HandlerFunc(ft.publicShareHandler()))
+	root.Handle("/share/{token}/{path:.+}", http.HandlerFunc(ft.publicShareHandler()))
 
 	// Public/semi-private handler
 	fileHandler := http.HandlerFunc(ft.fileHandler())
 	// Hook the standard endpint
 	r.Handle("/file/{ref}", fileHandler)
+	// HLS streaming of the transcoded videos
+	hlsHandler := http.HandlerFunc(ft.hlsHandler())
+	r.Handle("/file/{ref}/hls/playlist.m3u8", hlsHandler)
+	r.Handle("/file/{ref}/hls/{height:[0-9]+}.m3u8", hlsHandler)
+	r.Handle("/file/{ref}/hls/{segment:[a-f0-9]{64}}.ts", hlsHandler)
 	// Enable shortcut path from the root
 	root.Handle("/f/{ref}", fileHandler)
 	root.Handle("/w/{ref}.{ext}", http.HandlerFunc(ft.webmHandler()))
@@ -354,6 +480,9 @@ type Node struct {
 	Children      []*Node `json:"children,omitempty" msgpack:"c,omitempty"`
 	ChildrenCount int     `json:"children_count,omitempty" msgpack:"cc,omitempty"`
 
+	// Cursor of the next page of children (only set when the children are paginated)
+	ChildrenCursor string `json:"children_cursor,omitempty" msgpack:"-"`
+
 	// FIXME(ts): rename to Metadata
 	Data map[string]interface{} `json:"metadata,omitempty" msgpack:"md,omitempty"`
 	Info *Info                  `json:"info,omitempty" msgpack:"i,omitempty"`
@@ -391,6 +520,12 @@ func (ft *FileTree) Update(ctx context.Context, snap *Snapshot, n *Node, m *rnod
 		if h, ok := ctxutil.FileTreeHostname(ctx); ok {
 			snap.Hostname = h
 		}
+		if a, ok := ctxutil.FileTreeAuthor(ctx); ok && snap.Author == "" {
+			snap.Author = a
+		}
+		if m, ok := ctxutil.FileTreeMessage(ctx); ok && snap.Message == "" {
+			snap.Message = m
+		}
 		snapEncoded, err := msgpack.Marshal(snap)
 		if err != nil {
 			return nil, 0, err
@@ -506,6 +641,11 @@ func (ft *FileTree) Delete(ctx context.Context, snap *Snapshot, n *Node, prefixF
 	if n.parent == nil {
 		panic("can't delete root")
 	}
+	if n.fs != nil {
+		if err := ft.checkRetentionLock(ctx, n.fs.Name); err != nil {
+			return nil, 0, err
+		}
+	}
 	parent := n.parent
 
 	newRefs := []interface{}{}
@@ -708,28 +848,14 @@ func (ft *FileTree) fetchDir(ctx context.Context, n *Node, depth, maxDepth int)
 		return nil
 	}
 	if n.Type == rnode.Dir {
+		ft.prefetchNodes(ctx, n.Meta.Refs)
 		n.Children = []*Node{}
 		for _, ref := range n.Meta.Refs {
-			cn, err := ft.nodeByRef(ctx, ref.(string))
+			cn, err := ft.fetchChild(ctx, ref.(string), depth, maxDepth)
 			if err != nil {
 				return err
 			}
-			if cn.Type == "file" {
-				// FIXME(tsileo): init the new file in fetchInfo and only if needed
-				f := filereader.NewFile(ctx, ft.blobStore, cn.Meta, nil)
-				defer f.Close()
-
-				info, err := ft.fetchInfo(f, cn.Meta.Name, cn.Meta.Hash, cn.Meta.ContentHash)
-				if err != nil {
-					panic(err)
-				}
-				cn.Info = info
-			}
-
 			n.Children = append(n.Children, cn)
-			if err := ft.fetchDir(ctx, cn, depth+1, maxDepth); err != nil {
-				return err
-			}
 		}
 	}
 
@@ -740,6 +866,119 @@ func (ft *FileTree) fetchDir(ctx context.Context, n *Node, depth, maxDepth int)
 	return nil
 }
 
+// fetchChild fetches the child node (at the given depth) along with its children
+func (ft *FileTree) fetchChild(ctx context.Context, ref string, depth, maxDepth int) (*Node, error) {
+	cn, err := ft.nodeByRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if cn.Type == "file" {
+		// FIXME(tsileo): init the new file in fetchInfo and only if needed
+		f := filereader.NewFile(ctx, ft.blobStore, cn.Meta, nil)
+		defer f.Close()
+
+		info, err := ft.fetchInfo(f, cn.Meta.Name, cn.Meta.Hash, cn.Meta.ContentHash)
+		if err != nil {
+			panic(err)
+		}
+		cn.Info = info
+	}
+
+	if err := ft.fetchDir(ctx, cn, depth+1, maxDepth); err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// dirQuery parses the `depth` (1 to 5) and the `limit` (0 to return all the dir children, capped to
+// `maxDirPageSize`) query params
+func dirQuery(q *httputil.Query) (int, int, error) {
+	depth, err := q.GetInt("depth", 1, 5)
+	if err != nil {
+		return 0, 0, err
+	}
+	if depth < 1 {
+		return 0, 0, fmt.Errorf("invalid depth %d", depth)
+	}
+	limit, err := q.GetIntDefault("limit", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit < 0 {
+		return 0, 0, fmt.Errorf("invalid limit %d", limit)
+	}
+	if limit > maxDirPageSize {
+		limit = maxDirPageSize
+	}
+	return depth, limit, nil
+}
+
+// fetchDirPage fetches a page of `limit` dir children (recursively up to `maxDepth`), starting at the given cursor.
+// The children are returned in the order of the dir refs (the most recently updated first) as sorting them by name
+// would require fetching all of them. The cursor of the next page is set in `ChildrenCursor` (empty for the last
+// page), it's only valid for this version of the dir.
+func (ft *FileTree) fetchDirPage(ctx context.Context, n *Node, cursor string, limit, maxDepth int) error {
+	if n.Type != rnode.Dir {
+		return nil
+	}
+	var offset int
+	if cursor != "" {
+		var err error
+		offset, err = decodeDirCursor(n.Hash, cursor)
+		if err != nil {
+			return err
+		}
+	}
+	if offset > len(n.Meta.Refs) {
+		return errInvalidCursor
+	}
+	end := offset + limit
+	if end > len(n.Meta.Refs) {
+		end = len(n.Meta.Refs)
+	}
+
+	ft.prefetchNodes(ctx, n.Meta.Refs[offset:end])
+	n.Children = []*Node{}
+	for _, ref := range n.Meta.Refs[offset:end] {
+		cn, err := ft.fetchChild(ctx, ref.(string), 1, maxDepth)
+		if err != nil {
+			return err
+		}
+		n.Children = append(n.Children, cn)
+	}
+	n.ChildrenCursor = ""
+	if end < len(n.Meta.Refs) {
+		n.ChildrenCursor = encodeDirCursor(n.Hash, end)
+	}
+	return nil
+}
+
+// Max number of dir children returned in a single page
+const maxDirPageSize = 1000
+
+// errInvalidCursor is returned when the cursor is malformed, or when the dir has changed since the cursor was issued
+var errInvalidCursor = errors.New("invalid cursor (the directory may have changed)")
+
+func encodeDirCursor(hash string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", hash, offset)))
+}
+
+func decodeDirCursor(hash, cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 2 || parts[0] != hash {
+		return 0, errInvalidCursor
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil || offset < 0 {
+		return 0, errInvalidCursor
+	}
+	return offset, nil
+}
+
 // Commit duplicate the last snapshot and add a commit message
 func (fs *FS) commit(ctx context.Context, prefixFmt, message string) (int64, error) {
 	kv, err := fs.ft.kvStore.Get(ctx, fmt.Sprintf(prefixFmt, fs.Name), -1)
@@ -899,8 +1138,12 @@ func (fs *FS) Path(ctx context.Context, path string, depth int, create bool, mti
 				if err != nil {
 					return nil, nil, found, err
 				}
-				// load the dir children in order to continue the search
-				if err := fs.ft.fetchDir(ctx, node, 1, 1); err != nil {
+				// load the dir children in order to continue the search (or up to the requested depth for the last one)
+				maxDepth := 1
+				if i == pathCount-1 {
+					maxDepth = depth
+				}
+				if err := fs.ft.fetchDir(ctx, node, 1, maxDepth); err != nil {
 					return nil, nil, found, err
 				}
 				node.parent = prev
@@ -947,8 +1190,8 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
 		// Try to parse the metadata (JSON encoded in the `data` query argument)
 		var data map[string]interface{}
 		if d := r.URL.Query().Get("data"); d != "" {
@@ -968,7 +1211,7 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 			panic(err)
 		}
 		defer file.Close()
-		uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+		uploader := ft.NewUploader(ctx)
 		fdata, err := ioutil.ReadAll(file)
 		if err != nil {
 			panic(err)
@@ -988,6 +1231,7 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 			panic(err)
 		}
 		node.Info = info
+		audit.AddRefs(ctx, node.Hash)
 		httputil.MarshalAndWrite(r, w, node)
 	}
 }
@@ -1020,7 +1264,7 @@ func (ft *FileTree) fetchInfo(reader io.ReadSeeker, filename, hash, contentHash
 	// TODO(tsileo): parse PDF text
 	// XXX(tsileo): generate video thumbnail?
 	fmt.Printf("lname=%v\n", lname)
-	if vidinfo.IsVideo(filename) {
+	if vidinfo.IsVideo(filename) && contentHash != "" {
 		infoPath := vidinfo.InfoPath(ft.conf, contentHash)
 		if _, err := os.Stat(infoPath); err == nil {
 			js, err := ioutil.ReadFile(infoPath)
@@ -1068,7 +1312,7 @@ func (ft *FileTree) fsRootHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 		nodes := []*Node{}
 
@@ -1111,6 +1355,25 @@ func (ft *FileTree) IterFS(ctx context.Context, start string) ([]*FSInfo, error)
 	return out, nil
 }
 
+// WarmUp loads the latest root (and its direct children) of every FS, so the first requests after a restart don't
+// hit a cold cache, returns the number of FS loaded
+func (ft *FileTree) WarmUp(ctx context.Context) (int, error) {
+	it, err := ft.IterFS(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	for i, fsInfo := range it {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		fs := &FS{Name: fsInfo.Name, Ref: fsInfo.Ref, ft: ft}
+		if _, _, _, err := fs.Path(ctx, "/", 1, false, 0); err != nil {
+			return i, fmt.Errorf("failed to load FS %q: %v", fsInfo.Name, err)
+		}
+	}
+	return len(it), nil
+}
+
 func fixPath(p string) string {
 	if p == "." {
 		return ""
@@ -1124,7 +1387,7 @@ func (ft *FileTree) versionsHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 
 		}
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 		vars := mux.Vars(r)
 		fsName := vars["name"]
@@ -1267,8 +1530,8 @@ func (ft *FileTree) commitHandler() func(http.ResponseWriter, *http.Request) {
 
 func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
 
 		// FIXME(tsileo): handle mtime in the context too, and make it optional
 
@@ -1292,9 +1555,11 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 		if err != nil {
 			panic(err)
 		}
-		depth, err := q.GetInt("depth", 1, 5)
+		// Optional pagination of the dir children
+		depth, limit, err := dirQuery(q)
 		if err != nil {
-			panic(err)
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
 		var fs *FS
@@ -1305,6 +1570,7 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				ft:  ft,
 			}
 		case "fs":
+			ctx = ctxutil.WithUsageNamespace(ctx, "filetree:"+fsName)
 			fs, err = ft.FS(ctx, fsName, prefixFmt, false, asOf)
 			if err != nil {
 				panic(err)
@@ -1314,7 +1580,12 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 		}
 		switch r.Method {
 		case "GET", "HEAD":
-			node, _, _, err := fs.Path(ctx, path, depth, false, mtime)
+			pathDepth := depth
+			if limit > 0 {
+				// The children will be fetched page by page
+				pathDepth = 0
+			}
+			node, _, _, err := fs.Path(ctx, path, pathDepth, false, mtime)
 			switch err {
 			case nil:
 			case clientutil.ErrBlobNotFound:
@@ -1337,6 +1608,17 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
+			if limit > 0 {
+				if err := ft.fetchDirPage(ctx, node, q.Get("cursor"), limit, depth); err != nil {
+					if err == errInvalidCursor {
+						httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+						return
+					}
+					panic(err)
+				}
+			}
+			ft.prewarmSubdirs(ctx, node.Children)
+
 			if node.Type == "file" {
 				// FIXME(tsileo): init the new file in fetchInfo and only if needed
 				f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
@@ -1376,7 +1658,11 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 				panic(err)
 			}
 			defer file.Close()
-			uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+			var prev *Node
+			if !created {
+				prev = node
+			}
+			uploader := ft.NewDeltaUploader(ctx, prev)
 
 			// Create/save me Meta
 			meta, err := uploader.PutReader(filepath.Base(path), file, nil)
@@ -1545,8 +1831,12 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			}
 
 			// FIXME(tsileo): add a &Snapshot{} !
-			_, revision, err := ft.Delete(ctx, nil, node, prefixFmt, mtime)
+			_, revision, err := ft.deleteToTrash(ctx, fs.Name, node, path, prefixFmt, mtime)
 			if err != nil {
+				if err == ErrRetentionLocked {
+					httputil.WriteJSONError(w, http.StatusLocked, err.Error())
+					return
+				}
 				panic(err)
 			}
 
@@ -1605,8 +1895,8 @@ func (ft *FileTree) fsCreateHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
 
 		// FIXME(tsileo): handle mtime in the context too, and make it optional
 
@@ -1630,8 +1920,8 @@ func (ft *FileTree) fsCreateHandler() func(http.ResponseWriter, *http.Request) {
 
 func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
 
 		// FIXME(tsileo): handle mtime in the context too, and make it optional
 
@@ -1715,7 +2005,7 @@ func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
 
 				// write the file content (iter over all the blobs)
 				for _, iv := range n.Meta.FileRefs() {
-					blob, err := ft.blobStore.Get(ctx, iv.Value)
+					blob, err := filereader.GetChunk(ctx, ft.blobStore, iv.Value, iv.Base)
 					if err != nil {
 						panic(err)
 					}
@@ -1808,6 +2098,9 @@ func (ft *FileTree) TreeBlobs(ctx context.Context, node *Node) ([]string, error)
 		// write the file content (iter over all the blobs)
 		for _, iv := range n.Meta.FileRefs() {
 			out = append(out, iv.Value)
+			if iv.Base != "" {
+				out = append(out, iv.Base)
+			}
 		}
 		return nil
 	}); err != nil {
@@ -1836,7 +2129,7 @@ func (ft *FileTree) webmHandler() func(http.ResponseWriter, *http.Request) {
 			authorized = true
 		}
 
-		if !authorized {
+		if !authorized && !ft.checkEmbedCookie(r, hash) {
 			// Try if an API key is provided
 			ft.log.Info("before authFunc")
 			if !ft.authFunc(r) {
@@ -1863,7 +2156,7 @@ func (ft *FileTree) fileHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 		vars := mux.Vars(r)
 
 		hash := vars["ref"]
@@ -1882,7 +2175,7 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 		authorized = true
 	}
 
-	if !authorized {
+	if !authorized && !ft.checkEmbedCookie(r, hash) {
 		// Try if an API key is provided
 		ft.log.Info("before authFunc")
 		if !ft.authFunc(r) {
@@ -1913,7 +2206,20 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 	// Initialize a new `File`
 	var f io.ReadSeeker
 	// FIXME(tsileo): ctx
-	f = filereader.NewFile(ctx, ft.blobStore, m, nil)
+	ff := filereader.NewFile(ctx, ft.blobStore, m, nil)
+	if ft.conf.Filetree != nil && ft.conf.Filetree.ReadAhead > 0 {
+		ff.SetReadAhead(ft.conf.Filetree.ReadAhead)
+	}
+	f = ff
+
+	// Serve the MIME type sniffed at upload time rather than letting the browser guess it
+	if ct := m.ContentType(); ct != "" {
+		w.Header().Set("Content-Type", ct)
+		if strings.HasPrefix(ct, "text/html") && ft.conf.Filetree != nil && ft.conf.Filetree.HTMLContentSecurityPolicy != "" {
+			w.Header().Set("Content-Security-Policy", ft.conf.Filetree.HTMLContentSecurityPolicy)
+		}
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	// Check if the file is requested for download (?dl=1)
 	httputil.SetAttachment(m.Name, r, w)
@@ -1932,8 +2238,12 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 		mtime = time.Now()
 	}
 
+	// Compress text-based files if the client supports it (range requests are served as-is)
+	cw := httputil.NewCompressResponseWriter(w, r)
+	defer cw.Close()
+
 	// Serve the file content using the same code as the `http.ServeFile` (it'll handle HEAD request)
-	http.ServeContent(w, r, m.Name, mtime, f)
+	http.ServeContent(cw, r, m.Name, mtime, f)
 }
 
 func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
@@ -1943,8 +2253,8 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
 
 		vars := mux.Vars(r)
 		fsName := vars["name"]
@@ -1953,6 +2263,9 @@ func (ft *FileTree) publicHandler() func(http.ResponseWriter, *http.Request) {
 		prefixFmt := FSKeyFmt
 		if p := r.URL.Query().Get("prefix"); p != "" {
 			prefixFmt = p + ":%s"
+		} else if refType == "fs" && ft.conf.Public.IsPublicRoot(fsName) {
+			// The whole FS is public
+			path = "/" + vars["path"]
 		}
 		var mtime int64
 		var err error
@@ -2038,13 +2351,12 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 		// Check permissions
 		// permissions.CheckPerms(r, PermName)
 
-		// TODO(tsileo): limit the max depth of the tree configurable via query args
 		if r.Method != "GET" && r.Method != "HEAD" {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 		vars := mux.Vars(r)
 
 		hash := vars["ref"]
@@ -2077,9 +2389,24 @@ func (ft *FileTree) nodeHandler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		if err := ft.fetchDir(ctx, n, 1, 1); err != nil {
+		q := httputil.NewQuery(r.URL.Query())
+		depth, limit, err := dirQuery(q)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if limit > 0 {
+			if err := ft.fetchDirPage(ctx, n, q.Get("cursor"), limit, depth); err != nil {
+				if err == errInvalidCursor {
+					httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				panic(err)
+			}
+		} else if err := ft.fetchDir(ctx, n, 1, depth); err != nil {
 			panic(err)
 		}
+		ft.prewarmSubdirs(ctx, n.Children)
 
 		if r.URL.Query().Get("bewit") == "1" {
 			for _, child := range n.Children {
@@ -2138,7 +2465,7 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 			authorized = true
 		}
 
-		if !authorized {
+		if !authorized && !ft.checkEmbedCookie(r, mux.Vars(r)["ref"]) {
 			// Try if an API key is provided
 			ft.log.Info("before authFunc")
 			if !ft.authFunc(r) {
@@ -2205,7 +2532,7 @@ func (ft *FileTree) nodeTgzHandler() func(http.ResponseWriter, *http.Request) {
 
 			// write the file content (iter over all the blobs)
 			for _, iv := range n.Meta.FileRefs() {
-				blob, err := ft.blobStore.Get(ctx, iv.Value)
+				blob, err := filereader.GetChunk(ctx, ft.blobStore, iv.Value, iv.Base)
 				if err != nil {
 					panic(err)
 				}
@@ -2244,7 +2571,7 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 			auth.Forbidden(w)
 			return
 		}
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 		vars := mux.Vars(r)
 
 		hash := vars["ref"]
@@ -2262,6 +2589,7 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 
 		snap := &Snapshot{
 			Message:  sreq.Message,
+			Author:   auth.ID(r),
 			Hostname: sreq.Hostname,
 		}
 
@@ -2284,7 +2612,7 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 
 // nodeByRef fetch the blob containing the `meta.Meta` and convert it to a `Node`
 func (ft *FileTree) nodeByRef(ctx context.Context, hash string) (*Node, error) {
-	blob, err := ft.blobStore.Get(ctx, hash)
+	blob, err := ft.nodeBlob(ctx, hash)
 	if err != nil {
 		return nil, err
 	}
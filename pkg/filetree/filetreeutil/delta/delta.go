@@ -0,0 +1,150 @@
+/*
+
+Package delta implements a simple binary delta encoding (copy/insert instructions against a base), used to store a
+modified chunk of a file as a small delta against the matching chunk of the previous version of the file.
+
+*/
+package delta // import "a4.io/blobstash/pkg/filetree/filetreeutil/delta"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+var (
+	// DeltaBlobHeader is the header of the delta blobs, followed by the hex-encoded hash of the target
+	DeltaBlobHeader = []byte("#blobstash/delta\n")
+
+	// ErrCorrupted is returned when a delta cannot be applied
+	ErrCorrupted = errors.New("corrupted delta")
+)
+
+const (
+	opInsert byte = iota
+	opCopy
+)
+
+// Size of the blocks of the base indexed for finding matches
+const blockSize = 16
+
+const hashSize = 64
+
+// IsDelta returns true if the blob is a delta blob
+func IsDelta(blob []byte) bool {
+	return bytes.HasPrefix(blob, DeltaBlobHeader)
+}
+
+// IsText returns true if the data looks like text (i.e. no NUL bytes in the first 8000 bytes, like Git does)
+func IsText(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) == -1
+}
+
+// Diff returns the delta blob that recreates `target` from `base`
+func Diff(base, target []byte) []byte {
+	// Index the offset of the blocks of the base
+	idx := map[string]int{}
+	for i := 0; i+blockSize <= len(base); i += blockSize {
+		if _, ok := idx[string(base[i:i+blockSize])]; !ok {
+			idx[string(base[i:i+blockSize])] = i
+		}
+	}
+
+	out := append([]byte{}, DeltaBlobHeader...)
+	out = append(out, hashutil.Compute(target)...)
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v int) {
+		n := binary.PutUvarint(buf, uint64(v))
+		out = append(out, buf[:n]...)
+	}
+	insert := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		out = append(out, opInsert)
+		putUvarint(len(data))
+		out = append(out, data...)
+	}
+
+	var pending, i int
+	for i+blockSize <= len(target) {
+		off, ok := idx[string(target[i:i+blockSize])]
+		if !ok {
+			i++
+			continue
+		}
+		// Extend the match in both directions
+		for off > 0 && i > pending && base[off-1] == target[i-1] {
+			off--
+			i--
+		}
+		n := 0
+		for off+n < len(base) && i+n < len(target) && base[off+n] == target[i+n] {
+			n++
+		}
+
+		insert(target[pending:i])
+		out = append(out, opCopy)
+		putUvarint(off)
+		putUvarint(n)
+		i += n
+		pending = i
+	}
+	insert(target[pending:])
+	return out
+}
+
+// Patch applies the delta blob to the base, the result is checked against the target hash stored in the delta
+func Patch(base, delta []byte) ([]byte, error) {
+	if !IsDelta(delta) || len(delta) < len(DeltaBlobHeader)+hashSize {
+		return nil, ErrCorrupted
+	}
+	expected := string(delta[len(DeltaBlobHeader) : len(DeltaBlobHeader)+hashSize])
+	data := delta[len(DeltaBlobHeader)+hashSize:]
+	uvarint := func() (int, bool) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 || v > uint64(len(delta)+len(base)) {
+			return 0, false
+		}
+		data = data[n:]
+		return int(v), true
+	}
+
+	out := []byte{}
+	for len(data) > 0 {
+		op := data[0]
+		data = data[1:]
+		switch op {
+		case opInsert:
+			n, ok := uvarint()
+			if !ok || n > len(data) {
+				return nil, ErrCorrupted
+			}
+			out = append(out, data[:n]...)
+			data = data[n:]
+		case opCopy:
+			off, ok := uvarint()
+			if !ok {
+				return nil, ErrCorrupted
+			}
+			n, ok := uvarint()
+			if !ok || off+n > len(base) {
+				return nil, ErrCorrupted
+			}
+			out = append(out, base[off:off+n]...)
+		default:
+			return nil, ErrCorrupted
+		}
+	}
+
+	if h := hashutil.Compute(out); h != expected {
+		return nil, fmt.Errorf("corrupted delta: expected %s, got %s", expected, h)
+	}
+	return out, nil
+}
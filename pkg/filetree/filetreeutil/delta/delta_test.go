@@ -0,0 +1,44 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	base := make([]byte, 64*1024)
+	rand.Read(base)
+
+	target := append([]byte{}, base[:10000]...)
+	target = append(target, []byte("inserted")...)
+	target = append(target, base[10000:30000]...)
+	target = append(target, base[40000:]...)
+	target[50000] ^= 0xff
+
+	for _, tdata := range []struct {
+		base, target []byte
+	}{
+		{base, target},
+		{base, []byte("short")},
+		{[]byte{}, target},
+		{base, []byte{}},
+	} {
+		d := Diff(tdata.base, tdata.target)
+		out, err := Patch(tdata.base, d)
+		if err != nil {
+			t.Fatalf("failed to patch: %v", err)
+		}
+		if !bytes.Equal(out, tdata.target) {
+			t.Errorf("patched data does not match the target")
+		}
+	}
+
+	d := Diff(base, target)
+	if len(d) > 1024 {
+		t.Errorf("delta is too large: %d bytes", len(d))
+	}
+	if _, err := Patch(base[1:], d); err == nil {
+		t.Errorf("patching a different base should fail")
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"bytes"
 	"fmt"
 	"mime"
+	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/vmihailenco/msgpack"
 	"golang.org/x/crypto/blake2b"
@@ -30,6 +32,30 @@ const (
 	V1 = "1"
 )
 
+// ContentTypeKey is the metadata key holding the MIME type sniffed at upload time
+const ContentTypeKey = "content_type"
+
+// ExifKey is the metadata key holding the EXIF data extracted at upload time
+const ExifKey = "exif"
+
+// ProbeKey is the metadata key holding the media info (resolution, codec, duration) extracted by the probe
+const ProbeKey = "probe"
+
+// SniffLen is the number of bytes needed to sniff the MIME type
+const SniffLen = 512
+
+// SniffContentType detects the MIME type of a file from its first bytes, the extension is only used when the content
+// is not recognized (e.g. CSS/JS/JSON files are sniffed as plain text)
+func SniffContentType(name string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		if ext := mime.TypeByExtension(filepath.Ext(name)); ext != "" {
+			return ext
+		}
+	}
+	return sniffed
+}
+
 func IsNodeBlob(blob []byte) ([]byte, bool) { // returns (string, bool) string => meta type
 	// TODO add a test with a tiny blob
 	if len(blob) < NodeBlobOverhead {
@@ -44,6 +70,8 @@ func IsNodeBlob(blob []byte) ([]byte, bool) { // returns (string, bool) string =
 type IndexValue struct {
 	Index int64  `json:"i" msgpack:"i"`
 	Value string `json:"ref" msgpack:"r"`
+	// Set if the chunk is stored as a delta against the base chunk
+	Base string `json:"base,omitempty" msgpack:"b,omitempty"`
 }
 
 type RawNode struct {
@@ -57,7 +85,9 @@ type RawNode struct {
 	Version     string                 `msgpack:"v"`
 	ContentHash string                 `msgpack:"ch"`
 	Metadata    map[string]interface{} `msgpack:"m,omitempty"`
-	Hash        string                 `msgpack:"-"`
+	// Key of the client-side encrypted file, encrypted with the master key of the client
+	EncryptedKey []byte `msgpack:"ek,omitempty"`
+	Hash         string `msgpack:"-"`
 }
 
 func (n *RawNode) FileRefs() []*IndexValue {
@@ -93,6 +123,9 @@ func (n *RawNode) FileRefs() []*IndexValue {
 				panic("unexpected index")
 			}
 			iv := &IndexValue{Index: index, Value: data[1].(string)}
+			if len(data) > 2 {
+				iv.Base = data[2].(string)
+			}
 			out = append(out, iv)
 		}
 	}
@@ -126,6 +159,11 @@ func (n *RawNode) AddIndexedRef(index int, hash string) {
 	n.Refs = append(n.Refs, []interface{}{index, hash})
 }
 
+// AddDeltaRef adds a chunk stored as a delta against the base chunk
+func (n *RawNode) AddDeltaRef(index int, hash, base string) {
+	n.Refs = append(n.Refs, []interface{}{index, hash, base})
+}
+
 func (n *RawNode) AddRef(hash string) {
 	n.Refs = append(n.Refs, hash)
 }
@@ -149,11 +187,15 @@ func NewNodeFromBlob(hash string, blob []byte) (*RawNode, error) {
 	return node, nil
 }
 
+// ContentType returns the MIME type sniffed at upload time, or guesses it from the extension for older nodes
 func (n *RawNode) ContentType() string {
-	if n.IsFile() {
-		return mime.TypeByExtension(filepath.Ext(n.Name))
+	if !n.IsFile() {
+		return ""
+	}
+	if ct, ok := n.Metadata[ContentTypeKey].(string); ok && ct != "" {
+		return ct
 	}
-	return ""
+	return mime.TypeByExtension(filepath.Ext(n.Name))
 }
 
 // IsFile returns true if the Meta is a file.
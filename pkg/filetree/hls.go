@@ -0,0 +1,404 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/filetree/vidinfo"
+	"a4.io/blobstash/pkg/httputil/bewit"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// HLSJob is the kind of the HLS transcoding jobs (the params hold the `ref` of the video node)
+const HLSJob = "filetree.hls"
+
+// HLSKeyFmt is the key holding the HLS manifest of a video (by content hash), the ref of the version is a dir node
+// holding the segments (so they're referenced like the files of a FS)
+var HLSKeyFmt = "_filetree:hls:%s"
+
+// HLSMimeType is the content type of the HLS playlists
+const HLSMimeType = "application/vnd.apple.mpegurl"
+
+var defaultHLSRenditions = []int{360, 720}
+
+// hlsSourceHeight is the rendition height used when the height of the video is unknown (transcoded without scaling)
+const hlsSourceHeight = 0
+
+const defaultHLSSegmentDuration = 6
+
+// HLSManifest lists the renditions of a transcoded video
+type HLSManifest struct {
+	Renditions []*HLSRendition `json:"renditions"`
+}
+
+// HLSRendition holds the segments of a rendition, stored as filetree files
+type HLSRendition struct {
+	Width     int           `json:"width"`
+	Height    int           `json:"height"`
+	Bandwidth int           `json:"bandwidth"`
+	Segments  []*HLSSegment `json:"segments"`
+}
+
+// HLSSegment is a segment of a rendition
+type HLSSegment struct {
+	Ref      string  `json:"ref"`
+	Duration float64 `json:"duration"`
+}
+
+// relativeURI returns the URI as is
+func relativeURI(uri string) string {
+	return uri
+}
+
+// MasterPlaylist returns the HLS master playlist, `uri` returns the URL of each rendition playlist (from its name)
+func (m *HLSManifest) MasterPlaylist(uri func(string) string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range m.Renditions {
+		fmt.Fprintf(&buf, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s\n", r.Bandwidth, r.Width, r.Height, uri(fmt.Sprintf("%d.m3u8", r.Height)))
+	}
+	return buf.Bytes()
+}
+
+// rendition returns the rendition of the given height (nil if it does not exist)
+func (m *HLSManifest) rendition(height int) *HLSRendition {
+	for _, r := range m.Renditions {
+		if r.Height == height {
+			return r
+		}
+	}
+	return nil
+}
+
+// hasSegment returns true if the segment is part of one of the renditions
+func (m *HLSManifest) hasSegment(ref string) bool {
+	for _, r := range m.Renditions {
+		for _, s := range r.Segments {
+			if s.Ref == ref {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MediaPlaylist returns the HLS media playlist of the rendition, `uri` returns the URL of each segment (from its name)
+func (r *HLSRendition) MediaPlaylist(uri func(string) string) []byte {
+	var target float64
+	for _, s := range r.Segments {
+		target = math.Max(target, s.Duration)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(math.Ceil(target)))
+	for _, s := range r.Segments {
+		fmt.Fprintf(&buf, "#EXTINF:%.3f,\n%s\n", s.Duration, uri(s.Ref+".ts"))
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+func (ft *FileTree) hlsEnabled() bool {
+	return ft.conf.Filetree != nil && ft.conf.Filetree.HLS != nil
+}
+
+// HLSManifest returns the HLS manifest of the video, nil if it has not been transcoded (yet)
+func (ft *FileTree) HLSManifest(ctx context.Context, contentHash string) (*HLSManifest, error) {
+	kv, err := ft.kvStore.Get(ctx, fmt.Sprintf(HLSKeyFmt, contentHash), -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	m := &HLSManifest{}
+	if err := json.Unmarshal(kv.Data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type hlsParams struct {
+	Ref       string `json:"ref"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// registerHLSJob registers the HLS transcoding jobs (one video at a time), a job is started for each new video
+func (ft *FileTree) registerHLSJob(m *jobs.Manager) error {
+	if err := m.RegisterKind(&jobs.Kind{
+		Name: HLSJob,
+		Run:  ft.runHLS,
+		// Don't retry the videos ffmpeg fails to transcode
+		Retry:       jobs.RetryPolicy{MaxAttempts: 1},
+		Concurrency: 1,
+	}); err != nil {
+		return err
+	}
+	ft.hub.Subscribe(hub.NewFiletreeNode, "hls", func(ctx context.Context, _ *blob.Blob, data interface{}) error {
+		return ft.hlsHubCallback(ctx, m, data.(*rnode.RawNode))
+	})
+	return nil
+}
+
+func (ft *FileTree) hlsHubCallback(ctx context.Context, m *jobs.Manager, n *rnode.RawNode) error {
+	if !vidinfo.IsVideo(n.Name) || n.Size == 0 {
+		return nil
+	}
+	manifest, err := ft.HLSManifest(ctx, n.ContentHash)
+	if err != nil || manifest != nil {
+		return err
+	}
+	ns, _ := ctxutil.Namespace(ctx)
+	if _, err := m.Start(HLSJob, &hlsParams{Ref: n.Hash, Namespace: ns}); err != nil {
+		return err
+	}
+	ft.log.Info("HLS transcoding started", "ref", n.Hash)
+	return nil
+}
+
+func (ft *FileTree) runHLS(ctx context.Context, h *jobs.Handle) error {
+	params := &hlsParams{}
+	if err := h.Params(params); err != nil {
+		return err
+	}
+	if params.Namespace != "" {
+		ctx = ctxutil.WithNamespace(ctx, params.Namespace)
+	}
+	for ft.shedder.Shedding() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+	n, err := ft.nodeByRef(ctx, params.Ref)
+	if err != nil {
+		return err
+	}
+	// The video may have been transcoded by a previous job
+	m, err := ft.HLSManifest(ctx, n.Meta.ContentHash)
+	if err != nil || m != nil {
+		return err
+	}
+	return ft.transcodeHLS(ctx, n.Meta)
+}
+
+// hlsHeights returns the heights of the renditions for a video of the given height (the video is never upscaled), a
+// single rendition at the source height is returned if the height is unknown
+func (ft *FileTree) hlsHeights(videoHeight int) []int {
+	if videoHeight <= 0 {
+		return []int{hlsSourceHeight}
+	}
+	renditions := ft.conf.Filetree.HLS.Renditions
+	if len(renditions) == 0 {
+		renditions = defaultHLSRenditions
+	}
+	heights := []int{}
+	for _, h := range renditions {
+		if h <= videoHeight {
+			heights = append(heights, h)
+		}
+	}
+	if len(heights) == 0 {
+		// libx264 requires even dimensions
+		heights = append(heights, videoHeight&^1)
+	}
+	sort.Ints(heights)
+	return heights
+}
+
+// transcodeHLS transcodes the video into the configured renditions, and stores the segments as filetree files
+func (ft *FileTree) transcodeHLS(ctx context.Context, n *rnode.RawNode) error {
+	segmentDuration := ft.conf.Filetree.HLS.SegmentDuration
+	if segmentDuration <= 0 {
+		segmentDuration = defaultHLSSegmentDuration
+	}
+
+	dir, err := ioutil.TempDir("", "blobstash_hls_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := filereader.GetFile(ctx, ft.blobStore, n.Hash, src); err != nil {
+		return err
+	}
+	info, err := vidinfo.Parse(src)
+	if err != nil {
+		return err
+	}
+
+	m := &HLSManifest{Renditions: []*HLSRendition{}}
+	segmentRefs := map[string]struct{}{}
+	up := ft.NewUploader(ctx)
+	for _, height := range ft.hlsHeights(info.Height) {
+		segments, err := vidinfo.TranscodeHLS(src, dir, height, segmentDuration)
+		if err != nil {
+			return err
+		}
+		r := &HLSRendition{Height: height, Segments: []*HLSSegment{}}
+		switch {
+		case height == hlsSourceHeight && len(segments) > 0:
+			// Read the actual dimensions from the first segment
+			sinfo, err := vidinfo.Parse(filepath.Join(dir, segments[0].URI))
+			if err != nil {
+				return err
+			}
+			r.Width, r.Height = sinfo.Width, sinfo.Height
+		case info.Height > 0:
+			r.Width = (info.Width * height / info.Height) &^ 1
+		}
+		var size int64
+		var duration float64
+		for _, s := range segments {
+			p := filepath.Join(dir, s.URI)
+			fi, err := os.Stat(p)
+			if err != nil {
+				return err
+			}
+			meta, err := up.PutFile(p)
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+			duration += s.Duration
+			r.Segments = append(r.Segments, &HLSSegment{Ref: meta.Hash, Duration: s.Duration})
+			segmentRefs[meta.Hash] = struct{}{}
+		}
+		if duration > 0 {
+			r.Bandwidth = int(float64(size*8) / duration)
+		}
+		m.Renditions = append(m.Renditions, r)
+	}
+
+	// Reference the segments from a dir node, set as the ref of the manifest version
+	dirMeta := &rnode.RawNode{
+		Version: rnode.V1,
+		Type:    rnode.Dir,
+		Name:    "hls",
+		ModTime: time.Now().Unix(),
+	}
+	refs := []string{}
+	for ref := range segmentRefs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		dirMeta.AddRef(ref)
+	}
+	if err := up.PutMeta(dirMeta); err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = ft.kvStore.Put(ctx, fmt.Sprintf(HLSKeyFmt, n.ContentHash), dirMeta.Hash, js, -1)
+	return err
+}
+
+// hlsHandler serves the HLS playlists and segments of a video
+func (ft *FileTree) hlsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		vars := mux.Vars(r)
+
+		// The playlists served with a bewit link to the sub-playlists/segments with their own bewit
+		uri := relativeURI
+		if err := bewit.Validate(r, ft.sharingCred); err == nil {
+			base := path.Dir(r.URL.Path)
+			uri = func(name string) string {
+				u := &url.URL{Path: base + "/" + name}
+				if err := bewit.Bewit(ft.sharingCred, u, ft.shareTTL); err != nil {
+					panic(err)
+				}
+				return u.String()
+			}
+		} else if !ft.checkEmbedCookie(r, vars["ref"]) && !ft.authFunc(r) {
+			// Returns a 404 to prevent leak of hashes
+			notFound(w)
+			return
+		}
+
+		n, err := ft.nodeByRef(ctx, vars["ref"])
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+		m, err := ft.HLSManifest(ctx, n.ContentHash)
+		if err != nil {
+			panic(err)
+		}
+		if m == nil {
+			notFound(w)
+			return
+		}
+
+		switch {
+		case vars["segment"] != "":
+			segment := vars["segment"]
+			if !m.hasSegment(segment) {
+				notFound(w)
+				return
+			}
+			sn, err := ft.nodeByRef(ctx, segment)
+			if err != nil {
+				panic(err)
+			}
+			f := filereader.NewFile(ctx, ft.blobStore, sn.Meta, nil)
+			defer f.Close()
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Header().Set("Cache-Control", "max-age=31536000")
+			http.ServeContent(w, r, segment+".ts", time.Unix(0, 0), f)
+		case vars["height"] != "":
+			height, err := strconv.Atoi(vars["height"])
+			if err != nil {
+				notFound(w)
+				return
+			}
+			rendition := m.rendition(height)
+			if rendition == nil {
+				notFound(w)
+				return
+			}
+			w.Header().Set("Content-Type", HLSMimeType)
+			w.Write(rendition.MediaPlaylist(uri))
+		default:
+			w.Header().Set("Content-Type", HLSMimeType)
+			w.Write(m.MasterPlaylist(uri))
+		}
+	}
+}
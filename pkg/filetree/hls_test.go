@@ -0,0 +1,70 @@
+package filetree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/vidinfo"
+)
+
+func TestHLSPlaylists(t *testing.T) {
+	segments, err := vidinfo.ParsePlaylist([]byte(`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:7
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:6.006000,
+360_00000.ts
+#EXTINF:2.5,
+360_00001.ts
+#EXT-X-ENDLIST
+`))
+	check(err)
+	if len(segments) != 2 || segments[0].URI != "360_00000.ts" || segments[0].Duration != 6.006 || segments[1].Duration != 2.5 {
+		t.Fatalf("failed to parse playlist, got %+v", segments)
+	}
+	if _, err := vidinfo.ParsePlaylist([]byte("#EXTM3U\n360_00000.ts\n")); err == nil {
+		t.Errorf("a segment without duration should fail")
+	}
+
+	m := &HLSManifest{Renditions: []*HLSRendition{
+		{Width: 640, Height: 360, Bandwidth: 800000, Segments: []*HLSSegment{{Ref: "a", Duration: 6.006}, {Ref: "b", Duration: 2.5}}},
+	}}
+	if master := string(m.MasterPlaylist(relativeURI)); !strings.Contains(master, "#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\n360.m3u8\n") {
+		t.Errorf("bad master playlist %q", master)
+	}
+	media := string(m.rendition(360).MediaPlaylist(relativeURI))
+	for _, expected := range []string{"#EXT-X-TARGETDURATION:7\n", "#EXTINF:6.006,\na.ts\n", "#EXTINF:2.500,\nb.ts\n", "#EXT-X-ENDLIST\n"} {
+		if !strings.Contains(media, expected) {
+			t.Errorf("media playlist %q should contain %q", media, expected)
+		}
+	}
+	if m.rendition(720) != nil || !m.hasSegment("b") || m.hasSegment("c") {
+		t.Errorf("bad manifest lookups")
+	}
+
+	signed := string(m.MasterPlaylist(func(uri string) string { return "/hls/" + uri + "?bewit=x" }))
+	if !strings.Contains(signed, "\n/hls/360.m3u8?bewit=x\n") {
+		t.Errorf("bad signed master playlist %q", signed)
+	}
+}
+
+func TestHLSHeights(t *testing.T) {
+	ft := &FileTree{conf: &config.Config{Filetree: &config.FiletreeConfig{HLS: &config.HLSConfig{}}}}
+	for _, tdata := range []struct {
+		height   int
+		expected []int
+	}{
+		{1080, []int{360, 720}},
+		{480, []int{360}},
+		{241, []int{240}},
+		// Unknown height, transcoded at the source height
+		{0, []int{hlsSourceHeight}},
+	} {
+		if got := ft.hlsHeights(tdata.height); !reflect.DeepEqual(got, tdata.expected) {
+			t.Errorf("hlsHeights(%d) = %v, expected %v", tdata.height, got, tdata.expected)
+		}
+	}
+}
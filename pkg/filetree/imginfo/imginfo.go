@@ -1,7 +1,7 @@
 package imginfo // import "a4.io/blobstash/pkg/filetree/imginfo"
 
 import (
-	// "encoding/json"
+	"encoding/json"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
@@ -22,17 +22,18 @@ func IsImage(filename string) bool {
 	return false
 }
 
-func getWidthHeight(f io.Reader) (int, int, error) {
-	image, _, err := image.DecodeConfig(f)
+func getConfig(f io.Reader) (int, int, string, error) {
+	image, format, err := image.DecodeConfig(f)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, "", err
 	}
-	return image.Width, image.Height, nil
+	return image.Width, image.Height, format, nil
 }
 
 type Image struct {
 	Width  int       `json:"width,omitempty"`
 	Height int       `json:"height,omitempty"`
+	Format string    `json:"format,omitempty"` // Image codec (gif, jpeg or png)
 	Exif   *ExifInfo `json:"exif,omitempty"`
 }
 
@@ -45,6 +46,40 @@ type ExifInfo struct {
 	GPSLng    float64 `json:"gps_lng,omitempty"`
 }
 
+// Metadata returns the EXIF data as a map, to be stored in the node metadata
+func (e *ExifInfo) Metadata() map[string]interface{} {
+	js, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(js, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// ExifFromMetadata returns the EXIF data stored in the node metadata (see `ExifInfo.Metadata`)
+func ExifFromMetadata(v interface{}) (*ExifInfo, bool) {
+	if v == nil {
+		return nil, false
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	info := &ExifInfo{}
+	if err := json.Unmarshal(js, info); err != nil {
+		return nil, false
+	}
+	return info, true
+}
+
+// ParseExif extracts the EXIF data from a JPEG image (only the first segments are needed)
+func ParseExif(f io.Reader) (*ExifInfo, error) {
+	return parseExif(f)
+}
+
 func parseExif(f io.Reader) (*ExifInfo, error) {
 	x, err := exif.Decode(f)
 	if err != nil {
@@ -120,10 +155,11 @@ func parseExif(f io.Reader) (*ExifInfo, error) {
 
 func Parse(f io.ReadSeeker, shouldParseExif bool) (*Image, error) {
 	img := &Image{}
-	w, h, err := getWidthHeight(f)
+	w, h, format, err := getConfig(f)
 	if err == nil {
 		img.Width = w
 		img.Height = h
+		img.Format = format
 	}
 	f.Seek(0, os.SEEK_SET)
 	if shouldParseExif {
@@ -0,0 +1,233 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/audit"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ErrInvalidTar is returned when the imported tarball cannot be parsed, or contains unsafe paths
+var ErrInvalidTar = errors.New("invalid tarball")
+
+// ImportResult holds the result of a tarball import
+type ImportResult struct {
+	Ref   string `json:"ref"`
+	Files int    `json:"files"`
+	Dirs  int    `json:"dirs"`
+	Size  int64  `json:"size"`
+}
+
+// importDir is a directory of the imported tree, its meta is built once all the entries have been read
+type importDir struct {
+	name    string
+	mode    uint32
+	modTime int64
+	dirs    map[string]*importDir
+	files   map[string]*rnode.RawNode
+}
+
+func newImportDir(name string) *importDir {
+	return &importDir{
+		name:  name,
+		mode:  uint32(os.ModeDir | 0755),
+		dirs:  map[string]*importDir{},
+		files: map[string]*rnode.RawNode{},
+	}
+}
+
+// dir returns the directory at the given (cleaned) path, creating the missing ones
+func (d *importDir) dir(p string) (*importDir, error) {
+	// The top-level entries are either in "." (relative paths) or "/"
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		return d, nil
+	}
+	cur := d
+	for _, part := range strings.Split(p, "/") {
+		if _, ok := cur.files[part]; ok {
+			return nil, fmt.Errorf("%w: %q is both a file and a directory", ErrInvalidTar, p)
+		}
+		next, ok := cur.dirs[part]
+		if !ok {
+			next = newImportDir(part)
+			cur.dirs[part] = next
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// cleanTarPath returns the path of a tar entry relative to the archive root
+func cleanTarPath(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: unsafe path %q", ErrInvalidTar, name)
+		}
+	}
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return ".", nil
+	}
+	return p[1:], nil
+}
+
+// ImportTar uploads the content of the tarball, and returns the root node (named `name`), the directory metas are
+// built bottom-up once the whole archive is read (only the regular files and the directories are imported)
+func (ft *FileTree) ImportTar(ctx context.Context, name string, r io.Reader) (*ImportResult, error) {
+	up := ft.NewUploader(ctx)
+	root := newImportDir(name)
+	res := &ImportResult{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		switch err {
+		case nil:
+		case tar.ErrHeader, io.ErrUnexpectedEOF:
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTar, err)
+		default:
+			// Body read error
+			return nil, err
+		}
+		p, err := cleanTarPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			d, err := root.dir(p)
+			if err != nil {
+				return nil, err
+			}
+			d.mode = uint32(hdr.FileInfo().Mode())
+			d.modTime = hdr.ModTime.Unix()
+		case tar.TypeReg, tar.TypeRegA:
+			if p == "." {
+				return nil, fmt.Errorf("%w: invalid file name %q", ErrInvalidTar, hdr.Name)
+			}
+			parent, err := root.dir(path.Dir(p))
+			if err != nil {
+				return nil, err
+			}
+			base := path.Base(p)
+			if _, ok := parent.dirs[base]; ok {
+				return nil, fmt.Errorf("%w: %q is both a file and a directory", ErrInvalidTar, p)
+			}
+			meta, err := up.PutReaderMeta(tr, &rnode.RawNode{
+				Name:    base,
+				Type:    rnode.File,
+				Mode:    uint32(hdr.FileInfo().Mode()),
+				ModTime: hdr.ModTime.Unix(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			parent.files[base] = meta
+			res.Files++
+			res.Size += int64(meta.Size)
+		default:
+			// Links, devices... are skipped
+		}
+	}
+
+	meta, err := ft.putImportDir(up, root, res)
+	if err != nil {
+		return nil, err
+	}
+	res.Ref = meta.Hash
+	return res, nil
+}
+
+// putImportDir uploads the metas of the directory (after its children)
+func (ft *FileTree) putImportDir(up *writer.Uploader, d *importDir, res *ImportResult) (*rnode.RawNode, error) {
+	hashes := []string{}
+	for _, child := range d.dirs {
+		meta, err := ft.putImportDir(up, child, res)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, meta.Hash)
+	}
+	for _, meta := range d.files {
+		hashes = append(hashes, meta.Hash)
+	}
+	sort.Strings(hashes)
+
+	modTime := d.modTime
+	if modTime == 0 {
+		modTime = time.Now().Unix()
+	}
+	meta := &rnode.RawNode{
+		Version: rnode.V1,
+		Type:    rnode.Dir,
+		Name:    d.name,
+		Mode:    d.mode,
+		ModTime: modTime,
+	}
+	for _, hash := range hashes {
+		meta.AddRef(hash)
+	}
+	if err := up.PutMeta(meta); err != nil {
+		return nil, err
+	}
+	res.Dirs++
+	return meta, nil
+}
+
+func (ft *FileTree) importHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.Node),
+			perms.Resource(perms.Filetree, perms.Node),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "_root"
+		}
+		if strings.Contains(name, "/") {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "invalid root name")
+			return
+		}
+
+		res, err := ft.ImportTar(ctx, name, r.Body)
+		if err != nil {
+			if errors.Is(err, ErrInvalidTar) {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			panic(err)
+		}
+		audit.AddRefs(ctx, res.Ref)
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
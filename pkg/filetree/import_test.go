@@ -0,0 +1,78 @@
+package filetree
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func buildTar(entries []*tar.Header, contents map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		check(tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(contents[hdr.Name]))
+		check(err)
+	}
+	check(tw.Close())
+	return &buf
+}
+
+func TestImportTar(t *testing.T) {
+	env := testutil.New(t, "filetree_import_test")
+	defer env.Close()
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	contents := map[string]string{
+		"./a.txt":         "hello",
+		"./sub/deep/b.md": "# title",
+	}
+	archive := buildTar([]*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime},
+		{Name: "./sub/deep/b.md", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./link", Typeflag: tar.TypeSymlink, Linkname: "a.txt", ModTime: mtime},
+	}, contents)
+
+	ctx := context.Background()
+	res, err := ft.ImportTar(ctx, "myroot", archive)
+	check(err)
+	if res.Files != 2 || res.Dirs != 3 || res.Size != 12 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	root, err := ft.nodeByRef(ctx, res.Ref)
+	check(err)
+	if root.Name != "myroot" || root.Meta.ModTime != mtime.Unix() {
+		t.Errorf("unexpected root %+v", root.Meta)
+	}
+
+	fs := &FS{Ref: res.Ref, ft: ft}
+	for p, content := range contents {
+		node, _, _, err := fs.Path(ctx, p[1:], 1, false, 0)
+		check(err)
+		f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+		out, err := ioutil.ReadAll(f)
+		check(err)
+		f.Close()
+		if string(out) != content || node.Meta.ModTime != mtime.Unix() {
+			t.Errorf("%s: unexpected file %q %+v", p, out, node.Meta)
+		}
+	}
+
+	// Paths escaping the root are rejected
+	archive = buildTar([]*tar.Header{{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}}, nil)
+	if _, err := ft.ImportTar(ctx, "myroot", archive); !errors.Is(err, ErrInvalidTar) {
+		t.Errorf("expected ErrInvalidTar, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrRetentionLocked is returned when deleting from a FS whose latest version is younger than its retention lock
+var ErrRetentionLocked = errors.New("FS under retention lock")
+
+// checkRetentionLock returns ErrRetentionLocked if the FS is under its retention lock (the lock starts from the most
+// recent version of the FS)
+func (ft *FileTree) checkRetentionLock(ctx context.Context, name string) error {
+	lock := ft.conf.FSRetentionLock(name)
+	if lock == 0 {
+		return nil
+	}
+	kv, err := ft.kvStore.Get(ctx, fmt.Sprintf(FSKeyFmt, name), -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	if time.Unix(0, kv.Version).Add(lock).After(time.Now()) {
+		return ErrRetentionLocked
+	}
+	return nil
+}
+
+// KeyRetentionLocked returns true if the kv key holds the versions of a FS under its retention lock
+func (ft *FileTree) KeyRetentionLocked(ctx context.Context, key string) (bool, error) {
+	prefix := fmt.Sprintf(FSKeyFmt, "")
+	if !strings.HasPrefix(key, prefix) {
+		return false, nil
+	}
+	switch err := ft.checkRetentionLock(ctx, strings.TrimPrefix(key, prefix)); err {
+	case nil:
+		return false, nil
+	case ErrRetentionLocked:
+		return true, nil
+	default:
+		return false, err
+	}
+}
@@ -0,0 +1,60 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestRetentionLock(t *testing.T) {
+	env := testutil.New(t, "filetree_lock_test")
+	defer env.Close()
+	kvs := env.KvStore
+	conf := &config.Config{
+		RetentionLocks: &config.RetentionLocks{FS: map[string]int{"locked": 7}},
+	}
+	ft := newTestFileTree(t, env, conf)
+	defer ft.Close()
+
+	ctx := context.Background()
+	mtime := time.Now()
+	archive := buildTar([]*tar.Header{
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, map[string]string{"./a.txt": "hello"})
+	res, err := ft.ImportTar(ctx, "_root", archive)
+	check(err)
+	for _, name := range []string{"locked", "unlocked"} {
+		_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, name), res.Ref, nil, -1)
+		check(err)
+	}
+
+	for name, expected := range map[string]bool{"locked": true, "unlocked": false} {
+		locked, err := ft.KeyRetentionLocked(ctx, fmt.Sprintf(FSKeyFmt, name))
+		check(err)
+		if locked != expected {
+			t.Errorf("FS %q: expected locked=%v", name, expected)
+		}
+
+		fs, err := ft.FS(ctx, name, FSKeyFmt, false, 0)
+		check(err)
+		node, _, _, err := fs.Path(ctx, "/a.txt", 1, false, mtime.Unix())
+		check(err)
+		_, _, err = ft.Delete(ctx, nil, node, FSKeyFmt, mtime.Unix())
+		if expected && err != ErrRetentionLocked {
+			t.Errorf("expected ErrRetentionLocked, got %v", err)
+		}
+		if !expected && err != nil {
+			t.Errorf("failed to delete from FS %q: %v", name, err)
+		}
+	}
+
+	// Only the FS keys are locked
+	if locked, err := ft.KeyRetentionLocked(ctx, "locked"); err != nil || locked {
+		t.Errorf("unexpected lock on a non FS key (%v)", err)
+	}
+}
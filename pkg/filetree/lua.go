@@ -77,7 +77,7 @@ func (ft *FileTree) nodeSearchHandler() func(http.ResponseWriter, *http.Request)
 			return
 		}
 
-		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 		n, err := ft.nodeByRef(ctx, hash)
 		if err != nil {
@@ -18,7 +18,6 @@ import (
 	"a4.io/blobstash/pkg/filetree/imginfo"
 	"a4.io/blobstash/pkg/filetree/reader/filereader"
 	"a4.io/blobstash/pkg/filetree/vidinfo"
-	"a4.io/blobstash/pkg/filetree/writer"
 	"a4.io/blobstash/pkg/stash/store"
 )
 
@@ -225,7 +224,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 3
 			},
 			"put_file": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := ft.NewUploader(context.TODO())
 				name := L.ToString(1)
 				newName := L.ToString(2)
 				extraMeta := L.ToBool(3)
@@ -261,7 +260,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 1
 			},
 			"upload_file": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := ft.NewUploader(context.TODO())
 				name := L.ToString(1)
 				contents := L.ToString(2)
 				node, err := uploader.PutReader(name, strings.NewReader(contents), nil)
@@ -273,7 +272,7 @@ func setupFileTree(ft *filetree.FileTree, bs store.BlobStore, kv store.KvStore)
 				return 1
 			},
 			"put_file_at": func(L *lua.LState) int {
-				uploader := writer.NewUploader(filetree.NewBlobStoreCompat(bs, context.TODO()))
+				uploader := ft.NewUploader(context.TODO())
 				snap := toSnap(luautil.TableToMap(L, L.ToTable(1)))
 				name := L.ToString(2)
 				contents := L.ToString(3)
@@ -0,0 +1,185 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// MetadataRequest holds a metadata update (the keys set to null are removed)
+type MetadataRequest struct {
+	Metadata map[string]interface{} `json:"metadata"`
+
+	// Optional FS (and path) of the node, the updated node replaces it and the change is propagated up to the FS root
+	FS   string `json:"fs"`
+	Path string `json:"path"`
+}
+
+// reservedMetadataKeys are set by BlobStash itself (and used to serve the files), they cannot be updated via the API
+var reservedMetadataKeys = map[string]struct{}{
+	rnode.ContentTypeKey: struct{}{},
+	rnode.ExifKey:        struct{}{},
+	rnode.ProbeKey:       struct{}{},
+}
+
+// withMetadata returns a copy of the node with the updated metadata, the content refs are preserved
+func withMetadata(m *rnode.RawNode, metadata map[string]interface{}, ctime int64) *rnode.RawNode {
+	newMeta := *m
+	newMeta.Metadata = map[string]interface{}{}
+	for k, v := range m.Metadata {
+		newMeta.Metadata[k] = v
+	}
+	for k, v := range metadata {
+		if v == nil {
+			delete(newMeta.Metadata, k)
+			continue
+		}
+		newMeta.Metadata[k] = v
+	}
+	if len(newMeta.Metadata) == 0 {
+		newMeta.Metadata = nil
+	}
+	newMeta.ChangeTime = ctime
+	return &newMeta
+}
+
+// UpdateMetadata saves a new version of the node with the updated metadata, if the node is part of a FS (i.e. loaded
+// via `FS.Path`), the change is propagated up to the FS root
+func (ft *FileTree) UpdateMetadata(ctx context.Context, n *Node, metadata map[string]interface{}, prefixFmt string) (*Node, int64, error) {
+	newMeta := withMetadata(n.Meta, metadata, time.Now().Unix())
+	ref, data := newMeta.Encode()
+	newMeta.Hash = ref
+	if _, err := ft.blobStore.Put(ctx, &blob.Blob{Hash: ref, Data: data}); err != nil {
+		return nil, 0, err
+	}
+	if n.fs == nil {
+		newNode, err := ft.metaToNode(ctx, newMeta)
+		return newNode, 0, err
+	}
+	return ft.Update(ctx, nil, n, newMeta, prefixFmt, false)
+}
+
+// nodeMetadataHandler updates the metadata of a node (the tags, description and custom fields set at upload time)
+func (ft *FileTree) nodeMetadataHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
+		ref := mux.Vars(r)["ref"]
+
+		mreq := &MetadataRequest{}
+		if err := httputil.Unmarshal(r, mreq); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(mreq.Metadata) == 0 {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "missing metadata")
+			return
+		}
+		for k := range mreq.Metadata {
+			if _, reserved := reservedMetadataKeys[k]; reserved {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("reserved metadata key %q", k))
+				return
+			}
+		}
+
+		if mreq.FS == "" {
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.Node),
+				perms.ResourceWithID(perms.Filetree, perms.Node, ref),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			n, err := ft.nodeByRef(ctx, ref)
+			switch err {
+			case nil:
+			case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+				notFound(w)
+				return
+			default:
+				panic(err)
+			}
+			newNode, _, err := ft.UpdateMetadata(ctx, n, mreq.Metadata, FSKeyFmt)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, newNode)
+			return
+		}
+
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, mreq.FS),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx = ctxutil.WithUsageNamespace(ctx, "filetree:"+mreq.FS)
+		path := filepath.Clean("/" + mreq.Path)
+
+		fs, err := ft.FS(ctx, mreq.FS, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		if fs.Ref == "" {
+			notFound(w)
+			return
+		}
+		n, _, _, err := fs.Path(ctx, path, 1, false, 0)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+		// The node must still be the one at the path
+		if n.Hash != ref {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		newNode, revision, err := ft.UpdateMetadata(ctx, n, mreq.Metadata, FSKeyFmt)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      fmt.Sprintf("%s-patched", newNode.Type),
+			Ref:       newNode.Hash,
+			Path:      path[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, newNode)
+	}
+}
@@ -0,0 +1,85 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestUpdateMetadata(t *testing.T) {
+	env := testutil.New(t, "filetree_metadata_test")
+	defer env.Close()
+	dir, kvs := env.Dir, env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	src := filepath.Join(dir, "src")
+	check(os.MkdirAll(filepath.Join(src, "sub"), 0700))
+	check(ioutil.WriteFile(filepath.Join(src, "sub", "nested.txt"), []byte("nested"), 0600))
+	check(ioutil.WriteFile(filepath.Join(src, "other.txt"), []byte("other"), 0600))
+
+	ctx := context.Background()
+	root, err := ft.NewUploader(ctx).PutDir(src)
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "test"), root.Hash, nil, -1)
+	check(err)
+
+	fs, err := ft.FS(ctx, "test", FSKeyFmt, false, 0)
+	check(err)
+	n, _, _, err := fs.Path(ctx, "/sub/nested.txt", 1, false, 0)
+	check(err)
+	newNode, _, err := ft.UpdateMetadata(ctx, n, map[string]interface{}{
+		"tags":        []interface{}{"a", "b"},
+		"description": "nested file",
+	}, FSKeyFmt)
+	check(err)
+	if newNode.Hash == n.Hash || newNode.Meta.ContentHash != n.Meta.ContentHash || len(newNode.Meta.Refs) != len(n.Meta.Refs) {
+		t.Errorf("the content should be preserved in the new node, got %+v", newNode.Meta)
+	}
+
+	// The new ref is propagated up to the FS root
+	fs, err = ft.FS(ctx, "test", FSKeyFmt, false, 0)
+	check(err)
+	if fs.Ref == root.Hash {
+		t.Fatalf("the FS root should have been updated")
+	}
+	n2, _, _, err := fs.Path(ctx, "/sub/nested.txt", 1, false, 0)
+	check(err)
+	if n2.Hash != newNode.Hash || n2.Meta.Metadata["description"] != "nested file" {
+		t.Errorf("unexpected node %+v", n2.Meta)
+	}
+	other, _, _, err := fs.Path(ctx, "/other.txt", 1, false, 0)
+	check(err)
+	if other.Name != "other.txt" {
+		t.Errorf("the siblings should be kept")
+	}
+
+	// A nil value removes the key
+	n3, _, err := ft.UpdateMetadata(ctx, n2, map[string]interface{}{"description": nil}, FSKeyFmt)
+	check(err)
+	if _, ok := n3.Meta.Metadata["description"]; ok || n3.Meta.Metadata["tags"] == nil {
+		t.Errorf("unexpected metadata %+v", n3.Meta.Metadata)
+	}
+
+	// The reserved keys cannot be updated
+	for _, k := range []string{rnode.ContentTypeKey, rnode.ExifKey, rnode.ProbeKey} {
+		r := httptest.NewRequest("PATCH", "/node/"+n3.Hash+"/metadata", strings.NewReader(fmt.Sprintf(`{"metadata":{%q:null}}`, k)))
+		r = mux.SetURLVars(r, map[string]string{"ref": n3.Hash})
+		w := httptest.NewRecorder()
+		ft.nodeMetadataHandler()(w, r)
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("updating %q should be rejected, got %d", k, w.Code)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+var (
+	// ErrPathNotFound is returned when the source of a move/copy does not exist
+	ErrPathNotFound = errors.New("path not found")
+
+	// ErrPathExists is returned when the destination of a move/copy already exists
+	ErrPathExists = errors.New("path already exists")
+
+	// ErrInvalidMove is returned for moves/copies that cannot be applied (root, destination inside the source...)
+	ErrInvalidMove = errors.New("invalid move")
+)
+
+// MoveRequest is the payload of the move/copy API
+type MoveRequest struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// splitPath returns the names of the path components ("/" returns an empty slice)
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+// lookupChild returns the index (in the refs) and the meta of the named child of the dir, -1 if it does not exist
+func (ft *FileTree) lookupChild(ctx context.Context, dir *rnode.RawNode, name string) (int, *rnode.RawNode, error) {
+	for i, ref := range dir.Refs {
+		n, err := ft.nodeByRef(ctx, ref.(string))
+		if err != nil {
+			return -1, nil, err
+		}
+		if n.Meta.Name == name {
+			return i, n.Meta, nil
+		}
+	}
+	return -1, nil, nil
+}
+
+// lookupPath returns the meta at the given path components, nil if it does not exist
+func (ft *FileTree) lookupPath(ctx context.Context, root *rnode.RawNode, names []string) (*rnode.RawNode, error) {
+	m := root
+	for _, name := range names {
+		if m.Type != rnode.Dir {
+			return nil, nil
+		}
+		_, child, err := ft.lookupChild(ctx, m, name)
+		if err != nil || child == nil {
+			return nil, err
+		}
+		m = child
+	}
+	return m, nil
+}
+
+func (ft *FileTree) putRawNode(ctx context.Context, m *rnode.RawNode) error {
+	ref, data := m.Encode()
+	m.Hash = ref
+	_, err := ft.blobStore.Put(ctx, &blob.Blob{Hash: ref, Data: data})
+	return err
+}
+
+// rewriteDir calls `f` on the dir at the given path components (relative to `dir`), and saves the updated metas up to
+// `dir` (the missing dirs are created if `create` is set), only the dir metas are rewritten
+func (ft *FileTree) rewriteDir(ctx context.Context, dir *rnode.RawNode, names []string, create bool, mtime int64, f func(*rnode.RawNode)) error {
+	if dir.Type != rnode.Dir {
+		return fmt.Errorf("%w: %q is not a directory", ErrInvalidMove, dir.Name)
+	}
+	if len(names) == 0 {
+		f(dir)
+		dir.ModTime = mtime
+		dir.ChangeTime = 0
+		return ft.putRawNode(ctx, dir)
+	}
+
+	idx, child, err := ft.lookupChild(ctx, dir, names[0])
+	if err != nil {
+		return err
+	}
+	if child == nil {
+		if !create {
+			return ErrPathNotFound
+		}
+		child = &rnode.RawNode{
+			Type:    rnode.Dir,
+			Version: rnode.V1,
+			Name:    names[0],
+			ModTime: mtime,
+		}
+	}
+	if err := ft.rewriteDir(ctx, child, names[1:], create, mtime, f); err != nil {
+		return err
+	}
+	if idx == -1 {
+		dir.Refs = append(dir.Refs, child.Hash)
+	} else {
+		dir.Refs[idx] = child.Hash
+	}
+	return ft.putRawNode(ctx, dir)
+}
+
+// Move moves (or copies) the node at `src` to `dst` and saves a new version of the FS, the moved node meta is the only
+// node re-encoded (with its new name) along with the parent dirs, the file contents are not touched
+func (ft *FileTree) Move(ctx context.Context, fs *FS, src, dst string, copy bool, prefixFmt string, mtime int64) (*Node, int64, error) {
+	src = path.Clean("/" + src)
+	dst = path.Clean("/" + dst)
+	if src == "/" || dst == "/" {
+		return nil, 0, fmt.Errorf("%w: cannot move the root", ErrInvalidMove)
+	}
+	if !copy && strings.HasPrefix(dst, src+"/") {
+		return nil, 0, fmt.Errorf("%w: %q is inside %q", ErrInvalidMove, dst, src)
+	}
+
+	if fs.Ref == "" {
+		return nil, 0, ErrPathNotFound
+	}
+	root, err := fs.Root(ctx, false, mtime)
+	if err != nil {
+		if err == blobsfile.ErrBlobNotFound {
+			return nil, 0, ErrPathNotFound
+		}
+		return nil, 0, err
+	}
+	root.fs = fs
+	root.parent = nil
+
+	srcNames := splitPath(src)
+	dstNames := splitPath(dst)
+
+	srcMeta, err := ft.lookupPath(ctx, root.Meta, srcNames)
+	if err != nil {
+		return nil, 0, err
+	}
+	if srcMeta == nil {
+		return nil, 0, ErrPathNotFound
+	}
+	existing, err := ft.lookupPath(ctx, root.Meta, dstNames)
+	if err != nil {
+		return nil, 0, err
+	}
+	if existing != nil {
+		return nil, 0, ErrPathExists
+	}
+
+	newRoot := root.Meta
+	if !copy {
+		srcName := srcNames[len(srcNames)-1]
+		if err := ft.rewriteDir(ctx, newRoot, srcNames[:len(srcNames)-1], false, mtime, func(d *rnode.RawNode) {
+			idx, _, _ := ft.lookupChild(ctx, d, srcName)
+			d.Refs = append(d.Refs[:idx], d.Refs[idx+1:]...)
+		}); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	moved, err := ft.addNode(ctx, newRoot, dstNames, srcMeta, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Save the new FS version
+	_, revision, err := ft.Update(ctx, nil, root, newRoot, prefixFmt, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	node, err := ft.metaToNode(ctx, moved)
+	if err != nil {
+		return nil, 0, err
+	}
+	return node, revision, nil
+}
+
+// addNode saves a copy of the meta named after the last path component, and adds it to its parent dir (the missing
+// dirs are created), `root` is updated but the new FS version is not saved
+func (ft *FileTree) addNode(ctx context.Context, root *rnode.RawNode, names []string, m *rnode.RawNode, mtime int64) (*rnode.RawNode, error) {
+	added := *m
+	added.Name = names[len(names)-1]
+	added.ChangeTime = mtime
+	if err := ft.putRawNode(ctx, &added); err != nil {
+		return nil, err
+	}
+	if err := ft.rewriteDir(ctx, root, names[:len(names)-1], true, mtime, func(d *rnode.RawNode) {
+		d.Refs = append(d.Refs, added.Hash)
+	}); err != nil {
+		return nil, err
+	}
+	return &added, nil
+}
+
+// moveHandler handles the mv/cp API, the node is moved (or copied) within the same FS
+func (ft *FileTree) moveHandler(copy bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			panic(httputil.NewPublicErrorFmt("only FS can be updated"))
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx = ctxutil.WithUsageNamespace(ctx, "filetree:"+fsName)
+
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		mtime, err := q.GetInt64Default("mtime", 0)
+		if err != nil {
+			panic(err)
+		}
+		if mtime == 0 {
+			mtime = time.Now().Unix()
+		}
+
+		mreq := &MoveRequest{}
+		if err := httputil.Unmarshal(r, mreq); err != nil {
+			panic(err)
+		}
+		if mreq.Src == "" || mreq.Dst == "" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "missing src/dst")
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+
+		node, revision, err := ft.Move(ctx, fs, mreq.Src, mreq.Dst, copy, prefixFmt, mtime)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrPathNotFound):
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, ErrPathExists):
+				httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			case errors.Is(err, ErrInvalidMove):
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			default:
+				panic(err)
+			}
+			return
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		evtType := fmt.Sprintf("%s-moved", node.Type)
+		if copy {
+			evtType = fmt.Sprintf("%s-copied", node.Type)
+		}
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      evtType,
+			Ref:       node.Hash,
+			Path:      path.Clean("/" + mreq.Dst)[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, node)
+	}
+}
@@ -0,0 +1,89 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestMove(t *testing.T) {
+	env := testutil.New(t, "filetree_move_test")
+	defer env.Close()
+	kvs := env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := buildTar([]*tar.Header{
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./sub/b.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, map[string]string{"./a.txt": "hello", "./sub/b.txt": "world"})
+	res, err := ft.ImportTar(ctx, "_root", archive)
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), res.Ref, nil, -1)
+	check(err)
+
+	move := func(src, dst string, copy bool) (int64, error) {
+		fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+		check(err)
+		_, rev, err := ft.Move(ctx, fs, src, dst, copy, FSKeyFmt, mtime.Unix())
+		return rev, err
+	}
+	read := func(p string) (string, error) {
+		fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+		check(err)
+		node, _, _, err := fs.Path(ctx, p, 1, false, 0)
+		if err != nil {
+			return "", err
+		}
+		f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+		defer f.Close()
+		out, err := ioutil.ReadAll(f)
+		return string(out), err
+	}
+
+	if _, err := move("/a.txt", "/new/dir/c.txt", false); err != nil {
+		t.Fatalf("failed to move: %v", err)
+	}
+	if out, err := read("/new/dir/c.txt"); err != nil || out != "hello" {
+		t.Errorf("unexpected moved file %q %v", out, err)
+	}
+	if _, err := read("/a.txt"); err == nil {
+		t.Errorf("source should have been removed")
+	}
+
+	if _, err := move("/sub", "/sub2", true); err != nil {
+		t.Fatalf("failed to copy: %v", err)
+	}
+	for _, p := range []string{"/sub/b.txt", "/sub2/b.txt"} {
+		if out, err := read(p); err != nil || out != "world" {
+			t.Errorf("%s: unexpected file %q %v", p, out, err)
+		}
+	}
+
+	// Rename within the same dir
+	if _, err := move("/sub2/b.txt", "/sub2/c.txt", false); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	if out, err := read("/sub2/c.txt"); err != nil || out != "world" {
+		t.Errorf("unexpected renamed file %q %v", out, err)
+	}
+
+	if _, err := move("/missing", "/x", false); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound, got %v", err)
+	}
+	if _, err := move("/sub", "/sub2", false); !errors.Is(err, ErrPathExists) {
+		t.Errorf("expected ErrPathExists, got %v", err)
+	}
+	if _, err := move("/sub", "/sub/inner", false); !errors.Is(err, ErrInvalidMove) {
+		t.Errorf("expected ErrInvalidMove, got %v", err)
+	}
+}
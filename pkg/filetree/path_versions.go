@@ -0,0 +1,199 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// PathVersion holds a version of a path within a FS
+type PathVersion struct {
+	Ref     string `json:"ref,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Size    int    `json:"size,omitempty"`
+	ModTime string `json:"mtime,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+
+	// The first FS revision (and its root ref) containing this version
+	Revision int64  `json:"fs_revision"`
+	FSRef    string `json:"fs_ref"`
+
+	// Author and message of the FS revision
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// PathVersions returns the history of the given path within the FS (newest first), by walking the FS snapshots.
+func (ft *FileTree) PathVersions(ctx context.Context, name, prefixFmt, path string, limit int) ([]*PathVersion, error) {
+	kvv, _, err := ft.kvStore.Versions(ctx, fmt.Sprintf(prefixFmt, name), "0", -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return []*PathVersion{}, nil
+	default:
+		return nil, err
+	}
+
+	versions := []*PathVersion{}
+	var last *PathVersion
+	for _, kv := range kvv.Versions {
+		fs := &FS{Name: name, Ref: kv.HexHash(), Revision: kv.Version, ft: ft}
+		node, _, _, err := fs.Path(ctx, path, 1, false, 0)
+		var v *PathVersion
+		switch err {
+		case nil:
+			v = &PathVersion{Ref: node.Hash, Type: node.Type, Size: node.Size, ModTime: node.ModTime}
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			v = &PathVersion{Deleted: true}
+		default:
+			return nil, err
+		}
+
+		snap := &Snapshot{}
+		if err := msgpack.Unmarshal(kv.Data, snap); err != nil {
+			return nil, err
+		}
+
+		// Snapshots are iterated from the newest, the same node in an older snapshot means it was introduced earlier
+		if last != nil && last.Ref == v.Ref {
+			last.Revision = kv.Version
+			last.FSRef = fs.Ref
+			last.Author = snap.Author
+			last.Message = snap.Message
+			continue
+		}
+		if len(versions) == limit {
+			break
+		}
+		v.Revision = kv.Version
+		v.FSRef = fs.Ref
+		v.Author = snap.Author
+		v.Message = snap.Message
+		versions = append(versions, v)
+		last = v
+	}
+
+	// The path did not exist before its first version
+	if len(versions) > 0 && versions[len(versions)-1].Deleted {
+		versions = versions[:len(versions)-1]
+	}
+	return versions, nil
+}
+
+func (ft *FileTree) pathVersionsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			// A ref has no history
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "versions are only available for FS")
+			return
+		}
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		path := q.Get("path")
+		if path == "" || path[0] != '/' || path == "/" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "a path (starting with a `/`) is required")
+			return
+		}
+		limit, err := q.GetInt("limit", 50, 1000)
+		if err != nil {
+			panic(err)
+		}
+
+		switch r.Method {
+		case "GET":
+			versions, err := ft.PathVersions(ctx, fsName, prefixFmt, path, limit)
+			if err != nil {
+				panic(err)
+			}
+
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"path":     path,
+				"versions": versions,
+			})
+		case "POST":
+			// Restore a past version (the content is retrievable via `/api/filetree/file/{ref}`)
+			ref := q.Get("ref")
+			versions, err := ft.PathVersions(ctx, fsName, prefixFmt, path, -1)
+			if err != nil {
+				panic(err)
+			}
+			var found bool
+			for _, v := range versions {
+				if v.Ref == ref && !v.Deleted {
+					found = true
+					break
+				}
+			}
+			if !found {
+				httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("no version %q for path %q", ref, path))
+				return
+			}
+
+			old, err := ft.nodeByRef(ctx, ref)
+			if err != nil {
+				panic(err)
+			}
+
+			fs, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+			if err != nil {
+				panic(err)
+			}
+			node, _, created, err := fs.Path(ctx, path, 1, true, time.Now().Unix())
+			if err != nil {
+				panic(err)
+			}
+			if node.Hash == ref {
+				// Already the current version
+				httputil.MarshalAndWrite(r, w, node)
+				return
+			}
+
+			newNode, revision, err := ft.Update(ctx, &Snapshot{Message: fmt.Sprintf("Restore %s to %s", path, ref)}, node, old.Meta, prefixFmt, false)
+			if err != nil {
+				panic(err)
+			}
+
+			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+			evtType := "file-updated"
+			if created {
+				evtType = "file-created"
+			}
+			updateEvent := &FSUpdateEvent{
+				Name:      fs.Name,
+				Type:      evtType,
+				Ref:       newNode.Hash,
+				Path:      path[1:],
+				Time:      time.Now().UTC().Unix(),
+				SessionID: httputil.GetSessionID(r),
+			}
+			if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				panic(err)
+			}
+
+			httputil.MarshalAndWrite(r, w, newNode)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
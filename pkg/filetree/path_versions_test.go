@@ -0,0 +1,57 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestPathVersions(t *testing.T) {
+	env := testutil.New(t, "filetree_path_versions_test")
+	defer env.Close()
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	_, err := ft.CreateFS(ctx, "myfs", FSKeyFmt)
+	check(err)
+
+	refs := []string{}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+		check(err)
+		node, _, _, err := fs.Path(ctx, "/docs/file.txt", 1, true, time.Now().Unix())
+		check(err)
+		m, err := ft.NewUploader(ctx).PutReader("file.txt", bytes.NewReader([]byte(content)), nil)
+		check(err)
+		cctx := ctxutil.WithFileTreeMessage(ctxutil.WithFileTreeAuthor(ctx, "alice"), "update to "+content)
+		newNode, _, err := ft.Update(cctx, nil, node, m, FSKeyFmt, true)
+		check(err)
+		refs = append(refs, newNode.Hash)
+		// Versions are timestamped with a nanosecond resolution
+		time.Sleep(time.Millisecond)
+	}
+
+	versions, err := ft.PathVersions(ctx, "myfs", FSKeyFmt, "/docs/file.txt", -1)
+	check(err)
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d: %+v", len(versions), versions)
+	}
+	for i, v := range versions {
+		msg := "update to v" + strconv.Itoa(3-i)
+		if v.Ref != refs[len(refs)-1-i] || v.Size != 2 || v.Deleted || v.Author != "alice" || v.Message != msg {
+			t.Errorf("unexpected version %d: %+v", i, v)
+		}
+	}
+
+	versions, err = ft.PathVersions(ctx, "myfs", FSKeyFmt, "/docs/file.txt", 1)
+	check(err)
+	if len(versions) != 1 || versions[0].Ref != refs[2] {
+		t.Errorf("unexpected limited versions %+v", versions)
+	}
+}
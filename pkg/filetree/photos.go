@@ -0,0 +1,289 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/imginfo"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Layout of the photos index keys (the local time the photo was taken, as recorded by the camera), the `from`/`to`
+// bounds of the timeline queries can be any prefix of it
+const photoTimeLayout = "2006-01-02T15:04:05"
+
+var photoBoundLayouts = []string{"2006", "2006-01", "2006-01-02", photoTimeLayout}
+
+// ErrInvalidTimeBound is returned when the bounds of a photos query are not a prefix of "2006-01-02T15:04:05"
+var ErrInvalidTimeBound = errors.New("invalid time bound")
+
+// ErrInvalidCursor is returned when the cursor of a photos query is not one returned by a previous query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Photo holds the EXIF data of an image node of a FS
+type Photo struct {
+	Ref         string            `json:"ref"`
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	FS          string            `json:"fs"`
+	Path        string            `json:"path"`
+	ContentHash string            `json:"content_hash"`
+	TakenAt     string            `json:"taken_at"`
+	Exif        *imginfo.ExifInfo `json:"exif"`
+}
+
+// Layout of the photos index:
+//
+//	t:<taken at>\x00<namespace>\x00<fs>\x00<path>\x00<ref> => Photo JSON (sorted by taken time)
+//	p:<namespace>\x00<fs>\x00<path>                         => the "t:" key (for removing the stale entries)
+func photoFSPrefix(ns, fsName string) []byte {
+	return []byte("p:" + ns + "\x00" + fsName + "\x00")
+}
+
+func photoKey(p *Photo) []byte {
+	return []byte("t:" + p.TakenAt + "\x00" + p.Namespace + "\x00" + p.FS + "\x00" + p.Path + "\x00" + p.Ref)
+}
+
+// photosHubCallback queues the FS for (re)indexing its photos, the index is updated in the background by
+// `photosWorker`
+func (ft *FileTree) photosHubCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	evt := &FSUpdateEvent{}
+	if err := json.Unmarshal([]byte(data.(string)), evt); err != nil {
+		return err
+	}
+	ns, _ := ctxutil.Namespace(ctx)
+
+	ft.photosMu.Lock()
+	ft.photosPending[[2]string{ns, evt.Name}] = struct{}{}
+	ft.photosMu.Unlock()
+	select {
+	case ft.photosWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (ft *FileTree) photosWorker() {
+	log := ft.log.New("worker", "photos_worker")
+	for {
+		select {
+		case <-ft.stop:
+			return
+		case <-ft.photosWake:
+		}
+
+		ft.photosMu.Lock()
+		pending := ft.photosPending
+		ft.photosPending = map[[2]string]struct{}{}
+		ft.photosMu.Unlock()
+
+		for fs := range pending {
+			ctx := context.Background()
+			if fs[0] != "" {
+				ctx = ctxutil.WithNamespace(ctx, fs[0])
+			}
+			if err := ft.indexPhotos(ctx, fs[1]); err != nil {
+				log.Error("failed to index the photos", "namespace", fs[0], "fs", fs[1], "err", err)
+			}
+		}
+	}
+}
+
+// indexPhotos updates the photos index with the images of the FS that have a taken time in their EXIF data (stored
+// in the node metadata at upload time), the entries of the deleted/replaced files are removed
+func (ft *FileTree) indexPhotos(ctx context.Context, name string) error {
+	ns, _ := ctxutil.Namespace(ctx)
+	fs, err := ft.FS(ctx, name, FSKeyFmt, false, 0)
+	if err != nil {
+		return err
+	}
+
+	// Collect the current photos of the FS (keyed by path), only the node blobs are fetched
+	photos := map[string]*Photo{}
+	var walk func(string, string, bool) error
+	walk = func(ref, dir string, root bool) error {
+		data, err := ft.blobStore.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		n, err := rnode.NewNodeFromBlob(ref, data)
+		if err != nil {
+			return err
+		}
+		if !n.IsFile() {
+			p := dir
+			if !root {
+				p = path.Join(dir, n.Name)
+			}
+			for _, cref := range n.Refs {
+				if err := walk(cref.(string), p, false); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		exif, ok := imginfo.ExifFromMetadata(n.Metadata[rnode.ExifKey])
+		if !ok || exif.Datetime == "" {
+			return nil
+		}
+		takenAt, err := time.Parse(time.RFC3339, exif.Datetime)
+		if err != nil {
+			return nil
+		}
+		p := path.Join(dir, n.Name)
+		photos[p] = &Photo{
+			Ref:         n.Hash,
+			Name:        n.Name,
+			Namespace:   ns,
+			FS:          name,
+			Path:        p,
+			ContentHash: n.ContentHash,
+			TakenAt:     takenAt.Format(photoTimeLayout),
+			Exif:        exif,
+		}
+		return nil
+	}
+	if fs.Ref != "" {
+		if err := walk(fs.Ref, "/", true); err != nil {
+			return err
+		}
+	}
+
+	// Remove the stale entries, and keep the unchanged ones as is
+	b := rangedb.NewBatch()
+	prefix := photoFSPrefix(ns, name)
+	it := ft.photos.PrefixRange(prefix, false)
+	defer it.Close()
+	k, v, err := it.Next()
+	for ; err == nil; k, v, err = it.Next() {
+		p := string(k[len(prefix):])
+		if photo, ok := photos[p]; ok && bytes.Equal(v, photoKey(photo)) {
+			delete(photos, p)
+			continue
+		}
+		b.Delete(k)
+		b.Delete(v)
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	for p, photo := range photos {
+		js, err := json.Marshal(photo)
+		if err != nil {
+			return err
+		}
+		key := photoKey(photo)
+		b.Set(key, js)
+		b.Set(append(append([]byte{}, prefix...), p...), key)
+	}
+	return ft.photos.Write(b)
+}
+
+// Photos returns the indexed photos taken between `from` and `to` (both inclusive, any prefix of
+// "2006-01-02T15:04:05", e.g. "2019-01"), sorted by taken time, along with the cursor for fetching the next page.
+func (ft *FileTree) Photos(from, to, cursor string, limit int) ([]*Photo, string, error) {
+	for _, bound := range []string{from, to} {
+		if bound == "" {
+			continue
+		}
+		var valid bool
+		for _, layout := range photoBoundLayouts {
+			if _, err := time.Parse(layout, bound); err == nil {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, "", ErrInvalidTimeBound
+		}
+	}
+
+	start := []byte("t:" + from)
+	if cursor != "" {
+		k, err := hex.DecodeString(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		start = rangedb.NextKey(k)
+	}
+	end := []byte("t:\xff")
+	if to != "" {
+		end = []byte("t:" + to + "\xff")
+	}
+
+	photos := []*Photo{}
+	it := ft.photos.Range(start, end, false)
+	defer it.Close()
+	k, v, err := it.Next()
+	for ; err == nil && len(photos) < limit; k, v, err = it.Next() {
+		photo := &Photo{}
+		if err := json.Unmarshal(v, photo); err != nil {
+			return nil, "", err
+		}
+		photos = append(photos, photo)
+		cursor = hex.EncodeToString(k)
+	}
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	return photos, cursor, nil
+}
+
+func (ft *FileTree) photosHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.Node),
+			perms.Resource(perms.Filetree, perms.Node),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		limit, err := q.GetInt("limit", 50, 1000)
+		if err != nil {
+			panic(err)
+		}
+		photos, cursor, err := ft.Photos(q.Get("from"), q.Get("to"), q.Get("cursor"), limit)
+		switch err {
+		case nil:
+		case ErrInvalidTimeBound, ErrInvalidCursor:
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		default:
+			panic(fmt.Errorf("failed to query the photos: %v", err))
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": photos,
+			"pagination": map[string]interface{}{
+				"cursor":   cursor,
+				"has_more": len(photos) == limit,
+				"count":    len(photos),
+				"per_page": limit,
+			},
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package filetree
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/imginfo"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+// exifJPEG returns a JPEG image with an EXIF segment holding only the DateTime tag
+func exifJPEG(datetime string) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II*\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	// IFD0 with a single DateTime (ASCII) entry, the value follows the IFD
+	binary.Write(&tiff, binary.LittleEndian, uint16(1))
+	binary.Write(&tiff, binary.LittleEndian, []uint16{0x0132, 2})
+	binary.Write(&tiff, binary.LittleEndian, []uint32{20, 26})
+	binary.Write(&tiff, binary.LittleEndian, uint32(0))
+	tiff.WriteString(datetime + "\x00")
+
+	var img bytes.Buffer
+	check(jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil))
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2]) // SOI
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestPhotos(t *testing.T) {
+	env := testutil.New(t, "filetree_photos_test")
+	defer env.Close()
+	h, kvs := env.Hub, env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	mtime := time.Now()
+	archive := buildTar([]*tar.Header{
+		{Name: "./apr.jpg", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./sub/feb.jpg", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./sub/jan.jpg", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./noexif.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, map[string]string{
+		"./sub/jan.jpg": string(exifJPEG("2019:01:15 10:00:00")),
+		"./sub/feb.jpg": string(exifJPEG("2019:02:01 08:30:00")),
+		"./apr.jpg":     string(exifJPEG("2019:04:20 18:00:00")),
+		"./noexif.txt":  "hello",
+	})
+	res, err := ft.ImportTar(ctx, "_root", archive)
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), res.Ref, nil, -1)
+	check(err)
+
+	// The EXIF data is stored in the node metadata at upload time
+	fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	feb, _, _, err := fs.Path(ctx, "/sub/feb.jpg", 1, false, mtime.Unix())
+	check(err)
+	if exif, ok := imginfo.ExifFromMetadata(feb.Meta.Metadata[rnode.ExifKey]); !ok || exif.Datetime == "" {
+		t.Fatalf("missing EXIF metadata %+v", feb.Meta.Metadata)
+	}
+
+	check(ft.indexPhotos(ctx, "myfs"))
+
+	photos, _, err := ft.Photos("2019-01", "2019-03", "", 50)
+	check(err)
+	if len(photos) != 2 || photos[0].Path != "/sub/jan.jpg" || photos[1].TakenAt != "2019-02-01T08:30:00" || photos[1].FS != "myfs" {
+		t.Errorf("unexpected photos %+v", photos)
+	}
+
+	photos, cursor, err := ft.Photos("", "", "", 2)
+	check(err)
+	if len(photos) != 2 {
+		t.Fatalf("unexpected photos %+v", photos)
+	}
+	photos, _, err = ft.Photos("", "", cursor, 2)
+	check(err)
+	if len(photos) != 1 || photos[0].Name != "apr.jpg" {
+		t.Errorf("unexpected next page %+v", photos)
+	}
+
+	if _, _, err := ft.Photos("2019-13", "", "", 50); err != ErrInvalidTimeBound {
+		t.Errorf("expected ErrInvalidTimeBound, got %v", err)
+	}
+	if _, _, err := ft.Photos("", "", "nothex", 50); err != ErrInvalidCursor {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+
+	// The deleted photos are removed from the index in the background, once the FS update event is received
+	_, _, err = ft.Delete(ctx, nil, feb, FSKeyFmt, mtime.Unix())
+	check(err)
+	check(h.FiletreeFSUpdateEvent(ctx, nil, (&FSUpdateEvent{Name: "myfs", Type: "file-deleted"}).JSON()))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		photos, _, err = ft.Photos("", "", "", 50)
+		check(err)
+		if len(photos) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the deleted photo is still indexed %+v", photos)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if photos[0].Name != "jan.jpg" || photos[1].Name != "apr.jpg" {
+		t.Errorf("unexpected photos %+v", photos)
+	}
+}
@@ -0,0 +1,130 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"sync"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+// Number of children of each sub dir pre-warmed after a listing (the first page of the UI)
+var prewarmPageSize = 100
+
+// Max number of listings pre-warming their sub dirs at the same time (the others are skipped)
+const maxPrewarming = 4
+
+// Max number of prefetched node blobs kept in memory
+const nodeCacheSize = 4096
+
+func (ft *FileTree) prefetchWorkers() int {
+	if ft.conf.Filetree == nil {
+		return 0
+	}
+	return ft.conf.Filetree.PrefetchDirs
+}
+
+// nodeCacheKey returns the node cache key of the blob, scoped to the data context as the blobs of a namespace/stash
+// must not be visible from the others
+func nodeCacheKey(ctx context.Context, hash string) string {
+	ns, _ := ctxutil.Namespace(ctx)
+	stash, _ := ctxutil.StashName(ctx)
+	return stash + ":" + ns + ":" + hash
+}
+
+// nodeBlob returns the blob of the node, from the node cache if it has been prefetched
+func (ft *FileTree) nodeBlob(ctx context.Context, hash string) ([]byte, error) {
+	if cached, ok := ft.nodeCache.Get(nodeCacheKey(ctx, hash)); ok {
+		return cached.([]byte), nil
+	}
+	return ft.blobStore.Get(ctx, hash)
+}
+
+// prefetchNodes fetches the node blobs concurrently into the node cache, so listing a dir does not pay the latency of
+// each of its children sequentially (e.g. from a remote backend)
+func (ft *FileTree) prefetchNodes(ctx context.Context, refs []interface{}) {
+	workers := ft.prefetchWorkers()
+	if workers <= 0 || len(refs) < 2 {
+		return
+	}
+	if workers > len(refs) {
+		workers = len(refs)
+	}
+	refsc := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range refsc {
+				key := nodeCacheKey(ctx, ref)
+				if ft.nodeCache.Contains(key) {
+					continue
+				}
+				data, err := ft.blobStore.Get(ctx, ref)
+				if err != nil {
+					// The error will be returned by the actual fetch
+					continue
+				}
+				ft.nodeCache.Add(key, data)
+			}
+		}()
+	}
+L:
+	for _, ref := range refs {
+		select {
+		case refsc <- ref.(string):
+		case <-ctx.Done():
+			break L
+		}
+	}
+	close(refsc)
+	wg.Wait()
+}
+
+// prewarmSubdirs prefetches the first children of the listed sub dirs in the background, as they are likely to be
+// browsed next
+func (ft *FileTree) prewarmSubdirs(ctx context.Context, children []*Node) {
+	if ft.prefetchWorkers() <= 0 || ft.shedder.Shedding() {
+		return
+	}
+	refs := [][]interface{}{}
+	for _, c := range children {
+		if c.Type != rnode.Dir || len(c.Meta.Refs) == 0 {
+			continue
+		}
+		cr := c.Meta.Refs
+		if len(cr) > prewarmPageSize {
+			cr = cr[:prewarmPageSize]
+		}
+		refs = append(refs, cr)
+	}
+	if len(refs) == 0 {
+		return
+	}
+	select {
+	case ft.prewarming <- struct{}{}:
+	default:
+		return
+	}
+
+	// The request context is canceled once the listing is sent
+	bctx := context.Background()
+	if ns, ok := ctxutil.Namespace(ctx); ok {
+		bctx = ctxutil.WithNamespace(bctx, ns)
+	}
+	if stash, ok := ctxutil.StashName(ctx); ok {
+		bctx = ctxutil.WithStashName(bctx, stash)
+	}
+	go func() {
+		defer func() { <-ft.prewarming }()
+		for _, cr := range refs {
+			select {
+			case <-ft.stop:
+				return
+			default:
+			}
+			ft.prefetchNodes(bctx, cr)
+		}
+	}()
+}
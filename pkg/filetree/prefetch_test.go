@@ -0,0 +1,70 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestPrefetchDirs(t *testing.T) {
+	env := testutil.New(t, "filetree_prefetch_test")
+	defer env.Close()
+	dir := env.Dir
+	conf := &config.Config{
+		Filetree: &config.FiletreeConfig{PrefetchDirs: 4},
+	}
+	ft := newTestFileTree(t, env, conf)
+	defer ft.Close()
+
+	src := filepath.Join(dir, "src")
+	check(os.MkdirAll(filepath.Join(src, "sub"), 0700))
+	for i := 0; i < 4; i++ {
+		check(ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("file %d", i)), 0600))
+		check(ioutil.WriteFile(filepath.Join(src, "sub", fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("nested %d", i)), 0600))
+	}
+
+	ctx := context.Background()
+	root, err := ft.NewUploader(ctx).PutDir(src)
+	check(err)
+
+	n, err := ft.nodeByRef(ctx, root.Hash)
+	check(err)
+	check(ft.fetchDir(ctx, n, 1, 1))
+	if len(n.Children) != 5 {
+		t.Fatalf("unexpected children %+v", n.Children)
+	}
+	var sub *Node
+	for _, c := range n.Children {
+		if !ft.nodeCache.Contains(nodeCacheKey(ctx, c.Hash)) {
+			t.Errorf("child %s should have been prefetched", c.Name)
+		}
+		if c.Name == "sub" {
+			sub = c
+		}
+	}
+
+	// The children of the sub dir are pre-warmed in the background
+	ft.prewarmSubdirs(ctx, n.Children)
+	for _, ref := range sub.Meta.Refs {
+		key := nodeCacheKey(ctx, ref.(string))
+		for i := 0; i < 100 && !ft.nodeCache.Contains(key); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !ft.nodeCache.Contains(key) {
+			t.Errorf("sub dir child %s should have been pre-warmed", ref)
+		}
+	}
+
+	// The prefetched blobs are scoped to the namespace
+	if ft.nodeCache.Contains(nodeCacheKey(ctxutil.WithNamespace(ctx, "other"), sub.Hash)) {
+		t.Errorf("prefetched blobs should not be shared across namespaces")
+	}
+}
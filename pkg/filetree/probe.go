@@ -0,0 +1,199 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/imginfo"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/filetree/vidinfo"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ErrNotMedia is returned when probing a node that is neither an image nor a video
+var ErrNotMedia = errors.New("not an image or a video")
+
+// Probe extracts the media info (resolution, codec, duration) of an image/video node, and saves a new version of the
+// node with the info stored in its metadata (see `rnode.ProbeKey`), so it's included in the node JSON from now on. If
+// the node is part of a FS (i.e. loaded via `FS.Path`), the change is propagated up to the FS root.
+//
+// Unlike the webm worker (that probes the videos in the background before transcoding them), the probe is
+// performed right away.
+func (ft *FileTree) Probe(ctx context.Context, n *Node, prefixFmt string) (*Node, int64, error) {
+	if n.Type != "file" {
+		return nil, 0, ErrNotMedia
+	}
+
+	info := &Info{}
+	switch {
+	case vidinfo.IsVideo(n.Name):
+		// ffprobe needs an actual file
+		tmp, err := ioutil.TempFile("", "blobstash_probe_")
+		if err != nil {
+			return nil, 0, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := filereader.GetFile(ctx, ft.blobStore, n.Hash, tmp.Name()); err != nil {
+			return nil, 0, err
+		}
+		video, err := vidinfo.Parse(tmp.Name())
+		if err != nil {
+			return nil, 0, err
+		}
+		// Share the result with the webm worker (keyed by content hash, that the older nodes don't have)
+		if n.ContentHash != "" {
+			js, err := json.Marshal(video)
+			if err != nil {
+				return nil, 0, err
+			}
+			if err := ioutil.WriteFile(vidinfo.InfoPath(ft.conf, n.ContentHash), js, 0666); err != nil {
+				return nil, 0, err
+			}
+		}
+		info.Video = video
+	case imginfo.IsImage(n.Name):
+		f := filereader.NewFile(ctx, ft.blobStore, n.Meta, nil)
+		defer f.Close()
+		image, err := imginfo.Parse(f, strings.HasSuffix(strings.ToLower(n.Name), ".jpg"))
+		if err != nil {
+			return nil, 0, err
+		}
+		info.Image = image
+	default:
+		return nil, 0, ErrNotMedia
+	}
+
+	// Store the info as plain JSON values, like the metadata set by the clients
+	js, err := json.Marshal(info)
+	if err != nil {
+		return nil, 0, err
+	}
+	probe := map[string]interface{}{}
+	if err := json.Unmarshal(js, &probe); err != nil {
+		return nil, 0, err
+	}
+	newNode, revision, err := ft.UpdateMetadata(ctx, n, map[string]interface{}{rnode.ProbeKey: probe}, prefixFmt)
+	if err != nil {
+		return nil, 0, err
+	}
+	newNode.Info = info
+	return newNode, revision, nil
+}
+
+// probeHandler probes the node, if the FS (and the path) of the node are set (as query parameters), the probed node
+// replaces it in the FS
+func (ft *FileTree) probeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		vars := mux.Vars(r)
+		hash := vars["ref"]
+		q := r.URL.Query()
+		fsName := q.Get("fs")
+
+		if fsName == "" {
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.Node),
+				perms.ResourceWithID(perms.Filetree, perms.Node, hash),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+		} else if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
+
+		var n *Node
+		var err error
+		var fs *FS
+		p := filepath.Clean("/" + q.Get("path"))
+		if fsName == "" {
+			n, err = ft.nodeByRef(ctx, hash)
+		} else {
+			ctx = ctxutil.WithUsageNamespace(ctx, "filetree:"+fsName)
+			fs, err = ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+			if err != nil {
+				panic(err)
+			}
+			if fs.Ref == "" {
+				notFound(w)
+				return
+			}
+			n, _, _, err = fs.Path(ctx, p, 1, false, 0)
+		}
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			panic(err)
+		}
+		// The node must still be the one at the path
+		if n.Hash != hash {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		newNode, revision, err := ft.Probe(ctx, n, FSKeyFmt)
+		switch err {
+		case nil:
+		case ErrNotMedia:
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		default:
+			panic(err)
+		}
+
+		if fs != nil {
+			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+			updateEvent := &FSUpdateEvent{
+				Name:      fs.Name,
+				Type:      fmt.Sprintf("%s-patched", newNode.Type),
+				Ref:       newNode.Hash,
+				Path:      p[1:],
+				Time:      time.Now().UTC().Unix(),
+				SessionID: httputil.GetSessionID(r),
+			}
+			if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				panic(err)
+			}
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"node": newNode,
+		})
+	}
+}
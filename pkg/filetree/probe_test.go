@@ -0,0 +1,73 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestProbe(t *testing.T) {
+	env := testutil.New(t, "filetree_probe_test")
+	defer env.Close()
+	dir, kvs := env.Dir, env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	var buf bytes.Buffer
+	check(png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 32, 16))))
+	check(ioutil.WriteFile(filepath.Join(dir, "img.png"), buf.Bytes(), 0600))
+	check(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0600))
+
+	ctx := context.Background()
+	up := ft.NewUploader(ctx)
+	imgNode, err := up.PutFile(filepath.Join(dir, "img.png"))
+	check(err)
+	txtNode, err := up.PutFile(filepath.Join(dir, "notes.txt"))
+	check(err)
+
+	n, err := ft.nodeByRef(ctx, imgNode.Hash)
+	check(err)
+	probed, _, err := ft.Probe(ctx, n, FSKeyFmt)
+	check(err)
+	info := probed.Info
+	if info.Image == nil || info.Image.Width != 32 || info.Image.Height != 16 || info.Image.Format != "png" {
+		t.Errorf("unexpected info %+v", info.Image)
+	}
+
+	// The info is stored in the node metadata
+	stored, err := ft.nodeByRef(ctx, probed.Hash)
+	check(err)
+	probe, ok := stored.Data[rnode.ProbeKey].(map[string]interface{})
+	if !ok || probe["image"] == nil {
+		t.Errorf("unexpected node metadata %+v", stored.Data)
+	}
+
+	// The probed node replaces the one in the FS
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), imgNode.Hash, nil, -1)
+	check(err)
+	fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	root, _, _, err := fs.Path(ctx, "/", 1, false, 0)
+	check(err)
+	_, _, err = ft.Probe(ctx, root, FSKeyFmt)
+	check(err)
+	fs, err = ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	if fs.Ref == imgNode.Hash {
+		t.Errorf("the FS should point to the probed node")
+	}
+
+	n, err = ft.nodeByRef(ctx, txtNode.Hash)
+	check(err)
+	if _, _, err := ft.Probe(ctx, n, FSKeyFmt); err != ErrNotMedia {
+		t.Errorf("expected ErrNotMedia, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/retention"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// GCEligibleKeyFmt is the key holding the blobs only referenced by pruned versions (one version per prune run), they
+// are consumed by the stash GC (see `GCEligible`)
+var GCEligibleKeyFmt = "_filetree:gc_eligible:%s"
+
+// PruneResult holds the outcome of applying a retention policy to a FS
+type PruneResult struct {
+	Name            string  `json:"name"`
+	DryRun          bool    `json:"dry_run"`
+	Kept            []int64 `json:"kept"`
+	Pruned          []int64 `json:"pruned"`
+	Locked          int     `json:"locked"` // versions only kept because of the retention lock
+	GCEligibleBlobs int     `json:"gc_eligible_blobs"`
+	GCEligibleSize  int64   `json:"gc_eligible_size"`
+}
+
+// markTree adds all the blobs referenced by the tree at `ref` to `refs`, and skips the subtrees already present in
+// `refs` or in `skip` (nodes are content-addressed, so a known dir implies all its children are known too).
+func (ft *FileTree) markTree(ctx context.Context, ref string, refs, skip map[string]int64) error {
+	if _, ok := refs[ref]; ok {
+		return nil
+	}
+	if _, ok := skip[ref]; ok {
+		return nil
+	}
+	data, err := ft.blobStore.Get(ctx, ref)
+	if err != nil {
+		return err
+	}
+	refs[ref] = int64(len(data))
+
+	n, err := rnode.NewNodeFromBlob(ref, data)
+	if err != nil {
+		return err
+	}
+
+	if n.IsFile() {
+		// The index is the end offset of the chunk, the size can be computed without fetching the blob
+		var prev int64
+		for _, iv := range n.FileRefs() {
+			if _, ok := skip[iv.Value]; !ok {
+				refs[iv.Value] = iv.Index - prev
+			}
+			prev = iv.Index
+			// The base of a delta chunk must be kept along with the delta
+			if _, ok := skip[iv.Base]; iv.Base != "" && !ok {
+				if _, ok := refs[iv.Base]; !ok {
+					refs[iv.Base] = 0
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, cref := range n.Refs {
+		if err := ft.markTree(ctx, cref.(string), refs, skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune applies the retention policy to the FS versions, and returns the pruned versions, along with the blobs that
+// are only referenced by the pruned versions (and are now eligible for garbage collection).
+func (ft *FileTree) Prune(ctx context.Context, name string, policy *config.RetentionPolicy, dryRun bool) (*PruneResult, error) {
+	key := fmt.Sprintf(FSKeyFmt, name)
+	kvv, _, err := ft.kvStore.Versions(ctx, key, "0", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[int64]string{}
+	versions := []int64{}
+	for _, kv := range kvv.Versions {
+		refs[kv.Version] = kv.HexHash()
+		versions = append(versions, kv.Version)
+	}
+
+	now := time.Now()
+	keep, prune := retention.Select(versions, policy, now)
+
+	// The versions under the retention lock are kept no matter what the policy says
+	var locked int
+	if lock := ft.conf.FSRetentionLock(name); lock > 0 {
+		cutoff := now.Add(-lock).UnixNano()
+		unlocked := []int64{}
+		for _, v := range prune {
+			if v > cutoff {
+				keep = append(keep, v)
+				locked++
+				continue
+			}
+			unlocked = append(unlocked, v)
+		}
+		prune = unlocked
+		sort.Slice(keep, func(i, j int) bool { return keep[i] > keep[j] })
+	}
+
+	res := &PruneResult{
+		Name:   name,
+		DryRun: dryRun,
+		Kept:   keep,
+		Pruned: prune,
+		Locked: locked,
+	}
+	if len(prune) == 0 {
+		return res, nil
+	}
+
+	// Mark all the blobs still referenced by the kept versions
+	kept := map[string]int64{}
+	for _, v := range keep {
+		if err := ft.markTree(ctx, refs[v], kept, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The nodes in the trash are kept until they expire
+	trash, err := ft.Trash(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range trash {
+		if err := ft.markTree(ctx, entry.Ref, kept, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The blobs only referenced by the pruned versions
+	exclusive := map[string]int64{}
+	for _, v := range prune {
+		if err := ft.markTree(ctx, refs[v], exclusive, kept); err != nil {
+			return nil, err
+		}
+	}
+
+	eligible := []string{}
+	for ref, size := range exclusive {
+		eligible = append(eligible, ref)
+		res.GCEligibleSize += size
+	}
+	res.GCEligibleBlobs = len(eligible)
+
+	if dryRun {
+		return res, nil
+	}
+
+	if len(eligible) > 0 {
+		sort.Strings(eligible)
+		encoded, err := msgpack.Marshal(eligible)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ft.kvStore.Put(ctx, fmt.Sprintf(GCEligibleKeyFmt, name), "", encoded, -1); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range prune {
+		if err := ft.kvStore.DeleteVersion(ctx, key, v); err != nil && err != vkv.ErrNotFound {
+			return nil, err
+		}
+	}
+	if _, err := ft.PurgeTrash(ctx, name); err != nil {
+		return nil, err
+	}
+
+	ft.log.Info("FS pruned", "fs", name, "kept", len(keep), "pruned", len(prune), "gc_eligible_blobs", len(eligible))
+	return res, nil
+}
+
+// GCEligible returns the blobs marked GC-eligible by the prune runs of all the FS, the blobs referenced again by a FS
+// version saved after the prune run are not eligible anymore
+func (ft *FileTree) GCEligible(ctx context.Context) (map[string]struct{}, error) {
+	prefix := fmt.Sprintf(GCEligibleKeyFmt, "")
+	keys, _, err := ft.kvStore.Keys(ctx, prefix, prefix+"\xff", 0)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]struct{}{}
+	for _, kv := range keys {
+		runs, _, err := ft.kvStore.Versions(ctx, kv.Key, "0", -1)
+		if err != nil {
+			return nil, err
+		}
+		fsVersions := []*vkv.KeyValue{}
+		kvv, _, err := ft.kvStore.Versions(ctx, fmt.Sprintf(FSKeyFmt, strings.TrimPrefix(kv.Key, prefix)), "0", -1)
+		switch err {
+		case nil:
+			fsVersions = kvv.Versions
+		case vkv.ErrNotFound:
+		default:
+			return nil, err
+		}
+		for _, run := range runs.Versions {
+			refs := []string{}
+			if err := msgpack.Unmarshal(run.Data, &refs); err != nil {
+				return nil, err
+			}
+			newer := map[string]int64{}
+			for _, fv := range fsVersions {
+				if fv.Version > run.Version {
+					if err := ft.markTree(ctx, fv.HexHash(), newer, nil); err != nil {
+						return nil, err
+					}
+				}
+			}
+			for _, ref := range refs {
+				if _, ok := newer[ref]; !ok {
+					out[ref] = struct{}{}
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// retentionWorker periodically applies the retention policies defined in the config, and purges the expired trash
+// entries and embed cookie revocations
+func (ft *FileTree) retentionWorker(policies map[string]*config.RetentionPolicy) {
+	log := ft.log.New("worker", "retention_worker")
+	log.Debug("starting worker")
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-ft.stop:
+			log.Debug("worker stopped")
+			return
+		case <-t.C:
+			if ft.shedder.Shedding() {
+				log.Info("backend degraded, skipping the retention policies")
+				continue
+			}
+			for name, policy := range policies {
+				if _, err := ft.Prune(context.Background(), name, policy, false); err != nil && err != vkv.ErrNotFound {
+					log.Error("failed to prune FS", "fs", name, "err", err)
+				}
+			}
+			if ft.trashRetention() > 0 {
+				if err := ft.purgeAllTrashes(context.Background()); err != nil {
+					log.Error("failed to purge the trash", "err", err)
+				}
+			}
+			if _, err := ft.purgeEmbedRevocations(context.Background()); err != nil {
+				log.Error("failed to purge the embed cookie revocations", "err", err)
+			}
+		}
+	}
+}
+
+func (ft *FileTree) pruneHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			panic(httputil.NewPublicErrorFmt("only FS can be pruned"))
+		}
+
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.GC, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		dryRun, err := q.GetBoolDefault("dry_run", false)
+		if err != nil {
+			panic(err)
+		}
+
+		// Use the policy from the config, unless one is provided in the request body
+		var policy *config.RetentionPolicy
+		if ft.conf.Filetree != nil {
+			policy = ft.conf.Filetree.Retention[fsName]
+		}
+		if r.ContentLength > 0 {
+			policy = &config.RetentionPolicy{}
+			if err := httputil.Unmarshal(r, policy); err != nil {
+				panic(err)
+			}
+		}
+		if policy == nil {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("no retention policy for FS %q", fsName))
+			return
+		}
+
+		res, err := ft.Prune(ctx, fsName, policy, dryRun)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
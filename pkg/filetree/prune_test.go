@@ -0,0 +1,54 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestPruneGCEligible(t *testing.T) {
+	env := testutil.New(t, "filetree_prune_test")
+	defer env.Close()
+	kvs := env.KvStore
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	mtime := time.Now()
+	refs := []string{}
+	for i, content := range []string{"hello", "world"} {
+		archive := buildTar([]*tar.Header{
+			{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		}, map[string]string{"./a.txt": content})
+		res, err := ft.ImportTar(ctx, "_root", archive)
+		check(err)
+		_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), res.Ref, nil, int64(i+1))
+		check(err)
+		refs = append(refs, res.Ref)
+	}
+
+	res, err := ft.Prune(ctx, "myfs", &config.RetentionPolicy{KeepLast: 1}, false)
+	check(err)
+	if len(res.Pruned) != 1 || res.GCEligibleBlobs != 3 {
+		t.Fatalf("unexpected prune result %+v", res)
+	}
+	eligible, err := ft.GCEligible(ctx)
+	check(err)
+	if _, ok := eligible[refs[0]]; !ok || len(eligible) != 3 {
+		t.Errorf("the pruned root should be GC-eligible, got %v", eligible)
+	}
+
+	// The blobs referenced again by a newer version are not eligible anymore
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), refs[0], nil, -1)
+	check(err)
+	eligible, err = ft.GCEligible(ctx)
+	check(err)
+	if len(eligible) != 0 {
+		t.Errorf("expected no GC-eligible blobs, got %v", eligible)
+	}
+}
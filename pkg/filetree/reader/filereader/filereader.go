@@ -13,6 +13,8 @@ import (
 	"github.com/hashicorp/golang-lru"
 	"golang.org/x/crypto/blake2b"
 
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/delta"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
 )
 
@@ -83,9 +85,31 @@ func GetFile(ctx context.Context, bs BlobStore, hash, path string) error {
 type IndexValue struct {
 	Index int64
 	Value string
+	Base  string
 	I     int
 }
 
+// GetChunk fetches the chunk, chunks stored as delta are applied against their base chunk
+func GetChunk(ctx context.Context, bs BlobStore, ref, base string) ([]byte, error) {
+	data, err := bs.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if base == "" {
+		return data, nil
+	}
+	baseData, err := bs.Get(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	return delta.Patch(baseData, data)
+}
+
+// cacheKey returns the key of the chunk in the LRU cache (the same delta may apply to different bases)
+func (iv *IndexValue) cacheKey() string {
+	return iv.Value + iv.Base
+}
+
 // File implements io.Reader, and io.ReaderAt.
 // It fetch blobs on the fly.
 type File struct {
@@ -101,6 +125,13 @@ type File struct {
 
 	preloadOnce sync.Once
 
+	// Number of chunks fetched concurrently ahead of the current one (0 to fetch them sequentially)
+	readAhead int
+	mu        sync.Mutex
+	pending   map[int]*pendingChunk
+	current   *pendingChunk
+	currentI  int
+
 	lru *lru.Cache
 	ctx context.Context
 }
@@ -117,13 +148,39 @@ func NewFile(ctx context.Context, bs BlobStore, meta *node.RawNode, cache *lru.C
 	}
 	if fileRefs := meta.FileRefs(); fileRefs != nil {
 		for idx, riv := range fileRefs {
-			iv := &IndexValue{Index: riv.Index, Value: riv.Value, I: idx}
+			iv := &IndexValue{Index: riv.Index, Value: riv.Value, Base: riv.Base, I: idx}
 			f.lmrange = append(f.lmrange, iv)
 		}
 	}
 	return
 }
 
+// decryptingBlobStore decrypts the chunks of a client-side encrypted file
+type decryptingBlobStore struct {
+	bs  BlobStore
+	key *[32]byte
+}
+
+func (d *decryptingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	data, err := d.bs.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.OpenChunk(d.key, data)
+}
+
+// NewDecryptedFile creates a new File instance for a client-side encrypted file (unencrypted files are read as is)
+func NewDecryptedFile(ctx context.Context, bs BlobStore, meta *node.RawNode, master *[32]byte, cache *lru.Cache) (*File, error) {
+	if len(meta.EncryptedKey) == 0 {
+		return NewFile(ctx, bs, meta, cache), nil
+	}
+	key, err := crypto.UnwrapKey(master, meta.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the key of %q: %v", meta.Name, err)
+	}
+	return NewFile(ctx, &decryptingBlobStore{bs, key}, meta, cache), nil
+}
+
 // NewFileRemote creates a new File instance that will fetch chunks from the remote storage, and uses BlobStash as a indexer only
 func NewFileRemote(ctx context.Context, bs BlobStore, meta *node.RawNode, ivs []*node.IndexValue, cache *lru.Cache) (f *File) {
 	f = &File{
@@ -137,12 +194,115 @@ func NewFileRemote(ctx context.Context, bs BlobStore, meta *node.RawNode, ivs []
 	if ivs != nil {
 		for idx, riv := range ivs {
 			iv := &IndexValue{Index: riv.Index, Value: "remote://" + riv.Value, I: idx}
+			if riv.Base != "" {
+				iv.Base = "remote://" + riv.Base
+			}
 			f.lmrange = append(f.lmrange, iv)
 		}
 	}
 	return
 }
 
+// pendingChunk holds a chunk being fetched by the read-ahead
+type pendingChunk struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	data   []byte
+	err    error
+}
+
+// SetReadAhead enables fetching the next `n` chunks concurrently while reading, which improves the throughput when
+// streaming large files from a remote backend (0 disables it)
+func (f *File) SetReadAhead(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readAhead = n
+	f.cancelPending()
+	f.current = nil
+}
+
+// cancelPending cancels the in-flight read-ahead fetches (must be called with the lock held)
+func (f *File) cancelPending() {
+	for _, p := range f.pending {
+		p.cancel()
+	}
+	f.pending = map[int]*pendingChunk{}
+}
+
+// fetchChunk fetches the chunk (using the LRU cache if any)
+func (f *File) fetchChunk(ctx context.Context, iv *IndexValue) ([]byte, error) {
+	if f.lru != nil {
+		if cached, ok := f.lru.Get(iv.cacheKey()); ok {
+			return cached.([]byte), nil
+		}
+	}
+	data, err := GetChunk(ctx, f.bs, iv.Value, iv.Base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
+	}
+	if f.lru != nil {
+		f.lru.Add(iv.cacheKey(), data)
+	}
+	return data, nil
+}
+
+func (f *File) prefetch(iv *IndexValue) *pendingChunk {
+	ctx, cancel := context.WithCancel(f.ctx)
+	p := &pendingChunk{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(p.done)
+		defer cancel()
+		p.data, p.err = f.fetchChunk(ctx, iv)
+	}()
+	return p
+}
+
+// getChunk returns the chunk, and schedules the fetch of the next ones if the read-ahead is enabled
+func (f *File) getChunk(iv *IndexValue) ([]byte, error) {
+	f.mu.Lock()
+	if f.readAhead <= 0 {
+		f.mu.Unlock()
+		return f.fetchChunk(f.ctx, iv)
+	}
+
+	p := f.current
+	if p == nil || f.currentI != iv.I {
+		var ok bool
+		if p, ok = f.pending[iv.I]; ok {
+			delete(f.pending, iv.I)
+		} else {
+			p = f.prefetch(iv)
+		}
+		f.current = p
+		f.currentI = iv.I
+	}
+
+	// Forget the chunks outside of the window (after a seek), and schedule the next ones
+	for i, pc := range f.pending {
+		if i < iv.I || i > iv.I+f.readAhead {
+			pc.cancel()
+			delete(f.pending, i)
+		}
+	}
+	for i := iv.I + 1; i <= iv.I+f.readAhead && i < len(f.lmrange); i++ {
+		if _, ok := f.pending[i]; !ok {
+			f.pending[i] = f.prefetch(f.lmrange[i])
+		}
+	}
+	f.mu.Unlock()
+
+	<-p.done
+	if p.err != nil {
+		// Don't keep the failed fetch around so the next read retries it
+		f.mu.Lock()
+		if f.current == p {
+			f.current = nil
+		}
+		f.mu.Unlock()
+	}
+	return p.data, p.err
+}
+
 // PreloadChunks all the chunks in a goroutine
 func (f *File) PreloadChunks() {
 	f.preloadOnce.Do(func() {
@@ -165,12 +325,12 @@ func (f *File) PreloadChunks() {
 						break L
 					}
 					//bbuf, _, _ := f.client.Blobs.Get(iv.Value)
-					if _, ok := f.lru.Get(iv.Value); !ok {
-						bbuf, err := f.bs.Get(f.ctx, iv.Value)
+					if _, ok := f.lru.Get(iv.cacheKey()); !ok {
+						bbuf, err := GetChunk(f.ctx, f.bs, iv.Value, iv.Base)
 						if err != nil {
 							panic(fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err))
 						}
-						f.lru.Add(iv.Value, bbuf)
+						f.lru.Add(iv.cacheKey(), bbuf)
 					}
 					lastPreloaded = iv.I
 				}
@@ -179,8 +339,15 @@ func (f *File) PreloadChunks() {
 	})
 }
 
-// Close implements io.Closer
+// Close implements io.Closer (the in-flight read-ahead fetches are canceled)
 func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancelPending()
+	if f.current != nil {
+		f.current.cancel()
+		f.current = nil
+	}
 	return nil
 }
 
@@ -239,23 +406,9 @@ func (f *File) read(offset int64, cnt int) ([]byte, error) {
 		if iv.I > f.maxI {
 			f.maxI = iv.I
 		}
-		if f.lru != nil {
-			//bbuf, _, _ := f.client.Blobs.Get(iv.Value)
-			if cached, ok := f.lru.Get(iv.Value); ok {
-				cbuf = cached.([]byte)
-			} else {
-				bbuf, err := f.bs.Get(f.ctx, iv.Value)
-				if err != nil {
-					return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
-				}
-				f.lru.Add(iv.Value, bbuf)
-				cbuf = bbuf
-			}
-		} else {
-			cbuf, err = f.bs.Get(f.ctx, iv.Value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
-			}
+		cbuf, err = f.getChunk(iv)
+		if err != nil {
+			return nil, err
 		}
 		bbuf := cbuf
 		foffset := 0
@@ -333,8 +486,11 @@ func (f *File) Read(p []byte) (n int, err error) {
 	return
 }
 
-// Seek implements io.Seeker
+// Seek implements io.Seeker (the read-ahead fetches are canceled, the next read schedules them from the new offset)
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	f.cancelPending()
+	f.mu.Unlock()
 	switch whence {
 	case SEEK_SET:
 		f.offset = offset
@@ -0,0 +1,134 @@
+package filereader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+type memBlobStore map[string][]byte
+
+func (m memBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	if d, ok := m[hash]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("blob %s not found", hash)
+}
+
+// blockingBlobStore blocks the fetch of the chunks after the first one until the ctx is canceled
+type blockingBlobStore struct {
+	memBlobStore
+	first    string
+	mu       sync.Mutex
+	canceled int
+}
+
+func (b *blockingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	if hash == b.first {
+		return b.memBlobStore.Get(ctx, hash)
+	}
+	<-ctx.Done()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.canceled++
+	return nil, ctx.Err()
+}
+
+func (b *blockingBlobStore) canceledCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.canceled
+}
+
+// buildFile splits the data in chunks of `chunkSize` bytes
+func buildFile(bs memBlobStore, data []byte, chunkSize int) *node.RawNode {
+	meta := &node.RawNode{Name: "video.mp4", Type: node.File, Size: len(data)}
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := fmt.Sprintf("%x", blake2b.Sum256(data[i:end]))
+		bs[hash] = data[i:end]
+		meta.AddIndexedRef(end, hash)
+	}
+	return meta
+}
+
+func TestReadAhead(t *testing.T) {
+	bs := memBlobStore{}
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	meta := buildFile(bs, data, 1<<20)
+
+	f := NewFile(context.Background(), bs, meta, nil)
+	f.SetReadAhead(3)
+	// Small reads so the same chunk is read several times
+	out, err := ioutil.ReadAll(io.LimitReader(f, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("content mismatch")
+	}
+
+	// Seek backward, outside of the read-ahead window
+	if _, err := f.Seek(1000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[1000:1000+4096]) {
+		t.Errorf("content mismatch after seek")
+	}
+}
+
+func TestReadAheadCancel(t *testing.T) {
+	for _, tdata := range []struct {
+		name  string
+		close func(*File) error
+	}{
+		{"seek", func(f *File) error {
+			_, err := f.Seek(0, io.SeekStart)
+			return err
+		}},
+		{"close", func(f *File) error { return f.Close() }},
+	} {
+		mem := memBlobStore{}
+		data := make([]byte, 4<<10)
+		rand.New(rand.NewSource(1)).Read(data)
+		meta := buildFile(mem, data, 1<<10)
+		bs := &blockingBlobStore{memBlobStore: mem, first: meta.FileRefs()[0].Value}
+
+		f := NewFile(context.Background(), bs, meta, nil)
+		f.SetReadAhead(3)
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := tdata.close(f); err != nil {
+			t.Fatal(err)
+		}
+
+		// The 3 prefetch goroutines must return
+		deadline := time.Now().Add(5 * time.Second)
+		for bs.canceledCount() != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected 3 canceled fetches, got %d", tdata.name, bs.canceledCount())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
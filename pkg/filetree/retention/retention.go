@@ -0,0 +1,72 @@
+/*
+
+Package retention implements the selection of the FS versions to keep according to a retention policy.
+
+*/
+package retention // import "a4.io/blobstash/pkg/filetree/retention"
+
+import (
+	"sort"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+// bucket holds a time-based rule, versions formatted to the same key are competing for a single slot
+type bucket struct {
+	keep   int
+	format string
+	since  func(time.Time, int) time.Time
+}
+
+// Select returns the versions (nano timestamps) to keep and the ones to prune, both sorted from the most recent one.
+func Select(versions []int64, p *config.RetentionPolicy, now time.Time) ([]int64, []int64) {
+	sorted := make([]int64, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+
+	keep := []int64{}
+	prune := []int64{}
+	if len(sorted) == 0 {
+		return keep, prune
+	}
+
+	buckets := []*bucket{
+		&bucket{p.KeepHourly, "2006-01-02 15", func(t time.Time, n int) time.Time { return t.Add(-time.Duration(n) * time.Hour) }},
+		&bucket{p.KeepDaily, "2006-01-02", func(t time.Time, n int) time.Time { return t.AddDate(0, 0, -n) }},
+		&bucket{p.KeepMonthly, "2006-01", func(t time.Time, n int) time.Time { return t.AddDate(0, -n, 0) }},
+	}
+	seen := make([]map[string]struct{}, len(buckets))
+	for i := range buckets {
+		seen[i] = map[string]struct{}{}
+	}
+
+	for i, v := range sorted {
+		// Always keep the latest version
+		kept := i == 0 || (p.KeepLast < 0 || i < p.KeepLast)
+
+		t := time.Unix(0, v).UTC()
+		for bi, b := range buckets {
+			if b.keep == 0 {
+				continue
+			}
+			if b.keep > 0 && t.Before(b.since(now.UTC(), b.keep)) {
+				continue
+			}
+			// Versions are sorted, so the first version seen for a bucket is the most recent one
+			k := t.Format(b.format)
+			if _, ok := seen[bi][k]; !ok {
+				seen[bi][k] = struct{}{}
+				kept = true
+			}
+		}
+
+		if kept {
+			keep = append(keep, v)
+		} else {
+			prune = append(prune, v)
+		}
+	}
+
+	return keep, prune
+}
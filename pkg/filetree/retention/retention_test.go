@@ -0,0 +1,61 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestSelect(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 30, 0, 0, time.UTC)
+	ts := func(d time.Duration) int64 {
+		return now.Add(-d).UnixNano()
+	}
+
+	versions := []int64{
+		ts(10 * time.Minute),
+		ts(20 * time.Minute), // same hour as the previous one
+		ts(90 * time.Minute),
+		ts(26 * time.Hour),
+		ts(27 * time.Hour), // same day as the previous one
+		ts(40 * 24 * time.Hour),
+		ts(41 * 24 * time.Hour), // same month as the previous one
+		ts(400 * 24 * time.Hour),
+	}
+
+	for _, tdata := range []struct {
+		policy *config.RetentionPolicy
+		keep   []int64
+	}{
+		{
+			&config.RetentionPolicy{},
+			[]int64{versions[0]},
+		},
+		{
+			&config.RetentionPolicy{KeepLast: 3},
+			versions[0:3],
+		},
+		{
+			&config.RetentionPolicy{KeepHourly: 24},
+			[]int64{versions[0], versions[2]},
+		},
+		{
+			&config.RetentionPolicy{KeepHourly: 24, KeepDaily: 30, KeepMonthly: -1},
+			[]int64{versions[0], versions[2], versions[3], versions[5], versions[7]},
+		},
+		{
+			&config.RetentionPolicy{KeepLast: -1},
+			versions,
+		},
+	} {
+		keep, prune := Select(versions, tdata.policy, now)
+		if !reflect.DeepEqual(keep, tdata.keep) {
+			t.Errorf("policy %+v: expected keep=%v, got %v", tdata.policy, tdata.keep, keep)
+		}
+		if len(keep)+len(prune) != len(versions) {
+			t.Errorf("policy %+v: lost versions keep=%v prune=%v", tdata.policy, keep, prune)
+		}
+	}
+}
@@ -0,0 +1,1051 @@
+package filetree
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobsfile"
+	gcontext "github.com/gorilla/context"
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ssh"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Minimal SFTP (version 3, draft-ietf-secsh-filexfer-02) server exposing the FSes as top-level directories.
+//
+// Writes are buffered in a temporary file, and uploaded with the standard filetree writer when the handle is closed.
+//
+// The session runs with the identity used to log in, and each operation checks the same perms as the FS API.
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+
+	sftpStatus = 101
+	sftpHandle = 102
+	sftpData   = 103
+	sftpName   = 104
+	sftpAttrs  = 105
+)
+
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpMaxPacketSize = 1 << 18
+	sftpMaxReadSize   = 1 << 16
+	sftpReaddirBatch  = 128
+
+	// Max distance past the current end of file for a write, so a sparse write cannot fill the disk
+	sftpMaxWriteGap = 1 << 24
+)
+
+var (
+	errSFTPUnsupported = errors.New("operation unsupported")
+	errSFTPDenied      = errors.New("permission denied")
+	errSFTPExists      = errors.New("file already exists")
+	errSFTPBadHandle   = errors.New("invalid handle")
+)
+
+// sftpServer serves the SFTP subsystem over SSH
+type sftpServer struct {
+	ft       *FileTree
+	sshConf  *ssh.ServerConfig
+	listener net.Listener
+
+	// Serialize the FS mutations, as each of them updates the whole path up to the FS root
+	mu sync.Mutex
+
+	// Namespace served to the sessions (the root namespace if empty)
+	namespace string
+
+	// Auths of the logged in users (by SSH session ID), until their connection is set up
+	authsMu sync.Mutex
+	auths   map[string]*auth.Auth
+
+	closed bool
+	log    log.Logger
+}
+
+func (ft *FileTree) startSFTP(conf *config.SFTPConfig) (*sftpServer, error) {
+	if ft.authFunc == nil {
+		return nil, fmt.Errorf("the SFTP server requires at least one `auth` entry")
+	}
+	hostKeyPath := conf.HostKey
+	if hostKeyPath == "" {
+		hostKeyPath = filepath.Join(ft.conf.ConfigDir(), "sftp_host_key")
+	}
+	signer, err := loadSFTPHostKey(hostKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the SFTP host key: %v", err)
+	}
+
+	s := &sftpServer{
+		ft:        ft,
+		namespace: conf.Namespace,
+		auths:     map[string]*auth.Auth{},
+		log:       ft.log.New("worker", "sftp_server"),
+	}
+	s.sshConf = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			// Re-use the API basic auth check, so the same credentials work for both
+			req, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				return nil, err
+			}
+			req.SetBasicAuth(c.User(), string(password))
+			defer gcontext.Clear(req)
+			if !ft.authFunc(req) {
+				return nil, fmt.Errorf("invalid credentials for %q", c.User())
+			}
+			// Keep the identity for the perms checks of the session
+			if a, ok := auth.FromRequest(req); ok {
+				s.authsMu.Lock()
+				s.auths[string(c.SessionID())] = a
+				s.authsMu.Unlock()
+			}
+			return nil, nil
+		},
+	}
+	s.sshConf.AddHostKey(signer)
+
+	s.listener, err = net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("SFTP server listening", "addr", s.listener.Addr().String())
+	go s.serve()
+	return s, nil
+}
+
+func loadSFTPHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Close stops accepting new connections
+func (s *sftpServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+func (s *sftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			s.log.Error("failed to accept connection", "err", err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *sftpServer) handleConn(nConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.sshConf)
+	if err != nil {
+		s.log.Debug("SSH handshake failed", "remote_addr", nConn.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer conn.Close()
+	s.log.Info("new SSH connection", "user", conn.User(), "remote_addr", conn.RemoteAddr().String())
+	go ssh.DiscardRequests(reqs)
+
+	ctx := ctxutil.WithNamespace(context.Background(), s.namespace)
+	s.authsMu.Lock()
+	if a, ok := s.auths[string(conn.SessionID())]; ok {
+		ctx = ctxutil.WithAuth(ctx, a)
+		delete(s.auths, string(conn.SessionID()))
+	}
+	s.authsMu.Unlock()
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			s.log.Error("failed to accept channel", "err", err)
+			continue
+		}
+		go s.handleChannel(ctx, ch, requests)
+	}
+}
+
+func (s *sftpServer) handleChannel(ctx context.Context, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		// Only the "sftp" subsystem is supported (no shell/exec)
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			// A malformed request must only end its session, not the whole server
+			defer func() {
+				if r := recover(); r != nil {
+					s.log.Error("SFTP session panicked", "err", r, "stack", string(debug.Stack()))
+				}
+			}()
+			sess := &sftpSession{
+				srv:     s,
+				ctx:     ctx,
+				handles: map[string]interface{}{},
+			}
+			defer sess.closeHandles()
+			if err := sess.serve(ch); err != nil && err != io.EOF {
+				s.log.Error("SFTP session failed", "err", err)
+			}
+		}()
+	}
+}
+
+// sftpSession holds the state of a single SFTP subsystem
+type sftpSession struct {
+	srv     *sftpServer
+	ctx     context.Context
+	handles map[string]interface{}
+	next    uint64
+}
+
+type sftpDir struct {
+	entries []*sftpEntry
+}
+
+type sftpEntry struct {
+	name  string
+	attrs *sftpFileAttrs
+}
+
+type sftpReadFile struct {
+	f    *filereader.File
+	size int64
+}
+
+type sftpWriteFile struct {
+	fsName string
+	path   string
+	tmp    *os.File
+}
+
+type sftpFileAttrs struct {
+	size  uint64
+	mode  uint32
+	mtime int64
+}
+
+func (a *sftpFileAttrs) longname(name string) string {
+	mode := os.FileMode(a.mode & 0777)
+	if a.mode&0040000 != 0 {
+		mode |= os.ModeDir
+	}
+	return fmt.Sprintf("%s 1 blobstash blobstash %d %s %s", mode, a.size, time.Unix(a.mtime, 0).Format("Jan _2 15:04"), name)
+}
+
+func dirAttrs(mtime int64) *sftpFileAttrs {
+	return &sftpFileAttrs{mode: 0040000 | 0755, mtime: mtime}
+}
+
+func nodeAttrs(m *rnode.RawNode) *sftpFileAttrs {
+	perm := m.Mode & 0777
+	if m.Type == rnode.Dir {
+		if perm == 0 {
+			perm = 0755
+		}
+		return &sftpFileAttrs{mode: 0040000 | perm, mtime: m.ModTime}
+	}
+	if perm == 0 {
+		perm = 0644
+	}
+	return &sftpFileAttrs{size: uint64(m.Size), mode: 0100000 | perm, mtime: m.ModTime}
+}
+
+// splitSFTPPath returns the FS name and the path within the FS
+func splitSFTPPath(p string) (string, string) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", "/"
+	}
+	parts := strings.SplitN(p[1:], "/", 2)
+	if len(parts) == 1 {
+		return parts[0], "/"
+	}
+	return parts[0], "/" + parts[1]
+}
+
+// can returns errSFTPDenied if the session identity is not allowed to perform the action on the FS
+func (s *sftpSession) can(action perms.ActionType, fsName string) error {
+	a, ok := ctxutil.Auth(s.ctx)
+	if !ok {
+		// If there's no auth, it's not enabled
+		return nil
+	}
+	if !a.Can(perms.Action(action, perms.FS), perms.ResourceWithID(perms.Filetree, perms.FS, fsName)) {
+		return errSFTPDenied
+	}
+	return nil
+}
+
+func (s *sftpSession) fs(name string) (*FS, error) {
+	fs, err := s.srv.ft.FS(s.ctx, name, FSKeyFmt, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Ref == "" {
+		return nil, clientutil.ErrBlobNotFound
+	}
+	return fs, nil
+}
+
+// node returns the node at the given SFTP path, a nil node means the virtual root (listing the FSes)
+func (s *sftpSession) node(p string) (*FS, *Node, error) {
+	name, fsPath := splitSFTPPath(p)
+	if name == "" {
+		return nil, nil, nil
+	}
+	if err := s.can(perms.Read, name); err != nil {
+		return nil, nil, err
+	}
+	fs, err := s.fs(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	node, _, _, err := fs.Path(s.ctx, fsPath, 1, false, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs, node, nil
+}
+
+func (s *sftpSession) stat(p string) (*sftpFileAttrs, error) {
+	_, node, err := s.node(p)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return dirAttrs(0), nil
+	}
+	return nodeAttrs(node.Meta), nil
+}
+
+func (s *sftpSession) addHandle(h interface{}) string {
+	s.next++
+	id := strconv.FormatUint(s.next, 10)
+	s.handles[id] = h
+	return id
+}
+
+func (s *sftpSession) closeHandles() {
+	for id, h := range s.handles {
+		switch fh := h.(type) {
+		case *sftpReadFile:
+			fh.f.Close()
+		case *sftpWriteFile:
+			// The client disconnected without closing the handle, discard the partial upload
+			fh.tmp.Close()
+			os.Remove(fh.tmp.Name())
+		}
+		delete(s.handles, id)
+	}
+}
+
+func (s *sftpSession) serve(rw io.ReadWriter) error {
+	for {
+		typ, payload, err := readSFTPPacket(rw)
+		if err != nil {
+			return err
+		}
+		buf := &sftpBuf{b: payload}
+		if typ == sftpInit {
+			if _, err := rw.Write(newSFTPPacket(sftpVersion).uint32(3).bytes()); err != nil {
+				return err
+			}
+			continue
+		}
+		id := buf.uint32()
+		resp := s.handle(typ, id, buf)
+		if buf.err != nil {
+			resp = statusPacket(id, sftpBadMessage, buf.err.Error())
+		}
+		if _, err := rw.Write(resp.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpSession) handle(typ byte, id uint32, buf *sftpBuf) *sftpPacket {
+	switch typ {
+	case sftpRealpath:
+		p := path.Clean("/" + buf.string())
+		return newSFTPPacket(sftpName).uint32(id).uint32(1).string(p).string(p).attrs(nil)
+
+	case sftpStat, sftpLstat:
+		attrs, err := s.stat(buf.string())
+		if err != nil {
+			return errorPacket(id, err)
+		}
+		return newSFTPPacket(sftpAttrs).uint32(id).attrs(attrs)
+
+	case sftpFstat:
+		switch h := s.handles[buf.string()].(type) {
+		case *sftpReadFile:
+			return newSFTPPacket(sftpAttrs).uint32(id).attrs(&sftpFileAttrs{size: uint64(h.size), mode: 0100000 | 0644})
+		case *sftpWriteFile:
+			fi, err := h.tmp.Stat()
+			if err != nil {
+				return errorPacket(id, err)
+			}
+			return newSFTPPacket(sftpAttrs).uint32(id).attrs(&sftpFileAttrs{size: uint64(fi.Size()), mode: 0100000 | 0644})
+		default:
+			return errorPacket(id, errSFTPBadHandle)
+		}
+
+	case sftpSetstat, sftpFsetstat:
+		// Attributes (mode, times...) are managed by BlobStash, silently ignore them so `scp -p`/FileZilla don't fail
+		buf.string()
+		buf.attrs()
+		return statusPacket(id, sftpOK, "")
+
+	case sftpOpendir:
+		dir, err := s.opendir(buf.string())
+		if err != nil {
+			return errorPacket(id, err)
+		}
+		return newSFTPPacket(sftpHandle).uint32(id).string(s.addHandle(dir))
+
+	case sftpReaddir:
+		dir, ok := s.handles[buf.string()].(*sftpDir)
+		if !ok {
+			return errorPacket(id, errSFTPBadHandle)
+		}
+		if len(dir.entries) == 0 {
+			return statusPacket(id, sftpEOF, "")
+		}
+		batch := dir.entries
+		if len(batch) > sftpReaddirBatch {
+			batch = batch[:sftpReaddirBatch]
+		}
+		dir.entries = dir.entries[len(batch):]
+		resp := newSFTPPacket(sftpName).uint32(id).uint32(uint32(len(batch)))
+		for _, e := range batch {
+			resp.string(e.name).string(e.attrs.longname(e.name)).attrs(e.attrs)
+		}
+		return resp
+
+	case sftpOpen:
+		p := buf.string()
+		pflags := buf.uint32()
+		buf.attrs()
+		if buf.err != nil {
+			return nil
+		}
+		h, err := s.open(p, pflags)
+		if err != nil {
+			return errorPacket(id, err)
+		}
+		return newSFTPPacket(sftpHandle).uint32(id).string(s.addHandle(h))
+
+	case sftpRead:
+		hid := buf.string()
+		offset := int64(buf.uint64())
+		length := buf.uint32()
+		h, ok := s.handles[hid].(*sftpReadFile)
+		if !ok {
+			return errorPacket(id, errSFTPBadHandle)
+		}
+		if offset < 0 {
+			return statusPacket(id, sftpFailure, fmt.Sprintf("invalid offset %d", offset))
+		}
+		if offset >= h.size {
+			return statusPacket(id, sftpEOF, "")
+		}
+		if length > sftpMaxReadSize {
+			length = sftpMaxReadSize
+		}
+		if remaining := h.size - offset; int64(length) > remaining {
+			length = uint32(remaining)
+		}
+		data := make([]byte, length)
+		n, err := h.f.ReadAt(data, offset)
+		if err != nil && err != io.EOF {
+			return errorPacket(id, err)
+		}
+		return newSFTPPacket(sftpData).uint32(id).string(string(data[:n]))
+
+	case sftpWrite:
+		hid := buf.string()
+		offset := int64(buf.uint64())
+		data := buf.string()
+		h, ok := s.handles[hid].(*sftpWriteFile)
+		if !ok {
+			return errorPacket(id, errSFTPBadHandle)
+		}
+		fi, err := h.tmp.Stat()
+		if err != nil {
+			return errorPacket(id, err)
+		}
+		if offset < 0 || offset > fi.Size()+sftpMaxWriteGap {
+			return statusPacket(id, sftpFailure, fmt.Sprintf("offset %d too far past the end of file", offset))
+		}
+		if _, err := h.tmp.WriteAt([]byte(data), offset); err != nil {
+			return errorPacket(id, err)
+		}
+		return statusPacket(id, sftpOK, "")
+
+	case sftpClose:
+		hid := buf.string()
+		h, ok := s.handles[hid]
+		if !ok {
+			return errorPacket(id, errSFTPBadHandle)
+		}
+		delete(s.handles, hid)
+		switch fh := h.(type) {
+		case *sftpReadFile:
+			fh.f.Close()
+		case *sftpWriteFile:
+			if err := s.commit(fh); err != nil {
+				return errorPacket(id, err)
+			}
+		}
+		return statusPacket(id, sftpOK, "")
+
+	case sftpMkdir:
+		p := buf.string()
+		buf.attrs()
+		if buf.err != nil {
+			return nil
+		}
+		if err := s.mkdir(p); err != nil {
+			return errorPacket(id, err)
+		}
+		return statusPacket(id, sftpOK, "")
+
+	case sftpRemove, sftpRmdir:
+		if err := s.remove(buf.string(), typ == sftpRmdir); err != nil {
+			return errorPacket(id, err)
+		}
+		return statusPacket(id, sftpOK, "")
+
+	case sftpRename:
+		oldPath := buf.string()
+		newPath := buf.string()
+		if buf.err != nil {
+			return nil
+		}
+		if err := s.rename(oldPath, newPath); err != nil {
+			return errorPacket(id, err)
+		}
+		return statusPacket(id, sftpOK, "")
+
+	default:
+		// SYMLINK, READLINK, EXTENDED...
+		return statusPacket(id, sftpOpUnsupported, errSFTPUnsupported.Error())
+	}
+}
+
+func (s *sftpSession) opendir(p string) (*sftpDir, error) {
+	_, node, err := s.node(p)
+	if err != nil {
+		return nil, err
+	}
+	dir := &sftpDir{}
+	if node == nil {
+		fsInfos, err := s.srv.ft.IterFS(s.ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, fsInfo := range fsInfos {
+			// Only list the FSes the session can read
+			if s.can(perms.Read, fsInfo.Name) != nil {
+				continue
+			}
+			dir.entries = append(dir.entries, &sftpEntry{name: fsInfo.Name, attrs: dirAttrs(0)})
+		}
+		return dir, nil
+	}
+	if node.Type != rnode.Dir {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	for _, child := range node.Children {
+		dir.entries = append(dir.entries, &sftpEntry{name: child.Name, attrs: nodeAttrs(child.Meta)})
+	}
+	return dir, nil
+}
+
+func (s *sftpSession) open(p string, pflags uint32) (interface{}, error) {
+	fsName, fsPath := splitSFTPPath(p)
+	if pflags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreate|sftpFlagTrunc) == 0 {
+		_, node, err := s.node(p)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil || node.Type != rnode.File {
+			return nil, fmt.Errorf("%s is not a file", p)
+		}
+		return &sftpReadFile{
+			f:    filereader.NewFile(s.ctx, s.srv.ft.blobStore, node.Meta, nil),
+			size: int64(node.Meta.Size),
+		}, nil
+	}
+
+	// Only files within a FS can be written
+	if fsName == "" || fsPath == "/" {
+		return nil, errSFTPDenied
+	}
+	if err := s.can(perms.Write, fsName); err != nil {
+		return nil, err
+	}
+	fs, err := s.fs(fsName)
+	if err != nil {
+		return nil, err
+	}
+	// The parent directory must exist
+	parent, _, _, err := fs.Path(s.ctx, path.Dir(fsPath), 1, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Type != rnode.Dir {
+		return nil, fmt.Errorf("%s is not a directory", path.Dir(p))
+	}
+	var existing *Node
+	for _, child := range parent.Children {
+		if child.Name == path.Base(fsPath) {
+			existing = child
+			break
+		}
+	}
+	switch {
+	case existing == nil && pflags&sftpFlagCreate == 0:
+		return nil, clientutil.ErrBlobNotFound
+	case existing != nil && pflags&sftpFlagExcl != 0:
+		return nil, errSFTPExists
+	case existing != nil && existing.Type != rnode.File:
+		return nil, fmt.Errorf("%s is not a file", p)
+	}
+
+	tmp, err := ioutil.TempFile("", "blobstash_sftp_")
+	if err != nil {
+		return nil, err
+	}
+	// Start from the current content for partial writes (resumed uploads, appends)
+	if existing != nil && pflags&sftpFlagTrunc == 0 {
+		f := filereader.NewFile(s.ctx, s.srv.ft.blobStore, existing.Meta, nil)
+		defer f.Close()
+		if _, err := io.Copy(tmp, f); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return &sftpWriteFile{fsName: fsName, path: fsPath, tmp: tmp}, nil
+}
+
+// commit uploads the written file and adds it to the FS
+func (s *sftpSession) commit(h *sftpWriteFile) error {
+	defer os.Remove(h.tmp.Name())
+	defer h.tmp.Close()
+	if _, err := h.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+
+	fs, err := s.fs(h.fsName)
+	if err != nil {
+		return err
+	}
+	mtime := time.Now().Unix()
+	node, _, created, err := fs.Path(s.ctx, h.path, 1, true, mtime)
+	if err != nil {
+		return err
+	}
+	if node.Type != rnode.File {
+		return fmt.Errorf("%s is not a file", h.path)
+	}
+
+	var prev *Node
+	if !created {
+		prev = node
+	}
+	uploader := s.srv.ft.NewDeltaUploader(s.ctx, prev)
+	meta, err := uploader.PutReader(path.Base(h.path), h.tmp, nil)
+	if err != nil {
+		return err
+	}
+	meta.ModTime = mtime
+
+	newNode, _, err := s.srv.ft.Update(s.ctx, nil, node, meta, FSKeyFmt, true)
+	if err != nil {
+		return err
+	}
+
+	evtType := "file-updated"
+	if created {
+		evtType = "file-created"
+	}
+	return s.event(fs.Name, evtType, newNode.Hash, h.path)
+}
+
+func (s *sftpSession) mkdir(p string) error {
+	fsName, fsPath := splitSFTPPath(p)
+	if fsName == "" {
+		return errSFTPExists
+	}
+	if err := s.can(perms.Write, fsName); err != nil {
+		return err
+	}
+
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+
+	// Creating a top-level directory creates a new FS
+	if fsPath == "/" {
+		if _, err := s.fs(fsName); err == nil {
+			return errSFTPExists
+		}
+		_, err := s.srv.ft.CreateFS(s.ctx, fsName, FSKeyFmt)
+		return err
+	}
+
+	fs, err := s.fs(fsName)
+	if err != nil {
+		return err
+	}
+	parent, _, _, err := fs.Path(s.ctx, path.Dir(fsPath), 1, false, 0)
+	if err != nil {
+		return err
+	}
+	if parent.Type != rnode.Dir {
+		return fmt.Errorf("%s is not a directory", path.Dir(p))
+	}
+	for _, child := range parent.Children {
+		if child.Name == path.Base(fsPath) {
+			return errSFTPExists
+		}
+	}
+	mtime := time.Now().Unix()
+	newChild := &rnode.RawNode{
+		Version: rnode.V1,
+		Type:    rnode.Dir,
+		Name:    path.Base(fsPath),
+		ModTime: mtime,
+		Mode:    uint32(0755),
+	}
+	if _, _, err := s.srv.ft.AddChild(s.ctx, nil, parent, newChild, FSKeyFmt, mtime); err != nil {
+		return err
+	}
+	return s.event(fs.Name, "dir-patched", newChild.Hash, fsPath)
+}
+
+func (s *sftpSession) remove(p string, dir bool) error {
+	fsName, fsPath := splitSFTPPath(p)
+	// Deleting a whole FS is not supported
+	if fsPath == "/" {
+		return errSFTPDenied
+	}
+	if err := s.can(perms.Delete, fsName); err != nil {
+		return err
+	}
+
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+
+	fs, node, err := s.node(p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dir && node.Type != rnode.Dir:
+		return fmt.Errorf("%s is not a directory", p)
+	case dir && len(node.Children) > 0:
+		return fmt.Errorf("%s is not empty", p)
+	case !dir && node.Type == rnode.Dir:
+		return fmt.Errorf("%s is a directory", p)
+	}
+	if _, _, err := s.srv.ft.deleteToTrash(s.ctx, fs.Name, node, fsPath, FSKeyFmt, time.Now().Unix()); err != nil {
+		return err
+	}
+	return s.event(fs.Name, fmt.Sprintf("%s-deleted", node.Type), node.Hash, fsPath)
+}
+
+func (s *sftpSession) rename(oldPath, newPath string) error {
+	oldFS, oldFSPath := splitSFTPPath(oldPath)
+	newFS, newFSPath := splitSFTPPath(newPath)
+	if oldFSPath == "/" || newFSPath == "/" {
+		return errSFTPDenied
+	}
+	if oldFS != newFS {
+		return errSFTPUnsupported
+	}
+	if err := s.can(perms.Write, oldFS); err != nil {
+		return err
+	}
+
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+
+	fs, err := s.fs(oldFS)
+	if err != nil {
+		return err
+	}
+	// Unlike the move API, the parent directory must exist
+	parent, _, _, err := fs.Path(s.ctx, path.Dir(newFSPath), 1, false, 0)
+	if err != nil {
+		return err
+	}
+	if parent.Type != rnode.Dir {
+		return fmt.Errorf("%s is not a directory", path.Dir(newPath))
+	}
+	// The node is added at the new path and removed from the old one in a single FS version
+	node, _, err := s.srv.ft.Move(s.ctx, fs, oldFSPath, newFSPath, false, FSKeyFmt, time.Now().Unix())
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPathNotFound):
+		return clientutil.ErrBlobNotFound
+	case errors.Is(err, ErrPathExists):
+		return errSFTPExists
+	default:
+		return err
+	}
+	return s.event(fs.Name, fmt.Sprintf("%s-moved", node.Type), node.Hash, newFSPath)
+}
+
+func (s *sftpSession) event(fsName, evtType, ref, fsPath string) error {
+	updateEvent := &FSUpdateEvent{
+		Name: fsName,
+		Type: evtType,
+		Ref:  ref,
+		Path: fsPath[1:],
+		Time: time.Now().UTC().Unix(),
+	}
+	return s.srv.ft.hub.FiletreeFSUpdateEvent(s.ctx, nil, updateEvent.JSON())
+}
+
+func errorPacket(id uint32, err error) *sftpPacket {
+	switch err {
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		return statusPacket(id, sftpNoSuchFile, "no such file")
+	case errSFTPDenied, ErrRetentionLocked:
+		return statusPacket(id, sftpPermissionDenied, err.Error())
+	case errSFTPUnsupported:
+		return statusPacket(id, sftpOpUnsupported, err.Error())
+	default:
+		return statusPacket(id, sftpFailure, err.Error())
+	}
+}
+
+func statusPacket(id, code uint32, msg string) *sftpPacket {
+	return newSFTPPacket(sftpStatus).uint32(id).uint32(code).string(msg).string("")
+}
+
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size == 0 || size > sftpMaxPacketSize {
+		return 0, nil, fmt.Errorf("invalid packet size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+// sftpBuf decodes a packet payload, the first error is kept and the subsequent reads return zero values
+type sftpBuf struct {
+	b   []byte
+	err error
+}
+
+func (b *sftpBuf) next(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if len(b.b) < n {
+		b.err = errors.New("short packet")
+		return nil
+	}
+	out := b.b[:n]
+	b.b = b.b[n:]
+	return out
+}
+
+func (b *sftpBuf) uint32() uint32 {
+	if data := b.next(4); data != nil {
+		return binary.BigEndian.Uint32(data)
+	}
+	return 0
+}
+
+func (b *sftpBuf) uint64() uint64 {
+	if data := b.next(8); data != nil {
+		return binary.BigEndian.Uint64(data)
+	}
+	return 0
+}
+
+func (b *sftpBuf) string() string {
+	return string(b.next(int(b.uint32())))
+}
+
+// attrs skips the attributes (they're ignored)
+func (b *sftpBuf) attrs() {
+	flags := b.uint32()
+	if flags&sftpAttrSize != 0 {
+		b.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		b.uint32()
+		b.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		b.uint32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		b.uint32()
+		b.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		count := b.uint32()
+		for i := uint32(0); i < count && b.err == nil; i++ {
+			b.string()
+			b.string()
+		}
+	}
+}
+
+// sftpPacket encodes a packet
+type sftpPacket struct {
+	b []byte
+}
+
+func newSFTPPacket(typ byte) *sftpPacket {
+	return &sftpPacket{b: []byte{0, 0, 0, 0, typ}}
+}
+
+func (p *sftpPacket) uint32(v uint32) *sftpPacket {
+	p.b = append(p.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	return p
+}
+
+func (p *sftpPacket) uint64(v uint64) *sftpPacket {
+	return p.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+
+func (p *sftpPacket) string(s string) *sftpPacket {
+	p.uint32(uint32(len(s)))
+	p.b = append(p.b, s...)
+	return p
+}
+
+func (p *sftpPacket) attrs(a *sftpFileAttrs) *sftpPacket {
+	if a == nil {
+		return p.uint32(0)
+	}
+	return p.uint32(sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime).
+		uint64(a.size).
+		uint32(a.mode).
+		uint32(uint32(a.mtime)).
+		uint32(uint32(a.mtime))
+}
+
+func (p *sftpPacket) bytes() []byte {
+	binary.BigEndian.PutUint32(p.b, uint32(len(p.b)-4))
+	return p.b
+}
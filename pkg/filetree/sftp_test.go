@@ -0,0 +1,199 @@
+package filetree
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+type sftpTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint32
+}
+
+func (c *sftpTestClient) do(typ byte, p *sftpPacket) (byte, *sftpBuf) {
+	c.id++
+	req := newSFTPPacket(typ).uint32(c.id)
+	req.b = append(req.b, p.b[5:]...)
+	_, err := c.conn.Write(req.bytes())
+	check(err)
+	rtyp, payload, err := readSFTPPacket(c.conn)
+	check(err)
+	buf := &sftpBuf{b: payload}
+	if id := buf.uint32(); id != c.id {
+		c.t.Fatalf("bad response id %d, expected %d", id, c.id)
+	}
+	return rtyp, buf
+}
+
+func (c *sftpTestClient) expectStatus(typ byte, p *sftpPacket, code uint32) {
+	rtyp, buf := c.do(typ, p)
+	if rtyp != sftpStatus {
+		c.t.Fatalf("expected a status, got %d", rtyp)
+	}
+	if got := buf.uint32(); got != code {
+		c.t.Fatalf("expected status %d, got %d (%s)", code, got, buf.string())
+	}
+}
+
+func (c *sftpTestClient) handle(typ byte, p *sftpPacket) string {
+	rtyp, buf := c.do(typ, p)
+	if rtyp != sftpHandle {
+		c.t.Fatalf("expected a handle, got %d", rtyp)
+	}
+	return buf.string()
+}
+
+// newSFTPTestClient starts a session with the given context, and sends the init packet
+func newSFTPTestClient(t *testing.T, ft *FileTree, ctx context.Context) *sftpTestClient {
+	srvConn, conn := net.Pipe()
+	sess := &sftpSession{srv: &sftpServer{ft: ft, log: ft.log}, ctx: ctx, handles: map[string]interface{}{}}
+	go sess.serve(srvConn)
+
+	_, err := conn.Write(newSFTPPacket(sftpInit).uint32(3).bytes())
+	check(err)
+	typ, _, err := readSFTPPacket(conn)
+	check(err)
+	if typ != sftpVersion {
+		t.Fatalf("expected version packet, got %d", typ)
+	}
+	return &sftpTestClient{t: t, conn: conn}
+}
+
+func TestSFTPSession(t *testing.T) {
+	env := testutil.New(t, "filetree_sftp_test")
+	defer env.Close()
+	conf := &config.Config{Filetree: &config.FiletreeConfig{TrashRetention: 3600}}
+	ft := newTestFileTree(t, env, conf)
+	defer ft.Close()
+
+	c := newSFTPTestClient(t, ft, context.Background())
+	defer c.conn.Close()
+	c.expectStatus(sftpMkdir, newSFTPPacket(0).string("/myfs").uint32(0), sftpOK)
+	c.expectStatus(sftpMkdir, newSFTPPacket(0).string("/myfs/sub").uint32(0), sftpOK)
+	// Writing outside an existing directory must fail
+	c.expectStatus(sftpOpen, newSFTPPacket(0).string("/myfs/nope/hello.txt").uint32(sftpFlagWrite|sftpFlagCreate).uint32(0), sftpNoSuchFile)
+
+	hid := c.handle(sftpOpen, newSFTPPacket(0).string("/myfs/sub/hello.txt").uint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc).uint32(0))
+	c.expectStatus(sftpWrite, newSFTPPacket(0).string(hid).uint64(0).string("hello "), sftpOK)
+	c.expectStatus(sftpWrite, newSFTPPacket(0).string(hid).uint64(6).string("world"), sftpOK)
+	// A write far past the end of file must fail
+	c.expectStatus(sftpWrite, newSFTPPacket(0).string(hid).uint64(1<<40).string("!"), sftpFailure)
+	c.expectStatus(sftpClose, newSFTPPacket(0).string(hid), sftpOK)
+
+	rtyp, buf := c.do(sftpStat, newSFTPPacket(0).string("/myfs/sub/hello.txt"))
+	if rtyp != sftpAttrs {
+		t.Fatalf("expected attrs, got %d", rtyp)
+	}
+	buf.uint32()
+	if size := buf.uint64(); size != 11 {
+		t.Errorf("expected size 11, got %d", size)
+	}
+
+	hid = c.handle(sftpOpen, newSFTPPacket(0).string("/myfs/sub/hello.txt").uint32(sftpFlagRead).uint32(0))
+	rtyp, buf = c.do(sftpRead, newSFTPPacket(0).string(hid).uint64(0).uint32(1024))
+	if rtyp != sftpData {
+		t.Fatalf("expected data, got %d", rtyp)
+	}
+	if data := buf.string(); data != "hello world" {
+		t.Errorf("unexpected content %q", data)
+	}
+	c.expectStatus(sftpRead, newSFTPPacket(0).string(hid).uint64(11).uint32(1024), sftpEOF)
+	// A negative offset is rejected
+	c.expectStatus(sftpRead, newSFTPPacket(0).string(hid).uint64(1<<63).uint32(1024), sftpFailure)
+	c.expectStatus(sftpClose, newSFTPPacket(0).string(hid), sftpOK)
+
+	c.expectStatus(sftpRename, newSFTPPacket(0).string("/myfs/sub/hello.txt").string("/myfs/hello2.txt"), sftpOK)
+	c.expectStatus(sftpStat, newSFTPPacket(0).string("/myfs/sub/hello.txt"), sftpNoSuchFile)
+
+	hid = c.handle(sftpOpendir, newSFTPPacket(0).string("/myfs"))
+	rtyp, buf = c.do(sftpReaddir, newSFTPPacket(0).string(hid))
+	if rtyp != sftpName {
+		t.Fatalf("expected names, got %d", rtyp)
+	}
+	if count := buf.uint32(); count != 2 {
+		t.Fatalf("expected 2 entries, got %d", count)
+	}
+	names := []string{}
+	for i := 0; i < 2; i++ {
+		names = append(names, buf.string())
+		buf.string()
+		buf.attrs()
+	}
+	if names[0] != "hello2.txt" || names[1] != "sub" {
+		t.Errorf("unexpected entries %v", names)
+	}
+	c.expectStatus(sftpReaddir, newSFTPPacket(0).string(hid), sftpEOF)
+	c.expectStatus(sftpClose, newSFTPPacket(0).string(hid), sftpOK)
+
+	c.expectStatus(sftpRmdir, newSFTPPacket(0).string("/myfs/sub"), sftpOK)
+	c.expectStatus(sftpRemove, newSFTPPacket(0).string("/myfs/hello2.txt"), sftpOK)
+	c.expectStatus(sftpStat, newSFTPPacket(0).string("/myfs/hello2.txt"), sftpNoSuchFile)
+
+	// The removed nodes go to the trash
+	entries, err := ft.Trash(context.Background(), "myfs")
+	check(err)
+	if len(entries) != 2 || entries[0].Path != "/hello2.txt" || entries[1].Path != "/sub" {
+		t.Errorf("unexpected trash %+v", entries)
+	}
+}
+
+func TestSFTPSessionPerms(t *testing.T) {
+	env := testutil.New(t, "filetree_sftp_test")
+	defer env.Close()
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	admin := newSFTPTestClient(t, ft, context.Background())
+	defer admin.conn.Close()
+	admin.expectStatus(sftpMkdir, newSFTPPacket(0).string("/public").uint32(0), sftpOK)
+	admin.expectStatus(sftpMkdir, newSFTPPacket(0).string("/public/sub").uint32(0), sftpOK)
+	admin.expectStatus(sftpMkdir, newSFTPPacket(0).string("/private").uint32(0), sftpOK)
+
+	check(perms.SetupRole(&config.Role{
+		Name: "sftp-test-read-public",
+		Perms: []*config.Perm{&config.Perm{
+			Action:   perms.Action(perms.Read, perms.FS),
+			Resource: perms.ResourceWithID(perms.Filetree, perms.FS, "public"),
+		}},
+	}))
+	a, err := auth.NewAuth("reader", []string{"sftp-test-read-public"})
+	check(err)
+	c := newSFTPTestClient(t, ft, ctxutil.WithAuth(context.Background(), a))
+	defer c.conn.Close()
+
+	if rtyp, _ := c.do(sftpStat, newSFTPPacket(0).string("/public/sub")); rtyp != sftpAttrs {
+		t.Fatalf("expected attrs, got %d", rtyp)
+	}
+	c.expectStatus(sftpStat, newSFTPPacket(0).string("/private"), sftpPermissionDenied)
+	c.expectStatus(sftpMkdir, newSFTPPacket(0).string("/public/new").uint32(0), sftpPermissionDenied)
+	c.expectStatus(sftpOpen, newSFTPPacket(0).string("/public/hello.txt").uint32(sftpFlagWrite|sftpFlagCreate).uint32(0), sftpPermissionDenied)
+	c.expectStatus(sftpRmdir, newSFTPPacket(0).string("/public/sub"), sftpPermissionDenied)
+	c.expectStatus(sftpRename, newSFTPPacket(0).string("/public/sub").string("/public/sub2"), sftpPermissionDenied)
+
+	// Only the readable FSes are listed
+	hid := c.handle(sftpOpendir, newSFTPPacket(0).string("/"))
+	rtyp, buf := c.do(sftpReaddir, newSFTPPacket(0).string(hid))
+	if rtyp != sftpName {
+		t.Fatalf("expected names, got %d", rtyp)
+	}
+	if count := buf.uint32(); count != 1 {
+		t.Fatalf("expected 1 entry, got %d", count)
+	}
+	if name := buf.string(); name != "public" {
+		t.Errorf("unexpected entry %q", name)
+	}
+}
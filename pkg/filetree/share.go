@@ -0,0 +1,397 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ShareKeyFmt is the key holding a sharing link (always stored in the root namespace, as the public endpoint is not
+// namespaced)
+var ShareKeyFmt = "_filetree:share:%s"
+
+var (
+	errInvalidShareToken = errors.New("invalid share token")
+	errShareExpired      = errors.New("share expired")
+)
+
+// sharesMu protects the downloads counters
+var sharesMu sync.Mutex
+
+// Share holds a public sharing link for a file/dir node
+type Share struct {
+	ID           string `json:"id" msgpack:"id"`
+	Ref          string `json:"ref" msgpack:"r"`
+	Namespace    string `json:"namespace,omitempty" msgpack:"ns,omitempty"`
+	CreatedAt    int64  `json:"created_at" msgpack:"c"`
+	ExpiresAt    int64  `json:"expires_at,omitempty" msgpack:"e,omitempty"`
+	MaxDownloads int    `json:"max_downloads,omitempty" msgpack:"md,omitempty"`
+	Downloads    int    `json:"downloads" msgpack:"d"` // Loaded from the downloads index
+
+	// Only set when the share is created
+	Token string `json:"token,omitempty" msgpack:"-"`
+	URL   string `json:"url,omitempty" msgpack:"-"`
+}
+
+// Expired returns true if the link cannot be used anymore
+func (s *Share) Expired(now time.Time) bool {
+	if s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt {
+		return true
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return true
+	}
+	return false
+}
+
+// shareRequest is the payload for creating a new sharing link
+type shareRequest struct {
+	Ref          string `json:"ref" msgpack:"ref"`
+	TTL          string `json:"ttl,omitempty" msgpack:"ttl,omitempty"` // Parsed with `time.ParseDuration`
+	MaxDownloads int    `json:"max_downloads,omitempty" msgpack:"max_downloads,omitempty"`
+}
+
+// shareSig returns the signature of the share ID
+func (ft *FileTree) shareSig(id string) string {
+	mac := hmac.New(sha256.New, []byte(ft.conf.SharingKey))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareIDFromToken checks the token signature and returns the share ID
+func (ft *FileTree) shareIDFromToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", errInvalidShareToken
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(ft.shareSig(parts[0]))) {
+		return "", errInvalidShareToken
+	}
+	return parts[0], nil
+}
+
+// shareDownloads returns the downloads counter of the share (the counters are kept in a local index, outside the
+// kvstore, to avoid writing a new version on each download)
+func (ft *FileTree) shareDownloads(id string) (int, error) {
+	v, err := ft.shares.Get([]byte(id))
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+func (ft *FileTree) putShare(share *Share) error {
+	encoded, err := msgpack.Marshal(share)
+	if err != nil {
+		return err
+	}
+	_, err = ft.kvStore.Put(context.Background(), fmt.Sprintf(ShareKeyFmt, share.ID), "", encoded, -1)
+	return err
+}
+
+// GetShare returns the share for the given ID
+func (ft *FileTree) GetShare(id string) (*Share, error) {
+	kv, err := ft.kvStore.Get(context.Background(), fmt.Sprintf(ShareKeyFmt, id), -1)
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{}
+	if err := msgpack.Unmarshal(kv.Data, share); err != nil {
+		return nil, err
+	}
+	if share.Downloads, err = ft.shareDownloads(share.ID); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// CreateShare mints a new signed sharing link for the given node ref, `ttl` and `maxDownloads` are optional (0).
+func (ft *FileTree) CreateShare(ctx context.Context, ref string, ttl time.Duration, maxDownloads int) (*Share, error) {
+	// Ensure the node exists
+	if _, err := ft.nodeByRef(ctx, ref); err != nil {
+		return nil, err
+	}
+
+	rid := make([]byte, 16)
+	if _, err := rand.Read(rid); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	share := &Share{
+		ID:           hex.EncodeToString(rid),
+		Ref:          ref,
+		CreatedAt:    now.Unix(),
+		MaxDownloads: maxDownloads,
+	}
+	if ns, ok := ctxutil.Namespace(ctx); ok {
+		share.Namespace = ns
+	}
+	if ttl > 0 {
+		share.ExpiresAt = now.Add(ttl).Unix()
+	}
+	if err := ft.putShare(share); err != nil {
+		return nil, err
+	}
+
+	share.Token = share.ID + "." + ft.shareSig(share.ID)
+	share.URL = "/share/" + share.Token
+	return share, nil
+}
+
+// Shares returns all the sharing links (including the expired ones)
+func (ft *FileTree) Shares() ([]*Share, error) {
+	prefix := fmt.Sprintf(ShareKeyFmt, "")
+	keys, _, err := ft.kvStore.Keys(context.Background(), prefix, prefix+"\xff", 0)
+	if err != nil {
+		return nil, err
+	}
+	out := []*Share{}
+	for _, kv := range keys {
+		share := &Share{}
+		if err := msgpack.Unmarshal(kv.Data, share); err != nil {
+			return nil, err
+		}
+		if share.Downloads, err = ft.shareDownloads(share.ID); err != nil {
+			return nil, err
+		}
+		out = append(out, share)
+	}
+	return out, nil
+}
+
+// DeleteShare revokes the sharing link
+func (ft *FileTree) DeleteShare(id string) error {
+	if _, err := ft.kvStore.Delete(context.Background(), fmt.Sprintf(ShareKeyFmt, id), -1); err != nil {
+		return err
+	}
+	return ft.shares.Delete([]byte(id))
+}
+
+// useShare validates the token, and increments the downloads counter if `download` is true
+func (ft *FileTree) useShare(token string, download bool) (*Share, error) {
+	id, err := ft.shareIDFromToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+
+	share, err := ft.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if share.Expired(time.Now()) {
+		return nil, errShareExpired
+	}
+	if download {
+		share.Downloads++
+		if err := ft.shares.Set([]byte(id), []byte(strconv.Itoa(share.Downloads))); err != nil {
+			return nil, err
+		}
+	}
+	return share, nil
+}
+
+func (ft *FileTree) sharesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.Share),
+				perms.Resource(perms.Filetree, perms.Share),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+
+			shares, err := ft.Shares()
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": shares,
+			})
+		case "POST":
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+			sreq := &shareRequest{}
+			if err := httputil.Unmarshal(r, sreq); err != nil {
+				panic(err)
+			}
+			if sreq.Ref == "" {
+				panic(httputil.NewPublicErrorFmt("missing ref"))
+			}
+
+			// Sharing a node gives access to it, so it must be readable too
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.Share),
+				perms.ResourceWithID(perms.Filetree, perms.Share, sreq.Ref),
+			) || !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.Node),
+				perms.ResourceWithID(perms.Filetree, perms.Node, sreq.Ref),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+
+			var ttl time.Duration
+			if sreq.TTL != "" {
+				var err error
+				ttl, err = time.ParseDuration(sreq.TTL)
+				if err != nil {
+					panic(httputil.NewPublicErrorFmt("invalid ttl: %v", err))
+				}
+			}
+
+			share, err := ft.CreateShare(ctx, sreq.Ref, ttl, sreq.MaxDownloads)
+			switch err {
+			case nil:
+			case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			default:
+				panic(err)
+			}
+
+			httputil.MarshalAndWrite(r, w, share, httputil.WithStatusCode(http.StatusCreated))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (ft *FileTree) shareHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		switch r.Method {
+		case "GET", "HEAD":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.Share),
+				perms.ResourceWithID(perms.Filetree, perms.Share, id),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+
+			share, err := ft.GetShare(id)
+			if err != nil {
+				if err == vkv.ErrNotFound {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, share)
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.Share),
+				perms.ResourceWithID(perms.Filetree, perms.Share, id),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+
+			if err := ft.DeleteShare(id); err != nil {
+				if err == vkv.ErrNotFound {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// publicShareHandler serves a shared node, no auth is needed as the token is signed
+func (ft *FileTree) publicShareHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+
+		// Fetch the share without counting a download first, as the path may point to a directory
+		share, err := ft.useShare(vars["token"], false)
+		switch err {
+		case nil:
+		case errShareExpired:
+			w.WriteHeader(http.StatusGone)
+			return
+		case errInvalidShareToken, vkv.ErrNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), share.Namespace)
+		fs := NewFS(share.Ref, ft)
+		node, _, _, err := fs.Path(ctx, "/"+vars["path"], 1, false, 0)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+
+		w.Header().Set("ETag", node.Hash)
+
+		if node.Type != "file" {
+			httputil.MarshalAndWrite(r, w, node)
+			return
+		}
+
+		// Handle HEAD request
+		if r.Method == "HEAD" {
+			return
+		}
+
+		if _, err := ft.useShare(vars["token"], true); err != nil {
+			if err == errShareExpired {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			panic(err)
+		}
+
+		ft.serveFile(ctx, w, r, node.Hash, true)
+	}
+}
@@ -0,0 +1,125 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestShareDownloads(t *testing.T) {
+	env := testutil.New(t, "filetree_share_test")
+	defer env.Close()
+
+	// An empty sharing key is rejected
+	if _, err := New(env.Log, &config.Config{DataDir: env.Dir}, nil, env.KvStore, env.BlobStore, env.Hub, nil); err == nil {
+		t.Fatalf("expected an error for an empty sharing key")
+	}
+
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	archive := buildTar([]*tar.Header{
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Now()},
+	}, map[string]string{"./a.txt": "hello"})
+	res, err := ft.ImportTar(ctx, "_root", archive)
+	check(err)
+
+	share, err := ft.CreateShare(ctx, res.Ref, 0, 2)
+	check(err)
+	for i := 0; i < 2; i++ {
+		if _, err := ft.useShare(share.Token, true); err != nil {
+			t.Fatalf("download %d failed: %v", i, err)
+		}
+	}
+	if _, err := ft.useShare(share.Token, true); err != errShareExpired {
+		t.Errorf("expected the share to be expired, got %v", err)
+	}
+
+	// The downloads don't write new versions of the share
+	kvv, _, err := env.KvStore.Versions(ctx, fmt.Sprintf(ShareKeyFmt, share.ID), "0", -1)
+	check(err)
+	if len(kvv.Versions) != 1 {
+		t.Errorf("expected 1 version, got %d", len(kvv.Versions))
+	}
+	got, err := ft.GetShare(share.ID)
+	check(err)
+	if got.Downloads != 2 {
+		t.Errorf("expected 2 downloads, got %d", got.Downloads)
+	}
+
+	check(ft.DeleteShare(share.ID))
+	n, err := ft.shareDownloads(share.ID)
+	check(err)
+	if n != 0 {
+		t.Errorf("expected the counter to be removed, got %d", n)
+	}
+}
+
+func TestShareRequiresNodeRead(t *testing.T) {
+	env := testutil.New(t, "filetree_share_perms_test")
+	defer env.Close()
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	archive := buildTar([]*tar.Header{
+		{Name: "./a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Now()},
+	}, map[string]string{"./a.txt": "hello"})
+	res, err := ft.ImportTar(context.Background(), "_root", archive)
+	check(err)
+
+	check(auth.Setup(&config.Config{Roles: []*config.Role{
+		&config.Role{
+			Name: "share-test-write-share",
+			Perms: []*config.Perm{&config.Perm{
+				Action:   perms.Action(perms.Write, perms.Share),
+				Resource: perms.ResourceWithID(perms.Filetree, perms.Share, res.Ref),
+			}},
+		},
+		&config.Role{
+			Name: "share-test-read-node",
+			Perms: []*config.Perm{&config.Perm{
+				Action:   perms.Action(perms.Read, perms.Node),
+				Resource: perms.ResourceWithID(perms.Filetree, perms.Node, res.Ref),
+			}},
+		},
+	}}, env.Log))
+	writer, err := auth.NewAuth("writer", []string{"share-test-write-share"})
+	check(err)
+	sharer, err := auth.NewAuth("sharer", []string{"share-test-write-share", "share-test-read-node"})
+	check(err)
+	auths := map[string]*auth.Auth{"writer": writer, "sharer": sharer}
+	auth.RegisterChecker(func(r *http.Request) *auth.Auth {
+		return auths[r.Header.Get("X-Share-Test-Auth")]
+	})
+
+	for _, tdata := range []struct {
+		auth     string
+		expected int
+	}{
+		{"writer", http.StatusForbidden},
+		{"sharer", http.StatusCreated},
+	} {
+		r := httptest.NewRequest("POST", "/api/filetree/shares", strings.NewReader(fmt.Sprintf(`{"ref": %q}`, res.Ref)))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Share-Test-Auth", tdata.auth)
+		if !auth.Check(r) {
+			t.Fatalf("auth %q not found", tdata.auth)
+		}
+		w := httptest.NewRecorder()
+		ft.sharesHandler()(w, r)
+		if w.Code != tdata.expected {
+			t.Errorf("%s: expected %d, got %d", tdata.auth, tdata.expected, w.Code)
+		}
+	}
+}
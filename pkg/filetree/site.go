@@ -0,0 +1,220 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"a4.io/blobsfile"
+	"github.com/gorilla/mux"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"gopkg.in/yaml.v2"
+
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+)
+
+// Optional template at the root of the site FS, overriding the default one
+const siteLayoutName = "_layout.html"
+
+// Max size of the rendered Markdown files (and of the layout)
+const maxSiteFileSize = 10 << 20
+
+var siteMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var defaultSiteLayout = template.Must(template.New("layout").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ if .Title }}{{ .Title }} - {{ end }}{{ .Site }}</title>
+</head>
+<body>
+<main>
+{{ .Content }}
+</main>
+</body>
+</html>
+`))
+
+// SitePage is passed to the site layout template
+type SitePage struct {
+	Site    string
+	Path    string
+	Title   string
+	Meta    map[string]interface{}
+	Content template.HTML
+}
+
+// siteConfig returns the site config of the FS, or nil if it's not rendered as a site
+func (ft *FileTree) siteConfig(name string) *config.SiteConfig {
+	if ft.conf.Filetree == nil {
+		return nil
+	}
+	if site, ok := ft.conf.Filetree.Sites[name]; ok && site.Render {
+		return site
+	}
+	return nil
+}
+
+// parseFrontMatter splits the optional YAML front matter (delimited by `---` lines) from the Markdown content
+func parseFrontMatter(data []byte) (map[string]interface{}, []byte, error) {
+	meta := map[string]interface{}{}
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if !bytes.HasPrefix(data, []byte("---\n")) {
+		return meta, data, nil
+	}
+	end := bytes.Index(data[4:], []byte("\n---\n"))
+	if end == -1 {
+		return meta, data, nil
+	}
+	if err := yaml.Unmarshal(data[4:4+end], &meta); err != nil {
+		return nil, nil, fmt.Errorf("invalid front matter: %v", err)
+	}
+	return meta, data[4+end+5:], nil
+}
+
+// renderMarkdown returns the page for the given Markdown file content
+func renderMarkdown(site, p string, data []byte) (*SitePage, error) {
+	meta, md, err := parseFrontMatter(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := siteMarkdown.Convert(md, &buf); err != nil {
+		return nil, err
+	}
+	page := &SitePage{
+		Site:    site,
+		Path:    p,
+		Meta:    meta,
+		Content: template.HTML(buf.String()),
+	}
+	if title, ok := meta["title"].(string); ok {
+		page.Title = title
+	}
+	return page, nil
+}
+
+// readSiteFile returns the content of the file node
+func (ft *FileTree) readSiteFile(ctx context.Context, node *Node) ([]byte, error) {
+	if node.Size > maxSiteFileSize {
+		return nil, fmt.Errorf("file %q is too large", node.Name)
+	}
+	f := filereader.NewFile(ctx, ft.blobStore, node.Meta, nil)
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// siteLayout returns the layout template of the site
+func (ft *FileTree) siteLayout(ctx context.Context, fs *FS) (*template.Template, error) {
+	node, _, _, err := fs.Path(ctx, "/"+siteLayoutName, 1, false, 0)
+	switch err {
+	case nil:
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		return defaultSiteLayout, nil
+	default:
+		return nil, err
+	}
+	data, err := ft.readSiteFile(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("layout").Parse(string(data))
+}
+
+// siteLookup returns the node for the pretty URL, `/a/b` is looked up as `/a/b`, `/a/b.md`, `/a/b/index.md` and
+// `/a/b/index.html`
+func (fs *FS) siteLookup(ctx context.Context, p string) (*Node, error) {
+	candidates := []string{p, p + ".md", path.Join(p, "index.md"), path.Join(p, "index.html")}
+	if p == "/" {
+		candidates = candidates[2:]
+	}
+	for _, candidate := range candidates {
+		node, _, _, err := fs.Path(ctx, candidate, 1, false, 0)
+		switch err {
+		case nil:
+			if node.Type == "file" {
+				return node, nil
+			}
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		default:
+			return nil, err
+		}
+	}
+	return nil, clientutil.ErrBlobNotFound
+}
+
+// siteHandler serves the FS flagged with `render: true` as a static site (Markdown files are rendered as HTML)
+func (ft *FileTree) siteHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		vars := mux.Vars(r)
+		name := vars["name"]
+		if ft.siteConfig(name) == nil {
+			notFound(w)
+			return
+		}
+
+		p := path.Clean("/" + vars["path"])
+		// The files/dirs starting with `_` are private (like the layout)
+		for _, part := range strings.Split(p, "/") {
+			if strings.HasPrefix(part, "_") {
+				notFound(w)
+				return
+			}
+		}
+
+		fs, err := ft.FS(ctx, name, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		node, err := fs.siteLookup(ctx, p)
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+
+		if !strings.HasSuffix(node.Name, ".md") {
+			ft.serveFile(ctx, w, r, node.Hash, true)
+			return
+		}
+
+		data, err := ft.readSiteFile(ctx, node)
+		if err != nil {
+			panic(err)
+		}
+		page, err := renderMarkdown(name, p, data)
+		if err != nil {
+			panic(err)
+		}
+		layout, err := ft.siteLayout(ctx, fs)
+		if err != nil {
+			panic(err)
+		}
+		var out bytes.Buffer
+		if err := layout.Execute(&out, page); err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(out.Bytes())
+	}
+}
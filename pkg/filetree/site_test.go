@@ -0,0 +1,31 @@
+package filetree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	page, err := renderMarkdown("blog", "/hello", []byte("---\r\ntitle: Hello\r\ntags: [a, b]\r\n---\r\n# Hello\n\nWorld\n"))
+	check(err)
+	if page.Title != "Hello" {
+		t.Errorf("unexpected title %q", page.Title)
+	}
+	if tags, ok := page.Meta["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("unexpected meta %+v", page.Meta)
+	}
+	if !strings.Contains(string(page.Content), "<h1>Hello</h1>") || strings.Contains(string(page.Content), "title:") {
+		t.Errorf("unexpected content %q", page.Content)
+	}
+
+	// No front matter
+	page, err = renderMarkdown("blog", "/", []byte("---\nnot closed"))
+	check(err)
+	if page.Title != "" || len(page.Meta) != 0 {
+		t.Errorf("unexpected page %+v", page)
+	}
+
+	if _, err := renderMarkdown("blog", "/", []byte("---\n: [\n---\n")); err == nil {
+		t.Errorf("invalid front matter should fail")
+	}
+}
@@ -0,0 +1,28 @@
+package filetree
+
+import (
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+// newTestFileTree sets up a FileTree on top of the env stores, the data dir and the sharing key default to the env dir
+// and "test"
+func newTestFileTree(t *testing.T, env *testutil.Env, conf *config.Config) *FileTree {
+	t.Helper()
+	if conf == nil {
+		conf = &config.Config{}
+	}
+	if conf.DataDir == "" {
+		conf.DataDir = env.Dir
+	}
+	if conf.SharingKey == "" {
+		conf.SharingKey = "test"
+	}
+	ft, err := New(env.Log, conf, nil, env.KvStore, env.BlobStore, env.Hub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ft
+}
@@ -0,0 +1,335 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// TrashKeyFmt is the key holding the nodes deleted from a FS (one version per deleted node, the version being the
+// trash entry ID, and the ref the deleted node)
+var TrashKeyFmt = "_filetree:trash:%s"
+
+// ErrTrashEntryNotFound is returned when restoring an unknown (or expired) trash entry
+var ErrTrashEntryNotFound = errors.New("trash entry not found")
+
+// TrashEntry represents a node deleted from a FS, kept until it expires
+type TrashEntry struct {
+	ID        int64  `json:"id" msgpack:"-"`
+	Ref       string `json:"ref" msgpack:"-"`
+	Path      string `json:"path" msgpack:"p"`
+	Type      string `json:"type" msgpack:"t"`
+	Size      int    `json:"size" msgpack:"s"`
+	DeletedAt int64  `json:"deleted_at" msgpack:"d"`
+	ExpiresAt int64  `json:"expires_at" msgpack:"e"`
+}
+
+func (ft *FileTree) trashRetention() time.Duration {
+	if ft.conf.Filetree == nil {
+		return 0
+	}
+	return time.Duration(ft.conf.Filetree.TrashRetention) * time.Second
+}
+
+// addToTrash records the deleted node in the trash of the FS (if the trash is enabled)
+func (ft *FileTree) addToTrash(ctx context.Context, name string, n *Node, p string) error {
+	retention := ft.trashRetention()
+	if retention <= 0 || name == "" {
+		return nil
+	}
+	now := time.Now()
+	encoded, err := msgpack.Marshal(&TrashEntry{
+		Path:      path.Clean("/" + p),
+		Type:      n.Type,
+		Size:      n.Size,
+		DeletedAt: now.Unix(),
+		ExpiresAt: now.Add(retention).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ft.kvStore.Put(ctx, fmt.Sprintf(TrashKeyFmt, name), n.Hash, encoded, -1)
+	return err
+}
+
+// Trash returns the trash entries of the FS (most recently deleted first), the expired entries are skipped (they are
+// purged by `PurgeTrash`)
+func (ft *FileTree) Trash(ctx context.Context, name string) ([]*TrashEntry, error) {
+	entries := []*TrashEntry{}
+	kvv, _, err := ft.kvStore.Versions(ctx, fmt.Sprintf(TrashKeyFmt, name), "0", -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return entries, nil
+	default:
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, kv := range kvv.Versions {
+		entry := &TrashEntry{}
+		if err := msgpack.Unmarshal(kv.Data, entry); err != nil {
+			return nil, err
+		}
+		if entry.ExpiresAt <= now {
+			continue
+		}
+		entry.ID = kv.Version
+		entry.Ref = kv.HexHash()
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// PurgeTrash removes the expired entries from the trash of the FS, and returns the number of purged entries
+func (ft *FileTree) PurgeTrash(ctx context.Context, name string) (int, error) {
+	key := fmt.Sprintf(TrashKeyFmt, name)
+	kvv, _, err := ft.kvStore.Versions(ctx, key, "0", -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return 0, nil
+	default:
+		return 0, err
+	}
+
+	var purged int
+	now := time.Now().Unix()
+	for _, kv := range kvv.Versions {
+		entry := &TrashEntry{}
+		if err := msgpack.Unmarshal(kv.Data, entry); err != nil {
+			return purged, err
+		}
+		if entry.ExpiresAt > now {
+			continue
+		}
+		if err := ft.kvStore.DeleteVersion(ctx, key, kv.Version); err != nil && err != vkv.ErrNotFound {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeAllTrashes removes the expired entries from the trash of every FS
+func (ft *FileTree) purgeAllTrashes(ctx context.Context) error {
+	prefix := fmt.Sprintf(TrashKeyFmt, "")
+	keys, _, err := ft.kvStore.Keys(ctx, prefix, prefix+"\xff", 0)
+	if err != nil {
+		return err
+	}
+	for _, kv := range keys {
+		if _, err := ft.PurgeTrash(ctx, strings.TrimPrefix(kv.Key, prefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteToTrash removes the node from its FS and records it in the trash, the new root and the FS revision are
+// returned
+func (ft *FileTree) deleteToTrash(ctx context.Context, fsName string, n *Node, p, prefixFmt string, mtime int64) (*Node, int64, error) {
+	root, revision, err := ft.Delete(ctx, nil, n, prefixFmt, mtime)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := ft.addToTrash(ctx, fsName, n, p); err != nil {
+		return nil, 0, err
+	}
+	return root, revision, nil
+}
+
+// RestoreFromTrash adds the deleted node back to the FS (at its original path, unless `dst` is set), and saves a new
+// version of the FS, the path of the restored node is returned along with the new node
+func (ft *FileTree) RestoreFromTrash(ctx context.Context, fs *FS, id int64, dst, prefixFmt string, mtime int64) (*Node, string, int64, error) {
+	key := fmt.Sprintf(TrashKeyFmt, fs.Name)
+	kv, err := ft.kvStore.Get(ctx, key, id)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, "", 0, ErrTrashEntryNotFound
+		}
+		return nil, "", 0, err
+	}
+	entry := &TrashEntry{}
+	if err := msgpack.Unmarshal(kv.Data, entry); err != nil {
+		return nil, "", 0, err
+	}
+	if kv.Version != id || entry.ExpiresAt <= time.Now().Unix() {
+		return nil, "", 0, ErrTrashEntryNotFound
+	}
+	if dst == "" {
+		dst = entry.Path
+	}
+	dst = path.Clean("/" + dst)
+	if dst == "/" {
+		return nil, "", 0, fmt.Errorf("%w: cannot restore as the root", ErrInvalidMove)
+	}
+
+	deleted, err := ft.nodeByRef(ctx, kv.HexHash())
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	root, err := fs.Root(ctx, true, mtime)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	root.fs = fs
+	root.parent = nil
+
+	dstNames := splitPath(dst)
+	existing, err := ft.lookupPath(ctx, root.Meta, dstNames)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if existing != nil {
+		return nil, "", 0, ErrPathExists
+	}
+
+	restored, err := ft.addNode(ctx, root.Meta, dstNames, deleted.Meta, mtime)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	_, revision, err := ft.Update(ctx, nil, root, root.Meta, prefixFmt, false)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	if err := ft.kvStore.DeleteVersion(ctx, key, id); err != nil && err != vkv.ErrNotFound {
+		return nil, "", 0, err
+	}
+
+	node, err := ft.metaToNode(ctx, restored)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return node, dst, revision, nil
+}
+
+func (ft *FileTree) trashHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			panic(httputil.NewPublicErrorFmt("only FS have a trash"))
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		entries, err := ft.Trash(ctx, fsName)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": entries,
+		})
+	}
+}
+
+func (ft *FileTree) trashRestoreHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := commitContext(r)
+		ctx = ctxutil.WithNamespace(ctx, ctxutil.RequestNamespace(r))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		if vars["type"] != "fs" {
+			panic(httputil.NewPublicErrorFmt("only FS have a trash"))
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx = ctxutil.WithUsageNamespace(ctx, "filetree:"+fsName)
+
+		id, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusNotFound, ErrTrashEntryNotFound.Error())
+			return
+		}
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		// The destination path is optional
+		rreq := &MoveRequest{}
+		if r.ContentLength > 0 {
+			if err := httputil.Unmarshal(r, rreq); err != nil {
+				panic(err)
+			}
+		}
+
+		fs, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+
+		node, p, revision, err := ft.RestoreFromTrash(ctx, fs, id, rreq.Dst, prefixFmt, time.Now().Unix())
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrTrashEntryNotFound):
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, ErrPathExists):
+				httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			case errors.Is(err, ErrInvalidMove):
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			default:
+				panic(err)
+			}
+			return
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      fmt.Sprintf("%s-restored", node.Type),
+			Ref:       node.Hash,
+			Path:      p[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, node)
+	}
+}
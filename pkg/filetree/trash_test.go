@@ -0,0 +1,93 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestTrash(t *testing.T) {
+	env := testutil.New(t, "filetree_trash_test")
+	defer env.Close()
+	kvs := env.KvStore
+	conf := &config.Config{
+		Filetree: &config.FiletreeConfig{TrashRetention: 3600},
+	}
+	ft := newTestFileTree(t, env, conf)
+	defer ft.Close()
+
+	ctx := context.Background()
+	mtime := time.Now()
+	archive := buildTar([]*tar.Header{
+		{Name: "./sub/a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, map[string]string{"./sub/a.txt": "hello"})
+	res, err := ft.ImportTar(ctx, "_root", archive)
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(FSKeyFmt, "myfs"), res.Ref, nil, -1)
+	check(err)
+
+	fs, err := ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	node, _, _, err := fs.Path(ctx, "/sub/a.txt", 1, false, mtime.Unix())
+	check(err)
+	_, _, err = ft.Delete(ctx, nil, node, FSKeyFmt, mtime.Unix())
+	check(err)
+	check(ft.addToTrash(ctx, "myfs", node, "sub/a.txt"))
+
+	entries, err := ft.Trash(ctx, "myfs")
+	check(err)
+	if len(entries) != 1 || entries[0].Path != "/sub/a.txt" || entries[0].Ref != node.Hash {
+		t.Fatalf("unexpected trash %+v", entries)
+	}
+
+	// The trashed blobs are not eligible for GC (only the previous root and sub dir metas are)
+	pres, err := ft.Prune(ctx, "myfs", &config.RetentionPolicy{KeepLast: 1}, true)
+	check(err)
+	if pres.GCEligibleBlobs != 2 {
+		t.Errorf("unexpected GC eligible blobs %+v", pres)
+	}
+
+	fs, err = ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	restored, p, _, err := ft.RestoreFromTrash(ctx, fs, entries[0].ID, "", FSKeyFmt, mtime.Unix())
+	check(err)
+	if p != "/sub/a.txt" || restored.Name != "a.txt" {
+		t.Errorf("unexpected restored node %s %+v", p, restored)
+	}
+	fs, err = ft.FS(ctx, "myfs", FSKeyFmt, false, 0)
+	check(err)
+	if _, _, _, err := fs.Path(ctx, "/sub/a.txt", 1, false, 0); err != nil {
+		t.Errorf("restored file not found: %v", err)
+	}
+
+	// The entry is removed from the trash once restored
+	if _, _, _, err := ft.RestoreFromTrash(ctx, fs, entries[0].ID, "", FSKeyFmt, mtime.Unix()); !errors.Is(err, ErrTrashEntryNotFound) {
+		t.Errorf("expected ErrTrashEntryNotFound, got %v", err)
+	}
+
+	// The expired entries are hidden, but only purged explicitly
+	expired, err := msgpack.Marshal(&TrashEntry{Path: "/old.txt", ExpiresAt: mtime.Add(-time.Hour).Unix()})
+	check(err)
+	_, err = kvs.Put(ctx, fmt.Sprintf(TrashKeyFmt, "myfs"), node.Hash, expired, -1)
+	check(err)
+	entries, err = ft.Trash(ctx, "myfs")
+	check(err)
+	if len(entries) != 0 {
+		t.Errorf("expected the expired entry to be hidden, got %+v", entries)
+	}
+	_, err = ft.Prune(ctx, "myfs", &config.RetentionPolicy{KeepLast: 1}, true)
+	check(err)
+	purged, err := ft.PurgeTrash(ctx, "myfs")
+	check(err)
+	if purged != 1 {
+		t.Errorf("expected 1 purged entry, got %d", purged)
+	}
+}
@@ -0,0 +1,304 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"net/http"
+)
+
+// uiPage is a single-page file manager built on top of the filetree API (the browser authenticates via basic auth, and
+// the credentials are re-used by the API calls)
+const uiPage = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>BlobStash Files</title>
+<style>
+body { font-family: sans-serif; max-width: 960px; margin: 0 auto; padding: 1em; color: #222; }
+header { display: flex; align-items: center; justify-content: space-between; flex-wrap: wrap; gap: .5em; }
+nav a { text-decoration: none; }
+table { width: 100%; border-collapse: collapse; margin-top: 1em; }
+td, th { padding: .4em; border-bottom: 1px solid #eee; text-align: left; }
+td.actions { text-align: right; white-space: nowrap; }
+button { margin-left: .3em; }
+#status { min-height: 1.5em; color: #555; }
+#status.error { color: #b00; }
+#drop { border: 2px dashed #ccc; padding: 1em; text-align: center; margin-top: 1em; }
+#drop.over { border-color: #555; }
+</style>
+</head>
+<body>
+<header>
+<nav id="breadcrumb"></nav>
+<div id="toolbar">
+<input type="file" id="files" multiple>
+<button id="upload">Upload</button>
+</div>
+</header>
+<p id="status"></p>
+<table>
+<thead><tr><th>Name</th><th>Size</th><th>Modified</th><th></th></tr></thead>
+<tbody id="entries"></tbody>
+</table>
+<div id="drop">Drop files here to upload them</div>
+<script>
+(function() {
+  "use strict";
+  var api = "/api/filetree";
+  var $ = function(id) { return document.getElementById(id); };
+
+  // The location hash holds the current FS and path: #<fs>/<path>
+  function current() {
+    var parts = decodeURIComponent(location.hash.slice(1)).split("/").filter(function(p) { return p !== ""; });
+    return {fs: parts.length ? parts[0] : "", path: parts.slice(1)};
+  }
+
+  function fsURL(fs, path) {
+    return api + "/fs/fs/" + encodeURIComponent(fs) + "/" + path.map(encodeURIComponent).join("/");
+  }
+
+  function now() {
+    return Math.floor(Date.now() / 1000);
+  }
+
+  function status(msg, isError) {
+    $("status").textContent = msg || "";
+    $("status").className = isError ? "error" : "";
+  }
+
+  function request(method, url, opts) {
+    opts = opts || {};
+    opts.method = method;
+    opts.credentials = "same-origin";
+    opts.headers = opts.headers || {};
+    opts.headers["Accept"] = "application/json";
+    opts.headers["BlobStash-CSRF"] = "1";
+    return fetch(url, opts).then(function(resp) {
+      if (!resp.ok) {
+        return resp.text().then(function(body) {
+          var msg = resp.status + " " + resp.statusText;
+          try { msg = JSON.parse(body).error || msg; } catch (e) {}
+          throw new Error(msg);
+        });
+      }
+      if (resp.status === 204) {
+        return null;
+      }
+      return resp.json();
+    });
+  }
+
+  function humanSize(size) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (size >= 1024 && i < units.length - 1) {
+      size /= 1024;
+      i++;
+    }
+    return (i ? size.toFixed(1) : size) + " " + units[i];
+  }
+
+  function link(text, href, onclick) {
+    var a = document.createElement("a");
+    a.textContent = text;
+    a.href = href;
+    if (onclick) {
+      a.onclick = onclick;
+    }
+    return a;
+  }
+
+  function button(text, onclick) {
+    var b = document.createElement("button");
+    b.textContent = text;
+    b.onclick = onclick;
+    return b;
+  }
+
+  function cell(row, content) {
+    var td = document.createElement("td");
+    if (typeof content === "string") {
+      td.textContent = content;
+    } else if (content) {
+      td.appendChild(content);
+    }
+    row.appendChild(td);
+    return td;
+  }
+
+  function breadcrumb(cur) {
+    var nav = $("breadcrumb");
+    nav.textContent = "";
+    nav.appendChild(link("Roots", "#"));
+    if (!cur.fs) {
+      return;
+    }
+    var parts = [cur.fs].concat(cur.path);
+    parts.forEach(function(part, i) {
+      nav.appendChild(document.createTextNode(" / "));
+      nav.appendChild(link(part, "#" + parts.slice(0, i + 1).map(encodeURIComponent).join("/")));
+    });
+  }
+
+  function render() {
+    var cur = current();
+    breadcrumb(cur);
+    $("toolbar").style.display = cur.fs ? "" : "none";
+    $("drop").style.display = cur.fs ? "" : "none";
+    var tbody = $("entries");
+    tbody.textContent = "";
+    status("Loading...");
+
+    if (!cur.fs) {
+      return request("GET", api + "/fs").then(function(roots) {
+        (roots || []).forEach(function(root) {
+          var row = document.createElement("tr");
+          cell(row, link(root.name + "/", "#" + encodeURIComponent(root.name)));
+          cell(row, "");
+          cell(row, root.mtime || "");
+          cell(row, "");
+          tbody.appendChild(row);
+        });
+        status("");
+      }).catch(function(err) { status(err.message, true); });
+    }
+
+    return request("GET", fsURL(cur.fs, cur.path)).then(function(node) {
+      if (node.type === "file") {
+        location.href = api + "/file/" + node.ref + "?dl=1";
+        return;
+      }
+      var children = (node.children || []).slice().sort(function(a, b) {
+        if (a.type !== b.type) {
+          return a.type === "dir" ? -1 : 1;
+        }
+        return a.name.localeCompare(b.name);
+      });
+      children.forEach(function(child) {
+        var row = document.createElement("tr");
+        var path = cur.path.concat([child.name]);
+        if (child.type === "dir") {
+          cell(row, link(child.name + "/", "#" + [cur.fs].concat(path).map(encodeURIComponent).join("/")));
+          cell(row, "");
+        } else {
+          cell(row, link(child.name, api + "/file/" + child.ref + "?dl=1"));
+          cell(row, humanSize(child.size || 0));
+        }
+        cell(row, child.mtime || "");
+        var actions = cell(row, "");
+        actions.className = "actions";
+        actions.appendChild(button("Rename", function() { rename(cur, node, child); }));
+        actions.appendChild(button("Share", function() { share(child); }));
+        actions.appendChild(button("Delete", function() { remove(cur, child); }));
+        tbody.appendChild(row);
+      });
+      status(children.length ? "" : "This directory is empty.");
+    }).catch(function(err) { status(err.message, true); });
+  }
+
+  function upload(files) {
+    var cur = current();
+    if (!cur.fs || !files.length) {
+      return;
+    }
+    var uploads = Array.prototype.slice.call(files);
+    var done = 0;
+    status("Uploading " + uploads.length + " file(s)...");
+    var next = function() {
+      if (!uploads.length) {
+        status(done + " file(s) uploaded.");
+        return render();
+      }
+      var file = uploads.shift();
+      var form = new FormData();
+      form.append("file", file);
+      var mtime = Math.floor((file.lastModified || Date.now()) / 1000);
+      return request("POST", fsURL(cur.fs, cur.path.concat([file.name])) + "?mtime=" + mtime, {body: form}).then(function() {
+        done++;
+        return next();
+      });
+    };
+    next().catch(function(err) { status(err.message, true); });
+  }
+
+  function rename(cur, dir, child) {
+    var name = prompt("New name", child.name);
+    if (!name || name === child.name) {
+      return;
+    }
+    if (name.indexOf("/") !== -1) {
+      return status("The name cannot contain a /", true);
+    }
+    // Add the node under its new name, then remove the old entry
+    request("PATCH", fsURL(cur.fs, cur.path) + "?rename=1&mtime=" + now(), {
+      headers: {
+        "If-Match": dir.ref,
+        "BlobStash-Filetree-Patch-Ref": child.ref,
+        "BlobStash-Filetree-Patch-Name": name
+      }
+    }).then(function() {
+      return request("DELETE", fsURL(cur.fs, cur.path.concat([child.name])) + "?mtime=" + now());
+    }).then(function() {
+      status("Renamed to " + name + ".");
+      render();
+    }).catch(function(err) { status(err.message, true); });
+  }
+
+  function remove(cur, child) {
+    if (!confirm("Delete " + child.name + "?")) {
+      return;
+    }
+    request("DELETE", fsURL(cur.fs, cur.path.concat([child.name])) + "?mtime=" + now(), {
+      headers: {"If-Match": child.ref}
+    }).then(function() {
+      status(child.name + " deleted.");
+      render();
+    }).catch(function(err) { status(err.message, true); });
+  }
+
+  function share(child) {
+    var ttl = prompt("Link validity (e.g. 24h, 168h, empty for no expiration)", "168h");
+    if (ttl === null) {
+      return;
+    }
+    request("POST", api + "/shares", {
+      headers: {"Content-Type": "application/json"},
+      body: JSON.stringify({ref: child.ref, ttl: ttl})
+    }).then(function(resp) {
+      var url = resp.url;
+      prompt("Sharing link for " + child.name, url);
+    }).catch(function(err) { status(err.message, true); });
+  }
+
+  $("upload").onclick = function() { upload($("files").files); };
+  var drop = $("drop");
+  drop.ondragover = function(e) { e.preventDefault(); drop.className = "over"; };
+  drop.ondragleave = function() { drop.className = ""; };
+  drop.ondrop = function(e) {
+    e.preventDefault();
+    drop.className = "";
+    upload(e.dataTransfer.files);
+  };
+  window.onhashchange = render;
+  render();
+})();
+</script>
+</body>
+</html>
+`
+
+// uiHandler serves the web file manager
+func (ft *FileTree) uiHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Frame-Options", "DENY")
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write([]byte(uiPage))
+	}
+}
@@ -0,0 +1,202 @@
+package filetree // import "a4.io/blobstash/pkg/filetree"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// UnionRoots resolves the roots of an union, each root is either an FS (`fs:<name>`) or a node ref.
+func (ft *FileTree) UnionRoots(ctx context.Context, roots []string, asOf int64) ([]string, error) {
+	refs := []string{}
+	for _, root := range roots {
+		if !strings.HasPrefix(root, "fs:") {
+			refs = append(refs, root)
+			continue
+		}
+		fs, err := ft.FS(ctx, root[3:], FSKeyFmt, false, asOf)
+		if err != nil {
+			return nil, err
+		}
+		if fs.Ref == "" {
+			return nil, clientutil.ErrBlobNotFound
+		}
+		refs = append(refs, fs.Ref)
+	}
+	return refs, nil
+}
+
+// UnionPath returns the node at the given path within the read-only union of the given roots.
+//
+// The later roots shadow the earlier ones: a file shadows everything at the same path in the previous roots, and
+// the children of the dirs are merged (by name) until a root has a file at the path of the dir.
+// The returned node (and its children) is never saved, its ref is the ref of the top-most node.
+func (ft *FileTree) UnionPath(ctx context.Context, roots []string, path string, depth int) (*Node, error) {
+	// The layers at the current path, from the top-most one
+	layers := []*Node{}
+	for i := len(roots) - 1; i >= 0; i-- {
+		n, err := ft.nodeByRef(ctx, roots[i])
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, n)
+	}
+	if len(layers) == 0 {
+		return nil, clientutil.ErrBlobNotFound
+	}
+
+	if path != "/" {
+		for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+			next := []*Node{}
+			for _, layer := range mergedLayers(layers) {
+				if layer.Type != rnode.Dir {
+					// Only the top-most layer may be a file, and it shadows the rest
+					return nil, clientutil.ErrBlobNotFound
+				}
+				child, err := ft.childByName(ctx, layer, name)
+				if err != nil {
+					return nil, err
+				}
+				if child != nil {
+					next = append(next, child)
+				}
+			}
+			if len(next) == 0 {
+				return nil, clientutil.ErrBlobNotFound
+			}
+			layers = next
+		}
+	}
+
+	return ft.unionNode(ctx, layers, 1, depth)
+}
+
+// mergedLayers returns the layers actually visible: all the dirs from the top-most layer until a file (or the
+// top-most file alone)
+func mergedLayers(layers []*Node) []*Node {
+	if layers[0].Type != rnode.Dir {
+		return layers[:1]
+	}
+	for i, layer := range layers {
+		if layer.Type != rnode.Dir {
+			return layers[:i]
+		}
+	}
+	return layers
+}
+
+// childByName returns the child of the dir with the given name (nil if it does not exist)
+func (ft *FileTree) childByName(ctx context.Context, n *Node, name string) (*Node, error) {
+	for _, ref := range n.Meta.Refs {
+		cn, err := ft.nodeByRef(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		if cn.Name == name {
+			return cn, nil
+		}
+	}
+	return nil, nil
+}
+
+// unionNode merges the layers (of the same path), and fetches the merged children until `maxDepth`
+func (ft *FileTree) unionNode(ctx context.Context, layers []*Node, depth, maxDepth int) (*Node, error) {
+	layers = mergedLayers(layers)
+	n := layers[0]
+	if n.Type != rnode.Dir {
+		f := filereader.NewFile(ctx, ft.blobStore, n.Meta, nil)
+		defer f.Close()
+		info, err := ft.fetchInfo(f, n.Meta.Name, n.Meta.Hash, n.Meta.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+		n.Info = info
+		return n, nil
+	}
+
+	// Group the children of every layer by name (top-most first)
+	groups := map[string][]*Node{}
+	for _, layer := range layers {
+		for _, ref := range layer.Meta.Refs {
+			cn, err := ft.nodeByRef(ctx, ref.(string))
+			if err != nil {
+				return nil, err
+			}
+			groups[cn.Name] = append(groups[cn.Name], cn)
+		}
+	}
+	n.ChildrenCount = len(groups)
+	if depth > maxDepth {
+		return n, nil
+	}
+
+	n.Children = []*Node{}
+	for _, group := range groups {
+		cn, err := ft.unionNode(ctx, group, depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, cn)
+	}
+	sort.Slice(n.Children, func(i, j int) bool {
+		return n.Children[i].Name < n.Children[j].Name
+	})
+	return n, nil
+}
+
+func (ft *FileTree) unionHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+		path := "/" + mux.Vars(r)["path"]
+		q := httputil.NewQuery(r.URL.Query())
+		asOf, err := q.GetInt64Default("as_of", 0)
+		if err != nil {
+			panic(err)
+		}
+		depth, err := q.GetInt("depth", 1, 5)
+		if err != nil {
+			panic(err)
+		}
+		roots := r.URL.Query()["root"]
+		if len(roots) == 0 {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "at least one root is required")
+			return
+		}
+
+		var node *Node
+		refs, err := ft.UnionRoots(ctx, roots, asOf)
+		if err == nil {
+			node, err = ft.UnionPath(ctx, refs, path, depth)
+		}
+		switch err {
+		case nil:
+		case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			panic(fmt.Errorf("failed to get union path: %v", err))
+		}
+
+		w.Header().Set("ETag", node.Hash)
+		if r.Method == "HEAD" {
+			return
+		}
+		httputil.MarshalAndWrite(r, w, node)
+	}
+}
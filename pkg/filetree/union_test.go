@@ -0,0 +1,78 @@
+package filetree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestUnion(t *testing.T) {
+	env := testutil.New(t, "filetree_union_test")
+	defer env.Close()
+	dir := env.Dir
+	ft := newTestFileTree(t, env, nil)
+	defer ft.Close()
+
+	ctx := context.Background()
+	putDir := func(name string, files map[string]string) string {
+		src := filepath.Join(dir, name)
+		for path, content := range files {
+			check(os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0700))
+			check(ioutil.WriteFile(filepath.Join(src, path), []byte(content), 0600))
+		}
+		root, err := ft.NewUploader(ctx).PutDir(src)
+		check(err)
+		return root.Hash
+	}
+	base := putDir("base", map[string]string{
+		"readme.txt":      "base",
+		"data/a.csv":      "a",
+		"data/b.csv":      "b",
+		"shadowed/c.txt":  "c",
+		"only-in-base.md": "base",
+	})
+	overlay := putDir("overlay", map[string]string{
+		"readme.txt": "overlay",
+		"data/c.csv": "c",
+		"shadowed":   "now a file",
+	})
+
+	root, err := ft.UnionPath(ctx, []string{base, overlay}, "/", 2)
+	check(err)
+	names := map[string]*Node{}
+	for _, c := range root.Children {
+		names[c.Name] = c
+	}
+	if len(names) != 4 || root.ChildrenCount != 4 {
+		t.Fatalf("unexpected root children %+v", names)
+	}
+	if names["readme.txt"].Size != len("overlay") {
+		t.Errorf("readme.txt should come from the overlay")
+	}
+	if names["shadowed"].Type != "file" {
+		t.Errorf("shadowed should be a file")
+	}
+	if len(names["data"].Children) != 3 {
+		t.Errorf("data should be merged, got %d children", len(names["data"].Children))
+	}
+
+	n, err := ft.UnionPath(ctx, []string{base, overlay}, "/data/a.csv", 1)
+	check(err)
+	if n.Size != 1 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if _, err := ft.UnionPath(ctx, []string{base, overlay}, "/shadowed/c.txt", 1); err != clientutil.ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+	// The order of the roots matters
+	n, err = ft.UnionPath(ctx, []string{overlay, base}, "/shadowed/c.txt", 1)
+	check(err)
+	if n.Size != 1 {
+		t.Errorf("unexpected node %+v", n)
+	}
+}
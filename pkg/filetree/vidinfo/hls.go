@@ -0,0 +1,80 @@
+package vidinfo // import "a4.io/blobstash/pkg/filetree/vidinfo"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Segment is a media segment of an HLS playlist
+type Segment struct {
+	Duration float64
+	URI      string
+}
+
+// TranscodeHLS transcodes the video into a single HLS rendition of the given height (ffmpeg required), the playlist
+// and the segments are written in `dir`, the segments are returned in order. A height of 0 keeps the source height.
+func TranscodeHLS(p, dir string, height, segmentDuration int) ([]*Segment, error) {
+	playlist := filepath.Join(dir, fmt.Sprintf("%d.m3u8", height))
+	// libx264 requires even dimensions
+	scale := fmt.Sprintf("scale=-2:%d", height)
+	if height <= 0 {
+		scale = "scale=trunc(iw/2)*2:trunc(ih/2)*2"
+	}
+	cmd := exec.Command(
+		"ffmpeg", "-y", "-i", p,
+		"-vf", scale,
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+		"-c:a", "aac", "-ac", "2",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, fmt.Sprintf("%d_%%05d.ts", height)),
+		playlist,
+	)
+	if dat, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %v", dat, err)
+	}
+	data, err := ioutil.ReadFile(playlist)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePlaylist(data)
+}
+
+// ParsePlaylist returns the segments of an HLS media playlist
+func ParsePlaylist(data []byte) ([]*Segment, error) {
+	segments := []*Segment{}
+	var duration float64
+	var inf bool
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			d := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			var err error
+			if duration, err = strconv.ParseFloat(d, 64); err != nil {
+				return nil, fmt.Errorf("invalid segment duration %q", line)
+			}
+			inf = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			if !inf {
+				return nil, fmt.Errorf("missing duration for segment %q", line)
+			}
+			segments = append(segments, &Segment{Duration: duration, URI: line})
+			inf = false
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
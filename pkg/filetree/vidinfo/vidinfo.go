@@ -94,6 +94,9 @@ func Parse(p string) (*Video, error) {
 	if err := json.Unmarshal(js, r); err != nil {
 		return nil, err
 	}
+	if len(r.Streams) == 0 {
+		return nil, fmt.Errorf("no video stream found")
+	}
 	d, err := strconv.Atoi(strings.Split(r.Format.Duration, ".")[0])
 	if err != nil {
 		return nil, err
@@ -0,0 +1,178 @@
+package writer
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/restic/chunker"
+)
+
+// Content-defined chunking algorithms
+const (
+	Rabin   = "rabin"
+	FastCDC = "fastcdc"
+)
+
+// ChunkerOptions holds the content-defined chunking parameters
+type ChunkerOptions struct {
+	Algorithm string
+	MinSize   int
+	AvgSize   int // must be a power of 2
+	MaxSize   int
+	Pol       chunker.Pol // Rabin only
+}
+
+// DefaultChunkerOptions returns the chunking parameters used by default (Rabin fingerprints, ~1MiB chunks)
+func DefaultChunkerOptions() *ChunkerOptions {
+	return &ChunkerOptions{
+		Algorithm: Rabin,
+		MinSize:   chunker.MinSize,
+		AvgSize:   1 << 20,
+		MaxSize:   chunker.MaxSize,
+		Pol:       Pol,
+	}
+}
+
+// Validate checks the chunking parameters
+func (o *ChunkerOptions) Validate() error {
+	switch o.Algorithm {
+	case Rabin, FastCDC:
+	default:
+		return fmt.Errorf("unknown chunker algorithm %q", o.Algorithm)
+	}
+	if o.MinSize <= 0 || o.MinSize >= o.AvgSize || o.AvgSize >= o.MaxSize {
+		return fmt.Errorf("invalid chunk sizes, must be 0 < min (%d) < avg (%d) < max (%d)", o.MinSize, o.AvgSize, o.MaxSize)
+	}
+	if o.AvgSize&(o.AvgSize-1) != 0 {
+		return fmt.Errorf("the average chunk size (%d) must be a power of 2", o.AvgSize)
+	}
+	if o.Algorithm == Rabin && !o.Pol.Irreducible() {
+		return fmt.Errorf("the chunker polynomial %x is not irreducible", uint64(o.Pol))
+	}
+	return nil
+}
+
+// splitter splits a stream into chunks, the returned chunk may use `buf` as storage
+type splitter interface {
+	Next(buf []byte) ([]byte, error)
+}
+
+func (o *ChunkerOptions) newSplitter(rd io.Reader) splitter {
+	if o.Algorithm == FastCDC {
+		return newFastCDC(rd, o.MinSize, o.AvgSize, o.MaxSize)
+	}
+	c := chunker.NewWithBoundaries(rd, o.Pol, uint(o.MinSize), uint(o.MaxSize))
+	c.SetAverageBits(bits.TrailingZeros(uint(o.AvgSize)))
+	return &rabinSplitter{c}
+}
+
+type rabinSplitter struct {
+	c *chunker.Chunker
+}
+
+func (s *rabinSplitter) Next(buf []byte) ([]byte, error) {
+	chunk, err := s.c.Next(buf)
+	if err != nil {
+		return nil, err
+	}
+	return chunk.Data, nil
+}
+
+// gear is the FastCDC gear table, it is derived from a fixed seed and must never change as it would shift all the
+// chunk boundaries (and break the deduplication with the existing content)
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	seed := uint64(0x626c6f6273746173)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// fastCDC implements FastCDC ("FastCDC: a Fast and Efficient Content-Defined Chunking Approach for Data Deduplication",
+// Xia et al., 2016) with normalized chunking (level 1)
+type fastCDC struct {
+	rd io.Reader
+
+	buf        []byte
+	start, end int
+	eof        bool
+
+	minSize, avgSize, maxSize int
+	maskS, maskL              uint64
+}
+
+func newFastCDC(rd io.Reader, minSize, avgSize, maxSize int) *fastCDC {
+	b := uint(bits.TrailingZeros(uint(avgSize)))
+	// Use the most significant bits of the fingerprint, they depend on the last 64 bytes
+	return &fastCDC{
+		rd:      rd,
+		buf:     make([]byte, maxSize),
+		minSize: minSize,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		maskS:   ((1 << (b + 1)) - 1) << (64 - (b + 1)),
+		maskL:   ((1 << (b - 1)) - 1) << (64 - (b - 1)),
+	}
+}
+
+// cut returns the length of the next chunk in data
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := c.minSize
+	// Harder to match before the average size, easier after, to keep the chunk sizes close to the average
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+func (c *fastCDC) Next(buf []byte) ([]byte, error) {
+	if !c.eof && c.end-c.start < c.maxSize {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := io.ReadFull(c.rd, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	out := append(buf[:0], c.buf[c.start:c.start+n]...)
+	c.start += n
+	return out, nil
+}
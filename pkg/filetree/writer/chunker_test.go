@@ -0,0 +1,63 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func splitAll(t *testing.T, opts *ChunkerOptions, data []byte) [][]byte {
+	s := opts.newSplitter(bytes.NewReader(data))
+	buf := make([]byte, opts.MaxSize)
+	chunks := [][]byte{}
+	for {
+		chunk, err := s.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+	return chunks
+}
+
+func TestFastCDC(t *testing.T) {
+	opts := &ChunkerOptions{Algorithm: FastCDC, MinSize: 2 << 10, AvgSize: 8 << 10, MaxSize: 64 << 10}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	chunks := splitAll(t, opts, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("the chunks don't match the input")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > opts.MaxSize || (len(chunk) < opts.MinSize && i != len(chunks)-1) {
+			t.Errorf("chunk %d has an invalid size %d", i, len(chunk))
+		}
+	}
+	if avg := len(data) / len(chunks); avg < opts.AvgSize/2 || avg > opts.AvgSize*2 {
+		t.Errorf("average chunk size %d is too far from %d", avg, opts.AvgSize)
+	}
+
+	// Inserting data at the beginning must only change the first chunks
+	known := map[string]bool{}
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	var reused int
+	shifted := splitAll(t, opts, append([]byte("shifted"), data...))
+	for _, chunk := range shifted {
+		if known[string(chunk)] {
+			reused++
+		}
+	}
+	if reused < len(chunks)-2 {
+		t.Errorf("only %d/%d chunks were reused after the shift", reused, len(chunks))
+	}
+}
@@ -0,0 +1,40 @@
+package writer
+
+import (
+	"sort"
+
+	"a4.io/blobstash/pkg/filetree/filetreeutil/delta"
+)
+
+// A delta is only stored if it's at least twice smaller than the chunk
+const deltaMinRatio = 2
+
+// deltaChunk returns the delta of the chunk (starting at `start`) against the chunk of the delta base at the same
+// offset, along with the ref of the base chunk (the delta is nil if the chunk is not worth delta encoding).
+func (up *Uploader) deltaChunk(start int64, chunk []byte) (string, []byte, error) {
+	if len(up.deltaBase) == 0 || !delta.IsText(chunk) {
+		return "", nil, nil
+	}
+	// The index is the end offset of the chunk
+	i := sort.Search(len(up.deltaBase), func(i int) bool { return up.deltaBase[i].Index > start })
+	if i == len(up.deltaBase) {
+		return "", nil, nil
+	}
+	// Deltas are never chained, a delta chunk is replaced by its own base
+	base := up.deltaBase[i].Value
+	if up.deltaBase[i].Base != "" {
+		base = up.deltaBase[i].Base
+	}
+	data, err := up.bs.(BlobGetter).Get(base)
+	if err != nil {
+		return "", nil, err
+	}
+	if !delta.IsText(data) {
+		return "", nil, nil
+	}
+	d := delta.Diff(data, chunk)
+	if len(d)*deltaMinRatio > len(chunk) {
+		return "", nil, nil
+	}
+	return base, d, nil
+}
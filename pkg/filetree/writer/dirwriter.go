@@ -69,6 +69,7 @@ func (up *Uploader) DirExplorer(path string, pnode *node, nodes chan<- *node) {
 			pnode.children = append(pnode.children, n)
 		} else {
 			if fi.Mode()&os.ModeSymlink == 0 {
+				up.progress.fileFound(fi)
 				nodes <- n
 				pnode.children = append(pnode.children, n)
 			}
@@ -187,11 +188,12 @@ func (up *Uploader) PutDir(path string) (*rnode.RawNode, error) {
 	go func() {
 		defer wg.Done()
 		up.DirExplorer(path, n, nodes)
+		up.progress.scanDone()
 		defer close(nodes)
 	}()
-	// Upload discovered files (5 file descriptor at the same time max).
+	// Upload discovered files (`up.workers` file descriptor at the same time max).
 	wg.Add(1)
-	l := make(chan struct{}, 5)
+	l := make(chan struct{}, up.workers)
 	go func() {
 		defer wg.Done()
 		for f := range nodes {
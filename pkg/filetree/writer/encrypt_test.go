@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+)
+
+type memBlobStore map[string][]byte
+
+func (m memBlobStore) Stat(ctx context.Context, hash string) (bool, error) {
+	_, ok := m[hash]
+	return ok, nil
+}
+
+func (m memBlobStore) Put(ctx context.Context, hash string, data []byte) error {
+	m[hash] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m memBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	return m[hash], nil
+}
+
+func TestEncryptedUpload(t *testing.T) {
+	master, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := memBlobStore{}
+	up := NewUploader(bs)
+	up.SetEncryptionKey(master)
+
+	data := bytes.Repeat([]byte("secret content "), 100000)
+	meta, err := up.PutReader("secret.txt", bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.EncryptedKey) == 0 {
+		t.Fatalf("missing file key")
+	}
+	for _, iv := range meta.FileRefs() {
+		if bytes.Contains(bs[iv.Value], []byte("secret content")) {
+			t.Errorf("chunk %s is not encrypted", iv.Value)
+		}
+	}
+
+	f, err := filereader.NewDecryptedFile(context.Background(), bs, meta, master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("decrypted content mismatch")
+	}
+
+	other, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filereader.NewDecryptedFile(context.Background(), bs, meta, other, nil); err == nil {
+		t.Errorf("expected an error with the wrong key")
+	}
+}
@@ -1,17 +1,21 @@
 package writer // import "a4.io/blobstash/pkg/filetree/writer"
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/restic/chunker"
 	"golang.org/x/crypto/blake2b"
 
+	"a4.io/blobstash/pkg/crypto"
 	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/imginfo"
 	"a4.io/blobstash/pkg/hashutil"
 )
 
@@ -19,21 +23,54 @@ var (
 	Pol = chunker.Pol(0x3c657535c4d6f5)
 )
 
+// exifHeadLen is the number of bytes kept for extracting the EXIF data of JPEG images (the APP1 segment is at the
+// beginning of the file, and cannot exceed 64KB)
+const exifHeadLen = 128 << 10
+
 func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*WriteResult, error) {
 	ctx := context.TODO()
 	// writeResult := NewWriteResult()
 	// Init the rolling checksum
 
 	// reuse this buffer
-	buf := make([]byte, 8*1024*1024)
-	// Prepare the reader to compute the hash on the fly
-	fullHash, err := blake2b.New256(nil)
+	buf := make([]byte, up.chunker.MaxSize)
+	// Prepare the reader to compute the hash on the fly (keyed with the master key when encrypted, as the plain hash
+	// would let the server confirm a known content)
+	var hashKey []byte
+	var fileKey *[32]byte
+	if up.key != nil {
+		hashKey = up.key[:]
+		var err error
+		fileKey, err = crypto.NewKey()
+		if err != nil {
+			return err
+		}
+		meta.EncryptedKey, err = crypto.WrapKey(up.key, fileKey)
+		if err != nil {
+			return err
+		}
+	}
+	fullHash, err := blake2b.New256(hashKey)
 	if err != nil {
 		return err
 	}
-	freader := io.TeeReader(f, fullHash)
-	chunkSplitter := chunker.New(freader, Pol)
-	// TODO don't read one byte at a time if meta.Size < chunker.ChunkMinSize
+	// Keep the first bytes to sniff the MIME type (not for the encrypted files, as it would leak it)
+	head := &headWriter{max: rnode.SniffLen}
+	parseExif := strings.HasSuffix(strings.ToLower(meta.Name), ".jpg")
+	if parseExif {
+		head.max = exifHeadLen
+	}
+	var hashWriter io.Writer = fullHash
+	if fileKey == nil {
+		hashWriter = io.MultiWriter(fullHash, head)
+	}
+	freader := io.TeeReader(f, hashWriter)
+	chunkSplitter := up.chunker.newSplitter(freader)
+	// Check the chunks by batch if supported (the delta encoding needs to know if each chunk exists right away)
+	var batch *chunkBatch
+	if up.deltaBase == nil {
+		batch = up.newChunkBatch(ctx)
+	}
 	// Prepare the blob writer
 	var size uint
 	for {
@@ -41,24 +78,73 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 		if err == io.EOF {
 			break
 		}
-		chunkHash := hashutil.Compute(chunk.Data)
-		size += chunk.Length
+		if err != nil {
+			return err
+		}
+		start := int64(size)
+		size += uint(len(chunk))
+		if fileKey != nil {
+			chunk = crypto.SealChunk(fileKey, chunk)
+		}
+		chunkHash := hashutil.Compute(chunk)
+
+		if batch != nil {
+			if err := batch.add(chunkHash, chunk); err != nil {
+				return err
+			}
+			meta.AddIndexedRef(int(size), chunkHash)
+			continue
+		}
 
 		exists, err := up.bs.Stat(ctx, chunkHash)
 		if err != nil {
 			panic(fmt.Sprintf("DB error: %v", err))
 		}
 		if !exists {
-			if err := up.bs.Put(ctx, chunkHash, chunk.Data); err != nil {
+			base, d, err := up.deltaChunk(start, chunk)
+			if err != nil {
+				return err
+			}
+			if d != nil {
+				deltaHash := hashutil.Compute(d)
+				exists, err := up.bs.Stat(ctx, deltaHash)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					if err := up.bs.Put(ctx, deltaHash, d); err != nil {
+						return err
+					}
+				}
+				meta.AddDeltaRef(int(size), deltaHash, base)
+				continue
+			}
+
+			if err := up.bs.Put(ctx, chunkHash, chunk); err != nil {
 				panic(fmt.Errorf("failed to PUT blob %v", err))
 			}
 		}
+		up.progress.addBlob(len(chunk), !exists)
 
 		// Save the location and the blob hash into a sorted list (with the offset as index)
 		meta.AddIndexedRef(int(size), chunkHash)
 	}
+	if batch != nil {
+		if err := batch.flush(); err != nil {
+			return err
+		}
+	}
 	meta.Size = int(size)
 	meta.ContentHash = fmt.Sprintf("%x", fullHash.Sum(nil))
+	if _, ok := meta.Metadata[rnode.ContentTypeKey]; !ok && fileKey == nil {
+		meta.AddData(rnode.ContentTypeKey, rnode.SniffContentType(meta.Name, head.buf))
+	}
+	if _, ok := meta.Metadata[rnode.ExifKey]; !ok && fileKey == nil && parseExif {
+		// A missing/broken EXIF segment should not fail the upload
+		if exif, err := imginfo.ParseExif(bytes.NewReader(head.buf)); err == nil {
+			meta.AddData(rnode.ExifKey, exif.Metadata())
+		}
+	}
 	return nil
 	// writeResult.Hash = fmt.Sprintf("%x", fullHash.Sum(nil))
 	// if writeResult.BlobsUploaded > 0 {
@@ -68,6 +154,22 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 	// return writeResult, nil
 }
 
+// headWriter keeps the first `max` bytes written
+type headWriter struct {
+	buf []byte
+	max int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := h.max - len(h.buf); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		h.buf = append(h.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
 // PutFileRename uploads and renames the file at the given path
 func (up *Uploader) PutFileRename(path, filename string, extraMeta bool) (*rnode.RawNode, error) { // , *WriteResult, error) {
 	return up.putFile(path, filename, extraMeta)
@@ -140,6 +242,7 @@ func (up *Uploader) putFile(path, filename string, extraMeta bool) (*rnode.RawNo
 	// wr.SizeSkipped += len(mjs)
 	// }
 	meta.Hash = mhash
+	up.progress.fileDone(path, fstat.Size())
 	return meta, nil
 }
 
@@ -192,10 +295,6 @@ func (up *Uploader) RenameMeta(meta *rnode.RawNode, name string) error {
 
 // PutReader uploads a reader
 func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]interface{}) (*rnode.RawNode, error) { // *WriteResult, error) {
-	ctx := context.TODO()
-	up.StartUpload()
-	defer up.UploadDone()
-
 	meta := &rnode.RawNode{}
 	meta.Name = filepath.Base(name)
 	meta.Type = "file"
@@ -206,26 +305,20 @@ func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]int
 			meta.AddData(k, v)
 		}
 	}
+	return up.PutReaderMeta(reader, meta)
+}
+
+// PutReaderMeta uploads a reader as a file described by the given raw node (name, mode, mtime...)
+func (up *Uploader) PutReaderMeta(reader io.Reader, meta *rnode.RawNode) (*rnode.RawNode, error) {
+	up.StartUpload()
+	defer up.UploadDone()
+
 	// wr := NewWriteResult()
 	if err := up.writeReader(reader, meta); err != nil {
 		return nil, err
 	}
-	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
-		return nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	if err := up.PutMeta(meta); err != nil {
+		return nil, err
 	}
-	// wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
-		}
-		// wr.BlobsCount++
-		// wr.BlobsUploaded++
-		// wr.SizeUploaded += len(mjs)
-	} // else {
-	// wr.SizeSkipped += len(mjs)
-	// }
-	meta.Hash = mhash
 	return meta, nil
 }
@@ -0,0 +1,181 @@
+package writer // import "a4.io/blobstash/pkg/filetree/writer"
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// Max number of chunks/bytes buffered before checking which ones are missing in a single batch stat request
+var (
+	statBatchChunks = 128
+	statBatchSize   = 64 << 20
+)
+
+// BatchStater is implemented by the BlobStorer able to stat many blobs at once (like the client blobstore), the
+// uploader then only sends a stat request per batch of chunks
+type BatchStater interface {
+	// StatBatch returns the missing hashes
+	StatBatch(context.Context, []string) ([]string, error)
+}
+
+// Progress reports the state of an upload
+type Progress struct {
+	// Last uploaded file
+	Path string `json:"path"`
+
+	FilesDone  int   `json:"files_done"`
+	FilesTotal int   `json:"files_total"`
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+
+	// The totals are final once the directory has been fully scanned
+	Scanned bool `json:"scanned"`
+
+	// The chunks already stored on the server are skipped
+	BlobsUploaded int   `json:"blobs_uploaded"`
+	BlobsSkipped  int   `json:"blobs_skipped"`
+	BytesUploaded int64 `json:"bytes_uploaded"`
+}
+
+type progressTracker struct {
+	mu sync.Mutex
+	p  Progress
+	fn func(*Progress)
+}
+
+// notify must be called with the lock held, the callbacks are serialized
+func (t *progressTracker) notify() {
+	if t.fn != nil {
+		p := t.p
+		t.fn(&p)
+	}
+}
+
+func (t *progressTracker) addBlob(size int, uploaded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if uploaded {
+		t.p.BlobsUploaded++
+		t.p.BytesUploaded += int64(size)
+	} else {
+		t.p.BlobsSkipped++
+	}
+}
+
+func (t *progressTracker) fileFound(fi os.FileInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.FilesTotal++
+	t.p.BytesTotal += fi.Size()
+}
+
+func (t *progressTracker) scanDone() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Scanned = true
+	t.notify()
+}
+
+func (t *progressTracker) fileDone(path string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Path = path
+	t.p.FilesDone++
+	t.p.BytesDone += size
+	t.notify()
+}
+
+// SetProgress sets a callback called after each uploaded file (the calls are never concurrent)
+func (up *Uploader) SetProgress(fn func(*Progress)) {
+	up.progress.fn = fn
+}
+
+// Progress returns the current state of the upload
+func (up *Uploader) Progress() *Progress {
+	up.progress.mu.Lock()
+	defer up.progress.mu.Unlock()
+	p := up.progress.p
+	return &p
+}
+
+// SetWorkers sets the number of files uploaded concurrently by PutDir
+func (up *Uploader) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	up.workers = n
+	if n > cap(up.uploader) {
+		up.uploader = make(chan struct{}, n)
+	}
+}
+
+// pendingChunk is a chunk waiting for the next batch stat request
+type pendingChunk struct {
+	hash string
+	data []byte
+}
+
+// chunkBatch buffers the chunks of a file to check which ones are missing with a single request
+type chunkBatch struct {
+	up     *Uploader
+	bs     BatchStater
+	chunks []*pendingChunk
+	hashes []string
+	index  map[string]struct{}
+	size   int
+	ctx    context.Context
+}
+
+func (up *Uploader) newChunkBatch(ctx context.Context) *chunkBatch {
+	bs, ok := up.bs.(BatchStater)
+	if !ok {
+		return nil
+	}
+	return &chunkBatch{up: up, bs: bs, ctx: ctx, index: map[string]struct{}{}}
+}
+
+// add buffers the chunk (copied as the buffer is reused), and uploads the batch once full
+func (b *chunkBatch) add(hash string, chunk []byte) error {
+	if _, ok := b.index[hash]; ok {
+		b.up.progress.addBlob(len(chunk), false)
+		return nil
+	}
+	b.index[hash] = struct{}{}
+	b.chunks = append(b.chunks, &pendingChunk{hash, append([]byte(nil), chunk...)})
+	b.hashes = append(b.hashes, hash)
+	b.size += len(chunk)
+	if len(b.chunks) >= statBatchChunks || b.size >= statBatchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush uploads the missing chunks of the batch
+func (b *chunkBatch) flush() error {
+	if len(b.chunks) == 0 {
+		return nil
+	}
+	missing, err := b.bs.StatBatch(b.ctx, b.hashes)
+	if err != nil {
+		return err
+	}
+	toUpload := map[string]struct{}{}
+	for _, h := range missing {
+		toUpload[h] = struct{}{}
+	}
+	for _, c := range b.chunks {
+		_, ok := toUpload[c.hash]
+		if ok {
+			if err := b.up.bs.Put(b.ctx, c.hash, c.data); err != nil {
+				return err
+			}
+		}
+		b.up.progress.addBlob(len(c.data), ok)
+	}
+	b.chunks = nil
+	b.hashes = nil
+	b.index = map[string]struct{}{}
+	b.size = 0
+	return nil
+}
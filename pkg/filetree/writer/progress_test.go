@@ -0,0 +1,110 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// batchBlobStore counts the stat requests
+type batchBlobStore struct {
+	sync.Mutex
+	blobs      memBlobStore
+	stats      int
+	batchStats int
+}
+
+func (b *batchBlobStore) Stat(ctx context.Context, hash string) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.stats++
+	return b.blobs.Stat(ctx, hash)
+}
+
+func (b *batchBlobStore) StatBatch(ctx context.Context, hashes []string) ([]string, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.batchStats++
+	missing := []string{}
+	for _, h := range hashes {
+		if _, ok := b.blobs[h]; !ok {
+			missing = append(missing, h)
+		}
+	}
+	return missing, nil
+}
+
+func (b *batchBlobStore) Put(ctx context.Context, hash string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	return b.blobs.Put(ctx, hash, data)
+}
+
+func TestPutDirProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer_progress_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("file %d ", i)), 50000*(i+1))
+		total += int64(len(data))
+		p := filepath.Join(dir, fmt.Sprintf("f%d.txt", i))
+		if i%2 == 0 {
+			p = filepath.Join(dir, "sub", fmt.Sprintf("f%d.txt", i))
+		}
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs := &batchBlobStore{blobs: memBlobStore{}}
+	up := NewUploader(bs)
+	up.SetWorkers(3)
+	var calls int
+	up.SetProgress(func(p *Progress) {
+		calls++
+		if p.FilesDone > p.FilesTotal || p.BytesDone > p.BytesTotal {
+			t.Errorf("invalid progress %+v", p)
+		}
+	})
+	root, err := up.PutDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := up.Progress()
+	if !p.Scanned || p.FilesDone != 6 || p.FilesTotal != 6 || p.BytesDone != total || p.BytesTotal != total {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	if calls != 7 {
+		t.Errorf("expected 7 progress calls, got %d", calls)
+	}
+	if p.BlobsUploaded == 0 || p.BytesUploaded == 0 {
+		t.Errorf("chunks should have been uploaded %+v", p)
+	}
+	if bs.batchStats == 0 || bs.batchStats > 6 {
+		t.Errorf("expected at most one batch stat per file, got %d", bs.batchStats)
+	}
+
+	// Everything is already there, no chunk gets uploaded
+	up2 := NewUploader(bs)
+	root2, err := up2.PutDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root2.Hash != root.Hash {
+		t.Errorf("tree hash mismatch")
+	}
+	if p := up2.Progress(); p.BlobsUploaded != 0 || p.BlobsSkipped == 0 {
+		t.Errorf("chunks should have been skipped %+v", p)
+	}
+}
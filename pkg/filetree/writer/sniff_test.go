@@ -0,0 +1,46 @@
+package writer
+
+import (
+	"bytes"
+	"testing"
+
+	"a4.io/blobstash/pkg/crypto"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func TestContentTypeSniffing(t *testing.T) {
+	for _, tdata := range []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"image.bin", append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 1024)...), "image/png"},
+		{"index.txt", []byte("<!DOCTYPE html><html><body>hello</body></html>"), "text/html; charset=utf-8"},
+		{"style.css", []byte("body { color: red; }"), "text/css; charset=utf-8"},
+		{"notes", []byte("just some notes"), "text/plain; charset=utf-8"},
+	} {
+		up := NewUploader(memBlobStore{})
+		meta, err := up.PutReader(tdata.name, bytes.NewReader(tdata.data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := meta.ContentType(); ct != tdata.expected {
+			t.Errorf("%s: expected %q, got %q", tdata.name, tdata.expected, ct)
+		}
+	}
+
+	// The MIME type of the encrypted files is not stored
+	master, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := NewUploader(memBlobStore{})
+	up.SetEncryptionKey(master)
+	meta, err := up.PutReader("secret.bin", bytes.NewReader([]byte("<html></html>")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meta.Metadata[rnode.ContentTypeKey]; ok {
+		t.Errorf("the content type of an encrypted file should not be stored")
+	}
+}
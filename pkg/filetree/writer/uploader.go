@@ -1,6 +1,11 @@
 package writer
 
-import "context"
+import (
+	"context"
+	"fmt"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
 
 var (
 	uploader    = 25 // concurrent upload uploaders
@@ -14,23 +19,70 @@ type BlobStorer interface {
 	Put(context.Context, string, []byte) error
 }
 
+// BlobGetter is implemented by the BlobStorer able to fetch the chunks of the delta base
+type BlobGetter interface {
+	Get(string) ([]byte, error)
+}
+
 type Uploader struct {
-	bs BlobStorer
+	bs      BlobStorer
+	chunker *ChunkerOptions
+
+	// Previous version of the file, the modified text chunks are stored as deltas against it
+	deltaBase []*rnode.IndexValue
+
+	// Master key of the client-side encryption (nil if disabled)
+	key *[32]byte
 
 	uploader    chan struct{}
 	dirUploader chan struct{}
 
+	// Number of files uploaded concurrently by PutDir
+	workers  int
+	progress *progressTracker
+
 	// Ignorer *gignore.GitIgnore
 	Root string
 }
 
 func NewUploader(bs BlobStorer) *Uploader {
 	return &Uploader{
-		bs: bs,
+		bs:      bs,
+		chunker: DefaultChunkerOptions(),
 		// kvs:         kvs,
 		uploader:    make(chan struct{}, uploader),
 		dirUploader: make(chan struct{}, dirUploader),
+		workers:     5,
+		progress:    &progressTracker{},
+	}
+}
+
+// SetChunker sets the content-defined chunking parameters
+func (up *Uploader) SetChunker(opts *ChunkerOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	up.chunker = opts
+	return nil
+}
+
+// SetDeltaBase enables the delta encoding of the uploaded files against the given previous version of the file
+func (up *Uploader) SetDeltaBase(base *rnode.RawNode) error {
+	if up.key != nil {
+		return fmt.Errorf("delta encoding is not supported for encrypted files")
+	}
+	if _, ok := up.bs.(BlobGetter); !ok {
+		return fmt.Errorf("the blob storer cannot fetch blobs")
 	}
+	up.deltaBase = base.FileRefs()
+	return nil
+}
+
+// SetEncryptionKey enables the client-side encryption, each file is encrypted with its own random key, stored in the
+// file node encrypted with the master key (the names and the tree structure are not encrypted)
+func (up *Uploader) SetEncryptionKey(master *[32]byte) {
+	up.key = master
+	up.deltaBase = nil
 }
 
 // Block until the client can start the upload, thus limiting the number of file descriptor used.
@@ -2,10 +2,22 @@ package hashutil // import "a4.io/blobstash/pkg/hashutil"
 
 import (
 	"fmt"
+	"hash/crc32"
+	"strings"
 
 	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
 )
 
+// FastHashAlgo is the algorithm used for the secondary "fast" hash, the value returned by `ComputeFast` is prefixed
+// with it so the algorithm can be switched without invalidating the already recorded hashes.
+const FastHashAlgo = "blake3"
+
+// legacyFastHashAlgo was used for the fast hashes recorded before Blake3, they can still be checked
+const legacyFastHashAlgo = "crc32c"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // ComputeRaw returns the Blake2B hash hex-encoded
 func ComputeRaw(data []byte) [32]byte {
 	return blake2b.Sum256(data)
@@ -15,3 +27,26 @@ func ComputeRaw(data []byte) [32]byte {
 func Compute(data []byte) string {
 	return fmt.Sprintf("%x", blake2b.Sum256(data))
 }
+
+// ComputeFast returns the secondary fast hash, only meant for verifying the integrity of a blob whose canonical hash
+// is already known (it's not used for content addressing).
+func ComputeFast(data []byte) string {
+	return fmt.Sprintf("%s:%x", FastHashAlgo, blake3.Sum256(data))
+}
+
+// CheckFast ensures the data match the given fast hash
+func CheckFast(data []byte, fastHash string) error {
+	var chash string
+	switch {
+	case strings.HasPrefix(fastHash, FastHashAlgo+":"):
+		chash = ComputeFast(data)
+	case strings.HasPrefix(fastHash, legacyFastHashAlgo+":"):
+		chash = fmt.Sprintf("%s:%08x", legacyFastHashAlgo, crc32.Checksum(data, castagnoli))
+	default:
+		return fmt.Errorf("unsupported fast hash algorithm: %s", fastHash)
+	}
+	if chash != fastHash {
+		return fmt.Errorf("Fast hash mismatch: given=%s, computed=%v", fastHash, chash)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package httputil
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported response encodings
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// Responses smaller than this are not worth gzipping (or zstd encoding)
+const minCompressSize = 1024
+
+// Rank of the encodings when the client gives them the same q-value
+var encodingRank = map[string]int{
+	EncodingGzip:   1,
+	EncodingZstd:   2,
+	EncodingSnappy: 3,
+}
+
+var (
+	gzipWriterPool   sync.Pool
+	zstdWriterPool   sync.Pool
+	snappyWriterPool sync.Pool
+
+	// Shared encoder for the buffered responses (`EncodeAll` can be called concurrently)
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+// NegotiateEncoding returns the response encoding to use for the given request (according to its `Accept-Encoding`
+// header and the q-values), or an empty string if the response should not be encoded.
+// Snappy is only used if the client explicitly requests it (the `*` wildcard only selects gzip), browsers can't decode it.
+// On ties, snappy (only listed by the BlobStash clients) is preferred over zstd, and zstd over gzip.
+func NegotiateEncoding(r *http.Request) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch enc {
+		case EncodingGzip, EncodingZstd, EncodingSnappy:
+		case "*":
+			enc = EncodingGzip
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && q > 0 && encodingRank[enc] > encodingRank[best]) {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// isCompressible returns true if the content type is worth compressing
+func isCompressible(contentType string) bool {
+	ct := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	switch {
+	case strings.HasPrefix(ct, "text/"), strings.HasSuffix(ct, "+json"), strings.HasSuffix(ct, "+xml"):
+		return true
+	}
+	switch ct {
+	case jsonMimeType, msgpackMimeType, "application/javascript", "application/xml", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+type compressResponseWriter struct {
+	rw       http.ResponseWriter
+	encoding string
+	w        io.Writer
+
+	gzipWriter   *gzip.Writer
+	zstdWriter   *zstd.Encoder
+	snappyWriter *snappy.Writer
+
+	wroteHeader bool
+}
+
+// NewCompressResponseWriter returns a `http.ResponseWriter` wrapper which encodes the output with the encoding
+// negotiated with the client (see `NegotiateEncoding`).
+// The decision is taken when the header is written: only successful full (i.e. not partial content) responses with a
+// compressible content type are encoded, otherwise it will act like a regular `http.ResponseWriter`.
+// `Close` must be called to flush the output and put the encoder back in its `sync.Pool`.
+func NewCompressResponseWriter(rw http.ResponseWriter, r *http.Request) *compressResponseWriter {
+	// Set the necessary `Vary` header
+	rw.Header().Add("Vary", "Accept-Encoding")
+	return &compressResponseWriter{
+		rw:       rw,
+		encoding: NegotiateEncoding(r),
+		w:        rw,
+	}
+}
+
+// Header is necessary for satisfying the `http.ResponseWriter` interface.
+func (crw *compressResponseWriter) Header() http.Header {
+	return crw.rw.Header()
+}
+
+// WriteHeader is necessary for satisfying the `http.ResponseWriter` interface.
+func (crw *compressResponseWriter) WriteHeader(status int) {
+	if crw.wroteHeader {
+		return
+	}
+	crw.wroteHeader = true
+	h := crw.rw.Header()
+	if crw.encoding != "" && status == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", crw.encoding)
+		// The length of the encoded output is not known yet
+		h.Del("Content-Length")
+		switch crw.encoding {
+		case EncodingGzip:
+			if gw := gzipWriterPool.Get(); gw != nil {
+				crw.gzipWriter = gw.(*gzip.Writer)
+				crw.gzipWriter.Reset(crw.rw)
+			} else {
+				crw.gzipWriter = gzip.NewWriter(crw.rw)
+			}
+			crw.w = crw.gzipWriter
+		case EncodingZstd:
+			if zw := zstdWriterPool.Get(); zw != nil {
+				crw.zstdWriter = zw.(*zstd.Encoder)
+				crw.zstdWriter.Reset(crw.rw)
+			} else {
+				// A single goroutine per encoder, the responses are already encoded concurrently
+				crw.zstdWriter, _ = zstd.NewWriter(crw.rw, zstd.WithEncoderConcurrency(1))
+			}
+			crw.w = crw.zstdWriter
+		case EncodingSnappy:
+			if sw := snappyWriterPool.Get(); sw != nil {
+				crw.snappyWriter = sw.(*snappy.Writer)
+				crw.snappyWriter.Reset(crw.rw)
+			} else {
+				crw.snappyWriter = snappy.NewWriter(crw.rw)
+			}
+			crw.w = crw.snappyWriter
+		}
+	}
+	crw.rw.WriteHeader(status)
+}
+
+// Write implements io.Writer
+func (crw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !crw.wroteHeader {
+		if crw.rw.Header().Get("Content-Type") == "" {
+			crw.rw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		crw.WriteHeader(http.StatusOK)
+	}
+	return crw.w.Write(b)
+}
+
+// Close flushes the encoder and put it back into the pool
+func (crw *compressResponseWriter) Close() error {
+	var err error
+	if crw.gzipWriter != nil {
+		err = crw.gzipWriter.Close()
+		gzipWriterPool.Put(crw.gzipWriter)
+		crw.gzipWriter = nil
+	}
+	if crw.zstdWriter != nil {
+		err = crw.zstdWriter.Close()
+		zstdWriterPool.Put(crw.zstdWriter)
+		crw.zstdWriter = nil
+	}
+	if crw.snappyWriter != nil {
+		err = crw.snappyWriter.Close()
+		snappyWriterPool.Put(crw.snappyWriter)
+		crw.snappyWriter = nil
+	}
+	return err
+}
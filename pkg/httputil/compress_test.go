@@ -0,0 +1,157 @@
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tdata := range []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br", EncodingGzip},
+		{"gzip, deflate, br, zstd", EncodingZstd},
+		{"zstd;q=0.5, gzip", EncodingGzip},
+		{"zstd, snappy", EncodingSnappy},
+		{"snappy", EncodingSnappy},
+		{"gzip, snappy", EncodingSnappy},
+		{"snappy;q=0.5, gzip", EncodingGzip},
+		{"gzip;q=0", ""},
+		{"*", EncodingGzip},
+		{"br, *;q=0.1", EncodingGzip},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tdata.header)
+		if got := NegotiateEncoding(r); got != tdata.expected {
+			t.Errorf("NegotiateEncoding(%q) = %q, expected %q", tdata.header, got, tdata.expected)
+		}
+	}
+}
+
+func TestWriteEncoding(t *testing.T) {
+	data := []byte(strings.Repeat(`{"hello": "world"}`, 100))
+	for _, enc := range []string{"", "gzip", "zstd", "snappy"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		w := httptest.NewRecorder()
+		Write(r, w, data)
+		if got := w.Header().Get("Content-Encoding"); got != enc {
+			t.Errorf("expected encoding %q, got %q", enc, got)
+		}
+		body := w.Body.Bytes()
+		var err error
+		switch enc {
+		case "gzip":
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, err = ioutil.ReadAll(gr)
+			}
+		case "zstd":
+			body, err = zstdDecode(body)
+		case "snappy":
+			body, err = snappy.Decode(nil, body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("bad response body for encoding %q", enc)
+		}
+	}
+
+	// Small responses are not gzipped (or zstd encoded)
+	for _, enc := range []string{"gzip", "zstd"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		w := httptest.NewRecorder()
+		Write(r, w, []byte("{}"))
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("small response should not be encoded, got %q", got)
+		}
+	}
+}
+
+func zstdDecode(data []byte) ([]byte, error) {
+	zr, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func TestCompressResponseWriter(t *testing.T) {
+	content := strings.Repeat("hello world\n", 200)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		cw := NewCompressResponseWriter(w, r)
+		defer cw.Close()
+		name := "file.txt"
+		if r.URL.Path == "/bin" {
+			name = "file.bin"
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		http.ServeContent(cw, r, name, time.Time{}, strings.NewReader(content))
+	}
+
+	for _, tdata := range []struct {
+		path, rng, encoding string
+		status              int
+	}{
+		{"/txt", "", "gzip", http.StatusOK},
+		{"/txt", "", "zstd", http.StatusOK},
+		{"/txt", "bytes=0-9", "", http.StatusPartialContent},
+		{"/bin", "", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", tdata.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if tdata.encoding != "" {
+			r.Header.Set("Accept-Encoding", tdata.encoding)
+		}
+		if tdata.rng != "" {
+			r.Header.Set("Range", tdata.rng)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tdata.status || w.Header().Get("Content-Encoding") != tdata.encoding {
+			t.Errorf("%s (range=%q): unexpected response %d %+v", tdata.path, tdata.rng, w.Code, w.Header())
+			continue
+		}
+		if tdata.encoding != "" {
+			if w.Header().Get("Content-Length") != "" {
+				t.Errorf("Content-Length should not be set for encoded responses")
+			}
+			var body []byte
+			var err error
+			switch tdata.encoding {
+			case "gzip":
+				var gr *gzip.Reader
+				gr, err = gzip.NewReader(w.Body)
+				if err == nil {
+					body, err = ioutil.ReadAll(gr)
+				}
+			case "zstd":
+				body, err = zstdDecode(w.Body.Bytes())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != content {
+				t.Errorf("bad decoded body")
+			}
+		}
+	}
+}
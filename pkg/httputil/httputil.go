@@ -1,6 +1,7 @@
 package httputil // import "a4.io/blobstash/pkg/httputil"
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -74,21 +75,42 @@ func WriteEncoded(r *http.Request, w http.ResponseWriter, data []byte, writeOpti
 	}
 }
 
+// Write writes the response, encoded with the encoding negotiated with the client (see `NegotiateEncoding`), small
+// responses are never gzipped (or zstd encoded)
 func Write(r *http.Request, w http.ResponseWriter, data []byte, writeOptions ...func(http.ResponseWriter)) {
 	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept-Encoding")
 
-	var snap bool
-	if e := r.Header.Get("Accept-Encoding"); e == "snappy" {
-		w.Header().Set("Content-Encoding", e)
-		snap = true
+	encoding := NegotiateEncoding(r)
+	if (encoding == EncodingGzip || encoding == EncodingZstd) && len(data) < minCompressSize {
+		encoding = ""
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
 
 	for _, wo := range writeOptions {
 		wo(w)
 	}
 
-	if snap {
-		if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+	switch encoding {
+	case EncodingSnappy:
+		data = snappy.Encode(nil, data)
+	case EncodingZstd:
+		data = zstdEncoder.EncodeAll(data, nil)
+	case EncodingGzip:
+		var gw *gzip.Writer
+		if pgw := gzipWriterPool.Get(); pgw != nil {
+			gw = pgw.(*gzip.Writer)
+			gw.Reset(w)
+		} else {
+			gw = gzip.NewWriter(w)
+		}
+		defer gzipWriterPool.Put(gw)
+		if _, err := gw.Write(data); err != nil {
+			panic(err)
+		}
+		if err := gw.Close(); err != nil {
 			panic(err)
 		}
 		return
@@ -131,7 +153,7 @@ func MarshalAndWrite(r *http.Request, w http.ResponseWriter, data interface{}, w
 		return false
 	}
 
-	// Write the response (and optionally compress the response with snappy)
+	// Write the response (and optionally compress the response)
 	Write(r, w, out)
 	return true
 }
@@ -161,8 +183,13 @@ func WriteJSONError(w http.ResponseWriter, status int, msg string) {
 	w.Write(js)
 }
 
-// Error is an shortcut for `WriteJSONError(w, http.StatusInternalServerError, err.Error())`
+// Error is an shortcut for `WriteJSONError(w, http.StatusInternalServerError, err.Error())` (the status of
+// `PublicErrorer` errors is honored)
 func Error(w http.ResponseWriter, err error) {
+	if pe, ok := err.(PublicErrorer); ok {
+		WriteJSONError(w, pe.Status(), pe.Error())
+		return
+	}
 	WriteJSONError(w, http.StatusInternalServerError, err.Error())
 }
 
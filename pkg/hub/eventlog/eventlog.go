@@ -0,0 +1,254 @@
+/*
+
+Package eventlog implements a persistent hub event log.
+
+Each NewBlob event is stored in a local rangedb index (the key being the offset, and the value the blob hash), along
+with the offsets of the durable subscribers. Nothing is written to the blobstore, and the events already processed by
+every subscriber are trimmed periodically.
+
+*/
+package eventlog // import "a4.io/blobstash/pkg/hub/eventlog"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/stash/store"
+)
+
+// Key prefixes of the index
+var (
+	eventPrefix  = []byte("e:")
+	offsetPrefix = []byte("o:")
+)
+
+// Number of events fetched at once while replaying
+const replayPageSize = 1000
+
+// Retention is the max age of the events when there is no subscriber
+var Retention = 7 * 24 * time.Hour
+
+// EventLog is a rangedb-backed `hub.EventLog`
+type EventLog struct {
+	db        *rangedb.RangeDB
+	blobStore store.BlobStore
+
+	mu   sync.Mutex
+	last int64
+
+	stop chan struct{}
+	done chan struct{}
+	log  log.Logger
+}
+
+// New initializes the event log, the processed events are trimmed every `trimInterval`
+func New(logger log.Logger, path string, blobStore store.BlobStore, trimInterval time.Duration) (*EventLog, error) {
+	logger.Debug("init")
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &EventLog{
+		db:        db,
+		blobStore: blobStore,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		log:       logger,
+	}
+	if l.last, err = l.head(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go l.trimWorker(trimInterval)
+	return l, nil
+}
+
+// Close stops the trim worker
+func (l *EventLog) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.db.Close()
+}
+
+func (l *EventLog) trimWorker(interval time.Duration) {
+	defer close(l.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			if _, err := l.Trim(); err != nil {
+				l.log.Error("failed to trim the event log", "err", err)
+			}
+		}
+	}
+}
+
+func eventKey(offset int64) []byte {
+	k := make([]byte, len(eventPrefix)+8)
+	copy(k, eventPrefix)
+	binary.BigEndian.PutUint64(k[len(eventPrefix):], uint64(offset))
+	return k
+}
+
+func offsetKey(name string) []byte {
+	return append(append([]byte{}, offsetPrefix...), name...)
+}
+
+// head returns the offset of the most recent event (0 if the log is empty)
+func (l *EventLog) head() (int64, error) {
+	c := l.db.PrefixRange(eventPrefix, true)
+	defer c.Close()
+	k, _, err := c.Next()
+	switch err {
+	case nil:
+		return int64(binary.BigEndian.Uint64(k[len(eventPrefix):])), nil
+	case io.EOF:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// Append implements `hub.EventLog`
+func (l *EventLog) Append(ctx context.Context, blb *blob.Blob) (int64, error) {
+	// Offsets must be unique
+	l.mu.Lock()
+	offset := time.Now().UTC().UnixNano()
+	if offset <= l.last {
+		offset = l.last + 1
+	}
+	l.last = offset
+	l.mu.Unlock()
+
+	if err := l.db.Set(eventKey(offset), []byte(blb.Hash)); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Replay implements `hub.EventLog`
+func (l *EventLog) Replay(ctx context.Context, after int64, f func(int64, *blob.Blob) error) error {
+	start := eventKey(after + 1)
+	end := eventKey(-1)
+	for {
+		type event struct {
+			offset int64
+			hash   string
+		}
+		events := []*event{}
+		c := l.db.Range(start, end, false)
+		k, v, err := c.Next()
+		for ; err == nil && len(events) < replayPageSize; k, v, err = c.Next() {
+			events = append(events, &event{int64(binary.BigEndian.Uint64(k[len(eventPrefix):])), string(v)})
+		}
+		c.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		for _, e := range events {
+			data, err := l.blobStore.Get(ctx, e.hash)
+			if err != nil {
+				return err
+			}
+			if err := f(e.offset, &blob.Blob{Hash: e.hash, Data: data}); err != nil {
+				return err
+			}
+		}
+		if len(events) < replayPageSize {
+			return nil
+		}
+		start = eventKey(events[len(events)-1].offset + 1)
+	}
+}
+
+// Offset implements `hub.EventLog`
+func (l *EventLog) Offset(ctx context.Context, name string) (int64, error) {
+	v, err := l.db.Get(offsetKey(name))
+	if err != nil {
+		return 0, err
+	}
+	if v != nil {
+		return strconv.ParseInt(string(v), 10, 64)
+	}
+
+	// New subscriber, start at the end of the log
+	l.mu.Lock()
+	offset := l.last
+	l.mu.Unlock()
+	if err := l.db.Set(offsetKey(name), []byte(strconv.FormatInt(offset, 10))); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Commit implements `hub.EventLog`
+func (l *EventLog) Commit(ctx context.Context, name string, offset int64) error {
+	current, err := l.Offset(ctx, name)
+	if err != nil {
+		return err
+	}
+	if offset <= current {
+		return nil
+	}
+	return l.db.Set(offsetKey(name), []byte(strconv.FormatInt(offset, 10)))
+}
+
+// Trim removes the events processed by all the subscribers (or the ones older than the retention if there is no
+// subscriber), returns the number of removed events
+func (l *EventLog) Trim() (int, error) {
+	limit := time.Now().Add(-Retention).UnixNano()
+	c := l.db.PrefixRange(offsetPrefix, false)
+	_, v, err := c.Next()
+	var subscribed bool
+	var min int64
+	for ; err == nil; _, v, err = c.Next() {
+		offset, perr := strconv.ParseInt(string(v), 10, 64)
+		if perr != nil {
+			c.Close()
+			return 0, perr
+		}
+		if !subscribed || offset < min {
+			min = offset
+		}
+		subscribed = true
+	}
+	c.Close()
+	if err != io.EOF {
+		return 0, err
+	}
+	// The events not processed by a subscriber are never trimmed
+	if subscribed {
+		limit = min
+	}
+
+	var cnt int
+	c = l.db.Range(eventKey(0), eventKey(limit), false)
+	defer c.Close()
+	k, _, err := c.Next()
+	for ; err == nil; k, _, err = c.Next() {
+		if !bytes.HasPrefix(k, eventPrefix) {
+			break
+		}
+		if err := l.db.Delete(k); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	if err != io.EOF {
+		return cnt, err
+	}
+	return cnt, nil
+}
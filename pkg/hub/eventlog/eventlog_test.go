@@ -0,0 +1,109 @@
+package eventlog
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_eventlog_test")
+	check(err)
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger.New("app", "hub"), true)
+	bs, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, h)
+	check(err)
+	defer bs.Close()
+	ctx := context.Background()
+	path := filepath.Join(dir, "hub-events.index")
+
+	l, err := New(logger, path, bs, time.Hour)
+	check(err)
+	offsets := map[string]int64{}
+	for _, data := range []string{"a", "b", "c"} {
+		blb := blob.New([]byte(data))
+		_, err := bs.Put(ctx, blb)
+		check(err)
+		offsets[data], err = l.Append(ctx, blb)
+		check(err)
+		if data == "a" {
+			// New subscribers start at the end of the log
+			offset, err := l.Offset(ctx, "sub")
+			check(err)
+			if offset != offsets["a"] {
+				t.Errorf("expected offset %d, got %d", offsets["a"], offset)
+			}
+		}
+	}
+	check(l.Commit(ctx, "sub", offsets["b"]))
+
+	// The events processed by all the subscribers are trimmed, the other ones are kept even after the retention
+	retention := Retention
+	Retention = 0
+	removed, err := l.Trim()
+	Retention = retention
+	check(err)
+	if removed != 2 {
+		t.Errorf("expected 2 events to be trimmed, got %d", removed)
+	}
+	check(l.Close())
+
+	// Restart, "c" has not been processed
+	l2, err := New(logger, path, bs, time.Hour)
+	check(err)
+	defer l2.Close()
+	h.SetEventLog(l2)
+	received := []string{}
+	var failing bool
+	check(h.SubscribeDurable(ctx, "sub", func(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+		if failing {
+			return errors.New("subscriber down")
+		}
+		received = append(received, string(blb.Data))
+		return nil
+	}))
+	if len(received) != 1 || received[0] != "c" {
+		t.Errorf("expected the missed event to be replayed, got %v", received)
+	}
+
+	// The new events are persisted and delivered
+	_, err = bs.Put(ctx, blob.New([]byte("d")))
+	check(err)
+	if len(received) != 2 || received[1] != "d" {
+		t.Errorf("expected the new event to be delivered, got %v", received)
+	}
+
+	// A failing subscriber does not fail the write, and does not skip the failed events
+	failing = true
+	_, err = bs.Put(ctx, blob.New([]byte("e")))
+	check(err)
+	failing = false
+	_, err = bs.Put(ctx, blob.New([]byte("f")))
+	check(err)
+	if len(received) != 4 || received[2] != "e" || received[3] != "f" {
+		t.Errorf("expected the failed event to be delivered before the next one, got %v", received)
+	}
+	offset, err := l2.Offset(ctx, "sub")
+	check(err)
+	if offset <= offsets["c"] {
+		t.Errorf("the offset should have been committed, got %d", offset)
+	}
+}
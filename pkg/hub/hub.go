@@ -2,6 +2,9 @@ package hub // import "a4.io/blobstash/pkg/hub"
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 
 	log "github.com/inconshreveable/log15"
 
@@ -20,23 +23,137 @@ const (
 	FiletreeFSUpdate // TODO(tsileo): remove these events
 	SyncRemoteBlob
 	DeleteRemoteBlob
+	PutBlob         // triggered before saving a new blob, an error rejects the blob
+	DeleteKvVersion // triggered when a kvstore version is removed (the data is the removed `*vkv.KeyValue`)
 )
 
+// EventLog persists the NewBlob events, so the durable subscribers can replay the events they missed (e.g. after a
+// crash)
+type EventLog interface {
+	// Append persists the event and returns its offset (offsets are increasing)
+	Append(ctx context.Context, blob *blob.Blob) (int64, error)
+
+	// Replay calls f with the events persisted after the given offset, in order
+	Replay(ctx context.Context, after int64, f func(int64, *blob.Blob) error) error
+
+	// Offset returns the offset of the last event processed by the subscriber (the new subscribers start at the end
+	// of the log)
+	Offset(ctx context.Context, name string) (int64, error)
+
+	// Commit records the offset of the last event processed by the subscriber
+	Commit(ctx context.Context, name string, offset int64) error
+}
+
+type callbackFunc = func(context.Context, *blob.Blob, interface{}) error
+
+// Max number of events kept in memory for a durable subscriber when the event log is failing
+const maxPendingEvents = 10000
+
+// errStopReplay stops a replay once the event being published is reached
+var errStopReplay = errors.New("stop replay")
+
+// durableSubscriber tracks the delivery of the NewBlob events to a durable subscriber
+type durableSubscriber struct {
+	callback callbackFunc
+
+	// The deliveries to a subscriber are serialized (the events are delivered in order)
+	mu        sync.Mutex
+	delivered int64        // Offset of the last event delivered
+	lagging   bool         // A callback failed, the log is replayed from `delivered` on the next event
+	pending   []*blob.Blob // Events that could not be persisted, kept in memory until they are delivered
+}
+
 type Hub struct {
 	root        bool
 	log         log.Logger
 	subscribers map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error
+	// The subscriptions may happen at runtime (e.g. the config reloads)
+	subscribersMu sync.RWMutex
+
+	// Optional event log, and the NewBlob subscribers tracking their offsets in it
+	eventLog   EventLog
+	durable    map[string]*durableSubscriber
+	lastOffset int64 // Offset of the last event appended to the log
+	durableMu  sync.Mutex
+}
+
+// SetEventLog enables the persistence of the NewBlob events, must be called before any durable subscription
+func (h *Hub) SetEventLog(l EventLog) {
+	h.eventLog = l
+}
+
+// SubscribeDurable subscribes to the NewBlob events, and replays the events missed since the last event processed by
+// the subscriber (if the event log is enabled, it's a regular subscription otherwise).
+//
+// The events are delivered at least once, and in order: once a callback fails, the subscriber offset stays on the
+// failed event, and the next events are delivered by replaying the log from there.
+func (h *Hub) SubscribeDurable(ctx context.Context, name string, callback func(context.Context, *blob.Blob, interface{}) error) error {
+	h.log.Info("new durable subscription", "name", name, "event_log", h.eventLog != nil)
+	h.durableMu.Lock()
+	defer h.durableMu.Unlock()
+	sub := &durableSubscriber{callback: callback}
+	if h.eventLog != nil {
+		offset, err := h.eventLog.Offset(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to replay the events for %q: %w", name, err)
+		}
+		sub.delivered = offset
+		if err := h.replay(ctx, name, sub, 0, nil); err != nil {
+			return fmt.Errorf("failed to replay the events for %q: %w", name, err)
+		}
+		if sub.delivered > h.lastOffset {
+			h.lastOffset = sub.delivered
+		}
+	}
+	h.durable[name] = sub
+	return nil
+}
+
+// replay delivers the events the subscriber has not processed yet, up to the `until` offset (if set, its data being
+// `data`), the caller must hold the subscriber lock (or the hub lock before the subscription)
+func (h *Hub) replay(ctx context.Context, name string, sub *durableSubscriber, until int64, data interface{}) error {
+	var replayed int
+	if err := h.eventLog.Replay(ctx, sub.delivered, func(offset int64, blob *blob.Blob) error {
+		if until > 0 && offset > until {
+			return errStopReplay
+		}
+		var eventData interface{}
+		if offset == until {
+			eventData = data
+		}
+		if err := sub.callback(ctx, blob, eventData); err != nil {
+			return err
+		}
+		replayed++
+		sub.delivered = offset
+		return h.eventLog.Commit(ctx, name, offset)
+	}); err != nil && err != errStopReplay {
+		return err
+	}
+	if replayed > 0 {
+		h.log.Debug("events replayed", "name", name, "count", replayed)
+	}
+	return nil
 }
 
 func (h *Hub) Subscribe(etype EventType, name string, callback func(context.Context, *blob.Blob, interface{}) error) {
 	h.log.Info("new subscription", "type", etype, "name", name)
+	h.subscribersMu.Lock()
+	defer h.subscribersMu.Unlock()
 	h.subscribers[etype][name] = callback
 }
 
 func (h *Hub) newEvent(ctx context.Context, etype EventType, blob *blob.Blob, data interface{}) error {
 	l := h.log.New("type", etype, "blob", blob, "data", data)
 	l.Debug("new event")
+	// The callbacks are called without the lock held, so they can subscribe too
+	h.subscribersMu.RLock()
+	callbacks := make(map[string]callbackFunc, len(h.subscribers[etype]))
 	for name, callback := range h.subscribers[etype] {
+		callbacks[name] = callback
+	}
+	h.subscribersMu.RUnlock()
+	for name, callback := range callbacks {
 		h.log.Debug("triggering callback", "name", name)
 		if err := callback(ctx, blob, data); err != nil {
 			return err
@@ -45,10 +162,118 @@ func (h *Hub) newEvent(ctx context.Context, etype EventType, blob *blob.Blob, da
 	return nil
 }
 
+// durableEvent persists the event (if the event log is enabled) before calling the durable subscribers, the errors
+// are only logged as the blob is already saved (the failed events are replayed later if the event log is enabled)
+func (h *Hub) durableEvent(ctx context.Context, blob *blob.Blob, data interface{}) {
+	// Only the append is serialized, the subscribers are called without the hub lock held
+	h.durableMu.Lock()
+	if len(h.durable) == 0 {
+		h.durableMu.Unlock()
+		return
+	}
+	var offset, prev int64
+	var persisted bool
+	if h.eventLog != nil {
+		var err error
+		if offset, err = h.eventLog.Append(ctx, blob); err != nil {
+			h.log.Error("failed to persist the event", "blob", blob.Hash, "err", err)
+		} else {
+			prev = h.lastOffset
+			h.lastOffset = offset
+			persisted = true
+		}
+	}
+	subs := make(map[string]*durableSubscriber, len(h.durable))
+	for name, sub := range h.durable {
+		subs[name] = sub
+	}
+	h.durableMu.Unlock()
+
+	for name, sub := range subs {
+		switch {
+		case h.eventLog == nil:
+			h.log.Debug("triggering durable callback", "name", name)
+			if err := sub.callback(ctx, blob, data); err != nil {
+				h.log.Error("durable callback failed", "name", name, "blob", blob.Hash, "err", err)
+			}
+		case persisted:
+			h.deliver(ctx, name, sub, blob, data, offset, prev)
+		default:
+			h.deliverUnpersisted(ctx, name, sub, blob, data)
+		}
+	}
+}
+
+// deliverPending delivers the events kept in memory, returns false if a callback failed
+func (h *Hub) deliverPending(ctx context.Context, name string, sub *durableSubscriber) bool {
+	for len(sub.pending) > 0 {
+		if err := sub.callback(ctx, sub.pending[0], nil); err != nil {
+			h.log.Error("durable subscriber still failing", "name", name, "err", err)
+			return false
+		}
+		sub.pending = sub.pending[1:]
+	}
+	return true
+}
+
+// deliver delivers a persisted event, along with the previous events not delivered yet (the failed ones, and the ones
+// of the concurrent publishers)
+func (h *Hub) deliver(ctx context.Context, name string, sub *durableSubscriber, blob *blob.Blob, data interface{}, offset, prev int64) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if offset <= sub.delivered {
+		// Already delivered by a replay
+		return
+	}
+	if !h.deliverPending(ctx, name, sub) {
+		sub.lagging = true
+		return
+	}
+	if sub.lagging || sub.delivered != prev {
+		if err := h.replay(ctx, name, sub, offset, data); err != nil {
+			h.log.Error("durable subscriber still failing", "name", name, "err", err)
+			sub.lagging = true
+			return
+		}
+		sub.lagging = false
+		return
+	}
+	h.log.Debug("triggering durable callback", "name", name)
+	if err := sub.callback(ctx, blob, data); err != nil {
+		h.log.Error("durable callback failed", "name", name, "blob", blob.Hash, "err", err)
+		sub.lagging = true
+		return
+	}
+	sub.delivered = offset
+	if err := h.eventLog.Commit(ctx, name, offset); err != nil {
+		h.log.Error("failed to commit the offset", "name", name, "err", err)
+	}
+}
+
+// deliverUnpersisted delivers an event that could not be appended to the log, it's kept in memory until the
+// subscriber processes it
+func (h *Hub) deliverUnpersisted(ctx context.Context, name string, sub *durableSubscriber, blob *blob.Blob, data interface{}) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if h.deliverPending(ctx, name, sub) {
+		err := sub.callback(ctx, blob, data)
+		if err == nil {
+			return
+		}
+		h.log.Error("durable callback failed", "name", name, "blob", blob.Hash, "err", err)
+	}
+	if len(sub.pending) >= maxPendingEvents {
+		h.log.Error("too many pending events, dropping the oldest one", "name", name, "blob", sub.pending[0].Hash)
+		sub.pending = sub.pending[1:]
+	}
+	sub.pending = append(sub.pending, blob)
+}
+
 func (h *Hub) NewBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
 	if err := h.newEvent(ctx, NewBlob, blob, data); err != nil {
 		return err
 	}
+	h.durableEvent(ctx, blob, data)
 
 	// FIXME(tsileo): allow event to choose root or not
 	if h.root {
@@ -66,6 +291,11 @@ func (h *Hub) NewBlobEvent(ctx context.Context, blob *blob.Blob, data interface{
 	return nil
 }
 
+// PutBlobEvent is triggered before a new blob is saved, the blob is not saved if any callback returns an error
+func (h *Hub) PutBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, PutBlob, blob, data)
+}
+
 func (h *Hub) ScanBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
 	return h.newEvent(ctx, ScanBlob, blob, data)
 }
@@ -74,6 +304,11 @@ func (h *Hub) FiletreeFSUpdateEvent(ctx context.Context, blob *blob.Blob, data i
 	return h.newEvent(ctx, FiletreeFSUpdate, blob, data)
 }
 
+// DeleteKvVersionEvent is triggered after a kvstore version is removed
+func (h *Hub) DeleteKvVersionEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, DeleteKvVersion, blob, data)
+}
+
 func (h *Hub) NewDeleteRemoteBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
 	return h.newEvent(ctx, DeleteRemoteBlob, blob, data)
 }
@@ -85,8 +320,9 @@ func (h *Hub) NewSyncRemoteBlobEvent(ctx context.Context, blob *blob.Blob, data
 func New(logger log.Logger, root bool) *Hub {
 	logger.Debug("init")
 	return &Hub{
-		root: root,
-		log:  logger,
+		root:    root,
+		log:     logger,
+		durable: map[string]*durableSubscriber{},
 		subscribers: map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error{
 			NewBlob:          map[string]func(context.Context, *blob.Blob, interface{}) error{},
 			ScanBlob:         map[string]func(context.Context, *blob.Blob, interface{}) error{},
@@ -94,6 +330,8 @@ func New(logger log.Logger, root bool) *Hub {
 			SyncRemoteBlob:   map[string]func(context.Context, *blob.Blob, interface{}) error{},
 			NewFiletreeNode:  map[string]func(context.Context, *blob.Blob, interface{}) error{},
 			DeleteRemoteBlob: map[string]func(context.Context, *blob.Blob, interface{}) error{},
+			PutBlob:          map[string]func(context.Context, *blob.Blob, interface{}) error{},
+			DeleteKvVersion:  map[string]func(context.Context, *blob.Blob, interface{}) error{},
 		},
 	}
 }
@@ -0,0 +1,483 @@
+/*
+
+Package rules implements user-defined Lua rules triggered by the hub events.
+
+A rule is a Lua script subscribed to an event type (the same types as the webhooks), it's executed for every event
+with the event available in the `event` global (`event.type` and `event.data`, the webhook payload), and acts as both
+the predicate and the action, e.g. tagging the files uploaded in an "inbox" dir and notifying an external service:
+
+	if event.data.fs_path:match('^inbox/') then
+	  local kvstore = require('kvstore')
+	  kvstore.put('tags:' .. event.data.node_ref, 'inbox')
+	  require('rule').post_json('https://example.com/hook', event.data)
+	end
+
+The rules are stored in the kvstore (under `_rules:<name>`), and reloaded as soon as their kv entry changes. They are
+executed asynchronously by a single worker (the events are dropped if the queue is full), and the events triggered by
+the rules themselves never trigger other rules.
+
+*/
+package rules // import "a4.io/blobstash/pkg/hub/rules"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/apps/luautil"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	bsLua "a4.io/blobstash/pkg/blobstore/lua"
+	"a4.io/blobstash/pkg/extra"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/hub/webhook"
+	kvsLua "a4.io/blobstash/pkg/kvstore/lua"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// KeyPrefix is the prefix of the kv keys holding the rules
+const KeyPrefix = "_rules:"
+
+const (
+	queueSize  = 1000
+	runTimeout = 30 * time.Second
+)
+
+var (
+	// ErrInvalidRule is returned when saving a rule with an invalid name, event type or script
+	ErrInvalidRule = errors.New("invalid rule")
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	validEvents = map[string]bool{
+		webhook.BlobNew:        true,
+		webhook.KvVersion:      true,
+		webhook.FiletreeUpdate: true,
+	}
+)
+
+type key int
+
+// Set on the context of the rules executions, to prevent them from triggering other rules
+const ruleKey key = 0
+
+// Rule holds a Lua script executed for every event of the given type
+type Rule struct {
+	Name     string `json:"name"`
+	Event    string `json:"event"`
+	Script   string `json:"script"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	// Error returned by the last execution of the rule (not persisted)
+	LastError string `json:"last_error,omitempty"`
+}
+
+type event struct {
+	etype   string
+	payload []byte
+}
+
+// Rules maintains the rules from the kvstore, and executes them for the hub events
+type Rules struct {
+	kvs    store.KvStore
+	bs     store.BlobStore
+	rules  map[string]*Rule
+	events chan *event
+	client *http.Client
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	log  log.Logger
+	mu   sync.Mutex
+}
+
+// New loads the rules and subscribes to the hub events
+func New(logger log.Logger, kvs store.KvStore, bs store.BlobStore, h *hub.Hub) (*Rules, error) {
+	logger.Debug("init")
+	rules := &Rules{
+		kvs:    kvs,
+		bs:     bs,
+		rules:  map[string]*Rule{},
+		events: make(chan *event, queueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+		log:    logger,
+	}
+	if err := rules.load(context.Background()); err != nil {
+		return nil, err
+	}
+	h.Subscribe(hub.NewBlob, "rules", rules.newBlobCallback)
+	h.Subscribe(hub.FiletreeFSUpdate, "rules", rules.filetreeUpdateCallback)
+	rules.wg.Add(1)
+	go rules.worker()
+	return rules, nil
+}
+
+// Close stops the worker
+func (rs *Rules) Close() error {
+	close(rs.stop)
+	rs.wg.Wait()
+	return nil
+}
+
+// load (re)loads all the rules from the kvstore
+func (rs *Rules) load(ctx context.Context) error {
+	keys, _, err := rs.kvs.Keys(ctx, KeyPrefix, KeyPrefix+"\xff", 0)
+	if err != nil {
+		return err
+	}
+	rules := map[string]*Rule{}
+	for _, kv := range keys {
+		if kv.Tombstone || len(kv.Data) == 0 {
+			continue
+		}
+		rule := &Rule{}
+		if err := json.Unmarshal(kv.Data, rule); err != nil {
+			return fmt.Errorf("failed to load rule %q: %v", kv.Key, err)
+		}
+		rules[rule.Name] = rule
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	// Keep the last errors of the unchanged rules
+	for name, rule := range rules {
+		if old, ok := rs.rules[name]; ok && old.Script == rule.Script {
+			rule.LastError = old.LastError
+		}
+	}
+	rs.rules = rules
+	return nil
+}
+
+// Rules returns all the rules, sorted by name
+func (rs *Rules) Rules() []*Rule {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	out := []*Rule{}
+	for _, rule := range rs.rules {
+		r := *rule
+		out = append(out, &r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Get returns the rule with the given name (nil if it does not exist)
+func (rs *Rules) Get(name string) *Rule {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rule, ok := rs.rules[name]; ok {
+		r := *rule
+		return &r
+	}
+	return nil
+}
+
+// Save validates and saves the rule, the rule is active right away
+func (rs *Rules) Save(ctx context.Context, rule *Rule) error {
+	if !validName.MatchString(rule.Name) {
+		return fmt.Errorf("%w: name must match %s", ErrInvalidRule, validName)
+	}
+	if !validEvents[rule.Event] {
+		return fmt.Errorf("%w: unknown event %q", ErrInvalidRule, rule.Event)
+	}
+	L := lua.NewState()
+	defer L.Close()
+	if _, err := L.LoadString(rule.Script); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+
+	rule.LastError = ""
+	js, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.kvs.Put(ctx, KeyPrefix+rule.Name, "", js, -1); err != nil {
+		return err
+	}
+	return rs.load(ctx)
+}
+
+// Delete deletes the rule
+func (rs *Rules) Delete(ctx context.Context, name string) error {
+	if _, err := rs.kvs.Delete(ctx, KeyPrefix+name, -1); err != nil {
+		return err
+	}
+	return rs.load(ctx)
+}
+
+func (rs *Rules) newBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	if _, ok := ctx.Value(ruleKey).(string); ok {
+		return nil
+	}
+	if metaType, data, isMeta := meta.IsMetaBlob(blb.Data); isMeta && (metaType == vkv.KvType || metaType == vkv.KvBatchType) {
+		kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			// Hot-reload the rules updated via the kvstore API
+			if strings.HasPrefix(kv.Key, KeyPrefix) {
+				go func() {
+					if err := rs.load(context.Background()); err != nil {
+						rs.log.Error("failed to reload the rules", "err", err)
+					}
+				}()
+				continue
+			}
+			rs.enqueue(webhook.KvVersion, map[string]interface{}{
+				"key":       kv.Key,
+				"version":   kv.Version,
+				"hash":      kv.HexHash(),
+				"tombstone": kv.Tombstone,
+			})
+		}
+		return nil
+	}
+	rs.enqueue(webhook.BlobNew, map[string]interface{}{
+		"hash": blb.Hash,
+		"size": len(blb.Data),
+		"meta": blb.IsMeta() || blb.IsFiletreeNode(),
+	})
+	return nil
+}
+
+func (rs *Rules) filetreeUpdateCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	if _, ok := ctx.Value(ruleKey).(string); ok {
+		return nil
+	}
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("unexpected filetree event data %+v", data)
+	}
+	rs.enqueue(webhook.FiletreeUpdate, json.RawMessage(js))
+	return nil
+}
+
+// enqueue queues the event if a rule is subscribed to it, the event is dropped if the queue is full (the rules must
+// never slow down the writes)
+func (rs *Rules) enqueue(etype string, data interface{}) {
+	rs.mu.Lock()
+	var subscribed bool
+	for _, rule := range rs.rules {
+		if rule.Event == etype && !rule.Disabled {
+			subscribed = true
+			break
+		}
+	}
+	rs.mu.Unlock()
+	if !subscribed {
+		return
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		rs.log.Error("failed to encode event", "event", etype, "err", err)
+		return
+	}
+	select {
+	case rs.events <- &event{etype, payload}:
+	default:
+		rs.log.Error("rules queue is full, dropping event", "event", etype)
+	}
+}
+
+func (rs *Rules) worker() {
+	defer rs.wg.Done()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case evt := <-rs.events:
+			for _, rule := range rs.Rules() {
+				if rule.Event != evt.etype || rule.Disabled {
+					continue
+				}
+				err := rs.run(rule, evt)
+				if err != nil {
+					rs.log.Error("rule failed", "rule", rule.Name, "event", evt.etype, "err", err)
+				}
+				rs.mu.Lock()
+				if current, ok := rs.rules[rule.Name]; ok && current.Script == rule.Script {
+					current.LastError = ""
+					if err != nil {
+						current.LastError = err.Error()
+					}
+				}
+				rs.mu.Unlock()
+			}
+		}
+	}
+}
+
+// run executes the rule for the event
+func (rs *Rules) run(rule *Rule, evt *event) error {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ruleKey, rule.Name), runTimeout)
+	defer cancel()
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetContext(ctx)
+
+	kvsLua.Setup(L, rs.kvs, ctx)
+	bsLua.Setup(ctx, L, rs.bs)
+	extra.Setup(L)
+	L.PreloadModule("rule", rs.setupRuleModule(ctx, rule))
+
+	tbl := L.NewTable()
+	tbl.RawSetString("type", lua.LString(evt.etype))
+	tbl.RawSetString("data", luautil.FromJSON(L, evt.payload))
+	L.SetGlobal("event", tbl)
+
+	return L.DoString(rule.Script)
+}
+
+// setupRuleModule returns the `rule` module, holding the actions that don't fit in the other modules
+func (rs *Rules) setupRuleModule(ctx context.Context, rule *Rule) func(*lua.LState) int {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"name": func(L *lua.LState) int {
+				L.Push(lua.LString(rule.Name))
+				return 1
+			},
+			"log": func(L *lua.LState) int {
+				rs.log.Info(L.ToString(1), "rule", rule.Name)
+				return 0
+			},
+			// post_json(url, data) returns the response status code
+			"post_json": func(L *lua.LState) int {
+				req, err := http.NewRequest("POST", L.ToString(1), bytes.NewReader(luautil.ToJSON(L, L.Get(2))))
+				if err != nil {
+					L.RaiseError("invalid request: %v", err)
+					return 0
+				}
+				req = req.WithContext(ctx)
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := rs.client.Do(req)
+				if err != nil {
+					L.RaiseError("request failed: %v", err)
+					return 0
+				}
+				defer resp.Body.Close()
+				io.Copy(io.Discard, resp.Body)
+				L.Push(lua.LNumber(resp.StatusCode))
+				return 1
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+func (rs *Rules) rulesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.Rule),
+			perms.Resource(perms.Hub, perms.Rule),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": rs.Rules(),
+		})
+	}
+}
+
+func (rs *Rules) ruleHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		switch r.Method {
+		case "GET":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.Rule),
+				perms.ResourceWithID(perms.Hub, perms.Rule, name),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			rule := rs.Get(name)
+			if rule == nil {
+				httputil.WriteJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+				return
+			}
+			httputil.MarshalAndWrite(r, w, rule)
+		case "PUT":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.Rule),
+				perms.ResourceWithID(perms.Hub, perms.Rule, name),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			rule := &Rule{}
+			if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			rule.Name = name
+			if err := rs.Save(r.Context(), rule); err != nil {
+				if errors.Is(err, ErrInvalidRule) {
+					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+					return
+				}
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, rule)
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.Rule),
+				perms.ResourceWithID(perms.Hub, perms.Rule, name),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if rs.Get(name) == nil {
+				httputil.WriteJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+				return
+			}
+			if err := rs.Delete(r.Context(), name); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Register registers the rules API
+func (rs *Rules) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(rs.rulesHandler())))
+	r.Handle("/{name}", basicAuth(http.HandlerFunc(rs.ruleHandler())))
+}
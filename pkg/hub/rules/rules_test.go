@@ -0,0 +1,126 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// memKvStore is a minimal in-memory kvstore (only the methods used by the rules are implemented)
+type memKvStore struct {
+	store.KvStore
+	data map[string][]byte
+}
+
+func (m *memKvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	m.data[key] = data
+	return &vkv.KeyValue{Key: key, Data: data, Version: time.Now().UnixNano()}, nil
+}
+
+func (m *memKvStore) Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	delete(m.data, key)
+	return &vkv.KeyValue{Key: key, Tombstone: true}, nil
+}
+
+func (m *memKvStore) Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
+	out := []*vkv.KeyValue{}
+	for k, v := range m.data {
+		if k >= start && k <= end {
+			out = append(out, &vkv.KeyValue{Key: k, Data: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, "", nil
+}
+
+func TestRules(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		check(err)
+		payload := map[string]interface{}{}
+		check(json.Unmarshal(body, &payload))
+		received <- payload
+	}))
+	defer srv.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	kvs := &memKvStore{data: map[string][]byte{}}
+	rs, err := New(logger, kvs, nil, h)
+	check(err)
+	defer rs.Close()
+
+	ctx := context.Background()
+	for _, rule := range []*Rule{
+		&Rule{Name: "bad name", Event: "blob.new"},
+		&Rule{Name: "notify", Event: "nope"},
+		&Rule{Name: "notify", Event: "blob.new", Script: "if then"},
+	} {
+		if err := rs.Save(ctx, rule); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("expected ErrInvalidRule for %+v, got %v", rule, err)
+		}
+	}
+
+	check(rs.Save(ctx, &Rule{
+		Name:  "notify",
+		Event: "blob.new",
+		Script: `
+if event.data.size > 3 then
+  local kvstore = require('kvstore')
+  kvstore.put('notified:' .. event.data.hash, 'ok')
+  require('rule').post_json('` + srv.URL + `', {hash = event.data.hash, rule = require('rule').name()})
+end`,
+	}))
+	if rules := rs.Rules(); len(rules) != 1 || rules[0].Name != "notify" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+
+	// Too small, filtered by the rule
+	small := []byte("hi")
+	h.NewBlobEvent(ctx, &blob.Blob{Hash: hashutil.Compute(small), Data: small}, nil)
+	data := []byte("hello")
+	hash := hashutil.Compute(data)
+	h.NewBlobEvent(ctx, &blob.Blob{Hash: hash, Data: data}, nil)
+
+	select {
+	case payload := <-received:
+		if payload["hash"] != hash || payload["rule"] != "notify" {
+			t.Errorf("unexpected payload %+v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rule not executed")
+	}
+	if string(kvs.data["notified:"+hash]) != "ok" {
+		t.Errorf("kv not set by the rule")
+	}
+	if _, ok := kvs.data["notified:"+hashutil.Compute(small)]; ok {
+		t.Errorf("rule should have filtered the small blob")
+	}
+
+	check(rs.Delete(ctx, "notify"))
+	if rule := rs.Get("notify"); rule != nil {
+		t.Errorf("rule should have been deleted")
+	}
+}
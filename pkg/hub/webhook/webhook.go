@@ -0,0 +1,562 @@
+/*
+
+Package webhook implements the delivery of the hub events to webhooks.
+
+Each webhook has its own disk-backed queue (so a failing endpoint only delays its own deliveries), the payloads are
+signed with HMAC-SHA256, and the deliveries failing after all the retries are moved to a dead-letter queue that can be
+inspected (and retried) via the API.
+
+*/
+package webhook // import "a4.io/blobstash/pkg/hub/webhook"
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Event types
+const (
+	BlobNew        = "blob.new"
+	KvVersion      = "kv.version"
+	FiletreeUpdate = "filetree.update"
+)
+
+// Headers set on the deliveries
+const (
+	EventHeader      = "BlobStash-Webhook-Event"
+	DeliveryHeader   = "BlobStash-Webhook-Delivery"
+	SignatureHeader  = "BlobStash-Webhook-Signature"
+	maxAttempts      = 5
+	deliveryTimeout  = 10 * time.Second
+	deadLetterPrefix = "dead:"
+)
+
+var (
+	// Delay before the first retry, doubled after each failed attempt
+	initialBackoff = 1 * time.Second
+	// Delay before polling the queue again when it's empty
+	emptyQueueWait = 1 * time.Second
+)
+
+// Delivery holds an event to deliver to a webhook
+type Delivery struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Event     string          `json:"event"`
+	Time      int64           `json:"time"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+}
+
+type webhook struct {
+	conf   *config.Webhook
+	events map[string]bool
+	queue  *queue.Queue
+
+	// Closed to stop the worker of a webhook removed from the config
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Webhooks dispatches the hub events to the configured webhooks
+type Webhooks struct {
+	hooks  []*webhook
+	dead   *rangedb.RangeDB
+	client *http.Client
+
+	// Protects the hooks (updated when the config is reloaded)
+	mu         sync.RWMutex
+	h          *hub.Hub
+	varDir     string
+	subscribed bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	log  log.Logger
+}
+
+// New initializes the webhooks from the config, and subscribes to the hub events
+func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*Webhooks, error) {
+	logger.Debug("init")
+	dead, err := rangedb.New(filepath.Join(conf.VarDir(), "webhooks-dead.index"))
+	if err != nil {
+		return nil, err
+	}
+	wh := &Webhooks{
+		dead:   dead,
+		client: &http.Client{Timeout: deliveryTimeout},
+		h:      h,
+		varDir: conf.VarDir(),
+		stop:   make(chan struct{}),
+		log:    logger,
+	}
+	if err := wh.Reload(conf); err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func newEvents(hookConf *config.Webhook) map[string]bool {
+	events := map[string]bool{}
+	for _, evt := range hookConf.Events {
+		events[evt] = true
+	}
+	return events
+}
+
+// queuePath returns the path of the queue of the webhook, the queues are keyed by URL so a webhook keeps its queue
+// when the others are added/removed
+func (wh *Webhooks) queuePath(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(wh.varDir, fmt.Sprintf("webhook-%s.queue", hex.EncodeToString(h[:8])))
+}
+
+// Reload applies the webhooks from the config: the existing webhooks are updated (the queues are kept), the new ones
+// are started and the removed ones are stopped (their pending deliveries stay in their queue, and are delivered if
+// the webhook is added back).
+//
+// The webhooks are matched by URL, and the new config is applied at once (nothing is changed if it fails).
+func (wh *Webhooks) Reload(conf *config.Config) error {
+	wh.mu.Lock()
+	seen := map[string]bool{}
+	for _, hookConf := range conf.Webhooks {
+		if seen[hookConf.URL] {
+			wh.mu.Unlock()
+			return fmt.Errorf("duplicate webhook %q", hookConf.URL)
+		}
+		seen[hookConf.URL] = true
+	}
+
+	// Open the queues of the new webhooks first, as it may fail
+	current := map[string]*webhook{}
+	for _, hook := range wh.hooks {
+		current[hook.conf.URL] = hook
+	}
+	added := map[string]*queue.Queue{}
+	for _, hookConf := range conf.Webhooks {
+		if _, ok := current[hookConf.URL]; ok {
+			continue
+		}
+		q, err := queue.New(wh.queuePath(hookConf.URL))
+		if err != nil {
+			for _, q := range added {
+				q.Close()
+			}
+			wh.mu.Unlock()
+			return err
+		}
+		added[hookConf.URL] = q
+	}
+
+	hooks := []*webhook{}
+	for _, hookConf := range conf.Webhooks {
+		if hook, ok := current[hookConf.URL]; ok {
+			hook.conf = hookConf
+			hook.events = newEvents(hookConf)
+			hooks = append(hooks, hook)
+			delete(current, hookConf.URL)
+			continue
+		}
+		hook := &webhook{
+			conf:   hookConf,
+			queue:  added[hookConf.URL],
+			events: newEvents(hookConf),
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		hooks = append(hooks, hook)
+		// Added before starting the worker so a concurrent Close waits for it
+		wh.wg.Add(1)
+		go wh.worker(hook)
+	}
+	wh.hooks = hooks
+	subscribe := len(wh.hooks) > 0 && !wh.subscribed
+	wh.subscribed = wh.subscribed || subscribe
+	wh.mu.Unlock()
+
+	// The workers may be waiting for the lock
+	for _, hook := range current {
+		close(hook.stop)
+		<-hook.done
+		hook.queue.Close()
+	}
+
+	if subscribe {
+		// Replay the events missed since the last run (if the hub event log is enabled)
+		if err := wh.h.SubscribeDurable(context.Background(), "webhooks", wh.newBlobCallback); err != nil {
+			return err
+		}
+		wh.h.Subscribe(hub.FiletreeFSUpdate, "webhooks", wh.filetreeUpdateCallback)
+	}
+	return nil
+}
+
+// Close stops the workers
+func (wh *Webhooks) Close() error {
+	close(wh.stop)
+	wh.wg.Wait()
+	wh.mu.RLock()
+	hooks := wh.hooks
+	wh.mu.RUnlock()
+	for _, hook := range hooks {
+		<-hook.done
+		hook.queue.Close()
+	}
+	return wh.dead.Close()
+}
+
+func (wh *Webhooks) newBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	if metaType, data, isMeta := meta.IsMetaBlob(blb.Data); isMeta && (metaType == vkv.KvType || metaType == vkv.KvBatchType) {
+		kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+		if err != nil {
+			return err
+		}
+		// One event per version, even for batches
+		for _, kv := range kvs {
+			if err := wh.dispatch(KvVersion, map[string]interface{}{
+				"key":       kv.Key,
+				"version":   kv.Version,
+				"hash":      kv.HexHash(),
+				"tombstone": kv.Tombstone,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return wh.dispatch(BlobNew, map[string]interface{}{
+		"hash": blb.Hash,
+		"size": len(blb.Data),
+		"meta": blb.IsMeta() || blb.IsFiletreeNode(),
+	})
+}
+
+func (wh *Webhooks) filetreeUpdateCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("unexpected filetree event data %+v", data)
+	}
+	return wh.dispatch(FiletreeUpdate, json.RawMessage(js))
+}
+
+// dispatch enqueues the event for every webhook subscribed to it
+func (wh *Webhooks) dispatch(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().UnixNano()
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+	for _, hook := range wh.hooks {
+		if len(hook.events) > 0 && !hook.events[event] {
+			continue
+		}
+		did, err := id.New(now)
+		if err != nil {
+			return err
+		}
+		if _, err := hook.queue.Enqueue(&Delivery{
+			ID:      did.String(),
+			URL:     hook.conf.URL,
+			Event:   event,
+			Time:    now,
+			Payload: payload,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wh *Webhooks) worker(hook *webhook) {
+	defer wh.wg.Done()
+	defer close(hook.done)
+	wh.mu.RLock()
+	log := wh.log.New("worker", "webhook_worker", "url", hook.conf.URL)
+	wh.mu.RUnlock()
+	log.Debug("starting worker")
+	for {
+		select {
+		case <-wh.stop:
+			log.Debug("worker stopped")
+			return
+		case <-hook.stop:
+			log.Debug("worker stopped (webhook removed)")
+			return
+		default:
+		}
+
+		d := &Delivery{}
+		ok, deqFunc, err := hook.queue.Dequeue(d)
+		if err != nil {
+			log.Error("failed to dequeue", "err", err)
+		}
+		if !ok || err != nil {
+			select {
+			case <-wh.stop:
+			case <-hook.stop:
+			case <-time.After(emptyQueueWait):
+			}
+			continue
+		}
+
+		if err := wh.deliverWithRetry(hook, d); err != nil {
+			if err == errStopped {
+				// Keep the delivery in the queue, it will be retried after the restart
+				log.Debug("delivery interrupted", "delivery", d.ID)
+				deqFunc(false)
+				return
+			}
+			log.Error("delivery failed, moving it to the dead-letter queue", "delivery", d.ID, "err", err)
+			if err := wh.addDead(d); err != nil {
+				// Keep the delivery in the queue, it will be retried
+				log.Error("failed to save the failed delivery", "delivery", d.ID, "err", err)
+				deqFunc(false)
+				continue
+			}
+		}
+		deqFunc(true)
+	}
+}
+
+// errStopped is returned when the worker is stopped while a delivery is retried
+var errStopped = errors.New("webhook worker stopped")
+
+// deliverWithRetry tries to deliver the event until it succeeds, or the retries are exhausted
+func (wh *Webhooks) deliverWithRetry(hook *webhook, d *Delivery) error {
+	backoff := initialBackoff
+	for {
+		d.Attempts++
+		wh.mu.RLock()
+		secret := hook.conf.Secret
+		wh.mu.RUnlock()
+		err := wh.deliver(secret, d)
+		if err == nil {
+			return nil
+		}
+		d.LastError = err.Error()
+		if d.Attempts >= maxAttempts {
+			return err
+		}
+		select {
+		case <-wh.stop:
+			return errStopped
+		case <-hook.stop:
+			return errStopped
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Sign returns the signature of the payload (hex-encoded HMAC-SHA256), as sent in the signature header
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhooks) deliver(secret string, d *Delivery) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    d.ID,
+		"event": d.Event,
+		"time":  d.Time,
+		"data":  d.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, d.ID)
+	if secret != "" {
+		req.Header.Set(SignatureHeader, Sign(secret, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (wh *Webhooks) addDead(d *Delivery) error {
+	js, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return wh.dead.Set([]byte(deadLetterPrefix+d.ID), js)
+}
+
+// DeadLetters returns the failed deliveries
+func (wh *Webhooks) DeadLetters() ([]*Delivery, error) {
+	out := []*Delivery{}
+	c := wh.dead.PrefixRange([]byte(deadLetterPrefix), false)
+	defer c.Close()
+	_, v, err := c.Next()
+	for ; err == nil; _, v, err = c.Next() {
+		d := &Delivery{}
+		if err := json.Unmarshal(v, d); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (wh *Webhooks) deadLetter(did string) (*Delivery, error) {
+	js, err := wh.dead.Get([]byte(deadLetterPrefix + did))
+	if err != nil || js == nil {
+		return nil, err
+	}
+	d := &Delivery{}
+	if err := json.Unmarshal(js, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Retry re-enqueues a failed delivery, returns false if it does not exist
+func (wh *Webhooks) Retry(did string) (bool, error) {
+	d, err := wh.deadLetter(did)
+	if err != nil || d == nil {
+		return false, err
+	}
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+	for _, hook := range wh.hooks {
+		if hook.conf.URL != d.URL {
+			continue
+		}
+		d.Attempts = 0
+		d.LastError = ""
+		if _, err := hook.queue.Enqueue(d); err != nil {
+			return false, err
+		}
+		return true, wh.dead.Delete([]byte(deadLetterPrefix + did))
+	}
+	return false, fmt.Errorf("no webhook configured for %s", d.URL)
+}
+
+func (wh *Webhooks) deadLettersHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.Webhook),
+			perms.Resource(perms.Hub, perms.Webhook),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		deliveries, err := wh.DeadLetters()
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": deliveries,
+		})
+	}
+}
+
+func (wh *Webhooks) deadLetterHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		did := mux.Vars(r)["id"]
+		switch r.Method {
+		case "POST":
+			// Re-enqueue the delivery
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.Webhook),
+				perms.ResourceWithID(perms.Hub, perms.Webhook, did),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			ok, err := wh.Retry(did)
+			if err != nil {
+				panic(err)
+			}
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.Webhook),
+				perms.ResourceWithID(perms.Hub, perms.Webhook, did),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			d, err := wh.deadLetter(did)
+			if err != nil {
+				panic(err)
+			}
+			if d == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err := wh.dead.Delete([]byte(deadLetterPrefix + did)); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Register registers the HTTP handlers
+func (wh *Webhooks) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/dead", basicAuth(http.HandlerFunc(wh.deadLettersHandler())))
+	r.Handle("/dead/{id}", basicAuth(http.HandlerFunc(wh.deadLetterHandler())))
+}
@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	initialBackoff = 10 * time.Millisecond
+	emptyQueueWait = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "blobstash_webhook_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	received := make(chan map[string]interface{}, 10)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		check(err)
+		if sig := r.Header.Get(SignatureHeader); sig != Sign("s3cr3t", body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		payload := map[string]interface{}{}
+		check(json.Unmarshal(body, &payload))
+		received <- payload
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	wh, err := New(logger, &config.Config{
+		DataDir: dir,
+		Webhooks: []*config.Webhook{
+			&config.Webhook{URL: ok.URL, Secret: "s3cr3t", Events: []string{BlobNew}},
+			&config.Webhook{URL: failing.URL},
+		},
+	}, h)
+	check(err)
+	defer wh.Close()
+
+	data := []byte("hello")
+	h.NewBlobEvent(context.Background(), &blob.Blob{Hash: hashutil.Compute(data), Data: data}, nil)
+
+	select {
+	case payload := <-received:
+		if payload["event"] != BlobNew {
+			t.Errorf("unexpected event %v", payload["event"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	var dead []*Delivery
+	for i := 0; i < 100; i++ {
+		dead, err = wh.DeadLetters()
+		check(err)
+		if len(dead) > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(dead) != 1 || dead[0].URL != failing.URL || dead[0].Attempts != maxAttempts {
+		t.Fatalf("unexpected dead-letter queue %+v", dead)
+	}
+}
+
+func TestWebhooksReload(t *testing.T) {
+	emptyQueueWait = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "blobstash_webhook_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := func(hooks ...*config.Webhook) *config.Config {
+		return &config.Config{DataDir: dir, Webhooks: hooks}
+	}
+	a := &config.Webhook{URL: "http://a.invalid", Secret: "a"}
+	b := &config.Webhook{URL: "http://b.invalid", Secret: "b"}
+	c := &config.Webhook{URL: "http://c.invalid", Secret: "c"}
+	wh, err := New(logger, conf(a, b, c), hub.New(logger, true))
+	check(err)
+	defer wh.Close()
+	queues := map[string]interface{}{}
+	for _, hook := range wh.hooks {
+		queues[hook.conf.URL] = hook.queue
+	}
+
+	// Removing the webhook in the middle keeps the queues (and the secrets) of the other ones
+	check(wh.Reload(conf(a, c)))
+	if len(wh.hooks) != 2 {
+		t.Fatalf("unexpected webhooks %+v", wh.hooks)
+	}
+	for _, hook := range wh.hooks {
+		if queues[hook.conf.URL] != hook.queue || hook.conf.Secret != hook.conf.URL[7:8] {
+			t.Errorf("webhook %s did not keep its queue/secret", hook.conf.URL)
+		}
+	}
+	if wh.queuePath(a.URL) == wh.queuePath(c.URL) {
+		t.Errorf("the queues should be keyed by URL")
+	}
+
+	// An invalid config is not applied
+	if err := wh.Reload(conf(a, b, b)); err == nil {
+		t.Errorf("duplicate webhooks should be rejected")
+	}
+	if len(wh.hooks) != 2 {
+		t.Errorf("the failed reload should not change the webhooks")
+	}
+}
+
+func TestWebhooksStop(t *testing.T) {
+	initialBackoff = time.Hour
+	defer func() { initialBackoff = 1 * time.Second }()
+	emptyQueueWait = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "blobstash_webhook_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	attempted := make(chan struct{}, 10)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempted <- struct{}{}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	conf := &config.Config{DataDir: dir, Webhooks: []*config.Webhook{&config.Webhook{URL: failing.URL}}}
+	wh, err := New(logger, conf, h)
+	check(err)
+	data := []byte("hello")
+	h.NewBlobEvent(context.Background(), &blob.Blob{Hash: hashutil.Compute(data), Data: data}, nil)
+	select {
+	case <-attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not attempted")
+	}
+	// Stop the server while the delivery waits for its retry
+	check(wh.Close())
+
+	wh, err = New(logger, conf, hub.New(logger, true))
+	check(err)
+	defer wh.Close()
+	dead, err := wh.DeadLetters()
+	check(err)
+	if len(dead) != 0 {
+		t.Errorf("the interrupted delivery should not be dead-lettered %+v", dead)
+	}
+	select {
+	case <-attempted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the interrupted delivery should be retried after the restart")
+	}
+}
@@ -0,0 +1,158 @@
+package jobs // import "a4.io/blobstash/pkg/jobs"
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// StartRequest holds the kind and the params of a job to start
+type StartRequest struct {
+	Kind   string          `json:"kind"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Register registers the jobs API
+func (m *Manager) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("", basicAuth(http.HandlerFunc(m.jobsHandler())))
+	r.Handle("/{id}", basicAuth(http.HandlerFunc(m.jobHandler())))
+	r.Handle("/{id}/cancel", basicAuth(http.HandlerFunc(m.cancelHandler())))
+}
+
+// jobsHandler lists the jobs (GET) or starts a new one (POST)
+func (m *Manager) jobsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.Job),
+				perms.Resource(perms.Jobs, perms.Job),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			limit, err := q.GetIntDefault("limit", 50)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			jobs, err := m.List(q.Get("kind"), q.Get("state"), limit)
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": jobs,
+			})
+		case "POST":
+			sreq := &StartRequest{}
+			if err := httputil.Unmarshal(r, sreq); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Admin, perms.Job),
+				perms.ResourceWithID(perms.Jobs, perms.Job, sreq.Kind),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			var params interface{}
+			if len(sreq.Params) > 0 {
+				params = sreq.Params
+			}
+			job, err := m.Start(sreq.Kind, params)
+			switch err {
+			case nil:
+			case ErrUnknownKind:
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			case ErrAlreadyRunning:
+				httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+				return
+			default:
+				panic(err)
+			}
+			w.Header().Set("Location", r.URL.Path+"/"+job.ID)
+			httputil.MarshalAndWrite(r, w, job, httputil.WithStatusCode(http.StatusAccepted))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// jobHandler returns the job record
+func (m *Manager) jobHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Job),
+			perms.Resource(perms.Jobs, perms.Job),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		job, err := m.Get(mux.Vars(r)["id"])
+		switch err {
+		case nil:
+		case ErrNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, job)
+	}
+}
+
+// cancelHandler cancels a running (or pending) job
+func (m *Manager) cancelHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		job, err := m.Get(id)
+		switch err {
+		case nil:
+		case ErrNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Job),
+			perms.ResourceWithID(perms.Jobs, perms.Job, job.Kind),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		switch err := m.Cancel(id); err {
+		case nil:
+		case ErrFinished:
+			httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,628 @@
+// Package jobs implements the background jobs (verification, GC, re-keying...) with persistent records.
+//
+// Each job records its progress, its result and its attempts, the failed jobs are retried according to the retry
+// policy of their kind. The jobs interrupted by a shutdown are resumed once their kind is registered again (as long
+// as they have attempts left). The records of the finished jobs are removed once they are older than `Retention`.
+package jobs // import "a4.io/blobstash/pkg/jobs"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Job states
+const (
+	Running  = "running"
+	Pending  = "pending" // Waiting for the next attempt
+	Done     = "done"
+	Failed   = "failed"
+	Canceled = "canceled"
+)
+
+var (
+	// ErrNotFound is returned when the job does not exist
+	ErrNotFound = errors.New("job not found")
+
+	// ErrUnknownKind is returned when starting a job of an unregistered kind
+	ErrUnknownKind = errors.New("unknown job kind")
+
+	// ErrAlreadyRunning is returned when starting an exclusive job while another one of the same kind is running
+	ErrAlreadyRunning = errors.New("a job of this kind is already running")
+
+	// ErrFinished is returned when canceling a job that is already finished
+	ErrFinished = errors.New("job already finished")
+)
+
+// Min interval between the persistence of the progress of a running job
+var saveInterval = time.Second
+
+// Retention is how long the records of the finished jobs are kept
+var Retention = 30 * 24 * time.Hour
+
+// Interval between the removal of the expired records
+var pruneInterval = time.Hour
+
+// Progress holds the progress of a job
+type Progress struct {
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+// Job is the persistent record of a job
+type Job struct {
+	ID       string          `json:"id"`
+	Kind     string          `json:"kind"`
+	State    string          `json:"state"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Progress Progress        `json:"progress"`
+	Error    string          `json:"error,omitempty"`
+	Attempts int             `json:"attempts"`
+
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// Finished returns true if the job won't be run again
+func (j *Job) Finished() bool {
+	return j.State == Done || j.State == Failed || j.State == Canceled
+}
+
+func (j *Job) copy() *Job {
+	c := *j
+	return &c
+}
+
+// RetryPolicy defines how the failed jobs are retried
+type RetryPolicy struct {
+	// Max number of attempts (0 and 1 mean no retry)
+	MaxAttempts int
+
+	// Delay before the first retry, doubled after each failed attempt
+	Backoff time.Duration
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Kind defines a kind of job
+type Kind struct {
+	Name string
+
+	// Run performs the job, it must return as soon as possible once the context is canceled
+	Run func(context.Context, *Handle) error
+
+	Retry RetryPolicy
+
+	// Only a single job of the kind can run at a time
+	Exclusive bool
+
+	// Max number of jobs of the kind running at once (0 means no limit), the other ones are pending until a slot is
+	// available
+	Concurrency int
+}
+
+// Handle is the interface between a running job and its record
+type Handle struct {
+	m *Manager
+	e *entry
+}
+
+// ID returns the ID of the job
+func (h *Handle) ID() string {
+	return h.e.job.ID
+}
+
+// Attempt returns the current attempt (starting at 1)
+func (h *Handle) Attempt() int {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	return h.e.job.Attempts
+}
+
+// Params unmarshals the job parameters
+func (h *Handle) Params(v interface{}) error {
+	if len(h.e.job.Params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(h.e.job.Params, v)
+}
+
+// SetProgress updates the progress of the job
+func (h *Handle) SetProgress(done, total int64) {
+	h.m.update(h.e, false, func(j *Job) {
+		j.Progress = Progress{Done: done, Total: total}
+	})
+}
+
+// SetResult updates the (partial) result of the job
+func (h *Handle) SetResult(v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.m.update(h.e, false, func(j *Job) {
+		j.Result = js
+	})
+	return nil
+}
+
+// entry holds a job that is not finished yet
+type entry struct {
+	job      *Job
+	cancel   func()
+	canceled bool
+	savedAt  time.Time
+
+	// Closed once the job returns, err being the error of the last attempt
+	done chan struct{}
+	err  error
+}
+
+// Manager runs the jobs and keeps their records
+type Manager struct {
+	db    *rangedb.RangeDB
+	kinds map[string]*Kind
+	slots map[string]chan struct{} // Limits the number of running jobs of the kinds with a concurrency
+	live  map[string]*entry
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	log  log.Logger
+	mu   sync.Mutex
+}
+
+// New initializes the jobs manager, the records are stored in `dir`
+func New(logger log.Logger, dir string) (*Manager, error) {
+	db, err := rangedb.New(filepath.Join(dir, "jobs.index"))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		db:    db,
+		kinds: map[string]*Kind{},
+		slots: map[string]chan struct{}{},
+		live:  map[string]*entry{},
+		stop:  make(chan struct{}),
+		log:   logger,
+	}
+	m.wg.Add(1)
+	go m.pruneWorker()
+	return m, nil
+}
+
+// Close cancels the running jobs (they will be resumed on the next start) and closes the records DB
+func (m *Manager) Close() error {
+	close(m.stop)
+	m.mu.Lock()
+	for _, e := range m.live {
+		e.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	return m.db.Close()
+}
+
+// newID returns a time-ordered ID, so the records are listed by creation date
+func newID(t time.Time) (string, error) {
+	raw := make([]byte, 12)
+	binary.BigEndian.PutUint64(raw, uint64(t.UnixNano()))
+	if _, err := rand.Read(raw[8:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// RegisterKind registers a kind of job, and resumes its interrupted jobs
+func (m *Manager) RegisterKind(k *Kind) error {
+	m.mu.Lock()
+	if _, ok := m.kinds[k.Name]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("job kind %q already registered", k.Name)
+	}
+	m.kinds[k.Name] = k
+	if k.Concurrency > 0 {
+		m.slots[k.Name] = make(chan struct{}, k.Concurrency)
+	}
+	m.mu.Unlock()
+
+	interrupted, err := m.list(func(j *Job) bool { return j.Kind == k.Name && !j.Finished() }, 0)
+	if err != nil {
+		return err
+	}
+	for _, j := range interrupted {
+		if j.Attempts >= k.Retry.maxAttempts() {
+			now := time.Now()
+			j.State = Failed
+			j.Error = "interrupted by a shutdown"
+			j.FinishedAt = &now
+			j.NextAttemptAt = nil
+			if err := m.save(j); err != nil {
+				return err
+			}
+			continue
+		}
+		m.log.Info("resuming job", "kind", k.Name, "job", j.ID)
+		m.mu.Lock()
+		m.spawn(k, j)
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// Start starts a new job of the given kind, the params are JSON encoded
+func (m *Manager) Start(kind string, params interface{}) (*Job, error) {
+	var rawParams json.RawMessage
+	if params != nil {
+		var err error
+		if rawParams, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	id, err := newID(now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.kinds[kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+	if k.Exclusive {
+		for _, e := range m.live {
+			if e.job.Kind == kind {
+				return nil, ErrAlreadyRunning
+			}
+		}
+	}
+	j := &Job{
+		ID:        id,
+		Kind:      kind,
+		State:     Running,
+		Params:    rawParams,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := m.save(j); err != nil {
+		return nil, err
+	}
+	e := m.spawn(k, j)
+	m.log.Info("job started", "kind", kind, "job", id)
+	return e.job.copy(), nil
+}
+
+// spawn runs the job in the background (the lock must be held)
+func (m *Manager) spawn(k *Kind, j *Job) *entry {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &entry{job: j, cancel: cancel, done: make(chan struct{})}
+	m.live[j.ID] = e
+	m.wg.Add(1)
+	go m.run(ctx, k, e)
+	return e
+}
+
+func (m *Manager) run(ctx context.Context, k *Kind, e *entry) {
+	defer m.wg.Done()
+	defer close(e.done)
+	defer e.cancel()
+	h := &Handle{m: m, e: e}
+	for {
+		if !m.acquire(ctx, k, e) {
+			m.interrupted(e)
+			return
+		}
+		m.update(e, true, func(j *Job) {
+			j.State = Running
+			j.Attempts++
+			j.Error = ""
+			j.NextAttemptAt = nil
+		})
+		err := k.Run(ctx, h)
+		m.release(k)
+		m.mu.Lock()
+		e.err = err
+		m.mu.Unlock()
+
+		if ctx.Err() != nil {
+			m.interrupted(e)
+			return
+		}
+		if err == nil {
+			m.finish(e, Done, nil)
+			return
+		}
+
+		m.log.Error("job failed", "kind", k.Name, "job", e.job.ID, "err", err)
+		var attempts int
+		m.mu.Lock()
+		attempts = e.job.Attempts
+		m.mu.Unlock()
+		if attempts >= k.Retry.maxAttempts() {
+			m.finish(e, Failed, err)
+			return
+		}
+
+		backoff := k.Retry.Backoff << uint(attempts-1)
+		next := time.Now().Add(backoff)
+		m.update(e, true, func(j *Job) {
+			j.State = Pending
+			j.Error = err.Error()
+			j.NextAttemptAt = &next
+		})
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			m.interrupted(e)
+			return
+		}
+	}
+}
+
+// acquire waits for a slot if the kind has a concurrency, returns false if the job is canceled while waiting
+func (m *Manager) acquire(ctx context.Context, k *Kind, e *entry) bool {
+	m.mu.Lock()
+	slots := m.slots[k.Name]
+	m.mu.Unlock()
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	m.update(e, true, func(j *Job) {
+		j.State = Pending
+	})
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *Manager) release(k *Kind) {
+	m.mu.Lock()
+	slots := m.slots[k.Name]
+	m.mu.Unlock()
+	if slots != nil {
+		<-slots
+	}
+}
+
+// interrupted handles a job whose context is done, either canceled or left as-is to be resumed after a shutdown
+func (m *Manager) interrupted(e *entry) {
+	m.mu.Lock()
+	canceled := e.canceled
+	m.mu.Unlock()
+	if !canceled {
+		m.forget(e)
+		return
+	}
+	m.finish(e, Canceled, nil)
+}
+
+// update applies the changes to the live job, and persists it (at most every `saveInterval` unless forced)
+func (m *Manager) update(e *entry, force bool, f func(*Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(e.job)
+	now := time.Now()
+	e.job.UpdatedAt = now
+	if !force && now.Sub(e.savedAt) < saveInterval {
+		return
+	}
+	e.savedAt = now
+	if err := m.save(e.job); err != nil {
+		m.log.Error("failed to save job", "job", e.job.ID, "err", err)
+	}
+}
+
+func (m *Manager) finish(e *entry, state string, err error) {
+	m.update(e, true, func(j *Job) {
+		now := time.Now()
+		j.State = state
+		j.FinishedAt = &now
+		j.NextAttemptAt = nil
+		if err != nil {
+			j.Error = err.Error()
+		}
+	})
+	m.forget(e)
+	m.log.Info("job finished", "kind", e.job.Kind, "job", e.job.ID, "state", state)
+}
+
+func (m *Manager) forget(e *entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Persist the latest progress
+	if err := m.save(e.job); err != nil {
+		m.log.Error("failed to save job", "job", e.job.ID, "err", err)
+	}
+	delete(m.live, e.job.ID)
+}
+
+func (m *Manager) save(j *Job) error {
+	bid, err := hex.DecodeString(j.ID)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return m.db.Set(bid, js)
+}
+
+// Cancel cancels the job, the record is updated once the job returns
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.live[id]
+	if !ok {
+		if _, err := m.get(id); err != nil {
+			return err
+		}
+		return ErrFinished
+	}
+	e.canceled = true
+	e.cancel()
+	return nil
+}
+
+// Wait waits for the job to return, and returns its record along with its error (if it failed)
+func (m *Manager) Wait(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	e, ok := m.live[id]
+	m.mu.Unlock()
+	if !ok {
+		j, err := m.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if j.State == Failed {
+			return j, errors.New(j.Error)
+		}
+		return j, nil
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := e.job.copy()
+	if j.State == Failed {
+		return j, e.err
+	}
+	return j, nil
+}
+
+// Get returns the job
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.live[id]; ok {
+		return e.job.copy(), nil
+	}
+	return m.get(id)
+}
+
+func (m *Manager) get(id string) (*Job, error) {
+	bid, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	js, err := m.db.Get(bid)
+	if err != nil {
+		return nil, err
+	}
+	if js == nil {
+		return nil, ErrNotFound
+	}
+	j := &Job{}
+	if err := json.Unmarshal(js, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// List returns the jobs, the most recent first, optionally filtered by kind/state (`limit` <= 0 means no limit)
+func (m *Manager) List(kind, state string, limit int) ([]*Job, error) {
+	return m.list(func(j *Job) bool {
+		return (kind == "" || j.Kind == kind) && (state == "" || j.State == state)
+	}, limit)
+}
+
+func (m *Manager) pruneWorker() {
+	defer m.wg.Done()
+	t := time.NewTicker(pruneInterval)
+	defer t.Stop()
+	for {
+		if _, err := m.Prune(time.Now().Add(-Retention)); err != nil {
+			m.log.Error("failed to prune the jobs", "err", err)
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Prune removes the records of the jobs finished before the given time, returns the number of removed records
+func (m *Manager) Prune(before time.Time) (int, error) {
+	expired, err := m.list(func(j *Job) bool {
+		return j.Finished() && j.FinishedAt != nil && j.FinishedAt.Before(before)
+	}, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i, j := range expired {
+		bid, err := hex.DecodeString(j.ID)
+		if err != nil {
+			return i, err
+		}
+		if err := m.db.Delete(bid); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+func (m *Manager) list(filter func(*Job) bool, limit int) ([]*Job, error) {
+	out := []*Job{}
+	it := m.db.Range([]byte{}, []byte("\xff"), true)
+	defer it.Close()
+	for {
+		_, js, err := it.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		j := &Job{}
+		if err := json.Unmarshal(js, j); err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		if e, ok := m.live[j.ID]; ok {
+			j = e.job.copy()
+		}
+		m.mu.Unlock()
+		if !filter(j) {
+			continue
+		}
+		out = append(out, j)
+		if limit > 0 && len(out) == limit {
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func wait(t *testing.T, m *Manager, id string, state string) *Job {
+	for i := 0; i < 500; i++ {
+		j, err := m.Get(id)
+		check(err)
+		if j.State == state {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s never reached state %s", id, state)
+	return nil
+}
+
+func TestJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_jobs_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	m, err := New(logger, dir)
+	check(err)
+
+	// Fails twice, then succeeds
+	check(m.RegisterKind(&Kind{
+		Name: "flaky",
+		Run: func(ctx context.Context, h *Handle) error {
+			var params struct{ N int }
+			check(h.Params(&params))
+			if h.Attempt() < 3 {
+				return errors.New("nope")
+			}
+			h.SetProgress(int64(params.N), int64(params.N))
+			return h.SetResult(map[string]int{"n": params.N})
+		},
+		Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}))
+	// Runs until canceled
+	block := make(chan struct{})
+	check(m.RegisterKind(&Kind{
+		Name: "blocking",
+		Run: func(ctx context.Context, h *Handle) error {
+			close(block)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		Exclusive: true,
+	}))
+
+	if _, err := m.Start("unknown", nil); err != ErrUnknownKind {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+
+	flaky, err := m.Start("flaky", map[string]int{"N": 5})
+	check(err)
+	j := wait(t, m, flaky.ID, Done)
+	if j.Attempts != 3 || j.Progress.Done != 5 || string(j.Result) != `{"n":5}` || j.FinishedAt == nil {
+		t.Errorf("unexpected job %+v", j)
+	}
+
+	blocking, err := m.Start("blocking", nil)
+	check(err)
+	<-block
+	if _, err := m.Start("blocking", nil); err != ErrAlreadyRunning {
+		t.Errorf("expected ErrAlreadyRunning, got %v", err)
+	}
+	check(m.Cancel(blocking.ID))
+	wait(t, m, blocking.ID, Canceled)
+	if err := m.Cancel(blocking.ID); err != ErrFinished {
+		t.Errorf("expected ErrFinished, got %v", err)
+	}
+	if _, err := m.Get("deadbeef"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	all, err := m.List("", "", 0)
+	check(err)
+	if len(all) != 2 || all[0].ID != blocking.ID || all[1].ID != flaky.ID {
+		t.Errorf("unexpected jobs %+v", all)
+	}
+	done, err := m.List("", Done, 0)
+	check(err)
+	if len(done) != 1 || done[0].ID != flaky.ID {
+		t.Errorf("unexpected done jobs %+v", done)
+	}
+
+	// A job interrupted by a shutdown is resumed on the next start
+	started := make(chan struct{})
+	check(m.RegisterKind(&Kind{
+		Name: "resumable",
+		Run: func(ctx context.Context, h *Handle) error {
+			if h.Attempt() == 1 {
+				close(started)
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+		Retry: RetryPolicy{MaxAttempts: 2},
+	}))
+	resumable, err := m.Start("resumable", nil)
+	check(err)
+	<-started
+	check(m.Close())
+
+	m, err = New(logger, dir)
+	check(err)
+	defer m.Close()
+	j, err = m.Get(resumable.ID)
+	check(err)
+	if j.State != Running {
+		t.Errorf("interrupted job should still be running, got %+v", j)
+	}
+	check(m.RegisterKind(&Kind{
+		Name:  "resumable",
+		Run:   func(ctx context.Context, h *Handle) error { return nil },
+		Retry: RetryPolicy{MaxAttempts: 2},
+	}))
+	j = wait(t, m, resumable.ID, Done)
+	if j.Attempts != 2 {
+		t.Errorf("unexpected attempts %+v", j)
+	}
+}
+
+func TestJobsConcurrencyAndPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_jobs_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	m, err := New(logger, dir)
+	check(err)
+	defer m.Close()
+
+	// A single job runs at a time, the next one is pending until the first one returns
+	release := make(chan struct{})
+	running := make(chan struct{}, 2)
+	check(m.RegisterKind(&Kind{
+		Name: "serial",
+		Run: func(ctx context.Context, h *Handle) error {
+			running <- struct{}{}
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return errors.New("failed")
+		},
+		Concurrency: 1,
+	}))
+	first, err := m.Start("serial", nil)
+	check(err)
+	<-running
+	second, err := m.Start("serial", nil)
+	check(err)
+	wait(t, m, second.ID, Pending)
+	release <- struct{}{}
+	if _, err := m.Wait(context.Background(), first.ID); err == nil || err.Error() != "failed" {
+		t.Errorf("expected the job error, got %v", err)
+	}
+	<-running
+	release <- struct{}{}
+	j, err := m.Wait(context.Background(), second.ID)
+	if j.State != Failed || err == nil {
+		t.Errorf("unexpected job %+v (err=%v)", j, err)
+	}
+
+	// Only the finished jobs older than the retention are removed
+	removed, err := m.Prune(time.Now().Add(-time.Hour))
+	check(err)
+	if removed != 0 {
+		t.Errorf("expected no job to be pruned, got %d", removed)
+	}
+	removed, err = m.Prune(time.Now().Add(time.Second))
+	check(err)
+	if removed != 2 {
+		t.Errorf("expected 2 jobs to be pruned, got %d", removed)
+	}
+	if _, err := m.Get(first.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
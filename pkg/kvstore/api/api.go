@@ -1,14 +1,17 @@
 package api // import "a4.io/blobstash/pkg/kvstore/api"
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 
 	"github.com/gorilla/mux"
 
+	"a4.io/blobstash/pkg/audit"
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
@@ -19,6 +22,7 @@ type keyValue struct {
 	Version int64  `json:"version"`
 	Hash    string `json:"hash,omitempty"`
 	Data    []byte `json:"data,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
 }
 
 func toKeyValue(okv *vkv.KeyValue) *keyValue {
@@ -27,15 +31,34 @@ func toKeyValue(okv *vkv.KeyValue) *keyValue {
 		Version: okv.Version,
 		Hash:    okv.HexHash(),
 		Data:    okv.Data,
+		Deleted: okv.Tombstone,
 	}
 }
 
 type KvStoreAPI struct {
-	kv store.KvStore
+	kv       store.KvStore
+	writes   *coalescer
+	watchers *watchers
+
+	// Called before deleting a key, the locked keys cannot be deleted (see `WithLockCheck`)
+	locked func(context.Context, string) (bool, error)
 }
 
 func New(kv store.KvStore) *KvStoreAPI {
-	return &KvStoreAPI{kv}
+	return &KvStoreAPI{kv: kv, writes: newCoalescer(kv)}
+}
+
+// WithHub enables the watch endpoint, the new versions are followed via the hub
+func (kv *KvStoreAPI) WithHub(h *hub.Hub) *KvStoreAPI {
+	kv.watchers = newWatchers(h)
+	return kv
+}
+
+// WithLockCheck sets the check called before each key delete, the locked keys are rejected with a 423 error (e.g.
+// the filetree FS under a retention lock)
+func (kv *KvStoreAPI) WithLockCheck(locked func(context.Context, string) (bool, error)) *KvStoreAPI {
+	kv.locked = locked
+	return kv
 }
 
 func (kv *KvStoreAPI) keysHandler() func(http.ResponseWriter, *http.Request) {
@@ -52,7 +75,7 @@ func (kv *KvStoreAPI) keysHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 			q := httputil.NewQuery(r.URL.Query())
 			start := q.GetDefault("cursor", "")
 			limit, err := q.GetIntDefault("limit", 50)
@@ -111,7 +134,7 @@ func (kv *KvStoreAPI) versionsHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 			limit, err := q.GetIntDefault("limit", 50)
 			if err != nil {
 				panic(err)
@@ -161,7 +184,7 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 			q := httputil.NewQuery(r.URL.Query())
 			version, err := q.GetInt64Default("version", -1)
@@ -196,7 +219,7 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
-			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
 
 			// Parse the form value
 			hah, err := httputil.Read(r)
@@ -213,13 +236,60 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				httputil.Error(w, err)
 				return
 			}
-			res, err := kv.kv.Put(ctx, key, ref, []byte(data), version)
+			var res *vkv.KeyValue
+			if version > 0 {
+				// Explicit versions (i.e. replayed from another instance) may already exist, let the store handle them
+				res, err = kv.kv.Put(ctx, key, ref, []byte(data), version)
+			} else {
+				res, err = kv.writes.Put(ctx, key, ref, []byte(data), version)
+			}
 			if err != nil {
 				httputil.Error(w, err)
 				return
 			}
+			audit.AddRefs(ctx, audit.FormatRef(res.Key, res.Version))
 			httputil.MarshalAndWrite(r, w, toKeyValue(res))
 			// TODO(tsileo): switch to StatusCreated
+		case "DELETE":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Delete, perms.KVEntry),
+				perms.ResourceWithID(perms.KvStore, perms.KVEntry, key),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+
+			ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+
+			q := httputil.NewQuery(r.URL.Query())
+			version, err := q.GetInt64Default("version", -1)
+			if err != nil {
+				panic(err)
+			}
+
+			if kv.locked != nil {
+				locked, err := kv.locked(ctx, key)
+				if err != nil {
+					panic(err)
+				}
+				if locked {
+					httputil.WriteJSONError(w, http.StatusLocked, "key under retention lock")
+					return
+				}
+			}
+
+			res, err := kv.kv.Delete(ctx, key, version)
+			if err != nil {
+				if err == vkv.ErrNotFound {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				panic(err)
+			}
+			audit.AddRefs(ctx, audit.FormatRef(res.Key, res.Version))
+			w.WriteHeader(http.StatusNoContent)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
@@ -227,7 +297,11 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 }
 
 func (kv *KvStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/watch", basicAuth(http.HandlerFunc(kv.watchHandler())))
 	r.Handle("/keys", basicAuth(http.HandlerFunc(kv.keysHandler())))
+	r.Handle("/query", basicAuth(http.HandlerFunc(kv.queryHandler())))
+	r.Handle("/_move", basicAuth(http.HandlerFunc(kv.moveHandler())))
+	r.Handle("/_compact", basicAuth(http.HandlerFunc(kv.compactHandler())))
 	r.Handle("/key/{key}", basicAuth(http.HandlerFunc(kv.getHandler())))
 	r.Handle("/key/{key}/_versions", basicAuth(http.HandlerFunc(kv.versionsHandler())))
 }
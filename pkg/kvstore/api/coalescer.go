@@ -0,0 +1,106 @@
+package api // import "a4.io/blobstash/pkg/kvstore/api"
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// maxBatchSize is the maximum number of versions stored within a single batch
+var maxBatchSize = 256
+
+type putRequest struct {
+	kv   *vkv.KeyValue
+	done chan error
+}
+
+// coalescer groups the concurrent Puts (of a same namespace) into a single batch (one storage write and one meta
+// blob).
+//
+// There's no fixed window, the first write is flushed right away, and the writes received while a batch is being
+// flushed are grouped in the next one (so a lone writer does not see any extra latency).
+type coalescer struct {
+	kv store.KvStore
+
+	mu       sync.Mutex
+	pending  map[string][]*putRequest // map[<namespace>]<requests>
+	inflight map[string]bool
+}
+
+func newCoalescer(kv store.KvStore) *coalescer {
+	return &coalescer{
+		kv:       kv,
+		pending:  map[string][]*putRequest{},
+		inflight: map[string]bool{},
+	}
+}
+
+// Put queues the version and waits for its batch to be written
+func (c *coalescer) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	// Check the key now as an invalid key would fail the whole batch
+	if strings.Contains(key, "/") {
+		return nil, kvstore.ErrInvalidKey
+	}
+	res := &vkv.KeyValue{
+		Key:     key,
+		Version: version,
+		Data:    data,
+	}
+	if ref != "" {
+		if err := res.SetHexHash(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	req := &putRequest{kv: res, done: make(chan error, 1)}
+	ns, _ := ctxutil.Namespace(ctx)
+	c.mu.Lock()
+	c.pending[ns] = append(c.pending[ns], req)
+	if !c.inflight[ns] {
+		c.inflight[ns] = true
+		go c.flush(ns)
+	}
+	c.mu.Unlock()
+
+	if err := <-req.done; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// flush writes the pending batches for the given namespace until there's no more pending requests
+func (c *coalescer) flush(ns string) {
+	// The batch outlives the requests, don't tie it to a request context
+	ctx := ctxutil.WithNamespace(context.Background(), ns)
+	for {
+		c.mu.Lock()
+		reqs := c.pending[ns]
+		if len(reqs) == 0 {
+			delete(c.pending, ns)
+			delete(c.inflight, ns)
+			c.mu.Unlock()
+			return
+		}
+		if len(reqs) > maxBatchSize {
+			c.pending[ns] = reqs[maxBatchSize:]
+			reqs = reqs[:maxBatchSize]
+		} else {
+			c.pending[ns] = nil
+		}
+		c.mu.Unlock()
+
+		kvs := make([]*vkv.KeyValue, len(reqs))
+		for i, req := range reqs {
+			kvs[i] = req.kv
+		}
+		err := c.kv.PutBatch(ctx, kvs)
+		for _, req := range reqs {
+			req.done <- err
+		}
+	}
+}
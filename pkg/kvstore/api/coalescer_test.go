@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	env := testutil.New(t, "kvstore_coalescer_test")
+	defer env.Close()
+	kvs := env.KvStore
+
+	c := newCoalescer(kvs)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Half of the writes target the same key
+			key := fmt.Sprintf("k%d", i%50)
+			if _, err := c.Put(ctx, key, "", []byte(fmt.Sprintf("v%d", i)), -1); err != nil {
+				t.Errorf("put failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%d", i)
+		kvv, _, err := kvs.Versions(ctx, key, "0", -1)
+		check(err)
+		if len(kvv.Versions) != 2 {
+			t.Errorf("expected 2 versions for %s, got %d", key, len(kvv.Versions))
+		}
+		for _, v := range kvv.Versions {
+			h, err := kvs.GetMetaBlob(ctx, key, v.Version)
+			check(err)
+			if h == "" {
+				t.Errorf("missing meta blob for %s@%d", key, v.Version)
+			}
+		}
+	}
+
+	if _, err := c.Put(ctx, "invalid/key", "", []byte("v"), -1); err != kvstore.ErrInvalidKey {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package api // import "a4.io/blobstash/pkg/kvstore/api"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/audit"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// KeyMove holds the outcome of moving a single key
+type KeyMove struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Versions int    `json:"versions"`
+}
+
+// MovePrefix moves every key starting with `from` to the `to` prefix (e.g. `_filetree:fs:old` to
+// `_filetree:fs:new`), the whole history of the keys is copied, and the old keys are deleted.
+//
+// All the versions are written within a single batch (i.e. a single meta blob), so the move is atomic, and the
+// subscribers of the meta blobs (docstore views, webhooks...) see it like any other write.
+func MovePrefix(ctx context.Context, kv store.KvStore, from, to string, dryRun bool) ([]*KeyMove, error) {
+	if from == "" || to == "" || strings.Contains(to, "/") {
+		return nil, fmt.Errorf("invalid prefixes %q/%q", from, to)
+	}
+	// Moving a prefix inside itself would move the new keys again
+	if strings.HasPrefix(to, from) || strings.HasPrefix(from, to) {
+		return nil, fmt.Errorf("the prefixes %q and %q overlap", from, to)
+	}
+
+	// Deleted keys are not listed, their history stays under the old prefix
+	keys, _, err := kv.Keys(ctx, from, from+"\xff", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := []*KeyMove{}
+	batch := []*vkv.KeyValue{}
+	now := time.Now().UTC().UnixNano()
+	for _, key := range keys {
+		move := &KeyMove{From: key.Key, To: to + key.Key[len(from):]}
+		// A deleted destination key is not reused either, its tombstone would hide the moved versions
+		switch _, _, err := kv.Versions(ctx, move.To, "0", 1); err {
+		case nil:
+			return nil, fmt.Errorf("key %q already exists", move.To)
+		case vkv.ErrNotFound:
+		default:
+			return nil, err
+		}
+
+		// Start from the latest version (that may be set in the future)
+		kvv, _, err := kv.Versions(ctx, key.Key, strconv.FormatInt(key.Version, 10), -1)
+		if err != nil {
+			return nil, err
+		}
+		move.Versions = len(kvv.Versions)
+		moves = append(moves, move)
+
+		// Versions are sorted from the most recent one
+		for i := len(kvv.Versions) - 1; i >= 0; i-- {
+			v := kvv.Versions[i]
+			batch = append(batch, &vkv.KeyValue{
+				Key:       move.To,
+				Version:   v.Version,
+				Hash:      v.Hash,
+				Data:      v.Data,
+				Tombstone: v.Tombstone,
+			})
+		}
+
+		tombstone := &vkv.KeyValue{Key: key.Key, Version: now, Tombstone: true}
+		if latest := kvv.Versions[0].Version; tombstone.Version <= latest {
+			tombstone.Version = latest + 1
+		}
+		batch = append(batch, tombstone)
+	}
+
+	if dryRun || len(batch) == 0 {
+		return moves, nil
+	}
+	if err := kv.PutBatch(ctx, batch); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+func (kv *KvStoreAPI) moveHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.KVEntry),
+			perms.Resource(perms.KvStore, perms.KVEntry),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		q := httputil.NewQuery(r.URL.Query())
+		dryRun, err := q.GetBoolDefault("dry_run", false)
+		if err != nil {
+			panic(err)
+		}
+
+		moves, err := MovePrefix(ctx, kv.kv, q.Get("from"), q.Get("to"), dryRun)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if !dryRun {
+			for _, move := range moves {
+				audit.AddRefs(ctx, move.From, move.To)
+			}
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"dry_run": dryRun,
+			"data":    moves,
+		})
+	}
+}
+
+// compactHandler purges the dead versions (the tombstones and the versions before them) of the namespace kvstore
+func (kv *KvStoreAPI) compactHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.KVEntry),
+			perms.Resource(perms.KvStore, perms.KVEntry),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		compacter, ok := kv.kv.(interface {
+			Compact(context.Context) (int, error)
+		})
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		purged, err := compacter.Compact(ctx)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"purged": purged,
+		})
+	}
+}
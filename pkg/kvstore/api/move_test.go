@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestMovePrefix(t *testing.T) {
+	env := testutil.New(t, "kvstore_move_test")
+	defer env.Close()
+	kvs := env.KvStore
+
+	ctx := context.Background()
+	for _, v := range []int64{1, 2, 3} {
+		_, err := kvs.Put(ctx, "_filetree:fs:old", "", []byte("v"), v)
+		check(err)
+	}
+	_, err := kvs.Put(ctx, "_filetree:fs:old:sub", "", []byte("sub"), 1)
+	check(err)
+	_, err = kvs.Put(ctx, "_filetree:fs:other", "", []byte("other"), 1)
+	check(err)
+
+	moves, err := MovePrefix(ctx, kvs, "_filetree:fs:old", "_filetree:fs:new", true)
+	check(err)
+	if len(moves) != 2 || moves[0].Versions != 3 || moves[1].To != "_filetree:fs:new:sub" {
+		t.Errorf("unexpected moves %+v", moves)
+	}
+	if _, err := kvs.Get(ctx, "_filetree:fs:new", -1); err != vkv.ErrNotFound {
+		t.Errorf("dry run should not move the keys")
+	}
+
+	_, err = MovePrefix(ctx, kvs, "_filetree:fs:old", "_filetree:fs:new", false)
+	check(err)
+	kvv, _, err := kvs.Versions(ctx, "_filetree:fs:new", "0", -1)
+	check(err)
+	if len(kvv.Versions) != 3 || kvv.Versions[2].Version != 1 {
+		t.Errorf("the history should be moved, got %+v", kvv.Versions)
+	}
+	for _, key := range []string{"_filetree:fs:old", "_filetree:fs:old:sub"} {
+		if _, err := kvs.Get(ctx, key, -1); err != vkv.ErrNotFound {
+			t.Errorf("%s should be deleted, got %v", key, err)
+		}
+	}
+	if _, err := kvs.Get(ctx, "_filetree:fs:other", -1); err != nil {
+		t.Errorf("other keys should not be moved: %v", err)
+	}
+
+	// The destination must not exist
+	if _, err := MovePrefix(ctx, kvs, "_filetree:fs:other", "_filetree:fs:new", false); err == nil {
+		t.Errorf("moving to an existing key should fail")
+	}
+}
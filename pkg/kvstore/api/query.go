@@ -0,0 +1,275 @@
+package api // import "a4.io/blobstash/pkg/kvstore/api"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// NDJSONMimeType is the content type of the streamed query results (one JSON object per line)
+const NDJSONMimeType = "application/x-ndjson"
+
+// Value decoders
+const (
+	DecodeRaw     = "raw"
+	DecodeString  = "string"
+	DecodeJSON    = "json"
+	DecodeMsgpack = "msgpack"
+)
+
+// Number of keys/versions fetched at once while executing a query
+var queryPageSize = 100
+
+// ErrInvalidQuery is returned when the query cannot be executed
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query is a declarative query over the kvstore, executed server-side
+type Query struct {
+	// Only the keys starting with the prefix (all the keys if empty)
+	Prefix string `json:"prefix"`
+
+	// Only the keys matching the regex (RE2 syntax)
+	KeyRegex string `json:"key_regex"`
+
+	// Version range (inclusive, Unix nano timestamps), 0 means unbounded
+	MinVersion int64 `json:"min_version"`
+	MaxVersion int64 `json:"max_version"`
+
+	// Return every version within the range, instead of only the latest version of each key (when within the range)
+	AllVersions bool `json:"all_versions"`
+
+	// How to decode the values (raw, string, json or msgpack), the raw data is returned as base64
+	Decode string `json:"decode"`
+
+	// Max number of results (0 means no limit)
+	Limit int `json:"limit"`
+
+	// Keys order, "asc" (default) or "desc" (the versions are always sorted from the most recent one)
+	Order string `json:"order"`
+
+	re *regexp.Regexp
+}
+
+// QueryResult is a single version matched by a query
+type QueryResult struct {
+	Key         string      `json:"key"`
+	Version     int64       `json:"version"`
+	Hash        string      `json:"hash,omitempty"`
+	Data        []byte      `json:"data,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+	DecodeError string      `json:"decode_error,omitempty"`
+}
+
+func (q *Query) validate() error {
+	switch q.Decode {
+	case "", DecodeRaw, DecodeString, DecodeJSON, DecodeMsgpack:
+	default:
+		return fmt.Errorf("%w: unknown decoder %q", ErrInvalidQuery, q.Decode)
+	}
+	switch q.Order {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("%w: unknown order %q", ErrInvalidQuery, q.Order)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	if q.MaxVersion > 0 && q.MinVersion > q.MaxVersion {
+		return fmt.Errorf("%w: empty version range", ErrInvalidQuery)
+	}
+	if q.KeyRegex != "" {
+		re, err := regexp.Compile(q.KeyRegex)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		q.re = re
+	}
+	return nil
+}
+
+func (q *Query) inRange(version int64) bool {
+	return version >= q.MinVersion && (q.MaxVersion <= 0 || version <= q.MaxVersion)
+}
+
+func (q *Query) result(kv *vkv.KeyValue) *QueryResult {
+	res := &QueryResult{Key: kv.Key, Version: kv.Version, Hash: kv.HexHash()}
+	if len(kv.Data) == 0 {
+		return res
+	}
+	var err error
+	switch q.Decode {
+	case "", DecodeRaw:
+		res.Data = kv.Data
+	case DecodeString:
+		res.Value = string(kv.Data)
+	case DecodeJSON:
+		err = json.Unmarshal(kv.Data, &res.Value)
+	case DecodeMsgpack:
+		err = msgpack.Unmarshal(kv.Data, &res.Value)
+	}
+	if err != nil {
+		// Still return the raw data so the client can deal with it
+		res.Value = nil
+		res.Data = kv.Data
+		res.DecodeError = err.Error()
+	}
+	return res
+}
+
+// RunQuery executes the query, `fn` is called for each result (the results are never fully loaded in memory)
+func RunQuery(ctx context.Context, kvs store.KvStore, q *Query, fn func(*QueryResult) error) error {
+	if err := q.validate(); err != nil {
+		return err
+	}
+	start, end := q.Prefix, q.Prefix+"\xff"
+	if q.Prefix == "" {
+		end = "\xff"
+	}
+	reverse := q.Order == "desc"
+
+	var sent int
+	emit := func(kv *vkv.KeyValue) (bool, error) {
+		if err := fn(q.result(kv)); err != nil {
+			return false, err
+		}
+		sent++
+		return q.Limit > 0 && sent >= q.Limit, nil
+	}
+
+	for {
+		var keys []*vkv.KeyValue
+		var cursor string
+		var err error
+		if reverse {
+			keys, cursor, err = kvs.ReverseKeys(ctx, start, end, queryPageSize)
+		} else {
+			keys, cursor, err = kvs.Keys(ctx, start, end, queryPageSize)
+		}
+		if err != nil {
+			return err
+		}
+		for _, kv := range keys {
+			if q.re != nil && !q.re.MatchString(kv.Key) {
+				continue
+			}
+			if !q.AllVersions {
+				if !q.inRange(kv.Version) {
+					continue
+				}
+				done, err := emit(kv)
+				if done || err != nil {
+					return err
+				}
+				continue
+			}
+			done, err := q.versions(ctx, kvs, kv, emit)
+			if done || err != nil {
+				return err
+			}
+		}
+		if len(keys) < queryPageSize {
+			return nil
+		}
+		if reverse {
+			end = cursor
+		} else {
+			start = cursor
+		}
+	}
+}
+
+// versions emits the versions of the key within the range (from the most recent one)
+func (q *Query) versions(ctx context.Context, kvs store.KvStore, latest *vkv.KeyValue, emit func(*vkv.KeyValue) (bool, error)) (bool, error) {
+	// The latest version may be set in the future
+	cursor := strconv.FormatInt(latest.Version, 10)
+	if q.MaxVersion > 0 && q.MaxVersion < latest.Version {
+		cursor = strconv.FormatInt(q.MaxVersion, 10)
+	}
+	for {
+		res, next, err := kvs.Versions(ctx, latest.Key, cursor, queryPageSize)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		for _, kv := range res.Versions {
+			if kv.Version < q.MinVersion {
+				return false, nil
+			}
+			if kv.Tombstone || !q.inRange(kv.Version) {
+				continue
+			}
+			if done, err := emit(kv); done || err != nil {
+				return done, err
+			}
+		}
+		if len(res.Versions) < queryPageSize {
+			return false, nil
+		}
+		cursor = next
+	}
+}
+
+// queryHandler streams the results of the query as newline-delimited JSON, an error occurring after the first result
+// is sent is reported as a last `{"error": "..."}` line
+func (kv *KvStoreAPI) queryHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.KVEntry),
+			perms.Resource(perms.KvStore, perms.KVEntry),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		q := &Query{}
+		if err := httputil.Unmarshal(r, q); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := q.validate(); err != nil {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", NDJSONMimeType)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		var sent int
+		if err := RunQuery(ctx, kv.kv, q, func(res *QueryResult) error {
+			if err := enc.Encode(res); err != nil {
+				return err
+			}
+			if sent++; sent%queryPageSize == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}); err != nil {
+			if sent == 0 {
+				panic(err)
+			}
+			enc.Encode(map[string]string{"error": err.Error()})
+		}
+	}
+}
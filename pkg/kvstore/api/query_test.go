@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func TestRunQuery(t *testing.T) {
+	env := testutil.New(t, "kvstore_query_test")
+	defer env.Close()
+	kvs := env.KvStore
+
+	// Exercise the pagination
+	defer func(size int) { queryPageSize = size }(queryPageSize)
+	queryPageSize = 2
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		for _, v := range []int64{10, 20, 30} {
+			_, err := kvs.Put(ctx, fmt.Sprintf("user:%d", i), "", []byte(fmt.Sprintf(`{"id": %d, "v": %d}`, i, v)), v)
+			check(err)
+		}
+	}
+	_, err := kvs.Put(ctx, "other", "", []byte("nope"), 10)
+	check(err)
+	_, err = kvs.Put(ctx, "user:bad", "", []byte("{"), 15)
+	check(err)
+
+	run := func(q *Query) []*QueryResult {
+		out := []*QueryResult{}
+		check(RunQuery(ctx, kvs, q, func(res *QueryResult) error {
+			out = append(out, res)
+			return nil
+		}))
+		return out
+	}
+
+	res := run(&Query{Prefix: "user:", KeyRegex: `^user:\d+$`, Decode: DecodeJSON})
+	if len(res) != 5 || res[0].Key != "user:0" || res[0].Version != 30 {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	if v := res[1].Value.(map[string]interface{}); v["id"] != 1.0 || v["v"] != 30.0 {
+		t.Errorf("unexpected value %+v", res[1].Value)
+	}
+
+	res = run(&Query{Prefix: "user:", Order: "desc", Limit: 2})
+	if len(res) != 2 || res[0].Key != "user:bad" || res[1].Key != "user:4" || string(res[1].Data) == "" {
+		t.Errorf("unexpected results %+v", res)
+	}
+
+	// The latest version of `user:bad` is out of range
+	res = run(&Query{Prefix: "user:", AllVersions: true, MinVersion: 15, MaxVersion: 20, Decode: DecodeJSON})
+	if len(res) != 6 {
+		t.Fatalf("expected 6 results, got %+v", res)
+	}
+	for _, r := range res {
+		if r.Key == "user:bad" {
+			if r.DecodeError == "" || string(r.Data) != "{" {
+				t.Errorf("expected a decode error, got %+v", r)
+			}
+		} else if r.Version != 20 {
+			t.Errorf("unexpected version %+v", r)
+		}
+	}
+
+	res = run(&Query{AllVersions: true, MinVersion: 20})
+	if len(res) != 10 {
+		t.Errorf("expected 10 results, got %d", len(res))
+	}
+
+	for _, q := range []*Query{{KeyRegex: "("}, {Decode: "xml"}, {Order: "random"}, {MinVersion: 2, MaxVersion: 1}} {
+		if err := RunQuery(ctx, kvs, q, nil); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("expected ErrInvalidQuery for %+v, got %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package api // import "a4.io/blobstash/pkg/kvstore/api"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Number of versions buffered per watcher, a slower watcher is disconnected (and is expected to reconnect and catch
+// up using the `Keys` endpoint)
+const watchBufferSize = 256
+
+// Interval between the heartbeats sent to the watchers
+const watchHeartbeat = 20 * time.Second
+
+// watchers keeps track of the clients following the new versions
+type watchers struct {
+	clients map[chan *keyValue]string // map[<client chan>]<prefix>
+	mu      sync.Mutex
+}
+
+func newWatchers(h *hub.Hub) *watchers {
+	ws := &watchers{clients: map[chan *keyValue]string{}}
+	// The new versions are stored as meta blobs (the replicated/synced ones too)
+	h.Subscribe(hub.NewBlob, "kvstore_watch", ws.newBlobCallback)
+	return ws
+}
+
+func (ws *watchers) newBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	metaType, data, isMeta := meta.IsMetaBlob(blb.Data)
+	if !isMeta || (metaType != vkv.KvType && metaType != vkv.KvBatchType) {
+		return nil
+	}
+	kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+clients:
+	for c, prefix := range ws.clients {
+		for _, kv := range kvs {
+			if !strings.HasPrefix(kv.Key, prefix) {
+				continue
+			}
+			select {
+			case c <- toKeyValue(kv):
+			default:
+				// Never block the writes, drop the slow watcher
+				delete(ws.clients, c)
+				close(c)
+				continue clients
+			}
+		}
+	}
+	return nil
+}
+
+func (ws *watchers) add(prefix string) chan *keyValue {
+	c := make(chan *keyValue, watchBufferSize)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.clients[c] = prefix
+	return c
+}
+
+func (ws *watchers) remove(c chan *keyValue) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.clients[c]; ok {
+		delete(ws.clients, c)
+		close(c)
+	}
+}
+
+// watchHandler streams the new versions of the keys matching the given prefix as Server-Sent Events
+func (kv *KvStoreAPI) watchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.List, perms.KVEntry),
+			perms.Resource(perms.KvStore, perms.KVEntry),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if kv.watchers == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		c := kv.watchers.add(r.URL.Query().Get("prefix"))
+		defer kv.watchers.remove(c)
+
+		// Set the headers related to event streaming.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// Send an initial heartbeat
+		fmt.Fprintf(w, "event: heartbeat\ndata: \n\n")
+		f.Flush()
+
+		heartbeat := time.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprintf(w, "event: heartbeat\ndata: \n\n")
+			case v, open := <-c:
+				if !open {
+					// The watcher was too slow
+					return
+				}
+				js, err := json.Marshal(v)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Fprintf(w, "id: %d\nevent: kv\ndata: %s\n\n", v.Version, js)
+			}
+			f.Flush()
+		}
+	}
+}
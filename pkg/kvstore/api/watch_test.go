@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"a4.io/blobstash/pkg/testutil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestWatchers(t *testing.T) {
+	env := testutil.New(t, "kvstore_watch_test")
+	defer env.Close()
+	h, kvs := env.Hub, env.KvStore
+
+	ws := newWatchers(h)
+	c := ws.add("_filetree:")
+	defer ws.remove(c)
+
+	ctx := context.Background()
+	_, err := kvs.Put(ctx, "_filetree:fs:a", "", []byte("a"), 1)
+	check(err)
+	_, err = kvs.Put(ctx, "other", "", []byte("other"), 1)
+	check(err)
+	check(kvs.PutBatch(ctx, []*vkv.KeyValue{
+		{Key: "_filetree:fs:b", Data: []byte("b"), Version: 2},
+		{Key: "_filetree:fs:c", Data: []byte("c"), Version: 3},
+	}))
+
+	got := []string{}
+	for len(c) > 0 {
+		v := <-c
+		got = append(got, v.Key)
+	}
+	if len(got) != 3 || got[0] != "_filetree:fs:a" || got[1] != "_filetree:fs:b" || got[2] != "_filetree:fs:c" {
+		t.Errorf("unexpected versions %q", got)
+	}
+
+	// A slow watcher is dropped instead of blocking the writes
+	for i := 0; i <= watchBufferSize; i++ {
+		_, err = kvs.Put(ctx, "_filetree:fs:a", "", []byte("a"), int64(10+i))
+		check(err)
+	}
+	ws.mu.Lock()
+	n := len(ws.clients)
+	ws.mu.Unlock()
+	if n != 0 {
+		t.Errorf("the slow watcher should be dropped")
+	}
+}
@@ -11,6 +11,8 @@ import (
 
 	log "github.com/inconshreveable/log15"
 
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
@@ -43,6 +45,7 @@ func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *
 		vkv:       kv,
 	}
 	metaHandler.RegisterApplyFunc(KvType, kvStore.applyMetaFunc)
+	metaHandler.RegisterApplyFunc(vkv.KvBatchType, kvStore.applyBatchMetaFunc)
 	return kvStore, nil
 }
 
@@ -70,6 +73,24 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 		kv.log.Debug("kv already applied")
 		return nil
 	}
+	// The versions removed with DeleteVersion (e.g. pruned) must not come back
+	deleted, err := kv.vkv.VersionDeleted(rkv.Key, rkv.Version)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		kv.log.Debug("kv version deleted")
+		return nil
+	}
+
+	if rkv.Tombstone {
+		// The tombstone is applied as is (without checking the key exists), as the meta blobs may be replayed out of
+		// order (the tombstone before the versions it deletes)
+		if err := kv.vkv.PutBatch([]*vkv.KeyValue{rkv}, hash); err != nil {
+			return fmt.Errorf("failed to apply tombstone: %v", err)
+		}
+		return nil
+	}
 
 	if _, err := kv.Put(context.Background(), rkv.Key, rkv.HexHash(), rkv.Data, rkv.Version); err != nil {
 		return fmt.Errorf("failed to put: %v", err)
@@ -79,6 +100,42 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 	return nil
 }
 
+func (kv *KvStore) applyBatchMetaFunc(hash string, data []byte) error {
+	kv.log.Debug("Apply batch meta init", "hash", hash)
+	batch, err := vkv.UnserializeBatchBlob(data)
+	if err != nil {
+		return fmt.Errorf("failed to unserialize blob: %v", err)
+	}
+	pending := []*vkv.KeyValue{}
+	for _, rkv := range batch {
+		metaBlobHash, err := kv.vkv.GetMetaBlob(rkv.Key, rkv.Version)
+		if err != nil {
+			return err
+		}
+		if metaBlobHash != "" {
+			continue
+		}
+		deleted, err := kv.vkv.VersionDeleted(rkv.Key, rkv.Version)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			pending = append(pending, rkv)
+		}
+	}
+	if len(pending) == 0 {
+		kv.log.Debug("batch already applied")
+		return nil
+	}
+
+	// The batch is already stored as a meta blob, only the index needs to be updated
+	if err := kv.vkv.PutBatch(pending, hash); err != nil {
+		return fmt.Errorf("failed to put batch: %v", err)
+	}
+	kv.log.Debug("Applied batch meta", "count", len(pending))
+	return nil
+}
+
 func (kv *KvStore) Close() error {
 	return kv.vkv.Close()
 }
@@ -115,10 +172,51 @@ func (kv *KvStore) Versions(ctx context.Context, key, start string, limit int) (
 	return res, strconv.FormatInt(cursor, 10), nil
 }
 
+// DeleteVersion removes the given version of the key (the meta blob is kept in the BlobStore, but the version is not
+// restored by a rescan).
+func (kv *KvStore) DeleteVersion(ctx context.Context, key string, version int64) error {
+	kv.log.Info("OP DeleteVersion", "key", key, "version", version)
+	if err := kv.vkv.DeleteVersion(key, version); err != nil {
+		return err
+	}
+	kv.versionDeleted(ctx, &vkv.KeyValue{Key: key, Version: version})
+	return nil
+}
+
+// versionDeleted notifies the hub subscribers (e.g. the refgraph) of a removed version, the version is already gone so
+// a subscriber error is only logged
+func (kv *KvStore) versionDeleted(ctx context.Context, rkv *vkv.KeyValue) {
+	if err := kv.meta.Hub().DeleteKvVersionEvent(ctx, nil, rkv); err != nil {
+		kv.log.Error("failed to notify the version deletion", "key", rkv.Key, "version", rkv.Version, "err", err)
+	}
+}
+
+// Compact purges the dead versions (the tombstones and the versions before them), the meta blobs are kept in the
+// BlobStore.
+func (kv *KvStore) Compact() (int, error) {
+	kv.log.Info("OP Compact")
+	return kv.vkv.CompactFunc(func(rkv *vkv.KeyValue) error {
+		kv.versionDeleted(context.Background(), rkv)
+		return nil
+	})
+}
+
+// VersionRange returns the versions of all the keys within [start, end], ordered by version (see `vkv.DB.VersionRange`)
+func (kv *KvStore) VersionRange(ctx context.Context, start, end int64, cursor string, limit int) ([]*vkv.KeyValue, string, error) {
+	kv.log.Info("OP VersionRange", "start", start, "end", end, "cursor", cursor)
+	return kv.vkv.VersionRange(start, end, cursor, limit)
+}
+
 func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
 	return kv.vkv.ReverseKeys(start, end, limit)
 }
 
+// checkMetaBlob lets the hub subscribers (e.g. the quotas) reject the meta blob before the index is updated (the
+// BlobStore checks it again when it's saved, but a rejected write must not leave a version without its meta blob)
+func (kv *KvStore) checkMetaBlob(ctx context.Context, metaBlob *blob.Blob) error {
+	return kv.meta.Hub().PutBlobEvent(ctx, metaBlob, nil)
+}
+
 func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
 	if strings.Contains(key, "/") {
 		return nil, ErrInvalidKey
@@ -133,21 +231,99 @@ func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, versio
 	if ref != "" {
 		res.SetHexHash(ref)
 	}
-	if err := kv.vkv.Put(res); err != nil {
-		return nil, err
+	if res.Version < 1 {
+		res.Version = time.Now().UTC().UnixNano()
 	}
 
 	metaBlob, err := kv.meta.Build(res)
 	if err != nil {
 		return nil, err
 	}
+	if err := kv.checkMetaBlob(ctx, metaBlob); err != nil {
+		return nil, err
+	}
 
-	if err := kv.vkv.SetMetaBlob(key, res.Version, metaBlob.Hash); err != nil {
+	// Store the version along with its meta blob hash in a single write
+	if err := kv.vkv.PutBatch([]*vkv.KeyValue{res}, metaBlob.Hash); err != nil {
 		return nil, err
 	}
 
 	// XXX(tsileo): notify the blobstore it does not need to exec the meta hook for this one?
-	if _, err := kv.blobStore.Put(ctx, metaBlob); err != nil {
+	if _, err := kv.blobStore.Put(ctxutil.WithLocalWrite(ctx), metaBlob); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// PutBatch stores several versions at once, using a single storage write and a single meta blob.
+//
+// The missing versions are set to the current time.
+func (kv *KvStore) PutBatch(ctx context.Context, kvs []*vkv.KeyValue) error {
+	now := time.Now().UTC().UnixNano()
+	last := map[string]int64{}
+	for _, rkv := range kvs {
+		if strings.Contains(rkv.Key, "/") {
+			return ErrInvalidKey
+		}
+		if rkv.Version < 1 {
+			rkv.Version = now
+			// Two writes of the same key within a batch must not share a version
+			if v, ok := last[rkv.Key]; ok && rkv.Version <= v {
+				rkv.Version = v + 1
+			}
+		}
+		last[rkv.Key] = rkv.Version
+	}
+	kv.log.Info("OP PutBatch", "count", len(kvs))
+
+	metaBlob, err := kv.meta.Build(vkv.Batch(kvs))
+	if err != nil {
+		return err
+	}
+	if err := kv.checkMetaBlob(ctx, metaBlob); err != nil {
+		return err
+	}
+
+	if err := kv.vkv.PutBatch(kvs, metaBlob.Hash); err != nil {
+		return err
+	}
+
+	if _, err := kv.blobStore.Put(ctxutil.WithLocalWrite(ctx), metaBlob); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete marks the key as deleted, the tombstone is stored as a meta blob like any other version.
+func (kv *KvStore) Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	kv.log.Info("OP Delete", "key", key, "version", version)
+	if _, err := kv.vkv.Get(key, -1); err != nil {
+		return nil, err
+	}
+	res := &vkv.KeyValue{
+		Key:       key,
+		Version:   version,
+		Tombstone: true,
+	}
+	if res.Version < 1 {
+		res.Version = time.Now().UTC().UnixNano()
+	}
+
+	metaBlob, err := kv.meta.Build(res)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.checkMetaBlob(ctx, metaBlob); err != nil {
+		return nil, err
+	}
+
+	if err := kv.vkv.PutBatch([]*vkv.KeyValue{res}, metaBlob.Hash); err != nil {
+		return nil, err
+	}
+
+	if _, err := kv.blobStore.Put(ctxutil.WithLocalWrite(ctx), metaBlob); err != nil {
 		return nil, err
 	}
 
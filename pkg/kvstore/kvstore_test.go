@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// newTestKvStore sets up a KvStore in a temporary directory (`testutil` imports the kvstore, so it cannot be used here)
+func newTestKvStore(t *testing.T) (*KvStore, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kvstore_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := blobstore.New(logger, true, dir, nil, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := New(logger, dir, bs, metaHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs, func() {
+		kvs.Close()
+		bs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestApplyTombstoneOutOfOrder(t *testing.T) {
+	kvs, cleanup := newTestKvStore(t)
+	defer cleanup()
+
+	put, err := (&vkv.KeyValue{Key: "k", Version: 1, Data: []byte("v")}).Dump()
+	check(err)
+	tombstone, err := (&vkv.KeyValue{Key: "k", Version: 2, Tombstone: true}).Dump()
+	check(err)
+
+	// The tombstone is replayed before the version it deletes
+	check(kvs.applyMetaFunc("aa", tombstone))
+	check(kvs.applyMetaFunc("bb", put))
+	if _, err := kvs.vkv.Get("k", -1); err != vkv.ErrNotFound {
+		t.Errorf("the deleted key came back (%v)", err)
+	}
+
+	n, err := kvs.Compact()
+	check(err)
+	if n != 2 {
+		t.Errorf("expected 2 purged versions, got %d", n)
+	}
+}
+
+func TestApplyDeletedVersion(t *testing.T) {
+	kvs, cleanup := newTestKvStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := kvs.Put(ctx, "k", "", []byte("v1"), 1)
+	check(err)
+	_, err = kvs.Put(ctx, "k", "", []byte("v2"), 2)
+	check(err)
+	check(kvs.DeleteVersion(ctx, "k", 1))
+
+	// A rescan does not restore the deleted version
+	put, err := (&vkv.KeyValue{Key: "k", Version: 1, Data: []byte("v1")}).Dump()
+	check(err)
+	check(kvs.applyMetaFunc("aa", put))
+	if _, err := kvs.vkv.Get("k", 1); err != vkv.ErrNotFound {
+		t.Errorf("the deleted version came back (%v)", err)
+	}
+
+	// Unless it's explicitly stored again
+	_, err = kvs.Put(ctx, "k", "", []byte("v1"), 1)
+	check(err)
+	if deleted, err := kvs.vkv.VersionDeleted("k", 1); err != nil || deleted {
+		t.Errorf("the version should not be marked as deleted anymore (err=%v)", err)
+	}
+}
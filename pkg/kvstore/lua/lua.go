@@ -38,6 +38,15 @@ func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*l
 				L.Push(lua.LString(cursor))
 				return 2
 			},
+			"put": func(L *lua.LState) int {
+				// put(key, data[, ref]) returns the new version
+				kv, err := kvs.Put(ctx, L.ToString(1), L.OptString(3, ""), []byte(L.ToString(2)), -1)
+				if err != nil {
+					panic(err)
+				}
+				L.Push(lua.LString(strconv.FormatInt(kv.Version, 10)))
+				return 1
+			},
 			"get_meta_blob": func(L *lua.LState) int {
 				version, err := strconv.ParseInt(L.ToString(2), 10, 0)
 				if err != nil {
@@ -0,0 +1,227 @@
+/*
+
+Package loadshed implements the load shedding of the low-priority traffic while the backend is degraded.
+
+The blobstore reports the latency and the outcome of each operation, when the average latency or the error rate over
+the last `windowSize` seconds crosses the configured thresholds, the low-priority traffic (thumbnails, anonymous reads
+and background jobs) is shed until the backend has been healthy for the cooldown period. Writes and authenticated
+reads are never shed.
+
+*/
+package loadshed // import "a4.io/blobstash/pkg/loadshed"
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+var shedVar = expvar.NewInt("loadshed-shed-requests")
+
+const (
+	// Number of 1 second buckets the stats are computed on
+	windowSize = 30
+
+	// Minimum number of operations in the window to take a decision
+	minSamples = 10
+
+	defaultCooldown = 30 * time.Second
+)
+
+type bucket struct {
+	sec     int64
+	count   int
+	errors  int
+	latency time.Duration
+}
+
+// Status holds the shedding state (displayed in the status endpoint)
+type Status struct {
+	Shedding      bool       `json:"shedding"`
+	Since         *time.Time `json:"since,omitempty"`
+	LatencyMs     float64    `json:"latency_ms"`
+	ErrorRate     float64    `json:"error_rate"`
+	Samples       int        `json:"samples"`
+	ShedRequests  int64      `json:"shed_requests"`
+	MaxLatencyMs  int        `json:"max_latency_ms,omitempty"`
+	MaxErrorRate  float64    `json:"max_error_rate,omitempty"`
+	CooldownSecs  int        `json:"cooldown_secs"`
+	WindowSeconds int        `json:"window_secs"`
+}
+
+// Shedder tracks the backend health and sheds the low-priority traffic, a nil Shedder never sheds
+type Shedder struct {
+	maxLatency   time.Duration
+	maxErrorRate float64
+	cooldown     time.Duration
+
+	buckets  [windowSize]bucket
+	shedding bool
+	since    time.Time
+	lastOver time.Time
+	shed     int64
+
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// New returns a Shedder, or nil if the load shedding is not configured
+func New(conf *config.LoadShedding) *Shedder {
+	if conf == nil || (conf.MaxLatency <= 0 && conf.MaxErrorRate <= 0) {
+		return nil
+	}
+	cooldown := defaultCooldown
+	if conf.Cooldown > 0 {
+		cooldown = time.Duration(conf.Cooldown) * time.Second
+	}
+	return &Shedder{
+		maxLatency:   time.Duration(conf.MaxLatency) * time.Millisecond,
+		maxErrorRate: conf.MaxErrorRate,
+		cooldown:     cooldown,
+		now:          time.Now,
+	}
+}
+
+// Observe records the latency and the outcome of a backend operation
+func (s *Shedder) Observe(d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sec := s.now().Unix()
+	b := &s.buckets[sec%windowSize]
+	if b.sec != sec {
+		*b = bucket{sec: sec}
+	}
+	b.count++
+	b.latency += d
+	if err != nil {
+		b.errors++
+	}
+}
+
+// stats returns the average latency, the error rate and the number of samples over the window
+func (s *Shedder) stats(now time.Time) (time.Duration, float64, int) {
+	var count, errors int
+	var latency time.Duration
+	for _, b := range s.buckets {
+		if now.Unix()-b.sec >= windowSize {
+			continue
+		}
+		count += b.count
+		errors += b.errors
+		latency += b.latency
+	}
+	if count == 0 {
+		return 0, 0, 0
+	}
+	return latency / time.Duration(count), float64(errors) / float64(count), count
+}
+
+// update refreshes the shedding state, must be called with the lock held
+func (s *Shedder) update() (time.Duration, float64, int) {
+	now := s.now()
+	latency, errorRate, samples := s.stats(now)
+	over := samples >= minSamples &&
+		((s.maxLatency > 0 && latency > s.maxLatency) || (s.maxErrorRate > 0 && errorRate > s.maxErrorRate))
+	switch {
+	case over:
+		s.lastOver = now
+		if !s.shedding {
+			s.shedding = true
+			s.since = now
+		}
+	case s.shedding && now.Sub(s.lastOver) >= s.cooldown:
+		s.shedding = false
+	}
+	return latency, errorRate, samples
+}
+
+// Shedding returns true if the low-priority traffic must be shed
+func (s *Shedder) Shedding() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update()
+	return s.shedding
+}
+
+// Status returns the current shedding state (nil if the load shedding is disabled)
+func (s *Shedder) Status() *Status {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latency, errorRate, samples := s.update()
+	st := &Status{
+		Shedding:      s.shedding,
+		LatencyMs:     float64(latency) / float64(time.Millisecond),
+		ErrorRate:     errorRate,
+		Samples:       samples,
+		ShedRequests:  s.shed,
+		MaxLatencyMs:  int(s.maxLatency / time.Millisecond),
+		MaxErrorRate:  s.maxErrorRate,
+		CooldownSecs:  int(s.cooldown / time.Second),
+		WindowSeconds: windowSize,
+	}
+	if s.shedding {
+		since := s.since
+		st.Since = &since
+	}
+	return st
+}
+
+// Reject outputs the response for a shed request
+func (s *Shedder) Reject(w http.ResponseWriter) {
+	s.mu.Lock()
+	s.shed++
+	s.mu.Unlock()
+	shedVar.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.cooldown/time.Second)))
+	httputil.WriteJSONError(w, http.StatusServiceUnavailable, "server overloaded, try again later")
+}
+
+// isThumbnail returns true if the request asks for a resized image
+func isThumbnail(r *http.Request) bool {
+	q := r.URL.Query()
+	return (r.Method == "GET" || r.Method == "HEAD") && (q.Get("w") != "" || q.Get("h") != "")
+}
+
+// Middleware sheds the thumbnail requests (the anonymous reads are shed by the auth middleware)
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isThumbnail(r) && s.Shedding() {
+			s.Reject(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wait blocks the background jobs until the shedding stops (or the context is cancelled)
+func (s *Shedder) Wait(ctx context.Context) error {
+	if s == nil {
+		return ctx.Err()
+	}
+	for s.Shedding() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,77 @@
+package loadshed
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestShedder(t *testing.T) {
+	var s *Shedder
+	if s.Shedding() || s.Status() != nil {
+		t.Errorf("a nil shedder should never shed")
+	}
+
+	now := time.Unix(1000, 0)
+	s = New(&config.LoadShedding{MaxLatency: 100, MaxErrorRate: 0.5, Cooldown: 10})
+	s.now = func() time.Time { return now }
+
+	// Not enough samples to take a decision
+	s.Observe(time.Second, nil)
+	if s.Shedding() {
+		t.Errorf("should not shed with a single sample")
+	}
+
+	for i := 0; i < minSamples; i++ {
+		s.Observe(time.Second, nil)
+	}
+	if !s.Shedding() {
+		t.Errorf("should shed when the latency is over the threshold")
+	}
+
+	// Thumbnails are shed, other requests are not
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, code := range map[string]int{"/img.jpg?w=100": http.StatusServiceUnavailable, "/img.jpg": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != code {
+			t.Errorf("%s: got %d, expected %d", path, rec.Code, code)
+		}
+	}
+
+	// The slow operations are still in the window
+	now = now.Add(5 * time.Second)
+	for i := 0; i < minSamples; i++ {
+		s.Observe(time.Millisecond, nil)
+	}
+	if !s.Shedding() {
+		t.Errorf("should keep shedding while the backend is degraded")
+	}
+
+	// The backend is healthy again, but the cooldown is not over yet
+	now = now.Add((windowSize - 5) * time.Second)
+	for i := 0; i < minSamples; i++ {
+		s.Observe(time.Millisecond, nil)
+	}
+	s.lastOver = now.Add(-5 * time.Second)
+	if !s.Shedding() {
+		t.Errorf("should keep shedding during the cooldown")
+	}
+	now = now.Add(5 * time.Second)
+	if s.Shedding() {
+		t.Errorf("should stop shedding after the cooldown")
+	}
+
+	// Error rate
+	for i := 0; i < 2*minSamples; i++ {
+		s.Observe(time.Millisecond, errors.New("failed"))
+	}
+	st := s.Status()
+	if !st.Shedding || st.ErrorRate <= 0.5 || st.ShedRequests != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
@@ -46,6 +46,11 @@ func New(logger log.Logger, chub *hub.Hub) (*Meta, error) {
 	return meta, nil
 }
 
+// Hub returns the hub the meta blobs are received from
+func (m *Meta) Hub() *hub.Hub {
+	return m.hub
+}
+
 func (m *Meta) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
 	metaType, metaData, isMeta := IsMetaBlob(blob.Data)
 	m.log.Debug("newBlobCallback", "is_meta", isMeta, "meta_type", metaType, "blob_size", len(blob.Data))
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Endpoints expecting large request bodies
+var uploadPrefixes = []string{
+	"/api/blobstore/upload",
+	"/api/blobstore/blob/",
+	"/api/filetree/upload",
+	"/api/filetree/import",
+	"/api/filetree/fs/",
+	"/api/apps/",
+	"/v2/", // OCI registry blob uploads
+}
+
+// limitedBody returns an error once more than `remaining` bytes are read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	// Read up to one byte past the limit, to tell a body of exactly `remaining` bytes from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded = true
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+func maxBodySizeFor(conf *config.Config, path string) int64 {
+	upload := int64(-1)
+	json := int64(config.DefaultMaxJSONBodySize)
+	if conf.MaxBodySize != nil {
+		if conf.MaxBodySize.Upload != 0 {
+			upload = conf.MaxBodySize.Upload
+		}
+		if conf.MaxBodySize.JSON != 0 {
+			json = conf.MaxBodySize.JSON
+		}
+	}
+	for _, prefix := range uploadPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return upload
+		}
+	}
+	return json
+}
+
+// MaxBodySize enforces the request body size limits before the body is buffered, and returns a 413 error if the
+// limit is exceeded
+func MaxBodySize(conf *config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := maxBodySizeFor(conf, r.URL.Path)
+			if limit < 0 || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > limit {
+				httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+				return
+			}
+
+			// Chunked bodies (or lying Content-Length) are checked while being read
+			body := &limitedBody{ReadCloser: r.Body, remaining: limit}
+			r.Body = body
+			defer func() {
+				if e := recover(); e != nil {
+					// The handlers panic on body read errors
+					if body.exceeded {
+						httputil.WriteJSONError(w, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+						return
+					}
+					panic(e)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
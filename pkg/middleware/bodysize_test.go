@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestMaxBodySizeChunked(t *testing.T) {
+	conf := &config.Config{MaxBodySize: &config.MaxBodySize{JSON: 10}}
+	h := MaxBodySize(conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tdata := range []struct {
+		body     string
+		expected int
+	}{
+		{"123456789", http.StatusNoContent},
+		{"1234567890", http.StatusNoContent},
+		{"12345678901", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/api/kvstore/key/ok", strings.NewReader(tdata.body))
+		// Unknown length, like a chunked body
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tdata.expected {
+			t.Errorf("body of %d bytes: expected %d, got %d", len(tdata.body), tdata.expected, w.Code)
+		}
+	}
+	if limit := maxBodySizeFor(conf, "/v2/myimage/blobs/uploads/"); limit != -1 {
+		t.Errorf("expected the registry uploads to use the upload limit, got %d", limit)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/loadshed"
+	"a4.io/blobstash/pkg/ratelimit"
 
 	_ "github.com/carbocation/interpose/middleware"
 	"github.com/unrolled/secure"
@@ -52,9 +56,11 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func NewBasicAuth(conf *config.Config) (func(*http.Request) bool, func(http.Handler) http.Handler) {
+// NewBasicAuth returns the auth func and the auth middleware, the anonymous reads of the public resources are shed
+// while the backend is degraded, and the authenticated requests are rate limited per API key
+func NewBasicAuth(conf *config.Config, shedder *loadshed.Shedder, limiter *ratelimit.Limiter) (func(*http.Request) bool, func(http.Handler) http.Handler) {
 	// FIXME(tsileo): clean this, and load passfrom config
-	if len(conf.Auth) == 0 {
+	if len(conf.Auth) == 0 && conf.OIDC == nil && conf.ClientCerts == nil {
 		return nil, func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				next.ServeHTTP(w, r)
@@ -69,10 +75,27 @@ func NewBasicAuth(conf *config.Config) (func(*http.Request) bool, func(http.Hand
 			fmt.Printf("headers=%+v\n", r.Header)
 			if authFunc(r) {
 				apiAuthSuccess.Add(1)
+				if !limiter.Check(w, r, auth.ID(r)) {
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			// Anonymous access to the public resources
+			if isPublic(conf, r) {
+				if shedder.Shedding() {
+					shedder.Reject(w)
+					return
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
 			apiAuthFailure.Add(1)
+			// Send the browsers to the SSO login page
+			if conf.OIDC != nil && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/api/oidc/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
 			w.Header().Set("WWW-Authenticate", "Basic realm=\"BlobStash\"")
 			httputil.WriteJSONError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		})
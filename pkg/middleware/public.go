@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+)
+
+// isPublic returns true if the request is a read-only request on a resource configured as public, e.g.:
+//
+//	GET /api/filetree/fs/fs/{root}/{path}
+//	GET /api/docstore/{collection}
+//	GET /api/docstore/{collection}/{_id}
+//	GET /api/docstore/{collection}/{_id}/_versions
+//
+// The public resources always live in the root namespace, and the anonymous requests cannot run Lua code (the
+// `query`/`script` parameters are evaluated by the docstore).
+func isPublic(conf *config.Config, r *http.Request) bool {
+	if conf.Public == nil || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+	if ctxutil.RequestNamespace(r) != "" {
+		return false
+	}
+	p := r.URL.Path
+	// Only accept clean paths (the router would redirect the other ones anyway)
+	if path.Clean(p) != strings.TrimSuffix(p, "/") {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(p, "/api/filetree/fs/fs/"):
+		// A custom prefix would allow to read other kv entries
+		if r.URL.Query().Get("prefix") != "" {
+			return false
+		}
+		parts := strings.SplitN(strings.TrimPrefix(p, "/api/filetree/fs/fs/"), "/", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		// Skip the special endpoints (`_tgz`, `_prune`...)
+		if strings.HasPrefix(parts[1], "_") {
+			return false
+		}
+		return conf.Public.IsPublicRoot(parts[0])
+	case strings.HasPrefix(p, "/api/docstore/"):
+		if q := r.URL.Query(); q.Get("query") != "" || q.Get("script") != "" {
+			return false
+		}
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(p, "/api/docstore/"), "/"), "/")
+		switch len(parts) {
+		case 1:
+		case 2:
+			if strings.HasPrefix(parts[1], "_") {
+				return false
+			}
+		case 3:
+			if strings.HasPrefix(parts[1], "_") || parts[2] != "_versions" {
+				return false
+			}
+		default:
+			return false
+		}
+		return conf.Public.IsPublicCollection(parts[0])
+	}
+	return false
+}
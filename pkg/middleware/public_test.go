@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestIsPublic(t *testing.T) {
+	conf := &config.Config{
+		Public: &config.Public{
+			FiletreeRoots:       []string{"blog"},
+			DocstoreCollections: []string{"posts"},
+		},
+	}
+	for _, tdata := range []struct {
+		method   string
+		url      string
+		expected bool
+	}{
+		{"GET", "/api/filetree/fs/fs/blog/", true},
+		{"HEAD", "/api/filetree/fs/fs/blog/2019/index.html", true},
+		{"POST", "/api/filetree/fs/fs/blog/new.txt", false},
+		{"GET", "/api/filetree/fs/fs/blog/_tgz", false},
+		{"GET", "/api/filetree/fs/fs/blog/?prefix=secret", false},
+		{"GET", "/api/filetree/fs/fs/private/", false},
+		{"GET", "/api/filetree/fs/fs/blog/../private/", false},
+		{"GET", "/api/filetree/fs/ref/blog/", false},
+		{"GET", "/api/docstore/posts", true},
+		{"GET", "/api/docstore/posts/abc", true},
+		{"GET", "/api/docstore/posts/abc/_versions", true},
+		{"GET", "/api/docstore/posts/_indexes", false},
+		{"GET", "/api/docstore/posts?query=os.exit()", false},
+		{"GET", "/api/docstore/posts?script=return+true", false},
+		{"GET", "/api/docstore/posts?db=private", false},
+		{"POST", "/api/docstore/posts", false},
+		{"GET", "/api/docstore/drafts", false},
+		{"GET", "/api/docstore/", false},
+		{"GET", "/api/kvstore/keys", false},
+	} {
+		if got := isPublic(conf, httptest.NewRequest(tdata.method, tdata.url, nil)); got != tdata.expected {
+			t.Errorf("%s %s: expected %v, got %v", tdata.method, tdata.url, tdata.expected, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/docstore/posts", nil)
+	r.Header.Set("BlobStash-Namespace", "private")
+	if isPublic(conf, r) {
+		t.Errorf("the public requests should not select the namespace")
+	}
+
+	if isPublic(&config.Config{}, httptest.NewRequest("GET", "/api/docstore/posts", nil)) {
+		t.Errorf("nothing should be public by default")
+	}
+}
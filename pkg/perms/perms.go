@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"strings"
+	"sync"
 
 	"a4.io/blobstash/pkg/config"
 	"github.com/zpatrick/rbac"
@@ -34,9 +35,18 @@ const (
 	KVEntry        ObjectType = "kv"
 	FS             ObjectType = "fs"
 	Node           ObjectType = "node"
+	Share          ObjectType = "share"
 	Namespace      ObjectType = "namespace"
 	JSONDocument   ObjectType = "json-doc"
 	JSONCollection ObjectType = "json-col"
+	AuditEntry     ObjectType = "audit-entry"
+	Webhook        ObjectType = "webhook"
+	Rule           ObjectType = "rule"
+	Image          ObjectType = "image"
+	Conn           ObjectType = "conn"
+	Dashboard      ObjectType = "dashboard"
+	Config         ObjectType = "config"
+	Job            ObjectType = "job"
 )
 
 // Services
@@ -46,6 +56,12 @@ const (
 	DocStore  ServiceName = "docstore"
 	Filetree  ServiceName = "filetree"
 	Stash     ServiceName = "stash"
+	Audit     ServiceName = "audit"
+	Hub       ServiceName = "hub"
+	Registry  ServiceName = "registry"
+	Debug     ServiceName = "debug"
+	Server    ServiceName = "server"
+	Jobs      ServiceName = "jobs"
 )
 
 // Action formats an action `<action_type>:<object_type>`
@@ -93,11 +109,19 @@ func init() {
 			},
 		},
 	})
+	for k, r := range roles {
+		builtinRoles[k] = r
+	}
 }
 
 var roles = map[string]rbac.Role{}
 var managedRoles = map[string]*config.Role{}
 
+// The built-in roles (defined in `init`), kept when the config roles are reloaded
+var builtinRoles = map[string]rbac.Role{}
+
+var mu sync.RWMutex
+
 func newManagedRole(r *config.Role) error {
 	for _, k := range r.ArgsRequired {
 		if _, ok := r.Args[k]; !ok {
@@ -162,6 +186,8 @@ func SetupRole(r *config.Role) error {
 }
 
 func GetRole(k string) (rbac.Role, error) {
+	mu.RLock()
+	defer mu.RUnlock()
 	r, ok := roles[k]
 	if !ok {
 		return rbac.Role{}, fmt.Errorf("role %q not found", k)
@@ -182,6 +208,8 @@ func GetRoles(keys []string) (rbac.Roles, error) {
 }
 
 func Setup(conf *config.Config) error {
+	mu.Lock()
+	defer mu.Unlock()
 	for _, role := range conf.Roles {
 		if err := SetupRole(role); err != nil {
 			panic(err)
@@ -189,3 +217,23 @@ func Setup(conf *config.Config) error {
 	}
 	return nil
 }
+
+// Reload replaces the roles defined in the config (the previous roles are kept if the new ones are invalid)
+func Reload(conf *config.Config) error {
+	mu.Lock()
+	defer mu.Unlock()
+	prev, prevManaged := roles, managedRoles
+	roles = map[string]rbac.Role{}
+	for k, r := range builtinRoles {
+		roles[k] = r
+	}
+	// The managed roles removed from the config must not be usable as templates anymore
+	managedRoles = map[string]*config.Role{}
+	for _, role := range conf.Roles {
+		if err := SetupRole(role); err != nil {
+			roles, managedRoles = prev, prevManaged
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Package provenance implements the signing of the meta blobs and the filetree nodes with an Ed25519 server key.
+//
+// Only the blobs created by this instance are signed (the kv meta blobs and the filetree nodes written locally, see
+// `ctxutil.WithLocalWrite`), not the ones received via the sync, the replication or from the peers.
+//
+// The signatures are detached (the blobs are left untouched) and append-only: a blob is signed once, the signature is
+// never replaced. As the blobs are content-addressed, signing the hash signs the content, a mirror serving the blobs
+// can prove they originated from this instance by exposing the signatures along with the public key.
+package provenance // import "a4.io/blobstash/pkg/provenance"
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Algorithm is the signature algorithm
+const Algorithm = "ed25519"
+
+var messagePrefix = "blobstash-provenance\n"
+
+// Signature is the detached signature of a blob
+type Signature struct {
+	Hash      string `json:"hash"`
+	SignedAt  int64  `json:"signed_at"`
+	Signature []byte `json:"signature"`
+}
+
+// Message returns the signed message for the given blob, the signing time is signed too
+func Message(hash string, signedAt int64) []byte {
+	return []byte(messagePrefix + hash + "\n" + strconv.FormatInt(signedAt, 10))
+}
+
+// Verify returns true if the signature is valid for the public key
+func Verify(pub ed25519.PublicKey, sig *Signature) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, Message(sig.Hash, sig.SignedAt), sig.Signature)
+}
+
+// Provenance signs the meta blobs and the filetree nodes
+type Provenance struct {
+	key ed25519.PrivateKey
+	db  *rangedb.RangeDB
+	log log.Logger
+
+	// Make the check-and-set of the signatures atomic
+	mu sync.Mutex
+}
+
+// New loads the signing key (generated if needed) and subscribes to the new blobs
+func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*Provenance, error) {
+	keyPath := conf.Provenance.Key
+	if keyPath == "" {
+		keyPath = filepath.Join(conf.ConfigDir(), "provenance_key")
+	}
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the provenance key: %v", err)
+	}
+	db, err := rangedb.New(filepath.Join(conf.VarDir(), "provenance.index"))
+	if err != nil {
+		return nil, err
+	}
+	p := &Provenance{
+		key: key,
+		db:  db,
+		log: logger,
+	}
+	h.Subscribe(hub.NewBlob, "provenance", p.newBlobCallback)
+	logger.Info("signing the meta blobs", "public_key", hex.EncodeToString(p.PublicKey()))
+	return p, nil
+}
+
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// Close closes the signatures index
+func (p *Provenance) Close() error {
+	return p.db.Close()
+}
+
+// PublicKey returns the public key the signatures can be verified with
+func (p *Provenance) PublicKey() ed25519.PublicKey {
+	return p.key.Public().(ed25519.PublicKey)
+}
+
+func (p *Provenance) newBlobCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	if !ctxutil.LocalWrite(ctx) || (!b.IsMeta() && !b.IsFiletreeNode()) {
+		return nil
+	}
+	_, err := p.Sign(b.Hash)
+	return err
+}
+
+// Sign signs the blob, unless it's already signed (the existing signature is returned)
+func (p *Provenance) Sign(hash string) (*Signature, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sig, err := p.Signature(hash)
+	if err != nil || sig != nil {
+		return sig, err
+	}
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	signedAt := time.Now().UnixNano()
+	sig = &Signature{
+		Hash:      hash,
+		SignedAt:  signedAt,
+		Signature: ed25519.Sign(p.key, Message(hash, signedAt)),
+	}
+	val := make([]byte, 8+len(sig.Signature))
+	binary.BigEndian.PutUint64(val, uint64(signedAt))
+	copy(val[8:], sig.Signature)
+	if err := p.db.Set(bhash, val); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Signature returns the signature of the blob, nil if it has not been signed
+func (p *Provenance) Signature(hash string) (*Signature, error) {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	val, err := p.db.Get(bhash)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	return &Signature{
+		Hash:      hash,
+		SignedAt:  int64(binary.BigEndian.Uint64(val[0:8])),
+		Signature: val[8:],
+	}, nil
+}
+
+// Register registers the provenance API
+func (p *Provenance) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/key", basicAuth(http.HandlerFunc(p.keyHandler())))
+	r.Handle("/signature/{hash}", basicAuth(http.HandlerFunc(p.signatureHandler())))
+	r.Handle("/verify", basicAuth(http.HandlerFunc(p.verifyHandler())))
+}
+
+func canStat(w http.ResponseWriter, r *http.Request) bool {
+	return auth.Can(
+		w,
+		r,
+		perms.Action(perms.Stat, perms.Blob),
+		perms.Resource(perms.BlobStore, perms.Blob),
+	)
+}
+
+// keyHandler returns the public key
+func (p *Provenance) keyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canStat(w, r) {
+			auth.Forbidden(w)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"algorithm":  Algorithm,
+			"public_key": []byte(p.PublicKey()),
+		})
+	}
+}
+
+// signatureHandler returns the signature of the blob
+func (p *Provenance) signatureHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canStat(w, r) {
+			auth.Forbidden(w)
+			return
+		}
+		sig, err := p.Signature(mux.Vars(r)["hash"])
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if sig == nil {
+			httputil.WriteJSONError(w, http.StatusNotFound, "blob not signed")
+			return
+		}
+		httputil.MarshalAndWrite(r, w, sig)
+	}
+}
+
+// VerifyRequest holds a signature to verify, along with the blob data (optional)
+type VerifyRequest struct {
+	Signature
+	Data []byte `json:"data,omitempty"`
+}
+
+// verifyHandler checks a signature against the public key (and the data against the hash if provided)
+func (p *Provenance) verifyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canStat(w, r) {
+			auth.Forbidden(w)
+			return
+		}
+		req := &VerifyRequest{}
+		if err := httputil.Unmarshal(r, req); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		valid := Verify(p.PublicKey(), &req.Signature)
+		if valid && req.Data != nil && hashutil.Compute(req.Data) != req.Hash {
+			valid = false
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"valid": valid,
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package provenance
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_provenance_test")
+	check(err)
+	defer os.RemoveAll(dir)
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	conf := &config.Config{
+		DataDir:    dir,
+		Provenance: &config.ProvenanceConfig{Key: filepath.Join(dir, "key")},
+	}
+	p, err := New(logger, conf, h)
+	check(err)
+
+	ctx := ctxutil.WithLocalWrite(context.Background())
+	metaData := []byte("#blobstash/meta\nsome meta")
+	metaBlob := &blob.Blob{Hash: hashutil.Compute(metaData), Data: metaData}
+	check(h.NewBlobEvent(ctx, metaBlob, nil))
+	// The blobs received from another instance are not signed
+	remoteData := []byte("#blobstash/meta\nremote meta")
+	remoteBlob := &blob.Blob{Hash: hashutil.Compute(remoteData), Data: remoteData}
+	check(h.NewBlobEvent(context.Background(), remoteBlob, nil))
+	data := []byte("some data")
+	dataBlob := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+	check(h.NewBlobEvent(ctx, dataBlob, nil))
+
+	sig, err := p.Signature(metaBlob.Hash)
+	check(err)
+	if sig == nil || !Verify(p.PublicKey(), sig) {
+		t.Fatalf("the meta blob should be signed, got %+v", sig)
+	}
+	if sig, err := p.Signature(dataBlob.Hash); err != nil || sig != nil {
+		t.Errorf("data blobs should not be signed, got %+v %v", sig, err)
+	}
+
+	if sig, err := p.Signature(remoteBlob.Hash); err != nil || sig != nil {
+		t.Errorf("remote blobs should not be signed, got %+v %v", sig, err)
+	}
+
+	// Append-only: the existing signature is kept
+	sig2, err := p.Sign(metaBlob.Hash)
+	check(err)
+	if sig2.SignedAt != sig.SignedAt {
+		t.Errorf("the signature should not be replaced")
+	}
+
+	// The signing time is part of the signed message
+	forged := *sig
+	forged.SignedAt++
+	if Verify(p.PublicKey(), &forged) {
+		t.Errorf("the forged signature should not be valid")
+	}
+
+	// The key is reloaded on restart
+	pub := p.PublicKey()
+	check(p.Close())
+	p, err = New(logger, conf, h)
+	check(err)
+	defer p.Close()
+	if !pub.Equal(p.PublicKey()) {
+		t.Errorf("the key should be persisted")
+	}
+}
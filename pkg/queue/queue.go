@@ -54,11 +54,13 @@ func (q *Queue) Size() (int, error) {
 	defer c.Close()
 
 	// Iterate the range
-	c.Next()
-	var err error
+	_, _, err := c.Next()
 	for ; err == nil; _, _, err = c.Next() {
 		cnt++
 	}
+	if err != io.EOF {
+		return 0, err
+	}
 	return cnt, nil
 }
 
@@ -110,7 +112,13 @@ func (q *Queue) Blobs() ([]*blob.Blob, error) {
 
 // Enqueue the given `item`. Must be JSON serializable.
 func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
-	id, err := id.New(time.Now().UnixNano())
+	return q.EnqueueAt(item, time.Now())
+}
+
+// EnqueueAt enqueues the given `item` as if it was enqueued at `t` (the items are dequeued by enqueue date, a date in
+// the future delays the item behind the ones enqueued before).
+func (q *Queue) EnqueueAt(item interface{}, t time.Time) (*id.ID, error) {
+	id, err := id.New(t.UnixNano())
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +128,9 @@ func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
 		return nil, err
 	}
 
-	q.db.Set(id.Raw(), js)
+	if err := q.db.Set(id.Raw(), js); err != nil {
+		return nil, err
+	}
 
 	return id, nil
 }
@@ -161,3 +171,35 @@ func (q *Queue) Dequeue(item interface{}) (bool, func(bool), error) {
 
 // TODO(tsileo): func (q *Queue) Items() ([]*blob.Blob, error)
 // also use `*blob.Blob` instead if `interface{}`
+
+// DequeueBatch calls `f` with the (JSON encoded) `max` older items, the returned func removes them from the queue.
+// Returns 0 if the queue is empty.
+func (q *Queue) DequeueBatch(max int, f func([]byte) error) (int, func(bool), error) {
+	c := q.db.PrefixRange([]byte(""), false)
+	defer c.Close()
+
+	keys := [][]byte{}
+	k, js, err := c.Next()
+	for ; err == nil && len(keys) < max; k, js, err = c.Next() {
+		if err := f(js); err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err != nil && err != io.EOF {
+		return 0, nil, fmt.Errorf("next failed: %v", err)
+	}
+
+	deqFunc := func(remove bool) {
+		if !remove {
+			return
+		}
+		for _, k := range keys {
+			if err := q.db.Delete(k); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	return len(keys), deqFunc, nil
+}
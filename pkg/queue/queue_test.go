@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -76,3 +77,45 @@ func TestQueue(t *testing.T) {
 		t.Errorf("no item should have been dequeued, got \"%s\"", deq3.Val)
 	}
 }
+
+func TestQueueDequeueBatch(t *testing.T) {
+	q, err := New("queue_batch_test")
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	defer q.Remove()
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := q.Enqueue(&Item{v})
+		check(err)
+	}
+
+	vals := []string{}
+	collect := func(js []byte) error {
+		i := &Item{}
+		if err := json.Unmarshal(js, i); err != nil {
+			return err
+		}
+		vals = append(vals, i.Val)
+		return nil
+	}
+	cnt, deqFunc, err := q.DequeueBatch(2, collect)
+	check(err)
+	deqFunc(true)
+	if cnt != 2 || len(vals) != 2 || vals[0] != "a" || vals[1] != "b" {
+		t.Errorf("unexpected batch %d %v", cnt, vals)
+	}
+
+	vals = nil
+	cnt, deqFunc, err = q.DequeueBatch(2, collect)
+	check(err)
+	deqFunc(true)
+	if cnt != 1 || vals[0] != "c" {
+		t.Errorf("unexpected batch %d %v", cnt, vals)
+	}
+
+	cnt, _, err = q.DequeueBatch(2, collect)
+	check(err)
+	if cnt != 0 {
+		t.Errorf("the queue should be empty, got %d items", cnt)
+	}
+}
@@ -3,6 +3,7 @@ package rangedb // import "a4.io/blobstash/pkg/rangedb"
 import (
 	"io"
 	"os"
+	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
@@ -13,6 +14,9 @@ import (
 type RangeDB struct {
 	db   *leveldb.DB
 	path string
+
+	// Serializes the sorted sets updates (read-modify-write of the scores and the cardinality)
+	zmu sync.Mutex
 }
 
 // New creates a new database.
@@ -48,6 +52,29 @@ func (db *RangeDB) Delete(k []byte) error {
 	return db.db.Delete(k, nil)
 }
 
+// Batch groups several writes that will be applied atomically
+type Batch struct {
+	b *leveldb.Batch
+}
+
+// NewBatch returns an empty batch
+func NewBatch() *Batch {
+	return &Batch{new(leveldb.Batch)}
+}
+
+func (b *Batch) Set(k, v []byte) {
+	b.b.Put(k, v)
+}
+
+func (b *Batch) Delete(k []byte) {
+	b.b.Delete(k)
+}
+
+// Write applies the batch
+func (db *RangeDB) Write(b *Batch) error {
+	return db.db.Write(b.b, nil)
+}
+
 func (db *RangeDB) Get(k []byte) ([]byte, error) {
 	v, err := db.db.Get(k, nil)
 	if err != nil {
@@ -99,7 +126,15 @@ func (db *RangeDB) PrefixRange(prefix []byte, reverse bool) *Range {
 }
 
 func (db *RangeDB) Range(min, max []byte, reverse bool) *Range {
-	iter := db.db.NewIterator(&util.Range{Start: min, Limit: NextKey(max)}, nil)
+	// The max is inclusive, a max only made of 0xff bytes has no next key (i.e. no upper bound)
+	var limit []byte
+	for _, b := range max {
+		if b != 0xff {
+			limit = NextKey(max)
+			break
+		}
+	}
+	iter := db.db.NewIterator(&util.Range{Start: min, Limit: limit}, nil)
 	return &Range{
 		it:      iter,
 		Min:     min,
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"testing"
 )
@@ -66,6 +67,12 @@ func TestDBBasic(t *testing.T) {
 		t.Errorf("range check failed")
 	}
 
+	// No upper bound
+	rmax := getRange(t, db, []byte("hello090"), []byte("\xff"), false)
+	if !reflect.DeepEqual(rmax, append(out[90:], []byte("zello01"))) {
+		t.Errorf("range check failed %q", rmax)
+	}
+
 	// Reverse the original data
 	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
 		out[i], out[j] = out[j], out[i]
@@ -83,3 +90,62 @@ func TestDBBasic(t *testing.T) {
 		t.Errorf("range check failed")
 	}
 }
+
+func TestSortedSet(t *testing.T) {
+	db, err := New("db_zset")
+	defer db.Destroy()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+
+	for _, s := range []float64{-10.5, -1, 0, 0.5, 3, 1e10} {
+		if d := DecodeScore(EncodeScore(s)); d != s {
+			t.Errorf("score %v decoded as %v", s, d)
+		}
+	}
+
+	for i, s := range []float64{3, -1, 10, 0.5, -10.5} {
+		added, err := db.ZAdd("feed", s, fmt.Sprintf("item%d", i))
+		check(err)
+		if !added {
+			t.Errorf("item%d should have been added", i)
+		}
+	}
+	// Update the score of an existing member
+	added, err := db.ZAdd("feed", 7, "item0")
+	check(err)
+	if added {
+		t.Errorf("item0 should have been updated")
+	}
+	checkMembers := func(res []*ZMember, expected ...string) {
+		members := []string{}
+		for _, m := range res {
+			members = append(members, m.Member)
+		}
+		if !reflect.DeepEqual(members, expected) {
+			t.Errorf("expected %q, got %q", expected, members)
+		}
+	}
+
+	card, err := db.ZCard("feed")
+	check(err)
+	if card != 5 {
+		t.Errorf("expected 5 members, got %d", card)
+	}
+	res, err := db.ZRangeByScore("feed", -1, 7, false, 0)
+	check(err)
+	checkMembers(res, "item1", "item3", "item0")
+	if res[2].Score != 7 {
+		t.Errorf("unexpected score %v", res[2].Score)
+	}
+	res, err = db.ZRangeByScore("feed", math.Inf(-1), math.Inf(1), true, 2)
+	check(err)
+	checkMembers(res, "item2", "item0")
+
+	// Other sets are not mixed
+	_, err = db.ZAdd("feed2", 1, "other")
+	check(err)
+	res, err = db.ZRangeByScore("feed", 0, 1, false, 0)
+	check(err)
+	checkMembers(res, "item3")
+}
@@ -0,0 +1,128 @@
+package rangedb // import "a4.io/blobstash/pkg/rangedb"
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Sorted sets are stored as 3 kinds of keys (prefixed by `z` + the set name + `\x00`):
+// - `m` + member => the encoded score
+// - `s` + encoded score + member => empty (the score index, iterated by ZRangeByScore)
+// - `c` => the cardinality (uint64)
+const (
+	zsetPrefix      = 'z'
+	zsetMember      = 'm'
+	zsetScore       = 's'
+	zsetCardinality = 'c'
+)
+
+// ZMember is a sorted set member along with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// EncodeScore encodes the score so the byte-wise ordering of the encoded scores matches the numerical ordering
+func EncodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		// Negative numbers: reverse the ordering by flipping all the bits
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, bits)
+	return out
+}
+
+// DecodeScore decodes a score encoded by EncodeScore
+func DecodeScore(data []byte) float64 {
+	bits := binary.BigEndian.Uint64(data)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func zsetKey(name string, kind byte, parts ...[]byte) []byte {
+	k := make([]byte, 0, len(name)+3)
+	k = append(k, zsetPrefix)
+	k = append(k, name...)
+	k = append(k, 0, kind)
+	for _, p := range parts {
+		k = append(k, p...)
+	}
+	return k
+}
+
+// ZCard returns the number of members of the sorted set
+func (db *RangeDB) ZCard(name string) (int, error) {
+	data, err := db.Get(zsetKey(name, zsetCardinality))
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+// ZAdd adds the member to the sorted set (or updates its score), and returns true if the member was added
+func (db *RangeDB) ZAdd(name string, score float64, member string) (bool, error) {
+	db.zmu.Lock()
+	defer db.zmu.Unlock()
+
+	memberKey := zsetKey(name, zsetMember, []byte(member))
+	encoded := EncodeScore(score)
+	old, err := db.Get(memberKey)
+	if err != nil {
+		return false, err
+	}
+
+	b := NewBatch()
+	if old != nil {
+		b.Delete(zsetKey(name, zsetScore, old, []byte(member)))
+	} else {
+		card, err := db.ZCard(name)
+		if err != nil {
+			return false, err
+		}
+		cnt := make([]byte, 8)
+		binary.BigEndian.PutUint64(cnt, uint64(card+1))
+		b.Set(zsetKey(name, zsetCardinality), cnt)
+	}
+	b.Set(memberKey, encoded)
+	b.Set(zsetKey(name, zsetScore, encoded, []byte(member)), []byte{})
+	if err := db.Write(b); err != nil {
+		return false, err
+	}
+	return old == nil, nil
+}
+
+// ZRangeByScore returns the members with a score between min and max (inclusive), ordered by score (highest first if
+// reverse is set), limit <= 0 returns all the members
+func (db *RangeDB) ZRangeByScore(name string, min, max float64, reverse bool, limit int) ([]*ZMember, error) {
+	out := []*ZMember{}
+	if min > max {
+		return out, nil
+	}
+	// The range max is inclusive, and the score keys of the max score are prefixed by it
+	prefix := zsetKey(name, zsetScore)
+	r := db.Range(zsetKey(name, zsetScore, EncodeScore(min)), zsetKey(name, zsetScore, EncodeScore(max)), reverse)
+	defer r.Close()
+	for limit <= 0 || len(out) < limit {
+		k, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &ZMember{
+			Member: string(k[len(prefix)+8:]),
+			Score:  DecodeScore(k[len(prefix) : len(prefix)+8]),
+		})
+	}
+	return out, nil
+}
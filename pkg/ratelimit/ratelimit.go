@@ -0,0 +1,160 @@
+/*
+
+Package ratelimit implements a token bucket rate limiting of the authenticated requests, per API key and per route
+class (blob writes, kv writes and reads).
+
+The limits are configured per auth ID (see the `rate_limits` config item), the "*" entry applies to the API keys
+without their own limits.
+
+*/
+package ratelimit // import "a4.io/blobstash/pkg/ratelimit"
+
+import (
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+var limitedVar = expvar.NewMap("ratelimit-limited-requests")
+
+// Route classes
+const (
+	BlobWrites = "blob_writes"
+	KvWrites   = "kv_writes"
+	Reads      = "reads"
+)
+
+// Default limits entry
+const defaultID = "*"
+
+// Path prefixes of the endpoints storing blobs
+var blobPrefixes = []string{
+	"/api/blobstore/",
+	"/api/filetree/",
+	"/v2/",
+}
+
+// Path prefixes of the read-only endpoints also accepting POST requests
+var readPrefixes = []string{
+	"/api/query",
+}
+
+// Class returns the route class of the request
+func Class(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return Reads
+	}
+	for _, prefix := range readPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return Reads
+		}
+	}
+	for _, prefix := range blobPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return BlobWrites
+		}
+	}
+	return KvWrites
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter holds the buckets of the API keys
+type Limiter struct {
+	limits  map[string]map[string]*config.RateLimit
+	buckets map[string]*bucket
+
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// New returns a Limiter (the requests are not limited if no rate limits are configured)
+func New(conf *config.Config) *Limiter {
+	return &Limiter{
+		limits:  conf.RateLimits,
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Reload replaces the rate limits, the buckets are reset
+func (l *Limiter) Reload(conf *config.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = conf.RateLimits
+	l.buckets = map[string]*bucket{}
+}
+
+// limit returns the limit for the given auth ID and route class (nil if unlimited)
+func (l *Limiter) limit(id, class string) *config.RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits, ok := l.limits[id]
+	if !ok {
+		limits = l.limits[defaultID]
+	}
+	if limit, ok := limits[class]; ok && limit.Rate > 0 {
+		return limit
+	}
+	return nil
+}
+
+// Allow takes a token from the bucket, it returns the delay before the next token if the bucket is empty
+func (l *Limiter) Allow(id, class string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	limit := l.limit(id, class)
+	if limit == nil {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, limit.Rate)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	k := id + ":" + class
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[k] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// Check returns false (and outputs a 429 response) if the request of the given API key is rate limited
+func (l *Limiter) Check(w http.ResponseWriter, r *http.Request, id string) bool {
+	if l == nil {
+		return true
+	}
+	class := Class(r)
+	ok, delay := l.Allow(id, class)
+	if ok {
+		return true
+	}
+	limitedVar.Add(class, 1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	httputil.WriteJSONError(w, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+	return false
+}
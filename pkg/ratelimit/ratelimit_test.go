@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestLimiter(t *testing.T) {
+	var l *Limiter
+	if ok, _ := l.Allow("key", Reads); !ok {
+		t.Errorf("a nil limiter should allow everything")
+	}
+
+	now := time.Unix(1000, 0)
+	l = New(&config.Config{RateLimits: map[string]map[string]*config.RateLimit{
+		"*":      {BlobWrites: {Rate: 1, Burst: 2}},
+		"backup": {BlobWrites: {Rate: 10}},
+	}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("key", BlobWrites); !ok {
+			t.Errorf("request %d should be allowed (burst)", i)
+		}
+	}
+	ok, delay := l.Allow("key", BlobWrites)
+	if ok || delay != time.Second {
+		t.Errorf("expected to be limited for 1s, got %v %v", ok, delay)
+	}
+	// Other classes, and other keys are not affected
+	if ok, _ := l.Allow("key", Reads); !ok {
+		t.Errorf("reads should not be limited")
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("backup", BlobWrites); !ok {
+			t.Errorf("backup request %d should be allowed", i)
+		}
+	}
+	if ok, _ := l.Allow("backup", BlobWrites); ok {
+		t.Errorf("backup should be limited")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("key", BlobWrites); !ok {
+		t.Errorf("the bucket should have been refilled")
+	}
+
+	rec := httptest.NewRecorder()
+	if l.Check(rec, httptest.NewRequest("POST", "/api/blobstore/upload", nil), "key") {
+		t.Errorf("expected the request to be limited")
+	}
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestClass(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, class string
+	}{
+		{"GET", "/api/blobstore/blob/abc", Reads},
+		{"POST", "/api/blobstore/upload", BlobWrites},
+		{"POST", "/api/filetree/upload", BlobWrites},
+		{"PUT", "/v2/img/manifests/latest", BlobWrites},
+		{"POST", "/api/kvstore/key/abc", KvWrites},
+		{"DELETE", "/api/docstore/col/id", KvWrites},
+		{"POST", "/api/query", Reads},
+	} {
+		if c := Class(httptest.NewRequest(tc.method, tc.path, nil)); c != tc.class {
+			t.Errorf("%s %s: got %s, expected %s", tc.method, tc.path, c, tc.class)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+/*
+
+Package refgraph maintains a reverse index of the references between the blobs, answering "what references this
+blob?" across the apps.
+
+The index is fed by the hub (for the new and the scanned blobs), so it can be rebuilt with a rescan:
+
+ - filetree nodes reference their children (directories) and their chunks (files)
+ - kvstore versions reference the blob set as their hash (e.g. the filetree FS roots)
+ - docstore documents reference the filetree nodes they point to (`@filetree/ref:<hash>`)
+
+A reference count is maintained per blob (along with a forward index, from the referrers to the blobs they reference),
+the references of a kvstore version are released when the version is removed (deleted, compacted, or preceding a
+tombstone), so a blob whose count drops to 0 is no longer referenced (and can be collected without walking the whole graph).
+
+*/
+package refgraph // import "a4.io/blobstash/pkg/refgraph"
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Referrer types
+const (
+	Filetree = "filetree"
+	KvStore  = "kv"
+	DocStore = "docstore"
+)
+
+const (
+	docstorePrefix     = "docstore:"
+	pointerFiletreeRef = "@filetree/ref:"
+)
+
+// Index keys prefixes (the reverse index keys start with the referenced blob hash)
+const (
+	countPrefix   = "#"
+	forwardPrefix = ">"
+	countsBuilt   = "_counts_built"
+)
+
+// Referrer holds an object referencing a blob
+type Referrer struct {
+	Type string `json:"type"`
+
+	// Set for the filetree nodes
+	Ref string `json:"ref,omitempty"`
+
+	// Set for the kvstore entries/docstore documents
+	Key     string `json:"key,omitempty"`
+	Version int64  `json:"version,omitempty"`
+}
+
+// id returns the part of the index key identifying the referrer
+func (r *Referrer) id() string {
+	if r.Type == Filetree {
+		return r.Ref
+	}
+	return r.Key + "@" + strconv.FormatInt(r.Version, 10)
+}
+
+// RefGraph holds the reverse references index
+type RefGraph struct {
+	db  *rangedb.RangeDB
+	log log.Logger
+
+	// Serializes the reference counts updates
+	mu sync.Mutex
+}
+
+// New initializes the reverse index, and subscribes to the hub
+func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*RefGraph, error) {
+	db, err := rangedb.New(filepath.Join(conf.VarDir(), "refgraph"))
+	if err != nil {
+		return nil, err
+	}
+	rg := &RefGraph{
+		db:  db,
+		log: logger,
+	}
+	if err := rg.buildCounts(); err != nil {
+		return nil, fmt.Errorf("failed to build the reference counts: %w", err)
+	}
+	h.Subscribe(hub.NewBlob, "refgraph", rg.newBlobCallback)
+	h.Subscribe(hub.ScanBlob, "refgraph", rg.newBlobCallback)
+	h.Subscribe(hub.DeleteKvVersion, "refgraph", rg.deleteKvVersionCallback)
+	return rg, nil
+}
+
+// Close closes the underlying DB
+func (rg *RefGraph) Close() error {
+	return rg.db.Close()
+}
+
+// key returns the index key, <referenced blob>:<referrer type>:<referrer id>
+func key(hash string, r *Referrer) []byte {
+	return []byte(hash + ":" + r.Type + ":" + r.id())
+}
+
+// forwardKey returns the forward index key, ><referrer type>:<referrer id>:<referenced blob>
+func forwardKey(r *Referrer, hash string) []byte {
+	return []byte(forwardPrefix + r.Type + ":" + r.id() + ":" + hash)
+}
+
+func countKey(hash string) []byte {
+	return []byte(countPrefix + hash)
+}
+
+func (rg *RefGraph) newBlobCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	refs, tombstones, err := references(b)
+	if err != nil {
+		// A blob that cannot be decoded should not fail the upload
+		rg.log.Error("failed to extract the references", "hash", b.Hash, "err", err)
+		return nil
+	}
+	if err := rg.addReferences(refs); err != nil {
+		return err
+	}
+	// The versions deleted by a tombstone no longer reference their blobs
+	for _, kv := range tombstones {
+		for _, typ := range []string{KvStore, DocStore} {
+			if err := rg.releaseKey(typ, kv.Key, kv.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rg *RefGraph) addReferences(refs map[string][]*Referrer) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	batch := rangedb.NewBatch()
+	counts := map[string]int64{}
+	seen := map[string]bool{}
+	for hash, rs := range refs {
+		for _, r := range rs {
+			// The blobs may be seen multiple times (e.g. rescans), only count the new references
+			k := key(hash, r)
+			exists, err := rg.db.Has(k)
+			if err != nil {
+				return err
+			}
+			if exists || seen[string(k)] {
+				continue
+			}
+			seen[string(k)] = true
+			batch.Set(k, nil)
+			batch.Set(forwardKey(r, hash), nil)
+			counts[hash]++
+		}
+	}
+	if err := rg.addCounts(batch, counts); err != nil {
+		return err
+	}
+	return rg.db.Write(batch)
+}
+
+// addCounts adds the updated reference counts to the batch
+func (rg *RefGraph) addCounts(batch *rangedb.Batch, deltas map[string]int64) error {
+	for hash, delta := range deltas {
+		count, err := rg.RefCount(hash)
+		if err != nil {
+			return err
+		}
+		if count += delta; count > 0 {
+			batch.Set(countKey(hash), []byte(strconv.FormatInt(count, 10)))
+		} else {
+			batch.Delete(countKey(hash))
+		}
+	}
+	return nil
+}
+
+func (rg *RefGraph) deleteKvVersionCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	kv, ok := data.(*vkv.KeyValue)
+	if !ok {
+		return nil
+	}
+	// The docstore references are recorded in addition to the kvstore one
+	for _, typ := range []string{KvStore, DocStore} {
+		if _, err := rg.Release(&Referrer{Type: typ, Key: kv.Key, Version: kv.Version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseKey releases the references of the versions of the key up to (and including) `version`
+func (rg *RefGraph) releaseKey(typ, key string, version int64) error {
+	prefix := []byte(forwardPrefix + typ + ":" + key + "@")
+	versions := map[int64]bool{}
+	it := rg.db.PrefixRange(prefix, false)
+	k, _, err := it.Next()
+	for ; err == nil; k, _, err = it.Next() {
+		// The rest of the key is <version>:<hash>, the keys of other referrers may share the prefix (e.g. "key@a")
+		parts := strings.SplitN(string(k[len(prefix):]), ":", 2)
+		v, perr := strconv.ParseInt(parts[0], 10, 64)
+		if perr != nil || len(parts) != 2 || v > version {
+			continue
+		}
+		versions[v] = true
+	}
+	it.Close()
+	if err != io.EOF {
+		return err
+	}
+	for v := range versions {
+		if _, err := rg.Release(&Referrer{Type: typ, Key: key, Version: v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release removes the references of the given referrer, and returns the blobs that are no longer referenced
+func (rg *RefGraph) Release(r *Referrer) ([]string, error) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	prefix := []byte(forwardPrefix + r.Type + ":" + r.id() + ":")
+	hashes := []string{}
+	it := rg.db.PrefixRange(prefix, false)
+	k, _, err := it.Next()
+	for ; err == nil; k, _, err = it.Next() {
+		hashes = append(hashes, string(k[len(prefix):]))
+	}
+	it.Close()
+	if err != io.EOF {
+		return nil, err
+	}
+
+	batch := rangedb.NewBatch()
+	deltas := map[string]int64{}
+	for _, hash := range hashes {
+		batch.Delete(key(hash, r))
+		batch.Delete(forwardKey(r, hash))
+		deltas[hash]--
+	}
+	if err := rg.addCounts(batch, deltas); err != nil {
+		return nil, err
+	}
+	if err := rg.db.Write(batch); err != nil {
+		return nil, err
+	}
+
+	unreferenced := []string{}
+	for _, hash := range hashes {
+		count, err := rg.RefCount(hash)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	return unreferenced, nil
+}
+
+// RefCount returns the number of objects referencing the blob
+func (rg *RefGraph) RefCount(hash string) (int64, error) {
+	v, err := rg.db.Get(countKey(hash))
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(v), 10, 64)
+}
+
+// buildCounts initializes the reference counts and the forward index from the reverse index (for the indexes built
+// before the counts were maintained)
+func (rg *RefGraph) buildCounts() error {
+	built, err := rg.db.Has([]byte(countsBuilt))
+	if err != nil || built {
+		return err
+	}
+	batch := rangedb.NewBatch()
+	counts := map[string]int64{}
+	it := rg.db.PrefixRange(nil, false)
+	k, _, err := it.Next()
+	for ; err == nil; k, _, err = it.Next() {
+		parts := strings.SplitN(string(k), ":", 2)
+		if len(parts[0]) != 64 || len(parts) != 2 {
+			continue
+		}
+		counts[parts[0]]++
+		batch.Set([]byte(forwardPrefix+parts[1]+":"+parts[0]), nil)
+	}
+	it.Close()
+	if err != io.EOF {
+		return err
+	}
+	for hash, count := range counts {
+		batch.Set(countKey(hash), []byte(strconv.FormatInt(count, 10)))
+	}
+	batch.Set([]byte(countsBuilt), nil)
+	return rg.db.Write(batch)
+}
+
+// references returns the blobs referenced by the given blob, along with the tombstones it holds (if it's a meta blob)
+func references(b *blob.Blob) (map[string][]*Referrer, []*vkv.KeyValue, error) {
+	refs := map[string][]*Referrer{}
+
+	if _, ok := rnode.IsNodeBlob(b.Data); ok {
+		n, err := rnode.NewNodeFromBlob(b.Hash, b.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		r := &Referrer{Type: Filetree, Ref: b.Hash}
+		if n.IsFile() {
+			for _, iv := range n.FileRefs() {
+				refs[iv.Value] = append(refs[iv.Value], r)
+				if iv.Base != "" {
+					refs[iv.Base] = append(refs[iv.Base], r)
+				}
+			}
+		} else {
+			for _, ref := range n.Refs {
+				if h, ok := ref.(string); ok {
+					refs[h] = append(refs[h], r)
+				}
+			}
+		}
+		return refs, nil, nil
+	}
+
+	metaType, data, ok := meta.IsMetaBlob(b.Data)
+	if !ok {
+		return nil, nil, nil
+	}
+	kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tombstones []*vkv.KeyValue
+	for _, kv := range kvs {
+		if kv.Tombstone {
+			tombstones = append(tombstones, kv)
+			continue
+		}
+		if h := kv.HexHash(); h != "" {
+			refs[h] = append(refs[h], &Referrer{Type: KvStore, Key: kv.Key, Version: kv.Version})
+		}
+		if strings.HasPrefix(kv.Key, docstorePrefix) {
+			r := &Referrer{Type: DocStore, Key: kv.Key, Version: kv.Version}
+			for _, h := range filetreePointers(kv.Data) {
+				refs[h] = append(refs[h], r)
+			}
+		}
+	}
+	return refs, tombstones, nil
+}
+
+// filetreePointers returns the hashes of the `@filetree/ref:<hash>` pointers found in the (encoded) document
+func filetreePointers(data []byte) []string {
+	var out []string
+	for {
+		i := bytes.Index(data, []byte(pointerFiletreeRef))
+		if i == -1 {
+			return out
+		}
+		data = data[i+len(pointerFiletreeRef):]
+		if len(data) < 64 {
+			return out
+		}
+		if _, err := hex.DecodeString(string(data[:64])); err == nil {
+			out = append(out, string(data[:64]))
+		}
+	}
+}
+
+// Referrers returns the objects referencing the given blob
+func (rg *RefGraph) Referrers(hash string) ([]*Referrer, error) {
+	out := []*Referrer{}
+	prefix := []byte(hash + ":")
+	it := rg.db.PrefixRange(prefix, false)
+	defer it.Close()
+	k, _, err := it.Next()
+	for ; err == nil; k, _, err = it.Next() {
+		parts := strings.SplitN(string(k[len(prefix):]), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid index key %q", k)
+		}
+		r := &Referrer{Type: parts[0]}
+		switch r.Type {
+		case Filetree:
+			r.Ref = parts[1]
+		default:
+			i := strings.LastIndex(parts[1], "@")
+			if i == -1 {
+				return nil, fmt.Errorf("invalid index key %q", k)
+			}
+			r.Key = parts[1][:i]
+			if r.Version, err = strconv.ParseInt(parts[1][i+1:], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid index key %q", k)
+			}
+		}
+		out = append(out, r)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (rg *RefGraph) refsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Blob),
+			perms.ResourceWithID(perms.BlobStore, perms.Blob, hash),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		refs, err := rg.Referrers(hash)
+		if err != nil {
+			panic(err)
+		}
+		count, err := rg.RefCount(hash)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"hash":          hash,
+			"refcount":      count,
+			"referenced":    count > 0,
+			"referenced_by": refs,
+		})
+	}
+}
+
+// Register registers the HTTP endpoints
+func (rg *RefGraph) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/{hash:[a-f0-9]{64}}", basicAuth(http.HandlerFunc(rg.refsHandler())))
+}
+
+// RegisterBlobRefs registers the references endpoint of the blobstore API (`/blob/{hash}/refs`)
+func (rg *RefGraph) RegisterBlobRefs(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/blob/{hash:[a-f0-9]{64}}/refs", basicAuth(http.HandlerFunc(rg.refsHandler())))
+}
@@ -0,0 +1,123 @@
+package refgraph
+
+import (
+	"context"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	env := testutil.New(t, "refgraph_test")
+	defer env.Close()
+	h, bs, kvs := env.Hub, env.BlobStore, env.KvStore
+	rg, err := New(env.Log, &config.Config{DataDir: env.Dir}, env.Hub)
+	check(err)
+	defer rg.Close()
+
+	ctx := context.Background()
+	chunk := blob.New([]byte("chunk"))
+	_, err = bs.Put(ctx, chunk)
+	check(err)
+
+	file := &rnode.RawNode{Type: rnode.File, Name: "file.txt", Size: 5}
+	file.AddIndexedRef(5, chunk.Hash)
+	fileHash, data := file.Encode()
+	_, err = bs.Put(ctx, &blob.Blob{Hash: fileHash, Data: data})
+	check(err)
+
+	dir2 := &rnode.RawNode{Type: rnode.Dir, Name: "_root"}
+	dir2.AddRef(fileHash)
+	dirHash, data := dir2.Encode()
+	_, err = bs.Put(ctx, &blob.Blob{Hash: dirHash, Data: data})
+	check(err)
+
+	_, err = kvs.Put(ctx, "_filetree:fs:myfs", dirHash, nil, -1)
+	check(err)
+	doc, err := kvs.Put(ctx, "docstore:notes:1", "", []byte("{\"file\":\"@filetree/ref:"+fileHash+"\"}"), -1)
+	check(err)
+
+	refs, err := rg.Referrers(chunk.Hash)
+	check(err)
+	if len(refs) != 1 || refs[0].Type != Filetree || refs[0].Ref != fileHash {
+		t.Errorf("unexpected chunk referrers %+v", refs)
+	}
+
+	refs, err = rg.Referrers(fileHash)
+	check(err)
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 referrers, got %+v", refs)
+	}
+	// Sorted by type
+	if refs[0].Type != DocStore || refs[0].Key != "docstore:notes:1" || refs[0].Version != doc.Version {
+		t.Errorf("unexpected docstore referrer %+v", refs[0])
+	}
+	if refs[1].Type != Filetree || refs[1].Ref != dirHash {
+		t.Errorf("unexpected filetree referrer %+v", refs[1])
+	}
+
+	refs, err = rg.Referrers(dirHash)
+	check(err)
+	if len(refs) != 1 || refs[0].Type != KvStore || refs[0].Key != "_filetree:fs:myfs" {
+		t.Errorf("unexpected root referrers %+v", refs)
+	}
+
+	refs, err = rg.Referrers(blob.New([]byte("orphan")).Hash)
+	check(err)
+	if len(refs) != 0 {
+		t.Errorf("expected no referrers, got %+v", refs)
+	}
+
+	count := func(hash string) int64 {
+		c, err := rg.RefCount(hash)
+		check(err)
+		return c
+	}
+	if c := count(fileHash); c != 2 {
+		t.Errorf("expected a refcount of 2, got %d", c)
+	}
+
+	// Rescans don't change the counts
+	check(h.ScanBlobEvent(ctx, &blob.Blob{Hash: dirHash, Data: data}, nil))
+	if c := count(fileHash); c != 2 {
+		t.Errorf("expected a refcount of 2 after a rescan, got %d", c)
+	}
+
+	// Removing a kvstore version releases its references
+	check(kvs.DeleteVersion(ctx, "docstore:notes:1", doc.Version))
+	if c := count(fileHash); c != 1 {
+		t.Errorf("expected a refcount of 1, got %d", c)
+	}
+	fs, err := kvs.Get(ctx, "_filetree:fs:myfs", -1)
+	check(err)
+	unreferenced, err := rg.Release(&Referrer{Type: KvStore, Key: fs.Key, Version: fs.Version})
+	check(err)
+	if len(unreferenced) != 1 || unreferenced[0] != dirHash || count(dirHash) != 0 {
+		t.Errorf("the root dir should not be referenced anymore, got %+v", unreferenced)
+	}
+	if refs, err := rg.Referrers(dirHash); err != nil || len(refs) != 0 {
+		t.Errorf("expected no referrers, got %+v (%v)", refs, err)
+	}
+
+	// A tombstone releases the references of the versions it deletes
+	_, err = kvs.Put(ctx, "_filetree:fs:other", dirHash, nil, -1)
+	check(err)
+	if c := count(dirHash); c != 1 {
+		t.Errorf("expected a refcount of 1, got %d", c)
+	}
+	_, err = kvs.Delete(ctx, "_filetree:fs:other", -1)
+	check(err)
+	if c := count(dirHash); c != 0 {
+		t.Errorf("expected a refcount of 0 after the tombstone, got %d", c)
+	}
+
+}
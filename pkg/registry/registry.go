@@ -0,0 +1,728 @@
+/*
+
+Package registry implements the OCI distribution API (`/v2/`), a container registry backed by BlobStash.
+
+The layers are stored like the filetree files (split in content-defined chunks), so the identical chunks are only
+stored once across layers, images and the other BlobStash apps. The kvstore holds the mapping between the layer digests
+and the file nodes (`_registry:blob:<digest>`), the manifests (`_registry:manifest:<name>:<digest>`) and the tags
+(`_registry:tag:<name>:<tag>`, with the `/` of the repository name replaced by `+`).
+
+The layers are shared between the repositories, the permissions are checked against the repository name of the request.
+
+*/
+package registry // import "a4.io/blobstash/pkg/registry"
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// KeyPrefix is the prefix of the kv keys used by the registry
+const KeyPrefix = "_registry:"
+
+const (
+	blobKeyFmt     = KeyPrefix + "blob:%s"
+	manifestKeyFmt = KeyPrefix + "manifest:%s:%s"
+	tagKeyFmt      = KeyPrefix + "tag:%s:%s"
+)
+
+// keyName returns the repository name as used in the kv keys (`/` is not allowed in the keys)
+func keyName(name string) string {
+	return strings.Replace(name, "/", "+", -1)
+}
+
+// Max size of a manifest
+const maxManifestSize = 4 << 20
+
+const defaultManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// Repository name pattern (for the routes)
+const nameRe = `[a-z0-9]+(?:[._/-][a-z0-9]+)*`
+
+var (
+	validTag = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+	digestRe = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Error codes, as defined by the distribution spec
+const (
+	errBlobUnknown         = "BLOB_UNKNOWN"
+	errBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	errBlobUploadInvalid   = "BLOB_UPLOAD_INVALID"
+	errDigestInvalid       = "DIGEST_INVALID"
+	errManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	errManifestInvalid     = "MANIFEST_INVALID"
+	errManifestUnknown     = "MANIFEST_UNKNOWN"
+	errTagInvalid          = "TAG_INVALID"
+	errDenied              = "DENIED"
+	errUnsupported         = "UNSUPPORTED"
+)
+
+// manifest is stored in the kvstore
+type manifest struct {
+	MediaType string `json:"media_type"`
+	Data      []byte `json:"data"`
+}
+
+// upload is an in-progress blob upload, staged in a temporary file
+type upload struct {
+	name string
+	path string
+	size int64
+}
+
+// Registry implements the OCI distribution API
+type Registry struct {
+	kvStore   store.KvStore
+	blobStore store.BlobStore
+	filetree  *filetree.FileTree
+
+	uploadsDir string
+	uploads    map[string]*upload
+
+	log log.Logger
+	mu  sync.Mutex
+}
+
+// New initializes the registry
+func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree) (*Registry, error) {
+	logger.Debug("init")
+	// The in-progress uploads don't survive a restart
+	uploadsDir := filepath.Join(conf.VarDir(), "registry_uploads")
+	if err := os.RemoveAll(uploadsDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(uploadsDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Registry{
+		kvStore:    kvStore,
+		blobStore:  blobStore,
+		filetree:   ft,
+		uploadsDir: uploadsDir,
+		uploads:    map[string]*upload{},
+		log:        logger,
+	}, nil
+}
+
+// Close removes the in-progress uploads
+func (reg *Registry) Close() error {
+	return os.RemoveAll(reg.uploadsDir)
+}
+
+// Register registers the registry routes, the router must be mounted at `/v2`
+func (reg *Registry) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(reg.baseHandler())))
+	r.Handle("/{name:"+nameRe+"}/blobs/uploads/", basicAuth(http.HandlerFunc(reg.startUploadHandler())))
+	r.Handle("/{name:"+nameRe+"}/blobs/uploads/{uuid}", basicAuth(http.HandlerFunc(reg.uploadHandler())))
+	r.Handle("/{name:"+nameRe+"}/blobs/{digest}", basicAuth(http.HandlerFunc(reg.blobHandler())))
+	r.Handle("/{name:"+nameRe+"}/manifests/{reference}", basicAuth(http.HandlerFunc(reg.manifestHandler())))
+	r.Handle("/{name:"+nameRe+"}/tags/list", basicAuth(http.HandlerFunc(reg.tagsHandler())))
+}
+
+// writeError outputs an error in the format defined by the distribution spec
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	js, err := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": msg}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// can checks the permissions for the repository, and outputs an error if the request is not allowed
+func can(w http.ResponseWriter, r *http.Request, action perms.ActionType, name string) bool {
+	if !auth.Can(w, r, perms.Action(action, perms.Image), perms.ResourceWithID(perms.Registry, perms.Image, name)) {
+		writeError(w, http.StatusForbidden, errDenied, "requested access to the resource is denied")
+		return false
+	}
+	return true
+}
+
+func (reg *Registry) baseHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}
+}
+
+// blobRef returns the ref of the file node holding the blob, or an empty string if the blob is unknown
+func (reg *Registry) blobRef(ctx context.Context, digest string) (string, error) {
+	kv, err := reg.kvStore.Get(ctx, fmt.Sprintf(blobKeyFmt, digest), -1)
+	switch err {
+	case nil:
+		return string(kv.Data), nil
+	case vkv.ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// blobNode returns the file node of the blob, or nil if the blob is unknown
+func (reg *Registry) blobNode(ctx context.Context, digest string) (*rnode.RawNode, error) {
+	ref, err := reg.blobRef(ctx, digest)
+	if err != nil || ref == "" {
+		return nil, err
+	}
+	blob, err := reg.blobStore.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return rnode.NewNodeFromBlob(ref, blob)
+}
+
+func (reg *Registry) blobHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, http.StatusMethodNotAllowed, errUnsupported, "the operation is unsupported")
+			return
+		}
+		ctx := r.Context()
+		vars := mux.Vars(r)
+		if !can(w, r, perms.Read, vars["name"]) {
+			return
+		}
+		digest := vars["digest"]
+		if !digestRe.MatchString(digest) {
+			writeError(w, http.StatusBadRequest, errDigestInvalid, "invalid digest")
+			return
+		}
+		node, err := reg.blobNode(ctx, digest)
+		if err != nil {
+			panic(err)
+		}
+		if node == nil {
+			writeError(w, http.StatusNotFound, errBlobUnknown, "blob unknown to registry")
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Etag", strconv.Quote(digest))
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", strconv.Itoa(node.Size))
+			return
+		}
+		f := filereader.NewFile(ctx, reg.blobStore, node, nil)
+		defer f.Close()
+		http.ServeContent(w, r, "", time.Unix(node.ModTime, 0), f)
+	}
+}
+
+// newUploadID returns a random upload ID
+func newUploadID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeUploadStatus outputs the headers describing the state of an upload
+func writeUploadStatus(w http.ResponseWriter, id string, up *upload, status int) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", up.name, id))
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := up.size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+// writeBlobCreated outputs the response of a completed upload
+func writeBlobCreated(w http.ResponseWriter, name, digest string) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// newUpload creates a new upload session
+func (reg *Registry) newUpload(name string) (string, *upload, error) {
+	id := newUploadID()
+	up := &upload{name: name, path: filepath.Join(reg.uploadsDir, id)}
+	f, err := os.Create(up.path)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		return "", nil, err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.uploads[id] = up
+	return id, up, nil
+}
+
+// getUpload returns the upload session, or nil if it does not exist
+func (reg *Registry) getUpload(name, id string) *upload {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	up, ok := reg.uploads[id]
+	if !ok || up.name != name {
+		return nil
+	}
+	return up
+}
+
+// removeUpload deletes the upload session and its temporary file
+func (reg *Registry) removeUpload(id string) error {
+	reg.mu.Lock()
+	up, ok := reg.uploads[id]
+	delete(reg.uploads, id)
+	reg.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return os.Remove(up.path)
+}
+
+// append appends the data to the upload
+func (up *upload) append(data io.Reader) error {
+	f, err := os.OpenFile(up.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, data)
+	up.size += n
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// errDigestMismatch is returned when the uploaded data does not match the expected digest
+var errDigestMismatch = fmt.Errorf("digest mismatch")
+
+// commitUpload verifies the uploaded data against the digest, and stores it as a chunked file
+func (reg *Registry) commitUpload(ctx context.Context, up *upload, digest string) error {
+	f, err := os.Open(up.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != digest {
+		return errDigestMismatch
+	}
+
+	ref, err := reg.blobRef(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if ref != "" {
+		reg.log.Debug("blob already stored", "digest", digest)
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	node, err := reg.filetree.NewUploader(ctx).PutReader(digest, f, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := reg.kvStore.Put(ctx, fmt.Sprintf(blobKeyFmt, digest), "", []byte(node.Hash), -1); err != nil {
+		return err
+	}
+	reg.log.Info("blob stored", "digest", digest, "ref", node.Hash, "size", node.Size)
+	return nil
+}
+
+// completeUpload commits the upload and outputs the response
+func (reg *Registry) completeUpload(w http.ResponseWriter, r *http.Request, id string, up *upload, digest string) {
+	if !digestRe.MatchString(digest) {
+		writeError(w, http.StatusBadRequest, errDigestInvalid, "invalid digest")
+		return
+	}
+	err := reg.commitUpload(r.Context(), up, digest)
+	if rerr := reg.removeUpload(id); rerr != nil {
+		panic(rerr)
+	}
+	switch err {
+	case nil:
+	case errDigestMismatch:
+		writeError(w, http.StatusBadRequest, errDigestInvalid, "provided digest did not match uploaded content")
+		return
+	default:
+		panic(err)
+	}
+	writeBlobCreated(w, up.name, digest)
+}
+
+func (reg *Registry) startUploadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, errUnsupported, "the operation is unsupported")
+			return
+		}
+		ctx := r.Context()
+		name := mux.Vars(r)["name"]
+		if !can(w, r, perms.Write, name) {
+			return
+		}
+		q := r.URL.Query()
+
+		// Cross-repository mount, the blobs are shared so it only requires the blob to exist
+		if mount := q.Get("mount"); mount != "" && digestRe.MatchString(mount) {
+			ref, err := reg.blobRef(ctx, mount)
+			if err != nil {
+				panic(err)
+			}
+			if ref != "" {
+				writeBlobCreated(w, name, mount)
+				return
+			}
+		}
+
+		id, up, err := reg.newUpload(name)
+		if err != nil {
+			panic(err)
+		}
+
+		// Monolithic upload
+		if digest := q.Get("digest"); digest != "" {
+			if err := up.append(r.Body); err != nil {
+				panic(err)
+			}
+			reg.completeUpload(w, r, id, up, digest)
+			return
+		}
+
+		writeUploadStatus(w, id, up, http.StatusAccepted)
+	}
+}
+
+func (reg *Registry) uploadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		id := vars["uuid"]
+		if !can(w, r, perms.Write, name) {
+			return
+		}
+		up := reg.getUpload(name, id)
+		if up == nil {
+			writeError(w, http.StatusNotFound, errBlobUploadUnknown, "blob upload unknown to registry")
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			writeUploadStatus(w, id, up, http.StatusNoContent)
+		case "PATCH", "PUT":
+			// The chunks must be uploaded in order
+			if cr := r.Header.Get("Content-Range"); cr != "" {
+				var start, end int64
+				if _, err := fmt.Sscanf(cr, "%d-%d", &start, &end); err != nil || start != up.size {
+					w.Header().Set("Range", fmt.Sprintf("0-%d", up.size-1))
+					writeError(w, http.StatusRequestedRangeNotSatisfiable, errBlobUploadInvalid, "invalid content range")
+					return
+				}
+			}
+			if err := up.append(r.Body); err != nil {
+				panic(err)
+			}
+			if r.Method == "PATCH" {
+				writeUploadStatus(w, id, up, http.StatusAccepted)
+				return
+			}
+			reg.completeUpload(w, r, id, up, r.URL.Query().Get("digest"))
+		case "DELETE":
+			if err := reg.removeUpload(id); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errUnsupported, "the operation is unsupported")
+		}
+	}
+}
+
+// resolve returns the digest of the manifest reference (a tag or a digest), or an empty string if the tag is unknown
+func (reg *Registry) resolve(ctx context.Context, name, reference string) (string, error) {
+	if digestRe.MatchString(reference) {
+		return reference, nil
+	}
+	kv, err := reg.kvStore.Get(ctx, fmt.Sprintf(tagKeyFmt, keyName(name), reference), -1)
+	switch err {
+	case nil:
+		return string(kv.Data), nil
+	case vkv.ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// getManifest returns the manifest, or nil if it does not exist
+func (reg *Registry) getManifest(ctx context.Context, name, digest string) (*manifest, error) {
+	kv, err := reg.kvStore.Get(ctx, fmt.Sprintf(manifestKeyFmt, keyName(name), digest), -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(kv.Data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkReferences returns the first blob/manifest referenced by the manifest that is unknown
+func (reg *Registry) checkReferences(ctx context.Context, name string, data []byte) (string, error) {
+	type descriptor struct {
+		Digest string `json:"digest"`
+	}
+	m := &struct {
+		Config    *descriptor   `json:"config"`
+		Layers    []*descriptor `json:"layers"`
+		Manifests []*descriptor `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return "", err
+	}
+
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, m.Config)
+	}
+	for _, d := range blobs {
+		ref, err := reg.blobRef(ctx, d.Digest)
+		if err != nil {
+			return "", err
+		}
+		if ref == "" {
+			return d.Digest, nil
+		}
+	}
+	// Image index/manifest list
+	for _, d := range m.Manifests {
+		child, err := reg.getManifest(ctx, name, d.Digest)
+		if err != nil {
+			return "", err
+		}
+		if child == nil {
+			return d.Digest, nil
+		}
+	}
+	return "", nil
+}
+
+func (reg *Registry) manifestHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		vars := mux.Vars(r)
+		name := vars["name"]
+		reference := vars["reference"]
+		if !digestRe.MatchString(reference) && !validTag.MatchString(reference) {
+			writeError(w, http.StatusBadRequest, errTagInvalid, "manifest tag did not match URI")
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if !can(w, r, perms.Read, name) {
+				return
+			}
+			digest, err := reg.resolve(ctx, name, reference)
+			if err != nil {
+				panic(err)
+			}
+			var m *manifest
+			if digest != "" {
+				m, err = reg.getManifest(ctx, name, digest)
+				if err != nil {
+					panic(err)
+				}
+			}
+			if m == nil {
+				writeError(w, http.StatusNotFound, errManifestUnknown, "manifest unknown")
+				return
+			}
+			w.Header().Set("Content-Type", m.MediaType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(m.Data)))
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Header().Set("Etag", strconv.Quote(digest))
+			if r.Method == "HEAD" {
+				return
+			}
+			w.Write(m.Data)
+
+		case "PUT":
+			if !can(w, r, perms.Write, name) {
+				return
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+			if err != nil {
+				panic(err)
+			}
+			if len(data) > maxManifestSize {
+				writeError(w, http.StatusRequestEntityTooLarge, errManifestInvalid, "manifest too large")
+				return
+			}
+			sum := sha256.Sum256(data)
+			digest := "sha256:" + hex.EncodeToString(sum[:])
+			if digestRe.MatchString(reference) && reference != digest {
+				writeError(w, http.StatusBadRequest, errDigestInvalid, "provided digest did not match uploaded content")
+				return
+			}
+			unknown, err := reg.checkReferences(ctx, name, data)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errManifestInvalid, fmt.Sprintf("invalid manifest: %v", err))
+				return
+			}
+			if unknown != "" {
+				writeError(w, http.StatusBadRequest, errManifestBlobUnknown, fmt.Sprintf("blob unknown to registry: %s", unknown))
+				return
+			}
+
+			mediaType := r.Header.Get("Content-Type")
+			if mediaType == "" {
+				mediaType = defaultManifestType
+			}
+			js, err := json.Marshal(&manifest{MediaType: mediaType, Data: data})
+			if err != nil {
+				panic(err)
+			}
+			if _, err := reg.kvStore.Put(ctx, fmt.Sprintf(manifestKeyFmt, keyName(name), digest), "", js, -1); err != nil {
+				panic(err)
+			}
+			if reference != digest {
+				if _, err := reg.kvStore.Put(ctx, fmt.Sprintf(tagKeyFmt, keyName(name), reference), "", []byte(digest), -1); err != nil {
+					panic(err)
+				}
+			}
+			reg.log.Info("manifest stored", "name", name, "reference", reference, "digest", digest)
+
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusCreated)
+
+		case "DELETE":
+			if !can(w, r, perms.Delete, name) {
+				return
+			}
+			// Deleting a tag only removes the tag, deleting a digest removes the manifest (the layers are kept)
+			key := fmt.Sprintf(tagKeyFmt, keyName(name), reference)
+			if digestRe.MatchString(reference) {
+				key = fmt.Sprintf(manifestKeyFmt, keyName(name), reference)
+			}
+			if _, err := reg.kvStore.Get(ctx, key, -1); err != nil {
+				if err == vkv.ErrNotFound {
+					writeError(w, http.StatusNotFound, errManifestUnknown, "manifest unknown")
+					return
+				}
+				panic(err)
+			}
+			if _, err := reg.kvStore.Delete(ctx, key, -1); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errUnsupported, "the operation is unsupported")
+		}
+	}
+}
+
+func (reg *Registry) tagsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, errUnsupported, "the operation is unsupported")
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if !can(w, r, perms.Read, name) {
+			return
+		}
+		q := r.URL.Query()
+		limit := 0
+		if n := q.Get("n"); n != "" {
+			var err error
+			limit, err = strconv.Atoi(n)
+			if err != nil || limit < 0 {
+				writeError(w, http.StatusBadRequest, errUnsupported, "invalid n")
+				return
+			}
+		}
+
+		prefix := fmt.Sprintf(tagKeyFmt, keyName(name), "")
+		start := prefix
+		if last := q.Get("last"); last != "" {
+			start = prefix + last + "\x00"
+		}
+		tags := []string{}
+		for {
+			keys, cursor, err := reg.kvStore.Keys(r.Context(), start, prefix+"\xff", 100)
+			if err != nil {
+				panic(err)
+			}
+			for _, kv := range keys {
+				// Skip the deleted tags
+				if kv.Tombstone || len(kv.Data) == 0 {
+					continue
+				}
+				tags = append(tags, strings.TrimPrefix(kv.Key, prefix))
+				if limit > 0 && len(tags) == limit {
+					break
+				}
+			}
+			if len(keys) < 100 || (limit > 0 && len(tags) == limit) {
+				break
+			}
+			start = cursor
+		}
+
+		if limit > 0 && len(tags) == limit {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, name, limit, tags[len(tags)-1]))
+		}
+		js, err := json.Marshal(map[string]interface{}{"name": name, "tags": tags})
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestPushPull(t *testing.T) {
+	env := testutil.New(t, "registry_test")
+	defer env.Close()
+	conf := &config.Config{DataDir: env.Dir, SharingKey: "test"}
+	ft, err := filetree.New(env.Log, conf, nil, env.KvStore, env.BlobStore, env.Hub, nil)
+	check(err)
+	defer ft.Close()
+	reg, err := New(env.Log, conf, env.KvStore, env.BlobStore, ft)
+	check(err)
+	defer reg.Close()
+
+	router := mux.NewRouter()
+	reg.Register(router.PathPrefix("/v2").Subrouter(), func(h http.Handler) http.Handler { return h })
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(method, path string, body []byte, expected int) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		check(err)
+		resp, err := http.DefaultClient.Do(req)
+		check(err)
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, expected, resp.StatusCode)
+		}
+		return resp
+	}
+
+	// Chunked upload of the layer
+	layer := bytes.Repeat([]byte("layer data "), 100000)
+	layerDigest := digestOf(layer)
+	resp := do("POST", "/v2/library/app/blobs/uploads/", nil, http.StatusAccepted)
+	loc := resp.Header.Get("Location")
+	resp = do("PATCH", loc, layer[:1000], http.StatusAccepted)
+	if r := resp.Header.Get("Range"); r != "0-999" {
+		t.Errorf("unexpected range %q", r)
+	}
+	do("PUT", loc+"?digest=sha256:"+fmt.Sprintf("%064d", 0), layer[1000:], http.StatusBadRequest)
+
+	resp = do("POST", "/v2/library/app/blobs/uploads/", nil, http.StatusAccepted)
+	loc = resp.Header.Get("Location")
+	do("PATCH", loc, layer[:1000], http.StatusAccepted)
+	do("PUT", loc+"?digest="+layerDigest, layer[1000:], http.StatusCreated)
+
+	// Monolithic upload of the config
+	cfg := []byte(`{"architecture":"amd64"}`)
+	cfgDigest := digestOf(cfg)
+	do("POST", "/v2/library/app/blobs/uploads/?digest="+cfgDigest, cfg, http.StatusCreated)
+
+	// The layers are shared across repositories
+	do("POST", "/v2/other/blobs/uploads/?mount="+layerDigest+"&from=library/app", nil, http.StatusCreated)
+
+	resp = do("GET", "/v2/library/app/blobs/"+layerDigest, nil, http.StatusOK)
+	data, err := ioutil.ReadAll(resp.Body)
+	check(err)
+	resp.Body.Close()
+	if !bytes.Equal(data, layer) {
+		t.Errorf("layer mismatch")
+	}
+
+	// A manifest referencing an unknown layer is rejected
+	missing := []byte(fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[{"digest":%q}]}`, cfgDigest, digestOf([]byte("nope"))))
+	do("PUT", "/v2/library/app/manifests/latest", missing, http.StatusBadRequest)
+
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[{"digest":%q}]}`, cfgDigest, layerDigest))
+	resp = do("PUT", "/v2/library/app/manifests/latest", manifest, http.StatusCreated)
+	if d := resp.Header.Get("Docker-Content-Digest"); d != digestOf(manifest) {
+		t.Errorf("unexpected manifest digest %q", d)
+	}
+	for _, ref := range []string{"latest", digestOf(manifest)} {
+		resp = do("GET", "/v2/library/app/manifests/"+ref, nil, http.StatusOK)
+		data, err = ioutil.ReadAll(resp.Body)
+		check(err)
+		resp.Body.Close()
+		if !bytes.Equal(data, manifest) {
+			t.Errorf("manifest mismatch for %q", ref)
+		}
+	}
+
+	resp = do("GET", "/v2/library/app/tags/list", nil, http.StatusOK)
+	data, err = ioutil.ReadAll(resp.Body)
+	check(err)
+	resp.Body.Close()
+	if string(data) != `{"name":"library/app","tags":["latest"]}` {
+		t.Errorf("unexpected tags %s", data)
+	}
+
+	do("DELETE", "/v2/library/app/manifests/latest", nil, http.StatusAccepted)
+	do("GET", "/v2/library/app/manifests/latest", nil, http.StatusNotFound)
+}
@@ -2,6 +2,7 @@ package replication // import "a4.io/blobstash/pkg/replication"
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sync"
 	"time"
@@ -10,12 +11,16 @@ import (
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/client/oplog"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/jobs"
 	"a4.io/blobstash/pkg/stash/store"
 	bsync "a4.io/blobstash/pkg/sync"
 
 	log "github.com/inconshreveable/log15"
 )
 
+// SyncJob is the kind of the replication sync jobs (the result holds the sync stats)
+const SyncJob = "replication.sync"
+
 type Backoff struct {
 	delay    time.Duration
 	factor   float64
@@ -43,14 +48,18 @@ type Replication struct {
 	blobstore store.BlobStore
 	backoff   *Backoff
 
+	// Protects the remote (updated when the config is reloaded)
+	mu          sync.Mutex
 	remoteOplog *oplog.Oplog
+	conf        *config.ReplicateFrom
+	resync      bool
+	cancel      func()
 
-	conf *config.ReplicateFrom
-
-	wg *sync.WaitGroup
+	jobs *jobs.Manager
+	wg   *sync.WaitGroup
 }
 
-func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sync, wg *sync.WaitGroup) (*Replication, error) {
+func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sync, m *jobs.Manager, wg *sync.WaitGroup) (*Replication, error) {
 	logger.Debug("init")
 	rep := &Replication{
 		conf:        conf.ReplicateFrom,
@@ -63,7 +72,17 @@ func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sy
 			maxDelay: 120 * time.Second,
 			factor:   1.6,
 		},
-		wg: wg,
+		jobs: m,
+		wg:   wg,
+	}
+	// The syncs are retried by the replication loop
+	if err := m.RegisterKind(&jobs.Kind{
+		Name:      SyncJob,
+		Run:       rep.runSync,
+		Retry:     jobs.RetryPolicy{MaxAttempts: 1},
+		Exclusive: true,
+	}); err != nil {
+		return nil, err
 	}
 	if err := rep.init(); err != nil {
 		return nil, err
@@ -72,13 +91,52 @@ func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sy
 	return rep, nil
 }
 
-func (r *Replication) sync() error {
+// Reload switches to the remote from the new config, a full sync is performed with the new remote
+func (r *Replication) Reload(conf *config.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if *conf.ReplicateFrom == *r.conf {
+		return
+	}
+	r.conf = conf.ReplicateFrom
+	r.remoteOplog = oplog.New(clientutil.NewClientUtil(r.conf.URL, clientutil.WithAPIKey(r.conf.APIKey)))
+	r.resync = true
+	// Stop listening to the previous remote oplog
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *Replication) remote() (*oplog.Oplog, *config.ReplicateFrom) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remoteOplog, r.conf
+}
+
+func (r *Replication) runSync(ctx context.Context, h *jobs.Handle) error {
 	// Initiate a one-way synchronization
-	stats, err := r.synctable.Sync(r.conf.URL, r.conf.APIKey, true)
+	_, conf := r.remote()
+	stats, err := r.synctable.Sync(conf.URL, conf.APIKey, true)
 	if err != nil {
 		return err
 	}
 	r.log.Info("sync done", "stats", stats)
+	return h.SetResult(stats)
+}
+
+// sync runs a sync job, and waits for it
+func (r *Replication) sync() error {
+	job, err := r.jobs.Start(SyncJob, nil)
+	if err != nil {
+		return err
+	}
+	job, err = r.jobs.Wait(context.Background(), job.ID)
+	if err != nil {
+		return err
+	}
+	if job.State != jobs.Done {
+		return fmt.Errorf("sync job %s %s", job.ID, job.State)
+	}
 	return nil
 }
 
@@ -88,13 +146,14 @@ func (r *Replication) init() error {
 	if err := r.sync(); err != nil {
 		return err
 	}
-	var resync bool
-
 	ops := make(chan *oplog.Op)
 
 	// This should run forever (can't disable replication while BlobStash is already running)
 	go func() {
 		for {
+			r.mu.Lock()
+			resync := r.resync
+			r.mu.Unlock()
 			if resync {
 				r.log.Debug("trying to resync")
 				if err := r.sync(); err != nil {
@@ -104,15 +163,25 @@ func (r *Replication) init() error {
 				}
 				r.backoff.Reset()
 				r.log.Debug("sync successful")
-				resync = false
+				r.mu.Lock()
+				r.resync = false
+				r.mu.Unlock()
 			}
 
 			r.log.Debug("listen to remote oplog")
-			if err := r.remoteOplog.Notify(context.TODO(), ops, nil); err != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			r.mu.Lock()
+			r.cancel = cancel
+			remote := r.remoteOplog
+			r.mu.Unlock()
+			if err := remote.Notify(ctx, ops, nil); err != nil {
 				r.log.Error("remote oplog SSE error", "err", err, "attempt", r.backoff.attempt)
-				resync = true
+				r.mu.Lock()
+				r.resync = true
+				r.mu.Unlock()
 				time.Sleep(r.backoff.Delay())
 			}
+			cancel()
 			r.backoff.Reset()
 		}
 	}()
@@ -124,7 +193,8 @@ func (r *Replication) init() error {
 				r.log.Info("new blob from replication", "hash", hash)
 
 				// Fetch the blob from the remote BlobStash instance
-				data, err := r.remoteOplog.GetBlob(context.TODO(), hash)
+				remote, _ := r.remote()
+				data, err := remote.GetBlob(context.TODO(), hash)
 				if err != nil {
 					panic(err)
 				}
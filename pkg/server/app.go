@@ -0,0 +1,113 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/stash/store"
+)
+
+// App is a Go app compiled in BlobStash, the external packages register their apps in an `init` function:
+//
+//	func init() {
+//		server.RegisterApp(&myApp{})
+//	}
+//
+// and are enabled by importing the package (e.g. `import _ "example.com/myapp"`) in a custom `main` package.
+type App interface {
+	// Name is used as the API prefix (`/api/ext/{name}`) and to scope the kv keys of the app
+	Name() string
+
+	// Setup is called once the server is initialized, before the routes are registered
+	Setup(env *AppEnv) error
+
+	// Register registers the app routes (the basicAuth middleware protects them with the BlobStash auth)
+	Register(r *mux.Router, basicAuth func(http.Handler) http.Handler)
+
+	// Close is called when the server shuts down
+	Close() error
+}
+
+// AppEnv gives access to the BlobStash services to an App
+type AppEnv struct {
+	Logger    log.Logger
+	Conf      *config.Config
+	BlobStore store.BlobStore
+
+	// KvStore is scoped to the app (the keys are transparently stored under `_apps:{name}:`)
+	KvStore store.KvStore
+	Hub     *hub.Hub
+}
+
+var (
+	appsMu  sync.Mutex
+	extApps = map[string]App{}
+
+	validAppName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// RegisterApp registers an App, it panics if the name is invalid or already registered
+func RegisterApp(app App) {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	name := app.Name()
+	if !validAppName.MatchString(name) {
+		panic(fmt.Sprintf("invalid app name %q", name))
+	}
+	if _, dup := extApps[name]; dup {
+		panic(fmt.Sprintf("app %q is already registered", name))
+	}
+	extApps[name] = app
+}
+
+// registeredApps returns the registered apps sorted by name
+func registeredApps() []App {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	apps := []App{}
+	for _, app := range extApps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name() < apps[j].Name() })
+	return apps
+}
+
+// setupApps setups the registered apps and registers their routes, the setup apps are returned (for closing them)
+func setupApps(logger log.Logger, conf *config.Config, bs store.BlobStore, kvs store.KvStore, h *hub.Hub, router *mux.Router, basicAuth func(http.Handler) http.Handler) ([]App, error) {
+	apps := []App{}
+	for _, app := range registeredApps() {
+		name := app.Name()
+		if err := app.Setup(&AppEnv{
+			Logger:    logger.New("app", "ext:"+name),
+			Conf:      conf,
+			BlobStore: bs,
+			KvStore:   store.NewPrefixedKvStore(kvs, "_apps:"+name+":"),
+			Hub:       h,
+		}); err != nil {
+			closeApps(apps)
+			return nil, fmt.Errorf("failed to setup app %q: %v", name, err)
+		}
+		app.Register(router.PathPrefix("/api/ext/"+name).Subrouter(), basicAuth)
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// closeApps closes the apps (in reverse setup order), and returns the first error
+func closeApps(apps []App) error {
+	var rerr error
+	for i := len(apps) - 1; i >= 0; i-- {
+		if err := apps[i].Close(); err != nil && rerr == nil {
+			rerr = fmt.Errorf("failed to close app %q: %v", apps[i].Name(), err)
+		}
+	}
+	return rerr
+}
@@ -0,0 +1,237 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Interval between the checks of the config file modification time
+const configPollInterval = 5 * time.Second
+
+// Reload outcomes
+const (
+	ReloadApplied  = "applied"
+	ReloadRejected = "rejected"
+	ReloadFailed   = "failed"
+	ReloadNoop     = "unchanged"
+)
+
+// ReloadStatus reports the outcome of the last config reload
+type ReloadStatus struct {
+	Time            int64    `json:"time"`
+	Status          string   `json:"status"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// Reload applies the hot-reloadable items of the new config (the auth keys and roles, the webhooks, the rate limits,
+// the namespaces quotas and expiration retention, the replication remote and the log level), the whole reload is
+// rejected if any item requiring a restart changed (the namespaces themselves are created/deleted via the stash API)
+func (s *Server) Reload(newConf *config.Config) *ReloadStatus {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	status := &ReloadStatus{
+		Time:            time.Now().Unix(),
+		Applied:         []string{},
+		RestartRequired: []string{},
+	}
+	defer func() {
+		s.reloadStatus = status
+	}()
+
+	if err := newConf.Init(); err != nil {
+		status.Status = ReloadFailed
+		status.Error = err.Error()
+		s.log.Error("invalid config, reload failed", "err", err)
+		return status
+	}
+	if newConf.LogLevel != "" {
+		if _, err := log.LvlFromString(newConf.LogLevel); err != nil {
+			status.Status = ReloadFailed
+			status.Error = fmt.Sprintf("invalid log level %q", newConf.LogLevel)
+			s.log.Error("invalid config, reload failed", "err", status.Error)
+			return status
+		}
+	}
+
+	reloadable, restart := s.current.Diff(newConf)
+	if len(restart) > 0 {
+		status.Status = ReloadRejected
+		status.RestartRequired = restart
+		status.Error = fmt.Sprintf("the following items require a restart: %s", strings.Join(restart, ", "))
+		s.log.Error("config reload rejected", "restart_required", strings.Join(restart, ","))
+		return status
+	}
+	if len(reloadable) == 0 {
+		status.Status = ReloadNoop
+		return status
+	}
+
+	for _, item := range reloadable {
+		if err := s.apply(item, newConf); err != nil {
+			// Restore the items already applied (and the failed one), so the running config matches `s.current`
+			for _, applied := range append(status.Applied, item) {
+				if err := s.apply(applied, s.current); err != nil {
+					s.log.Error("failed to restore the previous config", "item", applied, "err", err)
+				}
+			}
+			status.Status = ReloadFailed
+			status.Error = fmt.Sprintf("failed to reload %q: %v", item, err)
+			status.Applied = []string{}
+			s.log.Error("config reload failed", "item", item, "err", err)
+			return status
+		}
+		status.Applied = append(status.Applied, item)
+	}
+
+	// The items requiring a restart are unchanged, the next reloads are diffed against the new config
+	s.current = newConf
+	status.Status = ReloadApplied
+	s.log.Info("config reloaded", "applied", strings.Join(status.Applied, ","))
+	return status
+}
+
+// apply updates the components depending on the given config item
+func (s *Server) apply(item string, conf *config.Config) error {
+	switch item {
+	case "auth", "roles":
+		return auth.Reload(conf)
+	case "webhooks":
+		if s.webhooks != nil {
+			return s.webhooks.Reload(conf)
+		}
+	case "rate_limits":
+		s.limiter.Reload(conf)
+	case "quotas":
+		if s.usage != nil {
+			s.usage.SetQuotas(conf.Quotas)
+		}
+	case "expired_namespaces_retention":
+		if s.stash != nil {
+			s.stash.SetExpiredRetention(time.Duration(conf.ExpiredNamespacesRetention) * time.Second)
+		}
+	case "stash_exports_retention":
+		if s.stash != nil {
+			s.stash.SetExportsRetention(time.Duration(conf.StashExportsRetention) * time.Second)
+		}
+	case "replicate_from":
+		if s.replication != nil {
+			s.replication.Reload(conf)
+		}
+	case "log_level":
+		s.log.SetHandler(log.LvlFilterHandler(conf.LogLvl(), log.StreamHandler(os.Stdout, log.LogfmtFormat())))
+	}
+	return nil
+}
+
+// reloadFromFile reloads the config from the file the server was started with
+func (s *Server) reloadFromFile() *ReloadStatus {
+	newConf, err := config.New(s.conf.Path())
+	if err != nil {
+		s.log.Error("failed to load the config", "err", err)
+		status := &ReloadStatus{
+			Time:            time.Now().Unix(),
+			Status:          ReloadFailed,
+			Applied:         []string{},
+			RestartRequired: []string{},
+			Error:           err.Error(),
+		}
+		s.reloadMu.Lock()
+		s.reloadStatus = status
+		s.reloadMu.Unlock()
+		return status
+	}
+	return s.Reload(newConf)
+}
+
+// watchConfig polls the config file and reloads it when it's modified
+func (s *Server) watchConfig(interval time.Duration) {
+	var lastMod time.Time
+	if fi, err := os.Stat(s.conf.Path()); err == nil {
+		lastMod = fi.ModTime()
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		fi, err := os.Stat(s.conf.Path())
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+		s.log.Info("config file modified, reloading")
+		s.reloadFromFile()
+	}
+}
+
+func (s *Server) reloadStatusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		s.reloadMu.Lock()
+		status := s.reloadStatus
+		s.reloadMu.Unlock()
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"hot_reloadable": config.HotReloadable,
+			"last_reload":    status,
+		})
+	}
+}
+
+func (s *Server) reloadHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Config),
+			perms.Resource(perms.Server, perms.Config),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if s.conf.Path() == "" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "the server was not started from a config file")
+			return
+		}
+
+		status := s.reloadFromFile()
+		code := http.StatusOK
+		switch status.Status {
+		case ReloadRejected:
+			code = http.StatusConflict
+		case ReloadFailed:
+			code = http.StatusUnprocessableEntity
+		}
+		httputil.MarshalAndWrite(r, w, status, httputil.WithStatusCode(code))
+	}
+}
@@ -2,6 +2,7 @@ package server // import "a4.io/blobstash/pkg/server"
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"expvar"
 	"fmt"
@@ -14,29 +15,47 @@ import (
 	"syscall"
 	"time"
 
+	"a4.io/blobstash/pkg/admin"
 	"a4.io/blobstash/pkg/apps"
+	"a4.io/blobstash/pkg/audit"
 	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/auth/mtls"
+	"a4.io/blobstash/pkg/auth/oidc"
 	"a4.io/blobstash/pkg/blobstore"
 	blobStoreAPI "a4.io/blobstash/pkg/blobstore/api"
 	"a4.io/blobstash/pkg/capabilities"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/conntrack"
 	"a4.io/blobstash/pkg/docstore"
 	docstoreLua "a4.io/blobstash/pkg/docstore/lua"
 	"a4.io/blobstash/pkg/expvarserver"
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/hub/eventlog"
+	"a4.io/blobstash/pkg/hub/rules"
+	"a4.io/blobstash/pkg/hub/webhook"
+	"a4.io/blobstash/pkg/jobs"
 	"a4.io/blobstash/pkg/js"
 	"a4.io/blobstash/pkg/kvstore"
 	kvStoreAPI "a4.io/blobstash/pkg/kvstore/api"
+	"a4.io/blobstash/pkg/loadshed"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/middleware"
 	"a4.io/blobstash/pkg/oplog"
+	"a4.io/blobstash/pkg/provenance"
+	"a4.io/blobstash/pkg/ratelimit"
+	"a4.io/blobstash/pkg/refgraph"
+	"a4.io/blobstash/pkg/registry"
 	"a4.io/blobstash/pkg/replication"
 	"a4.io/blobstash/pkg/session"
+	"a4.io/blobstash/pkg/sqlquery"
 	"a4.io/blobstash/pkg/stash"
 	stashAPI "a4.io/blobstash/pkg/stash/api"
+	"a4.io/blobstash/pkg/stash/gc"
+	"a4.io/blobstash/pkg/stats"
 	synctable "a4.io/blobstash/pkg/sync"
+	"a4.io/blobstash/pkg/usage"
 	"a4.io/blobstash/pkg/webauthn"
 	gcontext "github.com/gorilla/context"
 
@@ -57,10 +76,6 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-type App interface {
-	Register(*mux.Router, func(http.Handler) http.Handler)
-}
-
 type Server struct {
 	router    *mux.Router
 	conf      *config.Config
@@ -68,6 +83,24 @@ type Server struct {
 	closeFunc func() error
 
 	blobstore *blobstore.BlobStore
+	audit     *audit.Audit
+
+	// TLS client certificates auth (nil if disabled)
+	mtls *mtls.MTLS
+
+	// Open HTTP connections
+	conns *conntrack.Tracker
+
+	// Components updated when the config is reloaded
+	limiter     *ratelimit.Limiter
+	webhooks    *webhook.Webhooks
+	usage       *usage.Accounting
+	stash       *stash.Stash
+	replication *replication.Replication
+
+	reloadMu     sync.Mutex
+	current      *config.Config
+	reloadStatus *ReloadStatus
 
 	hostWhitelist map[string]bool
 	shutdown      chan struct{}
@@ -89,12 +122,29 @@ func New(conf *config.Config) (*Server, error) {
 	s := &Server{
 		router:        mux.NewRouter().StrictSlash(true),
 		conf:          conf,
+		current:       conf,
 		hostWhitelist: map[string]bool{},
 		log:           logger,
 		wg:            &wg,
 		shutdown:      make(chan struct{}),
 	}
-	authFunc, basicAuth := middleware.NewBasicAuth(conf)
+	shedder := loadshed.New(conf.LoadShedding)
+	s.limiter = ratelimit.New(conf)
+	authFunc, basicAuth := middleware.NewBasicAuth(conf, shedder, s.limiter)
+	if conf.OIDC != nil {
+		sso, err := oidc.New(logger.New("app", "oidc"), conf, sess)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the OIDC login: %v", err)
+		}
+		sso.Register(s.router.PathPrefix("/api/oidc").Subrouter())
+	}
+	if conf.ClientCerts != nil {
+		m, err := mtls.New(logger.New("app", "mtls"), conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the client certificates auth: %v", err)
+		}
+		s.mtls = m
+	}
 	s.router.Handle("/api/ping", basicAuth(http.HandlerFunc(pingHandler)))
 
 	hub := hub.New(logger.New("app", "hub"), true)
@@ -108,9 +158,27 @@ func New(conf *config.Config) (*Server, error) {
 		if err := rootBlobstore.Check(); err != nil {
 			return nil, fmt.Errorf("failed to check the blobstore: %v", err)
 		}
+		corrupted, err := rootBlobstore.Scrub(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrub the blobstore: %v", err)
+		}
+		if corrupted > 0 {
+			return nil, fmt.Errorf("found %d corrupted blobs", corrupted)
+		}
 	}
+	rootBlobstore.SetLatencyObserver(shedder.Observe)
 	s.blobstore = rootBlobstore
 
+	// Background jobs (the interrupted jobs are resumed as their kind is registered)
+	jobsManager, err := jobs.New(logger.New("app", "jobs"), conf.VarDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the jobs: %v", err)
+	}
+	if err := rootBlobstore.RegisterJobs(jobsManager); err != nil {
+		return nil, fmt.Errorf("failed to register the blobstore jobs: %v", err)
+	}
+	jobsManager.Register(s.router.PathPrefix("/api/jobs").Subrouter(), basicAuth)
+
 	s.router.Handle("/api/status", basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		stats, err := s.blobstore.S3Stats()
 		if err != nil {
@@ -127,12 +195,20 @@ func New(conf *config.Config) (*Server, error) {
 		bs["blobs_size"] = bstats.BlobsSize
 		bs["blobs_size_human"] = humanize.Bytes(uint64(bstats.BlobsSize))
 		bs["blobs_blobsfile_volumes"] = bstats.BlobsFilesCount
+		bs["pending_writes"] = s.blobstore.PendingWrites()
+		upstream, err := s.blobstore.UpstreamStatus()
+		if err != nil {
+			panic(err)
+		}
 
 		// return newRev.Version, nil
 		httputil.MarshalAndWrite(r, w, map[string]interface{}{
-			"s3":         stats,
-			"started_at": start.Format(time.RFC3339),
-			"blobstore":  bs,
+			"s3":            stats,
+			"started_at":    start.Format(time.RFC3339),
+			"blobstore":     bs,
+			"backends":      s.blobstore.Health(),
+			"load_shedding": shedder.Status(),
+			"upstream":      upstream,
 		})
 
 	})))
@@ -143,6 +219,14 @@ func New(conf *config.Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize blobstore meta: %v", err)
 	}
 
+	// Setup the usage accounting (and the quotas)
+	usageAccounting, err := usage.New(logger.New("app", "usage"), conf, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize usage accounting: %v", err)
+	}
+	usageAccounting.Register(s.router.PathPrefix("/api/usage").Subrouter(), basicAuth)
+	s.usage = usageAccounting
+
 	if conf.Replication != nil && conf.Replication.EnableOplog {
 		oplg, err := oplog.New(logger.New("app", "oplog"), conf, hub)
 		if err != nil {
@@ -156,22 +240,57 @@ func New(conf *config.Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize kvstore app: %v", err)
 	}
 
+	var eventLog *eventlog.EventLog
+	if conf.HubEventLog {
+		eventLog, err = eventlog.New(logger.New("app", "eventlog"), filepath.Join(conf.VarDir(), "hub-events.index"), rootBlobstore, 10*time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize the hub event log: %v", err)
+		}
+		hub.SetEventLog(eventLog)
+	}
+
 	// Now load the stash manager
 	// func New(dir string, m *meta.Meta, bs *blobstore.BlobStore, kvs *kvstore.KvStore, h *hub.Hub, l log.Logger) (*Stash, error) {
 	cstash, err := stash.New(conf.StashDir(), metaHandler, rootBlobstore, rootKvstore, hub, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize the stash manager: %v", err)
 	}
-	stashAPI.New(cstash, hub).Register(s.router.PathPrefix("/api/stash").Subrouter(), basicAuth)
+	if conf.RetentionLocks != nil {
+		cstash.SetRetentionLocks(conf.RetentionLocks.Namespaces)
+	}
+	// Account the blobs saved in the namespaces
+	cstash.Watch(usageAccounting.WatchNamespace, usageAccounting.ResetNamespace)
+	stashHandler := stashAPI.New(conf, cstash, hub).WithJobs(jobsManager)
+	stashHandler.Register(s.router.PathPrefix("/api/stash").Subrouter(), basicAuth)
+	stashHandler.RegisterMembers(s.router.PathPrefix("/api/ns").Subrouter(), basicAuth)
+	s.router.Use(stashHandler.NamespaceMiddleware)
+	s.router.Use(stashHandler.ExpiryMiddleware)
+
+	s.conns = conntrack.New()
+	s.conns.Register(s.router.PathPrefix("/api/debug").Subrouter(), basicAuth)
+	s.router.Use(shedder.Middleware)
+	// The retentions can be hot-reloaded, the worker is always started
+	cstash.SetExpiredRetention(time.Duration(conf.ExpiredNamespacesRetention) * time.Second)
+	cstash.SetExportsRetention(time.Duration(conf.StashExportsRetention) * time.Second)
+	cstash.StartExpiryWorker(logger.New("app", "stash"))
+	s.stash = cstash
 
 	blobstore := cstash.BlobStore()
 	// FIXME(tsileo): test the stash with kvstore
 	//kvstore := rootKvstore
 	kvstore := cstash.KvStore()
 
-	kvStoreAPI.New(kvstore).Register(s.router.PathPrefix("/api/kvstore").Subrouter(), basicAuth)
+	// Record the mutating API calls
+	s.audit = audit.New(logger.New("app", "audit"), kvstore)
+	s.audit.Register(s.router.PathPrefix("/api/audit").Subrouter(), basicAuth)
+
+	// Daily rollups of the blobs count/size per namespace
+	rollups := stats.New(logger.New("app", "stats"), kvstore, cstash.BlobStoreStats)
+	rollups.Register(s.router.PathPrefix("/api/stats").Subrouter(), basicAuth)
+
 	// FIXME(tsileo): handle middleware in the `Register` interface
-	blobStoreAPI.New(blobstore).Register(s.router.PathPrefix("/api/blobstore").Subrouter(), basicAuth)
+	blobStoreRouter := s.router.PathPrefix("/api/blobstore").Subrouter()
+	blobStoreAPI.New(blobstore).WithRoot(rootBlobstore).Register(blobStoreRouter, basicAuth)
 
 	// Load the synctable
 	// XXX(tsileo): sync should always get the root data context
@@ -180,23 +299,37 @@ func New(conf *config.Config) (*Server, error) {
 
 	// Enable replication if set in the config
 	if conf.ReplicateFrom != nil {
-		if _, err := replication.New(logger.New("app", "replication"), conf, rootBlobstore, synctable, &wg); err != nil {
+		repl, err := replication.New(logger.New("app", "replication"), conf, rootBlobstore, synctable, jobsManager, &wg)
+		if err != nil {
 			return nil, fmt.Errorf("failed to initialize replication app: %v", err)
 		}
+		s.replication = repl
 	}
 
-	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub)
+	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub, shedder)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize filetree app: %v", err)
 	}
 	filetree.Register(s.router.PathPrefix("/api/filetree").Subrouter(), s.router, basicAuth)
+	// The FS keys under a retention lock cannot be deleted through the kvstore API
+	kvStoreAPI.New(kvstore).WithHub(hub).WithLockCheck(filetree.KeyRetentionLocked).Register(s.router.PathPrefix("/api/kvstore").Subrouter(), basicAuth)
+	if err := filetree.RegisterJobs(jobsManager); err != nil {
+		return nil, fmt.Errorf("failed to register the filetree jobs: %v", err)
+	}
+	// The GC leaves the blobs only referenced by the pruned FS versions unmarked
+	if err := gc.RegisterJobs(jobsManager, cstash, filetree.GCEligible); err != nil {
+		return nil, fmt.Errorf("failed to register the GC jobs: %v", err)
+	}
 
-	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree)
+	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree, hub)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize docstore app: %v", err)
 	}
 	docstore.Register(s.router.PathPrefix("/api/docstore").Subrouter(), basicAuth)
 
+	// Read-only SQL-ish queries over the kvstore and the docstore
+	sqlquery.New(logger.New("app", "sqlquery"), kvstore, docstore).Register(s.router.PathPrefix("/api/query").Subrouter(), basicAuth)
+
 	// Load the Lua config
 	if _, err := os.Stat("blobstash.lua"); err == nil {
 		if err := func() error {
@@ -233,13 +366,104 @@ func New(conf *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize caps app: %v", err)
 	}
-	caps.Register(s.router.PathPrefix("/api/capabilities").Subrouter(), basicAuth)
+	caps.Register(s.router.PathPrefix("/api/capabilities").Subrouter(), s.router, basicAuth)
+
+	webhooks, err := webhook.New(logger.New("app", "webhooks"), conf, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize webhooks: %v", err)
+	}
+	webhooks.Register(s.router.PathPrefix("/api/webhooks").Subrouter(), basicAuth)
+	s.webhooks = webhooks
+
+	var prov *provenance.Provenance
+	if conf.Provenance != nil {
+		prov, err = provenance.New(logger.New("app", "provenance"), conf, hub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize provenance: %v", err)
+		}
+		prov.Register(s.router.PathPrefix("/api/provenance").Subrouter(), basicAuth)
+	}
+
+	s.router.Handle("/api/config/reload", basicAuth(http.HandlerFunc(s.reloadStatusHandler())))
+	s.router.Handle("/api/config/_reload", basicAuth(http.HandlerFunc(s.reloadHandler())))
+
+	rules, err := rules.New(logger.New("app", "rules"), kvstore, blobstore, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize rules: %v", err)
+	}
+	rules.Register(s.router.PathPrefix("/api/rules").Subrouter(), basicAuth)
+
+	refs, err := refgraph.New(logger.New("app", "refgraph"), conf, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the references graph: %v", err)
+	}
+	refs.Register(s.router.PathPrefix("/api/refs").Subrouter(), basicAuth)
+	refs.RegisterBlobRefs(blobStoreRouter, basicAuth)
+
+	admin.New(logger.New("app", "admin")).Register(s.router, "/admin", basicAuth)
+
+	var reg *registry.Registry
+	if conf.Registry {
+		reg, err = registry.New(logger.New("app", "registry"), conf, kvstore, blobstore, filetree)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize registry: %v", err)
+		}
+		reg.Register(s.router.PathPrefix("/v2").Subrouter(), basicAuth)
+	}
+
+	extApps, err := setupApps(logger, conf, blobstore, kvstore, hub, s.router, basicAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	warmUpCtx, cancelWarmUp := context.WithCancel(context.Background())
+	if conf.WarmUp {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			warmUp(warmUpCtx, logger.New("app", "warmup"), blobstore, filetree, shedder)
+		}()
+	}
 
 	// Setup the closeFunc
 	s.closeFunc = func() error {
+		cancelWarmUp()
 		logger.Debug("waiting for the waitgroup...")
 		wg.Wait()
 		logger.Debug("waitgroup done")
+		if err := jobsManager.Close(); err != nil {
+			return err
+		}
+		if err := rollups.Close(); err != nil {
+			return err
+		}
+		if err := webhooks.Close(); err != nil {
+			return err
+		}
+		if prov != nil {
+			if err := prov.Close(); err != nil {
+				return err
+			}
+		}
+		if eventLog != nil {
+			if err := eventLog.Close(); err != nil {
+				return err
+			}
+		}
+		if err := rules.Close(); err != nil {
+			return err
+		}
+		if err := refs.Close(); err != nil {
+			return err
+		}
+		if reg != nil {
+			if err := reg.Close(); err != nil {
+				return err
+			}
+		}
+		if err := closeApps(extApps); err != nil {
+			return err
+		}
 		if err := filetree.Close(); err != nil {
 			return err
 		}
@@ -264,6 +488,9 @@ func New(conf *config.Config) (*Server, error) {
 			return err
 		}
 		logger.Debug("root bs closed")
+		if err := usageAccounting.Close(); err != nil {
+			return err
+		}
 		return nil
 	}
 	return s, nil
@@ -274,6 +501,11 @@ func (s *Server) Shutdown() {
 	// TODO(tsileo) shotdown sync repl too
 }
 
+// Close closes all the components without serving (for the one-off commands like the restore)
+func (s *Server) Close() error {
+	return s.closeFunc()
+}
+
 func (s *Server) Bootstrap() error {
 	s.log.Debug("Bootstrap the server")
 
@@ -290,6 +522,14 @@ func (s *Server) Bootstrap() error {
 			return err
 		}
 	}
+	if s.conf.RestoreUntil > 0 {
+		if !s.blobstore.ReplicationEnabled() {
+			return errors.New("point-in-time restore requires the S3 replication to be configured")
+		}
+		if err := s.blobstore.S3Backend().RestoreUntil(s.conf.RestoreUntil); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -313,7 +553,8 @@ func (s *Server) whitelistHosts(hosts ...string) {
 func (s *Server) Serve() error {
 	reqLogger := httputil.LoggerMiddleware(s.log)
 	expvarMiddleare := httputil.ExpvarsMiddleware(serverCounters)
-	h := httputil.RecoverHandler(middleware.CorsMiddleware(reqLogger(expvarMiddleare(middleware.Secure(s.router)))))
+	h := httputil.RecoverHandler(middleware.CorsMiddleware(reqLogger(expvarMiddleare(middleware.Secure(middleware.MaxBodySize(s.conf)(s.audit.Middleware(s.router)))))))
+	h = s.conns.Middleware(h)
 	if s.conf.ExtraApacheCombinedLogs != "" {
 		s.log.Info(fmt.Sprintf("enabling apache logs to %s", s.conf.ExtraApacheCombinedLogs))
 		logFile, err := os.OpenFile(s.conf.ExtraApacheCombinedLogs, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -333,22 +574,39 @@ func (s *Server) Serve() error {
 			listen = s.conf.Listen
 		}
 		s.log.Info(fmt.Sprintf("listening on %v", listen))
-		if s.conf.AutoTLS {
-			cacheDir := autocert.DirCache(filepath.Join(s.conf.ConfigDir(), config.LetsEncryptDir))
-
-			m := autocert.Manager{
-				Prompt:     autocert.AcceptTOS,
-				HostPolicy: s.hostPolicy(s.conf.Domains...),
-				Cache:      cacheDir,
+		if s.conf.TLSEnabled() {
+			tlsConfig := &tls.Config{}
+			if s.conf.AutoTLS {
+				cacheDir := autocert.DirCache(filepath.Join(s.conf.ConfigDir(), config.LetsEncryptDir))
+
+				m := autocert.Manager{
+					Prompt:     autocert.AcceptTOS,
+					HostPolicy: s.hostPolicy(s.conf.Domains...),
+					Cache:      cacheDir,
+				}
+				tlsConfig = m.TLSConfig()
+			}
+			tlsHandler := h
+			if s.mtls != nil {
+				tlsConfig = s.mtls.TLSConfig(tlsConfig)
+				tlsHandler = s.mtls.Middleware(h)
 			}
-			s := &http.Server{
+			srv := &http.Server{
 				Addr:      listen,
-				Handler:   h,
-				TLSConfig: m.TLSConfig(),
+				Handler:   tlsHandler,
+				TLSConfig: tlsConfig,
+			}
+			s.conns.Setup(srv)
+			if err := srv.ListenAndServeTLS(s.conf.TLSCert, s.conf.TLSKey); err != nil {
+				s.log.Error("failed to start the HTTPS listener", "err", err)
 			}
-			s.ListenAndServeTLS("", "")
 		} else {
-			http.ListenAndServe(listen, h)
+			srv := &http.Server{
+				Addr:    listen,
+				Handler: h,
+			}
+			s.conns.Setup(srv)
+			srv.ListenAndServe()
 		}
 	}()
 	if s.conf.ExpvarListen != "" {
@@ -359,6 +617,9 @@ func (s *Server) Serve() error {
 			}
 		}()
 	}
+	if s.conf.Path() != "" {
+		go s.watchConfig(configPollInterval)
+	}
 	s.tillShutdown()
 	return s.closeFunc()
 	// return http.ListenAndServe(":8051", s.router)
@@ -371,8 +632,14 @@ func (s *Server) tillShutdown() {
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
+	// Reload the config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	for {
 		select {
+		case <-hup:
+			s.log.Info("captured SIGHUP, reloading the config")
+			s.reloadFromFile()
 		case sig := <-cs:
 			s.log.Debug("captured signal", "signal", sig)
 			s.log.Info("shutting down...")
@@ -0,0 +1,54 @@
+package server // import "a4.io/blobstash/pkg/server"
+
+import (
+	"context"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/loadshed"
+	"a4.io/blobstash/pkg/stash/store"
+)
+
+// Number of blobs enumerated at once when warming the blobs index
+const warmUpPageSize = 10000
+
+// warmUp pre-loads the blobs index and the filetree roots in the background (see the `warm_up` config item), it's
+// paused while the load is shed
+func warmUp(ctx context.Context, logger log.Logger, bs store.BlobStore, ft *filetree.FileTree, shedder *loadshed.Shedder) {
+	start := time.Now()
+	logger.Info("warming up the blobs index")
+	var cursor string
+	var count int
+	for {
+		if err := shedder.Wait(ctx); err != nil {
+			return
+		}
+		refs, next, err := bs.Enumerate(ctx, cursor, "\xff", warmUpPageSize)
+		if err != nil {
+			logger.Error("failed to warm up the blobs index", "err", err)
+			return
+		}
+		count += len(refs)
+		if len(refs) < warmUpPageSize {
+			break
+		}
+		logger.Info("warming up the blobs index", "blobs", count)
+		cursor = next
+	}
+	logger.Info("blobs index warmed up", "blobs", count, "duration", time.Since(start))
+
+	if err := shedder.Wait(ctx); err != nil {
+		return
+	}
+	start = time.Now()
+	n, err := ft.WarmUp(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("failed to warm up the filetree", "err", err)
+		}
+		return
+	}
+	logger.Info("filetree warmed up", "fs", n, "duration", time.Since(start))
+}
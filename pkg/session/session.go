@@ -1,6 +1,8 @@
 package session // import "a4.io/blobstash/pkg/session"
 
 import (
+	"net/http"
+
 	"a4.io/blobstash/pkg/config"
 	"github.com/gorilla/sessions"
 )
@@ -14,7 +16,12 @@ func (s *Session) Session() *sessions.CookieStore {
 }
 
 func New(conf *config.Config) *Session {
+	store := sessions.NewCookieStore([]byte(conf.SecretKey))
+	// The cookies are not sent along the cross-site subrequests (the top-level navigations are still allowed so the
+	// redirect from the SSO provider works)
+	store.Options.SameSite = http.SameSiteLaxMode
+	store.Options.HttpOnly = true
 	return &Session{
-		sess: sessions.NewCookieStore([]byte(conf.SecretKey)),
+		sess: store,
 	}
 }
@@ -0,0 +1,338 @@
+package sqlquery // import "a4.io/blobstash/pkg/sqlquery"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Sources
+const (
+	DocStore = "docstore"
+	KvStore  = "kv"
+)
+
+// Default/max number of rows returned
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+)
+
+// Query is a parsed SELECT statement
+type Query struct {
+	// Selected fields (empty for "*")
+	Fields []string
+
+	// Source, e.g. "docstore" for `FROM docstore.users`
+	Source string
+	// Collection (docstore) or key prefix (kv)
+	Name string
+
+	Where []*Cond
+
+	OrderBy string
+	Desc    bool
+
+	Limit int
+}
+
+// Cond is a single comparison of the WHERE clause (the conditions are joined with AND)
+type Cond struct {
+	Field string
+	Op    string
+	Value interface{} // string, float64, bool or nil
+}
+
+type tokenType int
+
+const (
+	tokIdent tokenType = iota
+	tokString
+	tokNumber
+	tokOp
+	tokComma
+	tokStar
+	tokEOF
+)
+
+type token struct {
+	typ tokenType
+	val string
+}
+
+var ops = []string{"<=", ">=", "!=", "<>", "=", "<", ">"}
+
+// lex splits the query into tokens
+func lex(q string) ([]*token, error) {
+	tokens := []*token{}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == ',':
+			tokens = append(tokens, &token{tokComma, ","})
+			i++
+		case c == '*':
+			tokens = append(tokens, &token{tokStar, "*"})
+			i++
+		case c == '\'':
+			// Quotes are escaped by doubling them
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(q) {
+					return nil, fmt.Errorf("%w: unterminated string", ErrInvalidQuery)
+				}
+				if q[i] == '\'' {
+					if i+1 < len(q) && q[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(q[i])
+				i++
+			}
+			tokens = append(tokens, &token{tokString, sb.String()})
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, &token{tokNumber, q[i:j]})
+			i = j
+		case strings.ContainsRune("<>=!", rune(c)):
+			var op string
+			for _, o := range ops {
+				if strings.HasPrefix(q[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, c)
+			}
+			tokens = append(tokens, &token{tokOp, op})
+			i += len(op)
+		case isIdentChar(c):
+			j := i
+			for j < len(q) && isIdentChar(q[j]) {
+				j++
+			}
+			tokens = append(tokens, &token{tokIdent, q[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, c)
+		}
+	}
+	return append(tokens, &token{tokEOF, ""}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parser is a recursive descent parser for the SELECT dialect
+type parser struct {
+	tokens []*token
+	pos    int
+}
+
+func (p *parser) peek() *token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() *token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword returns true if the next token is the given keyword
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.typ == tokIdent && strings.EqualFold(t.val, kw)
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.isKeyword(kw) {
+		return fmt.Errorf("%w: expected %s, got %q", ErrInvalidQuery, kw, p.peek().val)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) field() (string, error) {
+	t := p.next()
+	if t.typ != tokIdent {
+		return "", fmt.Errorf("%w: expected a field, got %q", ErrInvalidQuery, t.val)
+	}
+	return t.val, nil
+}
+
+// Parse parses a query like:
+//
+//	SELECT * FROM docstore.users WHERE age >= 18 AND country = 'FR' ORDER BY age DESC LIMIT 10
+//	SELECT key, data FROM kv.'config:' LIMIT 100
+func Parse(q string) (*Query, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	query := &Query{Limit: defaultLimit}
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peek().typ == tokStar {
+		p.next()
+	} else {
+		for {
+			f, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			query.Fields = append(query.Fields, f)
+			if p.peek().typ != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.source(query); err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("WHERE") {
+		p.next()
+		for {
+			cond, err := p.cond()
+			if err != nil {
+				return nil, err
+			}
+			query.Where = append(query.Where, cond)
+			if !p.isKeyword("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("ORDER") {
+		p.next()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if query.OrderBy, err = p.field(); err != nil {
+			return nil, err
+		}
+		switch {
+		case p.isKeyword("ASC"):
+			p.next()
+		case p.isKeyword("DESC"):
+			p.next()
+			query.Desc = true
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.next()
+		t := p.next()
+		limit, err := strconv.Atoi(t.val)
+		if t.typ != tokNumber || err != nil || limit < 1 {
+			return nil, fmt.Errorf("%w: invalid limit %q", ErrInvalidQuery, t.val)
+		}
+		if limit > maxLimit {
+			return nil, fmt.Errorf("%w: limit must be lower than %d", ErrInvalidQuery, maxLimit)
+		}
+		query.Limit = limit
+	}
+
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, t.val)
+	}
+	return query, nil
+}
+
+// source parses `docstore.<collection>`, `kv.<prefix>` or `kv.'<prefix>'`
+func (p *parser) source(query *Query) error {
+	t := p.next()
+	if t.typ != tokIdent {
+		return fmt.Errorf("%w: expected a source, got %q", ErrInvalidQuery, t.val)
+	}
+	parts := strings.SplitN(t.val, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%w: invalid source %q", ErrInvalidQuery, t.val)
+	}
+	query.Source, query.Name = strings.ToLower(parts[0]), parts[1]
+	if query.Name == "" && p.peek().typ == tokString {
+		query.Name = p.next().val
+	}
+	switch query.Source {
+	case DocStore:
+		if query.Name == "" || strings.Contains(query.Name, ".") {
+			return fmt.Errorf("%w: invalid collection %q", ErrInvalidQuery, query.Name)
+		}
+	case KvStore:
+		if query.Name == "" {
+			return fmt.Errorf("%w: missing key prefix", ErrInvalidQuery)
+		}
+	default:
+		return fmt.Errorf("%w: unknown source %q", ErrInvalidQuery, parts[0])
+	}
+	return nil
+}
+
+func (p *parser) cond() (*Cond, error) {
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.typ != tokOp {
+		return nil, fmt.Errorf("%w: expected an operator, got %q", ErrInvalidQuery, op.val)
+	}
+	cond := &Cond{Field: field, Op: op.val}
+	if cond.Op == "<>" {
+		cond.Op = "!="
+	}
+
+	t := p.next()
+	switch {
+	case t.typ == tokString:
+		cond.Value = t.val
+	case t.typ == tokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q", ErrInvalidQuery, t.val)
+		}
+		cond.Value = f
+	case t.typ == tokIdent && strings.EqualFold(t.val, "true"):
+		cond.Value = true
+	case t.typ == tokIdent && strings.EqualFold(t.val, "false"):
+		cond.Value = false
+	case t.typ == tokIdent && strings.EqualFold(t.val, "null"):
+		cond.Value = nil
+	default:
+		return nil, fmt.Errorf("%w: expected a value, got %q", ErrInvalidQuery, t.val)
+	}
+	switch cond.Value.(type) {
+	case string, float64:
+	default:
+		if cond.Op != "=" && cond.Op != "!=" {
+			return nil, fmt.Errorf("%w: %s only supports = and !=", ErrInvalidQuery, t.val)
+		}
+	}
+	return cond, nil
+}
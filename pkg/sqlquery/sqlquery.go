@@ -0,0 +1,361 @@
+/*
+
+Package sqlquery implements a limited, read-only, SQL SELECT dialect over the kvstore and the docstore.
+
+A query targets a single docstore collection or a single kvstore key prefix:
+
+	SELECT * FROM docstore.users WHERE age >= 18 AND country = 'FR' ORDER BY age DESC LIMIT 10
+	SELECT key, version FROM kv.'config:' WHERE key > 'config:b'
+
+The WHERE clause only supports comparisons on the indexed fields joined with AND (`_id` and the sort indexes for the
+docstore, `key` and `version` for the kvstore), the same goes for the ORDER BY clause.
+
+*/
+package sqlquery // import "a4.io/blobstash/pkg/sqlquery"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/docstore/maputil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrInvalidQuery is returned when the query cannot be parsed, or is not supported
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Fields of the kvstore rows
+var kvFields = map[string]bool{
+	"key":     true,
+	"version": true,
+	"hash":    false,
+	"data":    false,
+}
+
+// SQLQuery executes the queries
+type SQLQuery struct {
+	kvStore  store.KvStore
+	docstore *docstore.DocStore
+	log      log.Logger
+}
+
+// New initializes the query endpoint
+func New(logger log.Logger, kvStore store.KvStore, ds *docstore.DocStore) *SQLQuery {
+	return &SQLQuery{
+		kvStore:  kvStore,
+		docstore: ds,
+		log:      logger,
+	}
+}
+
+// Register registers the HTTP endpoint
+func (s *SQLQuery) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("", basicAuth(http.HandlerFunc(s.queryHandler())))
+}
+
+// matcher matches the rows against the WHERE clause
+type matcher struct {
+	conds []*Cond
+}
+
+// Match implements the `docstore.QueryMatcher` interface
+func (m *matcher) Match(row map[string]interface{}) (bool, error) {
+	for _, cond := range m.conds {
+		v, err := maputil.GetPath(row, cond.Field)
+		if err != nil {
+			v = nil
+		}
+		if !compare(v, cond) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Close implements the `docstore.QueryMatcher` interface
+func (m *matcher) Close() error { return nil }
+
+// compare returns true if the value satisfies the condition, the values of different types never match
+func compare(v interface{}, cond *Cond) bool {
+	if s, ok := v.(fmt.Stringer); ok {
+		// e.g. the docstore `_id`
+		v = s.String()
+	}
+
+	var c int
+	switch expected := cond.Value.(type) {
+	case nil:
+		return (v == nil) == (cond.Op == "=")
+	case bool:
+		b, ok := v.(bool)
+		return ok && (b == expected) == (cond.Op == "=")
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return cond.Op == "!="
+		}
+		c = strings.Compare(s, expected)
+	case float64:
+		f, ok := toFloat(v)
+		if !ok {
+			return cond.Op == "!="
+		}
+		switch {
+		case f < expected:
+			c = -1
+		case f > expected:
+			c = 1
+		}
+	}
+
+	switch cond.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// toFloat converts the decoded numbers (JSON or msgpack) to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// project returns the selected fields of the row
+func project(row map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return row
+	}
+	out := map[string]interface{}{}
+	for _, f := range fields {
+		v, err := maputil.GetPath(row, f)
+		if err != nil {
+			v = nil
+		}
+		out[f] = v
+	}
+	return out
+}
+
+// Exec executes the query
+func (s *SQLQuery) Exec(ctx context.Context, q *Query) ([]map[string]interface{}, error) {
+	switch q.Source {
+	case DocStore:
+		return s.execDocStore(q)
+	case KvStore:
+		return s.execKvStore(ctx, q)
+	}
+	return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidQuery, q.Source)
+}
+
+func (s *SQLQuery) execDocStore(q *Query) ([]map[string]interface{}, error) {
+	for _, cond := range q.Where {
+		if !s.docstore.IsIndexed(q.Name, cond.Field) {
+			return nil, fmt.Errorf("%w: field %q is not indexed", ErrInvalidQuery, cond.Field)
+		}
+	}
+	// Newest documents first by default
+	sortIndex := "-_id"
+	if q.OrderBy != "" {
+		if !s.docstore.IsIndexed(q.Name, q.OrderBy) {
+			return nil, fmt.Errorf("%w: cannot sort by %q, the field is not indexed", ErrInvalidQuery, q.OrderBy)
+		}
+		sortIndex = q.OrderBy
+		if q.Desc {
+			sortIndex = "-" + sortIndex
+		}
+	}
+
+	docs, err := s.docstore.Select(q.Name, &matcher{q.Where}, sortIndex, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	rows := []map[string]interface{}{}
+	for _, doc := range docs {
+		rows = append(rows, project(doc, q.Fields))
+	}
+	return rows, nil
+}
+
+func (s *SQLQuery) execKvStore(ctx context.Context, q *Query) ([]map[string]interface{}, error) {
+	for _, cond := range q.Where {
+		if !kvFields[cond.Field] {
+			return nil, fmt.Errorf("%w: field %q is not indexed", ErrInvalidQuery, cond.Field)
+		}
+	}
+	for _, f := range q.Fields {
+		if _, ok := kvFields[f]; !ok {
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidQuery, f)
+		}
+	}
+	if q.OrderBy != "" && q.OrderBy != "key" {
+		return nil, fmt.Errorf("%w: cannot sort by %q, the field is not indexed", ErrInvalidQuery, q.OrderBy)
+	}
+
+	m := &matcher{q.Where}
+	rows := []map[string]interface{}{}
+	start, end := q.Name, q.Name+"\xff"
+	for {
+		var kvs []*vkv.KeyValue
+		var cursor string
+		var err error
+		if q.Desc {
+			kvs, cursor, err = s.kvStore.ReverseKeys(ctx, start, end, q.Limit)
+		} else {
+			kvs, cursor, err = s.kvStore.Keys(ctx, start, end, q.Limit)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			row := map[string]interface{}{
+				"key":     kv.Key,
+				"version": kv.Version,
+				"hash":    kv.HexHash(),
+				"data":    string(kv.Data),
+			}
+			ok, err := m.Match(row)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			rows = append(rows, project(row, q.Fields))
+			if len(rows) == q.Limit {
+				return rows, nil
+			}
+		}
+		// The cursor is empty once the range is exhausted (the deleted keys are skipped, so a batch may be short)
+		if cursor == "" {
+			return rows, nil
+		}
+		if q.Desc {
+			end = cursor
+		} else {
+			start = cursor
+		}
+	}
+}
+
+func (s *SQLQuery) queryHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rawQuery string
+		switch r.Method {
+		case "GET":
+			rawQuery = r.URL.Query().Get("q")
+		case "POST":
+			in := struct {
+				Query string `json:"query"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			rawQuery = in.Query
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		q, err := Parse(rawQuery)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		var allowed bool
+		switch q.Source {
+		case DocStore:
+			allowed = auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.JSONCollection),
+				perms.ResourceWithID(perms.DocStore, perms.JSONCollection, q.Name),
+			)
+		case KvStore:
+			// The rows hold the values of the keys, listing them is not enough
+			allowed = auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.KVEntry),
+				perms.Resource(perms.KvStore, perms.KVEntry),
+			) && auth.Can(
+				w,
+				r,
+				perms.Action(perms.Read, perms.KVEntry),
+				perms.Resource(perms.KvStore, perms.KVEntry),
+			)
+		}
+		if !allowed {
+			auth.Forbidden(w)
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), ctxutil.RequestNamespace(r))
+		rows, err := s.Exec(ctx, q)
+		if err != nil {
+			if errors.Is(err, ErrInvalidQuery) {
+				httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data":  rows,
+			"count": len(rows),
+		})
+	}
+}
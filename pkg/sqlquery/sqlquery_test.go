@@ -0,0 +1,120 @@
+package sqlquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	q, err := Parse("select name, a.b FROM docstore.users WHERE age >= 18 AND name <> 'O''Brien' AND ok = true ORDER BY age desc LIMIT 10")
+	check(err)
+	expected := &Query{
+		Fields: []string{"name", "a.b"},
+		Source: DocStore,
+		Name:   "users",
+		Where: []*Cond{
+			{"age", ">=", 18.0},
+			{"name", "!=", "O'Brien"},
+			{"ok", "=", true},
+		},
+		OrderBy: "age",
+		Desc:    true,
+		Limit:   10,
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("unexpected query %+v", q)
+	}
+
+	q, err = Parse("SELECT * FROM kv.'config:' WHERE key > 'config:b'")
+	check(err)
+	if q.Source != KvStore || q.Name != "config:" || q.Limit != defaultLimit || len(q.Fields) != 0 {
+		t.Errorf("unexpected query %+v", q)
+	}
+
+	for _, bad := range []string{
+		"",
+		"DELETE FROM docstore.users",
+		"SELECT * FROM users",
+		"SELECT * FROM mysql.users",
+		"SELECT * FROM docstore.users WHERE age > 1 OR age < 0",
+		"SELECT * FROM docstore.users WHERE ok > true",
+		"SELECT * FROM docstore.users WHERE name = 'unterminated",
+		"SELECT * FROM docstore.users LIMIT 100000",
+		"SELECT * FROM docstore.users; DROP TABLE users",
+	} {
+		if _, err := Parse(bad); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("query %q should be rejected, got %v", bad, err)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	env := testutil.New(t, "sqlquery_test")
+	defer env.Close()
+	kvs := env.KvStore
+	conf := &config.Config{
+		DataDir: env.Dir,
+		Docstore: &config.DocstoreConfig{
+			SortIndexes: map[string]map[string]*config.DocstoreSortIndex{
+				"users": {"by_age": {Field: "age"}},
+			},
+		},
+	}
+	ds, err := docstore.New(env.Log, conf, env.KvStore, env.BlobStore, nil, env.Hub)
+	check(err)
+	defer ds.Close()
+	s := New(env.Log, env.KvStore, ds)
+
+	ctx := context.Background()
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		_, err := ds.Insert("users", map[string]interface{}{"name": name, "age": 10 + i*5})
+		check(err)
+		_, err = kvs.Put(ctx, fmt.Sprintf("config:%s", name), "", []byte(name), -1)
+		check(err)
+	}
+	_, err = kvs.Put(ctx, "other:key", "", []byte("other"), -1)
+	check(err)
+
+	exec := func(raw string) []map[string]interface{} {
+		q, err := Parse(raw)
+		check(err)
+		rows, err := s.Exec(ctx, q)
+		check(err)
+		return rows
+	}
+
+	rows := exec("SELECT name FROM docstore.users WHERE age >= 18 ORDER BY age DESC LIMIT 2")
+	if !reflect.DeepEqual(rows, []map[string]interface{}{{"name": "dave"}, {"name": "carol"}}) {
+		t.Errorf("unexpected docstore rows %+v", rows)
+	}
+
+	q, err := Parse("SELECT * FROM docstore.users WHERE name = 'bob'")
+	check(err)
+	if _, err := s.Exec(ctx, q); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("filtering on a non-indexed field should fail, got %v", err)
+	}
+
+	rows = exec("SELECT key, data FROM kv.'config:' WHERE key > 'config:b' ORDER BY key DESC LIMIT 2")
+	if !reflect.DeepEqual(rows, []map[string]interface{}{
+		{"key": "config:dave", "data": "dave"},
+		{"key": "config:carol", "data": "carol"},
+	}) {
+		t.Errorf("unexpected kv rows %+v", rows)
+	}
+	if rows := exec("SELECT key FROM kv.config"); len(rows) != 4 {
+		t.Errorf("expected 4 kv rows, got %+v", rows)
+	}
+}
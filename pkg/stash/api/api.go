@@ -2,27 +2,40 @@ package api // import "a4.io/blobstash/pkg/stash/api"
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
-	humanize "github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
 
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
+	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/stash"
 	"a4.io/blobstash/pkg/stash/gc"
-	"a4.io/blobstash/pkg/stash/store"
 )
 
 type StashAPI struct {
+	conf  *config.Config
 	stash *stash.Stash
 	hub   *hub.Hub
+	jobs  *jobs.Manager
 }
 
-func New(s *stash.Stash, h *hub.Hub) *StashAPI {
-	return &StashAPI{s, h}
+func New(conf *config.Config, s *stash.Stash, h *hub.Hub) *StashAPI {
+	return &StashAPI{conf: conf, stash: s, hub: h}
+}
+
+// WithJobs sets the jobs manager the GCs run on
+func (s *StashAPI) WithJobs(m *jobs.Manager) *StashAPI {
+	s.jobs = m
+	return s
 }
 
 func (s *StashAPI) listHandler() func(http.ResponseWriter, *http.Request) {
@@ -40,7 +53,7 @@ func (s *StashAPI) listHandler() func(http.ResponseWriter, *http.Request) {
 func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		name := mux.Vars(r)["name"]
-		dataContext, ok := s.stash.DataContextByName(name)
+		_, ok := s.stash.DataContextByName(name)
 		switch r.Method {
 		case "GET", "HEAD":
 			if !ok {
@@ -50,17 +63,34 @@ func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request)
 			if r.Method == "HEAD" {
 				return
 			}
+			var expiresAt interface{}
+			if exp := s.stash.Expiry(name); exp > 0 {
+				expiresAt = exp
+			}
+			var lockedUntil interface{}
+			until, err := s.stash.RetentionLockedUntil(r.Context(), name)
+			if err != nil {
+				panic(err)
+			}
+			if until > time.Now().Unix() {
+				lockedUntil = until
+			}
 			httputil.MarshalAndWrite(r, w, map[string]interface{}{
-				"data": nil,
+				"data": map[string]interface{}{
+					"expires_at":   expiresAt,
+					"expired":      s.stash.Expired(name),
+					"locked_until": lockedUntil,
+				},
 			})
 		case "DELETE":
 			if !ok {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
-			// FIXME(tsileo): stash.Destroy should destroy the data ctx
-			dataContext.Destroy()
 			if err := s.stash.Destroy(context.TODO(), name); err != nil {
+				if writeDestroyError(w, name, err) {
+					return
+				}
 				panic(err)
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -71,6 +101,24 @@ func (s *StashAPI) dataContextHandler() func(http.ResponseWriter, *http.Request)
 	}
 }
 
+// writeLocked reports a namespace that cannot be destroyed because of its retention lock
+func writeLocked(w http.ResponseWriter, name string) {
+	httputil.WriteJSONError(w, http.StatusLocked, fmt.Sprintf("namespace %q holds versions under retention lock", name))
+}
+
+// writeDestroyError reports the reason why the namespace cannot be destroyed, returns false for the other errors
+func writeDestroyError(w http.ResponseWriter, name string, err error) bool {
+	switch err {
+	case stash.ErrRetentionLocked:
+		writeLocked(w, name)
+	case stash.ErrHasForks:
+		httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("namespace %q has forks, destroy them first", name))
+	default:
+		return false
+	}
+	return true
+}
+
 func (s *StashAPI) dataContextMergeHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		name := mux.Vars(r)["name"]
@@ -82,6 +130,9 @@ func (s *StashAPI) dataContextMergeHandler() func(http.ResponseWriter, *http.Req
 				return
 			}
 			if err := s.stash.MergeAndDestroy(context.TODO(), name); err != nil {
+				if writeDestroyError(w, name, err) {
+					return
+				}
 				panic(err)
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -93,6 +144,7 @@ func (s *StashAPI) dataContextMergeHandler() func(http.ResponseWriter, *http.Req
 
 type GCInput struct {
 	Script string `json:"script" msgpack:"script"`
+	DryRun bool   `json:"dry_run" msgpack:"dry_run"`
 }
 
 func (s *StashAPI) dataContextGCHandler() func(http.ResponseWriter, *http.Request) {
@@ -101,8 +153,29 @@ func (s *StashAPI) dataContextGCHandler() func(http.ResponseWriter, *http.Reques
 		name := mux.Vars(r)["name"]
 		ctx = ctxutil.WithNamespace(ctx, name)
 
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.GC, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
 		_, ok := s.stash.DataContextByName(name)
 		switch r.Method {
+		case "GET":
+			// The GC waiting for the grace period, if any
+			report, err := gc.PendingReport(ctx, s.stash, name)
+			if err != nil {
+				panic(err)
+			}
+			if report == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			httputil.MarshalAndWrite(r, w, report)
 		case "POST":
 			defer r.Body.Close()
 			if !ok {
@@ -113,22 +186,95 @@ func (s *StashAPI) dataContextGCHandler() func(http.ResponseWriter, *http.Reques
 			if err := httputil.Unmarshal(r, out); err != nil {
 				panic(err)
 			}
-			fmt.Printf("\n\nGC imput: %+v\n\n", out)
-			if err := s.stash.DoAndDestroy(ctx, name, func(ctx context.Context, dc store.DataContext) error {
-				blobs, size, err := gc.GC(ctx, s.hub, s.stash, dc, out.Script, map[string]struct{}{})
-				fmt.Printf("GC err=%v, output: %d blobs,  %s\n\n", err, blobs, humanize.Bytes(size))
-				return err
+			job, err := s.jobs.Start(gc.Job, &gc.JobParams{
+				Namespace:   name,
+				Script:      out.Script,
+				DryRun:      out.DryRun,
+				GracePeriod: int64(s.conf.StashGCGracePeriod),
+			})
+			if err != nil {
+				panic(err)
+			}
+			w.Header().Set("BlobStash-Job-ID", job.ID)
+			async, err := httputil.NewQuery(r.URL.Query()).GetBoolDefault("async", false)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if async {
+				// The progress can be followed through the jobs API
+				httputil.MarshalAndWrite(r, w, job, httputil.WithStatusCode(http.StatusAccepted))
+				return
+			}
 
-			}); err != nil {
+			job, err = s.jobs.Wait(ctx, job.ID)
+			if job == nil {
+				// The client is gone, the GC keeps running
+				return
+			}
+			report := &gc.Report{}
+			if len(job.Result) > 0 {
+				if err := json.Unmarshal(job.Result, report); err != nil {
+					panic(err)
+				}
+			}
+			switch err {
+			case nil:
+			case gc.ErrTooEarly:
+				httputil.WriteJSONError(w, http.StatusTooEarly, fmt.Sprintf("cannot sweep before %s", time.Unix(report.SweepAfter, 0).UTC().Format(time.RFC3339)))
+				return
+			case stash.ErrRetentionLocked:
+				writeLocked(w, name)
+				return
+			default:
 				panic(err)
 			}
-			w.WriteHeader(http.StatusNoContent)
+			if job.State == jobs.Canceled {
+				httputil.WriteJSONError(w, http.StatusConflict, "GC canceled")
+				return
+			}
+
+			switch report.Status {
+			case gc.StatusDone:
+				w.WriteHeader(http.StatusNoContent)
+			case gc.StatusPending:
+				httputil.MarshalAndWrite(r, w, report, httputil.WithStatusCode(http.StatusAccepted))
+			default:
+				httputil.MarshalAndWrite(r, w, report)
+			}
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	}
 }
 
+func (s *StashAPI) gcReportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.GC, perms.Namespace),
+			perms.Resource(perms.Stash, perms.Namespace),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		report, err := gc.LastReport(r.Context(), s.stash)
+		if err != nil {
+			panic(err)
+		}
+		if report == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, report)
+	}
+}
+
 type GC2Input struct {
 	Ref     string `json:"ref" msgpack:"ref"`
 	Version int64  `json:"version" msgpack:"version"`
@@ -154,6 +300,9 @@ func (s *StashAPI) dataContextGC2Handler() func(http.ResponseWriter, *http.Reque
 			}
 			fmt.Printf("\n\nGC imput: %+v\n\n", out)
 			if err := s.stash.MergeFileTreeVersionAndDestroy(ctx, name, out.Ref, out.Version); err != nil {
+				if writeDestroyError(w, name, err) {
+					return
+				}
 				panic(err)
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -163,10 +312,425 @@ func (s *StashAPI) dataContextGC2Handler() func(http.ResponseWriter, *http.Reque
 	}
 }
 
+type ForkInput struct {
+	Source    string `json:"source" msgpack:"source"` // "" for the root namespace
+	Name      string `json:"name" msgpack:"name"`
+	ExpiresAt int64  `json:"expires_at,omitempty" msgpack:"expires_at,omitempty"` // optional Unix timestamp
+}
+
+func (s *StashAPI) forkHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		defer r.Body.Close()
+		in := &ForkInput{}
+		if err := httputil.Unmarshal(r, in); err != nil {
+			panic(err)
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, in.Name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		// The fork gives access to the source content, so the source must be readable too
+		srcResource := perms.ResourceWithID(perms.Stash, perms.Namespace, in.Source)
+		if !auth.Can(w, r, perms.Action(perms.Read, perms.Namespace), srcResource) &&
+			!auth.Can(w, r, perms.Action(perms.Admin, perms.Namespace), srcResource) {
+			auth.Forbidden(w)
+			return
+		}
+		if in.Name == "" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "missing namespace name")
+			return
+		}
+		for _, name := range []string{in.Source, in.Name} {
+			if !ctxutil.ValidNamespace(name) {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid namespace %q", name))
+				return
+			}
+		}
+		if _, ok := s.stash.DataContextByName(in.Source); !ok {
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", in.Source))
+			return
+		}
+		if _, ok := s.stash.DataContextByName(in.Name); ok {
+			httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("namespace %q already exists", in.Name))
+			return
+		}
+
+		blobs, err := s.stash.Fork(r.Context(), in.Source, in.Name)
+		if err != nil {
+			panic(err)
+		}
+		if in.ExpiresAt > 0 {
+			if err := s.stash.SetExpiry(in.Name, in.ExpiresAt); err != nil {
+				panic(err)
+			}
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"name":         in.Name,
+			"source":       in.Source,
+			"blobs_copied": blobs,
+		}, httputil.WithStatusCode(http.StatusCreated))
+	}
+}
+
+type ExpiryInput struct {
+	ExpiresAt int64 `json:"expires_at" msgpack:"expires_at"` // Unix timestamp, 0 removes the expiration
+}
+
+func (s *StashAPI) dataContextExpiryHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if _, ok := s.stash.DataContextByName(name); !ok || name == "" {
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", name))
+			return
+		}
+		defer r.Body.Close()
+		in := &ExpiryInput{}
+		if err := httputil.Unmarshal(r, in); err != nil {
+			panic(err)
+		}
+		if in.ExpiresAt < 0 {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "invalid expiration date")
+			return
+		}
+		if err := s.stash.SetExpiry(name, in.ExpiresAt); err != nil {
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// NamespaceMiddleware refuses the requests targeting an invalid namespace name (via the `BlobStash-Namespace` header or
+// the `db` query parameter), before any namespace lookup
+func (s *StashAPI) NamespaceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := ctxutil.RequestNamespace(r); !ctxutil.ValidNamespace(ns) {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid namespace %q", ns))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ExpiryMiddleware refuses the requests targeting an expired namespace (via the `BlobStash-Namespace` header or the
+// `db` query parameter)
+func (s *StashAPI) ExpiryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := ctxutil.RequestNamespace(r); ns != "" && s.stash.Expired(ns) {
+			httputil.WriteJSONError(w, http.StatusForbidden, fmt.Sprintf("namespace %q expired", ns))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *StashAPI) membersHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := mux.Vars(r)["ns"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if _, ok := s.stash.DataContextByName(name); !ok || name == "" {
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", name))
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		limit, err := q.GetInt("limit", 1000, 10000)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+		members, cursor, hasMore, err := s.stash.Members(r.Context(), name, q.Get("cursor"), limit)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": members,
+			"pagination": map[string]interface{}{
+				"cursor":   cursor,
+				"has_more": hasMore,
+				"count":    len(members),
+				"per_page": limit,
+			},
+		})
+	}
+}
+
+func (s *StashAPI) addMemberHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		name := vars["ns"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), name)
+		switch err := s.stash.AddMember(ctx, name, vars["hash"]); err {
+		case nil:
+		case stash.ErrNamespaceNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", name))
+			return
+		case stash.ErrMemberNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			panic(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dataContextDeleteHandler exports the namespace, then tombstones its keys, the data is destroyed once the retention
+// window is over
+func (s *StashAPI) dataContextDeleteHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		deletion, err := s.stash.Delete(r.Context(), name, s.stash.ExpiredRetention())
+		switch err {
+		case nil:
+		case stash.ErrNamespaceNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", name))
+			return
+		case stash.ErrNamespaceExpired:
+			httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("namespace %q already expired", name))
+			return
+		case stash.ErrInvalidExportName:
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("namespace %q cannot be exported", name))
+			return
+		case stash.ErrRetentionLocked:
+			writeLocked(w, name)
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": deletion,
+		})
+	}
+}
+
+// dataContextDumpHandler dumps the kvstore of the namespace as blobs, the returned ref can be restored on any instance
+// holding the dump blobs (the root namespace can be dumped via the `_root` name)
+func (s *StashAPI) dataContextDumpHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if name == "_root" {
+			name = ""
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		dump, err := s.stash.Dump(r.Context(), name)
+		switch err {
+		case nil:
+		case stash.ErrNamespaceNotFound:
+			httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("namespace %q not found", name))
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": dump,
+		}, httputil.WithStatusCode(http.StatusCreated))
+	}
+}
+
+type RestoreInput struct {
+	Ref string `json:"ref" msgpack:"ref"` // ref of the dump
+}
+
+// dataContextRestoreHandler restores a dump into a new (or empty) namespace
+func (s *StashAPI) dataContextRestoreHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, name),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		defer r.Body.Close()
+		in := &RestoreInput{}
+		if err := httputil.Unmarshal(r, in); err != nil {
+			panic(err)
+		}
+		if in.Ref == "" {
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, "missing dump ref")
+			return
+		}
+		dump, err := s.stash.Restore(r.Context(), name, in.Ref)
+		switch {
+		case err == nil:
+		case errors.Is(err, stash.ErrDumpNotFound):
+			httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, stash.ErrInvalidDump):
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		case err == stash.ErrNamespaceNotEmpty, err == stash.ErrNamespaceExpired:
+			httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("cannot restore into %q: %v", name, err))
+			return
+		case err == stash.ErrInvalidNamespace:
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid namespace %q", name))
+			return
+		default:
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": dump,
+		})
+	}
+}
+
+func (s *StashAPI) exportsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.Resource(perms.Stash, perms.Namespace),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		exports, err := s.stash.Exports()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": exports,
+		})
+	}
+}
+
+func (s *StashAPI) exportHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.Resource(perms.Stash, perms.Namespace),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		f, err := s.stash.OpenExport(id)
+		if err != nil {
+			if err == stash.ErrExportNotFound {
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			panic(err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", id))
+		http.ServeContent(w, r, "", stat.ModTime(), f)
+	}
+}
+
+// RegisterMembers registers the namespace membership endpoints (the members are GC roots of the namespace)
+func (s *StashAPI) RegisterMembers(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/{ns}/blobs", basicAuth(http.HandlerFunc(s.membersHandler())))
+	r.Handle("/{ns}/{hash:[a-f0-9]{64}}", basicAuth(http.HandlerFunc(s.addMemberHandler())))
+}
+
 func (s *StashAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/", basicAuth(http.HandlerFunc(s.listHandler())))
+	r.Handle("/_fork", basicAuth(http.HandlerFunc(s.forkHandler())))
+	r.Handle("/_gc/last", basicAuth(http.HandlerFunc(s.gcReportHandler())))
+	r.Handle("/_exports", basicAuth(http.HandlerFunc(s.exportsHandler())))
+	r.Handle("/_exports/{id}", basicAuth(http.HandlerFunc(s.exportHandler())))
 	r.Handle("/{name}", basicAuth(http.HandlerFunc(s.dataContextHandler())))
 	r.Handle("/{name}/_merge", basicAuth(http.HandlerFunc(s.dataContextMergeHandler())))
 	r.Handle("/{name}/_gc", basicAuth(http.HandlerFunc(s.dataContextGCHandler())))
+	r.Handle("/{name}/_expiry", basicAuth(http.HandlerFunc(s.dataContextExpiryHandler())))
+	r.Handle("/{name}/_delete", basicAuth(http.HandlerFunc(s.dataContextDeleteHandler())))
+	r.Handle("/{name}/_dump", basicAuth(http.HandlerFunc(s.dataContextDumpHandler())))
+	r.Handle("/{name}/_restore", basicAuth(http.HandlerFunc(s.dataContextRestoreHandler())))
 	r.Handle("/{name}/_merge_filetree_version", basicAuth(http.HandlerFunc(s.dataContextGC2Handler())))
 }
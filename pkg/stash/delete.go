@@ -0,0 +1,270 @@
+package stash // import "a4.io/blobstash/pkg/stash"
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of blobs/keys fetched at once while exporting a namespace
+const exportPageSize = 1000
+
+// ErrExportNotFound is returned when the export archive does not exist
+var ErrExportNotFound = fmt.Errorf("export not found")
+
+// ErrInvalidExportName is returned when the namespace name cannot be used in the export ID (the ID is a file name)
+var ErrInvalidExportName = fmt.Errorf("invalid namespace name for an export")
+
+// ExportedKey holds the latest version of a key exported from a namespace
+type ExportedKey struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+	Hash    string `json:"hash,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// ExportManifest is stored as `manifest.json` in the export archive, along with the blobs (as `blobs/<hash>`), the
+// meta blobs are exported too so the full kv history can be restored by importing the blobs.
+type ExportManifest struct {
+	Namespace  string         `json:"namespace"`
+	ExportedAt int64          `json:"exported_at"`
+	Blobs      int            `json:"blobs"`
+	Size       int64          `json:"size"`
+	Keys       []*ExportedKey `json:"keys"`
+}
+
+// Deletion holds the result of a namespace deletion
+type Deletion struct {
+	Namespace  string `json:"namespace"`
+	Export     string `json:"export"` // ID of the export archive
+	Blobs      int    `json:"blobs"`
+	Keys       int    `json:"keys"`
+	DeletedAt  int64  `json:"deleted_at"`
+	PurgeAfter int64  `json:"purge_after,omitempty"` // 0 if the data is kept until the namespace is destroyed
+}
+
+// exportsDir returns the directory holding the export archives (next to the namespaces as each directory of the stash
+// is a namespace)
+func (s *Stash) exportsDir() string {
+	return s.path + "_exports"
+}
+
+// Export writes a tar.gz archive of the namespace (its blobs and the latest version of its keys)
+func (s *Stash) Export(ctx context.Context, name string, w io.Writer) (*ExportManifest, error) {
+	dc, ok := s.DataContextByName(name)
+	if !ok || name == "" {
+		return nil, ErrNamespaceNotFound
+	}
+	manifest := &ExportManifest{
+		Namespace:  name,
+		ExportedAt: time.Now().Unix(),
+		Keys:       []*ExportedKey{},
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	writeFile := func(path string, data []byte) error {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:    path,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: time.Unix(manifest.ExportedAt, 0),
+		}); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(data)
+		return err
+	}
+
+	// Only the blobs stored in the namespace are exported (not the ones read from the root blobstore)
+	var cursor string
+	for {
+		refs, next, err := dc.bsDst.Enumerate(ctx, cursor, "\xff", exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			data, err := dc.bsDst.Get(ctx, ref.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if err := writeFile("blobs/"+ref.Hash, data); err != nil {
+				return nil, err
+			}
+			manifest.Blobs++
+			manifest.Size += int64(len(data))
+		}
+		if len(refs) < exportPageSize {
+			break
+		}
+		cursor = next
+	}
+
+	cursor = ""
+	for {
+		kvs, next, err := dc.kvs.Keys(ctx, cursor, "\xff", exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			manifest.Keys = append(manifest.Keys, &ExportedKey{
+				Key:     kv.Key,
+				Version: kv.Version,
+				Hash:    kv.HexHash(),
+				Data:    kv.Data,
+			})
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	js, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile("manifest.json", js); err != nil {
+		return nil, err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Delete deletes the namespace in two phases: the namespace is first exported (the archive can be downloaded using
+// `OpenExport`), then all its keys are tombstoned and the namespace expires right away. The data (and the blobs) are
+// only destroyed by the expiry worker once the retention window is over.
+func (s *Stash) Delete(ctx context.Context, name string, retention time.Duration) (*Deletion, error) {
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, ErrInvalidExportName
+	}
+	dc, ok := s.DataContextByName(name)
+	if !ok || name == "" {
+		return nil, ErrNamespaceNotFound
+	}
+	if dc.Expired(time.Now()) {
+		return nil, ErrNamespaceExpired
+	}
+	if err := s.CheckRetentionLock(ctx, name); err != nil {
+		return nil, err
+	}
+
+	// Phase 1: export the namespace
+	if err := os.MkdirAll(s.exportsDir(), 0700); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := fmt.Sprintf("%s-%d", name, now.UnixNano())
+	tmp, err := ioutil.TempFile(s.exportsDir(), ".tmp-"+id)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	manifest, err := s.Export(ctx, name, tmp)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to export the namespace: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.exportsDir(), id+".tar.gz")); err != nil {
+		return nil, err
+	}
+
+	// Phase 2: tombstone the keys and make the namespace inaccessible
+	for _, kv := range manifest.Keys {
+		if _, err := dc.kvs.Delete(ctx, kv.Key, -1); err != nil {
+			return nil, fmt.Errorf("failed to delete key %q: %w", kv.Key, err)
+		}
+	}
+	if err := s.SetExpiry(name, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	deletion := &Deletion{
+		Namespace: name,
+		Export:    id,
+		Blobs:     manifest.Blobs,
+		Keys:      len(manifest.Keys),
+		DeletedAt: now.Unix(),
+	}
+	if retention > 0 {
+		deletion.PurgeAfter = now.Add(retention).Unix()
+	}
+	return deletion, nil
+}
+
+// Exports returns the IDs of the available export archives
+func (s *Stash) Exports() ([]string, error) {
+	files, err := ioutil.ReadDir(s.exportsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	out := []string{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tar.gz") && !strings.HasPrefix(f.Name(), ".") {
+			out = append(out, strings.TrimSuffix(f.Name(), ".tar.gz"))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// OpenExport opens the export archive with the given ID
+func (s *Stash) OpenExport(id string) (*os.File, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, ErrExportNotFound
+	}
+	f, err := os.Open(filepath.Join(s.exportsDir(), id+".tar.gz"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrExportNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// PurgeExports removes the export archives older than the retention (and the leftovers of the interrupted exports),
+// and returns their IDs
+func (s *Stash) PurgeExports(retention time.Duration) ([]string, error) {
+	files, err := ioutil.ReadDir(s.exportsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	limit := time.Now().Add(-retention)
+	purged := []string{}
+	for _, f := range files {
+		if !f.ModTime().Before(limit) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.exportsDir(), f.Name())); err != nil {
+			return purged, err
+		}
+		if strings.HasSuffix(f.Name(), ".tar.gz") && !strings.HasPrefix(f.Name(), ".") {
+			purged = append(purged, strings.TrimSuffix(f.Name(), ".tar.gz"))
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,205 @@
+package stash // import "a4.io/blobstash/pkg/stash"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/blob"
+)
+
+// Dumps are logical backups of the kvstore of a namespace (the meta layer), stored as blobs in the root blobstore so
+// they are replicated/synced like any other blob and can be restored on another instance.
+//
+// A dump is made of pages (holding up to `dumpPageSize` keys) and an index blob (the dump ref) listing the pages, both
+// starting with `DumpBlobHeader` followed by the format version.
+
+// DumpBlobHeader is the header of the dump blobs
+var DumpBlobHeader = []byte("#blobstash/dbdump\n")
+
+// DumpFormatV1 is the current version of the dump format
+const DumpFormatV1 = byte('1')
+
+// Number of keys per dump page
+const dumpPageSize = 1000
+
+var (
+	// ErrInvalidDump is returned when restoring a blob that is not a dump
+	ErrInvalidDump = fmt.Errorf("invalid dump")
+
+	// ErrDumpNotFound is returned when the dump (or one of its pages) is missing from the root blobstore
+	ErrDumpNotFound = fmt.Errorf("dump not found")
+
+	// ErrNamespaceNotEmpty is returned when restoring a dump into a namespace that already holds keys
+	ErrNamespaceNotEmpty = fmt.Errorf("namespace not empty")
+)
+
+// DumpedKey holds the latest version of a key
+type DumpedKey struct {
+	Key     string `msgpack:"k"`
+	Version int64  `msgpack:"v"`
+	Hash    string `msgpack:"h,omitempty"`
+	Data    []byte `msgpack:"d,omitempty"`
+}
+
+// DumpIndex is the content of the dump blob
+type DumpIndex struct {
+	Namespace string   `json:"namespace" msgpack:"n"`
+	CreatedAt int64    `json:"created_at" msgpack:"c"`
+	Keys      int      `json:"keys" msgpack:"k"`
+	Pages     []string `json:"pages" msgpack:"p"`
+
+	// Hash of the index blob (not part of the blob)
+	Ref string `json:"ref" msgpack:"-"`
+}
+
+func encodeDumpBlob(v interface{}) (*blob.Blob, error) {
+	js, err := msgpack.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(DumpBlobHeader)
+	buf.WriteByte(DumpFormatV1)
+	buf.Write(js)
+	return blob.New(buf.Bytes()), nil
+}
+
+func decodeDumpBlob(data []byte, v interface{}) error {
+	if len(data) <= len(DumpBlobHeader) || !bytes.HasPrefix(data, DumpBlobHeader) {
+		return ErrInvalidDump
+	}
+	if data[len(DumpBlobHeader)] != DumpFormatV1 {
+		return fmt.Errorf("unsupported dump format version %q", data[len(DumpBlobHeader)])
+	}
+	if err := msgpack.Unmarshal(data[len(DumpBlobHeader)+1:], v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDump, err)
+	}
+	return nil
+}
+
+// Dump serializes the latest version of all the keys of the namespace, the blobs referenced by the keys are not part
+// of the dump
+func (s *Stash) Dump(ctx context.Context, name string) (*DumpIndex, error) {
+	dc, ok := s.DataContextByName(name)
+	if !ok {
+		return nil, ErrNamespaceNotFound
+	}
+	bs := s.Root().BlobStore()
+	index := &DumpIndex{
+		Namespace: name,
+		CreatedAt: time.Now().Unix(),
+		Pages:     []string{},
+	}
+
+	var cursor string
+	for {
+		kvs, next, err := dc.kvs.Keys(ctx, cursor, "\xff", dumpPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) > 0 {
+			page := make([]*DumpedKey, 0, len(kvs))
+			for _, kv := range kvs {
+				page = append(page, &DumpedKey{
+					Key:     kv.Key,
+					Version: kv.Version,
+					Hash:    kv.HexHash(),
+					Data:    kv.Data,
+				})
+			}
+			blb, err := encodeDumpBlob(page)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := bs.Put(ctx, blb); err != nil {
+				return nil, err
+			}
+			index.Pages = append(index.Pages, blb.Hash)
+			index.Keys += len(page)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	blb, err := encodeDumpBlob(index)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bs.Put(ctx, blb); err != nil {
+		return nil, err
+	}
+	index.Ref = blb.Hash
+	return index, nil
+}
+
+// Restore loads the dump (the dump blobs must be present in the root blobstore) into the given namespace, which is
+// created if needed and must not hold any key, the keys are restored with their original versions
+func (s *Stash) Restore(ctx context.Context, name, ref string) (*DumpIndex, error) {
+	if name == "" {
+		return nil, fmt.Errorf("cannot restore into the root namespace")
+	}
+	bs := s.Root().BlobStore()
+	data, err := bs.Get(ctx, ref)
+	if err != nil {
+		if err == blobsfile.ErrBlobNotFound {
+			return nil, ErrDumpNotFound
+		}
+		return nil, err
+	}
+	index := &DumpIndex{}
+	if err := decodeDumpBlob(data, index); err != nil {
+		return nil, err
+	}
+	index.Ref = ref
+
+	// Fetch all the pages first so an incomplete dump is not partially restored
+	pages := make([][]*DumpedKey, 0, len(index.Pages))
+	for _, pageRef := range index.Pages {
+		data, err := bs.Get(ctx, pageRef)
+		if err != nil {
+			if err == blobsfile.ErrBlobNotFound {
+				return nil, fmt.Errorf("%w: missing page %s", ErrDumpNotFound, pageRef)
+			}
+			return nil, err
+		}
+		page := []*DumpedKey{}
+		if err := decodeDumpBlob(data, &page); err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+
+	dc, ok := s.DataContextByName(name)
+	if ok {
+		if dc.Expired(time.Now()) {
+			return nil, ErrNamespaceExpired
+		}
+		kvs, _, err := dc.kvs.Keys(ctx, "", "\xff", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) > 0 {
+			return nil, ErrNamespaceNotEmpty
+		}
+	} else {
+		if dc, err = s.NewDataContext(name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, page := range pages {
+		for _, k := range page {
+			if _, err := dc.kvs.Put(ctx, k.Key, k.Hash, k.Data, k.Version); err != nil {
+				return nil, fmt.Errorf("failed to restore key %q: %w", k.Key, err)
+			}
+		}
+	}
+	return index, nil
+}
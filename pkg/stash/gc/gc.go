@@ -2,7 +2,6 @@ package gc // import "a4.io/blobstash/pkg/stash/gc"
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/vmihailenco/msgpack"
 	lua "github.com/yuin/gopher-lua"
@@ -11,6 +10,7 @@ import (
 	"a4.io/blobstash/pkg/apps/luautil"
 	"a4.io/blobstash/pkg/blob"
 	bsLua "a4.io/blobstash/pkg/blobstore/lua"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/extra"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/hub"
@@ -21,14 +21,29 @@ import (
 )
 
 func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, script string, existingRefs map[string]struct{}) (int, uint64, error) {
+	name, _ := ctxutil.Namespace(ctx)
+	orderedRefs, _, err := mark(ctx, s, name, script, existingRefs, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return save(ctx, s, dc, orderedRefs)
+}
+
+// mark executes the GC script and returns the marked refs, the blobs tagged into the namespace are always marked (along
+// with their children if they are filetree nodes).
+//
+// The `eligible` blobs (e.g. only referenced by pruned filetree versions) are not marked by the script, the number of
+// skipped blobs is returned along with the marked refs.
+func mark(ctx context.Context, s *stash.Stash, name, script string, existingRefs, eligible map[string]struct{}) ([]string, int, error) {
 
 	// TODO(tsileo): take a logger
 	refs := map[string]struct{}{}
 	orderedRefs := []string{}
+	skipped := map[string]struct{}{}
+	skipEligible := true
 
 	L := lua.NewState()
 	defer L.Close()
-	var skipped int
 
 	// premark(<blob hash>) notify the GC that this blob is already in the root blobstore explicitely (to speedup huge GC)
 	premark := func(L *lua.LState) int {
@@ -48,6 +63,10 @@ func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, s
 		//	skipped++
 		//	return 0
 		// }
+		if _, ok := eligible[ref]; ok && skipEligible {
+			skipped[ref] = struct{}{}
+			return 0
+		}
 		if _, ok := refs[ref]; !ok {
 			refs[ref] = struct{}{}
 			orderedRefs = append(orderedRefs, ref)
@@ -68,16 +87,53 @@ func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, s
 	// - mark_kv(key, version)  -- version must be a String because we use nano ts
 	// - mark_filetree_node(ref)
 	if err := L.DoString(luascripts.Get("stash_gc.lua")); err != nil {
-		return 0, 0, err
+		return nil, 0, err
 	}
 
 	if err := L.DoString(script); err != nil {
-		return 0, 0, err
+		return nil, 0, err
+	}
+
+	// The members are explicit GC roots, they're marked even if GC-eligible
+	skipEligible = false
+	members, _, _, err := s.Members(ctx, name, "", 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ref := range members {
+		data, err := s.BlobStore().Get(ctx, ref)
+		if err != nil {
+			if err == blobsfile.ErrBlobNotFound {
+				continue
+			}
+			return nil, 0, err
+		}
+		fn := "mark"
+		if _, ok := node.IsNodeBlob(data); ok {
+			fn = "mark_filetree_node"
+		}
+		if err := L.CallByParam(lua.P{
+			Fn:      L.GetGlobal(fn),
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(ref)); err != nil {
+			return nil, 0, err
+		}
+	}
+	var eligibleSkipped int
+	for ref := range skipped {
+		if _, ok := refs[ref]; !ok {
+			eligibleSkipped++
+		}
 	}
-	fmt.Printf("refs=%q\n", orderedRefs)
+	return orderedRefs, eligibleSkipped, nil
+}
+
+// save copies the given refs from the namespace to the root blobstore
+func save(ctx context.Context, s *stash.Stash, dc store.DataContext, refs []string) (int, uint64, error) {
 	blobsCnt := 0
 	totalSize := uint64(0)
-	for _, ref := range orderedRefs {
+	for _, ref := range refs {
 		// FIXME(tsileo): stat before get/put
 
 		// Get the marked blob from the blobstore proxy
@@ -100,7 +156,6 @@ func GC(ctx context.Context, h *hub.Hub, s *stash.Stash, dc store.DataContext, s
 			totalSize += uint64(len(data))
 		}
 	}
-	fmt.Printf("premarking helped skipped %d blobs, refs=%d blobs, saved %d blobs\n", skipped, len(orderedRefs), blobsCnt)
 
 	return blobsCnt, totalSize, nil
 }
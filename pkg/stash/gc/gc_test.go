@@ -2,9 +2,13 @@ package gc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
@@ -13,6 +17,7 @@ import (
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/jobs"
 	kstore "a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash"
@@ -112,3 +117,298 @@ func TestDataContextMerge(t *testing.T) {
 	// t.Errorf("bad GCed blob, expected %s, got %s", lastBlob.Hash, blobsRoot[0].Hash)
 	// }
 }
+
+func TestRunGracePeriod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stash_gc_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := bstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+	s, err := stash.New(filepath.Join(dir, "stash"), metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ctx := ctxutil.WithNamespace(context.Background(), "tmp")
+	dc, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+	blobs := []*blob.Blob{}
+	for i := 0; i < 3; i++ {
+		b := makeBlob([]byte(fmt.Sprintf("hello%d", i)))
+		if _, err := dc.BlobStoreProxy().Put(ctx, b); err != nil {
+			panic(err)
+		}
+		blobs = append(blobs, b)
+	}
+	if _, err := dc.KvStore().Put(ctx, "hello", blobs[2].Hash, nil, 10); err != nil {
+		panic(err)
+	}
+	script := "mark_kv('hello', 10)"
+
+	// The dry-run only reports the sweep set
+	report, err := Run(ctx, s, "tmp", script, &Opts{DryRun: true})
+	if err != nil {
+		panic(err)
+	}
+	if report.Status != StatusDryRun || len(report.Sweep) != 2 || report.Ref == "" {
+		t.Errorf("unexpected dry-run report %+v", report)
+	}
+	last, err := LastReport(ctx, s)
+	if err != nil {
+		panic(err)
+	}
+	if last == nil || last.Ref != report.Ref {
+		t.Errorf("unexpected last report %+v", last)
+	}
+
+	// The GC-eligible blobs are not marked by the script
+	report, err = Run(ctx, s, "tmp", script, &Opts{DryRun: true, Eligible: func(context.Context) (map[string]struct{}, error) {
+		return map[string]struct{}{blobs[2].Hash: struct{}{}}, nil
+	}})
+	if err != nil {
+		panic(err)
+	}
+	if report.Eligible != 1 || len(report.Sweep) != 3 {
+		t.Errorf("unexpected dry-run report %+v", report)
+	}
+
+	grace := &Opts{GracePeriod: time.Second}
+	report, err = Run(ctx, s, "tmp", script, grace)
+	if err != nil {
+		panic(err)
+	}
+	if report.Status != StatusPending {
+		t.Errorf("expected a pending GC, got %+v", report)
+	}
+	if _, err := Run(ctx, s, "tmp", script, grace); err != ErrTooEarly {
+		t.Errorf("expected ErrTooEarly, got %v", err)
+	}
+
+	// A blob uploaded during the grace period is kept
+	inflight := makeBlob([]byte("inflight"))
+	if _, err := dc.BlobStoreProxy().Put(ctx, inflight); err != nil {
+		panic(err)
+	}
+
+	time.Sleep(2 * time.Second)
+	report, err = Run(ctx, s, "tmp", script, grace)
+	if err != nil {
+		panic(err)
+	}
+	if report.Status != StatusDone || len(report.Sweep) != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, b := range []*blob.Blob{blobs[2], inflight} {
+		if ok, err := s.Root().BlobStore().Stat(context.Background(), b.Hash); err != nil || !ok {
+			t.Errorf("blob %s should have been saved (err=%v)", b.Hash, err)
+		}
+	}
+	for _, b := range blobs[:2] {
+		if ok, err := s.Root().BlobStore().Stat(context.Background(), b.Hash); err != nil || ok {
+			t.Errorf("blob %s should have been swept (err=%v)", b.Hash, err)
+		}
+	}
+	if _, ok := s.DataContextByName("tmp"); ok {
+		t.Errorf("the namespace should have been destroyed")
+	}
+}
+
+func TestRunMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stash_gc_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := bstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+	s, err := stash.New(filepath.Join(dir, "stash"), metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	ctx := ctxutil.WithNamespace(context.Background(), "tmp")
+	dc, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+	tagged := makeBlob([]byte("tagged"))
+	untagged := makeBlob([]byte("untagged"))
+	for _, b := range []*blob.Blob{tagged, untagged} {
+		if _, err := dc.BlobStoreProxy().Put(ctx, b); err != nil {
+			panic(err)
+		}
+	}
+	if err := s.AddMember(ctx, "tmp", tagged.Hash); err != nil {
+		panic(err)
+	}
+	if err := s.AddMember(ctx, "tmp", makeBlob([]byte("missing")).Hash); err != stash.ErrMemberNotFound {
+		t.Errorf("expected ErrMemberNotFound, got %v", err)
+	}
+	if err := s.AddMember(ctx, "nope", tagged.Hash); err != stash.ErrNamespaceNotFound {
+		t.Errorf("expected ErrNamespaceNotFound, got %v", err)
+	}
+	members, _, _, err := s.Members(ctx, "tmp", "", 0)
+	if err != nil {
+		panic(err)
+	}
+	if len(members) != 1 || members[0] != tagged.Hash {
+		t.Errorf("unexpected members %q", members)
+	}
+
+	// The members are paginated, and removed along with their namespace
+	pctx := ctxutil.WithNamespace(context.Background(), "paged")
+	pdc, err := s.NewDataContext("paged")
+	if err != nil {
+		panic(err)
+	}
+	for _, b := range []*blob.Blob{tagged, untagged} {
+		if _, err := pdc.BlobStoreProxy().Put(pctx, b); err != nil {
+			panic(err)
+		}
+		if err := s.AddMember(pctx, "paged", b.Hash); err != nil {
+			panic(err)
+		}
+	}
+	var paged []string
+	cursor := ""
+	for i := 0; ; i++ {
+		page, next, hasMore, err := s.Members(ctx, "paged", cursor, 1)
+		if err != nil {
+			panic(err)
+		}
+		paged = append(paged, page...)
+		cursor = next
+		if !hasMore {
+			if i != 1 {
+				t.Errorf("expected 2 pages, got %d", i+1)
+			}
+			break
+		}
+	}
+	if len(paged) != 2 {
+		t.Errorf("unexpected members %q", paged)
+	}
+	if err := s.Destroy(ctx, "paged"); err != nil {
+		panic(err)
+	}
+	if members, _, _, err := s.Members(ctx, "paged", "", 0); err != nil || len(members) != 0 {
+		t.Errorf("the members should be removed with the namespace, got %q (%v)", members, err)
+	}
+
+	// The members are GC roots, even if the script does not mark anything
+	report, err := Run(ctx, s, "tmp", "", &Opts{})
+	if err != nil {
+		panic(err)
+	}
+	if report.Status != StatusDone || report.Marked != 1 || len(report.Sweep) != 1 || report.Sweep[0] != untagged.Hash {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if ok, err := s.Root().BlobStore().Stat(context.Background(), tagged.Hash); err != nil || !ok {
+		t.Errorf("the tagged blob should have been saved (err=%v)", err)
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stash_gc_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := bstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+	s, err := stash.New(filepath.Join(dir, "stash"), metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	m, err := jobs.New(logger.New("app", "jobs"), dir)
+	if err != nil {
+		panic(err)
+	}
+	defer m.Close()
+	if err := RegisterJobs(m, s, nil); err != nil {
+		panic(err)
+	}
+
+	ctx := ctxutil.WithNamespace(context.Background(), "tmp")
+	dc, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := dc.BlobStoreProxy().Put(ctx, makeBlob([]byte("untagged"))); err != nil {
+		panic(err)
+	}
+
+	// The report is the result of the job
+	params := &JobParams{Namespace: "tmp", GracePeriod: 3600}
+	job, err := m.Start(Job, params)
+	if err != nil {
+		panic(err)
+	}
+	job, err = m.Wait(context.Background(), job.ID)
+	if err != nil {
+		panic(err)
+	}
+	report := &Report{}
+	if err := json.Unmarshal(job.Result, report); err != nil {
+		panic(err)
+	}
+	if job.State != jobs.Done || report.Status != StatusPending || len(report.Sweep) != 1 {
+		t.Errorf("unexpected job %+v (report=%+v)", job, report)
+	}
+
+	// The sweep is rejected until the end of the grace period
+	job, err = m.Start(Job, params)
+	if err != nil {
+		panic(err)
+	}
+	job, err = m.Wait(context.Background(), job.ID)
+	if err != ErrTooEarly || job.State != jobs.Failed {
+		t.Errorf("expected ErrTooEarly, got %v (job=%+v)", err, job)
+	}
+}
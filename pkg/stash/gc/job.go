@@ -0,0 +1,48 @@
+package gc // import "a4.io/blobstash/pkg/stash/gc"
+
+import (
+	"context"
+	"time"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/jobs"
+	"a4.io/blobstash/pkg/stash"
+)
+
+// Job is the kind of the GC jobs (the result holds the `Report`)
+const Job = "stash.gc"
+
+// JobParams holds the params of a GC job
+type JobParams struct {
+	Namespace   string `json:"namespace"`
+	Script      string `json:"script"`
+	DryRun      bool   `json:"dry_run"`
+	GracePeriod int64  `json:"grace_period"` // In seconds
+}
+
+// RegisterJobs registers the GC jobs on the jobs manager (a GC interrupted by a shutdown is not resumed, it can be
+// started again), `eligible` (optional) returns the blobs left unmarked by the GC scripts
+func RegisterJobs(m *jobs.Manager, s *stash.Stash, eligible EligibleFunc) error {
+	return m.RegisterKind(&jobs.Kind{
+		Name: Job,
+		Run: func(ctx context.Context, h *jobs.Handle) error {
+			params := &JobParams{}
+			if err := h.Params(params); err != nil {
+				return err
+			}
+			ctx = ctxutil.WithNamespace(ctx, params.Namespace)
+			report, err := Run(ctx, s, params.Namespace, params.Script, &Opts{
+				DryRun:      params.DryRun,
+				GracePeriod: time.Duration(params.GracePeriod) * time.Second,
+				Eligible:    eligible,
+			})
+			if report != nil {
+				if err := h.SetResult(report); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+		Retry: jobs.RetryPolicy{MaxAttempts: 1},
+	})
+}
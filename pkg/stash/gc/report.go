@@ -0,0 +1,293 @@
+package gc // import "a4.io/blobstash/pkg/stash/gc"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/stash"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Keys (in the root kvstore) pointing to the report blobs
+const (
+	LastReportKey       = "_stash:gc:last"
+	pendingReportKeyFmt = "_stash:gc:pending:%s"
+)
+
+// Report statuses
+const (
+	StatusDryRun  = "dry-run" // nothing was copied or dropped
+	StatusPending = "pending" // marked, waiting for the grace period to sweep
+	StatusDone    = "done"    // the namespace has been swept
+)
+
+// ErrTooEarly is returned when trying to sweep a namespace before the end of the grace period
+var ErrTooEarly = fmt.Errorf("the grace period is not over")
+
+// Opts holds the GC options
+type Opts struct {
+	// DryRun only computes the sweep set
+	DryRun bool
+
+	// GracePeriod is the minimum delay between the mark and the sweep, the blobs uploaded in the meantime are saved
+	// (0 means mark and sweep at once)
+	GracePeriod time.Duration
+
+	// Eligible returns the blobs of the namespace that must not be marked by the script (e.g. the blobs only
+	// referenced by the pruned filetree versions)
+	Eligible EligibleFunc
+}
+
+// EligibleFunc returns the GC-eligible blobs of the namespace (set in the context)
+type EligibleFunc func(ctx context.Context) (map[string]struct{}, error)
+
+// Report holds the outcome of a GC, it's stored as a blob in the root blobstore
+type Report struct {
+	Namespace string `json:"namespace"`
+	Status    string `json:"status"`
+	Script    string `json:"script"`
+
+	MarkedAt   int64 `json:"marked_at"`
+	SweepAfter int64 `json:"sweep_after,omitempty"`
+	SweptAt    int64 `json:"swept_at,omitempty"`
+
+	// Marked blobs, copied to the root blobstore
+	Marked     int    `json:"marked"`
+	Eligible   int    `json:"eligible"` // GC-eligible blobs left unmarked
+	Saved      int    `json:"saved"`
+	SavedBytes uint64 `json:"saved_bytes"`
+
+	// Blobs (only present in the namespace) dropped by the sweep
+	Sweep      []string `json:"sweep"`
+	SweepBytes uint64   `json:"sweep_bytes"`
+
+	// Hash of the report blob (not part of the blob)
+	Ref string `json:"ref,omitempty"`
+}
+
+// Run performs a GC of the namespace: the blobs marked by the script are saved in the root blobstore, and the
+// namespace is destroyed (i.e. the other blobs are swept).
+//
+// With a grace period, the first call only marks the blobs and records the sweep set, the sweep is performed by the
+// first call after the grace period: the script is executed again, and only the blobs of the recorded sweep set that
+// are still not marked are dropped.
+func Run(ctx context.Context, s *stash.Stash, name, script string, opts *Opts) (*Report, error) {
+	dc, ok := s.DataContextByName(name)
+	if !ok {
+		return nil, fmt.Errorf("data context not found")
+	}
+
+	if !opts.DryRun {
+		if err := s.CheckRetentionLock(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	pending, err := PendingReport(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if pending != nil && !opts.DryRun {
+		if now.Unix() < pending.SweepAfter {
+			return pending, ErrTooEarly
+		}
+		return sweep(ctx, s, name, pending, opts)
+	}
+
+	eligible, err := opts.eligible(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs, eligibleCnt, err := mark(ctx, s, name, script, map[string]struct{}{}, eligible)
+	if err != nil {
+		return nil, err
+	}
+	sweepSet, sweepBytes, err := unmarked(ctx, dc, refs)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Namespace:  name,
+		Script:     script,
+		MarkedAt:   now.Unix(),
+		Marked:     len(refs),
+		Eligible:   eligibleCnt,
+		Sweep:      sweepSet,
+		SweepBytes: sweepBytes,
+	}
+
+	switch {
+	case opts.DryRun:
+		report.Status = StatusDryRun
+	case opts.GracePeriod > 0:
+		report.Status = StatusPending
+		report.SweepAfter = now.Add(opts.GracePeriod).Unix()
+		if err := saveReport(ctx, s, fmt.Sprintf(pendingReportKeyFmt, name), report); err != nil {
+			return nil, err
+		}
+	default:
+		if err := s.DoAndDestroy(ctx, name, func(ctx context.Context, dc store.DataContext) error {
+			report.Saved, report.SavedBytes, err = save(ctx, s, dc, refs)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		report.Status = StatusDone
+		report.SweptAt = time.Now().UTC().Unix()
+	}
+
+	if err := saveReport(ctx, s, LastReportKey, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sweep executes the script again, and drop the blobs of the pending sweep set that are still not marked (the blobs
+// uploaded after the mark are all saved)
+func sweep(ctx context.Context, s *stash.Stash, name string, pending *Report, opts *Opts) (*Report, error) {
+	report := &Report{
+		Namespace:  name,
+		Script:     pending.Script,
+		MarkedAt:   pending.MarkedAt,
+		SweepAfter: pending.SweepAfter,
+		Sweep:      []string{},
+	}
+	candidates := map[string]struct{}{}
+	for _, ref := range pending.Sweep {
+		candidates[ref] = struct{}{}
+	}
+
+	eligible, err := opts.eligible(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs, eligibleCnt, err := mark(ctx, s, name, pending.Script, map[string]struct{}{}, eligible)
+	if err != nil {
+		return nil, err
+	}
+	report.Marked = len(refs)
+	report.Eligible = eligibleCnt
+	marked := map[string]struct{}{}
+	for _, ref := range refs {
+		marked[ref] = struct{}{}
+	}
+
+	if err := s.DoAndDestroy(ctx, name, func(ctx context.Context, dc store.DataContext) error {
+		blobs, _, err := dc.StashBlobStore().Enumerate(ctx, "", "\xff", 0)
+		if err != nil {
+			return err
+		}
+		toSave := refs
+		for _, blb := range blobs {
+			if _, ok := marked[blb.Hash]; ok {
+				continue
+			}
+			if _, ok := candidates[blb.Hash]; ok {
+				report.Sweep = append(report.Sweep, blb.Hash)
+				report.SweepBytes += uint64(blb.Size)
+				continue
+			}
+			// Uploaded during the grace period
+			toSave = append(toSave, blb.Hash)
+		}
+		report.Saved, report.SavedBytes, err = save(ctx, s, dc, toSave)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report.Status = StatusDone
+	report.SweptAt = time.Now().UTC().Unix()
+
+	if _, err := s.Root().KvStore().Delete(ctx, fmt.Sprintf(pendingReportKeyFmt, name), -1); err != nil {
+		return nil, err
+	}
+	if err := saveReport(ctx, s, LastReportKey, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// eligible returns the GC-eligible blobs (if an `Eligible` func is set)
+func (o *Opts) eligible(ctx context.Context) (map[string]struct{}, error) {
+	if o.Eligible == nil {
+		return nil, nil
+	}
+	return o.Eligible(ctx)
+}
+
+// unmarked returns the blobs only present in the namespace that are not marked
+func unmarked(ctx context.Context, dc store.DataContext, refs []string) ([]string, uint64, error) {
+	marked := map[string]struct{}{}
+	for _, ref := range refs {
+		marked[ref] = struct{}{}
+	}
+	blobs, _, err := dc.StashBlobStore().Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	out := []string{}
+	var size uint64
+	for _, blb := range blobs {
+		if _, ok := marked[blb.Hash]; ok {
+			continue
+		}
+		out = append(out, blb.Hash)
+		size += uint64(blb.Size)
+	}
+	return out, size, nil
+}
+
+// saveReport stores the report as a blob in the root blobstore, and points the given key to it
+func saveReport(ctx context.Context, s *stash.Stash, key string, report *Report) error {
+	report.Ref = ""
+	js, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	blb := blob.New(js)
+	if _, err := s.Root().BlobStore().Put(ctx, blb); err != nil {
+		return err
+	}
+	if _, err := s.Root().KvStore().Put(ctx, key, blb.Hash, nil, -1); err != nil {
+		return err
+	}
+	report.Ref = blb.Hash
+	return nil
+}
+
+func loadReport(ctx context.Context, s *stash.Stash, key string) (*Report, error) {
+	kv, err := s.Root().KvStore().Get(ctx, key, -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	data, err := s.Root().BlobStore().Get(ctx, kv.HexHash())
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	report.Ref = kv.HexHash()
+	return report, nil
+}
+
+// LastReport returns the report of the latest GC (nil if no GC has been performed yet)
+func LastReport(ctx context.Context, s *stash.Stash) (*Report, error) {
+	return loadReport(ctx, s, LastReportKey)
+}
+
+// PendingReport returns the report of the namespace waiting to be swept (if any)
+func PendingReport(ctx context.Context, s *stash.Stash, name string) (*Report, error) {
+	return loadReport(ctx, s, fmt.Sprintf(pendingReportKeyFmt, name))
+}
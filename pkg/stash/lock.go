@@ -0,0 +1,137 @@
+package stash // import "a4.io/blobstash/pkg/stash"
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRetentionLocked is returned when deleting/destroying a namespace that holds versions younger than its retention
+// lock
+var ErrRetentionLocked = errors.New("namespace under retention lock")
+
+// SetRetentionLocks sets the retention locks (in days) by namespace name
+func (s *Stash) SetRetentionLocks(days map[string]int) {
+	s.Lock()
+	defer s.Unlock()
+	s.locks = map[string]time.Duration{}
+	for name, d := range days {
+		s.locks[name] = time.Duration(d) * 24 * time.Hour
+	}
+}
+
+// RetentionLockedUntil returns the date (Unix timestamp) until which the namespace cannot be deleted nor garbage
+// collected (0 if it's not locked)
+func (s *Stash) RetentionLockedUntil(ctx context.Context, name string) (int64, error) {
+	s.Lock()
+	dc, ok := s.contexes[name]
+	lock := s.locks[name]
+	s.Unlock()
+	if !ok || lock == 0 {
+		return 0, nil
+	}
+	return dc.lockedUntil(lock), nil
+}
+
+// CheckRetentionLock returns ErrRetentionLocked if the namespace is locked
+func (s *Stash) CheckRetentionLock(ctx context.Context, name string) error {
+	until, err := s.RetentionLockedUntil(ctx, name)
+	if err != nil {
+		return err
+	}
+	if until > time.Now().Unix() {
+		return ErrRetentionLocked
+	}
+	return nil
+}
+
+// checkRetentionLock must be called with the stash lock held
+func (s *Stash) checkRetentionLock(dc *dataContext, name string) error {
+	lock := s.locks[name]
+	if lock == 0 {
+		return nil
+	}
+	if until := dc.lockedUntil(lock); until > time.Now().Unix() {
+		return ErrRetentionLocked
+	}
+	return nil
+}
+
+// Name of the file holding the most recent version written in the namespace (the retention lock starts from it)
+const lastWriteFilename = "last_write"
+
+// loadLastWrite loads the most recent version written in the namespace, the namespaces created before the file
+// existed are scanned once
+func (dc *dataContext) loadLastWrite(ctx context.Context) error {
+	data, err := ioutil.ReadFile(filepath.Join(dc.dir, lastWriteFilename))
+	switch {
+	case err == nil:
+		dc.lastWrite, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return err
+	case !os.IsNotExist(err):
+		return err
+	}
+	return dc.scanLastWrite(ctx)
+}
+
+// scanLastWrite records the most recent version of the namespace keys
+func (dc *dataContext) scanLastWrite(ctx context.Context) error {
+	var latest int64
+	var cursor string
+	for {
+		kvs, next, err := dc.kvs.Keys(ctx, cursor, "\xff", exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if kv.Version > latest {
+				latest = kv.Version
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return dc.recordWrite(latest)
+}
+
+// recordWrite updates the most recent version written in the namespace, the file is rounded up to the next minute
+// so it's only rewritten once per minute
+func (dc *dataContext) recordWrite(version int64) error {
+	// The root namespace cannot be destroyed
+	if dc.root {
+		return nil
+	}
+	dc.lastWriteMu.Lock()
+	defer dc.lastWriteMu.Unlock()
+	if version <= dc.lastWrite {
+		return nil
+	}
+	dc.lastWrite = version
+	if version <= dc.lastWriteSaved {
+		return nil
+	}
+	saved := time.Unix(0, version).Truncate(time.Minute).Add(time.Minute).UnixNano()
+	if err := ioutil.WriteFile(filepath.Join(dc.dir, lastWriteFilename), []byte(strconv.FormatInt(saved, 10)), 0600); err != nil {
+		return err
+	}
+	dc.lastWriteSaved = saved
+	return nil
+}
+
+// lockedUntil returns the date the most recent version of the namespace leaves the retention lock (versions are Unix
+// nano timestamps)
+func (dc *dataContext) lockedUntil(lock time.Duration) int64 {
+	dc.lastWriteMu.Lock()
+	defer dc.lastWriteMu.Unlock()
+	if dc.lastWrite == 0 {
+		return 0
+	}
+	return time.Unix(0, dc.lastWrite).Add(lock).Unix()
+}
@@ -0,0 +1,90 @@
+package stash // import "a4.io/blobstash/pkg/stash"
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Keys (in the root kvstore) recording the blobs tagged into a namespace
+const (
+	memberPrefixFmt = "_stash:ns:%s:"
+	memberKeyFmt    = memberPrefixFmt + "%s"
+)
+
+// ErrNamespaceNotFound is returned when the namespace does not exist
+var ErrNamespaceNotFound = fmt.Errorf("namespace not found")
+
+// ErrMemberNotFound is returned when tagging a blob that is not stored in the namespace
+var ErrMemberNotFound = fmt.Errorf("blob not found in the namespace")
+
+// AddMember tags the blob (stored in the namespace or the root blobstore) into the namespace, the members are GC roots
+// of the namespace (see the `gc` package)
+func (s *Stash) AddMember(ctx context.Context, name, hash string) error {
+	dc, ok := s.DataContextByName(name)
+	if !ok || name == "" {
+		return ErrNamespaceNotFound
+	}
+	exists, err := dc.BlobStoreProxy().Stat(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrMemberNotFound
+	}
+	_, err = s.Root().KvStore().Put(ctx, fmt.Sprintf(memberKeyFmt, name, hash), hash, nil, -1)
+	return err
+}
+
+// Members returns the blobs tagged into the namespace, starting at the given cursor (limit <= 0 returns all of them),
+// along with the cursor of the next page, and whether there are more members after it
+func (s *Stash) Members(ctx context.Context, name, cursor string, limit int) ([]string, string, bool, error) {
+	prefix := fmt.Sprintf(memberPrefixFmt, name)
+	out := []string{}
+	next := cursor
+	start := prefix + cursor
+	for {
+		// Fetch an extra member to know if there is a next page
+		fetch := 0
+		if limit > 0 {
+			fetch = limit + 1
+		}
+		kvs, kvsCursor, err := s.Root().KvStore().Keys(ctx, start, prefix+"\xff", fetch)
+		if err != nil {
+			return nil, "", false, err
+		}
+		for _, kv := range kvs {
+			hash := strings.TrimPrefix(kv.Key, prefix)
+			// Skip the members of the namespaces sharing the prefix (e.g. "a:b" for "a")
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+				continue
+			}
+			if limit > 0 && len(out) == limit {
+				return out, next, true, nil
+			}
+			out = append(out, hash)
+			next = strings.TrimPrefix(vkv.NextKey(kv.Key), prefix)
+		}
+		if fetch == 0 || len(kvs) < fetch {
+			return out, next, false, nil
+		}
+		start = kvsCursor
+	}
+}
+
+// deleteMembers removes the members of a destroyed namespace
+func (s *Stash) deleteMembers(ctx context.Context, name string) error {
+	members, _, _, err := s.Members(ctx, name, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, hash := range members {
+		if _, err := s.Root().KvStore().Delete(ctx, fmt.Sprintf(memberKeyFmt, name, hash), -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
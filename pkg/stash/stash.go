@@ -2,11 +2,16 @@ package stash // import "a4.io/blobstash/pkg/stash"
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
@@ -34,6 +39,17 @@ type dataContext struct {
 	dir      string
 	root     bool
 	closed   bool
+
+	// Unix timestamp after which the namespace is no longer accessible (0 if it never expires)
+	expiresAt int64
+
+	// Name of the namespace this one was forked from (the blobs missing from the layer are read from it)
+	parent string
+
+	// Most recent version written in the namespace (and the value saved in its file, see `recordWrite`)
+	lastWrite      int64
+	lastWriteSaved int64
+	lastWriteMu    sync.Mutex
 }
 
 func (dc *dataContext) StashBlobStore() store.BlobStore {
@@ -119,6 +135,10 @@ func (dc *dataContext) MergeFileTreeNode(ctx context.Context, refs *orderedRefs,
 			// Save each blob content
 			data := dref.([]interface{})
 			bref := data[1].(string)
+			// Delta chunks also reference their base chunk
+			if len(data) > 2 {
+				refs.Add(data[2].(string))
+			}
 			refs.Add(bref)
 		}
 	} else {
@@ -196,31 +216,96 @@ func (dc *dataContext) Destroy() error {
 	return os.RemoveAll(dc.dir)
 }
 
+// ErrNamespaceExpired is returned when accessing a namespace after its expiration date
+var ErrNamespaceExpired = errors.New("namespace expired")
+
+// Name of the file holding the expiration date of a namespace (in its directory)
+const expiryFilename = "expires_at"
+
+// Name of the file holding the name of the namespace a fork was created from (in its directory)
+const parentFilename = "parent"
+
+// ErrInvalidNamespace is returned when the namespace name cannot be used as a directory name
+var ErrInvalidNamespace = errors.New("invalid namespace name")
+
+// ErrHasForks is returned when destroying a namespace other namespaces were forked from (they read its blobs)
+var ErrHasForks = errors.New("namespace has forks")
+
+// Expired returns true if the namespace is expired at the given time
+func (dc *dataContext) Expired(now time.Time) bool {
+	return dc.expiresAt > 0 && now.Unix() >= dc.expiresAt
+}
+
 type Stash struct {
 	rootDataContext *dataContext
+	rootBlobStore   *blobstore.BlobStore
 	contexes        map[string]*dataContext
 	path            string
+	stop            chan struct{}
+
+	// Retention locks by namespace name
+	locks map[string]time.Duration
+
+	// Delay after the expiration of a namespace before its data is destroyed (0 keeps the data)
+	expiredRetention time.Duration
+
+	// Delay before the export archives are removed (0 keeps them)
+	exportsRetention time.Duration
+
+	// Callbacks notified of the namespaces lifecycle (see `Watch`)
+	loaded    []func(string, *hub.Hub)
+	destroyed []func(string) error
 	sync.Mutex
 }
 
+// Watch calls `loaded` with the hub of each namespace (the current ones, and the next ones when they're loaded), and
+// `destroyed` with the name of each destroyed namespace
+func (s *Stash) Watch(loaded func(string, *hub.Hub), destroyed func(string) error) {
+	s.Lock()
+	defer s.Unlock()
+	s.loaded = append(s.loaded, loaded)
+	s.destroyed = append(s.destroyed, destroyed)
+	for name, dc := range s.contexes {
+		loaded(name, dc.hub)
+	}
+}
+
 func (s *Stash) destroy(dataContext *dataContext, name string) error {
 	if dataContext.root {
 		return fmt.Errorf("cannot destroy the root data context")
 	}
+	if err := s.checkRetentionLock(dataContext, name); err != nil {
+		return err
+	}
+	for _, dc := range s.contexes {
+		if dc.parent == name {
+			return ErrHasForks
+		}
+	}
 
 	delete(s.contexes, name)
 
 	if err := dataContext.Destroy(); err != nil {
 		return err
 	}
+	if err := s.deleteMembers(context.Background(), name); err != nil {
+		return err
+	}
+	for _, destroyed := range s.destroyed {
+		if err := destroyed(name); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func New(dir string, m *meta.Meta, bs *blobstore.BlobStore, kvs *kvstore.KvStore, h *hub.Hub, l log.Logger) (*Stash, error) {
 	s := &Stash{
-		contexes: map[string]*dataContext{},
-		path:     dir,
+		contexes:      map[string]*dataContext{},
+		path:          dir,
+		stop:          make(chan struct{}),
+		rootBlobStore: bs,
 		rootDataContext: &dataContext{
 			bs:       bs,
 			kvs:      kvs,
@@ -255,12 +340,43 @@ func New(dir string, m *meta.Meta, bs *blobstore.BlobStore, kvs *kvstore.KvStore
 func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 	s.Lock()
 	defer s.Unlock()
+	return s.newDataContext(name, map[string]bool{})
+}
+
+// newDataContext loads the namespace, `visited` holds the names of the forks being loaded (to detect the loops in
+// the parent files)
+func (s *Stash) newDataContext(name string, visited map[string]bool) (*dataContext, error) {
+	if dc, ok := s.contexes[name]; ok {
+		return dc, nil
+	}
+	if !ctxutil.ValidNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
 	path := filepath.Join(s.path, name)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		if err := os.MkdirAll(path, 0700); err != nil {
 			return nil, err
 		}
 	}
+
+	// The blobs of a fork are read from its parent namespace (loaded first)
+	readSrc := s.rootDataContext.bs
+	var parent string
+	if data, err := ioutil.ReadFile(filepath.Join(path, parentFilename)); err == nil {
+		parent = strings.TrimSpace(string(data))
+		visited[name] = true
+		if parent == "" || visited[parent] {
+			return nil, fmt.Errorf("invalid parent %q for namespace %q (forks loop)", parent, name)
+		}
+		parentDataContext, err := s.newDataContext(parent, visited)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the parent of namespace %q: %v", name, err)
+		}
+		readSrc = parentDataContext.bsProxy
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	l := s.rootDataContext.log.New("data_ctx", name)
 	h := hub.New(l.New("app", "hub"), false)
 	m, err := meta.New(l.New("app", "meta"), h)
@@ -272,9 +388,13 @@ func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	// In caching proxy mode, the namespace is proxied to the same namespace on the upstream
+	if err := bsDst.ProxyUpstream(s.rootBlobStore, name, filepath.Join(path, "upstream.queue")); err != nil {
+		return nil, err
+	}
 	bs := &store.BlobStoreProxy{
 		BlobStore: bsDst,
-		ReadSrc:   s.rootDataContext.bs,
+		ReadSrc:   readSrc,
 	}
 	kvsDst, err := kvstore.New(l.New("app", "kvstore"), path, bs, m)
 	if err != nil {
@@ -294,12 +414,156 @@ func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 		kvsProxy: kvs,
 		bsProxy:  bs,
 		dir:      path,
+		parent:   parent,
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(path, expiryFilename)); err == nil {
+		dataCtx.expiresAt, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration date for namespace %q: %v", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := dataCtx.loadLastWrite(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load the last write of namespace %q: %v", name, err)
+	}
+	for _, loaded := range s.loaded {
+		loaded(name, h)
 	}
 	s.contexes[name] = dataCtx
 	return dataCtx, nil
 }
 
+// SetExpiry sets the expiration date (Unix timestamp) of the namespace, 0 removes it
+func (s *Stash) SetExpiry(name string, expiresAt int64) error {
+	if name == "" {
+		return fmt.Errorf("the root namespace cannot expire")
+	}
+	s.Lock()
+	defer s.Unlock()
+	dc, ok := s.contexes[name]
+	if !ok {
+		return fmt.Errorf("namespace %q not found", name)
+	}
+	path := filepath.Join(dc.dir, expiryFilename)
+	if expiresAt == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := ioutil.WriteFile(path, []byte(strconv.FormatInt(expiresAt, 10)), 0600); err != nil {
+			return err
+		}
+	}
+	dc.expiresAt = expiresAt
+	return nil
+}
+
+// Expiry returns the expiration date (Unix timestamp) of the namespace, 0 if it does not expire
+func (s *Stash) Expiry(name string) int64 {
+	s.Lock()
+	defer s.Unlock()
+	if dc, ok := s.contexes[name]; ok {
+		return dc.expiresAt
+	}
+	return 0
+}
+
+// Expired returns true if the namespace exists and is expired
+func (s *Stash) Expired(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	dc, ok := s.contexes[name]
+	return ok && dc.Expired(time.Now())
+}
+
+// PurgeExpired destroys the namespaces expired for longer than the retention, and returns their names
+func (s *Stash) PurgeExpired(retention time.Duration) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	purged := []string{}
+	for name, dc := range s.contexes {
+		if !dc.Expired(now.Add(-retention)) {
+			continue
+		}
+		if err := s.destroy(dc, name); err == ErrRetentionLocked || err == ErrHasForks {
+			// Will be purged once the lock is over (or the forks are gone)
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		purged = append(purged, name)
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
+
+// SetExpiredRetention sets the delay after the expiration of a namespace before its data is destroyed by the expiry
+// worker (0 keeps the data until the namespace is deleted)
+func (s *Stash) SetExpiredRetention(retention time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.expiredRetention = retention
+}
+
+// ExpiredRetention returns the delay after the expiration of a namespace before its data is destroyed
+func (s *Stash) ExpiredRetention() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.expiredRetention
+}
+
+// SetExportsRetention sets the delay before the export archives are removed by the expiry worker (0 keeps them)
+func (s *Stash) SetExportsRetention(retention time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.exportsRetention = retention
+}
+
+// ExportsRetention returns the delay before the export archives are removed
+func (s *Stash) ExportsRetention() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.exportsRetention
+}
+
+// StartExpiryWorker periodically destroys the namespaces expired for longer than the retention (see
+// `SetExpiredRetention`), and removes the old export archives (see `SetExportsRetention`)
+func (s *Stash) StartExpiryWorker(logger log.Logger) {
+	go func() {
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+		for {
+			if retention := s.ExpiredRetention(); retention > 0 {
+				purged, err := s.PurgeExpired(retention)
+				if err != nil {
+					logger.Error("failed to purge the expired namespaces", "err", err)
+				}
+				if len(purged) > 0 {
+					logger.Info("expired namespaces purged", "namespaces", purged)
+				}
+			}
+			if retention := s.ExportsRetention(); retention > 0 {
+				purged, err := s.PurgeExports(retention)
+				if err != nil {
+					logger.Error("failed to purge the export archives", "err", err)
+				}
+				if len(purged) > 0 {
+					logger.Info("export archives purged", "exports", purged)
+				}
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
 func (s *Stash) Close() error {
+	close(s.stop)
 	s.rootDataContext.Close()
 	s.Lock()
 	defer s.Unlock()
@@ -350,9 +614,14 @@ func (s *Stash) MergeFileTreeVersionAndDestroy(ctx context.Context, name string,
 
 	var blobsCnt int
 	var totalSize uint64
+	// The blobs of a fork may live in its parent namespace
+	src := dc.StashBlobStore()
+	if dc.parent != "" {
+		src = dc.BlobStoreProxy()
+	}
 	for _, ref := range refs.refs {
 		// Get the marked blob from the blobstore proxy
-		data, err := dc.StashBlobStore().Get(ctx, ref)
+		data, err := src.Get(ctx, ref)
 		if err != nil {
 			if err == blobsfile.ErrBlobNotFound {
 				continue
@@ -399,6 +668,72 @@ func (s *Stash) MergeAndDestroy(ctx context.Context, name string) error {
 	return nil
 }
 
+// Fork creates the `dst` namespace as a copy of the `src` namespace (the root namespace is "").
+//
+// Namespaces are layered on top of the root one, so forking the root namespace only creates an empty namespace (all
+// the metadata and blobs are shared). Forking another namespace only copies the meta blobs of its layer (the kv
+// entries are restored from them), the data blobs are read from the source namespace (which cannot be destroyed
+// while it has forks, and merging the fork merges it into the source namespace). Returns the number of copied blobs.
+func (s *Stash) Fork(ctx context.Context, src, dst string) (int, error) {
+	if dst == "" {
+		return 0, fmt.Errorf("cannot fork into the root namespace")
+	}
+	if !ctxutil.ValidNamespace(dst) {
+		return 0, ErrInvalidNamespace
+	}
+	srcDataContext, ok := s.DataContextByName(src)
+	if !ok {
+		return 0, fmt.Errorf("namespace %q not found", src)
+	}
+	if _, exists := s.DataContextByName(dst); exists {
+		return 0, fmt.Errorf("namespace %q already exists", dst)
+	}
+
+	if !srcDataContext.root {
+		path := filepath.Join(s.path, dst)
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return 0, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, parentFilename), []byte(src), 0600); err != nil {
+			return 0, err
+		}
+	}
+	dstDataContext, err := s.NewDataContext(dst)
+	if err != nil {
+		return 0, err
+	}
+	if srcDataContext.root {
+		return 0, nil
+	}
+
+	blobs, _, err := srcDataContext.bs.Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return 0, err
+	}
+	var cnt int
+	for _, blobRef := range blobs {
+		data, err := srcDataContext.bs.Get(ctx, blobRef.Hash)
+		if err != nil {
+			return 0, err
+		}
+		b := &blob.Blob{Hash: blobRef.Hash, Data: data}
+		if !b.IsMeta() {
+			continue
+		}
+		// Meta blobs will trigger the hub event and be applied to the new namespace kv store
+		if _, err := dstDataContext.bs.Put(ctx, b); err != nil {
+			return 0, err
+		}
+		cnt++
+	}
+	// The meta blobs were applied to the kvstore directly
+	if err := dstDataContext.scanLastWrite(ctx); err != nil {
+		return 0, err
+	}
+
+	return cnt, nil
+}
+
 func (s *Stash) Destroy(ctx context.Context, name string) error {
 	s.Lock()
 	defer s.Unlock()
@@ -417,8 +752,11 @@ func (s *Stash) Destroy(ctx context.Context, name string) error {
 func (s *Stash) dataContext(ctx context.Context) (*dataContext, error) {
 	// TODO(tsileo): handle destroyed context
 	name, _ := ctxutil.Namespace(ctx)
-	if ctx, ok := s.DataContextByName(name); ok {
-		return ctx, nil
+	if dc, ok := s.DataContextByName(name); ok {
+		if dc.Expired(time.Now()) {
+			return nil, ErrNamespaceExpired
+		}
+		return dc, nil
 	}
 
 	// If it does not exist, create it now
@@ -450,6 +788,30 @@ func (s *Stash) DataContextByName(name string) (*dataContext, bool) {
 	return nil, false
 }
 
+// BlobStoreStats returns the BlobStore stats for each namespace (the root namespace name is "")
+func (s *Stash) BlobStoreStats() (map[string]*blobsfile.Stats, error) {
+	s.Lock()
+	dcs := map[string]*dataContext{"": s.rootDataContext}
+	for name, dc := range s.contexes {
+		dcs[name] = dc
+	}
+	s.Unlock()
+
+	out := map[string]*blobsfile.Stats{}
+	for name, dc := range dcs {
+		bs, ok := dc.bs.(*blobstore.BlobStore)
+		if !ok || dc.closed {
+			continue
+		}
+		stats, err := bs.Stats()
+		if err != nil {
+			return nil, err
+		}
+		out[name] = stats
+	}
+	return out, nil
+}
+
 func (s *Stash) BlobStore() *BlobStore {
 	return &BlobStore{s}
 }
@@ -509,7 +871,30 @@ func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, versio
 	if err != nil {
 		return nil, err
 	}
-	return dataContext.KvStoreProxy().Put(ctx, key, ref, data, version)
+	res, err := dataContext.KvStoreProxy().Put(ctx, key, ref, data, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := dataContext.recordWrite(res.Version); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (kv *KvStore) PutBatch(ctx context.Context, kvs []*vkv.KeyValue) error {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := dataContext.KvStoreProxy().PutBatch(ctx, kvs); err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := dataContext.recordWrite(kv.Version); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (kv *KvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
@@ -551,3 +936,39 @@ func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int
 	}
 	return dataContext.KvStoreProxy().ReverseKeys(ctx, start, end, limit)
 }
+
+func (kv *KvStore) DeleteVersion(ctx context.Context, key string, version int64) error {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return err
+	}
+	return dataContext.KvStoreProxy().DeleteVersion(ctx, key, version)
+}
+
+func (kv *KvStore) Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := dataContext.KvStoreProxy().Delete(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := dataContext.recordWrite(res.Version); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Compact purges the dead versions of the namespace kvstore (see `kvstore.KvStore.Compact`)
+func (kv *KvStore) Compact(ctx context.Context) (int, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	compacter, ok := dataContext.KvStore().(interface{ Compact() (int, error) })
+	if !ok {
+		return 0, fmt.Errorf("the kvstore of the namespace cannot be compacted")
+	}
+	return compacter.Compact()
+}
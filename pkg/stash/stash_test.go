@@ -1,15 +1,23 @@
 package stash
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/kvstore"
@@ -105,3 +113,529 @@ func TestDataContextMerge(t *testing.T) {
 	}
 
 }
+
+func TestFork(t *testing.T) {
+	dir := "stashforktest"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashforktest2"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+	}()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { s.Close() }()
+
+	ctx := context.Background()
+	src, err := s.NewDataContext("src")
+	if err != nil {
+		panic(err)
+	}
+	b := makeBlob([]byte("hello"))
+	if _, err := src.BlobStoreProxy().Put(ctx, b); err != nil {
+		panic(err)
+	}
+	if _, err := src.KvStoreProxy().Put(ctx, "k1", b.Hash, []byte("v1"), -1); err != nil {
+		panic(err)
+	}
+
+	if _, err := s.Fork(ctx, "src", "src"); err == nil {
+		t.Errorf("forking into an existing namespace should fail")
+	}
+	// The names escaping the stash dir are rejected
+	for _, name := range []string{"../escape", "a/b", "..", "."} {
+		if _, err := s.Fork(ctx, "src", name); err != ErrInvalidNamespace {
+			t.Errorf("forking into %q: expected ErrInvalidNamespace, got %v", name, err)
+		}
+		if _, err := s.NewDataContext(name); err != ErrInvalidNamespace {
+			t.Errorf("loading %q: expected ErrInvalidNamespace, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat("escape"); !os.IsNotExist(err) {
+		t.Errorf("a namespace was created outside the stash dir")
+	}
+	copied, err := s.Fork(ctx, "src", "dst")
+	if err != nil {
+		panic(err)
+	}
+	// Only the meta blob is copied
+	if copied != 1 {
+		t.Errorf("expected 1 blob to be copied, got %d", copied)
+	}
+	dst, ok := s.DataContextByName("dst")
+	if !ok {
+		t.Fatalf("forked namespace not found")
+	}
+	kv, err := dst.KvStoreProxy().Get(ctx, "k1", -1)
+	if err != nil {
+		panic(err)
+	}
+	if string(kv.Data) != "v1" || kv.HexHash() != b.Hash {
+		t.Errorf("unexpected forked kv %+v", kv)
+	}
+	data, err := dst.BlobStoreProxy().Get(ctx, b.Hash)
+	if err != nil {
+		panic(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("unexpected forked blob %q", data)
+	}
+
+	// The source namespace is left untouched by the changes in the fork
+	if _, err := dst.KvStoreProxy().Put(ctx, "k1", "", []byte("v2"), -1); err != nil {
+		panic(err)
+	}
+	kv, err = src.KvStoreProxy().Get(ctx, "k1", -1)
+	if err != nil {
+		panic(err)
+	}
+	if string(kv.Data) != "v1" {
+		t.Errorf("fork changes leaked into the source namespace: %+v", kv)
+	}
+
+	// The data blob is not copied, it is read from the source namespace
+	if exists, err := dst.StashBlobStore().Stat(ctx, b.Hash); err != nil || exists {
+		t.Errorf("the data blob should not be copied into the fork")
+	}
+	if err := s.Destroy(ctx, "src"); err != ErrHasForks {
+		t.Errorf("expected ErrHasForks, got %v", err)
+	}
+
+	// The fork still reads from its source after a restart
+	s.Close()
+	s, err = New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	dst, ok = s.DataContextByName("dst")
+	if !ok {
+		t.Fatalf("forked namespace not found after a restart")
+	}
+	if data, err := dst.BlobStoreProxy().Get(ctx, b.Hash); err != nil || string(data) != "hello" {
+		t.Errorf("unexpected forked blob after a restart %q (%v)", data, err)
+	}
+
+	// Parent files forming a loop are rejected instead of recursing forever
+	for name, parent := range map[string]string{"self": "self", "loop1": "loop2", "loop2": "loop1"} {
+		if err := os.MkdirAll(filepath.Join(dir2, name), 0700); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir2, name, parentFilename), []byte(parent), 0600); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := s.NewDataContext("self"); err == nil {
+		t.Errorf("a namespace forked from itself should fail to load")
+	}
+	if _, err := s.NewDataContext("loop1"); err == nil {
+		t.Errorf("namespaces forked from each other should fail to load")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := "stashexpirytest"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashexpirytest2"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+	}()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	if _, err := s.NewDataContext("project"); err != nil {
+		panic(err)
+	}
+	ctx := ctxutil.WithNamespace(context.Background(), "project")
+	b := makeBlob([]byte("hello"))
+	if _, err := s.BlobStore().Put(ctx, b); err != nil {
+		panic(err)
+	}
+
+	if err := s.SetExpiry("project", time.Now().Add(-2*time.Hour).Unix()); err != nil {
+		panic(err)
+	}
+	if !s.Expired("project") {
+		t.Errorf("namespace should be expired")
+	}
+	if _, err := s.BlobStore().Get(ctx, b.Hash); err != ErrNamespaceExpired {
+		t.Errorf("expected ErrNamespaceExpired, got %v", err)
+	}
+	if _, err := s.KvStore().Put(ctx, "k", "", []byte("v"), -1); err != ErrNamespaceExpired {
+		t.Errorf("expected ErrNamespaceExpired, got %v", err)
+	}
+
+	// The expiration date is persisted
+	if err := s.contexes["project"].Close(); err != nil {
+		panic(err)
+	}
+	delete(s.contexes, "project")
+	if _, err := s.NewDataContext("project"); err != nil {
+		panic(err)
+	}
+	if !s.Expired("project") {
+		t.Errorf("the expiration date should be reloaded")
+	}
+
+	// Still within the retention
+	purged, err := s.PurgeExpired(3 * time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("unexpected purged namespaces %v", purged)
+	}
+	purged, err = s.PurgeExpired(time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if fmt.Sprintf("%v", purged) != "[project]" {
+		t.Errorf("unexpected purged namespaces %v", purged)
+	}
+	if _, ok := s.DataContextByName("project"); ok {
+		t.Errorf("the expired namespace should be destroyed")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir := "stashdeletetest"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashdeletetest2"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+		os.RemoveAll(dir2 + "_exports")
+	}()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	if _, err := s.NewDataContext("project"); err != nil {
+		panic(err)
+	}
+	ctx := ctxutil.WithNamespace(context.Background(), "project")
+	b := makeBlob([]byte("hello"))
+	if _, err := s.BlobStore().Put(ctx, b); err != nil {
+		panic(err)
+	}
+	if _, err := s.KvStore().Put(ctx, "k", b.Hash, nil, -1); err != nil {
+		panic(err)
+	}
+
+	deletion, err := s.Delete(context.Background(), "project", time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	// The blob, and the meta blob of the key
+	if deletion.Blobs != 2 || deletion.Keys != 1 || deletion.PurgeAfter == 0 {
+		t.Errorf("unexpected deletion %+v", deletion)
+	}
+	if !s.Expired("project") {
+		t.Errorf("the deleted namespace should be expired")
+	}
+	dc, _ := s.DataContextByName("project")
+	if _, err := dc.kvs.Get(context.Background(), "k", -1); err == nil {
+		t.Errorf("the key should be tombstoned")
+	}
+	if _, err := s.Delete(context.Background(), "project", time.Hour); err != ErrNamespaceExpired {
+		t.Errorf("expected ErrNamespaceExpired, got %v", err)
+	}
+
+	exports, err := s.Exports()
+	if err != nil {
+		panic(err)
+	}
+	if len(exports) != 1 || exports[0] != deletion.Export {
+		t.Errorf("unexpected exports %v", exports)
+	}
+	f, err := s.OpenExport(deletion.Export)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		panic(err)
+	}
+	tr := tar.NewReader(gr)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			panic(err)
+		}
+		files[hdr.Name] = data
+	}
+	if string(files["blobs/"+b.Hash]) != "hello" {
+		t.Errorf("the blob should be exported")
+	}
+	manifest := &ExportManifest{}
+	if err := json.Unmarshal(files["manifest.json"], manifest); err != nil {
+		panic(err)
+	}
+	if len(manifest.Keys) != 1 || manifest.Keys[0].Key != "k" || manifest.Keys[0].Hash != b.Hash {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	if _, err := s.OpenExport("../" + deletion.Export); err != ErrExportNotFound {
+		t.Errorf("expected ErrExportNotFound, got %v", err)
+	}
+	if _, err := s.Delete(context.Background(), "a/b", time.Hour); err != ErrInvalidExportName {
+		t.Errorf("expected ErrInvalidExportName, got %v", err)
+	}
+
+	// The archives are removed once the retention is over
+	purged, err := s.PurgeExports(time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("the recent archives should be kept, got %q", purged)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(s.exportsDir(), deletion.Export+".tar.gz"), old, old); err != nil {
+		panic(err)
+	}
+	purged, err = s.PurgeExports(time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if len(purged) != 1 || purged[0] != deletion.Export {
+		t.Errorf("unexpected purged archives %q", purged)
+	}
+	if _, err := s.OpenExport(deletion.Export); err != ErrExportNotFound {
+		t.Errorf("expected ErrExportNotFound, got %v", err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	dir := "stashdumptest"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashdumptest2"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+	}()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	if _, err := s.NewDataContext("src"); err != nil {
+		panic(err)
+	}
+	ctx := ctxutil.WithNamespace(context.Background(), "src")
+	for i := 0; i < 10; i++ {
+		if _, err := s.KvStore().Put(ctx, fmt.Sprintf("k%d", i), "", []byte(fmt.Sprintf("v%d", i)), int64(i+1)); err != nil {
+			panic(err)
+		}
+	}
+
+	dump, err := s.Dump(context.Background(), "src")
+	if err != nil {
+		panic(err)
+	}
+	if dump.Keys != 10 || len(dump.Pages) != 1 || dump.Ref == "" {
+		t.Errorf("unexpected dump %+v", dump)
+	}
+
+	if _, err := s.Restore(context.Background(), "src", dump.Ref); err != ErrNamespaceNotEmpty {
+		t.Errorf("expected ErrNamespaceNotEmpty, got %v", err)
+	}
+	if _, err := s.Restore(context.Background(), "dst", dump.Pages[0]); err == nil {
+		t.Errorf("restoring a dump page should fail")
+	}
+
+	if _, err := s.Restore(context.Background(), "dst", dump.Ref); err != nil {
+		panic(err)
+	}
+	dc, ok := s.DataContextByName("dst")
+	if !ok {
+		t.Fatalf("the namespace should have been created")
+	}
+	for i := 0; i < 10; i++ {
+		kv, err := dc.kvs.Get(context.Background(), fmt.Sprintf("k%d", i), -1)
+		if err != nil {
+			panic(err)
+		}
+		if string(kv.Data) != fmt.Sprintf("v%d", i) || kv.Version != int64(i+1) {
+			t.Errorf("unexpected restored key %+v", kv)
+		}
+	}
+}
+
+func TestRetentionLock(t *testing.T) {
+	dir := "stashlocktest"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashlocktest2"
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+		os.RemoveAll(dir2 + "_exports")
+	}()
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	hub := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	s.SetRetentionLocks(map[string]int{"recent": 7, "old": 7})
+
+	now := time.Now()
+	for name, version := range map[string]int64{
+		"recent":   now.Add(-24 * time.Hour).UnixNano(),
+		"old":      now.Add(-10 * 24 * time.Hour).UnixNano(),
+		"unlocked": now.UnixNano(),
+	} {
+		if _, err := s.NewDataContext(name); err != nil {
+			panic(err)
+		}
+		ctx := ctxutil.WithNamespace(context.Background(), name)
+		if _, err := s.KvStore().Put(ctx, "k", "", []byte("v"), version); err != nil {
+			panic(err)
+		}
+	}
+
+	until, err := s.RetentionLockedUntil(context.Background(), "recent")
+	if err != nil {
+		panic(err)
+	}
+	if expected := now.Add(6 * 24 * time.Hour).Unix(); until < expected-1 || until > expected+1 {
+		t.Errorf("unexpected lock date %d, expected %d", until, expected)
+	}
+	// The lock is persisted along with the namespace (rounded up to the minute)
+	saved := &dataContext{dir: filepath.Join(dir2, "recent")}
+	if err := saved.loadLastWrite(context.Background()); err != nil {
+		panic(err)
+	}
+	if savedUntil := saved.lockedUntil(7 * 24 * time.Hour); savedUntil < until || savedUntil > until+60 {
+		t.Errorf("unexpected saved lock date %d, expected %d", savedUntil, until)
+	}
+	if _, err := s.Delete(context.Background(), "recent", 0); err != ErrRetentionLocked {
+		t.Errorf("expected ErrRetentionLocked, got %v", err)
+	}
+	if err := s.Destroy(context.Background(), "recent"); err != ErrRetentionLocked {
+		t.Errorf("expected ErrRetentionLocked, got %v", err)
+	}
+	if err := s.SetExpiry("recent", now.Add(-2*time.Hour).Unix()); err != nil {
+		panic(err)
+	}
+	purged, err := s.PurgeExpired(time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("the locked namespace should not be purged, got %v", purged)
+	}
+
+	// The versions are older than the lock
+	if err := s.Destroy(context.Background(), "old"); err != nil {
+		t.Errorf("failed to destroy the namespace: %v", err)
+	}
+	if err := s.Destroy(context.Background(), "unlocked"); err != nil {
+		t.Errorf("failed to destroy the namespace: %v", err)
+	}
+}
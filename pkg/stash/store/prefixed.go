@@ -0,0 +1,117 @@
+package store // import "a4.io/blobstash/pkg/stash/store"
+
+import (
+	"context"
+	"strings"
+
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// PrefixedKvStore scopes a KvStore to the keys starting with the given prefix, the prefix is transparently added to
+// (and stripped from) the keys, so the users only see their own keys
+type PrefixedKvStore struct {
+	kvs    KvStore
+	prefix string
+}
+
+// NewPrefixedKvStore returns a KvStore scoped to `prefix`
+func NewPrefixedKvStore(kvs KvStore, prefix string) *PrefixedKvStore {
+	return &PrefixedKvStore{kvs, prefix}
+}
+
+func (p *PrefixedKvStore) strip(kv *vkv.KeyValue) *vkv.KeyValue {
+	if kv == nil {
+		return nil
+	}
+	nkv := *kv
+	nkv.Key = strings.TrimPrefix(kv.Key, p.prefix)
+	return &nkv
+}
+
+func (p *PrefixedKvStore) stripAll(kvs []*vkv.KeyValue) []*vkv.KeyValue {
+	out := make([]*vkv.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		out = append(out, p.strip(kv))
+	}
+	return out
+}
+
+func (p *PrefixedKvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	kv, err := p.kvs.Put(ctx, p.prefix+key, ref, data, version)
+	return p.strip(kv), err
+}
+
+func (p *PrefixedKvStore) PutBatch(ctx context.Context, kvs []*vkv.KeyValue) error {
+	pkvs := make([]*vkv.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		nkv := *kv
+		nkv.Key = p.prefix + kv.Key
+		pkvs = append(pkvs, &nkv)
+	}
+	return p.kvs.PutBatch(ctx, pkvs)
+}
+
+func (p *PrefixedKvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	kv, err := p.kvs.Get(ctx, p.prefix+key, version)
+	return p.strip(kv), err
+}
+
+func (p *PrefixedKvStore) GetMetaBlob(ctx context.Context, key string, version int64) (string, error) {
+	return p.kvs.GetMetaBlob(ctx, p.prefix+key, version)
+}
+
+func (p *PrefixedKvStore) Versions(ctx context.Context, key, start string, limit int) (*vkv.KeyValueVersions, string, error) {
+	res, cursor, err := p.kvs.Versions(ctx, p.prefix+key, start, limit)
+	if err != nil || res == nil {
+		return res, cursor, err
+	}
+	return &vkv.KeyValueVersions{Key: key, Versions: p.stripAll(res.Versions)}, cursor, nil
+}
+
+// bounds returns the prefixed range, an empty end means the end of the prefix.
+//
+// The cursors returned by Keys/ReverseKeys are opaque (they may be merge cursors when a stash is involved) and are
+// passed as is.
+func (p *PrefixedKvStore) bounds(start, end string) (string, string) {
+	if end == "" {
+		end = "\xff"
+	}
+	if !strings.HasPrefix(start, "stash:") && !strings.HasPrefix(start, p.prefix) {
+		start = p.prefix + start
+	}
+	return start, p.prefix + end
+}
+
+func (p *PrefixedKvStore) Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
+	pstart, pend := p.bounds(start, end)
+	kvs, cursor, err := p.kvs.Keys(ctx, pstart, pend, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return p.stripAll(kvs), cursor, nil
+}
+
+func (p *PrefixedKvStore) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
+	pstart, pend := p.bounds(start, end)
+	kvs, cursor, err := p.kvs.ReverseKeys(ctx, pstart, pend, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return p.stripAll(kvs), cursor, nil
+}
+
+func (p *PrefixedKvStore) DeleteVersion(ctx context.Context, key string, version int64) error {
+	return p.kvs.DeleteVersion(ctx, p.prefix+key, version)
+}
+
+func (p *PrefixedKvStore) Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	kv, err := p.kvs.Delete(ctx, p.prefix+key, version)
+	return p.strip(kv), err
+}
+
+// Close is a no-op, the underlying KvStore is shared
+func (p *PrefixedKvStore) Close() error {
+	return nil
+}
+
+var _ KvStore = (*PrefixedKvStore)(nil)
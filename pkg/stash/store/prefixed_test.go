@@ -0,0 +1,68 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestPrefixedKvStore(t *testing.T) {
+	env := testutil.New(t, "prefixed_kvstore_test")
+	defer env.Close()
+	kvs := env.KvStore
+
+	ctx := context.Background()
+	_, err := kvs.Put(ctx, "other", "", []byte("nope"), -1)
+	check(err)
+	pkvs := store.NewPrefixedKvStore(kvs, "_apps:test:")
+	for _, k := range []string{"a", "b", "c"} {
+		kv, err := pkvs.Put(ctx, k, "", []byte("data-"+k), -1)
+		check(err)
+		if kv.Key != k {
+			t.Errorf("expected key %q, got %q", k, kv.Key)
+		}
+	}
+
+	kv, err := kvs.Get(ctx, "_apps:test:b", -1)
+	check(err)
+	if string(kv.Data) != "data-b" {
+		t.Errorf("unexpected data %q", kv.Data)
+	}
+	kv, err = pkvs.Get(ctx, "b", -1)
+	check(err)
+	if kv.Key != "b" || string(kv.Data) != "data-b" {
+		t.Errorf("unexpected kv %+v", kv)
+	}
+
+	keys, _, err := pkvs.Keys(ctx, "", "", 0)
+	check(err)
+	if len(keys) != 3 || keys[0].Key != "a" || keys[2].Key != "c" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	// Paginate using the cursor
+	keys, cursor, err := pkvs.Keys(ctx, "", "", 2)
+	check(err)
+	if len(keys) != 2 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	keys, _, err = pkvs.Keys(ctx, cursor, "", 2)
+	check(err)
+	if len(keys) != 1 || keys[0].Key != "c" {
+		t.Errorf("unexpected second page %+v", keys)
+	}
+
+	versions, _, err := pkvs.Versions(ctx, "a", "0", 0)
+	check(err)
+	if versions.Key != "a" || len(versions.Versions) != 1 || versions.Versions[0].Key != "a" {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+}
@@ -80,11 +80,14 @@ type DataContext interface {
 
 type KvStore interface {
 	Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error)
+	PutBatch(ctx context.Context, kvs []*vkv.KeyValue) error
 	Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error)
 	GetMetaBlob(ctx context.Context, key string, version int64) (string, error)
 	Versions(ctx context.Context, key, start string, limit int) (*vkv.KeyValueVersions, string, error)
 	Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error)
 	ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error)
+	DeleteVersion(ctx context.Context, key string, version int64) error
+	Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error)
 	Close() error
 }
 
@@ -125,6 +128,23 @@ func (p *KvStoreProxy) Get(ctx context.Context, key string, version int64) (*vkv
 			}
 		}
 	case vkv.ErrNotFound:
+		// The key may have been deleted in the stash, a tombstone more recent than the root version hides it
+		if version <= 0 {
+			kvv, _, verr := p.KvStore.Versions(ctx, key, "0", 1)
+			if verr != nil && verr != vkv.ErrNotFound {
+				return nil, verr
+			}
+			if verr == nil && len(kvv.Versions) > 0 && kvv.Versions[0].Tombstone {
+				rkv, rerr := p.ReadSrc.Get(ctx, key, version)
+				if rerr != nil {
+					return nil, rerr
+				}
+				if rkv.Version < kvv.Versions[0].Version {
+					return nil, vkv.ErrNotFound
+				}
+				return rkv, nil
+			}
+		}
 		return p.ReadSrc.Get(ctx, key, version)
 	default:
 		return nil, err
@@ -132,6 +152,27 @@ func (p *KvStoreProxy) Get(ctx context.Context, key string, version int64) (*vkv
 	return kv, nil
 }
 
+func (p *KvStoreProxy) Delete(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
+	kv, err := p.KvStore.Delete(ctx, key, version)
+	switch err {
+	case nil:
+		return kv, nil
+	case vkv.ErrNotFound:
+		// The key may only exist in the root kv store, copy its latest version in the stash so the tombstone can be
+		// written on top of it (it will be applied to the root on merge)
+		rkv, err := p.Get(ctx, key, -1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.KvStore.Put(ctx, key, rkv.HexHash(), rkv.Data, rkv.Version); err != nil {
+			return nil, err
+		}
+		return p.KvStore.Delete(ctx, key, version)
+	default:
+		return nil, err
+	}
+}
+
 func (p *KvStoreProxy) GetMetaBlob(ctx context.Context, key string, version int64) (string, error) {
 	h, err := p.KvStore.GetMetaBlob(ctx, key, version)
 	switch err {
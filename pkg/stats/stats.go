@@ -0,0 +1,189 @@
+/*
+
+Package stats implements daily rollups of the blobs count/size per namespace, for capacity trending.
+
+The rollups are stored as versions of the `_stats:history:<namespace>` key (one version per day).
+
+*/
+package stats // import "a4.io/blobstash/pkg/stats"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// HistoryKeyFmt is the key holding the daily rollups of a namespace
+var HistoryKeyFmt = "_stats:history:%s"
+
+const dayFmt = "2006-01-02"
+
+// Point holds the rollup for a single day
+type Point struct {
+	Day        string `json:"day" msgpack:"d"`
+	Time       int64  `json:"time" msgpack:"t"`
+	BlobsCount int    `json:"blobs_count" msgpack:"bc"`
+	BlobsSize  int64  `json:"blobs_size" msgpack:"bs"`
+}
+
+// Stats records the daily rollups
+type Stats struct {
+	kvStore   store.KvStore
+	statsFunc func() (map[string]*blobsfile.Stats, error)
+
+	stop chan struct{}
+	log  log.Logger
+}
+
+// New initializes the rollups recording, `statsFunc` returns the current BlobStore stats for each namespace
+func New(logger log.Logger, kvStore store.KvStore, statsFunc func() (map[string]*blobsfile.Stats, error)) *Stats {
+	logger.Debug("init")
+	s := &Stats{
+		kvStore:   kvStore,
+		statsFunc: statsFunc,
+		stop:      make(chan struct{}),
+		log:       logger,
+	}
+	go s.worker()
+	return s
+}
+
+// Close stops the rollup worker
+func (s *Stats) Close() error {
+	close(s.stop)
+	return nil
+}
+
+func (s *Stats) worker() {
+	log := s.log.New("worker", "rollup_worker")
+	log.Debug("starting worker")
+	if err := s.Rollup(time.Now()); err != nil {
+		log.Error("rollup failed", "err", err)
+	}
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			log.Debug("worker stopped")
+			return
+		case <-t.C:
+			if err := s.Rollup(time.Now()); err != nil {
+				log.Error("rollup failed", "err", err)
+			}
+		}
+	}
+}
+
+// Rollup records the stats for each namespace, unless a point is already recorded for the current day
+func (s *Stats) Rollup(now time.Time) error {
+	stats, err := s.statsFunc()
+	if err != nil {
+		return err
+	}
+	day := now.UTC().Format(dayFmt)
+	for ns, st := range stats {
+		key := fmt.Sprintf(HistoryKeyFmt, ns)
+		last, err := s.kvStore.Get(context.Background(), key, -1)
+		switch err {
+		case nil:
+			if time.Unix(0, last.Version).UTC().Format(dayFmt) == day {
+				continue
+			}
+		case vkv.ErrNotFound:
+		default:
+			return err
+		}
+
+		p := &Point{
+			Day:        day,
+			Time:       now.UnixNano(),
+			BlobsCount: st.BlobsCount,
+			BlobsSize:  st.BlobsSize,
+		}
+		encoded, err := msgpack.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if _, err := s.kvStore.Put(context.Background(), key, "", encoded, p.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the rollups more recent than `since` for the given namespace, sorted from the most recent one
+func (s *Stats) History(ns string, since int64) ([]*Point, error) {
+	out := []*Point{}
+	kvv, _, err := s.kvStore.Versions(context.Background(), fmt.Sprintf(HistoryKeyFmt, ns), "0", -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return out, nil
+	default:
+		return nil, err
+	}
+	for _, kv := range kvv.Versions {
+		if kv.Version < since {
+			break
+		}
+		p := &Point{}
+		if err := msgpack.Unmarshal(kv.Data, p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (s *Stats) historyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		ns := q.Get("namespace")
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Namespace),
+			perms.ResourceWithID(perms.Stash, perms.Namespace, ns),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		since, err := q.GetInt64Default("since", 0)
+		if err != nil {
+			panic(err)
+		}
+
+		points, err := s.History(ns, since)
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"namespace": ns,
+			"data":      points,
+		})
+	}
+}
+
+// Register registers the HTTP handlers
+func (s *Stats) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/history", basicAuth(http.HandlerFunc(s.historyHandler())))
+}
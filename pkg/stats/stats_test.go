@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/testutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	env := testutil.New(t, "stats_test")
+	defer env.Close()
+	logger, kvs := env.Log, env.KvStore
+
+	count := 10
+	s := &Stats{
+		kvStore: kvs,
+		statsFunc: func() (map[string]*blobsfile.Stats, error) {
+			return map[string]*blobsfile.Stats{
+				"":   &blobsfile.Stats{BlobsCount: count, BlobsSize: int64(count * 100)},
+				"ns": &blobsfile.Stats{BlobsCount: 1, BlobsSize: 100},
+			}, nil
+		},
+		log: logger,
+	}
+
+	day1 := time.Date(2020, time.January, 1, 10, 0, 0, 0, time.UTC)
+	check(s.Rollup(day1))
+	// Only one point per day is recorded
+	count = 20
+	check(s.Rollup(day1.Add(1 * time.Hour)))
+	check(s.Rollup(day1.AddDate(0, 0, 1)))
+
+	points, err := s.History("", 0)
+	check(err)
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, got %d", len(points))
+	}
+	if points[0].Day != "2020-01-02" || points[0].BlobsCount != 20 || points[1].Day != "2020-01-01" || points[1].BlobsCount != 10 {
+		t.Errorf("unexpected points %+v %+v", points[0], points[1])
+	}
+
+	points, err = s.History("ns", day1.AddDate(0, 0, 1).UnixNano())
+	check(err)
+	if len(points) != 1 || points[0].BlobsSize != 100 {
+		t.Errorf("unexpected points for ns: %+v", points)
+	}
+}
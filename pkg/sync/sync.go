@@ -19,9 +19,12 @@ import (
 	"hash"
 	"net/http"
 	"sync"
+	"time"
 
+	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/stash/store"
 
 	"github.com/gorilla/mux"
@@ -53,9 +56,22 @@ type Sync struct {
 	blobstore store.BlobStore
 	conf      *config.Config
 
+	// Outcome of the last sync
+	last   *SyncStatus
+	lastMu sync.Mutex
+
 	log log2.Logger
 }
 
+// SyncStatus holds the outcome of a sync run
+type SyncStatus struct {
+	URL        string     `json:"url"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Stats      *SyncStats `json:"stats,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
 func New(logger log2.Logger, conf *config.Config, blobstore store.BlobStore) *Sync {
 	logger.Debug("init")
 	return &Sync{
@@ -69,6 +85,7 @@ func (st *Sync) Register(r *mux.Router, basicAuth func(http.Handler) http.Handle
 	r.Handle("/state", basicAuth(http.HandlerFunc(st.stateHandler())))
 	r.Handle("/state/leaf/{prefix}", basicAuth(http.HandlerFunc(st.stateLeafHandler())))
 	r.Handle("/_trigger", basicAuth(http.HandlerFunc(st.triggerHandler())))
+	r.Handle("/_status", basicAuth(http.HandlerFunc(st.statusHandler())))
 }
 
 func (st *Sync) Client(url, apiKey string, oneWay bool) *SyncClient {
@@ -79,22 +96,84 @@ func (st *Sync) Client(url, apiKey string, oneWay bool) *SyncClient {
 func (st *Sync) Sync(url, apiKey string, oneWay bool) (*SyncStats, error) {
 	log := st.log.New("trigger_id", logext.RandId(6))
 	log.Info("Starting sync...", "url", url)
+	status := &SyncStatus{URL: url, StartedAt: time.Now()}
 	rawState := st.generateTree()
 	defer rawState.Close()
 	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, oneWay)
-	return client.Sync()
+	stats, err := client.Sync()
+	status.FinishedAt = time.Now()
+	status.Stats = stats
+	if err != nil {
+		status.Error = err.Error()
+	}
+	st.lastMu.Lock()
+	st.last = status
+	st.lastMu.Unlock()
+	return stats, err
+}
+
+// LastStatus returns the outcome of the last sync (nil if no sync was triggered since the start)
+func (st *Sync) LastStatus() *SyncStatus {
+	st.lastMu.Lock()
+	defer st.lastMu.Unlock()
+	return st.last
+}
+
+func (st *Sync) statusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// The status exposes the remote URLs, it requires the same perms as triggering a sync
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": st.LastStatus(),
+		})
+	}
+}
+
+// syncTrigger is the payload of the sync trigger endpoint
+type syncTrigger struct {
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	OneWay bool   `json:"one_way"`
 }
 
 func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		q := httputil.NewQuery(r.URL.Query())
-		url := q.Get("url")
-		apiKey := q.Get("api_key")
-		oneWay, err := q.GetBoolDefault("one_way", false)
-		if err != nil {
-			panic(err)
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// The remote API key is sent in the body, so it does not end up in the access logs
+		in := &syncTrigger{}
+		if err := httputil.Unmarshal(r, in); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if in.URL == "" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "missing url")
+			return
 		}
-		stats, err := st.Sync(url, apiKey, oneWay)
+		stats, err := st.Sync(in.URL, in.APIKey, in.OneWay)
 		if err != nil {
 			panic(err)
 		}
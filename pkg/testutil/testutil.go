@@ -0,0 +1,72 @@
+/*
+
+Package testutil implements the setup shared by the tests needing a root BlobStore and KvStore.
+
+*/
+package testutil // import "a4.io/blobstash/pkg/testutil"
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+)
+
+// Env holds a root BlobStore and KvStore stored in a temporary directory
+type Env struct {
+	Dir       string
+	Log       log.Logger
+	Hub       *hub.Hub
+	Meta      *meta.Meta
+	BlobStore *blobstore.BlobStore
+	KvStore   *kvstore.KvStore
+}
+
+// New sets up a new env (the logs are discarded), the test is stopped on error
+func New(t testing.TB, name string) *Env {
+	t.Helper()
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, h)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	bs, err := blobstore.New(logger, true, dir, nil, h)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	kvs, err := kvstore.New(logger, dir, bs, metaHandler)
+	if err != nil {
+		bs.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return &Env{
+		Dir:       dir,
+		Log:       logger,
+		Hub:       h,
+		Meta:      metaHandler,
+		BlobStore: bs,
+		KvStore:   kvs,
+	}
+}
+
+// Close closes the stores and removes the directory
+func (e *Env) Close() {
+	e.KvStore.Close()
+	e.BlobStore.Close()
+	os.RemoveAll(e.Dir)
+}
@@ -0,0 +1,299 @@
+/*
+
+Package usage implements the storage accounting (bytes and blobs count) per namespace, and the quotas.
+
+The counters are maintained from the hub events, each new blob is accounted to a single namespace:
+
+  - `docstore:<collection>` for the meta blobs of the docstore documents
+  - `filetree:<name>` for the meta blobs of the FS, and for the blobs uploaded via the filetree API
+  - `stash:<name>` for the blobs stored in a stash namespace (each namespace has its own BlobStore and hub, see
+    `WatchNamespace`)
+  - `root` for everything else
+
+Blobs are content addressed, a blob already stored is never accounted twice (it stays accounted to the first
+namespace that uploaded it). Blobs are only removed when a stash namespace is destroyed, its usage is then reset.
+
+Quotas are checked before saving a new blob, they are "soft" limits as concurrent uploads may slightly exceed them.
+
+*/
+package usage // import "a4.io/blobstash/pkg/usage"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// RootNamespace is the namespace of the blobs not accounted to any other namespace
+const RootNamespace = "root"
+
+// Key prefixes of the docstore documents and the filetree FS (see the `docstore` and `filetree` packages)
+const (
+	docstoreKeyPrefix = "docstore:"
+	filetreeKeyPrefix = "_filetree:fs:"
+)
+
+// QuotaExceededError is returned when saving a blob would exceed the quota of its namespace
+type QuotaExceededError struct {
+	Namespace string
+	Quota     int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for namespace %q (%d bytes)", e.Namespace, e.Quota)
+}
+
+// Status implements the `httputil.PublicErrorer` interface
+func (e *QuotaExceededError) Status() int {
+	return http.StatusInsufficientStorage
+}
+
+// IsQuotaExceeded returns true if the error (or the error it wraps) is a `QuotaExceededError`
+func IsQuotaExceeded(err error) bool {
+	var e *QuotaExceededError
+	return errors.As(err, &e)
+}
+
+// Usage holds the storage used by a namespace
+type Usage struct {
+	Namespace string `json:"namespace"`
+	Blobs     int64  `json:"blobs"`
+	Bytes     int64  `json:"bytes"`
+	Quota     int64  `json:"quota,omitempty"`
+}
+
+// Accounting maintains the usage of each namespace
+type Accounting struct {
+	db     *rangedb.RangeDB
+	quotas map[string]int64
+	usages map[string]*Usage
+
+	log log.Logger
+	sync.Mutex
+}
+
+// New loads the counters and subscribes to the hub events
+func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*Accounting, error) {
+	logger.Debug("init")
+	db, err := rangedb.New(filepath.Join(conf.VarDir(), "usage.index"))
+	if err != nil {
+		return nil, err
+	}
+	quotas := conf.Quotas
+	if quotas == nil {
+		quotas = map[string]int64{}
+	}
+	a := &Accounting{
+		db:     db,
+		quotas: quotas,
+		usages: map[string]*Usage{},
+		log:    logger,
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	h.Subscribe(hub.PutBlob, "usage", a.putBlobCallback)
+	h.Subscribe(hub.NewBlob, "usage", a.newBlobCallback)
+	return a, nil
+}
+
+// SetQuotas replaces the quotas (when the config is reloaded)
+func (a *Accounting) SetQuotas(quotas map[string]int64) {
+	if quotas == nil {
+		quotas = map[string]int64{}
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.quotas = quotas
+}
+
+// Close closes the counters DB
+func (a *Accounting) Close() error {
+	return a.db.Close()
+}
+
+func (a *Accounting) load() error {
+	it := a.db.PrefixRange([]byte(""), false)
+	defer it.Close()
+	k, v, err := it.Next()
+	for ; err == nil; k, v, err = it.Next() {
+		u := &Usage{}
+		if err := json.Unmarshal(v, u); err != nil {
+			return err
+		}
+		a.usages[string(k)] = u
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// namespaceOf returns the namespace the blob is accounted to
+func namespaceOf(ctx context.Context, blb *blob.Blob) (string, error) {
+	if metaType, data, isMeta := meta.IsMetaBlob(blb.Data); isMeta {
+		kvs, err := vkv.UnserializeMetaBlob(metaType, data)
+		if err != nil {
+			return "", err
+		}
+		// A batch may span several namespaces, it's accounted to the first key
+		if len(kvs) > 0 {
+			key := kvs[0].Key
+			switch {
+			case strings.HasPrefix(key, docstoreKeyPrefix):
+				col := strings.SplitN(key[len(docstoreKeyPrefix):], ":", 2)[0]
+				return "docstore:" + col, nil
+			case strings.HasPrefix(key, filetreeKeyPrefix):
+				return "filetree:" + key[len(filetreeKeyPrefix):], nil
+			}
+		}
+	}
+	if ns, ok := ctxutil.UsageNamespace(ctx); ok && ns != "" {
+		return ns, nil
+	}
+	return RootNamespace, nil
+}
+
+// WatchNamespace accounts the blobs saved in the BlobStore of the stash namespace (via its hub) to `stash:<name>`
+func (a *Accounting) WatchNamespace(name string, h *hub.Hub) {
+	ns := "stash:" + name
+	h.Subscribe(hub.PutBlob, "usage", func(_ context.Context, blb *blob.Blob, _ interface{}) error {
+		return a.checkQuota(ns, blb)
+	})
+	h.Subscribe(hub.NewBlob, "usage", func(_ context.Context, blb *blob.Blob, _ interface{}) error {
+		return a.add(ns, blb)
+	})
+}
+
+// ResetNamespace drops the usage of the destroyed stash namespace
+func (a *Accounting) ResetNamespace(name string) error {
+	ns := "stash:" + name
+	a.Lock()
+	defer a.Unlock()
+	delete(a.usages, ns)
+	return a.db.Delete([]byte(ns))
+}
+
+// putBlobCallback rejects the blob if it would exceed the quota of its namespace
+func (a *Accounting) putBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	ns, err := namespaceOf(ctx, blb)
+	if err != nil {
+		return err
+	}
+	return a.checkQuota(ns, blb)
+}
+
+func (a *Accounting) checkQuota(ns string, blb *blob.Blob) error {
+	a.Lock()
+	defer a.Unlock()
+	quota, ok := a.quotas[ns]
+	if !ok {
+		return nil
+	}
+	var used int64
+	if u, ok := a.usages[ns]; ok {
+		used = u.Bytes
+	}
+	if used+int64(len(blb.Data)) > quota {
+		return &QuotaExceededError{Namespace: ns, Quota: quota}
+	}
+	return nil
+}
+
+func (a *Accounting) newBlobCallback(ctx context.Context, blb *blob.Blob, _ interface{}) error {
+	ns, err := namespaceOf(ctx, blb)
+	if err != nil {
+		return err
+	}
+	return a.add(ns, blb)
+}
+
+func (a *Accounting) add(ns string, blb *blob.Blob) error {
+	a.Lock()
+	defer a.Unlock()
+	u, ok := a.usages[ns]
+	if !ok {
+		u = &Usage{Namespace: ns}
+		a.usages[ns] = u
+	}
+	u.Blobs++
+	u.Bytes += int64(len(blb.Data))
+	js, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return a.db.Set([]byte(ns), js)
+}
+
+// Usages returns the usage of every namespace (including the ones with a quota but no blobs yet), sorted by name
+func (a *Accounting) Usages() []*Usage {
+	a.Lock()
+	defer a.Unlock()
+	out := []*Usage{}
+	for ns, u := range a.usages {
+		out = append(out, &Usage{Namespace: ns, Blobs: u.Blobs, Bytes: u.Bytes, Quota: a.quotas[ns]})
+	}
+	for ns, quota := range a.quotas {
+		if _, ok := a.usages[ns]; !ok {
+			out = append(out, &Usage{Namespace: ns, Quota: quota})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Namespace < out[j].Namespace })
+	return out
+}
+
+func (a *Accounting) usageHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Namespace),
+			perms.Resource(perms.Stash, perms.Namespace),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		usages := a.Usages()
+		total := &Usage{Namespace: "total"}
+		for _, u := range usages {
+			total.Blobs += u.Blobs
+			total.Bytes += u.Bytes
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data":  usages,
+			"total": total,
+		})
+	}
+}
+
+// Register registers the HTTP handlers
+func (a *Accounting) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("", basicAuth(http.HandlerFunc(a.usageHandler())))
+}
@@ -0,0 +1,102 @@
+package usage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/testutil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestAccounting(t *testing.T) {
+	env := testutil.New(t, "usage_test")
+	defer env.Close()
+	logger, bs, kvs := env.Log, env.BlobStore, env.KvStore
+	conf := &config.Config{DataDir: env.Dir, Quotas: map[string]int64{"stash:small": 10}}
+	a, err := New(logger, conf, env.Hub)
+	check(err)
+
+	ctx := context.Background()
+	_, err = kvs.Put(ctx, "docstore:notes:1", "", []byte("hello"), -1)
+	check(err)
+	_, err = kvs.Put(ctx, "_filetree:fs:photos", "", []byte("ref"), -1)
+	check(err)
+	_, err = bs.Put(ctxutil.WithUsageNamespace(ctx, "filetree:photos"), blob.New([]byte("chunk")))
+	check(err)
+	_, err = bs.Put(ctx, blob.New([]byte("root")))
+	check(err)
+
+	// Already stored blobs are not accounted twice
+	_, err = bs.Put(ctx, blob.New([]byte("root")))
+	check(err)
+
+	// A stash namespace has its own BlobStore and hub
+	nsDir, err := ioutil.TempDir("", "usage_test_ns")
+	check(err)
+	defer os.RemoveAll(nsDir)
+	nsHub := hub.New(logger, false)
+	a.WatchNamespace("small", nsHub)
+	nsBs, err := blobstore.New(logger, false, nsDir, nil, nsHub)
+	check(err)
+	defer nsBs.Close()
+	_, err = nsBs.Put(ctx, blob.New([]byte("0123456789")))
+	check(err)
+	if _, err := nsBs.Put(ctx, blob.New([]byte("!"))); !IsQuotaExceeded(err) {
+		t.Errorf("expected a quota exceeded error, got %v", err)
+	}
+
+	// A rejected kv write does not leave a version behind
+	a.SetQuotas(map[string]int64{"stash:small": 10, "docstore:full": 1})
+	if _, err := kvs.Put(ctx, "docstore:full:1", "", []byte("hello"), -1); !IsQuotaExceeded(err) {
+		t.Errorf("expected a quota exceeded error, got %v", err)
+	}
+	if _, err := kvs.Get(ctx, "docstore:full:1", -1); err != vkv.ErrNotFound {
+		t.Errorf("the rejected version should not be stored (%v)", err)
+	}
+	a.SetQuotas(conf.Quotas)
+
+	expected := map[string]int64{
+		"docstore:notes":  1,
+		"filetree:photos": 2,
+		RootNamespace:     1,
+		"stash:small":     1,
+	}
+	check(a.Close())
+	// The counters are persisted
+	a, err = New(logger, conf, hub.New(logger, true))
+	check(err)
+	defer a.Close()
+	usages := a.Usages()
+	if len(usages) != len(expected) {
+		t.Fatalf("expected %d namespaces, got %+v", len(expected), usages)
+	}
+	for _, u := range usages {
+		if u.Blobs != expected[u.Namespace] {
+			t.Errorf("expected %d blobs for %s, got %d", expected[u.Namespace], u.Namespace, u.Blobs)
+		}
+	}
+	if usages[len(usages)-1].Bytes != 10 || usages[len(usages)-1].Quota != 10 {
+		t.Errorf("bad usage for stash:small: %+v", usages[len(usages)-1])
+	}
+
+	// The usage of a destroyed namespace is dropped
+	check(a.ResetNamespace("small"))
+	for _, u := range a.Usages() {
+		if u.Namespace == "stash:small" && u.Blobs != 0 {
+			t.Errorf("the usage of the destroyed namespace should be reset: %+v", u)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"time"
 
@@ -22,11 +23,20 @@ const (
 	FlagMetaBlob
 	FlagVersion
 	FlagKey
+	FlagVersionIndex
+	FlagDeletedVersion
 )
 
+// Set once the global version index has been built for the versions stored before it existed (sorted after all the
+// index keys, as the versions are positive)
+var versionIndexBuiltKey = []byte{FlagVersionIndex, 0xff}
+
 // KvType for meta serialization
 const KvType = "kv"
 
+// KvBatchType for the meta serialization of several versions at once
+const KvBatchType = "kv-batch"
+
 var ErrNotFound = errors.New("vkv: key not found")
 
 type KeyValue struct {
@@ -36,6 +46,9 @@ type KeyValue struct {
 	Version int64  `msgpack:"v"`
 	Hash    []byte `msgpack:"h,omitempty"`
 	Data    []byte `msgpack:"d,omitempty"`
+
+	// Tombstone is set when the version marks the deletion of the key
+	Tombstone bool `msgpack:"t,omitempty"`
 }
 
 // Implements the `MetaData` interface
@@ -65,7 +78,23 @@ func (kv *KeyValue) HexHash() string {
 	return ""
 }
 
-// KeyValueVersions holds the full history for a key value pair
+// Batch holds several versions sharing a single meta blob
+type Batch []*KeyValue
+
+// Implements the `MetaData` interface
+func (b Batch) Type() string {
+	return KvBatchType
+}
+
+// Implements the `MetaData` interface
+func (b Batch) Dump() ([]byte, error) {
+	for _, kv := range b {
+		kv.SchemaVersion = schemaVersion
+	}
+	return msgpack.Marshal([]*KeyValue(b))
+}
+
+// KeyValueVersions holds the full history for a key value pair (including the tombstones)
 type KeyValueVersions struct {
 	Key string `json:"key"`
 
@@ -119,7 +148,17 @@ func New(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &DB{rdb: rdb}, nil
+	db := &DB{rdb: rdb}
+	built, err := rdb.Has(versionIndexBuiltKey)
+	if err != nil {
+		return nil, err
+	}
+	if !built {
+		if err := db.buildVersionIndex(); err != nil {
+			return nil, fmt.Errorf("failed to build the version index: %v", err)
+		}
+	}
+	return db, nil
 }
 
 func (db *DB) Close() error { return db.rdb.Close() }
@@ -130,10 +169,31 @@ func (db *DB) Get(key string, version int64) (*KeyValue, error) {
 	if version <= 0 {
 		return db.get(key)
 	}
-	return db.getAt(key, version)
+	kv, err := db.getAt(key, version)
+	if err != nil {
+		return nil, err
+	}
+	if kv.Tombstone {
+		return nil, ErrNotFound
+	}
+	return kv, nil
 }
 
 func (db *DB) get(key string) (*KeyValue, error) {
+	res, err := db.current(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Tombstone {
+		return nil, ErrNotFound
+	}
+
+	return res, nil
+}
+
+// current returns the latest version of the key, even if it's a tombstone
+func (db *DB) current(key string) (*KeyValue, error) {
 	kvkey := append([]byte{FlagKey}, []byte(key)...)
 	data, err := db.rdb.Get(kvkey)
 	if err != nil {
@@ -151,6 +211,23 @@ func (db *DB) get(key string) (*KeyValue, error) {
 	return res, nil
 }
 
+// Delete marks the key as deleted by writing a tombstone version (the previous versions are kept until the next
+// `Compact` call).
+func (db *DB) Delete(key string, version int64) (*KeyValue, error) {
+	if _, err := db.get(key); err != nil {
+		return nil, err
+	}
+	kv := &KeyValue{
+		Key:       key,
+		Version:   version,
+		Tombstone: true,
+	}
+	if err := db.Put(kv); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
 func (db *DB) Put(kv *KeyValue) error {
 	kv.SchemaVersion = schemaVersion
 
@@ -167,24 +244,118 @@ func (db *DB) Put(kv *KeyValue) error {
 	kvkey := append([]byte{FlagKey}, []byte(kv.Key)...)
 
 	// But only if it's the latest version (or there's no previous version)
-	ckv, err := db.get(kv.Key)
+	ckv, err := db.current(kv.Key)
 	if err != nil && err != ErrNotFound {
 		return err
 	}
 
+	// Both keys are written at once
+	batch := rangedb.NewBatch()
 	if ckv == nil || kv.Version > ckv.Version {
-		if err := db.rdb.Set(kvkey, encoded); err != nil {
+		batch.Set(kvkey, encoded)
+	}
+
+	// Set the version key (for keeping track of all the versions)
+	batch.Set(buildVkey(kvkey, kv.Version), encoded)
+	batch.Set(buildVersionIndexKey([]byte(kv.Key), kv.Version), []byte{})
+
+	return db.rdb.Write(batch)
+}
+
+// PutBatch stores all the versions (and their meta blob hash) using a single write, the versions must be set.
+//
+// It's also used by the kvstore for single versions, so the version and its meta blob hash are stored atomically.
+func (db *DB) PutBatch(kvs []*KeyValue, metaBlobHash string) error {
+	h, err := hex.DecodeString(metaBlobHash)
+	if err != nil {
+		return err
+	}
+
+	batch := rangedb.NewBatch()
+	// Keep track of the latest version for the keys updated more than once within the batch
+	latest := map[string]int64{}
+	for _, kv := range kvs {
+		if kv.Version < 1 {
+			return fmt.Errorf("missing version for key %q", kv.Key)
+		}
+		kv.SchemaVersion = schemaVersion
+		encoded, err := kv.Dump()
+		if err != nil {
 			return err
 		}
+
+		kvkey := append([]byte{FlagKey}, []byte(kv.Key)...)
+		current, ok := latest[kv.Key]
+		if !ok {
+			ckv, err := db.current(kv.Key)
+			switch err {
+			case nil:
+				current = ckv.Version
+			case ErrNotFound:
+			default:
+				return err
+			}
+		}
+		if kv.Version > current {
+			batch.Set(kvkey, encoded)
+			current = kv.Version
+		}
+		latest[kv.Key] = current
+
+		batch.Set(buildVkey(kvkey, kv.Version), encoded)
+		batch.Set(buildMetaBlobKey([]byte(kv.Key), kv.Version), h)
+		batch.Set(buildVersionIndexKey([]byte(kv.Key), kv.Version), []byte{})
+		batch.Delete(buildDeletedVersionKey([]byte(kv.Key), kv.Version))
 	}
 
-	// Set the version key (for keeping track of all the versions)
-	vkey := buildVkey(kvkey, kv.Version)
-	if err := db.rdb.Set(vkey, encoded); err != nil {
+	return db.rdb.Write(batch)
+}
+
+// DeleteVersion removes a single version of the given key, if the removed version was the latest one, the previous
+// version (if any) becomes the current value.
+//
+// The deleted version is remembered (see `VersionDeleted`), so it's not restored when its meta blob is replayed.
+func (db *DB) DeleteVersion(key string, version int64) error {
+	kvkey := append([]byte{FlagKey}, []byte(key)...)
+	if _, err := db.getAt(key, version); err != nil {
 		return err
 	}
 
-	return nil
+	if err := db.rdb.Delete(buildVkey(kvkey, version)); err != nil {
+		return err
+	}
+	if err := db.rdb.Delete(buildMetaBlobKey([]byte(key), version)); err != nil {
+		return err
+	}
+	if err := db.rdb.Delete(buildVersionIndexKey([]byte(key), version)); err != nil {
+		return err
+	}
+	if err := db.rdb.Set(buildDeletedVersionKey([]byte(key), version), []byte{}); err != nil {
+		return err
+	}
+
+	ckv, err := db.current(key)
+	if err != nil {
+		return err
+	}
+	if ckv.Version != version {
+		return nil
+	}
+
+	// The latest version was removed, restore the previous one as the current value
+	versions, _, err := db.Versions(key, 0, version, 1)
+	switch err {
+	case nil:
+		encoded, err := versions.Versions[0].Dump()
+		if err != nil {
+			return err
+		}
+		return db.rdb.Set(kvkey, encoded)
+	case ErrNotFound:
+		return db.rdb.Delete(kvkey)
+	default:
+		return err
+	}
 }
 
 func buildVkey(kvkey []byte, version int64) []byte {
@@ -225,6 +396,54 @@ func buildMetaBlobKey(key []byte, version int64) []byte {
 	return vkey
 }
 
+// buildDeletedVersionKey returns the key marking a version removed with `DeleteVersion`
+func buildDeletedVersionKey(key []byte, version int64) []byte {
+	dkey := buildMetaBlobKey(key, version)
+	dkey[0] = FlagDeletedVersion
+	return dkey
+}
+
+// VersionDeleted returns true if the version has been removed with `DeleteVersion` (and not stored again since)
+func (db *DB) VersionDeleted(key string, version int64) (bool, error) {
+	return db.rdb.Has(buildDeletedVersionKey([]byte(key), version))
+}
+
+// buildVersionIndexKey returns the global version index key, sorted by version first (then by key)
+func buildVersionIndexKey(key []byte, version int64) []byte {
+	ikey := make([]byte, len(key)+9)
+	ikey[0] = FlagVersionIndex
+	binary.BigEndian.PutUint64(ikey[1:], uint64(version))
+	copy(ikey[9:], key)
+	return ikey
+}
+
+// buildVersionIndex indexes the versions stored before the global version index existed
+func (db *DB) buildVersionIndex() error {
+	c := db.rdb.PrefixRange([]byte{FlagVersion}, false)
+	defer c.Close()
+
+	batch := rangedb.NewBatch()
+	var cnt int
+	k, _, err := c.Next()
+	for ; err == nil; k, _, err = c.Next() {
+		key := k[1 : len(k)-9]
+		version := int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+		batch.Set(buildVersionIndexKey(key, version), []byte{})
+		cnt++
+		if cnt%1000 == 0 {
+			if err := db.rdb.Write(batch); err != nil {
+				return err
+			}
+			batch = rangedb.NewBatch()
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	batch.Set(versionIndexBuiltKey, []byte{1})
+	return db.rdb.Write(batch)
+}
+
 func (db *DB) SetMetaBlob(key string, version int64, hash string) error {
 	vkey := buildMetaBlobKey([]byte(key), version)
 
@@ -286,19 +505,26 @@ func (db *DB) keys(start, end string, limit int, reverse bool) ([]*KeyValue, str
 	defer c.Close()
 
 	// Iterate the range
+	var last string
 	k, v, err := c.Next()
 	for ; err == nil && (limit <= 0 || len(out) < limit); k, v, err = c.Next() {
 		res := &KeyValue{Key: string(k[1:])}
 		if err := msgpack.Unmarshal(v, res); err != nil {
 			return nil, cursor, err
 		}
+		last = res.Key
+
+		// Skip the deleted keys
+		if res.Tombstone {
+			continue
+		}
 
 		out = append(out, res)
 	}
 
-	if len(out) > 0 {
+	if last != "" {
 		// Generate next cursor
-		rcursor := out[len(out)-1].Key
+		rcursor := last
 		if reverse {
 			cursor = PrevKey(rcursor)
 		} else {
@@ -358,6 +584,103 @@ func (db *DB) Versions(key string, start, end int64, limit int) (*KeyValueVersio
 	return res, nstart, nil
 }
 
+// VersionRange returns the versions of all the keys (tombstones included) within [start, end], ordered by version,
+// i.e. what changed between start and end without scanning the history of every key (end <= 0 means no upper bound).
+//
+// The cursor is opaque, pass it back (with the same bounds) to fetch the next page.
+func (db *DB) VersionRange(start, end int64, cursor string, limit int) ([]*KeyValue, string, error) {
+	out := []*KeyValue{}
+	if end <= 0 {
+		end = math.MaxInt64
+	}
+	min := buildVersionIndexKey(nil, start)
+	if cursor != "" {
+		var err error
+		if min, err = hex.DecodeString(cursor); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %v", err)
+		}
+	}
+	c := db.rdb.Range(min, buildVersionIndexKey(nil, end), false)
+	defer c.Close()
+
+	var last []byte
+	k, _, err := c.Next()
+	for ; err == nil && (limit <= 0 || len(out) < limit); k, _, err = c.Next() {
+		key := string(k[9:])
+		kv, err := db.getAt(key, int64(binary.BigEndian.Uint64(k[1:9])))
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, kv)
+		last = k
+	}
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	if last == nil {
+		return out, "", nil
+	}
+	// The smallest index key after the last one
+	return out, hex.EncodeToString(append(last, 0)), nil
+}
+
+// Compact purges the dead versions, i.e. the tombstones and all the versions preceding them (if the key is still
+// deleted, it's removed entirely). Returns the number of purged versions.
+func (db *DB) Compact() (int, error) {
+	return db.CompactFunc(nil)
+}
+
+// CompactFunc works like `Compact`, `fn` is called with each purged version (only the key and the version are set)
+func (db *DB) CompactFunc(fn func(*KeyValue) error) (int, error) {
+	var purged int
+	var ckey string
+	// Versions seen since the last tombstone of the current key
+	pending := []int64{}
+
+	c := db.rdb.PrefixRange([]byte{FlagVersion}, false)
+	defer c.Close()
+
+	// Versions are sorted by key, then by version
+	k, v, err := c.Next()
+	for ; err == nil; k, v, err = c.Next() {
+		key := string(k[1 : len(k)-9])
+		if key != ckey {
+			ckey = key
+			pending = pending[:0]
+		}
+
+		kv := &KeyValue{Key: key}
+		if err := msgpack.Unmarshal(v, kv); err != nil {
+			return purged, err
+		}
+
+		pending = append(pending, kv.Version)
+		if !kv.Tombstone {
+			continue
+		}
+
+		// Every version up to the tombstone is dead
+		for _, version := range pending {
+			if err := db.DeleteVersion(key, version); err != nil {
+				return purged, err
+			}
+			purged++
+			if fn != nil {
+				if err := fn(&KeyValue{Key: key, Version: version}); err != nil {
+					return purged, err
+				}
+			}
+		}
+		pending = pending[:0]
+	}
+	if err != io.EOF {
+		return purged, err
+	}
+
+	return purged, nil
+}
+
 func UnserializeBlob(blob []byte) (*KeyValue, error) {
 	kv := &KeyValue{}
 	if err := msgpack.Unmarshal(blob, kv); err != nil {
@@ -365,3 +688,29 @@ func UnserializeBlob(blob []byte) (*KeyValue, error) {
 	}
 	return kv, nil
 }
+
+// UnserializeBatchBlob decodes the versions of a "kv-batch" meta blob
+func UnserializeBatchBlob(blob []byte) (Batch, error) {
+	kvs := []*KeyValue{}
+	if err := msgpack.Unmarshal(blob, &kvs); err != nil {
+		return nil, err
+	}
+	return Batch(kvs), nil
+}
+
+// UnserializeMetaBlob returns the versions contained in either a "kv" or a "kv-batch" meta blob (and nil for other
+// meta types).
+func UnserializeMetaBlob(metaType string, blob []byte) ([]*KeyValue, error) {
+	switch metaType {
+	case KvType:
+		kv, err := UnserializeBlob(blob)
+		if err != nil {
+			return nil, err
+		}
+		return []*KeyValue{kv}, nil
+	case KvBatchType:
+		return UnserializeBatchBlob(blob)
+	default:
+		return nil, nil
+	}
+}
@@ -206,3 +206,225 @@ func TestDBIter(t *testing.T) {
 		t.Errorf("bad reverse sort order")
 	}
 }
+
+func TestDBDeleteVersion(t *testing.T) {
+	db, err := New("db_base")
+	defer db.Destroy()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	for v := 1; v <= 3; v++ {
+		check(db.Put(&KeyValue{
+			Key:     "k1",
+			Data:    []byte(fmt.Sprintf("hello-%d", v)),
+			Version: int64(v),
+		}))
+	}
+
+	// Remove a version in the middle
+	check(db.DeleteVersion("k1", 2))
+	if _, err := db.Get("k1", 2); err != ErrNotFound {
+		t.Errorf("version 2 should have been removed, got err=%v", err)
+	}
+	versions, _, err := db.Versions("k1", 0, -1, -1)
+	check(err)
+	if len(versions.Versions) != 2 {
+		t.Errorf("expected 2 versions, got %d", len(versions.Versions))
+	}
+
+	// Remove the latest version, the previous one should become the current value
+	check(db.DeleteVersion("k1", 3))
+	kv, err := db.Get("k1", -1)
+	check(err)
+	if kv.Version != 1 || string(kv.Data) != "hello-1" {
+		t.Errorf("expected version 1 to be the current value, got %+v", kv)
+	}
+
+	// Remove the last version, the key should be gone
+	check(db.DeleteVersion("k1", 1))
+	if _, err := db.Get("k1", -1); err != ErrNotFound {
+		t.Errorf("key should have been removed, got err=%v", err)
+	}
+	if err := db.DeleteVersion("k1", 1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDBDeleteAndCompact(t *testing.T) {
+	db, err := New("db_base")
+	defer db.Destroy()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	for i, k := range []string{"k1", "k2", "k3"} {
+		for v := 1; v <= 3; v++ {
+			check(db.Put(&KeyValue{
+				Key:     k,
+				Data:    []byte(fmt.Sprintf("hello-%d-%d", i, v)),
+				Version: int64(v),
+			}))
+		}
+	}
+
+	// Delete k2 for good, and delete then re-create k3
+	_, err = db.Delete("k2", 4)
+	check(err)
+	_, err = db.Delete("k3", 4)
+	check(err)
+	check(db.Put(&KeyValue{Key: "k3", Data: []byte("back"), Version: 5}))
+
+	if _, err := db.Get("k2", -1); err != ErrNotFound {
+		t.Errorf("k2 should be deleted, got err=%v", err)
+	}
+	if _, err := db.Get("k2", 4); err != ErrNotFound {
+		t.Errorf("the k2 tombstone should not be returned, got err=%v", err)
+	}
+	if _, err := db.Delete("k2", -1); err != ErrNotFound {
+		t.Errorf("deleting a deleted key should fail, got err=%v", err)
+	}
+	kv, err := db.Get("k2", 3)
+	check(err)
+	if string(kv.Data) != "hello-1-3" {
+		t.Errorf("old versions should still be available before compaction, got %+v", kv)
+	}
+
+	keys, _, err := db.Keys("", "\xff", -1)
+	check(err)
+	if len(keys) != 2 || keys[0].Key != "k1" || keys[1].Key != "k3" {
+		t.Errorf("deleted keys should be skipped, got %+v", keys)
+	}
+
+	// Compact and check the dead versions are gone
+	purged, err := db.Compact()
+	check(err)
+	if purged != 8 {
+		t.Errorf("expected 8 purged versions, got %d", purged)
+	}
+	if _, _, err := db.Versions("k2", 0, -1, -1); err != ErrNotFound {
+		t.Errorf("k2 versions should be purged, got err=%v", err)
+	}
+	versions, _, err := db.Versions("k3", 0, -1, -1)
+	check(err)
+	if len(versions.Versions) != 1 || string(versions.Versions[0].Data) != "back" {
+		t.Errorf("k3 should only have its last version, got %+v", versions)
+	}
+	versions, _, err = db.Versions("k1", 0, -1, -1)
+	check(err)
+	if len(versions.Versions) != 3 {
+		t.Errorf("k1 should be left untouched, got %+v", versions)
+	}
+}
+
+func TestDBPutBatch(t *testing.T) {
+	db, err := New("db_put_batch")
+	defer db.Destroy()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+
+	check(db.Put(&KeyValue{Key: "k1", Data: []byte("old"), Version: 20}))
+
+	batch := []*KeyValue{
+		&KeyValue{Key: "k1", Data: []byte("older"), Version: 10},
+		&KeyValue{Key: "k2", Data: []byte("a"), Version: 10},
+		&KeyValue{Key: "k2", Data: []byte("b"), Version: 11},
+	}
+	check(db.PutBatch(batch, "deadbeef"))
+
+	// An older version does not replace the current one
+	kv, err := db.Get("k1", -1)
+	check(err)
+	if string(kv.Data) != "old" {
+		t.Errorf("expected k1=old, got %s", kv.Data)
+	}
+	kv, err = db.Get("k2", -1)
+	check(err)
+	if string(kv.Data) != "b" {
+		t.Errorf("expected k2=b, got %s", kv.Data)
+	}
+
+	for _, kv := range batch {
+		h, err := db.GetMetaBlob(kv.Key, kv.Version)
+		check(err)
+		if h != "deadbeef" {
+			t.Errorf("bad meta blob hash for %s@%d: %q", kv.Key, kv.Version, h)
+		}
+		if _, err := db.Get(kv.Key, kv.Version); err != nil {
+			t.Errorf("failed to get %s@%d: %v", kv.Key, kv.Version, err)
+		}
+	}
+
+	if err := db.PutBatch([]*KeyValue{&KeyValue{Key: "k3"}}, "deadbeef"); err == nil {
+		t.Errorf("a batch without versions should fail")
+	}
+}
+
+func TestDBVersionRange(t *testing.T) {
+	db, err := New("db_version_range")
+	check(err)
+	defer db.Destroy()
+
+	for _, kv := range []*KeyValue{
+		{Key: "k1", Data: []byte("a"), Version: 10},
+		{Key: "k2", Data: []byte("b"), Version: 20},
+		{Key: "k1", Data: []byte("c"), Version: 30},
+		{Key: "k3", Data: []byte("d"), Version: 30},
+		{Key: "k3", Data: []byte("e"), Version: 40},
+	} {
+		check(db.Put(kv))
+	}
+	_, err = db.Delete("k2", 50)
+	check(err)
+
+	summary := func(kvs []*KeyValue) string {
+		var out string
+		for _, kv := range kvs {
+			out += fmt.Sprintf("%s@%d ", kv.Key, kv.Version)
+		}
+		return out
+	}
+
+	kvs, _, err := db.VersionRange(20, 40, "", -1)
+	check(err)
+	if s := summary(kvs); s != "k2@20 k1@30 k3@30 k3@40 " {
+		t.Errorf("unexpected range %q", s)
+	}
+
+	// Paginate the whole range, the tombstones are returned too
+	var all []*KeyValue
+	var cursor string
+	for {
+		kvs, cursor, err = db.VersionRange(0, -1, cursor, 2)
+		check(err)
+		all = append(all, kvs...)
+		if len(kvs) < 2 {
+			break
+		}
+	}
+	if s := summary(all); s != "k1@10 k2@20 k1@30 k3@30 k3@40 k2@50 " {
+		t.Errorf("unexpected range %q", s)
+	}
+	if !all[len(all)-1].Tombstone {
+		t.Errorf("the deletion should be returned as a tombstone")
+	}
+
+	// The deleted versions are removed from the index
+	check(db.DeleteVersion("k3", 30))
+	kvs, _, err = db.VersionRange(30, 30, "", -1)
+	check(err)
+	if s := summary(kvs); s != "k1@30 " {
+		t.Errorf("unexpected range %q", s)
+	}
+
+	// The index is rebuilt for the versions stored before it existed
+	check(db.rdb.Delete(versionIndexBuiltKey))
+	check(db.rdb.Delete(buildVersionIndexKey([]byte("k1"), 10)))
+	check(db.Close())
+	db, err = New("db_version_range")
+	check(err)
+	kvs, _, err = db.VersionRange(0, 10, "", -1)
+	check(err)
+	if s := summary(kvs); s != "k1@10 " {
+		t.Errorf("the index should be rebuilt, got %q", s)
+	}
+}